@@ -22,7 +22,8 @@ import (
 )
 
 var (
-	disable = flag.Bool("disable_buildbuddy", false, "If true, disable buildbuddy functionality and just run bazel.")
+	disable       = flag.Bool("disable_buildbuddy", false, "If true, disable buildbuddy functionality and just run bazel.")
+	tailExecution = flag.String("tail_execution", "", "If set, streams the output of the remote execution with this ID until it completes, instead of running bazel.")
 )
 
 func die(exitCode int, err error) {
@@ -117,6 +118,10 @@ func main() {
 	if err != nil {
 		die(-1, err)
 	}
+	if *tailExecution != "" {
+		err := remotebazel.TailExecutionLog(ctx, bazelOpts.BuildBuddyEndpoint, bazelOpts.APIKey, *tailExecution)
+		die(0, err)
+	}
 	opts := parseBazelRCs(bazelFlags)
 
 	// Determine if cache or BES options are set.
@@ -30,6 +30,7 @@ import (
 	bespb "github.com/buildbuddy-io/buildbuddy/proto/build_event_stream"
 	bbspb "github.com/buildbuddy-io/buildbuddy/proto/buildbuddy_service"
 	elpb "github.com/buildbuddy-io/buildbuddy/proto/eventlog"
+	espb "github.com/buildbuddy-io/buildbuddy/proto/execution_stats"
 	inpb "github.com/buildbuddy-io/buildbuddy/proto/invocation"
 	rnpb "github.com/buildbuddy-io/buildbuddy/proto/runner"
 	bspb "google.golang.org/genproto/googleapis/bytestream"
@@ -339,6 +340,49 @@ func streamLogs(ctx context.Context, bbClient bbspb.BuildBuddyServiceClient, inv
 	return nil
 }
 
+// TailExecutionLog writes the output of the remote execution with the given
+// ID to stdout as it is written, until the execution completes.
+func TailExecutionLog(ctx context.Context, server, apiKey, executionID string) error {
+	conn, err := grpc_client.DialTarget(server)
+	if err != nil {
+		return status.UnavailableErrorf("could not connect to BuildBuddy service %q: %s", server, err)
+	}
+	bbClient := bbspb.NewBuildBuddyServiceClient(conn)
+	ctx = metadata.AppendToOutgoingContext(ctx, "x-buildbuddy-api-key", apiKey)
+
+	chunkID := ""
+	// The number of bytes of the current chunk that have been written. Live
+	// chunks are returned again as they grow, so only the new part is written.
+	written := 0
+	for {
+		rsp, err := bbClient.GetExecutionLog(ctx, &espb.GetExecutionLogRequest{
+			ExecutionId: executionID,
+			ChunkId:     chunkID,
+		})
+		if err != nil {
+			return status.UnknownErrorf("error streaming execution log: %s", err)
+		}
+		buf := rsp.GetBuffer()
+		if len(buf) > written {
+			_, _ = os.Stdout.Write(buf[written:])
+		}
+		if rsp.GetNextChunkId() == "" {
+			return nil
+		}
+		if rsp.GetLive() || len(buf) == 0 {
+			// The chunk is still being written, so request it again once
+			// more output may have been written to it.
+			if len(buf) > written {
+				written = len(buf)
+			}
+			time.Sleep(1 * time.Second)
+		} else {
+			written = 0
+		}
+		chunkID = rsp.GetNextChunkId()
+	}
+}
+
 func downloadOutput(ctx context.Context, bsClient bspb.ByteStreamClient, resourceName string, outFile string) error {
 	if err := os.MkdirAll(filepath.Dir(outFile), 0755); err != nil {
 		return err
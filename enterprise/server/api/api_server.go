@@ -6,7 +6,9 @@ import (
 	"fmt"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/buildbuddy-io/buildbuddy/proto/build_event_stream"
 	"github.com/buildbuddy-io/buildbuddy/proto/invocation"
@@ -18,6 +20,7 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
 	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/digest"
 	"github.com/buildbuddy-io/buildbuddy/server/tables"
+	"github.com/buildbuddy-io/buildbuddy/server/util/db"
 	"github.com/buildbuddy-io/buildbuddy/server/util/perms"
 	"github.com/buildbuddy-io/buildbuddy/server/util/query_builder"
 	"github.com/buildbuddy-io/buildbuddy/server/util/status"
@@ -35,6 +38,19 @@ import (
 // prefix and support this old ID scheme for some period of time during the migration.
 const encodedIDPrefix = "id::v1::"
 
+const (
+	// The maximum number of test cases returned by a single GetTestCase call.
+	testCasePageSize = 100
+
+	// The number of test cases returned by GetSlowestTestCases if no limit is
+	// specified, and the maximum number that may be requested.
+	defaultSlowestTestCasesLimit = 25
+	maxSlowestTestCasesLimit     = 1000
+
+	// How far back GetSlowestTestCases looks if no start time is specified.
+	defaultSlowestTestCasesWindow = 7 * 24 * time.Hour
+)
+
 type APIServer struct {
 	env environment.Env
 }
@@ -106,6 +122,9 @@ func (s *APIServer) GetInvocation(ctx context.Context, req *apipb.GetInvocationR
 			CommitSha:     ti.CommitSHA,
 			Role:          ti.Role,
 		}
+		if fs := build_event_handler.TableInvocationToProto(&ti).GetFailureSummary(); fs != nil {
+			apiInvocation.FailureSummary = failureSummaryToAPIProto(fs)
+		}
 
 		invocations = append(invocations, apiInvocation)
 	}
@@ -144,6 +163,184 @@ func (s *APIServer) GetTarget(ctx context.Context, req *apipb.GetTargetRequest)
 	}, nil
 }
 
+func (s *APIServer) GetTestCase(ctx context.Context, req *apipb.GetTestCaseRequest) (*apipb.GetTestCaseResponse, error) {
+	user, err := s.checkPreconditions(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	selector := req.GetSelector()
+	if selector.GetInvocationId() == "" && selector.GetLabel() == "" {
+		return nil, status.InvalidArgumentErrorf("TestCaseSelector must contain a valid invocation_id or label")
+	}
+	offset := int64(0)
+	if req.GetPageToken() != "" {
+		offset, err = strconv.ParseInt(req.GetPageToken(), 10, 64)
+		if err != nil || offset < 0 {
+			return nil, status.InvalidArgumentErrorf("Invalid page_token %q", req.GetPageToken())
+		}
+	}
+
+	q := query_builder.NewQuery(`SELECT t.label, tc.class_name, tc.name, tc.status, tc.duration_usec,
+		tc.failure_message, i.invocation_id, i.commit_sha, i.created_at_usec
+		FROM TestCaseStatuses AS tc
+		JOIN Targets AS t ON tc.target_id = t.target_id
+		JOIN Invocations AS i ON tc.invocation_uuid = i.invocation_uuid`)
+	q.AddWhereClause("i.group_id = ?", user.GetGroupID())
+	q.AddWhereClause("t.group_id = ?", user.GetGroupID())
+	if err := perms.AddPermissionsCheckToQueryWithTableAlias(ctx, s.env, q, "i"); err != nil {
+		return nil, err
+	}
+	if selector.GetInvocationId() != "" {
+		q.AddWhereClause("i.invocation_id = ?", selector.GetInvocationId())
+	}
+	if selector.GetLabel() != "" {
+		q.AddWhereClause("t.label = ?", selector.GetLabel())
+	}
+	if selector.GetClassName() != "" {
+		q.AddWhereClause("tc.class_name = ?", selector.GetClassName())
+	}
+	if selector.GetName() != "" {
+		q.AddWhereClause("tc.name = ?", selector.GetName())
+	}
+	q.SetOrderBy("i.created_at_usec DESC, t.label ASC, tc.class_name ASC, tc.name", true /*=ascending*/)
+	q.SetLimit(testCasePageSize)
+	q.SetOffset(offset)
+	queryStr, args := q.Build()
+
+	testCases := []*apipb.TestCase{}
+	err = s.env.GetDBHandle().Transaction(ctx, func(tx *db.DB) error {
+		rows, err := tx.Raw(queryStr, args...).Rows()
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			row := struct {
+				Label          string
+				ClassName      string
+				Name           string
+				Status         int32
+				DurationUsec   int64
+				FailureMessage string
+				InvocationID   string
+				CommitSHA      string
+				CreatedAtUsec  int64
+			}{}
+			if err := tx.ScanRows(rows, &row); err != nil {
+				return err
+			}
+			testCases = append(testCases, &apipb.TestCase{
+				Id: &apipb.TestCase_Id{
+					InvocationId: row.InvocationID,
+					TargetId:     encodeID(row.Label),
+					TestCaseId:   encodeID(row.ClassName + "#" + row.Name),
+				},
+				Label:                   row.Label,
+				ClassName:               row.ClassName,
+				Name:                    row.Name,
+				Status:                  cmnpb.Status(row.Status),
+				Duration:                durationpb.New(time.Duration(row.DurationUsec) * time.Microsecond),
+				FailureMessage:          row.FailureMessage,
+				CommitSha:               row.CommitSHA,
+				InvocationCreatedAtUsec: row.CreatedAtUsec,
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	rsp := &apipb.GetTestCaseResponse{
+		TestCase: testCases,
+	}
+	if len(testCases) == testCasePageSize {
+		rsp.NextPageToken = strconv.FormatInt(offset+testCasePageSize, 10)
+	}
+	return rsp, nil
+}
+
+func (s *APIServer) GetSlowestTestCases(ctx context.Context, req *apipb.GetSlowestTestCasesRequest) (*apipb.GetSlowestTestCasesResponse, error) {
+	user, err := s.checkPreconditions(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	limit := int64(req.GetLimit())
+	if limit <= 0 {
+		limit = defaultSlowestTestCasesLimit
+	}
+	if limit > maxSlowestTestCasesLimit {
+		return nil, status.InvalidArgumentErrorf("limit must be at most %d", maxSlowestTestCasesLimit)
+	}
+	startUsec := req.GetStartTimeUsec()
+	if startUsec == 0 {
+		startUsec = time.Now().Add(-defaultSlowestTestCasesWindow).UnixMicro()
+	}
+
+	q := query_builder.NewQuery(`SELECT t.label, tc.class_name, tc.name, COUNT(*) AS run_count,
+		AVG(tc.duration_usec) AS avg_duration_usec, MAX(tc.duration_usec) AS max_duration_usec
+		FROM TestCaseStatuses AS tc
+		JOIN Targets AS t ON tc.target_id = t.target_id
+		JOIN Invocations AS i ON tc.invocation_uuid = i.invocation_uuid`)
+	q.AddWhereClause("i.group_id = ?", user.GetGroupID())
+	q.AddWhereClause("t.group_id = ?", user.GetGroupID())
+	if err := perms.AddPermissionsCheckToQueryWithTableAlias(ctx, s.env, q, "i"); err != nil {
+		return nil, err
+	}
+	q.AddWhereClause("i.created_at_usec >= ?", startUsec)
+	// Skipped test cases don't take any meaningful time to run.
+	q.AddWhereClause("tc.status != ?", int32(cmnpb.Status_SKIPPED))
+	if req.GetLabel() != "" {
+		q.AddWhereClause("t.label = ?", req.GetLabel())
+	}
+	if req.GetRepoUrl() != "" {
+		q.AddWhereClause("i.repo_url = ?", req.GetRepoUrl())
+	}
+	q.SetGroupBy("t.label, tc.class_name, tc.name")
+	q.SetOrderBy("avg_duration_usec", false /*=ascending*/)
+	q.SetLimit(limit)
+	queryStr, args := q.Build()
+
+	stats := []*apipb.TestCaseStats{}
+	err = s.env.GetDBHandle().Transaction(ctx, func(tx *db.DB) error {
+		rows, err := tx.Raw(queryStr, args...).Rows()
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			row := struct {
+				Label           string
+				ClassName       string
+				Name            string
+				RunCount        int64
+				AvgDurationUsec float64
+				MaxDurationUsec int64
+			}{}
+			if err := tx.ScanRows(rows, &row); err != nil {
+				return err
+			}
+			stats = append(stats, &apipb.TestCaseStats{
+				Label:           row.Label,
+				ClassName:       row.ClassName,
+				Name:            row.Name,
+				RunCount:        row.RunCount,
+				AverageDuration: durationpb.New(time.Duration(row.AvgDurationUsec) * time.Microsecond),
+				MaxDuration:     durationpb.New(time.Duration(row.MaxDurationUsec) * time.Microsecond),
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &apipb.GetSlowestTestCasesResponse{
+		TestCaseStats: stats,
+	}, nil
+}
+
 func (s *APIServer) GetAction(ctx context.Context, req *apipb.GetActionRequest) (*apipb.GetActionResponse, error) {
 	if _, err := s.checkPreconditions(ctx); err != nil {
 		return nil, err
@@ -276,6 +473,37 @@ func testStatusToStatus(testStatus build_event_stream.TestStatus) cmnpb.Status {
 	}
 }
 
+func failureSummaryToAPIProto(fs *invocation.FailureSummary) *apipb.FailureSummary {
+	out := &apipb.FailureSummary{}
+	for _, a := range fs.GetFailedAction() {
+		out.FailedAction = append(out.FailedAction, &apipb.FailureSummary_FailedAction{
+			Label:          a.GetLabel(),
+			Mnemonic:       a.GetMnemonic(),
+			ExitCode:       a.GetExitCode(),
+			FailureMessage: a.GetFailureMessage(),
+			StderrTail:     a.GetStderrTail(),
+		})
+	}
+	for _, t := range fs.GetFailedTest() {
+		out.FailedTest = append(out.FailedTest, &apipb.FailureSummary_FailedTest{
+			Label:   t.GetLabel(),
+			Status:  t.GetStatus().String(),
+			Run:     t.GetRun(),
+			Shard:   t.GetShard(),
+			Attempt: t.GetAttempt(),
+			LogTail: t.GetLogTail(),
+		})
+	}
+	for _, e := range fs.GetError() {
+		out.Error = append(out.Error, &apipb.FailureSummary_Error{
+			Label:   e.GetLabel(),
+			Reason:  e.GetReason().String(),
+			Message: e.GetMessage(),
+		})
+	}
+	return out
+}
+
 func targetMapFromInvocation(inv *invocation.Invocation) map[string]*apipb.Target {
 	targetMap := make(map[string]*apipb.Target)
 	for _, event := range inv.GetEvent() {
@@ -14,6 +14,7 @@ import (
 	"github.com/stretchr/testify/require"
 
 	apipb "github.com/buildbuddy-io/buildbuddy/proto/api/v1"
+	cmnpb "github.com/buildbuddy-io/buildbuddy/proto/api/v1/common"
 	bepb "github.com/buildbuddy-io/buildbuddy/proto/build_events"
 	pepb "github.com/buildbuddy-io/buildbuddy/proto/publish_build_event"
 	anypb "github.com/golang/protobuf/ptypes/any"
@@ -63,6 +64,34 @@ func TestGetInvocationAuth(t *testing.T) {
 	require.Nil(t, resp)
 }
 
+func TestGetInvocationFailureSummary(t *testing.T) {
+	testUUID, err := uuid.NewRandom()
+	require.NoError(t, err)
+	testInvocationID := testUUID.String()
+	env, ctx := getEnvAndCtx(t, "user1")
+	handler := build_event_handler.NewBuildEventHandler(env)
+	channel := handler.OpenChannel(context.Background(), testInvocationID)
+	err = channel.HandleEvent(streamRequest(startedEvent("--remote_header='"+testauth.APIKeyHeader+"=user1'"), testInvocationID, 1))
+	require.NoError(t, err)
+	err = channel.HandleEvent(streamRequest(failedActionEvent("//my/target:foo", "CppCompile"), testInvocationID, 2))
+	require.NoError(t, err)
+	err = channel.HandleEvent(streamRequest(failedFinishedEvent(), testInvocationID, 3))
+	require.NoError(t, err)
+	err = channel.FinalizeInvocation(testInvocationID)
+	require.NoError(t, err)
+
+	s := NewAPIServer(env)
+	resp, err := s.GetInvocation(ctx, &apipb.GetInvocationRequest{Selector: &apipb.InvocationSelector{InvocationId: testInvocationID}})
+	require.NoError(t, err)
+	require.Equal(t, 1, len(resp.Invocation))
+	assert.False(t, resp.Invocation[0].GetSuccess())
+	failedActions := resp.Invocation[0].GetFailureSummary().GetFailedAction()
+	require.Equal(t, 1, len(failedActions))
+	assert.Equal(t, "//my/target:foo", failedActions[0].GetLabel())
+	assert.Equal(t, "CppCompile", failedActions[0].GetMnemonic())
+	assert.Equal(t, int32(1), failedActions[0].GetExitCode())
+}
+
 func TestGetTarget(t *testing.T) {
 	testUUID, err := uuid.NewRandom()
 	require.NoError(t, err)
@@ -195,6 +224,92 @@ func TestGetLogAuth(t *testing.T) {
 	require.Nil(t, resp)
 }
 
+func TestGetTestCase(t *testing.T) {
+	testUUID, err := uuid.NewRandom()
+	require.NoError(t, err)
+	testInvocationID := testUUID.String()
+
+	env, ctx := getEnvAndCtx(t, "user1")
+	streamBuild(t, env, testInvocationID)
+	insertTestCases(t, env, testInvocationID, "//my/test:foo", map[string]int64{
+		"testFast": 1000,
+		"testSlow": 5000000,
+	})
+	s := NewAPIServer(env)
+
+	resp, err := s.GetTestCase(ctx, &apipb.GetTestCaseRequest{Selector: &apipb.TestCaseSelector{InvocationId: testInvocationID}})
+	require.NoError(t, err)
+	require.Equal(t, 2, len(resp.TestCase))
+	assert.Equal(t, "//my/test:foo", resp.TestCase[0].Label)
+	assert.Equal(t, "testFast", resp.TestCase[0].Name)
+	assert.Equal(t, cmnpb.Status_PASSED, resp.TestCase[0].Status)
+
+	resp, err = s.GetTestCase(ctx, &apipb.GetTestCaseRequest{Selector: &apipb.TestCaseSelector{Label: "//my/test:foo", Name: "testSlow"}})
+	require.NoError(t, err)
+	require.Equal(t, 1, len(resp.TestCase))
+	assert.Equal(t, testInvocationID, resp.TestCase[0].GetId().GetInvocationId())
+	assert.Equal(t, int64(5), resp.TestCase[0].GetDuration().GetSeconds())
+
+	_, err = s.GetTestCase(ctx, &apipb.GetTestCaseRequest{Selector: &apipb.TestCaseSelector{}})
+	require.Error(t, err)
+}
+
+func TestGetSlowestTestCases(t *testing.T) {
+	testUUID, err := uuid.NewRandom()
+	require.NoError(t, err)
+	testInvocationID := testUUID.String()
+
+	env, ctx := getEnvAndCtx(t, "user1")
+	streamBuild(t, env, testInvocationID)
+	insertTestCases(t, env, testInvocationID, "//my/test:foo", map[string]int64{
+		"testFast": 1000,
+		"testSlow": 5000000,
+	})
+	s := NewAPIServer(env)
+
+	resp, err := s.GetSlowestTestCases(ctx, &apipb.GetSlowestTestCasesRequest{Limit: 1})
+	require.NoError(t, err)
+	require.Equal(t, 1, len(resp.TestCaseStats))
+	assert.Equal(t, "testSlow", resp.TestCaseStats[0].Name)
+	assert.Equal(t, int64(1), resp.TestCaseStats[0].RunCount)
+}
+
+func TestGetTestCaseAuth(t *testing.T) {
+	env, ctx := getEnvAndCtx(t, "")
+	s := NewAPIServer(env)
+	resp, err := s.GetTestCase(ctx, &apipb.GetTestCaseRequest{Selector: &apipb.TestCaseSelector{Label: "//my/test:foo"}})
+	require.Error(t, err)
+	require.Nil(t, resp)
+}
+
+func insertTestCases(t *testing.T, te *testenv.TestEnv, iid, label string, durationsUsec map[string]int64) {
+	ctx := context.Background()
+	invocationUUID, err := uuid.Parse(iid)
+	require.NoError(t, err)
+	targetID := int64(len(label))
+	err = te.GetDBHandle().DB(ctx).Create(&tables.Target{
+		TargetID: targetID,
+		GroupID:  "group1",
+		Label:    label,
+		RuleType: "go_test rule",
+	}).Error
+	require.NoError(t, err)
+	i := int64(0)
+	for name, durationUsec := range durationsUsec {
+		i++
+		err := te.GetDBHandle().DB(ctx).Create(&tables.TestCaseStatus{
+			TargetID:       targetID,
+			InvocationUUID: invocationUUID[:],
+			TestCaseID:     i,
+			ClassName:      "FooTest",
+			Name:           name,
+			Status:         int32(cmnpb.Status_PASSED),
+			DurationUsec:   durationUsec,
+		}).Error
+		require.NoError(t, err)
+	}
+}
+
 func getEnvAndCtx(t *testing.T, user string) (*testenv.TestEnv, context.Context) {
 	te := testenv.GetTestEnv(t)
 	ta := testauth.NewTestAuthenticator(userMap)
@@ -342,3 +457,39 @@ func finishedEvent() *anypb.Any {
 	})
 	return finishedAny
 }
+
+func failedActionEvent(label, mnemonic string) *anypb.Any {
+	actionAny := &anypb.Any{}
+	actionAny.MarshalFrom(&build_event_stream.BuildEvent{
+		Id: &build_event_stream.BuildEventId{
+			Id: &build_event_stream.BuildEventId_ActionCompleted{
+				ActionCompleted: &build_event_stream.BuildEventId_ActionCompletedId{
+					Label: label,
+				},
+			},
+		},
+		Payload: &build_event_stream.BuildEvent_Action{
+			Action: &build_event_stream.ActionExecuted{
+				Success:  false,
+				Type:     mnemonic,
+				ExitCode: 1,
+			},
+		},
+	})
+	return actionAny
+}
+
+func failedFinishedEvent() *anypb.Any {
+	finishedAny := &anypb.Any{}
+	finishedAny.MarshalFrom(&build_event_stream.BuildEvent{
+		Payload: &build_event_stream.BuildEvent_Finished{
+			Finished: &build_event_stream.BuildFinished{
+				ExitCode: &build_event_stream.BuildFinished_ExitCode{
+					Name: "BUILD_FAILURE",
+					Code: 1,
+				},
+			},
+		},
+	})
+	return finishedAny
+}
@@ -16,6 +16,7 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/backends/redis_cache"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/backends/s3_cache"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/composable_cache"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/containers/sandbox"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/filecache"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/runner"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/scheduling/priority_task_scheduler"
@@ -228,6 +229,10 @@ func bufDialer(context.Context, string) (net.Conn, error) {
 }
 
 func main() {
+	// When the executor is re-executed to set up a sandbox, this runs the
+	// sandboxed command and exits.
+	sandbox.Init()
+
 	// The default umask (0022) has the effect of clearing the group-write and
 	// others-write bits when setting up workspace directories, regardless of the
 	// permissions bits passed to mkdir. We want to create these directories with
@@ -45,6 +45,7 @@ var (
 	logLevel        = flag.String("log_level", "info", "The loglevel to emit logs at")
 	setDefaultRoute = flag.Bool("set_default_route", false, "If true, will set the default eth0 route to 192.168.246.1")
 	initDockerd     = flag.Bool("init_dockerd", false, "If true, init dockerd before accepting exec requests. Requires docker to be installed.")
+	enableLoopback  = flag.Bool("enable_loopback", false, "If true, bring up the loopback interface. It is already up if networking is configured by the kernel.")
 )
 
 // die logs the provided error if it is not nil and then terminates the program.
@@ -117,6 +118,21 @@ func configureDefaultRoute(ifaceName, ipAddr string) error {
 	return nlConn.Close()
 }
 
+func bringUpLoopback() error {
+	iface, err := net.InterfaceByName("lo")
+	if err != nil {
+		return err
+	}
+	nlConn, err := rtnl.Dial(nil)
+	if err != nil {
+		return err
+	}
+	if err := nlConn.LinkUp(iface); err != nil {
+		return err
+	}
+	return nlConn.Close()
+}
+
 func copyFile(src, dest string, mode os.FileMode) error {
 	out, err := os.OpenFile(dest, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode)
 	if err != nil {
@@ -315,6 +331,9 @@ func main() {
 	if *setDefaultRoute {
 		die(configureDefaultRoute("eth0", "192.168.241.1"))
 	}
+	if *enableLoopback {
+		die(bringUpLoopback())
+	}
 
 	reapMutex := sync.RWMutex{}
 	go reapChildren(rootContext, &reapMutex)
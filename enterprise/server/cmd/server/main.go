@@ -31,6 +31,7 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/scheduling/task_router"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/selfauth"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/splash"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/tasksize"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/usage"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/usage_service"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/util/redisutil"
@@ -246,6 +247,11 @@ func main() {
 			log.Fatalf("Failed to create server: %s", err)
 		}
 		realEnv.SetTaskRouter(taskRouter)
+
+		// Measured task sizes are also stored in the remote execution redis.
+		if err := tasksize.Register(realEnv); err != nil {
+			log.Fatalf("Failed to create server: %s", err)
+		}
 	}
 
 	if rbeConfig := configurator.GetRemoteExecutionConfig(); rbeConfig != nil {
@@ -363,6 +369,9 @@ func main() {
 
 	executionService := execution_service.NewExecutionService(realEnv)
 	realEnv.SetExecutionService(executionService)
+	executionService.Start()
+	defer executionService.Stop()
+	realEnv.GetMux().Handle("/execution/repro", httpfilters.WrapAuthenticatedExternalHandler(realEnv, executionService))
 
 	telemetryServer := telserver.NewTelemetryServer(realEnv, realEnv.GetDBHandle())
 	telemetryServer.StartOrDieIfEnabled()
@@ -6,8 +6,11 @@ import (
 	"time"
 
 	"github.com/buildbuddy-io/buildbuddy/server/environment"
+	"github.com/buildbuddy-io/buildbuddy/server/eventlog"
 	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/digest"
 	"github.com/buildbuddy-io/buildbuddy/server/tables"
+	"github.com/buildbuddy-io/buildbuddy/server/util/db"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
 	"github.com/buildbuddy-io/buildbuddy/server/util/perms"
 	"github.com/buildbuddy-io/buildbuddy/server/util/query_builder"
 	"github.com/buildbuddy-io/buildbuddy/server/util/status"
@@ -21,14 +24,61 @@ import (
 	statuspb "google.golang.org/genproto/googleapis/rpc/status"
 )
 
+var (
+	// How often failed executions older than
+	// remote_execution.failed_execution_ttl_days are deleted.
+	failedExecutionCleanupInterval = time.Hour
+)
+
 type ExecutionService struct {
 	env environment.Env
+
+	failedExecutionTTL time.Duration
+	quit               chan struct{}
 }
 
 func NewExecutionService(env environment.Env) *ExecutionService {
-	return &ExecutionService{
+	es := &ExecutionService{
 		env: env,
 	}
+	if rec := env.GetConfigurator().GetRemoteExecutionConfig(); rec != nil {
+		es.failedExecutionTTL = time.Duration(rec.FailedExecutionTTLDays) * 24 * time.Hour
+	}
+	return es
+}
+
+// Start periodically deletes expired failed executions, if failed executions
+// are recorded.
+func (es *ExecutionService) Start() {
+	es.quit = make(chan struct{})
+	if es.failedExecutionTTL == 0 || es.env.GetDBHandle() == nil {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(failedExecutionCleanupInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				ctx := es.env.GetServerContext()
+				if err := es.deleteFailedExecutionsBefore(ctx, time.Now().Add(-es.failedExecutionTTL)); err != nil {
+					log.Warningf("Error deleting expired failed executions: %s", err)
+				}
+			case <-es.quit:
+				return
+			}
+		}
+	}()
+}
+
+func (es *ExecutionService) Stop() {
+	close(es.quit)
+}
+
+func (es *ExecutionService) deleteFailedExecutionsBefore(ctx context.Context, cutoff time.Time) error {
+	return es.env.GetDBHandle().TransactionWithOptions(ctx, db.Opts().WithQueryName("delete_expired_failed_executions"), func(tx *db.DB) error {
+		return tx.Where("created_at_usec < ?", cutoff.UnixMicro()).Delete(&tables.FailedExecution{}).Error
+	})
 }
 
 func checkPreconditions(req *espb.GetExecutionRequest) error {
@@ -147,3 +197,123 @@ func (es *ExecutionService) GetExecution(ctx context.Context, req *espb.GetExecu
 	}
 	return rsp, nil
 }
+
+func (es *ExecutionService) getFailedExecutions(ctx context.Context, invocationID, executionID string) ([]*tables.FailedExecution, error) {
+	dbh := es.env.GetDBHandle()
+	q := query_builder.NewQuery(`SELECT * FROM FailedExecutions as fe`)
+	if invocationID != "" {
+		q = q.AddWhereClause(`fe.invocation_id = ?`, invocationID)
+	}
+	if executionID != "" {
+		q = q.AddWhereClause(`fe.execution_id = ?`, executionID)
+	}
+	if err := perms.AddPermissionsCheckToQueryWithTableAlias(ctx, es.env, q, "fe"); err != nil {
+		return nil, err
+	}
+	q = q.SetOrderBy("fe.created_at_usec", true /*ascending*/)
+	queryStr, args := q.Build()
+	rows, err := dbh.DB(ctx).Raw(queryStr, args...).Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	failedExecutions := make([]*tables.FailedExecution, 0)
+	for rows.Next() {
+		fe := &tables.FailedExecution{}
+		if err := dbh.DB(ctx).ScanRows(rows, fe); err != nil {
+			return nil, err
+		}
+		failedExecutions = append(failedExecutions, fe)
+	}
+	return failedExecutions, nil
+}
+
+func tableFailedExecToProto(in *tables.FailedExecution) (*espb.FailedExecution, error) {
+	r, err := digest.ParseUploadResourceName(in.ExecutionID)
+	if err != nil {
+		return nil, err
+	}
+	commandDigest, err := digest.Parse(in.CommandDigest)
+	if err != nil {
+		return nil, err
+	}
+	inputRootDigest, err := digest.Parse(in.InputRootDigest)
+	if err != nil {
+		return nil, err
+	}
+	executeResponse := &repb.ExecuteResponse{}
+	if err := proto.Unmarshal(in.SerializedExecuteResponse, executeResponse); err != nil {
+		return nil, err
+	}
+	return &espb.FailedExecution{
+		ExecutionId:     in.ExecutionID,
+		InvocationId:    in.InvocationID,
+		ActionDigest:    r.GetDigest(),
+		CommandDigest:   commandDigest,
+		InputRootDigest: inputRootDigest,
+		ExecuteResponse: executeResponse,
+		CreatedAtUsec:   in.Model.CreatedAtUsec,
+	}, nil
+}
+
+func (es *ExecutionService) GetFailedExecutions(ctx context.Context, req *espb.GetFailedExecutionsRequest) (*espb.GetFailedExecutionsResponse, error) {
+	if es.env.GetDBHandle() == nil {
+		return nil, status.FailedPreconditionError("database not configured")
+	}
+	if req.GetInvocationId() == "" {
+		return nil, status.InvalidArgumentError("An invocation_id must be provided")
+	}
+	failedExecutions, err := es.getFailedExecutions(ctx, req.GetInvocationId(), "" /*=executionID*/)
+	if err != nil {
+		return nil, err
+	}
+	rsp := &espb.GetFailedExecutionsResponse{}
+	for _, fe := range failedExecutions {
+		protoFailedExec, err := tableFailedExecToProto(fe)
+		if err != nil {
+			return nil, err
+		}
+		rsp.FailedExecution = append(rsp.FailedExecution, protoFailedExec)
+	}
+	return rsp, nil
+}
+
+func (es *ExecutionService) getExecution(ctx context.Context, executionID string) (*tables.Execution, error) {
+	dbh := es.env.GetDBHandle()
+	q := query_builder.NewQuery(`SELECT * FROM Executions as e`)
+	q = q.AddWhereClause(`e.execution_id = ?`, executionID)
+	if err := perms.AddPermissionsCheckToQueryWithTableAlias(ctx, es.env, q, "e"); err != nil {
+		return nil, err
+	}
+	queryStr, args := q.Build()
+	execution := &tables.Execution{}
+	err := dbh.DB(ctx).Raw(queryStr, args...).Take(execution).Error
+	if db.IsRecordNotFound(err) {
+		return nil, status.NotFoundErrorf("execution %q not found", executionID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return execution, nil
+}
+
+// GetExecutionLog returns a chunk of the output that an execution has written
+// so far, so that the execution can be followed while it is running.
+func (es *ExecutionService) GetExecutionLog(ctx context.Context, req *espb.GetExecutionLogRequest) (*espb.GetExecutionLogResponse, error) {
+	if es.env.GetDBHandle() == nil {
+		return nil, status.FailedPreconditionError("database not configured")
+	}
+	if es.env.GetBlobstore() == nil {
+		return nil, status.FailedPreconditionError("blobstore not configured")
+	}
+	if req.GetExecutionId() == "" {
+		return nil, status.InvalidArgumentError("An execution_id must be provided")
+	}
+	// Looking up the execution checks that the user may read it.
+	execution, err := es.getExecution(ctx, req.GetExecutionId())
+	if err != nil {
+		return nil, err
+	}
+	inProgress := execution.Stage != int64(repb.ExecutionStage_COMPLETED)
+	return eventlog.GetExecutionLogChunk(ctx, es.env, execution.GroupID, req, inProgress)
+}
@@ -0,0 +1,173 @@
+package execution_service
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/tables"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testauth"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testenv"
+	"github.com/buildbuddy-io/buildbuddy/server/util/perms"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+
+	espb "github.com/buildbuddy-io/buildbuddy/proto/execution_stats"
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+)
+
+const (
+	commandHash   = "1111111111111111111111111111111111111111111111111111111111111111"
+	inputRootHash = "2222222222222222222222222222222222222222222222222222222222222222"
+)
+
+func executionID(i int) string {
+	return fmt.Sprintf("instance/uploads/00000000-0000-0000-0000-%012d/blobs/%064d/%d", i, i, 100+i)
+}
+
+func setupEnv(t *testing.T) (*testenv.TestEnv, map[string]context.Context) {
+	env := testenv.GetTestEnv(t)
+	users := testauth.TestUsers("US1", "GR1", "US2", "GR2")
+	env.SetAuthenticator(testauth.NewTestAuthenticator(users))
+	ctxs := map[string]context.Context{}
+	for id, u := range users {
+		ctxs[id] = testauth.WithAuthenticatedUserInfo(context.Background(), u)
+	}
+	return env, ctxs
+}
+
+func insertFailedExecution(t *testing.T, env *testenv.TestEnv, groupID, invocationID string, i int, createdAt time.Time) *repb.ExecuteResponse {
+	ctx := context.Background()
+	rsp := &repb.ExecuteResponse{
+		Result: &repb.ActionResult{ExitCode: int32(i)},
+	}
+	buf, err := proto.Marshal(rsp)
+	require.NoError(t, err)
+	fe := &tables.FailedExecution{
+		ExecutionID:               executionID(i),
+		InvocationID:              invocationID,
+		GroupID:                   groupID,
+		Perms:                     perms.GROUP_READ | perms.GROUP_WRITE,
+		CommandDigest:             commandHash + "/10",
+		InputRootDigest:           inputRootHash + "/20",
+		SerializedExecuteResponse: buf,
+	}
+	err = env.GetDBHandle().DB(ctx).Create(fe).Error
+	require.NoError(t, err)
+	// Creation time is always set to the current time, so backdate it
+	// separately.
+	err = env.GetDBHandle().DB(ctx).Exec(
+		`UPDATE FailedExecutions SET created_at_usec = ? WHERE execution_id = ?`,
+		createdAt.UnixMicro(), fe.ExecutionID).Error
+	require.NoError(t, err)
+	return rsp
+}
+
+func remainingExecutionIDs(t *testing.T, env *testenv.TestEnv) []string {
+	var rows []*tables.FailedExecution
+	err := env.GetDBHandle().DB(context.Background()).Order("execution_id").Find(&rows).Error
+	require.NoError(t, err)
+	ids := make([]string, 0, len(rows))
+	for _, fe := range rows {
+		ids = append(ids, fe.ExecutionID)
+	}
+	return ids
+}
+
+func TestDeleteFailedExecutionsBefore(t *testing.T) {
+	env, _ := setupEnv(t)
+	es := NewExecutionService(env)
+	now := time.Now()
+	insertFailedExecution(t, env, "GR1", "IID1", 1, now.Add(-3*time.Hour))
+	insertFailedExecution(t, env, "GR1", "IID1", 2, now.Add(-1*time.Hour))
+	insertFailedExecution(t, env, "GR2", "IID2", 3, now.Add(-3*time.Hour))
+
+	err := es.deleteFailedExecutionsBefore(context.Background(), now.Add(-2*time.Hour))
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{executionID(2)}, remainingExecutionIDs(t, env))
+}
+
+func TestGetFailedExecutions(t *testing.T) {
+	env, ctxs := setupEnv(t)
+	es := NewExecutionService(env)
+	now := time.Now()
+	// Inserted out of order, to check that they are returned oldest first.
+	rsp2 := insertFailedExecution(t, env, "GR1", "IID1", 2, now.Add(-1*time.Minute))
+	rsp1 := insertFailedExecution(t, env, "GR1", "IID1", 1, now.Add(-2*time.Minute))
+	insertFailedExecution(t, env, "GR1", "IID2", 3, now)
+	insertFailedExecution(t, env, "GR2", "IID1", 4, now)
+
+	rsp, err := es.GetFailedExecutions(ctxs["US1"], &espb.GetFailedExecutionsRequest{InvocationId: "IID1"})
+	require.NoError(t, err)
+
+	require.Len(t, rsp.GetFailedExecution(), 2)
+	for i, want := range []*repb.ExecuteResponse{rsp1, rsp2} {
+		fe := rsp.GetFailedExecution()[i]
+		assert.Equal(t, executionID(i+1), fe.GetExecutionId())
+		assert.Equal(t, "IID1", fe.GetInvocationId())
+		assert.Equal(t, fmt.Sprintf("%064d", i+1), fe.GetActionDigest().GetHash())
+		assert.Equal(t, int64(100+i+1), fe.GetActionDigest().GetSizeBytes())
+		assert.Equal(t, commandHash, fe.GetCommandDigest().GetHash())
+		assert.Equal(t, int64(10), fe.GetCommandDigest().GetSizeBytes())
+		assert.Equal(t, inputRootHash, fe.GetInputRootDigest().GetHash())
+		assert.Equal(t, int64(20), fe.GetInputRootDigest().GetSizeBytes())
+		assert.True(t, proto.Equal(want, fe.GetExecuteResponse()), "got %v, want %v", fe.GetExecuteResponse(), want)
+	}
+	assert.Less(t, rsp.GetFailedExecution()[0].GetCreatedAtUsec(), rsp.GetFailedExecution()[1].GetCreatedAtUsec())
+}
+
+func TestGetFailedExecutions_OtherGroup(t *testing.T) {
+	env, ctxs := setupEnv(t)
+	es := NewExecutionService(env)
+	insertFailedExecution(t, env, "GR1", "IID1", 1, time.Now())
+
+	rsp, err := es.GetFailedExecutions(ctxs["US2"], &espb.GetFailedExecutionsRequest{InvocationId: "IID1"})
+	require.NoError(t, err)
+
+	assert.Empty(t, rsp.GetFailedExecution())
+}
+
+func TestGetFailedExecutions_MissingInvocationID(t *testing.T) {
+	env, ctxs := setupEnv(t)
+	es := NewExecutionService(env)
+
+	_, err := es.GetFailedExecutions(ctxs["US1"], &espb.GetFailedExecutionsRequest{})
+
+	require.Error(t, err)
+	assert.True(t, status.IsInvalidArgumentError(err), "unexpected error: %s", err)
+}
+
+func TestGetFailedExecutions_NoDatabase(t *testing.T) {
+	env, ctxs := setupEnv(t)
+	env.SetDBHandle(nil)
+	es := NewExecutionService(env)
+
+	_, err := es.GetFailedExecutions(ctxs["US1"], &espb.GetFailedExecutionsRequest{InvocationId: "IID1"})
+
+	require.Error(t, err)
+	assert.True(t, status.IsFailedPreconditionError(err), "unexpected error: %s", err)
+}
+
+func TestStart_DeletesExpiredFailedExecutions(t *testing.T) {
+	failedExecutionCleanupInterval = 10 * time.Millisecond
+	t.Cleanup(func() { failedExecutionCleanupInterval = time.Hour })
+
+	env, _ := setupEnv(t)
+	es := NewExecutionService(env)
+	es.failedExecutionTTL = time.Hour
+	now := time.Now()
+	insertFailedExecution(t, env, "GR1", "IID1", 1, now.Add(-2*time.Hour))
+	insertFailedExecution(t, env, "GR1", "IID1", 2, now)
+
+	es.Start()
+	defer es.Stop()
+
+	require.Eventually(t, func() bool {
+		ids := remainingExecutionIDs(t, env)
+		return len(ids) == 1 && ids[0] == executionID(2)
+	}, 5*time.Second, 10*time.Millisecond)
+}
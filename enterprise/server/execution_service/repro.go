@@ -0,0 +1,197 @@
+package execution_service
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/repro"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/cachetools"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/digest"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/namespace"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/prefix"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/golang/protobuf/jsonpb"
+
+	espb "github.com/buildbuddy-io/buildbuddy/proto/execution_stats"
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+)
+
+// ServeHTTP serves a repro bundle for the failed execution given by the
+// execution_id query parameter. The bundle is a gzipped tarball laid out as
+// described in the repro package, which also holds the ExecuteResponse of
+// the failed execution as JSON.
+func (es *ExecutionService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if es.env.GetDBHandle() == nil {
+		http.Error(w, "database not configured", http.StatusNotImplemented)
+		return
+	}
+	executionID := r.URL.Query().Get("execution_id")
+	if executionID == "" {
+		http.Error(w, "An execution_id must be provided", http.StatusBadRequest)
+		return
+	}
+	failedExecutions, err := es.getFailedExecutions(r.Context(), "" /*=invocationID*/, executionID)
+	if err != nil {
+		log.Warningf("Error looking up failed execution %q: %s", executionID, err)
+		http.Error(w, "Failed execution not found", http.StatusNotFound)
+		return
+	}
+	if len(failedExecutions) == 0 {
+		http.Error(w, "Failed execution not found", http.StatusNotFound)
+		return
+	}
+	fe, err := tableFailedExecToProto(failedExecutions[0])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	ctx, err := prefix.AttachUserPrefixToContext(r.Context(), es.env)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=repro-%s.tar.gz", fe.GetActionDigest().GetHash()))
+	w.Header().Set("Content-Type", "application/gzip")
+	if err := es.writeReproBundle(ctx, w, fe); err != nil {
+		// The response has likely been partially written, so all that's
+		// left to do is to log the error.
+		log.Warningf("Error writing repro bundle for execution %q: %s", executionID, err)
+	}
+}
+
+func (es *ExecutionService) writeReproBundle(ctx context.Context, w io.Writer, fe *espb.FailedExecution) error {
+	r, err := digest.ParseUploadResourceName(fe.GetExecutionId())
+	if err != nil {
+		return err
+	}
+	instanceName := r.GetInstanceName()
+	cache := es.env.GetCache()
+	if cache == nil {
+		return status.FailedPreconditionError("cache not configured")
+	}
+	cmd := &repb.Command{}
+	if err := cachetools.ReadProtoFromCAS(ctx, cache, digest.NewResourceName(fe.GetCommandDigest(), instanceName), cmd); err != nil {
+		return status.WrapError(err, "could not fetch command")
+	}
+	cas, err := namespace.CASCache(ctx, cache, instanceName)
+	if err != nil {
+		return err
+	}
+
+	gzw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gzw)
+	script := repro.Script("Reproduces the failed execution "+fe.GetExecutionId(), cmd)
+	if err := writeTarFile(tw, repro.ScriptName, 0755, []byte(script)); err != nil {
+		return err
+	}
+	if dockerfile := repro.Dockerfile(cmd); dockerfile != "" {
+		if err := writeTarFile(tw, repro.DockerfileName, 0644, []byte(dockerfile)); err != nil {
+			return err
+		}
+	}
+	marshaler := jsonpb.Marshaler{Indent: "  "}
+	executeResponse, err := marshaler.MarshalToString(fe.GetExecuteResponse())
+	if err != nil {
+		return err
+	}
+	if err := writeTarFile(tw, "execute_response.json", 0644, []byte(executeResponse)); err != nil {
+		return err
+	}
+	if err := es.writeInputTree(ctx, tw, cache, cas, instanceName, fe.GetInputRootDigest(), repro.InputRootDir); err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gzw.Close()
+}
+
+func writeTarFile(tw *tar.Writer, name string, mode int64, contents []byte) error {
+	hdr := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     mode,
+		Size:     int64(len(contents)),
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err := tw.Write(contents)
+	return err
+}
+
+// writeInputTree writes the directory with the given digest, and everything
+// below it, to the tarball at dirPath.
+func (es *ExecutionService) writeInputTree(ctx context.Context, tw *tar.Writer, cache, cas interfaces.Cache, instanceName string, dirDigest *repb.Digest, dirPath string) error {
+	if err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: dirPath + "/", Mode: 0755}); err != nil {
+		return err
+	}
+	dir := &repb.Directory{}
+	if dirDigest.GetHash() != digest.EmptySha256 {
+		if err := cachetools.ReadProtoFromCAS(ctx, cache, digest.NewResourceName(dirDigest, instanceName), dir); err != nil {
+			return err
+		}
+	}
+	for _, f := range dir.GetFiles() {
+		mode := int64(0644)
+		if f.GetIsExecutable() {
+			mode = 0755
+		}
+		hdr := &tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     path.Join(dirPath, f.GetName()),
+			Mode:     mode,
+			Size:     f.GetDigest().GetSizeBytes(),
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if f.GetDigest().GetSizeBytes() == 0 {
+			continue
+		}
+		if err := copyBlob(ctx, tw, cas, f.GetDigest()); err != nil {
+			return status.WrapErrorf(err, "could not fetch input %q", hdr.Name)
+		}
+	}
+	for _, s := range dir.GetSymlinks() {
+		hdr := &tar.Header{
+			Typeflag: tar.TypeSymlink,
+			Name:     path.Join(dirPath, s.GetName()),
+			Linkname: s.GetTarget(),
+			Mode:     0777,
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+	}
+	for _, d := range dir.GetDirectories() {
+		if err := es.writeInputTree(ctx, tw, cache, cas, instanceName, d.GetDigest(), path.Join(dirPath, d.GetName())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func copyBlob(ctx context.Context, w io.Writer, cas interfaces.Cache, d *repb.Digest) error {
+	r, err := cas.Reader(ctx, d, 0)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	n, err := io.Copy(w, r)
+	if err != nil {
+		return err
+	}
+	if n != d.GetSizeBytes() {
+		return status.DataLossErrorf("read %d bytes of blob %s/%d", n, d.GetHash(), d.GetSizeBytes())
+	}
+	return nil
+}
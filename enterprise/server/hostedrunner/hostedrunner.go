@@ -181,6 +181,7 @@ func (r *runnerService) createAction(ctx context.Context, req *rnpb.RunRequest,
 				{Name: "container-image", Value: RunnerContainerImage},
 				{Name: "recycle-runner", Value: "true"},
 				{Name: "workload-isolation-type", Value: "firecracker"},
+				{Name: platform.NetworkPropertyName, Value: "full"},
 				{Name: platform.EstimatedComputeUnitsPropertyName, Value: "2"},
 				{Name: platform.EstimatedFreeDiskPropertyName, Value: "20000000000"}, // 20GB
 			},
@@ -8,14 +8,17 @@ import (
 	"io"
 	"os"
 	"os/exec"
+	"runtime"
 	"strings"
 	"syscall"
 	"time"
 
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/util/cgroup"
 	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
 	"github.com/buildbuddy-io/buildbuddy/server/util/log"
 	"github.com/buildbuddy-io/buildbuddy/server/util/status"
 
+	espb "github.com/buildbuddy-io/buildbuddy/proto/execution_stats"
 	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
 	ps "github.com/mitchellh/go-ps"
 )
@@ -38,7 +41,7 @@ var (
 	DebugStreamCommandOutputs = flag.Bool("debug_stream_command_outputs", false, "If true, stream command outputs to the terminal. Intended for debugging purposes only and should not be used in production.")
 )
 
-func constructExecCommand(command *repb.Command, workDir string, in io.Reader, out io.Writer) (*exec.Cmd, *bytes.Buffer, *bytes.Buffer) {
+func constructExecCommand(command *repb.Command, workDir string, stdio *interfaces.Stdio) (*exec.Cmd, func(*interfaces.CommandResult)) {
 	executable, args := splitExecutableArgs(command.GetArguments())
 	// Note: we don't use CommandContext here because the default behavior of
 	// CommandContext is to kill just the top-level process when the context is
@@ -48,24 +51,44 @@ func constructExecCommand(command *repb.Command, workDir string, in io.Reader, o
 	if workDir != "" {
 		cmd.Dir = workDir
 	}
-	var stdout, stderr bytes.Buffer
-	cmd.Stdout = &stdout
-	if out != nil {
-		cmd.Stdout = io.MultiWriter(cmd.Stdout, out)
-	}
-	cmd.Stderr = &stderr
-	if in != nil {
-		cmd.Stdin = in
-	}
-	if *DebugStreamCommandOutputs {
-		cmd.Stdout = io.MultiWriter(cmd.Stdout, os.Stdout)
-		cmd.Stderr = io.MultiWriter(cmd.Stderr, os.Stderr)
+	var captureOutput func(*interfaces.CommandResult)
+	cmd.Stdout, cmd.Stderr, captureOutput = StdioWriters(stdio)
+	if stdio != nil && stdio.Stdin != nil {
+		cmd.Stdin = stdio.Stdin
 	}
 	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
 	for _, envVar := range command.GetEnvironmentVariables() {
 		cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", envVar.GetName(), envVar.GetValue()))
 	}
-	return cmd, &stdout, &stderr
+	return cmd, captureOutput
+}
+
+// StdioWriters returns the writers for the stdout and stderr of a command
+// run with the given stdio, which may be nil. Output is written to the
+// writers of stdio, if set, and is otherwise buffered in memory. Once the
+// command has finished, captureOutput copies the buffered output into its
+// result.
+//
+// If DebugStreamCommandOutputs is set, output is also written to the
+// executor's own stdout and stderr.
+func StdioWriters(stdio *interfaces.Stdio) (stdout, stderr io.Writer, captureOutput func(*interfaces.CommandResult)) {
+	var stdoutBuf, stderrBuf bytes.Buffer
+	stdout, stderr = &stdoutBuf, &stderrBuf
+	if stdio != nil && stdio.Stdout != nil {
+		stdout = stdio.Stdout
+	}
+	if stdio != nil && stdio.Stderr != nil {
+		stderr = stdio.Stderr
+	}
+	if *DebugStreamCommandOutputs {
+		stdout = io.MultiWriter(stdout, os.Stdout)
+		stderr = io.MultiWriter(stderr, os.Stderr)
+	}
+	captureOutput = func(result *interfaces.CommandResult) {
+		result.Stdout = stdoutBuf.Bytes()
+		result.Stderr = stderrBuf.Bytes()
+	}
+	return stdout, stderr, captureOutput
 }
 
 // RetryIfTextFileBusy runs a function, retrying "text file busy" errors up to
@@ -84,25 +107,73 @@ func RetryIfTextFileBusy(fn func() error) error {
 }
 
 // Run a command, retrying "text file busy" errors and killing the process group
-// when the context is cancelled.
-func Run(ctx context.Context, command *repb.Command, workDir string, stdin io.Reader, stdout io.Writer) *interfaces.CommandResult {
+// when the context is cancelled. The stdio of the command may be nil.
+func Run(ctx context.Context, command *repb.Command, workDir string, stdio *interfaces.Stdio) *interfaces.CommandResult {
+	return RunInCgroup(ctx, command, workDir, stdio, nil /*=cg*/)
+}
+
+// RunInCgroup is like Run, but runs the command in the given cgroup, if it is
+// not nil.
+func RunInCgroup(ctx context.Context, command *repb.Command, workDir string, stdio *interfaces.Stdio, cg *cgroup.Cgroup) *interfaces.CommandResult {
 	var cmd *exec.Cmd
-	var stdoutBuf, stderrBuf *bytes.Buffer
+	var captureOutput func(*interfaces.CommandResult)
 
 	err := RetryIfTextFileBusy(func() error {
 		// Create a new command on each attempt since commands can only be run once.
-		cmd, stdoutBuf, stderrBuf = constructExecCommand(command, workDir, stdin, stdout)
-		return RunWithProcessTreeCleanup(ctx, cmd)
+		cmd, captureOutput = constructExecCommand(command, workDir, stdio)
+		return RunWithProcessTreeCleanupInCgroup(ctx, cmd, cg)
 	})
 
 	exitCode, err := ExitCode(ctx, cmd, err)
 
-	return &interfaces.CommandResult{
+	result := &interfaces.CommandResult{
 		ExitCode:           exitCode,
 		Error:              err,
-		Stdout:             stdoutBuf.Bytes(),
-		Stderr:             stderrBuf.Bytes(),
 		CommandDebugString: cmd.String(),
+		UsageStats:         UsageStats(cmd.ProcessState),
+	}
+	captureOutput(result)
+	return result
+}
+
+// UsageStats returns the resources used by a command that has exited, or nil if
+// they are not known.
+func UsageStats(state *os.ProcessState) *espb.UsageStats {
+	if state == nil {
+		return nil
+	}
+	rusage, ok := state.SysUsage().(*syscall.Rusage)
+	if !ok {
+		return nil
+	}
+	peakMemoryBytes := int64(rusage.Maxrss)
+	// ru_maxrss is reported in kilobytes on Linux, and in bytes on macOS.
+	if runtime.GOOS == "linux" {
+		peakMemoryBytes *= 1024
+	}
+	return &espb.UsageStats{
+		PeakMemoryBytes: peakMemoryBytes,
+		CpuNanos:        (state.UserTime() + state.SystemTime()).Nanoseconds(),
+	}
+}
+
+// CgroupUsageStats converts the usage of a cgroup to usage stats.
+func CgroupUsageStats(usage *cgroup.Usage) *espb.UsageStats {
+	return &espb.UsageStats{
+		PeakMemoryBytes: usage.PeakMemoryBytes,
+		CpuNanos:        usage.CPUNanos,
+		IoReadBytes:     usage.IOReadBytes,
+		IoWriteBytes:    usage.IOWriteBytes,
+		CpuPressure:     pressureProto(usage.CPUPressure),
+		MemoryPressure:  pressureProto(usage.MemoryPressure),
+		IoPressure:      pressureProto(usage.IOPressure),
+	}
+}
+
+func pressureProto(p cgroup.Pressure) *espb.PSI {
+	return &espb.PSI{
+		SomeStallUsec: p.Some.Microseconds(),
+		FullStallUsec: p.Full.Microseconds(),
 	}
 }
 
@@ -118,10 +189,29 @@ func Run(ctx context.Context, command *repb.Command, workDir string, stdin io.Re
 // For an example command that can be passed to this func, see
 // constructExecCommand.
 func RunWithProcessTreeCleanup(ctx context.Context, cmd *exec.Cmd) error {
+	return RunWithProcessTreeCleanupInCgroup(ctx, cmd, nil /*=cg*/)
+}
+
+// RunWithProcessTreeCleanupInCgroup is like RunWithProcessTreeCleanup, but
+// moves the command into the given cgroup, if it is not nil, as soon as it has
+// started.
+//
+// Processes that the command forks before it is moved stay outside of the
+// cgroup, but in practice commands are moved long before they get to fork.
+func RunWithProcessTreeCleanupInCgroup(ctx context.Context, cmd *exec.Cmd, cg *cgroup.Cgroup) error {
 	if err := cmd.Start(); err != nil {
 		return err
 	}
 	pid := cmd.Process.Pid
+	if cg != nil {
+		if err := cg.AddProcess(pid); err != nil {
+			if err := KillProcessTree(pid); err != nil {
+				log.Warningf("Failed to kill process tree: %s", err)
+			}
+			cmd.Wait()
+			return err
+		}
+	}
 	done := make(chan struct{})
 	defer close(done)
 	go func() {
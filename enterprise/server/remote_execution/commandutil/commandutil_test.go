@@ -2,6 +2,7 @@ package commandutil_test
 
 import (
 	"context"
+	"io"
 	"testing"
 	"time"
 
@@ -38,6 +39,17 @@ func TestRun_NormalExit_NoError(t *testing.T) {
 	}
 }
 
+func TestRun_ReportsUsageStats(t *testing.T) {
+	ctx := context.Background()
+
+	res := runSh(ctx, "exit 0")
+
+	require.NoError(t, res.Error)
+	require.NotNil(t, res.UsageStats)
+	assert.Greater(t, res.UsageStats.GetPeakMemoryBytes(), int64(0))
+	assert.GreaterOrEqual(t, res.UsageStats.GetCpuNanos(), int64(0))
+}
+
 // TODO(bduffany): Treat SIGABRT as a normal exit rather than an unexpected
 // termination, and ensure that unexpected terminations are retried rather than
 // immediately reporting them to Bazel.
@@ -87,7 +99,7 @@ func TestRun_CommandNotFound_ErrorResult(t *testing.T) {
 
 	{
 		cmd := &repb.Command{Arguments: []string{"./command_not_found_in_working_dir"}}
-		res := commandutil.Run(ctx, cmd, ".", nil /*=stdin*/, nil /*=stdout*/)
+		res := commandutil.Run(ctx, cmd, ".", nil /*=stdio*/)
 
 		assert.Error(t, res.Error)
 		assert.True(
@@ -97,7 +109,7 @@ func TestRun_CommandNotFound_ErrorResult(t *testing.T) {
 	}
 	{
 		cmd := &repb.Command{Arguments: []string{"command_not_found_in_PATH"}}
-		res := commandutil.Run(ctx, cmd, ".", nil /*=stdin*/, nil /*=stdout*/)
+		res := commandutil.Run(ctx, cmd, ".", nil /*=stdio*/)
 
 		assert.Error(t, res.Error)
 		assert.True(
@@ -113,7 +125,7 @@ func TestRun_CommandNotExecutable_ErrorResult(t *testing.T) {
 	testfs.WriteAllFileContents(t, wd, map[string]string{"non_executable_file": ""})
 
 	cmd := &repb.Command{Arguments: []string{"./non_executable_file"}}
-	res := commandutil.Run(ctx, cmd, wd, nil /*=stdin*/, nil /*=stdout*/)
+	res := commandutil.Run(ctx, cmd, wd, nil /*=stdio*/)
 
 	assert.Error(t, res.Error)
 	assert.True(
@@ -134,7 +146,7 @@ func TestRun_Timeout(t *testing.T) {
 	ctx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
 	defer cancel()
 
-	res := commandutil.Run(ctx, cmd, wd, nil, nil)
+	res := commandutil.Run(ctx, cmd, wd, nil /*=stdio*/)
 
 	require.True(t, status.IsDeadlineExceededError(res.Error), "expected DeadlineExceeded but got: %s", res.Error)
 	assert.Equal(t, "stdout\n", string(res.Stdout))
@@ -155,14 +167,56 @@ func TestRun_SubprocessInOwnProcessGroup_Timeout(t *testing.T) {
 	ctx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
 	defer cancel()
 
-	res := commandutil.Run(ctx, cmd, wd, nil, nil)
+	res := commandutil.Run(ctx, cmd, wd, nil /*=stdio*/)
 
 	assert.True(t, status.IsDeadlineExceededError(res.Error), "expected DeadlineExceeded but got: %s", res.Error)
 	assert.Equal(t, "stdout\n", string(res.Stdout))
 	assert.Equal(t, "stderr\n", string(res.Stderr))
 }
 
+func TestRun_OutputFiles(t *testing.T) {
+	ctx := context.Background()
+	wd := testfs.MakeTempDir(t)
+	stdout, err := commandutil.NewOutputFile(wd, "stdout", 0 /*=limit*/, nil /*=onExceeded*/)
+	require.NoError(t, err)
+	defer stdout.Close()
+	stderr, err := commandutil.NewOutputFile(wd, "stderr", 0 /*=limit*/, nil /*=onExceeded*/)
+	require.NoError(t, err)
+	defer stderr.Close()
+
+	cmd := &repb.Command{Arguments: []string{"sh", "-c", "echo stdout >&1; echo stderr >&2"}}
+	res := commandutil.Run(ctx, cmd, wd, &interfaces.Stdio{Stdout: stdout, Stderr: stderr})
+
+	require.NoError(t, res.Error)
+	assert.Empty(t, res.Stdout)
+	assert.Empty(t, res.Stderr)
+	b, err := io.ReadAll(stdout.Reader())
+	require.NoError(t, err)
+	assert.Equal(t, "stdout\n", string(b))
+	b, err = io.ReadAll(stderr.Reader())
+	require.NoError(t, err)
+	assert.Equal(t, "stderr\n", string(b))
+}
+
+func TestRun_OutputFileLimitExceeded(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	wd := testfs.MakeTempDir(t)
+	stdout, err := commandutil.NewOutputFile(wd, "stdout", 10 /*=limit*/, cancel)
+	require.NoError(t, err)
+	defer stdout.Close()
+
+	cmd := &repb.Command{Arguments: []string{"sh", "-c", "while true; do echo 0123456789; done"}}
+	commandutil.Run(ctx, cmd, wd, &interfaces.Stdio{Stdout: stdout})
+
+	require.True(t, status.IsResourceExhaustedError(stdout.Err()), "expected ResourceExhausted but got: %s", stdout.Err())
+	assert.Contains(t, status.Message(stdout.Err()), "stdout exceeded the limit of 10 bytes")
+	b, err := io.ReadAll(stdout.Reader())
+	require.NoError(t, err)
+	assert.Equal(t, "0123456789", string(b))
+}
+
 func runSh(ctx context.Context, script string) *interfaces.CommandResult {
 	cmd := &repb.Command{Arguments: []string{"sh", "-c", script}}
-	return commandutil.Run(ctx, cmd, ".", nil /*=stdin*/, nil /*=stdout*/)
+	return commandutil.Run(ctx, cmd, ".", nil /*=stdio*/)
 }
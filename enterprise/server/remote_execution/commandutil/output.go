@@ -0,0 +1,93 @@
+package commandutil
+
+import (
+	"io"
+	"os"
+	"sync"
+
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+)
+
+// OutputFile is a writer for one of the output streams of a command, such as
+// stdout, which writes the output to a temporary file so that it doesn't
+// need to be held in memory. The file can optionally be limited in size.
+type OutputFile struct {
+	name       string
+	limit      int64
+	onExceeded func()
+	file       *os.File
+
+	mu   sync.Mutex // protects(size), protects(err)
+	size int64
+	err  error
+}
+
+// NewOutputFile creates a temporary file in dir for the output stream with
+// the given name.
+//
+// If limit is positive, at most limit bytes are written to the file. Writes
+// past the limit fail with a RESOURCE_EXHAUSTED error, and onExceeded, if
+// not nil, is called when the limit is first exceeded.
+func NewOutputFile(dir, name string, limit int64, onExceeded func()) (*OutputFile, error) {
+	f, err := os.CreateTemp(dir, name+"-*")
+	if err != nil {
+		return nil, status.UnavailableErrorf("failed to create %s file: %s", name, err)
+	}
+	return &OutputFile{
+		name:       name,
+		limit:      limit,
+		onExceeded: onExceeded,
+		file:       f,
+	}, nil
+}
+
+func (o *OutputFile) Write(p []byte) (int, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.err != nil {
+		return 0, o.err
+	}
+	b := p
+	if o.limit > 0 && o.size+int64(len(b)) > o.limit {
+		b = b[:o.limit-o.size]
+	}
+	n, err := o.file.Write(b)
+	o.size += int64(n)
+	if err != nil {
+		o.err = status.UnavailableErrorf("failed to write %s: %s", o.name, err)
+		return n, o.err
+	}
+	if n < len(p) {
+		o.err = status.ResourceExhaustedErrorf("%s exceeded the limit of %d bytes", o.name, o.limit)
+		if o.onExceeded != nil {
+			o.onExceeded()
+		}
+		return n, o.err
+	}
+	return n, nil
+}
+
+// Err returns the error that caused writes to the file to fail, if any.
+func (o *OutputFile) Err() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.err
+}
+
+// Reader returns a reader for the output that has been written so far. The
+// reader is independent of any other readers, and remains valid until the
+// file is closed.
+func (o *OutputFile) Reader() io.ReadSeeker {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return io.NewSectionReader(o.file, 0, o.size)
+}
+
+// Close closes and removes the file.
+func (o *OutputFile) Close() error {
+	closeErr := o.file.Close()
+	if err := os.Remove(o.file.Name()); err != nil {
+		return err
+	}
+	return closeErr
+}
@@ -4,7 +4,6 @@ import (
 	"context"
 	"flag"
 	"fmt"
-	"io"
 	"sync"
 	"time"
 
@@ -51,11 +50,11 @@ type FileSystemLayout struct {
 // CommandContainer provides an execution environment for commands.
 type CommandContainer interface {
 	// Run the given command within the container and remove the container after
-	// it is done executing.
+	// it is done executing. The stdio of the command may be nil.
 	//
 	// It is approximately the same as calling PullImageIfNecessary, Create,
 	// Exec, then Remove.
-	Run(ctx context.Context, command *repb.Command, workingDir string, creds PullCredentials) *interfaces.CommandResult
+	Run(ctx context.Context, command *repb.Command, workingDir string, creds PullCredentials, stdio *interfaces.Stdio) *interfaces.CommandResult
 
 	// IsImageCached returns whether the configured image is cached locally.
 	IsImageCached(ctx context.Context) (bool, error)
@@ -74,11 +73,9 @@ type CommandContainer interface {
 	Create(ctx context.Context, workingDir string) error
 	// Exec runs a command inside a container, with the same working dir set when
 	// creating the container.
-	// If stdin is non-nil, the contents of stdin reader will be piped to the stdin of
-	// the executed process.
-	// If stdout is non-nil, the stdout of the executed process will be written to the
-	// stdout writer.
-	Exec(ctx context.Context, command *repb.Command, stdin io.Reader, stdout io.Writer) *interfaces.CommandResult
+	// The stdio of the command may be nil. Output streams that have no writer
+	// in stdio are captured in the returned result.
+	Exec(ctx context.Context, command *repb.Command, stdio *interfaces.Stdio) *interfaces.CommandResult
 	// Unpause un-freezes a container so that it can be used to execute commands.
 	Unpause(ctx context.Context) error
 	// Pause freezes a container so that it no longer consumes CPU resources.
@@ -257,10 +254,10 @@ type TracedCommandContainer struct {
 	implAttr attribute.KeyValue
 }
 
-func (t *TracedCommandContainer) Run(ctx context.Context, command *repb.Command, workingDir string, creds PullCredentials) *interfaces.CommandResult {
+func (t *TracedCommandContainer) Run(ctx context.Context, command *repb.Command, workingDir string, creds PullCredentials, stdio *interfaces.Stdio) *interfaces.CommandResult {
 	ctx, span := tracing.StartSpan(ctx, trace.WithAttributes(t.implAttr))
 	defer span.End()
-	return t.Delegate.Run(ctx, command, workingDir, creds)
+	return t.Delegate.Run(ctx, command, workingDir, creds, stdio)
 }
 
 func (t *TracedCommandContainer) IsImageCached(ctx context.Context) (bool, error) {
@@ -281,10 +278,10 @@ func (t *TracedCommandContainer) Create(ctx context.Context, workingDir string)
 	return t.Delegate.Create(ctx, workingDir)
 }
 
-func (t *TracedCommandContainer) Exec(ctx context.Context, command *repb.Command, stdin io.Reader, stdout io.Writer) *interfaces.CommandResult {
+func (t *TracedCommandContainer) Exec(ctx context.Context, command *repb.Command, stdio *interfaces.Stdio) *interfaces.CommandResult {
 	ctx, span := tracing.StartSpan(ctx, trace.WithAttributes(t.implAttr))
 	defer span.End()
-	return t.Delegate.Exec(ctx, command, stdin, stdout)
+	return t.Delegate.Exec(ctx, command, stdio)
 }
 
 func (t *TracedCommandContainer) Unpause(ctx context.Context) error {
@@ -2,7 +2,6 @@ package container_test
 
 import (
 	"context"
-	"io"
 	"testing"
 	"time"
 
@@ -24,7 +23,7 @@ type FakeContainer struct {
 	PullCount               int
 }
 
-func (c *FakeContainer) Run(context.Context, *repb.Command, string, container.PullCredentials) *interfaces.CommandResult {
+func (c *FakeContainer) Run(context.Context, *repb.Command, string, container.PullCredentials, *interfaces.Stdio) *interfaces.CommandResult {
 	return nil
 }
 func (c *FakeContainer) IsImageCached(context.Context) (bool, error) {
@@ -38,7 +37,7 @@ func (c *FakeContainer) PullImage(ctx context.Context, creds container.PullCrede
 	return nil
 }
 func (c *FakeContainer) Create(context.Context, string) error { return nil }
-func (c *FakeContainer) Exec(context.Context, *repb.Command, io.Reader, io.Writer) *interfaces.CommandResult {
+func (c *FakeContainer) Exec(context.Context, *repb.Command, *interfaces.Stdio) *interfaces.CommandResult {
 	return nil
 }
 func (c *FakeContainer) Remove(ctx context.Context) error  { return nil }
@@ -2,27 +2,33 @@ package bare
 
 import (
 	"context"
-	"io"
 
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/commandutil"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/container"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/util/cgroup"
 	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
 
 	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
 )
 
+type Opts struct {
+	// If set, commands are run in this cgroup.
+	Cgroup *cgroup.Cgroup
+}
+
 // bareCommandContainer executes commands directly, without any isolation
 // between containers.
 type bareCommandContainer struct {
 	WorkDir string
+	opts    Opts
 }
 
-func NewBareCommandContainer() container.CommandContainer {
-	return &bareCommandContainer{}
+func NewBareCommandContainer(opts *Opts) container.CommandContainer {
+	return &bareCommandContainer{opts: *opts}
 }
 
-func (c *bareCommandContainer) Run(ctx context.Context, command *repb.Command, workDir string, creds container.PullCredentials) *interfaces.CommandResult {
-	return commandutil.Run(ctx, command, workDir, nil, nil)
+func (c *bareCommandContainer) Run(ctx context.Context, command *repb.Command, workDir string, creds container.PullCredentials, stdio *interfaces.Stdio) *interfaces.CommandResult {
+	return commandutil.RunInCgroup(ctx, command, workDir, stdio, c.opts.Cgroup)
 }
 
 func (c *bareCommandContainer) Create(ctx context.Context, workDir string) error {
@@ -30,8 +36,8 @@ func (c *bareCommandContainer) Create(ctx context.Context, workDir string) error
 	return nil
 }
 
-func (c *bareCommandContainer) Exec(ctx context.Context, cmd *repb.Command, stdin io.Reader, stdout io.Writer) *interfaces.CommandResult {
-	return commandutil.Run(ctx, cmd, c.WorkDir, stdin, stdout)
+func (c *bareCommandContainer) Exec(ctx context.Context, cmd *repb.Command, stdio *interfaces.Stdio) *interfaces.CommandResult {
+	return commandutil.RunInCgroup(ctx, cmd, c.WorkDir, stdio, c.opts.Cgroup)
 }
 
 func (c *bareCommandContainer) IsImageCached(ctx context.Context) (bool, error) { return false, nil }
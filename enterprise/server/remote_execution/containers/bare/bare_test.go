@@ -57,8 +57,8 @@ func TestHelloWorldOnBareMetal(t *testing.T) {
 	ctx, cancel := context.WithTimeout(ctx, 1*time.Second)
 	defer cancel()
 
-	bareContainer := bare.NewBareCommandContainer()
-	result := bareContainer.Run(ctx, cmd, tempDir, container.PullCredentials{})
+	bareContainer := bare.NewBareCommandContainer(&bare.Opts{})
+	result := bareContainer.Run(ctx, cmd, tempDir, container.PullCredentials{}, nil /*=stdio*/)
 
 	if result.Error != nil {
 		t.Fatal(result.Error)
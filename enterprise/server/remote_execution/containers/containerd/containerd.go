@@ -0,0 +1,629 @@
+package containerd
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/commandutil"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/container"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/imagestore"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/util/networking"
+	"github.com/buildbuddy-io/buildbuddy/server/environment"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/util/background"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/random"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/containerd/containerd/cio"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/oci"
+	"github.com/containerd/containerd/remotes/docker"
+	"github.com/containerd/typeurl"
+	"github.com/docker/distribution/reference"
+
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+	cgroupsv1 "github.com/containerd/cgroups/stats/v1"
+	cgroupsv2 "github.com/containerd/cgroups/v2/stats"
+	containerdclient "github.com/containerd/containerd"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+const (
+	// Namespace is the containerd namespace in which images, containers and
+	// snapshots are created, which keeps them separate from those of other
+	// containerd clients on the same host, such as the kubelet.
+	Namespace = "buildbuddy"
+
+	// execSIGKILLExitCode is the exit code reported for an exec process that
+	// was terminated by SIGKILL.
+	execSIGKILLExitCode = 128 + int(syscall.SIGKILL)
+
+	containerFinalizationTimeout = 10 * time.Second
+)
+
+var (
+	// networkIdx is incremented for every network namespace that is set up
+	// for a container, to give each one its own addresses.
+	networkIdx int64
+
+	masqueradingOnce sync.Once
+)
+
+type ContainerdOptions struct {
+	ForceRoot bool
+	// Network is the network access of the container. Every container gets
+	// its own network namespace. Containers that don't need network access
+	// only have a loopback interface. Otherwise, including if Network is nil,
+	// the namespace is connected to the host with a veth pair and its traffic
+	// is routed out of the host's default device. Egress allowlists are
+	// applied to the namespace once the container has started.
+	Network *networking.Policy
+	// CgroupParent is the cgroup to create containers in, if set. It is a
+	// path relative to the root of the cgroup hierarchy.
+	CgroupParent string
+	// ImageStore can optionally be specified to pull images into the store
+	// shared with other isolation types. The image's blobs are then imported
+	// into containerd's content store rather than pulled by containerd.
+	ImageStore *imagestore.Store
+}
+
+// NewClient returns a client for the containerd daemon listening on the
+// given socket, which uses the BuildBuddy namespace.
+func NewClient(socket string) (*containerdclient.Client, error) {
+	client, err := containerdclient.New(socket, containerdclient.WithDefaultNamespace(Namespace))
+	if err != nil {
+		return nil, status.UnavailableErrorf("failed to connect to containerd: %s", err)
+	}
+	return client, nil
+}
+
+// containerdCommandContainer containerizes a command's execution using a
+// container managed by containerd.
+type containerdCommandContainer struct {
+	env            environment.Env
+	imageCacheAuth *container.ImageCacheAuthenticator
+
+	image string
+	// hostRootDir is the path on the host machine of the root data dir for
+	// builds. It is needed because containerd mounts workspaces from the
+	// host, which doesn't know about the directories inside this container.
+	hostRootDir string
+	client      *containerdclient.Client
+	options     *ContainerdOptions
+
+	// container and task are the container and the task running its
+	// top-level process, which are available after creating the container.
+	container containerdclient.Container
+	task      containerdclient.Task
+	// workDir is the path to the workspace directory mounted to the container.
+	workDir string
+	// netns is the name of the network namespace that is set up for the
+	// container if it needs network access, and cleanupNetwork removes the
+	// firewall rules that route its traffic.
+	netns          string
+	cleanupNetwork func(context.Context) error
+	// removed is a flag that is set once Remove is called (before actually
+	// removing the container).
+	removed bool
+}
+
+func NewContainerdContainer(env environment.Env, imageCacheAuth *container.ImageCacheAuthenticator, client *containerdclient.Client, image, hostRootDir string, options *ContainerdOptions) container.CommandContainer {
+	return &containerdCommandContainer{
+		env:            env,
+		imageCacheAuth: imageCacheAuth,
+		image:          image,
+		hostRootDir:    hostRootDir,
+		client:         client,
+		options:        options,
+	}
+}
+
+func wrapContainerdErr(err error, contextMsg string) error {
+	if err == nil {
+		return nil
+	}
+	if err == context.DeadlineExceeded {
+		return status.DeadlineExceededErrorf("%s: %s", contextMsg, err)
+	}
+	if errdefs.IsNotFound(err) {
+		return status.NotFoundErrorf("%s: %s", contextMsg, err)
+	}
+	return status.UnavailableErrorf("%s: %s", contextMsg, err)
+}
+
+// imageRef returns the fully qualified reference of the container's image.
+// Unlike Docker, containerd does not expand short references such as
+// "ubuntu" to "docker.io/library/ubuntu:latest".
+func (c *containerdCommandContainer) imageRef() (string, error) {
+	named, err := reference.ParseNormalizedNamed(c.image)
+	if err != nil {
+		return "", status.InvalidArgumentErrorf("invalid container image %q: %s", c.image, err)
+	}
+	return reference.TagNameOnly(named).String(), nil
+}
+
+func (c *containerdCommandContainer) Run(ctx context.Context, command *repb.Command, workDir string, creds container.PullCredentials, stdio *interfaces.Stdio) *interfaces.CommandResult {
+	if err := container.PullImageIfNecessary(ctx, c.env, c.imageCacheAuth, c, creds, c.image); err != nil {
+		return commandutil.ErrorResult(wrapContainerdErr(err, fmt.Sprintf("failed to pull image %q", c.image)))
+	}
+	if err := c.Create(ctx, workDir); err != nil {
+		return commandutil.ErrorResult(err)
+	}
+	defer func() {
+		ctx, cancel := background.ExtendContextForFinalization(ctx, containerFinalizationTimeout)
+		defer cancel()
+		if err := c.Remove(ctx); err != nil {
+			log.Warningf("Failed to remove containerd container: %s", err)
+		}
+	}()
+	return c.Exec(ctx, command, stdio)
+}
+
+func (c *containerdCommandContainer) IsImageCached(ctx context.Context) (bool, error) {
+	ref, err := c.imageRef()
+	if err != nil {
+		return false, err
+	}
+	image, err := c.client.GetImage(ctx, ref)
+	if errdefs.IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, wrapContainerdErr(err, "failed to get image")
+	}
+	// The image may have been pulled without being unpacked into a snapshot,
+	// for example by another containerd client.
+	unpacked, err := image.IsUnpacked(ctx, containerdclient.DefaultSnapshotter)
+	if err != nil {
+		return false, wrapContainerdErr(err, "failed to check whether image is unpacked")
+	}
+	return unpacked, nil
+}
+
+func (c *containerdCommandContainer) PullImage(ctx context.Context, creds container.PullCredentials) error {
+	ref, err := c.imageRef()
+	if err != nil {
+		return err
+	}
+	if c.options.ImageStore != nil {
+		return c.importImage(ctx, ref, creds)
+	}
+	named, err := reference.ParseNormalizedNamed(ref)
+	if err != nil {
+		return status.InvalidArgumentErrorf("invalid container image %q: %s", c.image, err)
+	}
+	authorizer := docker.NewDockerAuthorizer(docker.WithAuthCreds(registryCreds(reference.Domain(named), creds)))
+	resolver := docker.NewResolver(docker.ResolverOptions{
+		Hosts: docker.ConfigureDefaultRegistries(docker.WithAuthorizer(authorizer)),
+	})
+	_, err = c.client.Pull(
+		ctx, ref,
+		containerdclient.WithResolver(resolver),
+		containerdclient.WithPullUnpack,
+		containerdclient.WithPullSnapshotter(containerdclient.DefaultSnapshotter),
+	)
+	if err != nil {
+		return wrapContainerdErr(err, fmt.Sprintf("failed to pull image %q", c.image))
+	}
+	return nil
+}
+
+// importImage pulls the image into the image store, imports its blobs into
+// containerd's content store and unpacks it into a snapshot.
+func (c *containerdCommandContainer) importImage(ctx context.Context, ref string, creds container.PullCredentials) error {
+	img, err := c.options.ImageStore.Pull(ctx, c.image, creds)
+	if err != nil {
+		return err
+	}
+	cs := c.client.ContentStore()
+	for _, desc := range append([]ocispec.Descriptor{img.ConfigBlob}, img.Layers...) {
+		if err := c.importBlob(ctx, cs, desc); err != nil {
+			return err
+		}
+	}
+	// The manifest is imported last, labeled with references to its config
+	// and layers so that containerd doesn't garbage collect them.
+	if err := c.importBlob(ctx, cs, img.Manifest, content.WithLabels(childGCLabels(img))); err != nil {
+		return err
+	}
+	record := images.Image{Name: ref, Target: img.Manifest}
+	if _, err := c.client.ImageService().Create(ctx, record); errdefs.IsAlreadyExists(err) {
+		_, err = c.client.ImageService().Update(ctx, record, "target")
+		if err != nil {
+			return wrapContainerdErr(err, "failed to update image")
+		}
+	} else if err != nil {
+		return wrapContainerdErr(err, "failed to create image")
+	}
+	if err := containerdclient.NewImage(c.client, record).Unpack(ctx, containerdclient.DefaultSnapshotter); err != nil {
+		return wrapContainerdErr(err, fmt.Sprintf("failed to unpack image %q", c.image))
+	}
+	return nil
+}
+
+// importBlob copies a blob from the image store to containerd's content
+// store, unless it is already there.
+func (c *containerdCommandContainer) importBlob(ctx context.Context, cs content.Store, desc ocispec.Descriptor, opts ...content.Opt) error {
+	f, err := c.options.ImageStore.OpenBlob(desc.Digest)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := content.WriteBlob(ctx, cs, "import-"+desc.Digest.String(), f, desc, opts...); err != nil {
+		return wrapContainerdErr(err, fmt.Sprintf("failed to import blob %s", desc.Digest))
+	}
+	return nil
+}
+
+// childGCLabels returns the labels with which containerd's pulls mark the
+// config and layers of an image as referenced by its manifest.
+func childGCLabels(img *imagestore.Image) map[string]string {
+	labels := map[string]string{}
+	indexes := map[string]int{}
+	for _, desc := range append([]ocispec.Descriptor{img.ConfigBlob}, img.Layers...) {
+		for _, key := range images.ChildGCLabels(desc) {
+			// Keys ending with "." are numbered, e.g. one for each layer.
+			if strings.HasSuffix(key, ".") {
+				i := indexes[key]
+				indexes[key]++
+				key += strconv.Itoa(i)
+			}
+			labels[key] = desc.Digest.String()
+		}
+	}
+	return labels
+}
+
+// registryCreds returns a function that returns the credentials that the
+// resolver should use for a registry host, so that the pull credentials are
+// only sent to the registry of the image being pulled, and not to other hosts
+// that the pull is redirected to, such as blob storage.
+func registryCreds(registry string, creds container.PullCredentials) func(host string) (string, string, error) {
+	// Images on Docker Hub are pulled from a different host than the one
+	// that their references name.
+	if registry == "docker.io" {
+		registry = "registry-1.docker.io"
+	}
+	return func(host string) (string, string, error) {
+		if host != registry {
+			return "", "", nil
+		}
+		return creds.Username, creds.Password, nil
+	}
+}
+
+func generateContainerName() (string, error) {
+	suffix, err := random.RandomString(20)
+	if err != nil {
+		return "", err
+	}
+	return "buildbuddy_exec_" + suffix, nil
+}
+
+func (c *containerdCommandContainer) specOpts(image containerdclient.Image, id, workDir string) []oci.SpecOpts {
+	opts := []oci.SpecOpts{
+		oci.WithImageConfig(image),
+		// The top-level container process just sleeps forever so that the
+		// container stays alive until explicitly killed.
+		oci.WithProcessArgs("sleep", "infinity"),
+		oci.WithProcessCwd(workDir),
+		oci.WithHostname("localhost"),
+		oci.WithMounts([]specs.Mount{{
+			Type: "bind",
+			// The source path needs to point to the host machine, since
+			// containerd runs on the host.
+			Source:      filepath.Join(c.hostRootDir, filepath.Base(workDir)),
+			Destination: workDir,
+			Options:     []string{"rbind", "rw"},
+		}}),
+	}
+	if c.options.ForceRoot {
+		opts = append(opts, oci.WithUIDGID(0, 0))
+	}
+	if c.netns != "" {
+		opts = append(
+			opts,
+			oci.WithLinuxNamespace(specs.LinuxNamespace{
+				Type: specs.NetworkNamespace,
+				Path: filepath.Join("/var/run/netns", c.netns),
+			}),
+			oci.WithHostHostsFile,
+			oci.WithHostResolvconf,
+		)
+	}
+	if c.options.CgroupParent != "" {
+		opts = append(opts, oci.WithCgroup(filepath.Join(c.options.CgroupParent, id)))
+	}
+	return opts
+}
+
+func (c *containerdCommandContainer) Create(ctx context.Context, workDir string) error {
+	id, err := generateContainerName()
+	if err != nil {
+		return status.UnavailableErrorf("failed to generate containerd container name: %s", err)
+	}
+	ref, err := c.imageRef()
+	if err != nil {
+		return err
+	}
+	image, err := c.client.GetImage(ctx, ref)
+	if err != nil {
+		return wrapContainerdErr(err, fmt.Sprintf("failed to get image %q", c.image))
+	}
+	if c.options.Network == nil || c.options.Network.NeedsInterface() {
+		if err := c.setupNetwork(ctx, id); err != nil {
+			return err
+		}
+	}
+	ctr, err := c.client.NewContainer(
+		ctx, id,
+		containerdclient.WithImage(image),
+		containerdclient.WithNewSnapshot(id+"-snapshot", image),
+		containerdclient.WithNewSpec(c.specOpts(image, id, workDir)...),
+	)
+	if err != nil {
+		if err := c.removeNetwork(ctx); err != nil {
+			log.Warningf("Failed to remove container network: %s", err)
+		}
+		return wrapContainerdErr(err, "failed to create container")
+	}
+	c.container = ctr
+	c.workDir = workDir
+	task, err := ctr.NewTask(ctx, cio.NullIO)
+	if err != nil {
+		return wrapContainerdErr(err, "failed to create container task")
+	}
+	c.task = task
+	if err := task.Start(ctx); err != nil {
+		return wrapContainerdErr(err, "failed to start container task")
+	}
+	return c.restrictEgress(ctx)
+}
+
+// restrictEgress applies the egress allowlist of the container's network
+// policy, if it has one, to the network namespace of the container.
+func (c *containerdCommandContainer) restrictEgress(ctx context.Context) error {
+	if c.options.Network == nil || c.options.Network.Mode != networking.Egress {
+		return nil
+	}
+	allowed, err := networking.ResolveAllowedNetworks(ctx, c.options.Network)
+	if err != nil {
+		return err
+	}
+	if err := networking.RestrictEgressOfProcess(ctx, int(c.task.Pid()), allowed); err != nil {
+		return status.UnavailableErrorf("failed to restrict container egress: %s", err)
+	}
+	return nil
+}
+
+// setupNetwork creates a network namespace for the container with the given
+// id, and connects it to the host.
+func (c *containerdCommandContainer) setupNetwork(ctx context.Context, id string) error {
+	var masqueradingErr error
+	masqueradingOnce.Do(func() {
+		masqueradingErr = networking.EnableMasquerading(ctx)
+	})
+	if masqueradingErr != nil {
+		return status.UnavailableErrorf("failed to enable masquerading: %s", masqueradingErr)
+	}
+	if err := networking.CreateNetNamespace(ctx, id); err != nil {
+		return status.UnavailableErrorf("failed to create network namespace: %s", err)
+	}
+	c.netns = id
+	idx := int(atomic.AddInt64(&networkIdx, 1))
+	cleanup, err := networking.SetupNamespaceNetwork(ctx, id, idx)
+	if err != nil {
+		if err := c.removeNetwork(ctx); err != nil {
+			log.Warningf("Failed to remove container network: %s", err)
+		}
+		return status.UnavailableErrorf("failed to set up container network: %s", err)
+	}
+	c.cleanupNetwork = cleanup
+	return nil
+}
+
+// removeNetwork removes the network namespace of the container, if it has
+// one, along with the firewall rules that route its traffic.
+func (c *containerdCommandContainer) removeNetwork(ctx context.Context) error {
+	var lastErr error
+	if c.cleanupNetwork != nil {
+		if err := c.cleanupNetwork(ctx); err != nil {
+			lastErr = err
+		}
+		c.cleanupNetwork = nil
+	}
+	if c.netns != "" {
+		if err := networking.RemoveNetNamespace(ctx, c.netns); err != nil {
+			lastErr = err
+		}
+		c.netns = ""
+	}
+	return lastErr
+}
+
+func (c *containerdCommandContainer) Exec(ctx context.Context, command *repb.Command, stdio *interfaces.Stdio) *interfaces.CommandResult {
+	if stdio == nil {
+		stdio = &interfaces.Stdio{}
+	}
+	var res *interfaces.CommandResult
+	// Ignore error from this function; it is returned as part of res.
+	commandutil.RetryIfTextFileBusy(func() error {
+		res = c.exec(ctx, command, stdio)
+		return res.Error
+	})
+	return res
+}
+
+func (c *containerdCommandContainer) exec(ctx context.Context, command *repb.Command, stdio *interfaces.Stdio) *interfaces.CommandResult {
+	result := &interfaces.CommandResult{
+		CommandDebugString: fmt.Sprintf("(containerd) %s", command.GetArguments()),
+		ExitCode:           commandutil.NoExitCode,
+	}
+	if c.task == nil {
+		result.Error = status.FailedPreconditionError("container has not been created")
+		return result
+	}
+
+	// Exec processes inherit the container's spec, including its user and
+	// environment. The command's environment variables take precedence over
+	// the image's.
+	spec, err := c.container.Spec(ctx)
+	if err != nil {
+		result.Error = wrapContainerdErr(err, "failed to get container spec")
+		return result
+	}
+	for _, opt := range []oci.SpecOpts{oci.WithProcessArgs(command.GetArguments()...), oci.WithEnv(commandutil.EnvStringList(command))} {
+		if err := opt(ctx, nil /*=client*/, nil /*=container*/, spec); err != nil {
+			result.Error = status.InternalErrorf("failed to configure exec process: %s", err)
+			return result
+		}
+	}
+
+	outWriter, errWriter, captureOutput := commandutil.StdioWriters(stdio)
+
+	execID, err := random.RandomString(20)
+	if err != nil {
+		result.Error = status.UnavailableErrorf("failed to generate exec ID: %s", err)
+		return result
+	}
+	process, err := c.task.Exec(ctx, execID, spec.Process, cio.NewCreator(cio.WithStreams(stdio.Stdin, outWriter, errWriter)))
+	if err != nil {
+		result.Error = wrapContainerdErr(err, "failed to create exec process")
+		return result
+	}
+	defer func() {
+		ctx, cancel := background.ExtendContextForFinalization(ctx, containerFinalizationTimeout)
+		defer cancel()
+		if _, err := process.Delete(ctx, containerdclient.WithProcessKill); err != nil && !errdefs.IsNotFound(err) {
+			log.Warningf("Failed to delete exec process: %s", err)
+		}
+	}()
+	// Wait must be called before Start, so that the exit status isn't missed.
+	statusC, err := process.Wait(ctx)
+	if err != nil {
+		result.Error = wrapContainerdErr(err, "failed to wait for exec process")
+		return result
+	}
+	if err := process.Start(ctx); err != nil {
+		result.Error = wrapContainerdErr(err, "failed to start exec process")
+		return result
+	}
+
+	var exitStatus containerdclient.ExitStatus
+	select {
+	case exitStatus = <-statusC:
+	case <-ctx.Done():
+		if ctx.Err() == context.DeadlineExceeded {
+			result.Error = status.DeadlineExceededError("command timed out")
+		} else {
+			result.Error = status.CanceledError("command was canceled")
+		}
+		// Kill the process so that the output it wrote before the context
+		// was done can be returned.
+		killCtx, cancel := background.ExtendContextForFinalization(ctx, containerFinalizationTimeout)
+		defer cancel()
+		if err := process.Kill(killCtx, syscall.SIGKILL); err != nil {
+			log.Warningf("Failed to kill exec process: %s", err)
+			return result
+		}
+		select {
+		case <-statusC:
+		case <-killCtx.Done():
+			return result
+		}
+	}
+	// Wait for the command's outputs to be copied.
+	process.IO().Wait()
+	captureOutput(result)
+	if result.Error != nil {
+		return result
+	}
+
+	exitCode, _, err := exitStatus.Result()
+	if err != nil {
+		result.Error = wrapContainerdErr(err, "failed to get exec process status")
+		return result
+	}
+	// Like Docker, containerd reports an exit code of `128 + signal` for
+	// processes that were terminated by a signal, which is also a valid exit
+	// code. Only treat it as SIGKILL when the container was removed and a
+	// SIGKILL is expected as a result.
+	if c.removed && int(exitCode) == execSIGKILLExitCode {
+		result.ExitCode = commandutil.KilledExitCode
+		result.Error = commandutil.ErrSIGKILL
+		return result
+	}
+	result.ExitCode = int(exitCode)
+	return result
+}
+
+func (c *containerdCommandContainer) Pause(ctx context.Context) error {
+	if err := c.task.Pause(ctx); err != nil {
+		return wrapContainerdErr(err, "failed to pause container")
+	}
+	return nil
+}
+
+func (c *containerdCommandContainer) Unpause(ctx context.Context) error {
+	if err := c.task.Resume(ctx); err != nil {
+		return wrapContainerdErr(err, "failed to unpause container")
+	}
+	return nil
+}
+
+func (c *containerdCommandContainer) Remove(ctx context.Context) error {
+	c.removed = true
+	if c.task != nil {
+		// WithProcessKill kills all of the container's processes, including
+		// exec processes, before deleting the task.
+		if _, err := c.task.Delete(ctx, containerdclient.WithProcessKill); err != nil && !errdefs.IsNotFound(err) {
+			return wrapContainerdErr(err, "failed to delete container task")
+		}
+	}
+	if c.container != nil {
+		if err := c.container.Delete(ctx, containerdclient.WithSnapshotCleanup); err != nil && !errdefs.IsNotFound(err) {
+			return wrapContainerdErr(err, fmt.Sprintf("failed to remove container %s", c.container.ID()))
+		}
+	}
+	if err := c.removeNetwork(ctx); err != nil {
+		return status.UnavailableErrorf("failed to remove container network: %s", err)
+	}
+	return nil
+}
+
+func (c *containerdCommandContainer) Stats(ctx context.Context) (*container.Stats, error) {
+	metric, err := c.task.Metrics(ctx)
+	if err != nil {
+		return nil, wrapContainerdErr(err, "failed to get container metrics")
+	}
+	data, err := typeurl.UnmarshalAny(metric.Data)
+	if err != nil {
+		return nil, status.InternalErrorf("failed to decode container metrics: %s", err)
+	}
+	// The page cache is excluded from memory usage, since it can be
+	// reclaimed, as in `docker stats`.
+	switch m := data.(type) {
+	case *cgroupsv1.Metrics:
+		if m.Memory == nil || m.Memory.Usage == nil {
+			return &container.Stats{}, nil
+		}
+		return &container.Stats{MemoryUsageBytes: int64(m.Memory.Usage.Usage - m.Memory.TotalCache)}, nil
+	case *cgroupsv2.Metrics:
+		if m.Memory == nil {
+			return &container.Stats{}, nil
+		}
+		return &container.Stats{MemoryUsageBytes: int64(m.Memory.Usage - m.Memory.InactiveFile)}, nil
+	default:
+		return nil, status.InternalErrorf("unexpected container metrics type %T", data)
+	}
+}
@@ -0,0 +1,218 @@
+package containerd_test
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/container"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/containers/containerd"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/util/networking"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testauth"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testenv"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testfs"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+	containerdclient "github.com/containerd/containerd"
+)
+
+const (
+	socket = "/run/containerd/containerd.sock"
+	image  = "docker.io/library/busybox"
+)
+
+func newClient(t *testing.T) *containerdclient.Client {
+	client, err := containerd.NewClient(socket)
+	require.NoError(t, err)
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func newContainer(t *testing.T, image, rootDir string, opts *containerd.ContainerdOptions) (context.Context, container.CommandContainer) {
+	env := testenv.GetTestEnv(t)
+	env.SetAuthenticator(testauth.NewTestAuthenticator(testauth.TestUsers("US1", "GR1")))
+	cacheAuth := container.NewImageCacheAuthenticator(container.ImageCacheAuthenticatorOpts{})
+	c := containerd.NewContainerdContainer(env, cacheAuth, newClient(t), image, rootDir, opts)
+	// Need to give enough time to download the image.
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	t.Cleanup(cancel)
+	err := container.PullImageIfNecessary(ctx, env, cacheAuth, c, container.PullCredentials{}, image)
+	require.NoError(t, err)
+	return ctx, c
+}
+
+func makeRootDirWithWorldTxt(t *testing.T) string {
+	rootDir := testfs.MakeTempDir(t)
+	workDir := testfs.MakeDirAll(t, rootDir, "work")
+	testfs.WriteAllFileContents(t, workDir, map[string]string{"world.txt": "world"})
+	return rootDir
+}
+
+func helloWorldCommand() *repb.Command {
+	return &repb.Command{
+		EnvironmentVariables: []*repb.Command_EnvironmentVariable{
+			{Name: "GREETING", Value: "Hello"},
+		},
+		Arguments: []string{"sh", "-c", `printf "$GREETING $(cat world.txt)!"`},
+	}
+}
+
+func TestRunHelloWorld(t *testing.T) {
+	rootDir := makeRootDirWithWorldTxt(t)
+	ctx, c := newContainer(t, image, rootDir, &containerd.ContainerdOptions{})
+
+	result := c.Run(ctx, helloWorldCommand(), "/work", container.PullCredentials{}, nil /*=stdio*/)
+
+	require.NoError(t, result.Error)
+	assert.Equal(t, "Hello world!", string(result.Stdout))
+	assert.Empty(t, string(result.Stderr), "stderr should be empty")
+	assert.Equal(t, 0, result.ExitCode, "should exit with success")
+}
+
+func TestHelloWorldExec(t *testing.T) {
+	rootDir := makeRootDirWithWorldTxt(t)
+	ctx, c := newContainer(t, image, rootDir, &containerd.ContainerdOptions{})
+
+	err := c.Create(ctx, "/work")
+	require.NoError(t, err)
+
+	result := c.Exec(ctx, helloWorldCommand(), nil /*=stdio*/)
+	assert.NoError(t, result.Error)
+	assert.Equal(t, "Hello world!", string(result.Stdout))
+	assert.Empty(t, string(result.Stderr), "stderr should be empty")
+	assert.Equal(t, 0, result.ExitCode, "should exit with success")
+
+	// A paused container should still be usable after unpausing it.
+	require.NoError(t, c.Pause(ctx))
+	stats, err := c.Stats(ctx)
+	require.NoError(t, err)
+	assert.Greater(t, stats.MemoryUsageBytes, int64(0))
+	require.NoError(t, c.Unpause(ctx))
+
+	result = c.Exec(ctx, &repb.Command{Arguments: []string{"sh", "-c", "exit 3"}}, nil /*=stdio*/)
+	assert.NoError(t, result.Error)
+	assert.Equal(t, 3, result.ExitCode)
+
+	err = c.Remove(ctx)
+	assert.NoError(t, err)
+}
+
+func TestExec_Timeout(t *testing.T) {
+	rootDir := testfs.MakeTempDir(t)
+	workDir := testfs.MakeDirAll(t, rootDir, "work")
+	cmd := &repb.Command{Arguments: []string{
+		"sh", "-c", `
+			echo ExampleStdout >&1
+			echo ExampleStderr >&2
+			echo "output" > output.txt
+			# Wait for the context to be canceled
+			sleep 100
+		`,
+	}}
+	ctx, c := newContainer(t, image, rootDir, &containerd.ContainerdOptions{})
+	require.NoError(t, c.Create(ctx, "/work"))
+	t.Cleanup(func() { c.Remove(context.Background()) })
+
+	ctx, cancel := context.WithTimeout(ctx, 1*time.Second)
+	defer cancel()
+	res := c.Exec(ctx, cmd, nil /*=stdio*/)
+
+	assert.True(
+		t, status.IsDeadlineExceededError(res.Error),
+		"expected DeadlineExceeded error, got: %s", res.Error)
+	assert.Less(
+		t, res.ExitCode, 0,
+		"if timed out, exit code should be < 0 (unset)")
+	assert.Equal(t, "ExampleStdout\n", string(res.Stdout))
+	assert.Equal(t, "ExampleStderr\n", string(res.Stderr))
+	output := testfs.ReadFileAsString(t, workDir, "output.txt")
+	assert.Equal(t, "output\n", output)
+}
+
+func TestIsImageCached(t *testing.T) {
+	rootDir := testfs.MakeTempDir(t)
+	env := testenv.GetTestEnv(t)
+	cacheAuth := container.NewImageCacheAuthenticator(container.ImageCacheAuthenticatorOpts{})
+	ctx := context.Background()
+
+	_, c := newContainer(t, image, rootDir, &containerd.ContainerdOptions{})
+	cached, err := c.IsImageCached(ctx)
+	require.NoError(t, err)
+	assert.True(t, cached)
+
+	c = containerd.NewContainerdContainer(env, cacheAuth, newClient(t), "test.image", rootDir, &containerd.ContainerdOptions{})
+	cached, err = c.IsImageCached(ctx)
+	require.NoError(t, err)
+	assert.False(t, cached)
+}
+
+func TestForceRoot(t *testing.T) {
+	rootDir := testfs.MakeTempDir(t)
+	testfs.MakeDirAll(t, rootDir, "work")
+	cmd := &repb.Command{Arguments: []string{"id", "-u"}}
+
+	for _, tc := range []struct {
+		forceRoot bool
+		wantUID   int
+	}{
+		{forceRoot: true, wantUID: 0},
+		{forceRoot: false, wantUID: 1000},
+	} {
+		ctx, c := newContainer(t, "gcr.io/flame-public/test-nonroot:test-enterprise-v1.5.4", rootDir, &containerd.ContainerdOptions{ForceRoot: tc.forceRoot})
+		result := c.Run(ctx, cmd, "/work", container.PullCredentials{}, nil /*=stdio*/)
+		require.NoError(t, result.Error)
+		uid, err := strconv.Atoi(strings.TrimSpace(string(result.Stdout)))
+		assert.NoError(t, err)
+		assert.Equal(t, tc.wantUID, uid)
+	}
+}
+
+func TestNetworkOff(t *testing.T) {
+	rootDir := testfs.MakeTempDir(t)
+	testfs.MakeDirAll(t, rootDir, "work")
+	cmd := &repb.Command{Arguments: []string{"ls", "/sys/class/net"}}
+
+	ctx, c := newContainer(t, image, rootDir, &containerd.ContainerdOptions{Network: &networking.Policy{Mode: networking.Off}})
+	result := c.Run(ctx, cmd, "/work", container.PullCredentials{}, nil /*=stdio*/)
+
+	require.NoError(t, result.Error)
+	assert.Equal(t, "lo\n", string(result.Stdout))
+}
+
+func TestNetworkFull(t *testing.T) {
+	rootDir := testfs.MakeTempDir(t)
+	testfs.MakeDirAll(t, rootDir, "work")
+	cmd := &repb.Command{Arguments: []string{"ls", "/sys/class/net"}}
+
+	ctx, c := newContainer(t, image, rootDir, &containerd.ContainerdOptions{Network: &networking.Policy{Mode: networking.Full}})
+	result := c.Run(ctx, cmd, "/work", container.PullCredentials{}, nil /*=stdio*/)
+
+	// The container gets its own network namespace, connected to the host
+	// with a veth pair, rather than the host's interfaces.
+	require.NoError(t, result.Error)
+	interfaces := strings.Fields(string(result.Stdout))
+	require.Len(t, interfaces, 2)
+	assert.Equal(t, "lo", interfaces[0])
+	assert.True(t, strings.HasPrefix(interfaces[1], "veth0"), "unexpected interface %q", interfaces[1])
+}
+
+func TestNetworkEgress(t *testing.T) {
+	rootDir := testfs.MakeTempDir(t)
+	testfs.MakeDirAll(t, rootDir, "work")
+	// Connections outside of the allowlist are rejected, rather than left to
+	// time out.
+	cmd := &repb.Command{Arguments: []string{"nc", "-w", "5", "198.51.100.1", "80"}}
+
+	policy := &networking.Policy{Mode: networking.Egress, AllowedHosts: []string{"192.0.2.0/24"}}
+	ctx, c := newContainer(t, image, rootDir, &containerd.ContainerdOptions{Network: policy})
+	result := c.Run(ctx, cmd, "/work", container.PullCredentials{}, nil /*=stdio*/)
+
+	require.NoError(t, result.Error)
+	assert.Equal(t, 1, result.ExitCode)
+	assert.Contains(t, string(result.Stderr), "Connection refused")
+}
@@ -17,6 +17,7 @@ import (
 
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/commandutil"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/container"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/util/networking"
 	"github.com/buildbuddy-io/buildbuddy/server/environment"
 	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
 	"github.com/buildbuddy-io/buildbuddy/server/util/log"
@@ -51,8 +52,13 @@ type DockerOptions struct {
 	ForceRoot               bool
 	DockerMountMode         string
 	InheritUserIDs          bool
-	DockerNetwork           string
-	DockerCapAdd            string
+	// Network is the network access of the container. If nil, the
+	// container's network access is not restricted.
+	Network      *networking.Policy
+	DockerCapAdd string
+	// CgroupParent is the cgroup to create containers in, if set. It is a
+	// path relative to the root of the cgroup hierarchy.
+	CgroupParent string
 }
 
 // dockerCommandContainer containerizes a command's execution using a Docker container.
@@ -90,7 +96,7 @@ func NewDockerContainer(env environment.Env, imageCacheAuth *container.ImageCach
 	}
 }
 
-func (r *dockerCommandContainer) Run(ctx context.Context, command *repb.Command, workDir string, creds container.PullCredentials) *interfaces.CommandResult {
+func (r *dockerCommandContainer) Run(ctx context.Context, command *repb.Command, workDir string, creds container.PullCredentials, stdio *interfaces.Stdio) *interfaces.CommandResult {
 	result := &interfaces.CommandResult{
 		CommandDebugString: fmt.Sprintf("(docker) %s", command.GetArguments()),
 		ExitCode:           commandutil.NoExitCode,
@@ -109,6 +115,10 @@ func (r *dockerCommandContainer) Run(ctx context.Context, command *repb.Command,
 		return result
 	}
 
+	if r.options.Network != nil && r.options.Network.Mode == networking.Egress {
+		return r.runWithRestrictedEgress(ctx, command, workDir, stdio)
+	}
+
 	containerCfg, err := r.containerConfig(
 		command.GetArguments(),
 		commandutil.EnvStringList(command),
@@ -155,7 +165,7 @@ func (r *dockerCommandContainer) Run(ctx context.Context, command *repb.Command,
 		}()
 	}()
 
-	r.copyContainerLogs(ctx, cid, result)
+	r.copyContainerLogs(ctx, cid, stdio, result)
 	if result.Error != nil {
 		return result
 	}
@@ -178,7 +188,25 @@ func (r *dockerCommandContainer) Run(ctx context.Context, command *repb.Command,
 	return result
 }
 
-func (r *dockerCommandContainer) copyContainerLogs(ctx context.Context, cid string, result *interfaces.CommandResult) {
+// runWithRestrictedEgress runs the command in a container that is created
+// first, since egress rules can only be applied once the container's network
+// namespace exists, and must be in place before the command starts.
+func (r *dockerCommandContainer) runWithRestrictedEgress(ctx context.Context, command *repb.Command, workDir string, stdio *interfaces.Stdio) *interfaces.CommandResult {
+	if err := r.Create(ctx, workDir); err != nil {
+		if r.id != "" {
+			r.Remove(context.Background())
+		}
+		return commandutil.ErrorResult(err)
+	}
+	defer func() {
+		if err := r.Remove(context.Background()); err != nil {
+			log.Errorf("Failed to remove docker container: %s", err)
+		}
+	}()
+	return r.Exec(ctx, command, stdio)
+}
+
+func (r *dockerCommandContainer) copyContainerLogs(ctx context.Context, cid string, stdio *interfaces.Stdio, result *interfaces.CommandResult) {
 	logOptions := dockertypes.ContainerLogsOptions{
 		ShowStdout: true,
 		ShowStderr: true,
@@ -189,7 +217,7 @@ func (r *dockerCommandContainer) copyContainerLogs(ctx context.Context, cid stri
 		result.Error = wrapDockerErr(err, "failed to get docker container logs")
 		return
 	}
-	err = copyOutputs(logs, result)
+	err = copyOutputs(logs, stdio, result)
 	if closeErr := logs.Close(); closeErr != nil {
 		log.Warningf("Failed to close docker logs: %s", closeErr)
 	}
@@ -235,14 +263,26 @@ func (r *dockerCommandContainer) containerConfig(args, env []string, workDir str
 	}, nil
 }
 
-func (r *dockerCommandContainer) hostConfig(workDir string) *dockercontainer.HostConfig {
-	networkMode := dockercontainer.NetworkMode("")
-	if r.options.UseHostNetwork {
-		networkMode = dockercontainer.NetworkMode("host")
+func (r *dockerCommandContainer) networkMode() dockercontainer.NetworkMode {
+	if r.options.Network != nil {
+		switch r.options.Network.Mode {
+		case networking.Off, networking.Loopback:
+			// Containers on the "none" network only have a loopback
+			// interface.
+			return dockercontainer.NetworkMode("none")
+		case networking.Egress:
+			// Egress rules are applied in the container's network namespace,
+			// so it can't share the host's.
+			return dockercontainer.NetworkMode("")
+		}
 	}
-	if strings.ToLower(r.options.DockerNetwork) == "off" {
-		networkMode = dockercontainer.NetworkMode("none")
+	if r.options.UseHostNetwork {
+		return dockercontainer.NetworkMode("host")
 	}
+	return dockercontainer.NetworkMode("")
+}
+
+func (r *dockerCommandContainer) hostConfig(workDir string) *dockercontainer.HostConfig {
 	capAdd := make([]string, 0)
 	if r.options.DockerCapAdd != "" {
 		capAdd = append(capAdd, strings.Split(r.options.DockerCapAdd, ",")...)
@@ -266,10 +306,11 @@ func (r *dockerCommandContainer) hostConfig(workDir string) *dockercontainer.Hos
 		binds = append(binds, fmt.Sprintf("%s:%s%s", r.options.Socket, r.options.Socket, mountMode))
 	}
 	return &dockercontainer.HostConfig{
-		NetworkMode: networkMode,
+		NetworkMode: r.networkMode(),
 		Binds:       binds,
 		CapAdd:      capAdd,
 		Resources: dockercontainer.Resources{
+			CgroupParent: r.options.CgroupParent,
 			Ulimits: []*units.Ulimit{
 				&units.Ulimit{Name: "nofile", Soft: defaultDockerUlimit, Hard: defaultDockerUlimit},
 			},
@@ -277,17 +318,10 @@ func (r *dockerCommandContainer) hostConfig(workDir string) *dockercontainer.Hos
 	}
 }
 
-func copyOutputs(reader io.Reader, result *interfaces.CommandResult) error {
-	var stdoutBuf, stderrBuf bytes.Buffer
-
-	stdout, stderr := io.Writer(&stdoutBuf), io.Writer(&stderrBuf)
-	if *commandutil.DebugStreamCommandOutputs {
-		stdout, stderr = io.MultiWriter(stdout, os.Stdout), io.MultiWriter(stderr, os.Stderr)
-	}
-
+func copyOutputs(reader io.Reader, stdio *interfaces.Stdio, result *interfaces.CommandResult) error {
+	stdout, stderr, captureOutput := commandutil.StdioWriters(stdio)
 	_, err := stdcopy.StdCopy(stdout, stderr, reader)
-	result.Stdout = stdoutBuf.Bytes()
-	result.Stderr = stderrBuf.Bytes()
+	captureOutput(result)
 	return err
 }
 
@@ -420,21 +454,50 @@ func (r *dockerCommandContainer) create(ctx context.Context, workDir string) err
 	if err := r.client.ContainerStart(ctx, r.id, dockertypes.ContainerStartOptions{}); err != nil {
 		return wrapDockerErr(err, "failed to start container")
 	}
+	if err := r.restrictEgress(ctx); err != nil {
+		return err
+	}
 	r.workDir = workDir
 	return nil
 }
 
-func (r *dockerCommandContainer) Exec(ctx context.Context, command *repb.Command, stdin io.Reader, stdout io.Writer) *interfaces.CommandResult {
+// restrictEgress applies the egress allowlist of the container's network
+// policy, if it has one, to the network namespace of the container.
+func (r *dockerCommandContainer) restrictEgress(ctx context.Context) error {
+	if r.options.Network == nil || r.options.Network.Mode != networking.Egress {
+		return nil
+	}
+	info, err := r.client.ContainerInspect(ctx, r.id)
+	if err != nil {
+		return wrapDockerErr(err, "failed to inspect container")
+	}
+	if info.State == nil || info.State.Pid == 0 {
+		return status.UnavailableErrorf("container %s is not running", r.id)
+	}
+	allowed, err := networking.ResolveAllowedNetworks(ctx, r.options.Network)
+	if err != nil {
+		return err
+	}
+	if err := networking.RestrictEgressOfProcess(ctx, info.State.Pid, allowed); err != nil {
+		return status.UnavailableErrorf("failed to restrict container egress: %s", err)
+	}
+	return nil
+}
+
+func (r *dockerCommandContainer) Exec(ctx context.Context, command *repb.Command, stdio *interfaces.Stdio) *interfaces.CommandResult {
+	if stdio == nil {
+		stdio = &interfaces.Stdio{}
+	}
 	var res *interfaces.CommandResult
 	// Ignore error from this function; it is returned as part of res.
 	commandutil.RetryIfTextFileBusy(func() error {
-		res = r.exec(ctx, command, stdin, stdout)
+		res = r.exec(ctx, command, stdio)
 		return res.Error
 	})
 	return res
 }
 
-func (r *dockerCommandContainer) exec(ctx context.Context, command *repb.Command, stdin io.Reader, stdout io.Writer) *interfaces.CommandResult {
+func (r *dockerCommandContainer) exec(ctx context.Context, command *repb.Command, stdio *interfaces.Stdio) *interfaces.CommandResult {
 	result := &interfaces.CommandResult{
 		CommandDebugString: fmt.Sprintf("(docker) %s", command.GetArguments()),
 		ExitCode:           commandutil.NoExitCode,
@@ -450,7 +513,7 @@ func (r *dockerCommandContainer) exec(ctx context.Context, command *repb.Command
 		WorkingDir:   r.workDir,
 		AttachStdout: true,
 		AttachStderr: true,
-		AttachStdin:  stdin != nil,
+		AttachStdin:  stdio.Stdin != nil,
 		User:         u,
 	}
 	exec, err := r.client.ContainerExecCreate(ctx, r.id, cfg)
@@ -464,18 +527,8 @@ func (r *dockerCommandContainer) exec(ctx context.Context, command *repb.Command
 		return result
 	}
 
-	if stdin != nil {
-		go io.Copy(attachResp.Conn, stdin)
-	}
-
-	var responseReader io.Reader
-	responseReader = attachResp.Reader
-	if stdout != nil {
-		r, w := io.Pipe()
-		defer w.Close()
-		responseReader = io.TeeReader(responseReader, w)
-		// TODO(siggisim): Pipe stderr to the action result's stdout.
-		go stdcopy.StdCopy(stdout, ioutil.Discard, r)
+	if stdio.Stdin != nil {
+		go io.Copy(attachResp.Conn, stdio.Stdin)
 	}
 
 	// note: Close() doesn't return an error, and can be safely called more than once.
@@ -486,7 +539,7 @@ func (r *dockerCommandContainer) exec(ctx context.Context, command *repb.Command
 		<-ctx.Done()
 		attachResp.Close()
 	}()
-	if err := copyOutputs(responseReader, result); err != nil {
+	if err := copyOutputs(attachResp.Reader, stdio, result); err != nil {
 		// If we timed out, ignore the "closed connection" error from copying
 		// outputs
 		if ctx.Err() == context.DeadlineExceeded {
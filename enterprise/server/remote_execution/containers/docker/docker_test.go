@@ -60,7 +60,7 @@ func TestDockerRun(t *testing.T) {
 	cacheAuth := container.NewImageCacheAuthenticator(container.ImageCacheAuthenticatorOpts{})
 	c := docker.NewDockerContainer(env, cacheAuth, dc, "docker.io/library/busybox", rootDir, cfg)
 
-	res := c.Run(ctx, cmd, workDir, container.PullCredentials{})
+	res := c.Run(ctx, cmd, workDir, container.PullCredentials{}, nil /*=stdio*/)
 
 	assert.Equal(t, expectedResult, res)
 }
@@ -125,7 +125,7 @@ func TestDockerLifecycleControl(t *testing.T) {
 	// the docker container.
 	isContainerRunning = true
 
-	res := c.Exec(ctx, cmd, nil, nil)
+	res := c.Exec(ctx, cmd, nil /*=stdio*/)
 
 	require.NoError(t, res.Error)
 	assert.Equal(t, res, expectedResult)
@@ -144,7 +144,7 @@ func TestDockerLifecycleControl(t *testing.T) {
 	assert.Greater(t, stats.MemoryUsageBytes, int64(0))
 
 	// Try executing the same command again after unpausing.
-	res = c.Exec(ctx, cmd, nil, nil)
+	res = c.Exec(ctx, cmd, nil /*=stdio*/)
 
 	require.NoError(t, res.Error)
 	assert.Equal(t, res, expectedResult)
@@ -192,7 +192,7 @@ func TestDockerRun_Timeout_StdoutStderrStillVisible(t *testing.T) {
 	ctx, cancel := context.WithTimeout(ctx, 1*time.Second)
 	defer cancel()
 
-	res := c.Run(ctx, cmd, workDir, container.PullCredentials{})
+	res := c.Run(ctx, cmd, workDir, container.PullCredentials{}, nil /*=stdio*/)
 
 	assert.True(
 		t, status.IsDeadlineExceededError(res.Error),
@@ -252,7 +252,7 @@ func TestDockerExec_Timeout_StdoutStderrStillVisible(t *testing.T) {
 
 	ctx, cancel := context.WithTimeout(ctx, 1*time.Second)
 	defer cancel()
-	res := c.Exec(ctx, cmd, nil /*=stdin*/, nil /*=stdout*/)
+	res := c.Exec(ctx, cmd, nil /*=stdio*/)
 
 	assert.True(
 		t, status.IsDeadlineExceededError(res.Error),
@@ -1,6 +1,10 @@
 package firecracker
 
 import (
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/imagestore"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/util/cgroup"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/util/networking"
+
 	dockerclient "github.com/docker/docker/client"
 )
 
@@ -15,6 +19,15 @@ type ContainerOpts struct {
 	// performed.
 	DockerClient *dockerclient.Client
 
+	// ImageStore can optionally be specified to pull container images into
+	// the executor's image store, which takes priority over DockerClient.
+	ImageStore *imagestore.Store
+
+	// WarmPool can optionally be specified to start the container from a VM
+	// which is already booted, if the pool has one for this image and VM
+	// configuration.
+	WarmPool *WarmPool
+
 	// The action directory with inputs / outputs.
 	ActionWorkingDirectory string
 
@@ -31,10 +44,21 @@ type ContainerOpts struct {
 	// Whether or not to enable networking.
 	EnableNetworking bool
 
+	// Whether or not to bring up the loopback interface when networking is
+	// disabled. It is always up when networking is enabled.
+	EnableLoopback bool
+
+	// If set, the VM may only connect to the hosts allowed by the egress
+	// allowlist of this policy. Requires EnableNetworking.
+	EgressPolicy *networking.Policy
+
 	// Whether or not to initialize dockerd. Docker must be installed in the
 	// VM image in order for this to work.
 	InitDockerd bool
 
+	// If set, the VMM process is run in this cgroup.
+	Cgroup *cgroup.Cgroup
+
 	// Optional flags -- these will default to sane values.
 	// They are here primarily for debugging and running
 	// VMs outside of the normal action-execution framework.
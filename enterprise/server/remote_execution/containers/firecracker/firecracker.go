@@ -5,6 +5,7 @@ package firecracker
 
 import (
 	"context"
+	"crypto/rand"
 	"crypto/sha256"
 	"encoding/json"
 	"fmt"
@@ -24,7 +25,9 @@ import (
 	"github.com/armon/circbuf"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/commandutil"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/container"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/imagestore"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/snaploader"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/util/cgroup"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/util/ext4"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/util/networking"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/util/vfs_server"
@@ -123,6 +126,9 @@ const (
 	vmAddr  = vmIP + "/29"
 	vmIface = "eth0"
 
+	// The nameserver that goinit writes to the VM's /etc/resolv.conf.
+	vmNameserver = "8.8.8.8"
+
 	// https://access.redhat.com/documentation/en-us/red_hat_enterprise_linux/7/html/networking_guide/sec-configuring_ip_networking_from_the_kernel_command_line
 	// ip<client-IP-number>:[<server-id>]:<gateway-IP-number>:<netmask>:<client-hostname>:<interface>:{dhcp|dhcp6|auto6|on|any|none|off}
 	machineIPBootArgs = "ip=" + vmIP + ":::255.255.255.48::" + vmIface + ":off"
@@ -260,6 +266,7 @@ type Constants struct {
 	MemSizeMB         int64
 	ScratchDiskSizeMB int64
 	EnableNetworking  bool
+	EnableLoopback    bool
 	InitDockerd       bool
 	DebugMode         bool
 }
@@ -270,11 +277,13 @@ type FirecrackerContainer struct {
 	vmIdx int    // the index of this vm on the host machine
 
 	constants           Constants
-	containerImage      string // the OCI container image. ex "alpine:latest"
-	actionWorkingDir    string // the action directory with inputs / outputs
-	workspaceGeneration int    // the number of times the workspace has been re-mounted into the guest VM
-	containerFSPath     string // the path to the container ext4 image
-	tempDir             string // path for writing disk images before the chroot is created
+	egressPolicy        *networking.Policy // if set, the egress allowlist of the VM
+	containerImage      string             // the OCI container image. ex "alpine:latest"
+	actionWorkingDir    string             // the action directory with inputs / outputs
+	workspaceGeneration int                // the number of times the workspace has been re-mounted into the guest VM
+	containerFSPath     string             // the path to the container ext4 image
+	tempDir             string             // path for writing disk images before the chroot is created
+	containerFSDir      string             // if set, holds the container's link to its ext4 image in the image store
 
 	rmOnce *sync.Once
 	rmErr  error
@@ -282,12 +291,18 @@ type FirecrackerContainer struct {
 	// dockerClient is used to optimize image pulls by reusing image layers from
 	// the Docker cache as well as deduping multiple requests for the same image.
 	dockerClient *dockerclient.Client
+	// imageStore, if set, is used to pull images instead of dockerClient.
+	imageStore *imagestore.Store
+	// warmPool, if set, provides VMs which are already booted.
+	warmPool *WarmPool
 
 	// when VFS is enabled, this contains the layout for the next execution
 	fsLayout  *container.FileSystemLayout
 	vfsServer *vfs_server.Server
 
 	jailerRoot           string            // the root dir the jailer will work in
+	cgroup               *cgroup.Cgroup    // the cgroup to run the VMM in, if any
+	vmCgroup             *cgroup.Cgroup    // the child of cgroup that the current VMM runs in
 	machine              *fcclient.Machine // the firecracker machine object.
 	vmLog                *VMLog
 	env                  environment.Env
@@ -309,14 +324,23 @@ type FirecrackerContainer struct {
 // ConfigurationHash returns a digest that can be used to look up or save a
 // cached snapshot for this container configuration.
 func (c *FirecrackerContainer) ConfigurationHash() *repb.Digest {
+	return configurationHash(c.constants, c.containerImage)
+}
+
+func configurationHash(constants Constants, containerImage string) *repb.Digest {
 	params := []string{
-		fmt.Sprintf("cpus=%d", c.constants.NumCPUs),
-		fmt.Sprintf("mb=%d", c.constants.MemSizeMB),
-		fmt.Sprintf("scratch=%d", c.constants.ScratchDiskSizeMB),
-		fmt.Sprintf("net=%t", c.constants.EnableNetworking),
-		fmt.Sprintf("dockerd=%t", c.constants.InitDockerd),
-		fmt.Sprintf("debug=%t", c.constants.DebugMode),
-		fmt.Sprintf("container=%s", c.containerImage),
+		fmt.Sprintf("cpus=%d", constants.NumCPUs),
+		fmt.Sprintf("mb=%d", constants.MemSizeMB),
+		fmt.Sprintf("scratch=%d", constants.ScratchDiskSizeMB),
+		fmt.Sprintf("net=%t", constants.EnableNetworking),
+		fmt.Sprintf("dockerd=%t", constants.InitDockerd),
+		fmt.Sprintf("debug=%t", constants.DebugMode),
+		fmt.Sprintf("container=%s", containerImage),
+	}
+	// Only added when set, so that snapshots saved before the loopback
+	// option existed stay valid.
+	if constants.EnableLoopback {
+		params = append(params, "lo=true")
 	}
 	return &repb.Digest{
 		Hash:      hash.String(strings.Join(params, "&")),
@@ -354,16 +378,13 @@ func NewContainer(env environment.Env, imageCacheAuth *container.ImageCacheAuthe
 	}
 
 	c := &FirecrackerContainer{
-		constants: Constants{
-			NumCPUs:           opts.NumCPUs,
-			MemSizeMB:         opts.MemSizeMB,
-			ScratchDiskSizeMB: opts.ScratchDiskSizeMB,
-			EnableNetworking:  opts.EnableNetworking,
-			InitDockerd:       opts.InitDockerd,
-			DebugMode:         opts.DebugMode,
-		},
+		constants:          constantsFromOpts(opts),
+		egressPolicy:       opts.EgressPolicy,
 		jailerRoot:         opts.JailerRoot,
+		cgroup:             opts.Cgroup,
 		dockerClient:       opts.DockerClient,
+		imageStore:         opts.ImageStore,
+		warmPool:           opts.WarmPool,
 		containerImage:     opts.ContainerImage,
 		actionWorkingDir:   opts.ActionWorkingDirectory,
 		env:                env,
@@ -382,6 +403,18 @@ func NewContainer(env environment.Env, imageCacheAuth *container.ImageCacheAuthe
 	return c, nil
 }
 
+func constantsFromOpts(opts ContainerOpts) Constants {
+	return Constants{
+		NumCPUs:           opts.NumCPUs,
+		MemSizeMB:         opts.MemSizeMB,
+		ScratchDiskSizeMB: opts.ScratchDiskSizeMB,
+		EnableNetworking:  opts.EnableNetworking,
+		EnableLoopback:    opts.EnableLoopback,
+		InitDockerd:       opts.InitDockerd,
+		DebugMode:         opts.DebugMode,
+	}
+}
+
 // mergeDiffSnapshot reads from diffSnapshotPath and writes all non-zero blocks into the baseSnapshotPath file.
 func mergeDiffSnapshot(ctx context.Context, baseSnapshotPath string, diffSnapshotPath string, concurrency int, bufSize int) error {
 	ctx, span := tracing.StartSpan(ctx)
@@ -495,6 +528,11 @@ func (c *FirecrackerContainer) SaveSnapshot(ctx context.Context, instanceName st
 	}
 
 	snapshotType := diffSnapshotType
+	if baseSnapshotDigest == nil && c.startedFromSnapshot() {
+		// Dirty pages are only tracked since the snapshot was loaded, so a
+		// diff snapshot would be missing the pages that were never changed.
+		snapshotType = fullSnapshotType
+	}
 	memSnapshotFile := fullMemSnapshotName
 	if baseSnapshotDigest != nil {
 		memSnapshotFile = diffMemSnapshotName
@@ -571,6 +609,19 @@ func (c *FirecrackerContainer) LoadSnapshot(ctx context.Context, workspaceDirOve
 		log.Debugf("LoadSnapshot %s took %s", snapshotDigest.GetHash(), time.Since(start))
 	}()
 
+	if err := c.loadSnapshot(ctx, instanceName, snapshotDigest, false /*=fork*/); err != nil {
+		return err
+	}
+	return c.resumeLoadedSnapshot(ctx, workspaceDirOverride)
+}
+
+// loadSnapshot starts a VMM and loads a VM snapshot into it, leaving the VM
+// paused.
+//
+// If fork is true, the VM gets its own copy of the writable disk images in
+// the snapshot, so that several VMs can be loaded from the same snapshot.
+// The memory snapshot is always mapped copy-on-write, so it can be shared.
+func (c *FirecrackerContainer) loadSnapshot(ctx context.Context, instanceName string, snapshotDigest *repb.Digest, fork bool) error {
 	c.rmOnce = &sync.Once{}
 	c.rmErr = nil
 
@@ -613,6 +664,10 @@ func (c *FirecrackerContainer) LoadSnapshot(ctx context.Context, workspaceDirOve
 		return err
 	}
 
+	if err := c.newVMCgroup(); err != nil {
+		return err
+	}
+
 	vmCtx := context.Background()
 	cmd := c.getJailerCommand(vmCtx)
 	machineOpts := []fcclient.Opt{
@@ -644,6 +699,11 @@ func (c *FirecrackerContainer) LoadSnapshot(ctx context.Context, workspaceDirOve
 	if err := loader.UnpackSnapshot(c.getChroot()); err != nil {
 		return err
 	}
+	if fork {
+		if err := c.copyWritableDisks(ctx); err != nil {
+			return err
+		}
+	}
 
 	machine, err := fcclient.NewMachine(vmCtx, cfg, machineOpts...)
 	if err != nil {
@@ -663,6 +723,13 @@ func (c *FirecrackerContainer) LoadSnapshot(ctx context.Context, workspaceDirOve
 	if err := c.machine.LoadSnapshot(ctx, fullMemSnapshotName, vmStateSnapshotName, enableDiffSnapshotsOpt); err != nil {
 		return status.InternalErrorf("error loading snapshot: %s", err)
 	}
+	return nil
+}
+
+// resumeLoadedSnapshot resumes a VM which was loaded from a snapshot, and
+// initializes the guest. If workspaceDirOverride is set, it also hot-swaps
+// the workspace drive.
+func (c *FirecrackerContainer) resumeLoadedSnapshot(ctx context.Context, workspaceDirOverride string) error {
 	if err := c.machine.ResumeVM(ctx); err != nil {
 		return status.InternalErrorf("error resuming VM: %s", err)
 	}
@@ -673,10 +740,17 @@ func (c *FirecrackerContainer) LoadSnapshot(ctx context.Context, workspaceDirOve
 	}
 	defer conn.Close()
 
+	// Every VM restored from a snapshot starts with the same random number
+	// generator state, so reseed it.
+	entropy := make([]byte, 64)
+	if _, err := rand.Read(entropy); err != nil {
+		return err
+	}
 	execClient := vmxpb.NewExecClient(conn)
 	_, err = execClient.Initialize(ctx, &vmxpb.InitializeRequest{
 		UnixTimestampNanoseconds: time.Now().UnixNano(),
 		ClearArpCache:            true,
+		Entropy:                  entropy,
 	})
 	if err != nil {
 		return status.WrapError(err, "Failed to initialize firecracker VM exec client")
@@ -696,6 +770,43 @@ func (c *FirecrackerContainer) LoadSnapshot(ctx context.Context, workspaceDirOve
 	return nil
 }
 
+// copyWritableDisks replaces the scratch and workspace disk images in the
+// chroot, which are hard links to the files in the snapshot, with copies of
+// them.
+func (c *FirecrackerContainer) copyWritableDisks(ctx context.Context) error {
+	for _, name := range []string{scratchFSName, workspaceFSName} {
+		path := filepath.Join(c.getChroot(), name)
+		if err := copySparseFile(ctx, path, path+".tmp"); err != nil {
+			return status.UnavailableErrorf("failed to copy %s: %s", name, err)
+		}
+		if err := os.Rename(path+".tmp", path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copySparseFile copies src to dst, only writing the regions of src which
+// contain data.
+func copySparseFile(ctx context.Context, src, dst string) error {
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, info.Mode())
+	if err != nil {
+		return err
+	}
+	if err := f.Truncate(info.Size()); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return mergeDiffSnapshot(ctx, dst, src, mergeDiffSnapshotConcurrency, mergeDiffSnapshotBlockSize)
+}
+
 // createWorkspaceImage creates a new ext4 image from the action working dir.
 func (c *FirecrackerContainer) createWorkspaceImage(ctx context.Context, workspacePath string) error {
 	ctx, span := tracing.StartSpan(ctx)
@@ -802,7 +913,18 @@ func (c *FirecrackerContainer) getJailerCommand(ctx context.Context) *exec.Cmd {
 		builder = builder.WithStdin(os.Stdin)
 	}
 	builder = builder.WithStdout(stdout).WithStderr(stderr)
-	return builder.Build(ctx)
+	cmd := builder.Build(ctx)
+	if c.vmCgroup != nil {
+		// The jailer can't be told to use a cgroup v2 cgroup, so it is
+		// started through a shell that first moves itself into the VM's
+		// cgroup. This way the VMM is limited and measured from the start,
+		// before it has allocated any memory. The shell execs the jailer,
+		// which execs the VMM, so they all share a pid.
+		procsPath := filepath.Join(c.vmCgroup.Path(), "cgroup.procs")
+		cmd.Args = append([]string{"sh", "-c", `echo $$ > "$0" && exec "$@"`, procsPath}, cmd.Args...)
+		cmd.Path = "/bin/sh"
+	}
+	return cmd
 }
 
 // getConfig returns the firecracker config for the current container and given
@@ -826,6 +948,8 @@ func (c *FirecrackerContainer) getConfig(ctx context.Context, containerFS, scrat
 	}
 	if c.constants.EnableNetworking {
 		bootArgs = "-set_default_route " + bootArgs
+	} else if c.constants.EnableLoopback {
+		bootArgs = "-enable_loopback " + bootArgs
 	}
 	if c.constants.InitDockerd {
 		bootArgs = "-init_dockerd " + bootArgs
@@ -1097,6 +1221,22 @@ func (c *FirecrackerContainer) setupNetworking(ctx context.Context) error {
 		return err
 	}
 	c.cleanupVethPair = cleanupVethPair
+	return c.restrictEgress(ctx)
+}
+
+// restrictEgress applies the egress allowlist of the container, if it has
+// one, to the traffic that the VM sends through its tap device.
+func (c *FirecrackerContainer) restrictEgress(ctx context.Context) error {
+	if !c.constants.EnableNetworking || c.egressPolicy == nil || c.egressPolicy.Mode != networking.Egress {
+		return nil
+	}
+	allowed, err := networking.ResolveAllowedNetworks(ctx, c.egressPolicy)
+	if err != nil {
+		return err
+	}
+	if err := networking.RestrictForwardedEgressInNamespace(ctx, c.id, tapDeviceName, []net.IP{net.ParseIP(vmNameserver)}, allowed); err != nil {
+		return status.UnavailableErrorf("failed to restrict VM egress: %s", err)
+	}
 	return nil
 }
 
@@ -1155,7 +1295,7 @@ func (c *FirecrackerContainer) SetTaskFileSystemLayout(fsLayout *container.FileS
 //
 // It is approximately the same as calling PullImageIfNecessary, Create,
 // Exec, then Remove.
-func (c *FirecrackerContainer) Run(ctx context.Context, command *repb.Command, actionWorkingDir string, creds container.PullCredentials) *interfaces.CommandResult {
+func (c *FirecrackerContainer) Run(ctx context.Context, command *repb.Command, actionWorkingDir string, creds container.PullCredentials, stdio *interfaces.Stdio) *interfaces.CommandResult {
 	ctx, span := tracing.StartSpan(ctx)
 	defer span.End()
 
@@ -1216,12 +1356,14 @@ func (c *FirecrackerContainer) Run(ctx context.Context, command *repb.Command, a
 		}
 	}()
 
-	cmdResult := c.Exec(ctx, command, nil /*=stdin*/, nil /*=stdout*/)
+	cmdResult := c.Exec(ctx, command, stdio)
 	return cmdResult
 }
 
 // Create creates a new VM and starts a top-level process inside it listening
-// for commands to execute.
+// for commands to execute. If the container has a warm pool, the VM is taken
+// from the pool or forked from its base snapshot when possible, rather than
+// booted.
 func (c *FirecrackerContainer) Create(ctx context.Context, actionWorkingDir string) error {
 	ctx, span := tracing.StartSpan(ctx)
 	defer span.End()
@@ -1236,6 +1378,21 @@ func (c *FirecrackerContainer) Create(ctx context.Context, actionWorkingDir stri
 
 	c.actionWorkingDir = actionWorkingDir
 
+	if c.warmPool != nil {
+		vm, err := c.warmPool.get(ctx, c.ConfigurationHash(), c.containerImage)
+		if err != nil {
+			log.Warningf("Failed to start VM from warm pool; will boot a new VM: %s", err)
+		}
+		if vm != nil {
+			if err := c.adopt(ctx, vm.(*FirecrackerContainer)); err != nil {
+				return err
+			}
+			// VMs in the pool don't have egress rules, since they aren't part
+			// of the VM configuration.
+			return c.restrictEgress(ctx)
+		}
+	}
+
 	var err error
 	c.tempDir, err = os.MkdirTemp(c.jailerRoot, "fc-container-*")
 	if err != nil {
@@ -1269,11 +1426,16 @@ func (c *FirecrackerContainer) Create(ctx context.Context, actionWorkingDir stri
 		return err
 	}
 
+	if err := c.newVMCgroup(); err != nil {
+		return err
+	}
+
 	vmCtx := context.Background()
 
+	jailerCmd := c.getJailerCommand(vmCtx)
 	machineOpts := []fcclient.Opt{
 		fcclient.WithLogger(getLogrusLogger(c.constants.DebugMode)),
-		fcclient.WithProcessRunner(c.getJailerCommand(vmCtx)),
+		fcclient.WithProcessRunner(jailerCmd),
 	}
 
 	m, err := fcclient.NewMachine(vmCtx, *fcCfg, machineOpts...)
@@ -1293,7 +1455,23 @@ func (c *FirecrackerContainer) Create(ctx context.Context, actionWorkingDir stri
 	return nil
 }
 
-func (c *FirecrackerContainer) SendExecRequestToGuest(ctx context.Context, req *vmxpb.ExecRequest) (*vmxpb.ExecResponse, error) {
+// newVMCgroup creates a child of the container's cgroup, if it has one, for
+// the VMM that is about to be started.
+func (c *FirecrackerContainer) newVMCgroup() error {
+	if c.cgroup == nil {
+		return nil
+	}
+	cg, err := cgroup.New(c.cgroup.Path(), "vm-"+c.id)
+	if err != nil {
+		return err
+	}
+	c.vmCgroup = cg
+	return nil
+}
+
+// SendExecRequestToGuest runs a command in the guest, writing its output to
+// stdout and stderr while it runs.
+func (c *FirecrackerContainer) SendExecRequestToGuest(ctx context.Context, req *vmxpb.ExecRequest, stdout, stderr io.Writer) (*vmxpb.ExecResponse, error) {
 	ctx, span := tracing.StartSpan(ctx)
 	defer span.End()
 
@@ -1316,7 +1494,7 @@ func (c *FirecrackerContainer) SendExecRequestToGuest(ctx context.Context, req *
 		req.Timeout = ptypes.DurationProto(time.Until(execDeadline))
 	}
 
-	return c.vmExec(ctx, client, req)
+	return c.vmExec(ctx, client, req, stdout, stderr)
 }
 
 func (c *FirecrackerContainer) dialVMExecServer(ctx context.Context) (*grpc.ClientConn, error) {
@@ -1342,15 +1520,41 @@ func (c *FirecrackerContainer) dialVMExecServer(ctx context.Context) (*grpc.Clie
 	return conn, nil
 }
 
-func (c *FirecrackerContainer) vmExec(ctx context.Context, client vmxpb.ExecClient, req *vmxpb.ExecRequest) (*vmxpb.ExecResponse, error) {
+func (c *FirecrackerContainer) vmExec(ctx context.Context, client vmxpb.ExecClient, req *vmxpb.ExecRequest, stdout, stderr io.Writer) (*vmxpb.ExecResponse, error) {
 	ctx, span := tracing.StartSpan(ctx)
 	defer span.End()
 
-	rsp, err := client.Exec(ctx, req)
+	// Cancelling the stream kills the command, for example if its output
+	// can't be written.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	stream, err := client.ExecStreamed(ctx, req)
 	if err != nil {
 		return nil, status.WrapError(err, "Firecracker exec failed")
 	}
-	return rsp, nil
+	for {
+		msg, err := stream.Recv()
+		if err == io.EOF {
+			return nil, status.InternalError("Firecracker exec failed: stream ended without a response")
+		}
+		if err != nil {
+			return nil, status.WrapError(err, "Firecracker exec failed")
+		}
+		if rsp := msg.GetResponse(); rsp != nil {
+			return rsp, nil
+		}
+		if len(msg.GetStdout()) > 0 {
+			if _, err := stdout.Write(msg.GetStdout()); err != nil {
+				return nil, err
+			}
+		}
+		if len(msg.GetStderr()) > 0 {
+			if _, err := stderr.Write(msg.GetStderr()); err != nil {
+				return nil, err
+			}
+		}
+	}
 }
 
 func (c *FirecrackerContainer) SendPrepareFileSystemRequestToGuest(ctx context.Context, req *vmfspb.PrepareRequest) (*vmfspb.PrepareResponse, error) {
@@ -1383,11 +1587,9 @@ func (c *FirecrackerContainer) SendPrepareFileSystemRequestToGuest(ctx context.C
 
 // Exec runs a command inside a container, with the same working dir set when
 // creating the container.
-// If stdin is non-nil, the contents of stdin reader will be piped to the stdin of
-// the executed process.
-// If stdout is non-nil, the stdout of the executed process will be written to the
-// stdout writer.
-func (c *FirecrackerContainer) Exec(ctx context.Context, cmd *repb.Command, stdin io.Reader, stdout io.Writer) *interfaces.CommandResult {
+// The stdin of stdio is not supported yet. The output of the command is
+// written to the writers of stdio while it runs.
+func (c *FirecrackerContainer) Exec(ctx context.Context, cmd *repb.Command, stdio *interfaces.Stdio) *interfaces.CommandResult {
 	ctx, span := tracing.StartSpan(ctx)
 	defer span.End()
 
@@ -1428,7 +1630,9 @@ func (c *FirecrackerContainer) Exec(ctx context.Context, cmd *repb.Command, stdi
 		})
 	}
 
-	rsp, err := c.SendExecRequestToGuest(ctx, execRequest)
+	stdout, stderr, captureOutput := commandutil.StdioWriters(stdio)
+	defer captureOutput(result)
+	rsp, err := c.SendExecRequestToGuest(ctx, execRequest, stdout, stderr)
 	if err != nil {
 		result.Error = err
 		return result
@@ -1436,6 +1640,9 @@ func (c *FirecrackerContainer) Exec(ctx context.Context, cmd *repb.Command, stdi
 	if rsp.Status != nil {
 		result.Error = gstatus.ErrorProto(rsp.Status)
 	}
+	// Unlike the usage of the container's cgroup, which includes the VMM,
+	// the usage measured in the guest only covers this command.
+	result.UsageStats = rsp.GetUsageStats()
 	// If FUSE is enabled then outputs are already in the workspace.
 	if c.fsLayout == nil {
 		// Command was successful, let's unpack the files back to our
@@ -1458,8 +1665,6 @@ func (c *FirecrackerContainer) Exec(ctx context.Context, cmd *repb.Command, stdi
 	}
 
 	result.ExitCode = int(rsp.GetExitCode())
-	result.Stdout = rsp.GetStdout()
-	result.Stderr = rsp.GetStderr()
 	return result
 }
 
@@ -1467,7 +1672,7 @@ func (c *FirecrackerContainer) IsImageCached(ctx context.Context) (bool, error)
 	ctx, span := tracing.StartSpan(ctx)
 	defer span.End()
 
-	diskImagePath, err := containerutil.CachedDiskImagePath(ctx, c.jailerRoot, c.containerImage)
+	diskImagePath, err := c.cachedDiskImagePath(ctx)
 	if err != nil {
 		return false, err
 	}
@@ -1491,7 +1696,7 @@ func (c *FirecrackerContainer) PullImage(ctx context.Context, creds container.Pu
 	if c.containerFSPath != "" {
 		return nil
 	}
-	containerFSPath, err := containerutil.CreateDiskImage(ctx, c.dockerClient, c.jailerRoot, c.containerImage, creds)
+	containerFSPath, err := c.createDiskImage(ctx, creds)
 	if err != nil {
 		return err
 	}
@@ -1501,6 +1706,61 @@ func (c *FirecrackerContainer) PullImage(ctx context.Context, creds container.Pu
 	return nil
 }
 
+func (c *FirecrackerContainer) cachedDiskImagePath(ctx context.Context) (string, error) {
+	if c.imageStore == nil {
+		return containerutil.CachedDiskImagePath(ctx, c.jailerRoot, c.containerImage)
+	}
+	img, err := c.imageStore.CachedImage(c.containerImage)
+	if err != nil || img == nil {
+		return "", err
+	}
+	path, err := c.imageStoreLinkPath()
+	if err != nil {
+		return "", err
+	}
+	ok, err := c.imageStore.CachedDiskImage(img, path)
+	if err != nil || !ok {
+		return "", err
+	}
+	return path, nil
+}
+
+func (c *FirecrackerContainer) createDiskImage(ctx context.Context, creds container.PullCredentials) (string, error) {
+	if c.imageStore == nil {
+		return containerutil.CreateDiskImage(ctx, c.dockerClient, c.jailerRoot, c.containerImage, creds)
+	}
+	img, err := c.imageStore.Pull(ctx, c.containerImage, creds)
+	if err != nil {
+		return "", err
+	}
+	path, err := c.imageStoreLinkPath()
+	if err != nil {
+		return "", err
+	}
+	if err := c.imageStore.DiskImage(ctx, img, path); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// imageStoreLinkPath returns the path at which the container links its disk
+// image from the image store, so that the disk image outlives its eviction
+// from the store until the container is removed.
+func (c *FirecrackerContainer) imageStoreLinkPath() (string, error) {
+	if c.containerFSDir == "" {
+		dir, err := os.MkdirTemp(c.jailerRoot, "containerfs-*")
+		if err != nil {
+			return "", status.InternalErrorf("failed to create container fs dir: %s", err)
+		}
+		c.containerFSDir = dir
+	}
+	path := filepath.Join(c.containerFSDir, containerFSName)
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return "", status.InternalErrorf("failed to remove container fs link: %s", err)
+	}
+	return path, nil
+}
+
 // Remove kills any processes currently running inside the container and
 // removes any resources associated with the container itself.
 func (c *FirecrackerContainer) Remove(ctx context.Context) error {
@@ -1524,13 +1784,29 @@ func (c *FirecrackerContainer) Remove(ctx context.Context) error {
 func (c *FirecrackerContainer) remove(ctx context.Context) error {
 	var lastErr error
 
-	if err := c.machine.Shutdown(ctx); err != nil {
-		log.Errorf("Error shutting down machine: %s", err)
-		lastErr = err
+	if c.machine != nil {
+		if err := c.machine.Shutdown(ctx); err != nil {
+			log.Errorf("Error shutting down machine: %s", err)
+			lastErr = err
+		}
+		if err := c.machine.StopVMM(); err != nil {
+			log.Errorf("Error stopping VM: %s", err)
+			lastErr = err
+		}
+	} else if c.externalJailerCmd != nil && c.externalJailerCmd.Process != nil {
+		// Loading a snapshot failed after the VMM was started.
+		if err := c.externalJailerCmd.Process.Kill(); err != nil {
+			log.Errorf("Error killing VMM: %s", err)
+			lastErr = err
+		}
+		c.externalJailerCmd.Wait()
 	}
-	if err := c.machine.StopVMM(); err != nil {
-		log.Errorf("Error stopping VM: %s", err)
-		lastErr = err
+	if c.vmCgroup != nil {
+		if err := c.vmCgroup.Remove(); err != nil {
+			log.Errorf("Error removing VM cgroup: %s", err)
+			lastErr = err
+		}
+		c.vmCgroup = nil
 	}
 	if err := c.cleanupNetworking(ctx); err != nil {
 		log.Errorf("Error cleaning up networking: %s", err)
@@ -1542,6 +1818,12 @@ func (c *FirecrackerContainer) remove(ctx context.Context) error {
 			lastErr = err
 		}
 	}
+	if c.containerFSDir != "" {
+		if err := os.RemoveAll(c.containerFSDir); err != nil {
+			log.Errorf("Error removing container fs: %s", err)
+			lastErr = err
+		}
+	}
 	if err := os.RemoveAll(filepath.Dir(c.getChroot())); err != nil {
 		log.Errorf("Error removing chroot: %s", err)
 		lastErr = err
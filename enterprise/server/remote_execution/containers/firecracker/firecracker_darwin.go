@@ -5,7 +5,6 @@ package firecracker
 
 import (
 	"context"
-	"io"
 
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/container"
 	"github.com/buildbuddy-io/buildbuddy/server/environment"
@@ -17,12 +16,29 @@ import (
 
 type FirecrackerContainer struct{}
 
+type WarmPool struct{}
+
+type WarmPoolImage struct {
+	Opts        ContainerOpts
+	Credentials container.PullCredentials
+}
+
+func NewWarmPool(env environment.Env, imageCacheAuth *container.ImageCacheAuthenticator, size int, memoryBytes int64, images []*WarmPoolImage) (*WarmPool, error) {
+	return nil, status.UnimplementedError("Not yet implemented.")
+}
+
+func (p *WarmPool) Start() {}
+
+func (p *WarmPool) Shutdown(ctx context.Context) error {
+	return nil
+}
+
 func NewContainer(env environment.Env, imageCacheAuth *container.ImageCacheAuthenticator, opts ContainerOpts) (*FirecrackerContainer, error) {
 	c := &FirecrackerContainer{}
 	return c, nil
 }
 
-func (c *FirecrackerContainer) Run(ctx context.Context, command *repb.Command, actionWorkingDir string, creds container.PullCredentials) *interfaces.CommandResult {
+func (c *FirecrackerContainer) Run(ctx context.Context, command *repb.Command, actionWorkingDir string, creds container.PullCredentials, stdio *interfaces.Stdio) *interfaces.CommandResult {
 	return &interfaces.CommandResult{}
 }
 
@@ -30,7 +46,7 @@ func (c *FirecrackerContainer) Create(ctx context.Context, actionWorkingDir stri
 	return status.UnimplementedError("Not yet implemented.")
 }
 
-func (c *FirecrackerContainer) Exec(ctx context.Context, cmd *repb.Command, stdin io.Reader, stdout io.Writer) *interfaces.CommandResult {
+func (c *FirecrackerContainer) Exec(ctx context.Context, cmd *repb.Command, stdio *interfaces.Stdio) *interfaces.CommandResult {
 	return &interfaces.CommandResult{}
 }
 
@@ -151,7 +151,7 @@ func TestFirecrackerRunSimple(t *testing.T) {
 	}
 
 	// Run will handle the full lifecycle: no need to call Remove() here.
-	res := c.Run(ctx, cmd, opts.ActionWorkingDirectory, container.PullCredentials{})
+	res := c.Run(ctx, cmd, opts.ActionWorkingDirectory, container.PullCredentials{}, nil /*=stdio*/)
 	if res.Error != nil {
 		t.Fatal(res.Error)
 	}
@@ -214,7 +214,7 @@ func TestFirecrackerLifecycle(t *testing.T) {
 			t.Fatal(err)
 		}
 	})
-	res := c.Exec(ctx, cmd, nil, nil)
+	res := c.Exec(ctx, cmd, nil /*=stdio*/)
 	if res.Error != nil {
 		t.Fatal(res.Error)
 	}
@@ -280,7 +280,7 @@ func TestFirecrackerSnapshotAndResume(t *testing.T) {
 		CommandDebugString: "(firecracker) [sh -c printf \"$GREETING $(cat world.txt)\" && printf \"foo\" >&2]",
 	}
 
-	res := c.Exec(ctx, cmd, nil /*=reader*/, nil /*=writer*/)
+	res := c.Exec(ctx, cmd, nil /*=stdio*/)
 	if res.Error != nil {
 		t.Fatalf("error: %s", res.Error)
 	}
@@ -337,7 +337,7 @@ func TestFirecrackerFileMapping(t *testing.T) {
 		t.Fatal(err)
 	}
 	// Run will handle the full lifecycle: no need to call Remove() here.
-	res := c.Run(ctx, cmd, opts.ActionWorkingDirectory, container.PullCredentials{})
+	res := c.Run(ctx, cmd, opts.ActionWorkingDirectory, container.PullCredentials{}, nil /*=stdio*/)
 	if res.Error != nil {
 		t.Fatalf("error: %s", res.Error)
 	}
@@ -397,7 +397,7 @@ func TestFirecrackerRunStartFromSnapshot(t *testing.T) {
 	}
 	// Run will handle the full lifecycle: no need to call Remove() here.
 	firstRunStart := time.Now()
-	res := c.Run(ctx, cmd, opts.ActionWorkingDirectory, container.PullCredentials{})
+	res := c.Run(ctx, cmd, opts.ActionWorkingDirectory, container.PullCredentials{}, nil /*=stdio*/)
 	firstRunDuration := time.Since(firstRunStart)
 	if res.Error != nil {
 		t.Fatal(res.Error)
@@ -435,7 +435,7 @@ func TestFirecrackerRunStartFromSnapshot(t *testing.T) {
 
 	// Run will handle the full lifecycle: no need to call Remove() here.
 	secondRunStart := time.Now()
-	res = c.Run(ctx, cmd, opts.ActionWorkingDirectory, container.PullCredentials{})
+	res = c.Run(ctx, cmd, opts.ActionWorkingDirectory, container.PullCredentials{}, nil /*=stdio*/)
 	secondRunDuration := time.Since(secondRunStart)
 	if res.Error != nil {
 		t.Fatal(res.Error)
@@ -479,7 +479,7 @@ func TestFirecrackerRunWithNetwork(t *testing.T) {
 	}
 
 	// Run will handle the full lifecycle: no need to call Remove() here.
-	res := c.Run(ctx, cmd, opts.ActionWorkingDirectory, container.PullCredentials{})
+	res := c.Run(ctx, cmd, opts.ActionWorkingDirectory, container.PullCredentials{}, nil /*=stdio*/)
 	if res.Error != nil {
 		t.Fatal(res.Error)
 	}
@@ -511,7 +511,7 @@ func TestFirecrackerRunNOPWithZeroDisk(t *testing.T) {
 	require.NoError(t, err)
 
 	// Run will handle the full lifecycle: no need to call Remove() here.
-	res := c.Run(ctx, cmd, opts.ActionWorkingDirectory, container.PullCredentials{})
+	res := c.Run(ctx, cmd, opts.ActionWorkingDirectory, container.PullCredentials{}, nil /*=stdio*/)
 	require.NoError(t, res.Error)
 	assert.Equal(t, 0, res.ExitCode)
 	assert.Equal(t, "", string(res.Stderr))
@@ -561,7 +561,7 @@ func TestFirecrackerRunWithDocker(t *testing.T) {
 	}
 
 	// Run will handle the full lifecycle: no need to call Remove() here.
-	res := c.Run(ctx, cmd, opts.ActionWorkingDirectory, container.PullCredentials{})
+	res := c.Run(ctx, cmd, opts.ActionWorkingDirectory, container.PullCredentials{}, nil /*=stdio*/)
 	if res.Error != nil {
 		t.Fatal(res.Error)
 	}
@@ -602,7 +602,7 @@ func TestFirecrackerExecWithRecycledWorkspaceWithNewContents(t *testing.T) {
 		err = c.Remove(ctx)
 		assert.NoError(t, err)
 	})
-	res := c.Exec(ctx, &repb.Command{Arguments: []string{"sh", "test1.sh"}}, nil, nil)
+	res := c.Exec(ctx, &repb.Command{Arguments: []string{"sh", "test1.sh"}}, nil /*=stdio*/)
 	require.NoError(t, res.Error)
 	require.Equal(t, "", string(res.Stderr))
 	require.Equal(t, "Hello\n", string(res.Stdout))
@@ -621,7 +621,7 @@ func TestFirecrackerExecWithRecycledWorkspaceWithNewContents(t *testing.T) {
 	err = c.Unpause(ctx)
 	require.NoError(t, err)
 
-	res = c.Exec(ctx, &repb.Command{Arguments: []string{"sh", "test2.sh"}}, nil, nil)
+	res = c.Exec(ctx, &repb.Command{Arguments: []string{"sh", "test2.sh"}}, nil /*=stdio*/)
 
 	require.NoError(t, res.Error)
 	require.Equal(t, "", string(res.Stderr))
@@ -641,7 +641,7 @@ func TestFirecrackerExecWithRecycledWorkspaceWithNewContents(t *testing.T) {
 	err = c.Unpause(ctx)
 	require.NoError(t, err)
 
-	res = c.Exec(ctx, &repb.Command{Arguments: []string{"sh", "test3.sh"}}, nil, nil)
+	res = c.Exec(ctx, &repb.Command{Arguments: []string{"sh", "test3.sh"}}, nil /*=stdio*/)
 
 	require.NoError(t, res.Error)
 	require.Equal(t, "", string(res.Stderr))
@@ -704,7 +704,7 @@ func TestFirecrackerExecWithRecycledWorkspaceWithDocker(t *testing.T) {
 		`},
 		OutputFiles: []string{"preserves.txt"},
 	}
-	res := c.Exec(ctx, cmd, nil, nil)
+	res := c.Exec(ctx, cmd, nil /*=stdio*/)
 	require.NoError(t, res.Error)
 	require.Equal(t, "", string(res.Stderr))
 	require.Equal(t, "Hello\nworld\n", string(res.Stdout))
@@ -737,7 +737,7 @@ func TestFirecrackerExecWithRecycledWorkspaceWithDocker(t *testing.T) {
 	err = c.Unpause(ctx)
 	require.NoError(t, err)
 
-	res = c.Exec(ctx, &repb.Command{Arguments: []string{"sh", "test2.sh"}}, nil, nil)
+	res = c.Exec(ctx, &repb.Command{Arguments: []string{"sh", "test2.sh"}}, nil /*=stdio*/)
 
 	log.Debugf("Resumed VM and executed docker-in-firecracker command in %s", time.Since(start))
 
@@ -800,7 +800,7 @@ func TestFirecrackerExecWithDockerFromSnapshot(t *testing.T) {
 		`},
 	}
 
-	res := c.Exec(ctx, cmd, nil /*=reader*/, nil /*=writer*/)
+	res := c.Exec(ctx, cmd, nil /*=stdio*/)
 
 	require.NoError(t, res.Error)
 	assert.Equal(t, 0, res.ExitCode)
@@ -821,7 +821,7 @@ func TestFirecrackerExecWithDockerFromSnapshot(t *testing.T) {
 		`},
 	}
 
-	res = c.Exec(ctx, cmd, nil /*=reader*/, nil /*=writer*/)
+	res = c.Exec(ctx, cmd, nil /*=stdio*/)
 
 	require.NoError(t, res.Error)
 	assert.Equal(t, 0, res.ExitCode)
@@ -860,7 +860,7 @@ func TestFirecrackerRun_Timeout_DebugOutputIsAvailable(t *testing.T) {
 	`}}
 	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
 	defer cancel()
-	res := c.Run(ctx, cmd, opts.ActionWorkingDirectory, container.PullCredentials{})
+	res := c.Run(ctx, cmd, opts.ActionWorkingDirectory, container.PullCredentials{}, nil /*=stdio*/)
 
 	require.True(
 		t, status.IsDeadlineExceededError(res.Error),
@@ -911,7 +911,7 @@ func TestFirecrackerExec_Timeout_DebugOutputIsAvailable(t *testing.T) {
 	`}}
 	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
 	defer cancel()
-	res := c.Exec(ctx, cmd, nil, nil)
+	res := c.Exec(ctx, cmd, nil /*=stdio*/)
 
 	require.True(
 		t, status.IsDeadlineExceededError(res.Error),
@@ -0,0 +1,547 @@
+//go:build linux && !android
+// +build linux,!android
+
+package firecracker
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/container"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/snaploader"
+	"github.com/buildbuddy-io/buildbuddy/server/environment"
+	"github.com/buildbuddy-io/buildbuddy/server/metrics"
+	"github.com/buildbuddy-io/buildbuddy/server/util/hash"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/perms"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/firecracker-microvm/firecracker-go-sdk/client/operations"
+	"github.com/prometheus/client_golang/prometheus"
+
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+)
+
+const (
+	// How long to wait before retrying after failing to add a VM to the warm
+	// pool.
+	warmPoolRetryDelay = 30 * time.Second
+
+	// How long to allow for a warm VM to be created, including booting the
+	// VM for the base snapshot if needed.
+	warmPoolAddTimeout = 5 * time.Minute
+
+	// How long a group's VMs are kept in the pool after the group last took
+	// one.
+	warmPoolTenantTTL = 1 * time.Hour
+
+	warmPoolHitStatusLabel  = "hit"
+	warmPoolForkStatusLabel = "fork"
+	warmPoolMissStatusLabel = "miss"
+)
+
+// WarmPoolImage describes the VMs that a warm pool keeps for an image.
+type WarmPoolImage struct {
+	// Opts are the options of the containers which are started from the
+	// warm VMs. Only containers with the same image and VM configuration
+	// can use them.
+	Opts ContainerOpts
+
+	// Credentials are used to pull the image.
+	Credentials container.PullCredentials
+}
+
+// memoryBytes returns the memory of each VM for the image.
+func (img *WarmPoolImage) memoryBytes() int64 {
+	return img.Opts.MemSizeMB * 1e6
+}
+
+// WarmPool keeps paused VMs for frequently used images, so that containers
+// can start without booting a VM.
+//
+// VMs are never shared between groups. Once a group runs an action with one
+// of the images, a VM is booted for the group and saved to a base snapshot
+// in the file cache. The group's warm VMs are loaded from its base snapshot
+// and left paused until one of its containers takes one. If no warm VM is
+// available, a container is forked from the base snapshot instead, which is
+// still faster than booting. The guest's random number generator is reseeded
+// whenever a VM is resumed, so VMs loaded from the same snapshot don't share
+// its state.
+//
+// The paused VMs are limited to a memory budget, which the executor reserves
+// for them. When the pool is full, the VMs of the group which least recently
+// took one are evicted first, and groups which haven't taken a VM for a while
+// are removed from the pool.
+type WarmPool struct {
+	env         environment.Env
+	factory     warmVMFactory
+	size        int
+	memoryBytes int64
+	tenantTTL   time.Duration
+	retryDelay  time.Duration
+	images      map[string]*WarmPoolImage
+
+	// refill is signaled when the pool may need more VMs.
+	refill chan struct{}
+
+	// ctx is cancelled when the pool is shut down.
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu              sync.Mutex // protects(isShutdown, tenants, memoryBytesUsed)
+	isShutdown      bool
+	tenants         map[warmPoolTenantKey]*warmPoolTenant
+	memoryBytesUsed int64
+}
+
+type warmPoolTenantKey struct {
+	configurationHash string
+	groupID           string
+}
+
+// warmPoolTenant holds the warm VMs of an image for a group.
+type warmPoolTenant struct {
+	img            *WarmPoolImage
+	groupID        string
+	snapshotDigest *repb.Digest
+	// idle holds the paused VMs which are ready to be taken.
+	idle []warmVM
+	// lastUsed is when the group last requested a VM.
+	lastUsed time.Time
+}
+
+// warmVM is a VM which is kept in the pool.
+type warmVM interface {
+	resumeLoadedSnapshot(ctx context.Context, workspaceDirOverride string) error
+	Remove(ctx context.Context) error
+}
+
+// warmVMFactory creates the VMs in the pool.
+type warmVMFactory interface {
+	// hasSnapshot returns whether the base snapshot is in the file cache.
+	hasSnapshot(ctx context.Context, img *WarmPoolImage, snapshotDigest *repb.Digest) bool
+	// saveBaseSnapshot boots a VM for the image and saves it to the base
+	// snapshot.
+	saveBaseSnapshot(ctx context.Context, img *WarmPoolImage, snapshotDigest *repb.Digest) error
+	// fork loads a new VM from the base snapshot, leaving it paused.
+	fork(ctx context.Context, img *WarmPoolImage, snapshotDigest *repb.Digest) (warmVM, error)
+}
+
+// NewWarmPool returns a warm pool which keeps up to size paused VMs for each
+// of the given images and each group using them, within memoryBytes of VM
+// memory, once started.
+func NewWarmPool(env environment.Env, imageCacheAuth *container.ImageCacheAuthenticator, size int, memoryBytes int64, images []*WarmPoolImage) (*WarmPool, error) {
+	factory := &firecrackerVMFactory{env: env, imageCacheAuth: imageCacheAuth}
+	return newWarmPool(env, factory, size, memoryBytes, images)
+}
+
+func newWarmPool(env environment.Env, factory warmVMFactory, size int, memoryBytes int64, images []*WarmPoolImage) (*WarmPool, error) {
+	if size <= 0 {
+		return nil, status.InvalidArgumentErrorf("invalid warm pool size %d", size)
+	}
+	p := &WarmPool{
+		env:         env,
+		factory:     factory,
+		size:        size,
+		memoryBytes: memoryBytes,
+		tenantTTL:   warmPoolTenantTTL,
+		retryDelay:  warmPoolRetryDelay,
+		images:      make(map[string]*WarmPoolImage, len(images)),
+		refill:      make(chan struct{}, 1),
+		tenants:     make(map[warmPoolTenantKey]*warmPoolTenant),
+	}
+	p.ctx, p.cancel = context.WithCancel(context.Background())
+	for _, img := range images {
+		if img.memoryBytes() > memoryBytes {
+			return nil, status.InvalidArgumentErrorf("warm pool memory of %d bytes is less than the memory of a VM for %q", memoryBytes, img.Opts.ContainerImage)
+		}
+		// Egress rules are applied when a VM is taken from the pool, since
+		// they aren't part of the VM configuration.
+		img.Opts.EgressPolicy = nil
+		d := configurationHash(constantsFromOpts(img.Opts), img.Opts.ContainerImage)
+		p.images[d.GetHash()] = img
+	}
+	return p, nil
+}
+
+// Start fills the pool in the background, and keeps it filled until the pool
+// is shut down.
+func (p *WarmPool) Start() {
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		p.fill()
+	}()
+}
+
+func (p *WarmPool) fill() {
+	for {
+		t, evicted := p.nextTenantToFill()
+		removeWarmVMs(evicted)
+		if t == nil {
+			select {
+			case <-p.ctx.Done():
+				return
+			case <-p.refill:
+			case <-time.After(p.tenantTTL):
+			}
+			continue
+		}
+		if err := p.add(t); err != nil {
+			log.Warningf("Failed to add VM for %q to warm pool: %s", t.img.Opts.ContainerImage, err)
+			select {
+			case <-p.ctx.Done():
+				return
+			case <-time.After(p.retryDelay):
+			}
+		}
+	}
+}
+
+func (p *WarmPool) signalRefill() {
+	select {
+	case p.refill <- struct{}{}:
+	default:
+	}
+}
+
+// nextTenantToFill removes the tenants which haven't been used recently, and
+// returns the most recently used tenant which needs another VM, after
+// reserving memory for it. It also returns the VMs which were evicted to make
+// room for it, which the caller must remove. It returns a nil tenant if no
+// tenant needs a VM, or there is no memory for one.
+func (p *WarmPool) nextTenantToFill() (*warmPoolTenant, []warmVM) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.isShutdown {
+		return nil, nil
+	}
+
+	var evicted []warmVM
+	var next *warmPoolTenant
+	for key, t := range p.tenants {
+		if time.Since(t.lastUsed) > p.tenantTTL {
+			evicted = append(evicted, p.evictLocked(t, len(t.idle))...)
+			delete(p.tenants, key)
+			continue
+		}
+		if len(t.idle) < p.size && (next == nil || t.lastUsed.After(next.lastUsed)) {
+			next = t
+		}
+	}
+	if next == nil {
+		return nil, evicted
+	}
+
+	for p.memoryBytesUsed+next.img.memoryBytes() > p.memoryBytes {
+		// Make room by evicting a VM of the least recently used tenant,
+		// but never one which was used more recently than this one.
+		var lru *warmPoolTenant
+		for _, t := range p.tenants {
+			if len(t.idle) > 0 && t.lastUsed.Before(next.lastUsed) && (lru == nil || t.lastUsed.Before(lru.lastUsed)) {
+				lru = t
+			}
+		}
+		if lru == nil {
+			return nil, evicted
+		}
+		evicted = append(evicted, p.evictLocked(lru, 1)...)
+	}
+	p.memoryBytesUsed += next.img.memoryBytes()
+	return next, evicted
+}
+
+// evictLocked removes the last n idle VMs of the tenant from the pool, and
+// returns them.
+func (p *WarmPool) evictLocked(t *warmPoolTenant, n int) []warmVM {
+	vms := t.idle[len(t.idle)-n:]
+	t.idle = t.idle[:len(t.idle)-n]
+	p.memoryBytesUsed -= int64(n) * t.img.memoryBytes()
+	metrics.FirecrackerWarmPoolCount.Sub(float64(n))
+	return vms
+}
+
+// add adds a paused VM for the tenant to the pool, first saving the base
+// snapshot if it is not in the file cache. The VM's memory must have been
+// reserved.
+func (p *WarmPool) add(t *warmPoolTenant) error {
+	ctx, cancel := context.WithTimeout(p.ctx, warmPoolAddTimeout)
+	defer cancel()
+
+	vm, err := p.newVM(ctx, t)
+	if err != nil {
+		p.mu.Lock()
+		p.memoryBytesUsed -= t.img.memoryBytes()
+		p.mu.Unlock()
+		return err
+	}
+
+	p.mu.Lock()
+	if p.isShutdown {
+		p.mu.Unlock()
+		removeWarmVMs([]warmVM{vm})
+		return nil
+	}
+	t.idle = append(t.idle, vm)
+	metrics.FirecrackerWarmPoolCount.Inc()
+	p.mu.Unlock()
+	return nil
+}
+
+func (p *WarmPool) newVM(ctx context.Context, t *warmPoolTenant) (warmVM, error) {
+	if !p.factory.hasSnapshot(ctx, t.img, t.snapshotDigest) {
+		if err := p.factory.saveBaseSnapshot(ctx, t.img, t.snapshotDigest); err != nil {
+			return nil, status.WrapError(err, "save base snapshot")
+		}
+	}
+	return p.factory.fork(ctx, t.img, t.snapshotDigest)
+}
+
+// tenantSnapshotDigest returns the digest of a group's base snapshot for a VM
+// configuration. The group is part of the digest, since snapshots in the file
+// cache are only keyed by their digest.
+func tenantSnapshotDigest(configurationHash *repb.Digest, groupID string) *repb.Digest {
+	return &repb.Digest{
+		Hash:      hash.String(configurationHash.GetHash() + "/group=" + groupID),
+		SizeBytes: configurationHash.GetSizeBytes(),
+	}
+}
+
+// get returns a running VM with the given configuration for the
+// authenticated group, which is either taken from the pool or forked from the
+// group's base snapshot. It returns nil if neither is available, in which
+// case the caller should boot a new VM.
+func (p *WarmPool) get(ctx context.Context, configurationHash *repb.Digest, containerImage string) (warmVM, error) {
+	img, ok := p.images[configurationHash.GetHash()]
+	if !ok {
+		if p.hasImage(containerImage) {
+			// The image has a warm pool, but this container's VM is configured
+			// differently, for example with more memory.
+			recordWarmPoolRequest(warmPoolMissStatusLabel)
+		}
+		return nil, nil
+	}
+	groupID := ""
+	if u, err := perms.AuthenticatedUser(ctx, p.env); err == nil {
+		groupID = u.GetGroupID()
+	}
+	key := warmPoolTenantKey{configurationHash: configurationHash.GetHash(), groupID: groupID}
+
+	var vm warmVM
+	p.mu.Lock()
+	t, ok := p.tenants[key]
+	if !ok {
+		t = &warmPoolTenant{
+			img:            img,
+			groupID:        groupID,
+			snapshotDigest: tenantSnapshotDigest(configurationHash, groupID),
+		}
+		p.tenants[key] = t
+	}
+	t.lastUsed = time.Now()
+	if len(t.idle) > 0 {
+		vm = p.evictLocked(t, 1)[0]
+	}
+	p.mu.Unlock()
+	p.signalRefill()
+
+	label := warmPoolHitStatusLabel
+	if vm == nil {
+		if !p.factory.hasSnapshot(ctx, img, t.snapshotDigest) {
+			recordWarmPoolRequest(warmPoolMissStatusLabel)
+			return nil, nil
+		}
+		var err error
+		vm, err = p.factory.fork(ctx, img, t.snapshotDigest)
+		if err != nil {
+			recordWarmPoolRequest(warmPoolMissStatusLabel)
+			return nil, err
+		}
+		label = warmPoolForkStatusLabel
+	}
+	if err := vm.resumeLoadedSnapshot(ctx, "" /*=workspaceDirOverride*/); err != nil {
+		removeWarmVMs([]warmVM{vm})
+		recordWarmPoolRequest(warmPoolMissStatusLabel)
+		return nil, err
+	}
+	recordWarmPoolRequest(label)
+	return vm, nil
+}
+
+func (p *WarmPool) hasImage(containerImage string) bool {
+	for _, img := range p.images {
+		if img.Opts.ContainerImage == containerImage {
+			return true
+		}
+	}
+	return false
+}
+
+func recordWarmPoolRequest(statusLabel string) {
+	metrics.FirecrackerWarmPoolRequests.With(prometheus.Labels{
+		metrics.FirecrackerWarmPoolRequestStatusLabel: statusLabel,
+	}).Inc()
+}
+
+func removeWarmVMs(vms []warmVM) {
+	ctx, cancel := context.WithTimeout(context.Background(), finalizationTimeout)
+	defer cancel()
+	for _, vm := range vms {
+		if err := vm.Remove(ctx); err != nil {
+			log.Warningf("Failed to remove warm pool VM: %s", err)
+		}
+	}
+}
+
+// Shutdown stops filling the pool and removes the paused VMs in it.
+func (p *WarmPool) Shutdown(ctx context.Context) error {
+	p.mu.Lock()
+	if p.isShutdown {
+		p.mu.Unlock()
+		return nil
+	}
+	p.isShutdown = true
+	p.cancel()
+	var vms []warmVM
+	for _, t := range p.tenants {
+		vms = append(vms, p.evictLocked(t, len(t.idle))...)
+	}
+	p.mu.Unlock()
+
+	var lastErr error
+	for _, vm := range vms {
+		if err := vm.Remove(ctx); err != nil {
+			lastErr = err
+		}
+	}
+	p.wg.Wait()
+	return lastErr
+}
+
+// firecrackerVMFactory creates the firecracker VMs of a warm pool.
+type firecrackerVMFactory struct {
+	env            environment.Env
+	imageCacheAuth *container.ImageCacheAuthenticator
+}
+
+func (f *firecrackerVMFactory) hasSnapshot(ctx context.Context, img *WarmPoolImage, snapshotDigest *repb.Digest) bool {
+	loader, err := snaploader.New(ctx, f.env, img.Opts.JailerRoot, "" /*=instanceName*/, snapshotDigest)
+	if err != nil {
+		return false
+	}
+	_, err = loader.GetConfigurationData()
+	return err == nil
+}
+
+func (f *firecrackerVMFactory) saveBaseSnapshot(ctx context.Context, img *WarmPoolImage, snapshotDigest *repb.Digest) error {
+	start := time.Now()
+	c, err := NewContainer(f.env, f.imageCacheAuth, img.Opts)
+	if err != nil {
+		return err
+	}
+	if err := container.PullImageIfNecessary(ctx, f.env, f.imageCacheAuth, c, img.Credentials, img.Opts.ContainerImage); err != nil {
+		return err
+	}
+	workDir, err := os.MkdirTemp(img.Opts.JailerRoot, "warm-pool-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(workDir)
+	if err := c.Create(ctx, workDir); err != nil {
+		return err
+	}
+	defer func() {
+		if err := c.Remove(ctx); err != nil {
+			log.Warningf("Failed to remove VM after saving base snapshot: %s", err)
+		}
+	}()
+	if err := c.saveBaseSnapshot(ctx, snapshotDigest); err != nil {
+		return err
+	}
+	log.Infof("Saved base snapshot for %q in %s", img.Opts.ContainerImage, time.Since(start))
+	return nil
+}
+
+func (f *firecrackerVMFactory) fork(ctx context.Context, img *WarmPoolImage, snapshotDigest *repb.Digest) (warmVM, error) {
+	vm, err := NewContainer(f.env, f.imageCacheAuth, img.Opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := vm.loadSnapshot(ctx, "" /*=instanceName*/, snapshotDigest, true /*=fork*/); err != nil {
+		removeWarmVMs([]warmVM{vm})
+		return nil, err
+	}
+	return vm, nil
+}
+
+// saveBaseSnapshot saves a full snapshot of a newly booted VM to the file
+// cache under the given digest. Unlike SaveSnapshot, it leaves the VM
+// paused, since its disk images are now part of the snapshot.
+func (c *FirecrackerContainer) saveBaseSnapshot(ctx context.Context, d *repb.Digest) error {
+	// Wait for init to start the exec server, so that VMs loaded from the
+	// snapshot don't need to wait for it.
+	conn, err := c.dialVMExecServer(ctx)
+	if err != nil {
+		return status.UnavailableErrorf("failed to dial VM exec server: %s", err)
+	}
+	conn.Close()
+
+	if err := c.machine.PauseVM(ctx); err != nil {
+		return status.InternalErrorf("error pausing VM: %s", err)
+	}
+	snapshotTypeOpt := func(params *operations.CreateSnapshotParams) {
+		params.Body.SnapshotType = fullSnapshotType
+	}
+	if err := c.machine.CreateSnapshot(ctx, fullMemSnapshotName, vmStateSnapshotName, snapshotTypeOpt); err != nil {
+		return status.InternalErrorf("error creating snapshot: %s", err)
+	}
+	configJSON, err := json.Marshal(c.constants)
+	if err != nil {
+		return err
+	}
+	opts := &snaploader.LoadSnapshotOptions{
+		ConfigurationData:   configJSON,
+		MemSnapshotPath:     filepath.Join(c.getChroot(), fullMemSnapshotName),
+		VMStateSnapshotPath: filepath.Join(c.getChroot(), vmStateSnapshotName),
+		KernelImagePath:     kernelImagePath,
+		InitrdImagePath:     initrdImagePath,
+		ContainerFSPath:     filepath.Join(c.getChroot(), containerFSName),
+		ScratchFSPath:       filepath.Join(c.getChroot(), scratchFSName),
+		WorkspaceFSPath:     c.workspaceFSPath(),
+		ForceSnapshotDigest: d,
+	}
+	_, err = snaploader.CacheSnapshot(ctx, c.env, "" /*=instanceName*/, c.jailerRoot, opts)
+	return err
+}
+
+// adopt takes over a running VM from the warm pool.
+func (c *FirecrackerContainer) adopt(ctx context.Context, vm *FirecrackerContainer) error {
+	c.id = vm.id
+	c.vmIdx = vm.vmIdx
+	c.machine = vm.machine
+	c.externalJailerCmd = vm.externalJailerCmd
+	c.cleanupVethPair = vm.cleanupVethPair
+	c.vmLog = vm.vmLog
+	c.workspaceGeneration = vm.workspaceGeneration
+	// The VM's VFS server serves the pool's working directory rather than
+	// this container's, so replace it.
+	if vm.vfsServer != nil {
+		vm.vfsServer.Stop()
+	}
+	if err := c.setupVFSServer(ctx); err != nil {
+		return err
+	}
+	// Warm VMs are started before it is known which container will take
+	// them, so their VMM can only be moved into the container's cgroup now.
+	if err := c.newVMCgroup(); err != nil {
+		return err
+	}
+	if c.vmCgroup != nil && c.externalJailerCmd != nil && c.externalJailerCmd.Process != nil {
+		return c.vmCgroup.AddProcess(c.externalJailerCmd.Process.Pid)
+	}
+	return nil
+}
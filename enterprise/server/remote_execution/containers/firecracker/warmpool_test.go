@@ -0,0 +1,246 @@
+//go:build linux && !android
+// +build linux,!android
+
+package firecracker
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testauth"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testenv"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+)
+
+const (
+	testImage     = "docker.io/library/busybox"
+	testVMMemSize = 100
+)
+
+type fakeVM struct {
+	factory        *fakeVMFactory
+	snapshotDigest *repb.Digest
+	resumed        bool
+	removed        bool
+}
+
+func (vm *fakeVM) resumeLoadedSnapshot(ctx context.Context, workspaceDirOverride string) error {
+	vm.factory.mu.Lock()
+	defer vm.factory.mu.Unlock()
+	vm.resumed = true
+	return nil
+}
+
+func (vm *fakeVM) Remove(ctx context.Context) error {
+	vm.factory.mu.Lock()
+	defer vm.factory.mu.Unlock()
+	vm.removed = true
+	return nil
+}
+
+// fakeVMFactory records the snapshots and VMs that the pool creates.
+type fakeVMFactory struct {
+	mu        sync.Mutex
+	snapshots map[string]bool
+	vms       []*fakeVM
+}
+
+func (f *fakeVMFactory) hasSnapshot(ctx context.Context, img *WarmPoolImage, snapshotDigest *repb.Digest) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.snapshots[snapshotDigest.GetHash()]
+}
+
+func (f *fakeVMFactory) saveBaseSnapshot(ctx context.Context, img *WarmPoolImage, snapshotDigest *repb.Digest) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.snapshots[snapshotDigest.GetHash()] = true
+	return nil
+}
+
+func (f *fakeVMFactory) fork(ctx context.Context, img *WarmPoolImage, snapshotDigest *repb.Digest) (warmVM, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	vm := &fakeVM{factory: f, snapshotDigest: snapshotDigest}
+	f.vms = append(f.vms, vm)
+	return vm, nil
+}
+
+// liveVMs returns the VMs forked from the snapshot which haven't been
+// removed.
+func (f *fakeVMFactory) liveVMs(snapshotDigest *repb.Digest) []*fakeVM {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var vms []*fakeVM
+	for _, vm := range f.vms {
+		if vm.snapshotDigest.GetHash() == snapshotDigest.GetHash() && !vm.removed {
+			vms = append(vms, vm)
+		}
+	}
+	return vms
+}
+
+func (f *fakeVMFactory) forkCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.vms)
+}
+
+func (f *fakeVMFactory) isResumed(vm *fakeVM) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return vm.resumed
+}
+
+func newTestWarmPool(t *testing.T, size int, memoryBytes int64) (*WarmPool, *fakeVMFactory, *repb.Digest) {
+	env := testenv.GetTestEnv(t)
+	env.SetAuthenticator(testauth.NewTestAuthenticator(testauth.TestUsers(
+		"US1", "GR1",
+		"US2", "GR2",
+	)))
+	factory := &fakeVMFactory{snapshots: map[string]bool{}}
+	img := &WarmPoolImage{Opts: ContainerOpts{ContainerImage: testImage, MemSizeMB: testVMMemSize}}
+	p, err := newWarmPool(env, factory, size, memoryBytes, []*WarmPoolImage{img})
+	require.NoError(t, err)
+	p.retryDelay = 10 * time.Millisecond
+	t.Cleanup(func() {
+		err := p.Shutdown(context.Background())
+		require.NoError(t, err)
+	})
+	return p, factory, configurationHash(constantsFromOpts(img.Opts), testImage)
+}
+
+func withAuthenticatedUser(t *testing.T, ctx context.Context, userID string) context.Context {
+	jwt, err := testauth.TestJWTForUserID(userID)
+	require.NoError(t, err)
+	return context.WithValue(ctx, "x-buildbuddy-jwt", jwt)
+}
+
+func waitForLiveVMs(t *testing.T, factory *fakeVMFactory, snapshotDigest *repb.Digest, n int) []*fakeVM {
+	require.Eventually(t, func() bool {
+		return len(factory.liveVMs(snapshotDigest)) == n
+	}, 10*time.Second, 5*time.Millisecond)
+	return factory.liveVMs(snapshotDigest)
+}
+
+func TestWarmPool_FillTakeAndRefill(t *testing.T) {
+	p, factory, d := newTestWarmPool(t, 2, 10*testVMMemSize*1e6)
+	p.Start()
+	ctx := withAuthenticatedUser(t, context.Background(), "US1")
+	gr1Snapshot := tenantSnapshotDigest(d, "GR1")
+
+	// The pool only has VMs for groups that have asked for one.
+	vm, err := p.get(ctx, d, testImage)
+	require.NoError(t, err)
+	assert.Nil(t, vm)
+	idle := waitForLiveVMs(t, factory, gr1Snapshot, 2)
+
+	vm, err = p.get(ctx, d, testImage)
+	require.NoError(t, err)
+	require.NotNil(t, vm)
+	assert.Contains(t, idle, vm)
+	assert.True(t, factory.isResumed(vm.(*fakeVM)))
+
+	// The taken VM is replaced.
+	waitForLiveVMs(t, factory, gr1Snapshot, 3)
+
+	// Other groups never get the group's VMs, or VMs from its snapshot.
+	ctx2 := withAuthenticatedUser(t, context.Background(), "US2")
+	vm2, err := p.get(ctx2, d, testImage)
+	require.NoError(t, err)
+	assert.Nil(t, vm2)
+	gr2Snapshot := tenantSnapshotDigest(d, "GR2")
+	assert.NotEqual(t, gr1Snapshot.GetHash(), gr2Snapshot.GetHash())
+	waitForLiveVMs(t, factory, gr2Snapshot, 2)
+	vm2, err = p.get(ctx2, d, testImage)
+	require.NoError(t, err)
+	require.NotNil(t, vm2)
+	assert.Equal(t, gr2Snapshot.GetHash(), vm2.(*fakeVM).snapshotDigest.GetHash())
+}
+
+func TestWarmPool_ForksWhenEmpty(t *testing.T) {
+	// Don't start the pool, so that it never has any idle VMs.
+	p, factory, d := newTestWarmPool(t, 1, testVMMemSize*1e6)
+	ctx := withAuthenticatedUser(t, context.Background(), "US1")
+	snapshot := tenantSnapshotDigest(d, "GR1")
+	err := factory.saveBaseSnapshot(ctx, nil, snapshot)
+	require.NoError(t, err)
+
+	vm, err := p.get(ctx, d, testImage)
+	require.NoError(t, err)
+	require.NotNil(t, vm)
+	assert.Equal(t, snapshot.GetHash(), vm.(*fakeVM).snapshotDigest.GetHash())
+	assert.True(t, factory.isResumed(vm.(*fakeVM)))
+}
+
+func TestWarmPool_OtherConfiguration(t *testing.T) {
+	p, _, _ := newTestWarmPool(t, 1, testVMMemSize*1e6)
+	p.Start()
+	ctx := withAuthenticatedUser(t, context.Background(), "US1")
+	d := configurationHash(Constants{MemSizeMB: 2 * testVMMemSize}, testImage)
+
+	vm, err := p.get(ctx, d, testImage)
+	require.NoError(t, err)
+	assert.Nil(t, vm)
+}
+
+func TestWarmPool_EvictsLeastRecentlyUsedGroup(t *testing.T) {
+	// Only leave room for a single VM.
+	p, factory, d := newTestWarmPool(t, 1, testVMMemSize*1e6)
+	p.Start()
+	ctx1 := withAuthenticatedUser(t, context.Background(), "US1")
+	ctx2 := withAuthenticatedUser(t, context.Background(), "US2")
+
+	_, err := p.get(ctx1, d, testImage)
+	require.NoError(t, err)
+	waitForLiveVMs(t, factory, tenantSnapshotDigest(d, "GR1"), 1)
+
+	// GR2 used the pool more recently, so GR1's VM makes room for its VM.
+	_, err = p.get(ctx2, d, testImage)
+	require.NoError(t, err)
+	waitForLiveVMs(t, factory, tenantSnapshotDigest(d, "GR1"), 0)
+	waitForLiveVMs(t, factory, tenantSnapshotDigest(d, "GR2"), 1)
+
+	vm, err := p.get(ctx2, d, testImage)
+	require.NoError(t, err)
+	require.NotNil(t, vm)
+	assert.Equal(t, tenantSnapshotDigest(d, "GR2").GetHash(), vm.(*fakeVM).snapshotDigest.GetHash())
+}
+
+func TestWarmPool_RemovesUnusedGroups(t *testing.T) {
+	p, factory, d := newTestWarmPool(t, 1, testVMMemSize*1e6)
+	p.tenantTTL = 100 * time.Millisecond
+	p.Start()
+	ctx := withAuthenticatedUser(t, context.Background(), "US1")
+
+	_, err := p.get(ctx, d, testImage)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return factory.forkCount() > 0
+	}, 10*time.Second, 5*time.Millisecond)
+
+	waitForLiveVMs(t, factory, tenantSnapshotDigest(d, "GR1"), 0)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	assert.Empty(t, p.tenants)
+	assert.Zero(t, p.memoryBytesUsed)
+}
+
+func TestWarmPool_ShutdownRemovesVMs(t *testing.T) {
+	p, factory, d := newTestWarmPool(t, 2, 10*testVMMemSize*1e6)
+	p.Start()
+	ctx := withAuthenticatedUser(t, context.Background(), "US1")
+
+	_, err := p.get(ctx, d, testImage)
+	require.NoError(t, err)
+	waitForLiveVMs(t, factory, tenantSnapshotDigest(d, "GR1"), 2)
+
+	err = p.Shutdown(context.Background())
+	require.NoError(t, err)
+	waitForLiveVMs(t, factory, tenantSnapshotDigest(d, "GR1"), 0)
+}
@@ -3,14 +3,18 @@ package podman
 import (
 	"context"
 	"fmt"
-	"io"
+	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/commandutil"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/container"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/imagestore"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/util/cgroup"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/util/networking"
 	"github.com/buildbuddy-io/buildbuddy/server/environment"
 	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
 	"github.com/buildbuddy-io/buildbuddy/server/util/background"
@@ -36,9 +40,19 @@ const (
 
 type PodmanOptions struct {
 	ForceRoot bool
-	Network   string
-	CapAdd    string
-	Runtime   string
+	// Network is the network access of the container. If nil, the
+	// container's network access is not restricted.
+	Network *networking.Policy
+	CapAdd  string
+	Runtime string
+	// CgroupParent is the cgroup to create containers in, if set. It is a
+	// path relative to the root of the cgroup hierarchy.
+	CgroupParent string
+	// ImageStore can optionally be specified to pull images into the store
+	// shared with other isolation types, instead of podman's own image
+	// storage. Containers then run on root filesystems unpacked from the
+	// store.
+	ImageStore *imagestore.Store
 }
 
 // podmanCommandContainer containerizes a command's execution using a Podman container.
@@ -55,6 +69,16 @@ type podmanCommandContainer struct {
 	// name is the container name.
 	name string
 
+	// cgroup is the cgroup of the container created by Create, used to
+	// measure the resources used by each Exec. It is nil if the cgroup could
+	// not be found.
+	cgroup *cgroup.Cgroup
+	// execCount is the number of commands executed in the container.
+	execCount int
+	// rootFSDir is the directory that the image was unpacked into for the
+	// container created by Create, if the image store is used.
+	rootFSDir string
+
 	mu sync.Mutex // protects(removed)
 	// removed is a flag that is set once Remove is called (before actually
 	// removing the container).
@@ -90,7 +114,8 @@ func (c *podmanCommandContainer) getPodmanRunArgs(workDir string) []string {
 	if c.options.ForceRoot {
 		args = append(args, "--user=0:0")
 	}
-	if strings.ToLower(c.options.Network) == "off" {
+	if c.options.Network != nil && !c.options.Network.NeedsInterface() {
+		// Containers on the "none" network only have a loopback interface.
 		args = append(args, "--network=none")
 	}
 	if c.options.CapAdd != "" {
@@ -99,10 +124,13 @@ func (c *podmanCommandContainer) getPodmanRunArgs(workDir string) []string {
 	if c.options.Runtime != "" {
 		args = append(args, "--runtime="+c.options.Runtime)
 	}
+	if c.options.CgroupParent != "" {
+		args = append(args, "--cgroup-parent="+c.options.CgroupParent)
+	}
 	return args
 }
 
-func (c *podmanCommandContainer) Run(ctx context.Context, command *repb.Command, workDir string, creds container.PullCredentials) *interfaces.CommandResult {
+func (c *podmanCommandContainer) Run(ctx context.Context, command *repb.Command, workDir string, creds container.PullCredentials, stdio *interfaces.Stdio) *interfaces.CommandResult {
 	result := &interfaces.CommandResult{
 		CommandDebugString: fmt.Sprintf("(podman) %s", command.GetArguments()),
 		ExitCode:           commandutil.NoExitCode,
@@ -118,14 +146,25 @@ func (c *podmanCommandContainer) Run(ctx context.Context, command *repb.Command,
 		return result
 	}
 
+	if c.options.Network != nil && c.options.Network.Mode == networking.Egress {
+		return c.runWithRestrictedEgress(ctx, command, workDir, stdio)
+	}
+
 	podmanRunArgs := c.getPodmanRunArgs(workDir)
 
+	imageOpts, imageArgs, rootFSDir, err := c.imageArgs(ctx)
+	if err != nil {
+		result.Error = err
+		return result
+	}
+	defer removeRootFS(rootFSDir)
+	podmanRunArgs = append(podmanRunArgs, imageOpts...)
 	for _, envVar := range command.GetEnvironmentVariables() {
 		podmanRunArgs = append(podmanRunArgs, "--env", fmt.Sprintf("%s=%s", envVar.GetName(), envVar.GetValue()))
 	}
-	podmanRunArgs = append(podmanRunArgs, c.image)
+	podmanRunArgs = append(podmanRunArgs, imageArgs...)
 	podmanRunArgs = append(podmanRunArgs, command.Arguments...)
-	result = runPodman(ctx, "run", nil, nil, podmanRunArgs...)
+	result = runPodman(ctx, "run", stdio, podmanRunArgs...)
 	if exitedCleanly := result.ExitCode >= 0; !exitedCleanly {
 		err = killContainerIfRunning(ctx, containerName)
 	}
@@ -135,6 +174,24 @@ func (c *podmanCommandContainer) Run(ctx context.Context, command *repb.Command,
 	return result
 }
 
+// runWithRestrictedEgress runs the command in a container that is created
+// first, since egress rules can only be applied once the container's network
+// namespace exists, and must be in place before the command starts.
+func (c *podmanCommandContainer) runWithRestrictedEgress(ctx context.Context, command *repb.Command, workDir string, stdio *interfaces.Stdio) *interfaces.CommandResult {
+	err := c.Create(ctx, workDir)
+	defer func() {
+		if err := killContainerIfRunning(ctx, c.name); err != nil {
+			log.Warningf("Failed to shut down podman container: %s", err)
+		}
+		removeRootFS(c.rootFSDir)
+		c.rootFSDir = ""
+	}()
+	if err != nil {
+		return commandutil.ErrorResult(err)
+	}
+	return c.Exec(ctx, command, stdio)
+}
+
 func (c *podmanCommandContainer) Create(ctx context.Context, workDir string) error {
 	containerName, err := generateContainerName()
 	if err != nil {
@@ -143,18 +200,117 @@ func (c *podmanCommandContainer) Create(ctx context.Context, workDir string) err
 	c.name = containerName
 
 	podmanRunArgs := c.getPodmanRunArgs(workDir)
-	podmanRunArgs = append(podmanRunArgs, c.image)
+	imageOpts, imageArgs, rootFSDir, err := c.imageArgs(ctx)
+	if err != nil {
+		return err
+	}
+	c.rootFSDir = rootFSDir
+	podmanRunArgs = append(podmanRunArgs, imageOpts...)
+	podmanRunArgs = append(podmanRunArgs, imageArgs...)
 	podmanRunArgs = append(podmanRunArgs, "sleep", "infinity")
-	createResult := runPodman(ctx, "create", nil, nil, podmanRunArgs...)
+	createResult := runPodman(ctx, "create", nil /*=stdio*/, podmanRunArgs...)
 	if err = createResult.Error; err != nil {
 		return status.UnavailableErrorf("failed to create container: %s", err)
 	}
 
-	startResult := runPodman(ctx, "start", nil, nil, c.name)
-	return startResult.Error
+	startResult := runPodman(ctx, "start", nil /*=stdio*/, c.name)
+	if startResult.Error != nil {
+		return startResult.Error
+	}
+	c.cgroup = nil
+	c.execCount = 0
+	if cg, err := c.lookupCgroup(ctx); err != nil {
+		log.Warningf("Failed to find cgroup of podman container %s, its resource usage won't be measured: %s", c.name, err)
+	} else {
+		c.cgroup = cg
+	}
+	return c.restrictEgress(ctx)
+}
+
+// imageArgs returns the options of `podman run` or `podman create` that
+// configure the container for its image, and the arguments that select the
+// image, which precede the command.
+//
+// If the image store is used, the image's root filesystem is unpacked into a
+// new directory, which is returned so that the caller can remove it once the
+// container is gone, and the configuration of the image which podman would
+// otherwise apply is passed as options.
+func (c *podmanCommandContainer) imageArgs(ctx context.Context) (opts, args []string, rootFSDir string, err error) {
+	if c.options.ImageStore == nil {
+		return nil, []string{c.image}, "", nil
+	}
+	img, err := c.options.ImageStore.CachedImage(c.image)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	if img == nil {
+		return nil, nil, "", status.UnavailableErrorf("image %q is not in the image store", c.image)
+	}
+	rootFSDir, err = os.MkdirTemp(c.buildRoot, "rootfs-")
+	if err != nil {
+		return nil, nil, "", status.InternalErrorf("failed to create rootfs dir: %s", err)
+	}
+	if err := c.options.ImageStore.Unpack(ctx, img, rootFSDir); err != nil {
+		removeRootFS(rootFSDir)
+		return nil, nil, "", err
+	}
+	for _, e := range img.Config.Env {
+		opts = append(opts, "--env", e)
+	}
+	if img.Config.User != "" && !c.options.ForceRoot {
+		opts = append(opts, "--user="+img.Config.User)
+	}
+	args = append([]string{"--rootfs", rootFSDir}, img.Config.Entrypoint...)
+	return opts, args, rootFSDir, nil
+}
+
+func removeRootFS(dir string) {
+	if dir == "" {
+		return
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		log.Warningf("Failed to remove podman container rootfs %q: %s", dir, err)
+	}
+}
+
+// lookupCgroup returns the cgroup of the running container.
+func (c *podmanCommandContainer) lookupCgroup(ctx context.Context) (*cgroup.Cgroup, error) {
+	res := runPodman(ctx, "inspect", nil /*=stdio*/, "--format={{.State.CgroupPath}}", c.name)
+	if res.Error != nil {
+		return nil, status.UnavailableErrorf("failed to inspect container: %s", res.Error)
+	}
+	path := strings.TrimSpace(string(res.Stdout))
+	if path == "" {
+		return nil, status.UnavailableErrorf("container %s has no cgroup", c.name)
+	}
+	return cgroup.Open(path)
 }
 
-func (c *podmanCommandContainer) Exec(ctx context.Context, cmd *repb.Command, stdin io.Reader, stdout io.Writer) *interfaces.CommandResult {
+// restrictEgress applies the egress allowlist of the container's network
+// policy, if it has one, to the network namespace of the container.
+func (c *podmanCommandContainer) restrictEgress(ctx context.Context) error {
+	if c.options.Network == nil || c.options.Network.Mode != networking.Egress {
+		return nil
+	}
+	res := runPodman(ctx, "inspect", nil /*=stdio*/, "--format={{.State.Pid}}", c.name)
+	if res.Error != nil {
+		return status.UnavailableErrorf("failed to inspect container: %s", res.Error)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(res.Stdout)))
+	if err != nil || pid == 0 {
+		return status.UnavailableErrorf("failed to get pid of container %s: %q", c.name, string(res.Stdout))
+	}
+	allowed, err := networking.ResolveAllowedNetworks(ctx, c.options.Network)
+	if err != nil {
+		return err
+	}
+	if err := networking.RestrictEgressOfProcess(ctx, pid, allowed); err != nil {
+		return status.UnavailableErrorf("failed to restrict container egress: %s", err)
+	}
+	return nil
+}
+
+func (c *podmanCommandContainer) Exec(ctx context.Context, cmd *repb.Command, stdio *interfaces.Stdio) *interfaces.CommandResult {
 	podmanRunArgs := make([]string, 0, 2*len(cmd.GetEnvironmentVariables())+len(cmd.Arguments)+1)
 	for _, envVar := range cmd.GetEnvironmentVariables() {
 		podmanRunArgs = append(podmanRunArgs, "--env", fmt.Sprintf("%s=%s", envVar.GetName(), envVar.GetValue()))
@@ -162,9 +318,6 @@ func (c *podmanCommandContainer) Exec(ctx context.Context, cmd *repb.Command, st
 	if c.options.ForceRoot {
 		podmanRunArgs = append(podmanRunArgs, "--user=0:0")
 	}
-	if strings.ToLower(c.options.Network) == "off" {
-		podmanRunArgs = append(podmanRunArgs, "--network=none")
-	}
 	podmanRunArgs = append(podmanRunArgs, c.name)
 	podmanRunArgs = append(podmanRunArgs, cmd.Arguments...)
 	// Podman doesn't provide a way to find out whether an exec process was
@@ -173,7 +326,19 @@ func (c *podmanCommandContainer) Exec(ctx context.Context, cmd *repb.Command, st
 	// during a normal execution, so we are overly cautious here and only
 	// interpret this code specially when the container was removed and we are
 	// expecting a SIGKILL as a result.
-	res := runPodman(ctx, "exec", stdin, stdout, podmanRunArgs...)
+	var base *cgroup.Usage
+	if c.cgroup != nil {
+		u, err := c.cgroup.Usage()
+		if err != nil {
+			log.Warningf("Failed to read cgroup usage of podman container %s: %s", c.name, err)
+		}
+		base = u
+	}
+	res := runPodman(ctx, "exec", stdio, podmanRunArgs...)
+	c.execCount++
+	if base != nil {
+		c.recordUsage(res, base)
+	}
 	c.mu.Lock()
 	removed := c.removed
 	c.mu.Unlock()
@@ -184,9 +349,29 @@ func (c *podmanCommandContainer) Exec(ctx context.Context, cmd *repb.Command, st
 	return res
 }
 
+// recordUsage records the resources used by the container's cgroup since base
+// was measured into the result of an exec.
+func (c *podmanCommandContainer) recordUsage(res *interfaces.CommandResult, base *cgroup.Usage) {
+	usage, err := c.cgroup.Usage()
+	if err != nil {
+		log.Warningf("Failed to read cgroup usage of podman container %s: %s", c.name, err)
+		return
+	}
+	res.UsageStats = commandutil.CgroupUsageStats(usage.Sub(base))
+	// The container's peak memory usage can't be reset between execs, so it
+	// only describes the first command executed in the container.
+	if c.execCount != 1 {
+		res.UsageStats.PeakMemoryBytes = 0
+	}
+}
+
 func (c *podmanCommandContainer) IsImageCached(ctx context.Context) (bool, error) {
+	if c.options.ImageStore != nil {
+		img, err := c.options.ImageStore.CachedImage(c.image)
+		return img != nil, err
+	}
 	// Try to avoid the `pull` command which results in a network roundtrip.
-	listResult := runPodman(ctx, "image", nil /*=stdin*/, nil /*=stdout*/, "inspect", "--format={{.ID}}", c.image)
+	listResult := runPodman(ctx, "image", nil /*=stdio*/, "inspect", "--format={{.ID}}", c.image)
 	if listResult.ExitCode == podmanInternalExitCode {
 		return false, nil
 	} else if listResult.Error != nil {
@@ -202,6 +387,10 @@ func (c *podmanCommandContainer) IsImageCached(ctx context.Context) (bool, error
 }
 
 func (c *podmanCommandContainer) PullImage(ctx context.Context, creds container.PullCredentials) error {
+	if c.options.ImageStore != nil {
+		_, err := c.options.ImageStore.Pull(ctx, c.image, creds)
+		return err
+	}
 	podmanArgs := make([]string, 0, 2)
 	if !creds.IsEmpty() {
 		podmanArgs = append(podmanArgs, fmt.Sprintf(
@@ -211,7 +400,7 @@ func (c *podmanCommandContainer) PullImage(ctx context.Context, creds container.
 		))
 	}
 	podmanArgs = append(podmanArgs, c.image)
-	pullResult := runPodman(ctx, "pull", nil /*=stdin*/, nil /*=stdout*/, podmanArgs...)
+	pullResult := runPodman(ctx, "pull", nil /*=stdio*/, podmanArgs...)
 	if pullResult.Error != nil {
 		return pullResult.Error
 	}
@@ -222,17 +411,19 @@ func (c *podmanCommandContainer) Remove(ctx context.Context) error {
 	c.mu.Lock()
 	c.removed = true
 	c.mu.Unlock()
-	res := runPodman(ctx, "kill", nil /*=stdin*/, nil /*=stdout*/, "--signal=KILL", c.name)
+	res := runPodman(ctx, "kill", nil /*=stdio*/, "--signal=KILL", c.name)
+	removeRootFS(c.rootFSDir)
+	c.rootFSDir = ""
 	return res.Error
 }
 
 func (c *podmanCommandContainer) Pause(ctx context.Context) error {
-	res := runPodman(ctx, "pause", nil /*=stdin*/, nil /*=stdout*/, c.name)
+	res := runPodman(ctx, "pause", nil /*=stdio*/, c.name)
 	return res.Error
 }
 
 func (c *podmanCommandContainer) Unpause(ctx context.Context) error {
-	res := runPodman(ctx, "unpause", nil /*=stdin*/, nil /*=stdout*/, c.name)
+	res := runPodman(ctx, "unpause", nil /*=stdio*/, c.name)
 	return res.Error
 }
 
@@ -240,14 +431,17 @@ func (c *podmanCommandContainer) Stats(ctx context.Context) (*container.Stats, e
 	return &container.Stats{}, nil
 }
 
-func runPodman(ctx context.Context, subCommand string, stdin io.Reader, stdout io.Writer, args ...string) *interfaces.CommandResult {
+func runPodman(ctx context.Context, subCommand string, stdio *interfaces.Stdio, args ...string) *interfaces.CommandResult {
 	command := []string{
 		"podman",
 		subCommand,
 	}
 
 	command = append(command, args...)
-	result := commandutil.Run(ctx, &repb.Command{Arguments: command}, "" /*=workDir*/, stdin, stdout)
+	result := commandutil.Run(ctx, &repb.Command{Arguments: command}, "" /*=workDir*/, stdio)
+	// The resources used by the podman CLI say nothing about the container,
+	// whose processes are not its children.
+	result.UsageStats = nil
 	return result
 }
 
@@ -263,7 +457,7 @@ func killContainerIfRunning(ctx context.Context, containerName string) error {
 	ctx, cancel := background.ExtendContextForFinalization(ctx, containerFinalizationTimeout)
 	defer cancel()
 
-	result := runPodman(ctx, "kill", nil, nil, containerName)
+	result := runPodman(ctx, "kill", nil /*=stdio*/, containerName)
 	if result.Error != nil {
 		return result.Error
 	}
@@ -53,7 +53,7 @@ func TestRunHelloWorld(t *testing.T) {
 	cacheAuth := container.NewImageCacheAuthenticator(container.ImageCacheAuthenticatorOpts{})
 
 	podman := podman.NewPodmanCommandContainer(env, cacheAuth, "docker.io/library/busybox", rootDir, &podman.PodmanOptions{})
-	result := podman.Run(ctx, cmd, "/work", container.PullCredentials{})
+	result := podman.Run(ctx, cmd, "/work", container.PullCredentials{}, nil /*=stdio*/)
 
 	require.NoError(t, result.Error)
 	assert.Regexp(t, "^(/usr)?/bin/podman\\s", result.CommandDebugString, "sanity check: command should be run bare")
@@ -87,7 +87,7 @@ func TestHelloWorldExec(t *testing.T) {
 	err := podman.Create(ctx, "/work")
 	require.NoError(t, err)
 
-	result := podman.Exec(ctx, cmd, nil, nil)
+	result := podman.Exec(ctx, cmd, nil /*=stdio*/)
 	assert.NoError(t, result.Error)
 
 	assert.Regexp(t, "^(/usr)?/bin/podman\\s", result.CommandDebugString, "sanity check: command should be run bare")
@@ -128,7 +128,7 @@ func TestRun_Timeout(t *testing.T) {
 	ctx, cancel := context.WithTimeout(ctx, 1*time.Second)
 	defer cancel()
 
-	res := c.Run(ctx, cmd, workDir, container.PullCredentials{})
+	res := c.Run(ctx, cmd, workDir, container.PullCredentials{}, nil /*=stdio*/)
 
 	assert.True(
 		t, status.IsDeadlineExceededError(res.Error),
@@ -176,7 +176,7 @@ func TestExec_Timeout(t *testing.T) {
 	ctx, cancel := context.WithTimeout(ctx, 1*time.Second)
 	defer cancel()
 
-	res := c.Run(ctx, cmd, workDir, container.PullCredentials{})
+	res := c.Run(ctx, cmd, workDir, container.PullCredentials{}, nil /*=stdio*/)
 
 	assert.True(
 		t, status.IsDeadlineExceededError(res.Error),
@@ -275,7 +275,7 @@ func TestForceRoot(t *testing.T) {
 	}
 	for _, tc := range tests {
 		podman := podman.NewPodmanCommandContainer(env, cacheAuth, image, rootDir, &podman.PodmanOptions{ForceRoot: tc.forceRoot})
-		result := podman.Run(ctx, cmd, "/work", container.PullCredentials{})
+		result := podman.Run(ctx, cmd, "/work", container.PullCredentials{}, nil /*=stdio*/)
 		uid, err := strconv.Atoi(strings.TrimSpace(string(result.Stdout)))
 		assert.NoError(t, err)
 		assert.Equal(t, tc.wantUID, uid)
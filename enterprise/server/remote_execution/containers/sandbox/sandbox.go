@@ -0,0 +1,489 @@
+//go:build linux && !android
+// +build linux,!android
+
+// Package sandbox runs commands in lightweight Linux sandboxes, in the spirit
+// of Bazel's linux-sandbox.
+//
+// Each command runs in its own user, mount, PID and network namespace. The
+// root filesystem only contains the host's system directories, bind-mounted
+// read-only, a minimal /dev, a fresh tmpfs on /tmp and the action's working
+// directory, bind-mounted read-write at the same path as on the host. The
+// network namespace only has a loopback interface, which is down if network
+// access is off, so commands have no network access. Since the user namespace
+// maps root inside the sandbox to the user running the executor, no privileges
+// or container daemon are needed.
+//
+// The sandbox is set up by re-executing the executor binary as an init
+// process inside the new namespaces, so executors that enable sandboxing must
+// call Init at the start of main.
+package sandbox
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/commandutil"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/container"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/util/cgroup"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/util/networking"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"golang.org/x/sys/unix"
+
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+)
+
+const (
+	// The argv[0] that the executor binary is re-executed with to set up a
+	// sandbox.
+	initArg0 = "buildbuddy-sandbox-init"
+
+	// The file descriptor that the init process reports setup errors on.
+	initErrorFD = 3
+	// The file descriptor that the init process reads the command's
+	// environment from.
+	initEnvFD = 4
+)
+
+var (
+	// The host directories that make up the sandbox's root filesystem. They
+	// are bind-mounted read-only on an otherwise empty root, so that the
+	// rest of the host filesystem, such as the executor's root directory,
+	// local cache and config, is not visible to commands.
+	rootfsDirs = []string{"/bin", "/etc", "/lib", "/lib32", "/lib64", "/libx32", "/sbin", "/usr"}
+
+	// The host device nodes that are bind-mounted into the sandbox's /dev.
+	devices = []string{"/dev/full", "/dev/null", "/dev/random", "/dev/tty", "/dev/urandom", "/dev/zero"}
+)
+
+// initError is an error that the init process encountered before running the
+// command.
+type initError struct {
+	Message string `json:"message"`
+	// Whether the command's executable could not be found.
+	NotFound bool `json:"not_found,omitempty"`
+}
+
+// commandNotFoundError is returned by the init process if the command's
+// executable could not be found.
+type commandNotFoundError struct {
+	err error
+}
+
+func (e *commandNotFoundError) Error() string { return e.err.Error() }
+func (e *commandNotFoundError) Unwrap() error { return e.err }
+
+type Opts struct {
+	// If set, sandboxes are run in this cgroup.
+	Cgroup *cgroup.Cgroup
+	// Network is the network access of the sandbox, which is either off or
+	// loopback. If nil, the sandbox only has loopback access.
+	Network *networking.Policy
+}
+
+// sandboxCommandContainer runs commands in a Linux sandbox.
+type sandboxCommandContainer struct {
+	WorkDir string
+	opts    Opts
+}
+
+func NewSandboxCommandContainer(opts *Opts) container.CommandContainer {
+	return &sandboxCommandContainer{opts: *opts}
+}
+
+func (c *sandboxCommandContainer) Run(ctx context.Context, command *repb.Command, workDir string, creds container.PullCredentials, stdio *interfaces.Stdio) *interfaces.CommandResult {
+	return run(ctx, command, workDir, stdio, &c.opts)
+}
+
+func (c *sandboxCommandContainer) Create(ctx context.Context, workDir string) error {
+	c.WorkDir = workDir
+	return nil
+}
+
+func (c *sandboxCommandContainer) Exec(ctx context.Context, cmd *repb.Command, stdio *interfaces.Stdio) *interfaces.CommandResult {
+	return run(ctx, cmd, c.WorkDir, stdio, &c.opts)
+}
+
+func (c *sandboxCommandContainer) IsImageCached(ctx context.Context) (bool, error) { return false, nil }
+func (c *sandboxCommandContainer) PullImage(ctx context.Context, creds container.PullCredentials) error {
+	return nil
+}
+func (c *sandboxCommandContainer) Start(ctx context.Context) error   { return nil }
+func (c *sandboxCommandContainer) Remove(ctx context.Context) error  { return nil }
+func (c *sandboxCommandContainer) Pause(ctx context.Context) error   { return nil }
+func (c *sandboxCommandContainer) Unpause(ctx context.Context) error { return nil }
+
+func (c *sandboxCommandContainer) Stats(ctx context.Context) (*container.Stats, error) {
+	return &container.Stats{}, nil
+}
+
+func run(ctx context.Context, command *repb.Command, workDir string, stdio *interfaces.Stdio, opts *Opts) *interfaces.CommandResult {
+	if len(command.GetArguments()) == 0 {
+		return commandutil.ErrorResult(status.InvalidArgumentError("command has no arguments"))
+	}
+	network := networking.Loopback
+	if opts.Network != nil {
+		network = opts.Network.Mode
+	}
+	if network != networking.Off && network != networking.Loopback {
+		return commandutil.ErrorResult(status.InvalidArgumentErrorf("sandboxes do not support network %q", network))
+	}
+	workDir, err := filepath.Abs(workDir)
+	if err != nil {
+		return commandutil.ErrorResult(err)
+	}
+	// The new root is assembled on an empty directory, which is only a mount
+	// point in the sandbox's mount namespace and can be removed right after.
+	newRoot, err := os.MkdirTemp("", "sandbox-root-")
+	if err != nil {
+		return commandutil.ErrorResult(status.UnavailableErrorf("could not create sandbox root: %s", err))
+	}
+	defer os.Remove(newRoot)
+	errReader, errWriter, err := os.Pipe()
+	if err != nil {
+		return commandutil.ErrorResult(status.UnavailableErrorf("could not create pipe: %s", err))
+	}
+	defer errReader.Close()
+	envReader, envWriter, err := os.Pipe()
+	if err != nil {
+		return commandutil.ErrorResult(status.UnavailableErrorf("could not create pipe: %s", err))
+	}
+	defer envReader.Close()
+	go func() {
+		defer envWriter.Close()
+		json.NewEncoder(envWriter).Encode(commandutil.EnvStringList(command))
+	}()
+
+	cmd := exec.Command("/proc/self/exe")
+	cmd.Args = append([]string{initArg0, newRoot, workDir, string(network)}, command.GetArguments()...)
+	// The init process sets up the sandbox while it can still see the host's
+	// filesystem, so the command's environment, which could e.g. set
+	// LD_PRELOAD, is only applied to the command itself.
+	cmd.Env = []string{}
+	var captureOutput func(*interfaces.CommandResult)
+	cmd.Stdout, cmd.Stderr, captureOutput = commandutil.StdioWriters(stdio)
+	if stdio != nil && stdio.Stdin != nil {
+		cmd.Stdin = stdio.Stdin
+	}
+	cmd.ExtraFiles = []*os.File{errWriter, envReader}
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Setpgid:    true,
+		Pdeathsig:  syscall.SIGKILL,
+		Cloneflags: syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS | syscall.CLONE_NEWPID | syscall.CLONE_NEWNET,
+		UidMappings: []syscall.SysProcIDMap{
+			{ContainerID: 0, HostID: os.Getuid(), Size: 1},
+		},
+		GidMappings: []syscall.SysProcIDMap{
+			{ContainerID: 0, HostID: os.Getgid(), Size: 1},
+		},
+	}
+	runErr := commandutil.RunWithProcessTreeCleanupInCgroup(ctx, cmd, opts.Cgroup)
+	errWriter.Close()
+	// Unblock the environment from being written if the init process exited
+	// without reading it.
+	envReader.Close()
+
+	result := &interfaces.CommandResult{
+		CommandDebugString: fmt.Sprintf("(sandbox) %s", command.GetArguments()),
+		UsageStats:         commandutil.UsageStats(cmd.ProcessState),
+	}
+	captureOutput(result)
+	if cmd.Process == nil {
+		result.ExitCode = commandutil.NoExitCode
+		result.Error = status.UnavailableErrorf("could not start sandbox: %s", runErr)
+		return result
+	}
+	// If the init process failed to set up the sandbox or to start the
+	// command, the exit code is the init process's, not the command's.
+	if b, err := io.ReadAll(errReader); err == nil && len(b) > 0 {
+		ie := &initError{}
+		if err := json.Unmarshal(b, ie); err != nil {
+			ie.Message = string(b)
+		}
+		result.ExitCode = commandutil.NoExitCode
+		if ie.NotFound {
+			result.Error = status.NotFoundError(ie.Message)
+		} else {
+			result.Error = status.UnavailableErrorf("could not set up sandbox: %s", ie.Message)
+		}
+		return result
+	}
+	result.ExitCode, result.Error = commandutil.ExitCode(ctx, cmd, runErr)
+	return result
+}
+
+// Init sets up the sandbox and runs the command in it if the current process
+// is the init process of a sandbox, and exits with the command's exit code.
+// Otherwise it does nothing.
+//
+// It must be called at the start of main by binaries that run commands in
+// sandboxes, before any other initialization.
+func Init() {
+	if len(os.Args) < 5 || os.Args[0] != initArg0 {
+		return
+	}
+	errFile := os.NewFile(initErrorFD, "init-error")
+	unix.CloseOnExec(initErrorFD)
+	envFile := os.NewFile(initEnvFD, "init-env")
+	unix.CloseOnExec(initEnvFD)
+	exitCode, err := runInit(os.Args[1], os.Args[2], networking.Mode(os.Args[3]), os.Args[4:], envFile)
+	if err != nil {
+		ie := &initError{Message: err.Error()}
+		var notFoundErr *commandNotFoundError
+		ie.NotFound = errors.As(err, &notFoundErr)
+		b, _ := json.Marshal(ie)
+		errFile.Write(b)
+		os.Exit(1)
+	}
+	os.Exit(exitCode)
+}
+
+// runInit sets up the sandbox at newRoot and runs args in workDir inside it,
+// with the environment read from envFile. It returns the command's exit code,
+// or an error if the command could not be started.
+func runInit(newRoot, workDir string, network networking.Mode, args []string, envFile *os.File) (int, error) {
+	var env []string
+	if err := json.NewDecoder(envFile).Decode(&env); err != nil {
+		return 0, fmt.Errorf("could not read command environment: %s", err)
+	}
+	envFile.Close()
+	if err := setUpMounts(newRoot, workDir); err != nil {
+		return 0, err
+	}
+	if network == networking.Loopback {
+		if err := setUpLoopback(); err != nil {
+			return 0, err
+		}
+	}
+	if err := pivotRoot(newRoot); err != nil {
+		return 0, err
+	}
+
+	// The init process is PID 1 in the sandbox, so when it exits, every
+	// process the command left behind is killed. Run the command as a child
+	// rather than exec'ing it, so that orphans are reaped until then.
+	// The executable is looked up in the command's PATH.
+	path := ""
+	for _, v := range env {
+		if strings.HasPrefix(v, "PATH=") {
+			path = strings.TrimPrefix(v, "PATH=")
+		}
+	}
+	if err := os.Setenv("PATH", path); err != nil {
+		return 0, err
+	}
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Dir = workDir
+	cmd.Env = env
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		// Executables that are looked up in the PATH fail with an
+		// *exec.Error, and executable paths fail with an *fs.PathError.
+		var execErr *exec.Error
+		if errors.As(err, &execErr) || errors.Is(err, fs.ErrNotExist) {
+			return 0, &commandNotFoundError{err}
+		}
+		return 0, err
+	}
+	err := cmd.Wait()
+	if err == nil {
+		return 0, nil
+	}
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok {
+		return 0, err
+	}
+	// Signals can't be re-raised by PID 1, so report them like a shell does.
+	if ws, ok := exitErr.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		return 128 + int(ws.Signal()), nil
+	}
+	return exitErr.ExitCode(), nil
+}
+
+func setUpMounts(newRoot, workDir string) error {
+	// Don't propagate any of the mounts below to the host.
+	if err := unix.Mount("", "/", "", unix.MS_REC|unix.MS_PRIVATE, ""); err != nil {
+		return status.UnavailableErrorf("make mounts private: %s", err)
+	}
+	// The root starts out empty and writable so that mount points can be
+	// created, and is made read-only once they are.
+	if err := unix.Mount("tmpfs", newRoot, "tmpfs", unix.MS_NOSUID|unix.MS_NODEV, "mode=0755"); err != nil {
+		return status.UnavailableErrorf("mount rootfs: %s", err)
+	}
+	for _, dir := range rootfsDirs {
+		if err := bindReadOnly(newRoot, dir); err != nil {
+			return status.UnavailableErrorf("bind-mount %s: %s", dir, err)
+		}
+	}
+	if err := setUpDev(newRoot); err != nil {
+		return err
+	}
+	for _, dir := range []string{"proc", "sys", "tmp"} {
+		if err := os.Mkdir(filepath.Join(newRoot, dir), 0755); err != nil {
+			return status.UnavailableErrorf("create /%s mount point: %s", dir, err)
+		}
+	}
+	if err := unix.Mount("tmpfs", filepath.Join(newRoot, "tmp"), "tmpfs", unix.MS_NOSUID|unix.MS_NODEV, "mode=1777"); err != nil {
+		return status.UnavailableErrorf("mount /tmp: %s", err)
+	}
+	if err := unix.Mount("proc", filepath.Join(newRoot, "proc"), "proc", unix.MS_NOSUID|unix.MS_NODEV|unix.MS_NOEXEC, ""); err != nil {
+		return status.UnavailableErrorf("mount /proc: %s", err)
+	}
+	// A fresh sysfs only shows the sandbox's own network interfaces.
+	if err := unix.Mount("sysfs", filepath.Join(newRoot, "sys"), "sysfs", unix.MS_RDONLY|unix.MS_NOSUID|unix.MS_NODEV|unix.MS_NOEXEC, ""); err != nil {
+		return status.UnavailableErrorf("mount /sys: %s", err)
+	}
+	// The working directory is mounted last, since it may be below /tmp.
+	workDirMountPoint := filepath.Join(newRoot, workDir)
+	if err := os.MkdirAll(workDirMountPoint, 0755); err != nil {
+		return status.UnavailableErrorf("create working directory mount point: %s", err)
+	}
+	if err := unix.Mount(workDir, workDirMountPoint, "", unix.MS_BIND|unix.MS_REC, ""); err != nil {
+		return status.UnavailableErrorf("bind-mount working directory: %s", err)
+	}
+	if err := unix.Mount("", newRoot, "", unix.MS_REMOUNT|unix.MS_BIND|unix.MS_RDONLY|unix.MS_NOSUID|unix.MS_NODEV, ""); err != nil {
+		return status.UnavailableErrorf("make rootfs read-only: %s", err)
+	}
+	return nil
+}
+
+// bindReadOnly bind-mounts the host path at the same path below newRoot,
+// read-only. Symlinks, like /bin on merged-/usr systems, are recreated rather
+// than mounted, and paths that don't exist on the host are skipped.
+func bindReadOnly(newRoot, path string) error {
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	target := filepath.Join(newRoot, path)
+	if info.Mode()&os.ModeSymlink != 0 {
+		link, err := os.Readlink(path)
+		if err != nil {
+			return err
+		}
+		return os.Symlink(link, target)
+	}
+	if err := os.MkdirAll(target, 0755); err != nil {
+		return err
+	}
+	if err := unix.Mount(path, target, "", unix.MS_BIND|unix.MS_REC, ""); err != nil {
+		return err
+	}
+	return remountReadOnly(target)
+}
+
+// setUpDev creates a minimal /dev below newRoot, with the host's basic device
+// nodes and a private /dev/shm.
+func setUpDev(newRoot string) error {
+	dev := filepath.Join(newRoot, "dev")
+	if err := os.MkdirAll(filepath.Join(dev, "shm"), 0755); err != nil {
+		return status.UnavailableErrorf("create /dev: %s", err)
+	}
+	for _, device := range devices {
+		if _, err := os.Stat(device); err != nil {
+			continue
+		}
+		target := filepath.Join(newRoot, device)
+		if err := os.WriteFile(target, nil, 0644); err != nil {
+			return status.UnavailableErrorf("create %s mount point: %s", device, err)
+		}
+		if err := unix.Mount(device, target, "", unix.MS_BIND, ""); err != nil {
+			return status.UnavailableErrorf("bind-mount %s: %s", device, err)
+		}
+	}
+	for name, link := range map[string]string{
+		"fd":     "/proc/self/fd",
+		"stdin":  "/proc/self/fd/0",
+		"stdout": "/proc/self/fd/1",
+		"stderr": "/proc/self/fd/2",
+	} {
+		if err := os.Symlink(link, filepath.Join(dev, name)); err != nil {
+			return status.UnavailableErrorf("create /dev/%s: %s", name, err)
+		}
+	}
+	if err := unix.Mount("tmpfs", filepath.Join(dev, "shm"), "tmpfs", unix.MS_NOSUID|unix.MS_NODEV, "mode=1777"); err != nil {
+		return status.UnavailableErrorf("mount /dev/shm: %s", err)
+	}
+	return nil
+}
+
+// remountReadOnly makes the bind mount at path, and all mounts below it,
+// read-only.
+func remountReadOnly(path string) error {
+	err := unix.MountSetattr(-1, path, unix.AT_RECURSIVE, &unix.MountAttr{Attr_set: unix.MOUNT_ATTR_RDONLY})
+	if err != unix.ENOSYS {
+		return err
+	}
+	// Kernels older than 5.12 can only remount one mount at a time, so only
+	// the top-level mount is made read-only. Flags that are locked because
+	// the mount came from a more privileged mount namespace must be kept.
+	var st unix.Statfs_t
+	if err := unix.Statfs(path, &st); err != nil {
+		return err
+	}
+	flags := uintptr(unix.MS_BIND | unix.MS_REMOUNT | unix.MS_RDONLY)
+	for _, f := range []struct{ st, ms uintptr }{
+		{unix.ST_NOSUID, unix.MS_NOSUID},
+		{unix.ST_NODEV, unix.MS_NODEV},
+		{unix.ST_NOEXEC, unix.MS_NOEXEC},
+		{unix.ST_NOATIME, unix.MS_NOATIME},
+		{unix.ST_NODIRATIME, unix.MS_NODIRATIME},
+		{unix.ST_RELATIME, unix.MS_RELATIME},
+	} {
+		if uintptr(st.Flags)&f.st != 0 {
+			flags |= f.ms
+		}
+	}
+	return unix.Mount("", path, "", flags, "")
+}
+
+// setUpLoopback brings up the loopback interface of the sandbox's network
+// namespace, which is its only network interface.
+func setUpLoopback() error {
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return status.UnavailableErrorf("open socket: %s", err)
+	}
+	defer unix.Close(fd)
+	ifr, err := unix.NewIfreq("lo")
+	if err != nil {
+		return err
+	}
+	if err := unix.IoctlIfreq(fd, unix.SIOCGIFFLAGS, ifr); err != nil {
+		return status.UnavailableErrorf("get loopback flags: %s", err)
+	}
+	ifr.SetUint16(ifr.Uint16() | unix.IFF_UP)
+	if err := unix.IoctlIfreq(fd, unix.SIOCSIFFLAGS, ifr); err != nil {
+		return status.UnavailableErrorf("bring up loopback: %s", err)
+	}
+	return nil
+}
+
+// pivotRoot makes newRoot the root of the mount namespace and detaches the
+// old root, so that the rest of the host filesystem is unreachable.
+func pivotRoot(newRoot string) error {
+	if err := os.Chdir(newRoot); err != nil {
+		return err
+	}
+	// Stacks the old root on top of the new one, from where it is unmounted.
+	if err := unix.PivotRoot(".", "."); err != nil {
+		return status.UnavailableErrorf("pivot_root: %s", err)
+	}
+	if err := unix.Unmount(".", unix.MNT_DETACH); err != nil {
+		return status.UnavailableErrorf("unmount old root: %s", err)
+	}
+	return os.Chdir("/")
+}
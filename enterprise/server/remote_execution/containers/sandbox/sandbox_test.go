@@ -0,0 +1,130 @@
+//go:build linux && !android
+// +build linux,!android
+
+package sandbox_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/container"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/containers/sandbox"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/util/networking"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testfs"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+)
+
+func TestMain(m *testing.M) {
+	// The test binary is re-executed to set up sandboxes.
+	sandbox.Init()
+	os.Exit(m.Run())
+}
+
+func run(t *testing.T, workDir string, args ...string) (string, string, int) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	cmd := &repb.Command{
+		Arguments: args,
+		EnvironmentVariables: []*repb.Command_EnvironmentVariable{
+			{Name: "PATH", Value: "/usr/local/bin:/usr/bin:/bin"},
+			{Name: "GREETING", Value: "Hello"},
+		},
+	}
+	c := sandbox.NewSandboxCommandContainer(&sandbox.Opts{})
+	require.NoError(t, c.Create(ctx, workDir))
+	result := c.Exec(ctx, cmd, nil /*=stdio*/)
+	require.NoError(t, result.Error)
+	return string(result.Stdout), string(result.Stderr), result.ExitCode
+}
+
+func TestSandbox_WorkDir(t *testing.T) {
+	workDir := testfs.MakeTempDir(t)
+	testfs.WriteAllFileContents(t, workDir, map[string]string{"world.txt": "world"})
+
+	stdout, stderr, exitCode := run(t, workDir, "sh", "-c", `printf "$GREETING $(cat world.txt)!" && echo out > out.txt`)
+
+	assert.Equal(t, "Hello world!", stdout)
+	assert.Empty(t, stderr)
+	assert.Equal(t, 0, exitCode)
+	out, err := os.ReadFile(filepath.Join(workDir, "out.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "out\n", string(out))
+}
+
+func TestSandbox_Isolation(t *testing.T) {
+	workDir := testfs.MakeTempDir(t)
+	// The sandbox gets its own /tmp.
+	hostTmpFile, err := os.CreateTemp("/tmp", "sandbox-test-")
+	require.NoError(t, err)
+	hostTmpFile.Close()
+	t.Cleanup(func() { os.Remove(hostTmpFile.Name()) })
+	// Host paths outside of the system directories, like the test binary,
+	// aren't visible.
+	hostPath, err := os.Executable()
+	require.NoError(t, err)
+
+	stdout, _, exitCode := run(t, workDir, "sh", "-c", `
+		touch /usr/sandbox-test 2>/dev/null && echo "rootfs writable"
+		touch /tmp/x || echo "tmp not writable"
+		ls /sys/class/net | grep -v '^lo$' && echo "host network visible"
+		[ "$PPID" = 1 ] || echo "not in a new PID namespace"
+		ls `+hostTmpFile.Name()+` 2>/dev/null && echo "host /tmp visible"
+		ls `+hostPath+` 2>/dev/null && echo "host filesystem visible"
+		touch /sandbox-test 2>/dev/null && echo "root writable"
+		echo x > /dev/null || echo "/dev/null not writable"
+		exit 3
+	`)
+
+	assert.Empty(t, stdout)
+	assert.Equal(t, 3, exitCode)
+}
+
+func TestSandbox_Network(t *testing.T) {
+	for _, tc := range []struct {
+		mode     networking.Mode
+		expected string
+	}{
+		// The loopback interface is only up with loopback access.
+		{networking.Off, "lo 0x8\n"},
+		{networking.Loopback, "lo 0x9\n"},
+	} {
+		workDir := testfs.MakeTempDir(t)
+		cmd := &repb.Command{
+			Arguments:            []string{"sh", "-c", `for i in $(ls /sys/class/net); do echo "$i $(cat /sys/class/net/$i/flags)"; done`},
+			EnvironmentVariables: []*repb.Command_EnvironmentVariable{{Name: "PATH", Value: "/usr/bin:/bin"}},
+		}
+		opts := &sandbox.Opts{Network: &networking.Policy{Mode: tc.mode}}
+
+		result := sandbox.NewSandboxCommandContainer(opts).Run(context.Background(), cmd, workDir, container.PullCredentials{}, nil /*=stdio*/)
+
+		require.NoError(t, result.Error, tc.mode)
+		assert.Equal(t, tc.expected, string(result.Stdout), tc.mode)
+	}
+
+	// Sandboxes can't reach any other network.
+	for _, policy := range []*networking.Policy{
+		{Mode: networking.Egress, AllowedHosts: []string{"example.com"}},
+		{Mode: networking.Full},
+	} {
+		cmd := &repb.Command{Arguments: []string{"true"}}
+		opts := &sandbox.Opts{Network: policy}
+		result := sandbox.NewSandboxCommandContainer(opts).Run(context.Background(), cmd, testfs.MakeTempDir(t), container.PullCredentials{}, nil /*=stdio*/)
+		assert.True(t, status.IsInvalidArgumentError(result.Error), "expected InvalidArgument error for %s, got %v", policy.Mode, result.Error)
+	}
+}
+
+func TestSandbox_ExecutableNotFound(t *testing.T) {
+	workDir := testfs.MakeTempDir(t)
+	cmd := &repb.Command{Arguments: []string{"/does/not/exist"}}
+
+	result := sandbox.NewSandboxCommandContainer(&sandbox.Opts{}).Run(context.Background(), cmd, workDir, container.PullCredentials{}, nil /*=stdio*/)
+
+	assert.True(t, status.IsNotFoundError(result.Error), "expected NotFound error, got %v", result.Error)
+}
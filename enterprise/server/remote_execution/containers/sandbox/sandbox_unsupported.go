@@ -0,0 +1,56 @@
+//go:build !linux || android
+// +build !linux android
+
+package sandbox
+
+import (
+	"context"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/commandutil"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/container"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/util/cgroup"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/util/networking"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+)
+
+type Opts struct {
+	Cgroup  *cgroup.Cgroup
+	Network *networking.Policy
+}
+
+type sandboxCommandContainer struct{}
+
+func NewSandboxCommandContainer(opts *Opts) container.CommandContainer {
+	return &sandboxCommandContainer{}
+}
+
+// Init does nothing, since sandboxes are only supported on Linux.
+func Init() {}
+
+func (c *sandboxCommandContainer) Run(ctx context.Context, command *repb.Command, workDir string, creds container.PullCredentials, stdio *interfaces.Stdio) *interfaces.CommandResult {
+	return commandutil.ErrorResult(status.UnimplementedError("Sandboxes are only supported on Linux."))
+}
+
+func (c *sandboxCommandContainer) Create(ctx context.Context, workDir string) error {
+	return status.UnimplementedError("Sandboxes are only supported on Linux.")
+}
+
+func (c *sandboxCommandContainer) Exec(ctx context.Context, cmd *repb.Command, stdio *interfaces.Stdio) *interfaces.CommandResult {
+	return commandutil.ErrorResult(status.UnimplementedError("Sandboxes are only supported on Linux."))
+}
+
+func (c *sandboxCommandContainer) IsImageCached(ctx context.Context) (bool, error) { return false, nil }
+func (c *sandboxCommandContainer) PullImage(ctx context.Context, creds container.PullCredentials) error {
+	return nil
+}
+func (c *sandboxCommandContainer) Start(ctx context.Context) error   { return nil }
+func (c *sandboxCommandContainer) Remove(ctx context.Context) error  { return nil }
+func (c *sandboxCommandContainer) Pause(ctx context.Context) error   { return nil }
+func (c *sandboxCommandContainer) Unpause(ctx context.Context) error { return nil }
+
+func (c *sandboxCommandContainer) Stats(ctx context.Context) (*container.Stats, error) {
+	return &container.Stats{}, nil
+}
@@ -39,6 +39,17 @@ type TransferInfo struct {
 	// Exists tracks the files that already existed, keyed by their
 	// workspace-relative paths.
 	Exists map[string]*repb.FileNode
+	// Removed tracks the files of the previous tree that are no longer in the
+	// downloaded tree, keyed by their workspace-relative paths. It is only set
+	// when diffing against a previous tree.
+	Removed map[string]*repb.FileNode
+	// Replaced tracks the files of the previous tree that were deleted because
+	// a file or directory of the downloaded tree replaced them or their
+	// parent directory, keyed by their workspace-relative paths. It is only
+	// set when diffing against a previous tree.
+	Replaced map[string]*repb.FileNode
+	// Tree is the downloaded tree, indexed by digest.
+	Tree *IndexedTree
 }
 
 // DirHelper is a poor mans trie that helps us check if a partial path like
@@ -283,11 +294,20 @@ func uploadFiles(ctx context.Context, env environment.Env, instanceName string,
 	return uploader.Wait()
 }
 
-func UploadTree(ctx context.Context, env environment.Env, dirHelper *DirHelper, instanceName, rootDir string, actionResult *repb.ActionResult) (*TransferInfo, error) {
+// UploadTree uploads the outputs of an action under rootDir, and adds them to
+// actionResult. If maxBytes is positive and the output files are larger than
+// maxBytes in total, it returns RESOURCE_EXHAUSTED without uploading any of
+// them.
+func UploadTree(ctx context.Context, env environment.Env, dirHelper *DirHelper, instanceName, rootDir string, maxBytes int64, actionResult *repb.ActionResult) (*TransferInfo, error) {
 	txInfo := &TransferInfo{}
 	startTime := time.Now()
 	filesToUpload := make([]*fileToUpload, 0)
+	totalBytes := int64(0)
 	uploadFileFn := func(parentDir string, info os.FileInfo) (*repb.FileNode, error) {
+		totalBytes += info.Size()
+		if maxBytes > 0 && totalBytes > maxBytes {
+			return nil, status.ResourceExhaustedErrorf("output files exceeded the limit of %d bytes", maxBytes)
+		}
 		uploadableFile, err := newFileToUpload(instanceName, parentDir, info)
 		if err != nil {
 			return nil, err
@@ -655,6 +675,12 @@ func fetchDir(ctx context.Context, bsClient bspb.ByteStreamClient, reqDigest *di
 	return dir, nil
 }
 
+// IndexedTree is a tree whose directories are indexed by digest.
+type IndexedTree struct {
+	RootDigest *repb.Digest
+	DirMap     map[digest.Key]*repb.Directory
+}
+
 func DirMapFromTree(tree *repb.Tree) (rootDigest *repb.Digest, dirMap map[digest.Key]*repb.Directory, err error) {
 	dirMap = make(map[digest.Key]*repb.Directory, 1+len(tree.Children))
 
@@ -726,6 +752,15 @@ type DownloadTreeOpts struct {
 	// TrackTransfers specifies whether to record the full set of files downloaded
 	// and return them in TransferInfo.Transfers.
 	TrackTransfers bool
+	// PreviousTree is the tree that was last downloaded to the same directory,
+	// if any. Directories whose digests haven't changed since then are assumed
+	// to be intact and are not walked, so TransferInfo.Exists only covers the
+	// directories that changed. Files of the previous tree that are no longer
+	// in the tree are returned in TransferInfo.Removed, but are not deleted.
+	// Files and directories of the previous tree whose paths are now
+	// directories or files are deleted, and their files are returned in
+	// TransferInfo.Replaced.
+	PreviousTree *IndexedTree
 }
 
 func DownloadTree(ctx context.Context, env environment.Env, instanceName string, tree *repb.Tree, rootDir string, opts *DownloadTreeOpts) (*TransferInfo, error) {
@@ -759,9 +794,31 @@ func downloadTree(ctx context.Context, env environment.Env, instanceName string,
 		dirPerms = 0777
 	}
 
+	var prevDirMap map[digest.Key]*repb.Directory
+	if opts.PreviousTree != nil {
+		prevDirMap = opts.PreviousTree.DirMap
+		txInfo.Removed = map[string]*repb.FileNode{}
+		txInfo.Replaced = map[string]*repb.FileNode{}
+	}
+	// trackPrevFilesFn records all files under the given directory of the
+	// previous tree in the given map.
+	var trackPrevFilesFn func(prevDir *repb.Directory, parentDir string, m map[string]*repb.FileNode)
+	trackPrevFilesFn = func(prevDir *repb.Directory, parentDir string, m map[string]*repb.FileNode) {
+		for _, node := range prevDir.GetFiles() {
+			m[trimPathPrefix(filepath.Join(parentDir, node.GetName()), rootDir)] = node
+		}
+		for _, child := range prevDir.GetDirectories() {
+			if childDir, ok := prevDirMap[digest.NewKey(child.GetDigest())]; ok {
+				trackPrevFilesFn(childDir, filepath.Join(parentDir, child.GetName()), m)
+			}
+		}
+	}
+
 	filesToFetch := make(map[digest.Key][]*FilePointer, 0)
-	var fetchDirFn func(dir *repb.Directory, parentDir string) error
-	fetchDirFn = func(dir *repb.Directory, parentDir string) error {
+	// fetchDirFn walks the given directory, along with the directory that was
+	// previously downloaded to the same path, if any.
+	var fetchDirFn func(dir, prevDir *repb.Directory, parentDir string) error
+	fetchDirFn = func(dir, prevDir *repb.Directory, parentDir string) error {
 		for _, fileNode := range dir.GetFiles() {
 			func(node *repb.FileNode, location string) {
 				d := node.GetDigest()
@@ -789,8 +846,60 @@ func downloadTree(ctx context.Context, env environment.Env, instanceName string,
 				trackTransfersFn(relPath, node)
 			}(fileNode, parentDir)
 		}
+		prevChildren := make(map[string]*repb.DirectoryNode, len(prevDir.GetDirectories()))
+		if prevDir != nil {
+			files := make(map[string]bool, len(dir.GetFiles()))
+			for _, node := range dir.GetFiles() {
+				files[node.GetName()] = true
+			}
+			dirs := make(map[string]bool, len(dir.GetDirectories()))
+			for _, child := range dir.GetDirectories() {
+				dirs[child.GetName()] = true
+			}
+			for _, node := range prevDir.GetFiles() {
+				if files[node.GetName()] {
+					continue
+				}
+				fullPath := filepath.Join(parentDir, node.GetName())
+				relPath := trimPathPrefix(fullPath, rootDir)
+				if !dirs[node.GetName()] {
+					txInfo.Removed[relPath] = node
+					continue
+				}
+				// The file is now a directory, which can only be created
+				// once the file is gone.
+				if err := os.Remove(fullPath); err != nil && !os.IsNotExist(err) {
+					return err
+				}
+				txInfo.Replaced[relPath] = node
+			}
+			for _, child := range prevDir.GetDirectories() {
+				prevChildren[child.GetName()] = child
+				if dirs[child.GetName()] {
+					continue
+				}
+				fullPath := filepath.Join(parentDir, child.GetName())
+				removed := txInfo.Removed
+				if files[child.GetName()] {
+					// The directory is now a file, which can only be
+					// downloaded once the directory is gone.
+					if err := os.RemoveAll(fullPath); err != nil {
+						return err
+					}
+					removed = txInfo.Replaced
+				}
+				if childDir, ok := prevDirMap[digest.NewKey(child.GetDigest())]; ok {
+					trackPrevFilesFn(childDir, fullPath, removed)
+				}
+			}
+		}
 		for _, child := range dir.GetDirectories() {
 			newRoot := filepath.Join(parentDir, child.GetName())
+			prevChild, ok := prevChildren[child.GetName()]
+			if ok && digest.NewKey(prevChild.GetDigest()) == digest.NewKey(child.GetDigest()) {
+				// Unchanged since the previous download.
+				continue
+			}
 			if err := os.MkdirAll(newRoot, dirPerms); err != nil {
 				return err
 			}
@@ -801,7 +910,15 @@ func downloadTree(ctx context.Context, env environment.Env, instanceName string,
 			if !ok {
 				return digest.MissingDigestError(child.GetDigest())
 			}
-			if err := fetchDirFn(childDir, newRoot); err != nil {
+			var prevChildDir *repb.Directory
+			if prevChild != nil {
+				prevChildDir = prevDirMap[digest.NewKey(prevChild.GetDigest())]
+				if prevChildDir == nil {
+					// Empty directories may not be in the previous tree.
+					prevChildDir = &repb.Directory{}
+				}
+			}
+			if err := fetchDirFn(childDir, prevChildDir, newRoot); err != nil {
 				return err
 			}
 		}
@@ -813,9 +930,21 @@ func downloadTree(ctx context.Context, env environment.Env, instanceName string,
 		return nil
 	}
 	// Create the directory structure and track files to download.
-	if err := fetchDirFn(dirMap[digest.NewKey(rootDirectoryDigest)], rootDir); err != nil {
-		return nil, err
+	rootKey := digest.NewKey(rootDirectoryDigest)
+	if opts.PreviousTree == nil {
+		if err := fetchDirFn(dirMap[rootKey], nil, rootDir); err != nil {
+			return nil, err
+		}
+	} else if digest.NewKey(opts.PreviousTree.RootDigest) != rootKey {
+		prevRoot := prevDirMap[digest.NewKey(opts.PreviousTree.RootDigest)]
+		if prevRoot == nil {
+			prevRoot = &repb.Directory{}
+		}
+		if err := fetchDirFn(dirMap[rootKey], prevRoot, rootDir); err != nil {
+			return nil, err
+		}
 	}
+	txInfo.Tree = &IndexedTree{RootDigest: rootDirectoryDigest, DirMap: dirMap}
 
 	ff := NewBatchFileFetcher(ctx, instanceName, env.GetFileCache(), env.GetByteStreamClient(), env.GetContentAddressableStorageClient())
 
@@ -2,6 +2,7 @@ package dirtools_test
 
 import (
 	"context"
+	"os"
 	"path/filepath"
 	"testing"
 
@@ -135,6 +136,155 @@ func TestDownloadTreeEmptyDigest(t *testing.T) {
 	assert.FileExists(t, filepath.Join(tmpDir, "file_notempty.txt"), "file_notempty.txt should exist")
 }
 
+func TestDownloadTreeWithPreviousTree(t *testing.T) {
+	env, ctx := testEnv(t)
+	tmpDir := testfs.MakeTempDir(t)
+	instanceName := "foo"
+	fileADigest := setFile(t, env, ctx, instanceName, "mytestdataA")
+	fileBDigest := setFile(t, env, ctx, instanceName, "mytestdataB")
+	fileCDigest := setFile(t, env, ctx, instanceName, "mytestdataC")
+
+	unchangedDir := &repb.Directory{
+		Files: []*repb.FileNode{{Name: "fileA.txt", Digest: fileADigest}},
+	}
+	unchangedDigest, err := digest.ComputeForMessage(unchangedDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	removedDir := &repb.Directory{
+		Files: []*repb.FileNode{{Name: "fileB.txt", Digest: fileBDigest}},
+	}
+	removedDigest, err := digest.ComputeForMessage(removedDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	previous := &repb.Tree{
+		Root: &repb.Directory{
+			Files: []*repb.FileNode{{Name: "fileB.txt", Digest: fileBDigest}},
+			Directories: []*repb.DirectoryNode{
+				{Name: "unchanged", Digest: unchangedDigest},
+				{Name: "removed", Digest: removedDigest},
+			},
+		},
+		Children: []*repb.Directory{unchangedDir, removedDir},
+	}
+	opts := &dirtools.DownloadTreeOpts{TrackTransfers: true}
+	info, err := dirtools.DownloadTree(ctx, env, instanceName, previous, tmpDir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, int64(3), info.FileCount, "three files were transferred")
+	assert.Nil(t, info.Removed, "nothing was diffed")
+
+	// Files in unchanged directories are assumed to be intact, so this file
+	// should not be downloaded again.
+	if err := os.Remove(filepath.Join(tmpDir, "unchanged/fileA.txt")); err != nil {
+		t.Fatal(err)
+	}
+
+	tree := &repb.Tree{
+		Root: &repb.Directory{
+			Files: []*repb.FileNode{{Name: "fileC.txt", Digest: fileCDigest}},
+			Directories: []*repb.DirectoryNode{
+				{Name: "unchanged", Digest: unchangedDigest},
+			},
+		},
+		Children: []*repb.Directory{unchangedDir},
+	}
+	opts = &dirtools.DownloadTreeOpts{
+		Skip:           info.Transfers,
+		TrackTransfers: true,
+		PreviousTree:   info.Tree,
+	}
+	info, err = dirtools.DownloadTree(ctx, env, instanceName, tree, tmpDir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, int64(1), info.FileCount, "one file was transferred")
+	assert.Equal(t, map[string]*repb.FileNode{"fileC.txt": tree.Root.Files[0]}, info.Transfers)
+	assert.ElementsMatch(t, []string{"fileB.txt", "removed/fileB.txt"}, keys(info.Removed))
+	assert.FileExists(t, filepath.Join(tmpDir, "fileC.txt"), "fileC.txt should exist")
+	assert.NoFileExists(t, filepath.Join(tmpDir, "unchanged/fileA.txt"), "fileA.txt should not be downloaded again")
+
+	// Nothing needs to be done if the tree is unchanged.
+	opts.PreviousTree = info.Tree
+	info, err = dirtools.DownloadTree(ctx, env, instanceName, tree, tmpDir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, int64(0), info.FileCount, "no files were transferred")
+	assert.Empty(t, info.Removed, "no files were removed")
+}
+
+func TestDownloadTreeWithPreviousTree_TypeChange(t *testing.T) {
+	env, ctx := testEnv(t)
+	tmpDir := testfs.MakeTempDir(t)
+	instanceName := "foo"
+	fileADigest := setFile(t, env, ctx, instanceName, "mytestdataA")
+	fileBDigest := setFile(t, env, ctx, instanceName, "mytestdataB")
+
+	childDir := &repb.Directory{
+		Files: []*repb.FileNode{{Name: "fileA.txt", Digest: fileADigest}},
+	}
+	childDigest, err := digest.ComputeForMessage(childDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// "a" starts out as a file and "b" as a directory.
+	previous := &repb.Tree{
+		Root: &repb.Directory{
+			Files:       []*repb.FileNode{{Name: "a", Digest: fileBDigest}},
+			Directories: []*repb.DirectoryNode{{Name: "b", Digest: childDigest}},
+		},
+		Children: []*repb.Directory{childDir},
+	}
+	opts := &dirtools.DownloadTreeOpts{TrackTransfers: true}
+	info, err := dirtools.DownloadTree(ctx, env, instanceName, previous, tmpDir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.ElementsMatch(t, []string{"a", "b/fileA.txt"}, keys(info.Transfers))
+
+	// Then "a" becomes a directory and "b" a file.
+	tree := &repb.Tree{
+		Root: &repb.Directory{
+			Files:       []*repb.FileNode{{Name: "b", Digest: fileBDigest}},
+			Directories: []*repb.DirectoryNode{{Name: "a", Digest: childDigest}},
+		},
+		Children: []*repb.Directory{childDir},
+	}
+	opts = &dirtools.DownloadTreeOpts{
+		Skip:           info.Transfers,
+		TrackTransfers: true,
+		PreviousTree:   info.Tree,
+	}
+	info, err = dirtools.DownloadTree(ctx, env, instanceName, tree, tmpDir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.ElementsMatch(t, []string{"a/fileA.txt", "b"}, keys(info.Transfers))
+	// Both paths are still in the tree, so they must not be cleaned as
+	// removed inputs, but the files they replaced are gone.
+	assert.Empty(t, info.Removed, "no files were removed")
+	assert.ElementsMatch(t, []string{"a", "b/fileA.txt"}, keys(info.Replaced))
+	assert.FileExists(t, filepath.Join(tmpDir, "a/fileA.txt"), "a/fileA.txt should exist")
+	contents, err := os.ReadFile(filepath.Join(tmpDir, "b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "mytestdataB", string(contents), "b should be a file")
+}
+
+func keys(m map[string]*repb.FileNode) []string {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
 func testEnv(t *testing.T) (*testenv.TestEnv, context.Context) {
 	env := testenv.GetTestEnv(t)
 	ctx := context.Background()
@@ -13,8 +13,14 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/backends/pubsub"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/operation"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/platform"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/scheduling/cache_locality"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/scheduling/fair_share"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/scheduling/speculation"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/tasksize"
+	"github.com/buildbuddy-io/buildbuddy/server/backends/chunkstore"
+	"github.com/buildbuddy-io/buildbuddy/server/config"
 	"github.com/buildbuddy-io/buildbuddy/server/environment"
+	"github.com/buildbuddy-io/buildbuddy/server/eventlog"
 	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
 	"github.com/buildbuddy-io/buildbuddy/server/metrics"
 	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/action_cache_server"
@@ -24,6 +30,7 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/server/tables"
 	"github.com/buildbuddy-io/buildbuddy/server/util/bazel_request"
 	"github.com/buildbuddy-io/buildbuddy/server/util/db"
+	"github.com/buildbuddy-io/buildbuddy/server/util/keyval"
 	"github.com/buildbuddy-io/buildbuddy/server/util/log"
 	"github.com/buildbuddy-io/buildbuddy/server/util/perms"
 	"github.com/buildbuddy-io/buildbuddy/server/util/prefix"
@@ -31,9 +38,11 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/server/util/tracing"
 	"github.com/golang/protobuf/proto"
 	"github.com/golang/protobuf/ptypes"
+	"github.com/google/uuid"
 	"github.com/prometheus/client_golang/prometheus"
 	"google.golang.org/genproto/googleapis/longrunning"
 
+	akpb "github.com/buildbuddy-io/buildbuddy/proto/api_key"
 	espb "github.com/buildbuddy-io/buildbuddy/proto/execution_stats"
 	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
 	scpb "github.com/buildbuddy-io/buildbuddy/proto/scheduler"
@@ -100,6 +109,10 @@ type ExecutionServer struct {
 	cache                             interfaces.Cache
 	streamPubSub                      *pubsub.StreamPubSub
 	enableRedisAvailabilityMonitoring bool
+	fairShareWeights                  []config.FairShareWeight
+	speculativeRetryMultiplier        float64
+	recordFailedExecutions            bool
+	enableCacheLocalityRouting        bool
 }
 
 func NewExecutionServer(env environment.Env) (*ExecutionServer, error) {
@@ -117,6 +130,10 @@ func NewExecutionServer(env environment.Env) (*ExecutionServer, error) {
 	}
 	if rec := env.GetConfigurator().GetRemoteExecutionConfig(); rec != nil {
 		es.enableRedisAvailabilityMonitoring = rec.EnableRedisAvailabilityMonitoring
+		es.fairShareWeights = rec.FairShareWeights
+		es.speculativeRetryMultiplier = rec.SpeculativeRetryMultiplier
+		es.recordFailedExecutions = rec.FailedExecutionTTLDays > 0
+		es.enableCacheLocalityRouting = rec.EnableCacheLocalityRouting
 	}
 	return es, nil
 }
@@ -292,11 +309,12 @@ func (s *ExecutionServer) Dispatch(ctx context.Context, req *repb.ExecuteRequest
 	}
 
 	executionTask := &repb.ExecutionTask{
-		ExecuteRequest: req,
-		InvocationId:   invocationID,
-		ExecutionId:    executionID,
-		Action:         action,
-		Command:        command,
+		ExecuteRequest:  req,
+		InvocationId:    invocationID,
+		ExecutionId:     executionID,
+		Action:          action,
+		Command:         command,
+		RequestMetadata: bazel_request.GetRequestMetadata(ctx),
 	}
 	// Allow execution worker to auth to cache (if necessary).
 	if jwt, ok := ctx.Value("x-buildbuddy-jwt").(string); ok {
@@ -315,7 +333,11 @@ func (s *ExecutionServer) Dispatch(ctx context.Context, req *repb.ExecuteRequest
 		return "", status.InternalErrorf("Error marshalling execution task %q: %s", executionID, err)
 	}
 
-	taskSize := tasksize.Estimate(executionTask)
+	var measuredSize *scpb.TaskSize
+	if sizer := s.env.GetTaskSizer(); sizer != nil {
+		measuredSize = sizer.Get(ctx, executionTask)
+	}
+	taskSize := tasksize.EstimateWithMeasuredSize(executionTask, measuredSize)
 
 	props := platform.ParseProperties(executionTask)
 
@@ -341,13 +363,24 @@ func (s *ExecutionServer) Dispatch(ctx context.Context, req *repb.ExecuteRequest
 		}
 	}
 
+	groupWeight, invocationWeight := fair_share.Weights(s.fairShareWeights, taskGroupID, fair_share.Role(ctx, s.env, props.WorkflowID != ""))
 	schedulingMetadata := &scpb.SchedulingMetadata{
-		Os:              props.OS,
-		Arch:            props.Arch,
-		Pool:            props.Pool,
-		TaskSize:        taskSize,
-		ExecutorGroupId: executorGroupID,
-		TaskGroupId:     taskGroupID,
+		Os:               props.OS,
+		Arch:             props.Arch,
+		Pool:             props.Pool,
+		TaskSize:         taskSize,
+		ExecutorGroupId:  executorGroupID,
+		TaskGroupId:      taskGroupID,
+		TaskInvocationId: invocationID,
+		GroupWeight:      groupWeight,
+		InvocationWeight: invocationWeight,
+		Priority:         req.GetExecutionPolicy().GetPriority(),
+	}
+	if props.SpeculativeRetry {
+		schedulingMetadata.SpeculativeExecutionDelayUsec = s.speculativeExecutionDelay(ctx, command, req.GetInstanceName()).Microseconds()
+	}
+	if s.enableCacheLocalityRouting {
+		schedulingMetadata.LocalityDigest = s.localityDigests(ctx, req.GetInstanceName(), action.GetInputRootDigest())
 	}
 	scheduleReq := &scpb.ScheduleTaskRequest{
 		TaskId:         executionID,
@@ -355,11 +388,54 @@ func (s *ExecutionServer) Dispatch(ctx context.Context, req *repb.ExecuteRequest
 		SerializedTask: serializedTask,
 	}
 	if _, err := scheduler.ScheduleTask(ctx, scheduleReq); err != nil {
-		return "", status.UnavailableErrorf("Error scheduling execution task %q: %s", executionID, err.Error())
+		// The group may be over its queued task limit, in which case the
+		// error is returned as-is so that the client sees when to retry.
+		if !status.IsResourceExhaustedError(err) {
+			err = status.UnavailableErrorf("Error scheduling execution task %q: %s", executionID, err.Error())
+		}
+		// The execution was already inserted, so record that it failed rather
+		// than leaving it in the UNKNOWN stage.
+		if markErr := s.MarkExecutionFailed(ctx, executionID, err); markErr != nil {
+			log.Warningf("Could not mark unscheduled execution %q as failed: %s", executionID, markErr)
+		}
+		return "", err
 	}
 	return executionID, nil
 }
 
+// speculativeExecutionDelay returns how long the given command may execute
+// before a speculative copy of it is started, or 0 if its duration can't be
+// estimated yet.
+func (s *ExecutionServer) speculativeExecutionDelay(ctx context.Context, command *repb.Command, remoteInstanceName string) time.Duration {
+	router := s.env.GetTaskRouter()
+	if router == nil {
+		return 0
+	}
+	expectedDuration, ok := router.ExpectedDuration(ctx, command, remoteInstanceName)
+	if !ok {
+		return 0
+	}
+	return speculation.Delay(expectedDuration, s.speculativeRetryMultiplier)
+}
+
+// localityDigests returns a sample of the inputs under the given input root,
+// which is used to route the task to executors that have them in their file
+// cache. Errors are logged rather than returned since they only make routing
+// less effective.
+func (s *ExecutionServer) localityDigests(ctx context.Context, instanceName string, inputRootDigest *repb.Digest) []*repb.Digest {
+	cas, err := namespace.CASCache(ctx, s.cache, instanceName)
+	if err != nil {
+		log.Warningf("Could not sample inputs for locality routing: %s", err)
+		return nil
+	}
+	digests, err := cache_locality.InputDigests(ctx, cas, inputRootDigest)
+	if err != nil {
+		log.Warningf("Could not sample inputs for locality routing: %s", err)
+		return nil
+	}
+	return digests
+}
+
 func (s *ExecutionServer) execute(req *repb.ExecuteRequest, stream streamLike) error {
 	adInstanceDigest := digest.NewResourceName(req.GetActionDigest(), req.GetInstanceName())
 	ctx, err := prefix.AttachUserPrefixToContext(stream.Context(), s.env)
@@ -555,12 +631,26 @@ func loopAfterTimeout(ctx context.Context, timeout time.Duration, f func()) {
 	}
 }
 
+// recordTaskFailure lets the scheduler count a failure of the current attempt
+// of a task against the health of the executor that leased it, if the failure
+// was caused by an infrastructure error.
+func (s *ExecutionServer) recordTaskFailure(ctx context.Context, taskID string, reason error) {
+	scheduler := s.env.GetSchedulerService()
+	if scheduler == nil || reason == nil {
+		return
+	}
+	if err := scheduler.RecordTaskFailure(ctx, taskID, reason); err != nil {
+		log.Warningf("Could not record failure of task %q: %s", taskID, err)
+	}
+}
+
 func (s *ExecutionServer) MarkExecutionFailed(ctx context.Context, taskID string, reason error) error {
 	r, err := digest.ParseDownloadResourceName(taskID)
 	if err != nil {
 		log.Warningf("Could not parse taskID: %s", err)
 		return err
 	}
+	s.recordTaskFailure(ctx, taskID, reason)
 	op, err := operation.AssembleFailed(repb.ExecutionStage_COMPLETED, taskID, r, reason)
 	if err != nil {
 		return err
@@ -628,12 +718,28 @@ func (s *ExecutionServer) PublishOperation(stream repb.Execution_PublishOperatio
 		log.Debugf("PublishOperation: operation %q stage: %s", taskID, stage)
 
 		if stage == repb.ExecutionStage_COMPLETED {
+			// If a speculative copy of the execution was started, only the
+			// first copy to complete is reported.
+			first, err := speculation.ClaimCompletion(ctx, s.env.GetRemoteExecutionRedisClient(), taskID)
+			if err != nil {
+				log.Warningf("Could not claim completion of execution %q: %s", taskID, err)
+			} else if !first {
+				log.Infof("PublishOperation: ignoring completion of execution %q: another copy completed first", taskID)
+				continue
+			}
+
 			response := operation.ExtractExecuteResponse(op)
 			if response != nil {
 				if err := s.markTaskComplete(ctx, taskID, response); err != nil {
 					// Errors updating the router or recording usage are non-fatal.
 					log.Error(err.Error())
 				}
+				s.recordTaskFailure(ctx, taskID, gstatus.ErrorProto(response.GetStatus()))
+				if s.recordFailedExecutions && executionFailed(response) {
+					if err := s.recordFailedExecution(ctx, taskID, response); err != nil {
+						log.Warningf("Could not record failed execution %q: %s", taskID, err)
+					}
+				}
 			}
 		}
 
@@ -665,6 +771,188 @@ func (s *ExecutionServer) PublishOperation(stream repb.Execution_PublishOperatio
 	}
 }
 
+// PublishExecutionLog writes the output streamed by an executor while it runs
+// an execution to the execution's log, from which it can be read with
+// GetExecutionLog.
+//
+// Only one task running an execution writes its log, so if a speculative copy
+// of the execution is started, the log contains the output of the original.
+// If the task is retried, the log is reset and the new attempt takes it over;
+// the stream of the previous attempt, if it is still open, is aborted.
+func (s *ExecutionServer) PublishExecutionLog(stream repb.Execution_PublishExecutionLogServer) error {
+	ctx, err := prefix.AttachUserPrefixToContext(stream.Context(), s.env)
+	if err != nil {
+		return err
+	}
+	executorGroupID, err := s.authorizeExecutor(ctx)
+	if err != nil {
+		return err
+	}
+	if s.env.GetBlobstore() == nil {
+		return status.FailedPreconditionError("blobstore not configured")
+	}
+	rdb := s.env.GetRemoteExecutionRedisClient()
+	// Identifies this attempt at publishing the log, so that it can tell
+	// whether a later attempt took the log over.
+	attemptID := uuid.New().String()
+	executionID := ""
+	var logWriter *eventlog.EventLogWriter
+	closeLog := func() error {
+		if logWriter == nil {
+			return nil
+		}
+		err := logWriter.Close(ctx)
+		logWriter = nil
+		return err
+	}
+	defer closeLog()
+	// checkOwnership aborts the stream if a later attempt took the log over.
+	// The writer is dropped without closing it, since closing it would flush
+	// its buffered output over the log of the later attempt.
+	checkOwnership := func() error {
+		owned, err := speculation.OwnsLog(ctx, rdb, executionID, attemptID)
+		if err != nil {
+			return status.UnavailableErrorf("Error checking execution log claim: %s", err)
+		}
+		if !owned {
+			logWriter = nil
+			return status.AbortedErrorf("execution log of %q was taken over by a later attempt", executionID)
+		}
+		return nil
+	}
+
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if logWriter == nil {
+			if req.GetExecutionId() == "" {
+				return status.InvalidArgumentError("An execution_id must be provided")
+			}
+			executionID = req.GetExecutionId()
+			groupID, err := s.executionGroupID(ctx, executionID)
+			if err != nil {
+				return err
+			}
+			if err := s.authorizeExecutorForGroup(executorGroupID, groupID); err != nil {
+				return err
+			}
+			// The original task of an execution has the same ID as the
+			// execution.
+			taskID := req.GetTaskId()
+			if taskID == "" {
+				taskID = executionID
+			}
+			claim, err := speculation.ClaimLog(ctx, rdb, executionID, taskID, attemptID)
+			if err != nil {
+				return status.UnavailableErrorf("Error claiming execution log: %s", err)
+			}
+			if claim == speculation.LogNotClaimed {
+				return status.AlreadyExistsErrorf("execution log of %q is already being published", executionID)
+			}
+			logPath := eventlog.GetExecutionLogPath(groupID, executionID)
+			if claim == speculation.LogTakenOver {
+				if err := s.resetExecutionLog(ctx, logPath); err != nil {
+					return status.UnavailableErrorf("Error resetting execution log: %s", err)
+				}
+			}
+			logWriter = eventlog.NewEventLogWriter(
+				ctx,
+				s.env.GetBlobstore(),
+				s.env.GetKeyValStore(),
+				logPath,
+				0, /*=numLinesToRetain*/
+			)
+		} else if err := checkOwnership(); err != nil {
+			return err
+		}
+		if len(req.GetData()) == 0 {
+			continue
+		}
+		if _, err := logWriter.Write(ctx, req.GetData()); err != nil {
+			return status.UnavailableErrorf("Error writing execution log: %s", err)
+		}
+	}
+	if logWriter != nil {
+		if err := checkOwnership(); err != nil {
+			return err
+		}
+	}
+	// Flush the log before responding, so that it is complete by the time the
+	// execution is.
+	if err := closeLog(); err != nil {
+		return status.UnavailableErrorf("Error closing execution log: %s", err)
+	}
+	return stream.SendAndClose(&repb.PublishExecutionLogResponse{})
+}
+
+// resetExecutionLog deletes the log written by a previous attempt of an
+// execution, so that a new attempt can write it from the start.
+func (s *ExecutionServer) resetExecutionLog(ctx context.Context, logPath string) error {
+	if kvs := s.env.GetKeyValStore(); kvs != nil {
+		if err := keyval.SetProto(ctx, kvs, logPath, nil); err != nil {
+			return err
+		}
+	}
+	return chunkstore.New(s.env.GetBlobstore(), &chunkstore.ChunkstoreOptions{}).DeleteBlob(ctx, logPath)
+}
+
+// authorizeExecutor checks that the caller is an executor, if executors must
+// be authorized, in the same way as the scheduler does. It returns the ID of
+// the group that owns the executor, or "" if executors aren't authorized.
+func (s *ExecutionServer) authorizeExecutor(ctx context.Context) (string, error) {
+	if conf := s.env.GetConfigurator().GetRemoteExecutionConfig(); conf == nil || !conf.RequireExecutorAuthorization {
+		return "", nil
+	}
+	auth := s.env.GetAuthenticator()
+	if auth == nil {
+		return "", status.FailedPreconditionError("executor authorization required, but authenticator is not set")
+	}
+	// AuthenticateGRPCRequest ignores the JWT of the task, so that the
+	// executor's own API key is checked.
+	user, err := auth.AuthenticateGRPCRequest(ctx)
+	if err != nil {
+		return "", err
+	}
+	if !user.HasCapability(akpb.ApiKey_REGISTER_EXECUTOR_CAPABILITY) {
+		return "", status.PermissionDeniedError("API key is missing executor registration capability")
+	}
+	return user.GetGroupID(), nil
+}
+
+// authorizeExecutorForGroup checks that an executor owned by executorGroupID
+// may run the executions of executionGroupID: executions only run on their
+// group's own executors or on the shared executor pool.
+func (s *ExecutionServer) authorizeExecutorForGroup(executorGroupID, executionGroupID string) error {
+	if conf := s.env.GetConfigurator().GetRemoteExecutionConfig(); conf == nil || !conf.RequireExecutorAuthorization {
+		return nil
+	}
+	if executorGroupID == executionGroupID || executorGroupID == s.env.GetConfigurator().GetRemoteExecutionConfig().SharedExecutorPoolGroupID {
+		return nil
+	}
+	return status.PermissionDeniedError("executor is not authorized to run executions of this group")
+}
+
+// executionGroupID returns the ID of the group that owns an execution.
+func (s *ExecutionServer) executionGroupID(ctx context.Context, executionID string) (string, error) {
+	if s.env.GetDBHandle() == nil {
+		return "", status.FailedPreconditionError("database not configured")
+	}
+	execution := &tables.Execution{}
+	err := s.env.GetDBHandle().DB(ctx).Where("execution_id = ?", executionID).Take(execution).Error
+	if db.IsRecordNotFound(err) {
+		return "", status.NotFoundErrorf("execution %q not found", executionID)
+	}
+	if err != nil {
+		return "", err
+	}
+	return execution.GroupID, nil
+}
+
 // markTaskComplete contains logic to be run when the task is complete but
 // before letting the client know that the task has completed.
 func (s *ExecutionServer) markTaskComplete(ctx context.Context, taskID string, executeResponse *repb.ExecuteResponse) error {
@@ -682,11 +970,93 @@ func (s *ExecutionServer) markTaskComplete(ctx context.Context, taskID string, e
 	if router != nil && !executeResponse.GetCachedResult() {
 		nodeID := executeResponse.GetResult().GetExecutionMetadata().GetExecutorId()
 		router.MarkComplete(ctx, cmd, actionResourceName.GetInstanceName(), nodeID)
+		// Only successful executions are representative of the task's
+		// duration.
+		if executeResponse.GetStatus().GetCode() == 0 {
+			if d, err := workerDuration(executeResponse.GetResult().GetExecutionMetadata()); err == nil {
+				router.RecordDuration(ctx, cmd, actionResourceName.GetInstanceName(), d)
+			}
+		}
+	}
+
+	if sizer := s.env.GetTaskSizer(); sizer != nil && !executeResponse.GetCachedResult() {
+		if err := s.updateTaskSize(ctx, sizer, cmd, actionResourceName.GetInstanceName(), executeResponse); err != nil {
+			log.Warningf("Failed to update measured task size: %s", err)
+		}
 	}
 
 	return s.updateUsage(ctx, cmd, executeResponse)
 }
 
+func executionFailed(executeResponse *repb.ExecuteResponse) bool {
+	if executeResponse.GetCachedResult() {
+		return false
+	}
+	return executeResponse.GetStatus().GetCode() != 0 || executeResponse.GetResult().GetExitCode() != 0
+}
+
+// recordFailedExecution stores the details of a failed execution so that it
+// can be diagnosed and reproduced after the fact.
+func (s *ExecutionServer) recordFailedExecution(ctx context.Context, taskID string, executeResponse *repb.ExecuteResponse) error {
+	dbh := s.env.GetDBHandle()
+	if dbh == nil {
+		return status.FailedPreconditionError("database not configured")
+	}
+	actionResourceName, err := digest.ParseUploadResourceName(taskID)
+	if err != nil {
+		return err
+	}
+	action := &repb.Action{}
+	if err := cachetools.ReadProtoFromCAS(ctx, s.cache, actionResourceName, action); err != nil {
+		return err
+	}
+	serializedResponse, err := proto.Marshal(executeResponse)
+	if err != nil {
+		return err
+	}
+	return dbh.TransactionWithOptions(ctx, db.Opts().WithQueryName("insert_failed_execution"), func(tx *db.DB) error {
+		var existing []*tables.FailedExecution
+		if err := tx.Where("execution_id = ?", taskID).Limit(1).Find(&existing).Error; err != nil {
+			return err
+		}
+		if len(existing) > 0 {
+			// Already recorded by an earlier attempt.
+			return nil
+		}
+		// The failure is visible to whoever can see the execution.
+		var execution tables.Execution
+		if err := tx.Where("execution_id = ?", taskID).First(&execution).Error; err != nil {
+			return err
+		}
+		return tx.Create(&tables.FailedExecution{
+			ExecutionID:               taskID,
+			InvocationID:              execution.InvocationID,
+			UserID:                    execution.UserID,
+			GroupID:                   execution.GroupID,
+			Perms:                     execution.Perms,
+			CommandDigest:             fmt.Sprintf("%s/%d", action.GetCommandDigest().GetHash(), action.GetCommandDigest().GetSizeBytes()),
+			InputRootDigest:           fmt.Sprintf("%s/%d", action.GetInputRootDigest().GetHash(), action.GetInputRootDigest().GetSizeBytes()),
+			SerializedExecuteResponse: serializedResponse,
+		}).Error
+	})
+}
+
+func (s *ExecutionServer) updateTaskSize(ctx context.Context, sizer interfaces.TaskSizer, cmd *repb.Command, remoteInstanceName string, executeResponse *repb.ExecuteResponse) error {
+	// Only successful executions are representative of the task's usage.
+	if executeResponse.GetStatus().GetCode() != 0 || executeResponse.GetMessage() == "" {
+		return nil
+	}
+	data, err := base64.StdEncoding.DecodeString(executeResponse.GetMessage())
+	if err != nil {
+		return err
+	}
+	summary := &espb.ExecutionSummary{}
+	if err := proto.Unmarshal(data, summary); err != nil {
+		return err
+	}
+	return sizer.Update(ctx, cmd, remoteInstanceName, summary)
+}
+
 func (s *ExecutionServer) updateUsage(ctx context.Context, cmd *repb.Command, executeResponse *repb.ExecuteResponse) error {
 	ut := s.env.GetUsageTracker()
 	if ut == nil {
@@ -738,6 +1108,21 @@ func executionDuration(md *repb.ExecutedActionMetadata) (time.Duration, error) {
 	return dur, nil
 }
 
+// workerDuration returns how long the worker spent on the execution.
+func workerDuration(md *repb.ExecutedActionMetadata) (time.Duration, error) {
+	if err := md.GetWorkerStartTimestamp().CheckValid(); err != nil {
+		return 0, err
+	}
+	if err := md.GetWorkerCompletedTimestamp().CheckValid(); err != nil {
+		return 0, err
+	}
+	dur := md.GetWorkerCompletedTimestamp().AsTime().Sub(md.GetWorkerStartTimestamp().AsTime())
+	if dur <= 0 {
+		return 0, status.InternalErrorf("Worker duration is <= 0")
+	}
+	return dur, nil
+}
+
 func (s *ExecutionServer) Cancel(ctx context.Context, invocationID string) error {
 	dbh := s.env.GetDBHandle()
 	rows, err := dbh.DB(ctx).Raw(
@@ -0,0 +1,156 @@
+package executionlog
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+)
+
+const (
+	// How often buffered output is published.
+	publishInterval = 1 * time.Second
+
+	// The maximum amount of output that is sent in a single request.
+	maxRequestBytes = 1_000_000
+
+	// The maximum amount of output that is buffered while waiting to be
+	// published. Output written past this is dropped.
+	maxBufferedBytes = 4_000_000
+)
+
+// Publisher publishes the output of an execution to the app while the
+// execution is running, so that it can be followed before the execution
+// completes.
+//
+// Writes never block on the app and never fail. If the output can't be
+// published fast enough, or the app can't be reached, the output is dropped
+// from the live log; it is still uploaded when the execution completes.
+type Publisher struct {
+	executionID string
+	taskID      string
+	stream      repb.Execution_PublishExecutionLogClient
+
+	mu      sync.Mutex // protects(buf), protects(dropped)
+	buf     []byte
+	dropped bool
+
+	done    chan struct{}
+	stopped chan struct{}
+	err     error
+}
+
+// StartPublisher starts publishing the log of the execution with the given ID,
+// which is run by the scheduler task with the given ID. Close must be called
+// once the execution has finished.
+func StartPublisher(ctx context.Context, client repb.ExecutionClient, executionID, taskID string) (*Publisher, error) {
+	stream, err := client.PublishExecutionLog(ctx)
+	if err != nil {
+		return nil, status.UnavailableErrorf("failed to start publishing execution log: %s", err)
+	}
+	return startPublisher(stream, executionID, taskID, publishInterval), nil
+}
+
+func startPublisher(stream repb.Execution_PublishExecutionLogClient, executionID, taskID string, interval time.Duration) *Publisher {
+	p := &Publisher{
+		executionID: executionID,
+		taskID:      taskID,
+		stream:      stream,
+		done:        make(chan struct{}),
+		stopped:     make(chan struct{}),
+	}
+	go p.run(interval)
+	return p
+}
+
+func (p *Publisher) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.buf)+len(b) > maxBufferedBytes {
+		if !p.dropped {
+			log.Warningf("Dropping live output of execution %q: publishing is falling behind", p.executionID)
+			p.dropped = true
+		}
+		return len(b), nil
+	}
+	p.buf = append(p.buf, b...)
+	return len(b), nil
+}
+
+func (p *Publisher) run(interval time.Duration) {
+	defer close(p.stopped)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	first := true
+	for {
+		select {
+		case <-ticker.C:
+		case <-p.done:
+			if p.err == nil {
+				p.err = p.publish(first)
+			}
+			if _, err := p.stream.CloseAndRecv(); err != nil && p.err == nil {
+				p.err = status.UnavailableErrorf("failed to publish execution log: %s", err)
+			}
+			return
+		}
+		if p.err != nil {
+			// Keep draining the buffer so that it doesn't fill up.
+			p.take()
+			continue
+		}
+		p.err = p.publish(first)
+		first = false
+	}
+}
+
+// take removes and returns the output buffered since it was last called.
+func (p *Publisher) take() []byte {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	b := p.buf
+	p.buf = nil
+	p.dropped = false
+	return b
+}
+
+// publish sends the buffered output. The execution and task IDs are only sent
+// in the first request.
+func (p *Publisher) publish(first bool) error {
+	b := p.take()
+	if len(b) == 0 && !first {
+		return nil
+	}
+	for {
+		n := len(b)
+		if n > maxRequestBytes {
+			n = maxRequestBytes
+		}
+		req := &repb.PublishExecutionLogRequest{Data: b[:n]}
+		if first {
+			req.ExecutionId = p.executionID
+			req.TaskId = p.taskID
+			first = false
+		}
+		if err := p.stream.Send(req); err != nil {
+			return status.UnavailableErrorf("failed to publish execution log: %s", err)
+		}
+		b = b[n:]
+		if len(b) == 0 {
+			return nil
+		}
+	}
+}
+
+// Close publishes any remaining output and waits for the app to write it to
+// the log. It returns the error that stopped the output from being published,
+// if any.
+func (p *Publisher) Close() error {
+	close(p.done)
+	<-p.stopped
+	return p.err
+}
@@ -0,0 +1,173 @@
+package executionlog
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+)
+
+const (
+	executionID = "instance/uploads/123/blobs/abc/1"
+	taskID      = "instance/uploads/123/blobs/abc/1/speculative"
+)
+
+// fakeStream records the requests sent on it.
+type fakeStream struct {
+	grpc.ClientStream
+
+	mu      sync.Mutex
+	reqs    []*repb.PublishExecutionLogRequest
+	sendErr error
+	closed  bool
+}
+
+func (s *fakeStream) Send(req *repb.PublishExecutionLogRequest) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.sendErr != nil {
+		return s.sendErr
+	}
+	s.reqs = append(s.reqs, req)
+	return nil
+}
+
+func (s *fakeStream) CloseAndRecv() (*repb.PublishExecutionLogResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	return &repb.PublishExecutionLogResponse{}, nil
+}
+
+func (s *fakeStream) requests() []*repb.PublishExecutionLogRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*repb.PublishExecutionLogRequest{}, s.reqs...)
+}
+
+// data returns all of the output sent on the stream.
+func (s *fakeStream) data() string {
+	var b bytes.Buffer
+	for _, req := range s.requests() {
+		b.Write(req.GetData())
+	}
+	return b.String()
+}
+
+func write(t *testing.T, p *Publisher, data string) {
+	n, err := p.Write([]byte(data))
+	require.NoError(t, err)
+	require.Equal(t, len(data), n)
+}
+
+func TestPublisher_PublishesPeriodically(t *testing.T) {
+	s := &fakeStream{}
+	p := startPublisher(s, executionID, taskID, 10*time.Millisecond)
+
+	write(t, p, "hello\n")
+	require.Eventually(t, func() bool {
+		return s.data() == "hello\n"
+	}, 10*time.Second, 5*time.Millisecond)
+	write(t, p, "world\n")
+	require.Eventually(t, func() bool {
+		return s.data() == "hello\nworld\n"
+	}, 10*time.Second, 5*time.Millisecond)
+
+	err := p.Close()
+	require.NoError(t, err)
+	assert.Equal(t, "hello\nworld\n", s.data())
+	assert.True(t, s.closed)
+}
+
+func TestPublisher_SendsIDsInFirstRequestOnly(t *testing.T) {
+	s := &fakeStream{}
+	p := startPublisher(s, executionID, taskID, 10*time.Millisecond)
+
+	write(t, p, "hello\n")
+	require.Eventually(t, func() bool {
+		return s.data() == "hello\n"
+	}, 10*time.Second, 5*time.Millisecond)
+	write(t, p, "world\n")
+	err := p.Close()
+	require.NoError(t, err)
+
+	reqs := s.requests()
+	require.GreaterOrEqual(t, len(reqs), 2)
+	assert.Equal(t, executionID, reqs[0].GetExecutionId())
+	assert.Equal(t, taskID, reqs[0].GetTaskId())
+	for _, req := range reqs[1:] {
+		assert.Empty(t, req.GetExecutionId())
+		assert.Empty(t, req.GetTaskId())
+	}
+}
+
+func TestPublisher_NoOutput(t *testing.T) {
+	s := &fakeStream{}
+	p := startPublisher(s, executionID, taskID, time.Hour)
+
+	err := p.Close()
+	require.NoError(t, err)
+
+	// The execution ID is still sent, so that the app can create the log.
+	reqs := s.requests()
+	require.Len(t, reqs, 1)
+	assert.Equal(t, executionID, reqs[0].GetExecutionId())
+	assert.Empty(t, reqs[0].GetData())
+}
+
+func TestPublisher_SplitsLargeOutput(t *testing.T) {
+	s := &fakeStream{}
+	p := startPublisher(s, executionID, taskID, time.Hour)
+
+	data := strings.Repeat("a", maxRequestBytes+1)
+	write(t, p, data)
+	err := p.Close()
+	require.NoError(t, err)
+
+	reqs := s.requests()
+	require.Len(t, reqs, 2)
+	assert.Equal(t, executionID, reqs[0].GetExecutionId())
+	assert.Len(t, reqs[0].GetData(), maxRequestBytes)
+	assert.Empty(t, reqs[1].GetExecutionId())
+	assert.Len(t, reqs[1].GetData(), 1)
+	assert.Equal(t, data, s.data())
+}
+
+func TestPublisher_DropsOutputWhenBehind(t *testing.T) {
+	s := &fakeStream{}
+	p := startPublisher(s, executionID, taskID, time.Hour)
+
+	data := strings.Repeat("a", maxBufferedBytes)
+	write(t, p, data)
+	// The buffer is full, so this is dropped, but the write still succeeds.
+	write(t, p, "b")
+	err := p.Close()
+	require.NoError(t, err)
+
+	assert.Equal(t, data, s.data())
+}
+
+func TestPublisher_SendError(t *testing.T) {
+	s := &fakeStream{sendErr: status.UnavailableError("connection lost")}
+	p := startPublisher(s, executionID, taskID, 10*time.Millisecond)
+
+	// Writes keep succeeding after the output can no longer be published.
+	write(t, p, "hello\n")
+	time.Sleep(50 * time.Millisecond)
+	write(t, p, strings.Repeat("a", maxBufferedBytes))
+	time.Sleep(50 * time.Millisecond)
+	write(t, p, "world\n")
+	err := p.Close()
+
+	require.True(t, status.IsUnavailableError(err), "expected Unavailable but got: %s", err)
+	assert.Empty(t, s.requests())
+	assert.True(t, s.closed)
+}
@@ -91,6 +91,10 @@ func NewExecutor(env environment.Env, id string, runnerPool interfaces.RunnerPoo
 	}, nil
 }
 
+func (s *Executor) ID() string {
+	return s.id
+}
+
 func (s *Executor) HostID() string {
 	return s.hostID
 }
@@ -339,6 +343,7 @@ func (s *Executor) ExecuteTaskAndStreamResults(ctx context.Context, task *repb.E
 	execSummary := &espb.ExecutionSummary{
 		IoStats:                ioStats,
 		ExecutedActionMetadata: md,
+		UsageStats:             cmdResult.UsageStats,
 	}
 	if err := stateChangeFn(repb.ExecutionStage_COMPLETED, operation.ExecuteResponseWithResult(actionResult, execSummary, cmdResult.Error)); err != nil {
 		logActionResult(taskID, md)
@@ -12,6 +12,7 @@ import (
 
 	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
 	"github.com/buildbuddy-io/buildbuddy/server/metrics"
+	"github.com/buildbuddy-io/buildbuddy/server/util/bloom"
 	"github.com/buildbuddy-io/buildbuddy/server/util/disk"
 	"github.com/buildbuddy-io/buildbuddy/server/util/fastcopy"
 	"github.com/buildbuddy-io/buildbuddy/server/util/log"
@@ -33,6 +34,11 @@ const (
 	hitMetricLabel = "hit"
 	// missMetricLabel is the prometheus metric label applied to filecache misses.
 	missMetricLabel = "miss"
+
+	// The target false positive rate of the sketch returned by Sketch, and
+	// the max size of the sketch, which is reached with about 100K files.
+	sketchFalsePositiveRate = 0.01
+	maxSketchBytes          = 128 * 1024
 )
 
 // fileCache implements a fixed-size, filesystem backed, LRU cache.
@@ -226,3 +232,22 @@ func (c *fileCache) AddFile(node *repb.FileNode, existingFilePath string) {
 func (c *fileCache) WaitForDirectoryScanToComplete() {
 	<-c.dirScanDone
 }
+
+// Sketch returns a Bloom filter of the hashes of the files in the cache,
+// regardless of whether they are executable.
+func (c *fileCache) Sketch() (*bloom.Filter, error) {
+	// Every file in rootDir is tracked by the LRU, since evicted files are
+	// unlinked, so listing the directory is simpler than walking the LRU.
+	entries, err := os.ReadDir(c.rootDir)
+	if err != nil {
+		return nil, err
+	}
+	f := bloom.NewWithEstimates(len(entries), sketchFalsePositiveRate, maxSketchBytes)
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		f.Add(strings.Split(e.Name(), ".")[0])
+	}
+	return f, nil
+}
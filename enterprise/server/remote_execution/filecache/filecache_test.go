@@ -83,6 +83,27 @@ func Test_Filecache(t *testing.T) {
 	assertFileContents(t, filepath.Join(baseDir, "my/fun/second-fastlinkedfile"), "my/fun/file")
 }
 
+func TestSketch(t *testing.T) {
+	fc, err := filecache.NewFileCache(testfs.MakeTempDir(t), 100000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fc.WaitForDirectoryScanToComplete()
+	baseDir := testfs.MakeTempDir(t)
+	writeFile(t, baseDir, "file", false)
+	writeFile(t, baseDir, "executable", true)
+	fc.AddFile(nodeFromString("file", false), filepath.Join(baseDir, "file"))
+	fc.AddFile(nodeFromString("executable", true), filepath.Join(baseDir, "executable"))
+
+	sketch, err := fc.Sketch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, sketch.MayContain(hash.String("file")))
+	assert.True(t, sketch.MayContain(hash.String("executable")))
+	assert.False(t, sketch.MayContain(hash.String("missing")))
+}
+
 func assertFileContents(t *testing.T, path, contents string) {
 	bytes, err := ioutil.ReadFile(path)
 	if err != nil {
@@ -0,0 +1,525 @@
+// Package imagestore pulls OCI container images from registries into a
+// store on local disk, which is shared by the executor's isolation types:
+// firecracker VMs are created from ext4 disk images converted from the
+// store's images, podman containers run on root filesystems unpacked from
+// them, and containerd imports their blobs into its content store rather
+// than pulling them itself.
+//
+// Docker still pulls images through the Docker daemon, which can only import
+// images from archives in its own format, and sandboxes run on the host's
+// system directories rather than on images.
+//
+// The store is laid out as follows:
+//
+//	blobs/sha256/<hex>                 manifests, configs and layers
+//	refs/<sha256 of image ref>         digest of the ref's manifest
+//	disks/<manifest hex>/containerfs.ext4
+//
+// Blobs are content-addressed, so layers which are shared by several images
+// are only downloaded and stored once. Blobs and disk images are evicted in
+// least recently used order once the store exceeds its max size. Callers get
+// their own hard links to disk images, so that eviction doesn't affect disk
+// images which are in use.
+package imagestore
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/container"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/util/ext4"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/lru"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/docker/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	"golang.org/x/sync/singleflight"
+
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	diskImageFileName = "containerfs.ext4"
+)
+
+// Image is an image whose manifest, config and layers are in the store.
+type Image struct {
+	// Ref is the normalized reference that the image was pulled with, such as
+	// "docker.io/library/ubuntu:20.04".
+	Ref string
+	// Digest is the digest of the image's manifest.
+	Digest digest.Digest
+	// Manifest and ConfigBlob describe the image's manifest and config
+	// blobs.
+	Manifest   ocispec.Descriptor
+	ConfigBlob ocispec.Descriptor
+	// Layers are the image's layers, from the bottom up.
+	Layers []ocispec.Descriptor
+	// Config holds the image's configuration, such as its environment
+	// variables and user.
+	Config ocispec.ImageConfig
+}
+
+// Store is a local store of container images.
+type Store struct {
+	rootDir    string
+	httpClient *http.Client
+
+	// group dedupes concurrent downloads of the same blob, and concurrent
+	// conversions of the same image to a disk image.
+	group singleflight.Group
+
+	mu sync.Mutex // protects(files)
+	// files tracks the blobs and disk images in the store by path, in least
+	// recently used order.
+	files interfaces.LRU
+}
+
+// file is a blob or disk image in the store.
+type file struct {
+	path      string
+	sizeBytes int64
+}
+
+func sizeFn(value interface{}) int64 {
+	if f, ok := value.(*file); ok {
+		return f.sizeBytes
+	}
+	return 0
+}
+
+func evictFn(value interface{}) {
+	f, ok := value.(*file)
+	if !ok {
+		return
+	}
+	if err := os.Remove(f.path); err != nil && !os.IsNotExist(err) {
+		log.Warningf("Failed to evict %q from image store: %s", f.path, err)
+		return
+	}
+	if filepath.Base(f.path) == diskImageFileName {
+		os.Remove(filepath.Dir(f.path))
+	}
+	log.Debugf("Evicted %q from image store", f.path)
+}
+
+// New returns a store of images in the given directory, which is created if
+// it does not exist. Files already in the directory are tracked as if they
+// had been used in the order of their modification times.
+func New(rootDir string, maxSizeBytes int64) (*Store, error) {
+	if maxSizeBytes <= 0 {
+		return nil, status.InvalidArgumentError("image store max size must be positive")
+	}
+	for _, dir := range []string{"blobs/sha256", "refs", "disks", "tmp"} {
+		if err := os.MkdirAll(filepath.Join(rootDir, dir), 0755); err != nil {
+			return nil, status.InternalErrorf("failed to create image store: %s", err)
+		}
+	}
+	l, err := lru.NewLRU(&lru.Config{MaxSize: maxSizeBytes, SizeFn: sizeFn, OnEvict: evictFn})
+	if err != nil {
+		return nil, err
+	}
+	s := &Store{rootDir: rootDir, httpClient: http.DefaultClient, files: l}
+	if err := s.scan(); err != nil {
+		return nil, status.InternalErrorf("failed to scan image store: %s", err)
+	}
+	return s, nil
+}
+
+// scan adds the blobs and disk images in the store's directory to files.
+func (s *Store) scan() error {
+	paths, err := filepath.Glob(filepath.Join(s.rootDir, "blobs", "*", "*"))
+	if err != nil {
+		return err
+	}
+	diskImages, err := filepath.Glob(filepath.Join(s.rootDir, "disks", "*", diskImageFileName))
+	if err != nil {
+		return err
+	}
+	paths = append(paths, diskImages...)
+	infos := make(map[string]os.FileInfo, len(paths))
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		infos[path] = info
+	}
+	sort.Slice(paths, func(i, j int) bool {
+		return infos[paths[i]].ModTime().Before(infos[paths[j]].ModTime())
+	})
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, path := range paths {
+		s.files.Add(path, &file{path: path, sizeBytes: infos[path].Size()})
+	}
+	return nil
+}
+
+// use marks the file at path as the most recently used file in the store,
+// adding it to the store if needed, which may evict other files.
+func (s *Store) use(path string, sizeBytes int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.useLocked(path, sizeBytes)
+}
+
+func (s *Store) useLocked(path string, sizeBytes int64) {
+	if _, ok := s.files.Get(path); !ok {
+		s.files.Add(path, &file{path: path, sizeBytes: sizeBytes})
+	}
+	// Persist the order of use across restarts.
+	now := time.Now()
+	if err := os.Chtimes(path, now, now); err != nil && !os.IsNotExist(err) {
+		log.Warningf("Failed to update modification time of %q: %s", path, err)
+	}
+}
+
+// normalize returns the fully qualified form of an image reference, such as
+// "docker.io/library/ubuntu:latest" for "ubuntu".
+func normalize(imageRef string) (reference.Named, error) {
+	ref, err := reference.ParseNormalizedNamed(imageRef)
+	if err != nil {
+		return nil, status.InvalidArgumentErrorf("invalid image reference %q: %s", imageRef, err)
+	}
+	return reference.TagNameOnly(ref), nil
+}
+
+func (s *Store) blobPath(d digest.Digest) string {
+	return filepath.Join(s.rootDir, "blobs", d.Algorithm().String(), d.Hex())
+}
+
+func (s *Store) refPath(ref reference.Named) string {
+	return filepath.Join(s.rootDir, "refs", fmt.Sprintf("%x", sha256.Sum256([]byte(ref.String()))))
+}
+
+func (s *Store) diskImagePath(img *Image) string {
+	return filepath.Join(s.rootDir, "disks", img.Digest.Hex(), diskImageFileName)
+}
+
+func exists(path string) (bool, error) {
+	_, err := os.Stat(path)
+	if err == nil {
+		return true, nil
+	}
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return false, err
+}
+
+// Pull pulls an image into the store. The registry is always asked for the
+// image's manifest, so that the credentials are checked and the latest image
+// for a tag is returned, but only the blobs which are not already in the
+// store are downloaded.
+func (s *Store) Pull(ctx context.Context, imageRef string, creds container.PullCredentials) (*Image, error) {
+	ref, err := normalize(imageRef)
+	if err != nil {
+		return nil, err
+	}
+	client := newRegistryClient(s.httpClient, ref, creds)
+	tagOrDigest := ""
+	if d, ok := ref.(reference.Digested); ok {
+		tagOrDigest = d.Digest().String()
+	} else {
+		tagOrDigest = ref.(reference.Tagged).Tag()
+	}
+	b, d, err := client.manifest(ctx, tagOrDigest)
+	if err != nil {
+		return nil, status.WrapErrorf(err, "failed to get manifest for %q", ref)
+	}
+	if err := s.writeBlob(d, b); err != nil {
+		return nil, err
+	}
+	manifest, err := parseManifest(b)
+	if err != nil {
+		return nil, err
+	}
+	blobs := append([]ocispec.Descriptor{manifest.Config}, manifest.Layers...)
+	for _, desc := range blobs {
+		if err := s.fetchBlob(ctx, client, desc); err != nil {
+			return nil, err
+		}
+	}
+	if err := s.writeFileAtomically(s.refPath(ref), []byte(d.String())); err != nil {
+		return nil, err
+	}
+	log.Debugf("Pulled image %q (%s)", ref, d)
+	return s.image(ref, d)
+}
+
+// CachedImage returns the image with the given reference, if it was pulled
+// into the store before. It returns nil (with no error) otherwise.
+func (s *Store) CachedImage(imageRef string) (*Image, error) {
+	ref, err := normalize(imageRef)
+	if err != nil {
+		return nil, err
+	}
+	b, err := os.ReadFile(s.refPath(ref))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, status.InternalErrorf("failed to read image ref: %s", err)
+	}
+	d, err := digest.Parse(strings.TrimSpace(string(b)))
+	if err != nil {
+		return nil, status.InternalErrorf("invalid digest for image %q: %s", ref, err)
+	}
+	img, err := s.image(ref, d)
+	if status.IsNotFoundError(err) {
+		return nil, nil
+	}
+	return img, err
+}
+
+// image returns the image with the given manifest, or a NotFound error if
+// any of its blobs are missing from the store.
+func (s *Store) image(ref reference.Named, d digest.Digest) (*Image, error) {
+	b, err := os.ReadFile(s.blobPath(d))
+	if os.IsNotExist(err) {
+		return nil, status.NotFoundErrorf("manifest %s not found", d)
+	}
+	if err != nil {
+		return nil, status.InternalErrorf("failed to read manifest: %s", err)
+	}
+	s.use(s.blobPath(d), int64(len(b)))
+	manifest, err := parseManifest(b)
+	if err != nil {
+		return nil, err
+	}
+	manifestDesc := ocispec.Descriptor{
+		MediaType: manifestMediaType(b),
+		Digest:    d,
+		Size:      int64(len(b)),
+	}
+	for _, layer := range manifest.Layers {
+		ok, err := exists(s.blobPath(layer.Digest))
+		if err != nil {
+			return nil, status.InternalErrorf("failed to stat layer: %s", err)
+		}
+		if !ok {
+			return nil, status.NotFoundErrorf("layer %s not found", layer.Digest)
+		}
+		s.use(s.blobPath(layer.Digest), layer.Size)
+	}
+	b, err = os.ReadFile(s.blobPath(manifest.Config.Digest))
+	if os.IsNotExist(err) {
+		return nil, status.NotFoundErrorf("config %s not found", manifest.Config.Digest)
+	}
+	if err != nil {
+		return nil, status.InternalErrorf("failed to read image config: %s", err)
+	}
+	config := &ocispec.Image{}
+	if err := json.Unmarshal(b, config); err != nil {
+		return nil, status.InternalErrorf("failed to decode image config: %s", err)
+	}
+	s.use(s.blobPath(manifest.Config.Digest), int64(len(b)))
+	return &Image{
+		Ref:        ref.String(),
+		Digest:     d,
+		Manifest:   manifestDesc,
+		ConfigBlob: manifest.Config,
+		Layers:     manifest.Layers,
+		Config:     config.Config,
+	}, nil
+}
+
+// OpenBlob opens one of the image's blobs, such as its manifest or one of its
+// layers. It returns a NotFound error if the blob was evicted.
+func (s *Store) OpenBlob(d digest.Digest) (*os.File, error) {
+	f, err := os.Open(s.blobPath(d))
+	if os.IsNotExist(err) {
+		return nil, status.NotFoundErrorf("blob %s not found", d)
+	}
+	if err != nil {
+		return nil, status.InternalErrorf("failed to open blob: %s", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, status.InternalErrorf("failed to stat blob: %s", err)
+	}
+	s.use(s.blobPath(d), info.Size())
+	return f, nil
+}
+
+func parseManifest(b []byte) (*ocispec.Manifest, error) {
+	manifest := &ocispec.Manifest{}
+	if err := json.Unmarshal(b, manifest); err != nil {
+		return nil, status.UnavailableErrorf("failed to decode manifest: %s", err)
+	}
+	for _, desc := range append([]ocispec.Descriptor{manifest.Config}, manifest.Layers...) {
+		if err := desc.Digest.Validate(); err != nil {
+			return nil, status.UnavailableErrorf("invalid digest %q in manifest: %s", desc.Digest, err)
+		}
+	}
+	return manifest, nil
+}
+
+// manifestMediaType returns the media type that an image manifest declares,
+// which is optional for OCI manifests.
+func manifestMediaType(b []byte) string {
+	m := struct {
+		MediaType string `json:"mediaType"`
+	}{}
+	if err := json.Unmarshal(b, &m); err != nil || m.MediaType == "" {
+		return ocispec.MediaTypeImageManifest
+	}
+	return m.MediaType
+}
+
+// fetchBlob downloads a blob into the store, unless it is already there.
+func (s *Store) fetchBlob(ctx context.Context, client *registryClient, desc ocispec.Descriptor) error {
+	path := s.blobPath(desc.Digest)
+	if ok, err := exists(path); err != nil {
+		return status.InternalErrorf("failed to stat blob: %s", err)
+	} else if ok {
+		return nil
+	}
+	_, err, _ := s.group.Do(path, func() (interface{}, error) {
+		if ok, err := exists(path); err != nil || ok {
+			return nil, err
+		}
+		r, err := client.blob(ctx, desc.Digest)
+		if err != nil {
+			return nil, status.WrapErrorf(err, "failed to download blob %s", desc.Digest)
+		}
+		defer r.Close()
+		return nil, s.writeVerifiedBlob(desc, r)
+	})
+	return err
+}
+
+// writeVerifiedBlob writes a blob to the store, failing if its contents
+// don't match its descriptor.
+func (s *Store) writeVerifiedBlob(desc ocispec.Descriptor, r io.Reader) error {
+	f, err := os.CreateTemp(filepath.Join(s.rootDir, "tmp"), "blob-*")
+	if err != nil {
+		return status.InternalErrorf("failed to create blob: %s", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	verifier := desc.Digest.Verifier()
+	n, err := io.Copy(io.MultiWriter(f, verifier), io.LimitReader(r, desc.Size+1))
+	if err != nil {
+		return status.UnavailableErrorf("failed to download blob %s: %s", desc.Digest, err)
+	}
+	if n != desc.Size || !verifier.Verified() {
+		return status.DataLossErrorf("downloaded blob does not match digest %s and size %d", desc.Digest, desc.Size)
+	}
+	if err := f.Close(); err != nil {
+		return status.InternalErrorf("failed to write blob: %s", err)
+	}
+	if err := os.Rename(f.Name(), s.blobPath(desc.Digest)); err != nil {
+		return status.InternalErrorf("failed to write blob: %s", err)
+	}
+	s.use(s.blobPath(desc.Digest), desc.Size)
+	return nil
+}
+
+// writeBlob writes a blob that was already verified to the store.
+func (s *Store) writeBlob(d digest.Digest, b []byte) error {
+	if err := s.writeFileAtomically(s.blobPath(d), b); err != nil {
+		return err
+	}
+	s.use(s.blobPath(d), int64(len(b)))
+	return nil
+}
+
+func (s *Store) writeFileAtomically(path string, b []byte) error {
+	f, err := os.CreateTemp(filepath.Join(s.rootDir, "tmp"), "file-*")
+	if err != nil {
+		return status.InternalErrorf("failed to create file: %s", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if _, err := f.Write(b); err != nil {
+		return status.InternalErrorf("failed to write file: %s", err)
+	}
+	if err := f.Close(); err != nil {
+		return status.InternalErrorf("failed to write file: %s", err)
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return status.InternalErrorf("failed to write file: %s", err)
+	}
+	return nil
+}
+
+// CachedDiskImage hard-links the ext4 disk image holding the image's root
+// filesystem to path, if it was created before, and returns whether it was.
+// The caller owns the link, so the disk image stays intact if the store
+// evicts it.
+func (s *Store) CachedDiskImage(img *Image, path string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	src := s.diskImagePath(img)
+	info, err := os.Stat(src)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, status.InternalErrorf("failed to stat disk image: %s", err)
+	}
+	if err := os.Link(src, path); err != nil {
+		return false, status.InternalErrorf("failed to link disk image: %s", err)
+	}
+	s.useLocked(src, info.Size())
+	return true, nil
+}
+
+// DiskImage hard-links an ext4 disk image holding the image's root
+// filesystem to path, creating the disk image in the store if needed. The
+// caller owns the link, so the disk image stays intact if the store evicts
+// it, but must not modify it.
+func (s *Store) DiskImage(ctx context.Context, img *Image, path string) error {
+	diskImagePath := s.diskImagePath(img)
+	_, err, _ := s.group.Do(diskImagePath, func() (interface{}, error) {
+		if ok, err := exists(diskImagePath); err != nil || ok {
+			return nil, err
+		}
+		rootFSDir, err := os.MkdirTemp(filepath.Join(s.rootDir, "tmp"), "rootfs-*")
+		if err != nil {
+			return nil, status.InternalErrorf("failed to create rootfs dir: %s", err)
+		}
+		defer os.RemoveAll(rootFSDir)
+		if err := s.Unpack(ctx, img, rootFSDir); err != nil {
+			return nil, err
+		}
+		imageFile := filepath.Join(s.rootDir, "tmp", filepath.Base(rootFSDir)+".ext4")
+		defer os.Remove(imageFile)
+		if err := ext4.DirectoryToImageAutoSize(ctx, rootFSDir, imageFile); err != nil {
+			return nil, err
+		}
+		if err := os.MkdirAll(filepath.Dir(diskImagePath), 0755); err != nil {
+			return nil, status.InternalErrorf("failed to create disk image dir: %s", err)
+		}
+		if err := os.Rename(imageFile, diskImagePath); err != nil {
+			return nil, status.InternalErrorf("failed to write disk image: %s", err)
+		}
+		log.Debugf("Wrote disk image for %q to %q", img.Ref, diskImagePath)
+		return nil, nil
+	})
+	if err != nil {
+		return err
+	}
+	ok, err := s.CachedDiskImage(img, path)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return status.UnavailableErrorf("disk image for %q was evicted from the image store before it could be used", img.Ref)
+	}
+	return nil
+}
@@ -0,0 +1,241 @@
+package imagestore_test
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/container"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/imagestore"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/testutil/testregistry"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testfs"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func newStore(t *testing.T) *imagestore.Store {
+	s, err := imagestore.New(testfs.MakeTempDir(t), 1e9)
+	require.NoError(t, err)
+	return s
+}
+
+// dirSize returns the total size of the files below dir.
+func dirSize(t *testing.T, dir string) int64 {
+	size := int64(0)
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	return size
+}
+
+func TestPull_DedupesLayers(t *testing.T) {
+	ctx := context.Background()
+	reg := testregistry.Run(t, nil)
+	base := testregistry.Layer{"etc/": "", "etc/os-release": "test"}
+	ref1 := reg.Push(t, "test/one:latest", base, testregistry.Layer{"one.txt": "1"})
+	ref2 := reg.Push(t, "test/two:latest", base, testregistry.Layer{"two.txt": "2"})
+	s := newStore(t)
+
+	img1, err := s.Pull(ctx, ref1, container.PullCredentials{})
+	require.NoError(t, err)
+	img2, err := s.Pull(ctx, ref2, container.PullCredentials{})
+	require.NoError(t, err)
+
+	require.Len(t, img1.Layers, 2)
+	require.Len(t, img2.Layers, 2)
+	baseDigest := testregistry.LayerDigest(t, base)
+	assert.Equal(t, baseDigest, img1.Layers[0].Digest)
+	assert.Equal(t, baseDigest, img2.Layers[0].Digest)
+	assert.Equal(t, 1, reg.BlobRequests(baseDigest), "shared layer should only be downloaded once")
+	assert.Equal(t, []string{"PATH=/usr/bin:/bin"}, img1.Config.Env)
+
+	// Pulling again should not download any layers.
+	_, err = s.Pull(ctx, ref1, container.PullCredentials{})
+	require.NoError(t, err)
+	assert.Equal(t, 1, reg.BlobRequests(img1.Layers[1].Digest))
+}
+
+func TestCachedImage(t *testing.T) {
+	ctx := context.Background()
+	reg := testregistry.Run(t, nil)
+	ref := reg.Push(t, "test/image:latest", testregistry.Layer{"hello.txt": "hello"})
+	s := newStore(t)
+
+	img, err := s.CachedImage(ref)
+	require.NoError(t, err)
+	assert.Nil(t, img)
+
+	pulled, err := s.Pull(ctx, ref, container.PullCredentials{})
+	require.NoError(t, err)
+
+	img, err = s.CachedImage(ref)
+	require.NoError(t, err)
+	assert.Equal(t, pulled, img)
+
+	ok, err := s.CachedDiskImage(img, filepath.Join(testfs.MakeTempDir(t), "containerfs.ext4"))
+	require.NoError(t, err)
+	assert.False(t, ok, "disk image should not exist until it is created")
+}
+
+func TestOpenBlob(t *testing.T) {
+	ctx := context.Background()
+	reg := testregistry.Run(t, nil)
+	ref := reg.Push(t, "test/image:latest", testregistry.Layer{"hello.txt": "hello"})
+	s := newStore(t)
+
+	img, err := s.Pull(ctx, ref, container.PullCredentials{})
+	require.NoError(t, err)
+
+	assert.Equal(t, img.Digest, img.Manifest.Digest)
+	assert.Equal(t, ocispec.MediaTypeImageManifest, img.Manifest.MediaType)
+	assert.Equal(t, ocispec.MediaTypeImageConfig, img.ConfigBlob.MediaType)
+	for _, desc := range append([]ocispec.Descriptor{img.Manifest, img.ConfigBlob}, img.Layers...) {
+		f, err := s.OpenBlob(desc.Digest)
+		require.NoError(t, err)
+		b, err := io.ReadAll(f)
+		f.Close()
+		require.NoError(t, err)
+		assert.Equal(t, desc.Size, int64(len(b)))
+		assert.Equal(t, desc.Digest, digest.FromBytes(b))
+	}
+
+	_, err = s.OpenBlob(digest.FromString("missing"))
+	assert.True(t, status.IsNotFoundError(err), "expected NotFound, got %v", err)
+}
+
+func TestPull_EvictsLeastRecentlyUsedBlobs(t *testing.T) {
+	ctx := context.Background()
+	reg := testregistry.Run(t, nil)
+	ref1 := reg.Push(t, "test/one:latest", testregistry.Layer{"one.txt": "1"})
+	ref2 := reg.Push(t, "test/two:latest", testregistry.Layer{"two.txt": "2"})
+
+	// Measure how much space the blobs of an image take.
+	dir := testfs.MakeTempDir(t)
+	s, err := imagestore.New(dir, 1e9)
+	require.NoError(t, err)
+	_, err = s.Pull(ctx, ref1, container.PullCredentials{})
+	require.NoError(t, err)
+	imageSize := dirSize(t, filepath.Join(dir, "blobs"))
+
+	// Make room for one and a half images.
+	dir = testfs.MakeTempDir(t)
+	s, err = imagestore.New(dir, imageSize*3/2)
+	require.NoError(t, err)
+	_, err = s.Pull(ctx, ref1, container.PullCredentials{})
+	require.NoError(t, err)
+	_, err = s.Pull(ctx, ref2, container.PullCredentials{})
+	require.NoError(t, err)
+
+	assert.LessOrEqual(t, dirSize(t, filepath.Join(dir, "blobs")), imageSize*3/2)
+	img, err := s.CachedImage(ref1)
+	require.NoError(t, err)
+	assert.Nil(t, img, "least recently used image should be evicted")
+	img, err = s.CachedImage(ref2)
+	require.NoError(t, err)
+	assert.NotNil(t, img)
+
+	// Evicted images are pulled again.
+	_, err = s.Pull(ctx, ref1, container.PullCredentials{})
+	require.NoError(t, err)
+	img, err = s.CachedImage(ref1)
+	require.NoError(t, err)
+	assert.NotNil(t, img)
+
+	// The store keeps tracking its files across restarts.
+	s, err = imagestore.New(dir, imageSize*3/2)
+	require.NoError(t, err)
+	_, err = s.Pull(ctx, ref2, container.PullCredentials{})
+	require.NoError(t, err)
+	img, err = s.CachedImage(ref1)
+	require.NoError(t, err)
+	assert.Nil(t, img)
+}
+
+func TestPull_Auth(t *testing.T) {
+	ctx := context.Background()
+	reg := testregistry.Run(t, &testregistry.Opts{Username: "user", Password: "pass"})
+	ref := reg.Push(t, "test/private:latest", testregistry.Layer{"secret.txt": "secret"})
+	s := newStore(t)
+
+	_, err := s.Pull(ctx, ref, container.PullCredentials{})
+	assert.True(t, status.IsUnauthenticatedError(err), "expected Unauthenticated error, got: %s", err)
+
+	_, err = s.Pull(ctx, ref, container.PullCredentials{Username: "user", Password: "wrong"})
+	assert.True(t, status.IsUnauthenticatedError(err), "expected Unauthenticated error, got: %s", err)
+
+	img, err := s.Pull(ctx, ref, container.PullCredentials{Username: "user", Password: "pass"})
+	require.NoError(t, err)
+	assert.Len(t, img.Layers, 1)
+}
+
+func TestPull_Index(t *testing.T) {
+	ctx := context.Background()
+	reg := testregistry.Run(t, nil)
+	ref := reg.PushIndex(t, "test/multiarch:latest", map[string][]testregistry.Layer{
+		runtime.GOARCH: {{"arch.txt": runtime.GOARCH}},
+		"fakearch":     {{"arch.txt": "fakearch"}},
+	})
+	s := newStore(t)
+
+	img, err := s.Pull(ctx, ref, container.PullCredentials{})
+	require.NoError(t, err)
+
+	dir := testfs.MakeTempDir(t)
+	require.NoError(t, s.Unpack(ctx, img, dir))
+	assert.Equal(t, runtime.GOARCH, testfs.ReadFileAsString(t, dir, "arch.txt"))
+}
+
+func TestUnpack_Whiteouts(t *testing.T) {
+	ctx := context.Background()
+	reg := testregistry.Run(t, nil)
+	ref := reg.Push(
+		t, "test/whiteouts:latest",
+		testregistry.Layer{
+			"bin/":             "",
+			"bin/tool":         "v1",
+			"etc/":             "",
+			"etc/removed.conf": "removed",
+			"etc/kept.conf":    "kept",
+			"opaque/":          "",
+			"opaque/old.txt":   "old",
+		},
+		testregistry.Layer{
+			"bin/tool":             "v2",
+			"etc/.wh.removed.conf": "",
+			"opaque/":              "",
+			"opaque/.wh..wh..opq":  "",
+			"opaque/new.txt":       "new",
+		},
+	)
+	s := newStore(t)
+	img, err := s.Pull(ctx, ref, container.PullCredentials{})
+	require.NoError(t, err)
+
+	dir := testfs.MakeTempDir(t)
+	require.NoError(t, s.Unpack(ctx, img, dir))
+
+	assert.Equal(t, "v2", testfs.ReadFileAsString(t, dir, "bin/tool"))
+	assert.Equal(t, "kept", testfs.ReadFileAsString(t, dir, "etc/kept.conf"))
+	assert.NoFileExists(t, filepath.Join(dir, "etc/removed.conf"))
+	assert.NoFileExists(t, filepath.Join(dir, "etc/.wh.removed.conf"))
+	assert.NoFileExists(t, filepath.Join(dir, "opaque/old.txt"))
+	assert.NoFileExists(t, filepath.Join(dir, "opaque/.wh..wh..opq"))
+	assert.Equal(t, "new", testfs.ReadFileAsString(t, dir, "opaque/new.txt"))
+	fi, err := os.Stat(filepath.Join(dir, "bin"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0755), fi.Mode().Perm())
+}
@@ -0,0 +1,287 @@
+package imagestore
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"runtime"
+	"strings"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/container"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/docker/distribution/reference"
+	"github.com/opencontainers/go-digest"
+
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	dockerHubDomain   = "docker.io"
+	dockerHubRegistry = "registry-1.docker.io"
+
+	dockerManifestMediaType     = "application/vnd.docker.distribution.manifest.v2+json"
+	dockerManifestListMediaType = "application/vnd.docker.distribution.manifest.list.v2+json"
+
+	// The maximum size of a manifest, which is read into memory.
+	maxManifestSizeBytes = 4e6
+)
+
+var (
+	manifestMediaTypes = []string{
+		ocispec.MediaTypeImageManifest,
+		ocispec.MediaTypeImageIndex,
+		dockerManifestMediaType,
+		dockerManifestListMediaType,
+	}
+
+	authParamRegexp = regexp.MustCompile(`(\w+)="([^"]*)"`)
+)
+
+// registryClient fetches the manifests and blobs of a single repository
+// from a registry, using the Docker Registry HTTP API V2.
+type registryClient struct {
+	httpClient *http.Client
+	creds      container.PullCredentials
+	// baseURL is the URL of the repository, such as
+	// "https://registry-1.docker.io/v2/library/ubuntu".
+	baseURL string
+	// repository is the name of the repository within the registry, such as
+	// "library/ubuntu".
+	repository string
+	// authorization is the value of the Authorization header sent with
+	// requests, once the registry has asked for authentication.
+	authorization string
+}
+
+func newRegistryClient(httpClient *http.Client, ref reference.Named, creds container.PullCredentials) *registryClient {
+	host := reference.Domain(ref)
+	if host == dockerHubDomain {
+		host = dockerHubRegistry
+	}
+	// Like Docker, talk to registries on the local host over plain HTTP.
+	hostname := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		hostname = h
+	}
+	scheme := "https"
+	if isLocalhost(hostname) {
+		scheme = "http"
+	}
+	return &registryClient{
+		httpClient: httpClient,
+		creds:      creds,
+		baseURL:    fmt.Sprintf("%s://%s/v2/%s", scheme, host, reference.Path(ref)),
+		repository: reference.Path(ref),
+	}
+}
+
+func isLocalhost(hostname string) bool {
+	if hostname == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(hostname)
+	return ip != nil && ip.IsLoopback()
+}
+
+// get sends a GET request for the given path within the repository,
+// authenticating with the registry if it asks for it.
+func (c *registryClient) get(ctx context.Context, path string, accept ...string) (*http.Response, error) {
+	rsp, err := c.send(ctx, path, accept)
+	if err != nil {
+		return nil, err
+	}
+	if rsp.StatusCode == http.StatusUnauthorized && c.authorization == "" {
+		challenge := rsp.Header.Get("WWW-Authenticate")
+		rsp.Body.Close()
+		if err := c.authenticate(ctx, challenge); err != nil {
+			return nil, err
+		}
+		rsp, err = c.send(ctx, path, accept)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if rsp.StatusCode != http.StatusOK {
+		defer rsp.Body.Close()
+		return nil, httpError(rsp, fmt.Sprintf("GET %s", path))
+	}
+	return rsp, nil
+}
+
+func (c *registryClient) send(ctx context.Context, path string, accept []string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL+path, nil)
+	if err != nil {
+		return nil, status.InternalErrorf("failed to create registry request: %s", err)
+	}
+	for _, mediaType := range accept {
+		req.Header.Add("Accept", mediaType)
+	}
+	if c.authorization != "" {
+		req.Header.Set("Authorization", c.authorization)
+	}
+	rsp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, status.UnavailableErrorf("registry request failed: %s", err)
+	}
+	return rsp, nil
+}
+
+// authenticate answers the registry's authentication challenge, either by
+// sending the pull credentials with each request, or by exchanging them for
+// a bearer token with the registry's token service.
+func (c *registryClient) authenticate(ctx context.Context, challenge string) error {
+	scheme, params := parseChallenge(challenge)
+	switch strings.ToLower(scheme) {
+	case "basic":
+		if c.creds.IsEmpty() {
+			return status.UnauthenticatedError("registry requires credentials")
+		}
+		c.authorization = "Basic " + base64.StdEncoding.EncodeToString([]byte(c.creds.String()))
+		return nil
+	case "bearer":
+		token, err := c.fetchToken(ctx, params)
+		if err != nil {
+			return err
+		}
+		c.authorization = "Bearer " + token
+		return nil
+	default:
+		return status.UnauthenticatedErrorf("unsupported registry authentication challenge %q", challenge)
+	}
+}
+
+func parseChallenge(challenge string) (string, map[string]string) {
+	scheme, rest := challenge, ""
+	if i := strings.Index(challenge, " "); i >= 0 {
+		scheme, rest = challenge[:i], challenge[i+1:]
+	}
+	params := map[string]string{}
+	for _, m := range authParamRegexp.FindAllStringSubmatch(rest, -1) {
+		params[strings.ToLower(m[1])] = m[2]
+	}
+	return scheme, params
+}
+
+func (c *registryClient) fetchToken(ctx context.Context, params map[string]string) (string, error) {
+	realm, err := url.Parse(params["realm"])
+	if err != nil || params["realm"] == "" {
+		return "", status.UnavailableErrorf("invalid registry token realm %q", params["realm"])
+	}
+	q := realm.Query()
+	if service := params["service"]; service != "" {
+		q.Set("service", service)
+	}
+	scope := params["scope"]
+	if scope == "" {
+		scope = fmt.Sprintf("repository:%s:pull", c.repository)
+	}
+	q.Set("scope", scope)
+	realm.RawQuery = q.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, realm.String(), nil)
+	if err != nil {
+		return "", status.InternalErrorf("failed to create token request: %s", err)
+	}
+	if !c.creds.IsEmpty() {
+		req.SetBasicAuth(c.creds.Username, c.creds.Password)
+	}
+	rsp, err := c.httpClient.Do(req)
+	if err != nil {
+		return "", status.UnavailableErrorf("registry token request failed: %s", err)
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		return "", httpError(rsp, "registry token request")
+	}
+	tokenRsp := struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}{}
+	if err := json.NewDecoder(io.LimitReader(rsp.Body, maxManifestSizeBytes)).Decode(&tokenRsp); err != nil {
+		return "", status.UnavailableErrorf("failed to decode registry token: %s", err)
+	}
+	if tokenRsp.Token != "" {
+		return tokenRsp.Token, nil
+	}
+	if tokenRsp.AccessToken != "" {
+		return tokenRsp.AccessToken, nil
+	}
+	return "", status.UnavailableError("registry token response did not contain a token")
+}
+
+func httpError(rsp *http.Response, what string) error {
+	body, _ := io.ReadAll(io.LimitReader(rsp.Body, 1024))
+	msg := fmt.Sprintf("%s: %s: %s", what, rsp.Status, strings.TrimSpace(string(body)))
+	switch rsp.StatusCode {
+	case http.StatusUnauthorized:
+		return status.UnauthenticatedError(msg)
+	case http.StatusForbidden:
+		return status.PermissionDeniedError(msg)
+	case http.StatusNotFound:
+		return status.NotFoundError(msg)
+	case http.StatusTooManyRequests:
+		return status.ResourceExhaustedError(msg)
+	default:
+		return status.UnavailableError(msg)
+	}
+}
+
+// manifest fetches the manifest with the given tag or digest. If it is an
+// index of manifests for multiple platforms, the manifest for the current
+// platform is fetched instead. It returns the manifest's contents and
+// digest.
+func (c *registryClient) manifest(ctx context.Context, tagOrDigest string) ([]byte, digest.Digest, error) {
+	b, d, err := c.fetchManifest(ctx, tagOrDigest)
+	if err != nil {
+		return nil, "", err
+	}
+	index := &ocispec.Index{}
+	if err := json.Unmarshal(b, index); err != nil {
+		return nil, "", status.UnavailableErrorf("failed to decode manifest %s: %s", d, err)
+	}
+	if len(index.Manifests) == 0 {
+		return b, d, nil
+	}
+	for _, m := range index.Manifests {
+		if m.Platform != nil && m.Platform.OS == "linux" && m.Platform.Architecture == runtime.GOARCH {
+			return c.fetchManifest(ctx, m.Digest.String())
+		}
+	}
+	return nil, "", status.NotFoundErrorf("image index %s does not contain a manifest for linux/%s", d, runtime.GOARCH)
+}
+
+func (c *registryClient) fetchManifest(ctx context.Context, tagOrDigest string) ([]byte, digest.Digest, error) {
+	rsp, err := c.get(ctx, "/manifests/"+tagOrDigest, manifestMediaTypes...)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rsp.Body.Close()
+	b, err := io.ReadAll(io.LimitReader(rsp.Body, maxManifestSizeBytes+1))
+	if err != nil {
+		return nil, "", status.UnavailableErrorf("failed to read manifest: %s", err)
+	}
+	if len(b) > maxManifestSizeBytes {
+		return nil, "", status.ResourceExhaustedErrorf("manifest %s is too large", tagOrDigest)
+	}
+	d := digest.FromBytes(b)
+	if expected, err := digest.Parse(tagOrDigest); err == nil && expected != d {
+		return nil, "", status.DataLossErrorf("manifest digest mismatch: expected %s, got %s", expected, d)
+	}
+	return b, d, nil
+}
+
+// blob returns a reader for the blob with the given digest. The caller is
+// responsible for verifying its contents.
+func (c *registryClient) blob(ctx context.Context, d digest.Digest) (io.ReadCloser, error) {
+	rsp, err := c.get(ctx, "/blobs/"+d.String())
+	if err != nil {
+		return nil, err
+	}
+	return rsp.Body, nil
+}
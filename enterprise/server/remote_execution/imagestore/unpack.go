@@ -0,0 +1,308 @@
+package imagestore
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+)
+
+const (
+	// whiteoutPrefix marks a file in a layer which deletes the file with the
+	// rest of its name from the layers below.
+	whiteoutPrefix = ".wh."
+	// opaqueWhiteout marks a directory in a layer which hides the contents of
+	// that directory in the layers below.
+	opaqueWhiteout = ".wh..wh..opq"
+
+	// The maximum number of symlinks which are followed when resolving a
+	// path, as in Linux.
+	maxSymlinkHops = 40
+)
+
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// Unpack unpacks the image's layers into dir, which must be empty. Whiteout
+// files are applied, and are not written to dir.
+//
+// When not running as root, file ownership is not preserved, and device
+// files are skipped, which is enough to run most images.
+func (s *Store) Unpack(ctx context.Context, img *Image, dir string) error {
+	u := &unpacker{
+		root:     dir,
+		dirModes: map[string]os.FileMode{},
+		isRoot:   os.Geteuid() == 0,
+	}
+	for _, layer := range img.Layers {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := u.unpackLayerFile(s.blobPath(layer.Digest)); err != nil {
+			return status.WrapErrorf(err, "failed to unpack layer %s", layer.Digest)
+		}
+	}
+	return u.restoreDirModes()
+}
+
+type unpacker struct {
+	root   string
+	isRoot bool
+	// dirModes holds the modes of the directories that were unpacked. They
+	// are only applied once all layers are unpacked, so that files can be
+	// added to directories which aren't writable.
+	dirModes map[string]os.FileMode
+	// layerPaths holds the paths which were unpacked from the current layer,
+	// which are not hidden by its opaque whiteouts.
+	layerPaths map[string]struct{}
+}
+
+func (u *unpacker) unpackLayerFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return status.InternalErrorf("failed to open layer: %s", err)
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	// Layers are usually compressed with gzip, but may also be uncompressed
+	// tarballs.
+	var layer io.Reader = r
+	if magic, err := r.Peek(len(gzipMagic)); err == nil && bytes.Equal(magic, gzipMagic) {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return status.InvalidArgumentErrorf("failed to decompress layer: %s", err)
+		}
+		defer gz.Close()
+		layer = gz
+	}
+	return u.unpackLayer(tar.NewReader(layer))
+}
+
+func (u *unpacker) unpackLayer(tr *tar.Reader) error {
+	u.layerPaths = map[string]struct{}{}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return status.InvalidArgumentErrorf("failed to read layer: %s", err)
+		}
+		if err := u.unpackEntry(hdr, tr); err != nil {
+			return status.WrapErrorf(err, "failed to unpack %q", hdr.Name)
+		}
+	}
+}
+
+// resolve returns the path on disk of a path within the root filesystem.
+// Symlinks in the path's parent directories are followed, but are never
+// allowed to point outside of the root filesystem.
+func (u *unpacker) resolve(name string) (string, error) {
+	name = filepath.Clean("/" + name)
+	if name == "/" {
+		return u.root, nil
+	}
+	parent, err := u.resolveDir(filepath.Dir(name), 0)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(parent, filepath.Base(name)), nil
+}
+
+func (u *unpacker) resolveDir(name string, hops int) (string, error) {
+	resolved := "/"
+	components := strings.Split(strings.TrimPrefix(filepath.Clean("/"+name), "/"), "/")
+	for i, c := range components {
+		if c == "" {
+			continue
+		}
+		next := filepath.Join(resolved, c)
+		fi, err := os.Lstat(filepath.Join(u.root, next))
+		if err != nil || fi.Mode()&os.ModeSymlink == 0 {
+			// Missing directories are created as needed by unpackEntry.
+			resolved = next
+			continue
+		}
+		if hops++; hops > maxSymlinkHops {
+			return "", status.InvalidArgumentErrorf("too many levels of symbolic links in %q", name)
+		}
+		target, err := os.Readlink(filepath.Join(u.root, next))
+		if err != nil {
+			return "", status.InternalErrorf("failed to read symlink: %s", err)
+		}
+		if !filepath.IsAbs(target) {
+			target = filepath.Join(resolved, target)
+		}
+		rest := filepath.Join(append([]string{target}, components[i+1:]...)...)
+		return u.resolveDir(rest, hops)
+	}
+	return filepath.Join(u.root, resolved), nil
+}
+
+func (u *unpacker) unpackEntry(hdr *tar.Header, r io.Reader) error {
+	name := filepath.Clean("/" + hdr.Name)
+	base := filepath.Base(name)
+	if base == opaqueWhiteout {
+		return u.applyOpaqueWhiteout(filepath.Dir(name))
+	}
+	if strings.HasPrefix(base, whiteoutPrefix) {
+		path, err := u.resolve(filepath.Join(filepath.Dir(name), strings.TrimPrefix(base, whiteoutPrefix)))
+		if err != nil {
+			return err
+		}
+		return removeAll(path)
+	}
+
+	path, err := u.resolve(name)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return status.InternalErrorf("failed to create parent directory: %s", err)
+	}
+	u.layerPaths[path] = struct{}{}
+	mode := hdr.FileInfo().Mode()
+
+	// Replace whatever was at the path in lower layers, other than a
+	// directory which is replaced by a directory.
+	fi, err := os.Lstat(path)
+	if err == nil && !(fi.IsDir() && hdr.Typeflag == tar.TypeDir) {
+		if err := removeAll(path); err != nil {
+			return err
+		}
+	}
+
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		if err := os.Mkdir(path, 0700); err != nil && !os.IsExist(err) {
+			return status.InternalErrorf("failed to create directory: %s", err)
+		}
+		// Keep the directory writable until all layers are unpacked.
+		if err := os.Chmod(path, mode.Perm()|0700); err != nil {
+			return status.InternalErrorf("failed to chmod directory: %s", err)
+		}
+		u.dirModes[path] = mode
+	case tar.TypeReg, tar.TypeRegA:
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err != nil {
+			return status.InternalErrorf("failed to create file: %s", err)
+		}
+		_, err = io.Copy(f, r)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return status.InternalErrorf("failed to write file: %s", err)
+		}
+		if err := os.Chmod(path, modeBits(mode)); err != nil {
+			return status.InternalErrorf("failed to chmod file: %s", err)
+		}
+	case tar.TypeSymlink:
+		if err := os.Symlink(hdr.Linkname, path); err != nil {
+			return status.InternalErrorf("failed to create symlink: %s", err)
+		}
+	case tar.TypeLink:
+		target, err := u.resolve(hdr.Linkname)
+		if err != nil {
+			return err
+		}
+		if err := os.Link(target, path); err != nil {
+			return status.InternalErrorf("failed to create hard link: %s", err)
+		}
+	case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		// Device files can't be created without privileges, and are
+		// provided by the container runtime anyway.
+		log.Debugf("Skipping special file %q in image layer", name)
+		delete(u.layerPaths, path)
+		return nil
+	default:
+		log.Debugf("Skipping %q in image layer with unsupported type %q", name, hdr.Typeflag)
+		delete(u.layerPaths, path)
+		return nil
+	}
+
+	if u.isRoot {
+		if err := os.Lchown(path, hdr.Uid, hdr.Gid); err != nil {
+			return status.InternalErrorf("failed to chown: %s", err)
+		}
+		// Changing the owner clears the setuid and setgid bits.
+		if hdr.Typeflag == tar.TypeReg || hdr.Typeflag == tar.TypeRegA {
+			if err := os.Chmod(path, modeBits(mode)); err != nil {
+				return status.InternalErrorf("failed to chmod file: %s", err)
+			}
+		}
+	}
+	if hdr.Typeflag != tar.TypeSymlink {
+		if err := os.Chtimes(path, hdr.ModTime, hdr.ModTime); err != nil {
+			return status.InternalErrorf("failed to set modification time: %s", err)
+		}
+	}
+	return nil
+}
+
+// applyOpaqueWhiteout removes the contents of a directory which came from
+// lower layers.
+func (u *unpacker) applyOpaqueWhiteout(name string) error {
+	dir, err := u.resolve(name)
+	if err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return status.InternalErrorf("failed to read directory: %s", err)
+	}
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+		if _, ok := u.layerPaths[path]; ok {
+			continue
+		}
+		if err := removeAll(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (u *unpacker) restoreDirModes() error {
+	for path, mode := range u.dirModes {
+		if err := os.Chmod(path, mode.Perm()); err != nil && !os.IsNotExist(err) {
+			return status.InternalErrorf("failed to chmod directory: %s", err)
+		}
+	}
+	return nil
+}
+
+// removeAll removes a path and its contents, including the contents of
+// directories which are not writable.
+func removeAll(path string) error {
+	err := os.RemoveAll(path)
+	if err == nil || os.IsNotExist(err) {
+		return nil
+	}
+	// Make the directories writable and try again.
+	filepath.Walk(path, func(p string, fi os.FileInfo, err error) error {
+		if err == nil && fi.IsDir() {
+			os.Chmod(p, 0700)
+		}
+		return nil
+	})
+	if err := os.RemoveAll(path); err != nil {
+		return status.InternalErrorf("failed to remove %q: %s", path, err)
+	}
+	return nil
+}
+
+// modeBits returns the os.FileMode bits that os.Chmod understands.
+func modeBits(mode os.FileMode) os.FileMode {
+	return mode & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+}
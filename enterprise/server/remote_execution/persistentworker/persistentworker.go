@@ -0,0 +1,348 @@
+// Package persistentworker speaks the Bazel persistent worker protocol with
+// a worker process: WorkRequests are written to the worker's stdin, and
+// WorkResponses are read from its stdout, either as length-delimited protos
+// or as JSON.
+package persistentworker
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
+
+	wkpb "github.com/buildbuddy-io/buildbuddy/proto/worker"
+)
+
+const (
+	// ProtocolJSON is the protocol of workers which read and write JSON
+	// values, one per line.
+	ProtocolJSON = "json"
+	// ProtocolProto is the protocol of workers which read and write
+	// length-delimited protos. It is the default.
+	ProtocolProto = "proto"
+
+	// The maximum number of bytes of the worker's stderr which are included
+	// in the error returned when it exits.
+	maxStderrBytesInError = 1024
+)
+
+// ExecFunc runs a worker process with the given stdin and stdout, returning
+// once the process exits. The process must be killed when ctx is cancelled.
+type ExecFunc func(ctx context.Context, stdin io.Reader, stdout io.Writer) *interfaces.CommandResult
+
+// Worker is a running persistent worker process.
+//
+// A multiplex worker may handle several requests at once, which are told
+// apart by their request IDs. Other workers handle one request at a time.
+type Worker struct {
+	protocol  string
+	multiplex bool
+
+	cancel context.CancelFunc
+	// done is closed once the worker process exits, after result is set.
+	done   chan struct{}
+	result *interfaces.CommandResult
+
+	stdin io.WriteCloser
+	// stdoutPipe is the read end of the worker's stdout, which stdout reads
+	// from.
+	stdoutPipe io.Closer
+	stdout     *bufio.Reader
+	// jsonDecoder reads responses from stdout when using the JSON protocol.
+	jsonDecoder *json.Decoder
+
+	// writeMu serializes requests written to stdin, and ensures that a
+	// singleplex worker has only one request in flight.
+	writeMu sync.Mutex
+
+	mu sync.Mutex // protects(nextRequestID, pending, err)
+	// nextRequestID is the ID of the next request sent to a multiplex
+	// worker.
+	nextRequestID int32
+	// pending holds the channels on which responses are delivered, keyed by
+	// request ID.
+	pending map[int32]chan *wkpb.WorkResponse
+	// err is set once the worker can no longer be used, because it exited or
+	// wrote a response which couldn't be read.
+	err error
+}
+
+// Start starts a worker process using exec, which speaks the given protocol.
+func Start(protocol string, multiplex bool, exec ExecFunc) (*Worker, error) {
+	if protocol == "" {
+		protocol = ProtocolProto
+	}
+	if protocol != ProtocolJSON && protocol != ProtocolProto {
+		return nil, status.FailedPreconditionErrorf("unsupported persistent worker type %s", protocol)
+	}
+	// Stdin is an OS pipe rather than an in-memory pipe, so that it is passed
+	// to the worker process as is. Otherwise, waiting for the process would
+	// also wait for requests to be copied to it, which never completes once
+	// the process has exited without reading them.
+	stdinReader, stdinWriter, err := os.Pipe()
+	if err != nil {
+		return nil, status.UnavailableErrorf("failed to create persistent worker stdin: %s", err)
+	}
+	stdoutReader, stdoutWriter := io.Pipe()
+	// The worker process outlives the requests that it handles, so it is not
+	// started with a request's context.
+	ctx, cancel := context.WithCancel(context.Background())
+	w := &Worker{
+		protocol:      protocol,
+		multiplex:     multiplex,
+		cancel:        cancel,
+		done:          make(chan struct{}),
+		stdin:         stdinWriter,
+		stdoutPipe:    stdoutReader,
+		stdout:        bufio.NewReader(stdoutReader),
+		nextRequestID: 1,
+		pending:       map[int32]chan *wkpb.WorkResponse{},
+	}
+	w.jsonDecoder = json.NewDecoder(w.stdout)
+	go func() {
+		w.result = exec(ctx, stdinReader, stdoutWriter)
+		log.Debugf("Persistent worker exited with result: %+v", w.result)
+		close(w.done)
+		// Unblock any pending reads of responses and writes of requests.
+		stdoutWriter.Close()
+		stdinReader.Close()
+		stdinWriter.Close()
+	}()
+	if multiplex {
+		go w.readResponses()
+	}
+	return w, nil
+}
+
+// Multiplex returns whether the worker handles several requests at once.
+func (w *Worker) Multiplex() bool {
+	return w.multiplex
+}
+
+// Exited returns whether the worker process has exited.
+func (w *Worker) Exited() bool {
+	select {
+	case <-w.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Err returns the error which made the worker unusable, if any.
+func (w *Worker) Err() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.err
+}
+
+// Stop kills the worker process and waits for it to exit.
+func (w *Worker) Stop() {
+	w.fail(status.UnavailableError("persistent worker was stopped"))
+	w.cancel()
+	// Output that the worker wrote but that was never read must not keep it
+	// from exiting.
+	w.stdoutPipe.Close()
+	<-w.done
+}
+
+// Send sends a request to the worker and waits for its response. The request
+// ID is set by Send.
+//
+// If ctx is done before a singleplex worker responds, the worker is stopped,
+// since it would otherwise respond to the next request with this response.
+// A multiplex worker is instead sent a request to cancel this one.
+func (w *Worker) Send(ctx context.Context, req *wkpb.WorkRequest) (*wkpb.WorkResponse, error) {
+	if !w.multiplex {
+		w.writeMu.Lock()
+		defer w.writeMu.Unlock()
+	}
+
+	req = proto.Clone(req).(*wkpb.WorkRequest)
+	w.mu.Lock()
+	if w.err != nil {
+		w.mu.Unlock()
+		return nil, w.err
+	}
+	req.RequestId = 0
+	if w.multiplex {
+		req.RequestId = w.nextRequestID
+		w.nextRequestID++
+	}
+	ch := make(chan *wkpb.WorkResponse, 1)
+	w.pending[req.RequestId] = ch
+	w.mu.Unlock()
+	defer func() {
+		w.mu.Lock()
+		delete(w.pending, req.RequestId)
+		w.mu.Unlock()
+	}()
+
+	if err := w.writeRequest(req); err != nil {
+		// Stdin is only closed once the worker process has exited, in which
+		// case the error should say how it exited.
+		if w.Exited() {
+			return nil, w.fail(w.readError(io.EOF))
+		}
+		return nil, w.fail(status.UnavailableErrorf("failed to write work request: %s", err))
+	}
+	if !w.multiplex {
+		// Singleplex workers' responses are only read while a request is in
+		// flight, so that nothing else written to stdout is mistaken for a
+		// response.
+		go w.readNextResponse()
+	}
+
+	select {
+	case rsp, ok := <-ch:
+		if !ok {
+			return nil, w.Err()
+		}
+		return rsp, nil
+	case <-ctx.Done():
+		if w.multiplex {
+			go w.cancelRequest(req.RequestId)
+		} else {
+			w.Stop()
+		}
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, status.DeadlineExceededError("timed out waiting for work response")
+		}
+		return nil, status.CanceledError("canceled while waiting for work response")
+	}
+}
+
+// cancelRequest asks a multiplex worker to cancel the request with the given
+// ID. The response to the request, if the worker still sends one, is dropped.
+func (w *Worker) cancelRequest(id int32) {
+	if err := w.writeRequest(&wkpb.WorkRequest{RequestId: id, Cancel: true}); err != nil {
+		log.Debugf("Failed to cancel persistent work request %d: %s", id, err)
+	}
+}
+
+func (w *Worker) writeRequest(req *wkpb.WorkRequest) error {
+	if w.multiplex {
+		w.writeMu.Lock()
+		defer w.writeMu.Unlock()
+	}
+	if w.protocol == ProtocolJSON {
+		marshaler := jsonpb.Marshaler{EmitDefaults: true}
+		if err := marshaler.Marshal(w.stdin, req); err != nil {
+			return err
+		}
+		_, err := fmt.Fprintf(w.stdin, "\n")
+		return err
+	}
+	buf := proto.NewBuffer( /* buf */ nil)
+	if err := buf.EncodeMessage(req); err != nil {
+		return err
+	}
+	_, err := w.stdin.Write(buf.Bytes())
+	return err
+}
+
+func (w *Worker) readResponse() (*wkpb.WorkResponse, error) {
+	rsp := &wkpb.WorkResponse{}
+	if w.protocol == ProtocolJSON {
+		unmarshaler := jsonpb.Unmarshaler{AllowUnknownFields: true}
+		if err := unmarshaler.UnmarshalNext(w.jsonDecoder, rsp); err != nil {
+			return nil, err
+		}
+		return rsp, nil
+	}
+	// Read the response size from stdout as a unsigned varint.
+	size, err := binary.ReadUvarint(w.stdout)
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(w.stdout, data); err != nil {
+		return nil, err
+	}
+	if err := proto.Unmarshal(data, rsp); err != nil {
+		return nil, err
+	}
+	return rsp, nil
+}
+
+// readResponses delivers a multiplex worker's responses to the requests
+// waiting for them, until the worker fails.
+func (w *Worker) readResponses() {
+	for w.readNextResponse() {
+	}
+}
+
+// readNextResponse reads a response and delivers it to the request waiting
+// for it. It returns false if the worker failed.
+func (w *Worker) readNextResponse() bool {
+	rsp, err := w.readResponse()
+	if err != nil {
+		w.fail(w.readError(err))
+		return false
+	}
+	w.mu.Lock()
+	id := rsp.GetRequestId()
+	if !w.multiplex {
+		// A singleplex worker has at most one request in flight, which always
+		// has ID 0.
+		id = 0
+	}
+	ch, ok := w.pending[id]
+	if ok {
+		ch <- rsp
+		delete(w.pending, id)
+	}
+	w.mu.Unlock()
+	// Responses to cancelled requests are expected to arrive after the
+	// request stopped waiting for them.
+	if !ok && !rsp.GetWasCancelled() {
+		log.Warningf("Dropping persistent worker response for unknown request ID %d", rsp.GetRequestId())
+	}
+	return true
+}
+
+// readError returns the error to report when a response can't be read. If
+// the worker exited, the error describes how.
+func (w *Worker) readError(err error) error {
+	if err != io.EOF && err != io.ErrUnexpectedEOF {
+		return status.UnavailableErrorf("failed to read work response: %s", err)
+	}
+	// Stdout is only closed once the worker process has exited.
+	<-w.done
+	res := w.result
+	stderr := res.Stderr
+	if len(stderr) > maxStderrBytesInError {
+		stderr = stderr[len(stderr)-maxStderrBytesInError:]
+	}
+	if res.Error != nil {
+		return status.UnavailableErrorf("persistent worker exited: %s; stderr: %q", res.Error, stderr)
+	}
+	return status.UnavailableErrorf("persistent worker exited with code %d; stderr: %q", res.ExitCode, stderr)
+}
+
+// fail marks the worker as unusable, and fails all pending requests with the
+// given error. It returns the error which made the worker unusable, which is
+// err unless the worker already failed.
+func (w *Worker) fail(err error) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err != nil {
+		return w.err
+	}
+	w.err = err
+	for id, ch := range w.pending {
+		close(ch)
+		delete(w.pending, id)
+	}
+	return err
+}
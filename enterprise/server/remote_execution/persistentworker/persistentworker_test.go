@@ -0,0 +1,240 @@
+package persistentworker_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/persistentworker"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	wkpb "github.com/buildbuddy-io/buildbuddy/proto/worker"
+)
+
+// fakeWorker returns an ExecFunc that handles each request with handle,
+// which returns the response, or nil to exit the worker with code 1. If
+// handle is slow, later requests are handled concurrently.
+func fakeWorker(t *testing.T, protocol string, handle func(req *wkpb.WorkRequest) *wkpb.WorkResponse) persistentworker.ExecFunc {
+	return func(ctx context.Context, stdin io.Reader, stdout io.Writer) *interfaces.CommandResult {
+		// Exit once killed, like a real worker process.
+		go func() {
+			<-ctx.Done()
+			stdin.(io.Closer).Close()
+		}()
+		in := bufio.NewReader(stdin)
+		decoder := json.NewDecoder(in)
+		var mu sync.Mutex
+		var wg sync.WaitGroup
+		defer wg.Wait()
+		for {
+			req := &wkpb.WorkRequest{}
+			if protocol == persistentworker.ProtocolJSON {
+				if err := jsonpb.UnmarshalNext(decoder, req); err != nil {
+					return &interfaces.CommandResult{ExitCode: 0}
+				}
+			} else {
+				size, err := binary.ReadUvarint(in)
+				if err != nil {
+					return &interfaces.CommandResult{ExitCode: 0}
+				}
+				b := make([]byte, size)
+				// The worker doesn't run on the test goroutine, so it
+				// reports failures with assert and exits.
+				if _, err := io.ReadFull(in, b); !assert.NoError(t, err) {
+					return &interfaces.CommandResult{ExitCode: 1}
+				}
+				if err := proto.Unmarshal(b, req); !assert.NoError(t, err) {
+					return &interfaces.CommandResult{ExitCode: 1}
+				}
+			}
+			wg.Add(1)
+			done := make(chan *wkpb.WorkResponse, 1)
+			go func() {
+				defer wg.Done()
+				rsp := handle(req)
+				done <- rsp
+				if rsp == nil {
+					return
+				}
+				rsp.RequestId = req.GetRequestId()
+				mu.Lock()
+				defer mu.Unlock()
+				// Write errors are ignored, since they only happen once the
+				// worker is stopped.
+				if protocol == persistentworker.ProtocolJSON {
+					(&jsonpb.Marshaler{}).Marshal(stdout, rsp)
+					fmt.Fprintln(stdout)
+				} else {
+					buf := proto.NewBuffer(nil)
+					if assert.NoError(t, buf.EncodeMessage(rsp)) {
+						stdout.Write(buf.Bytes())
+					}
+				}
+			}()
+			// Exit without responding if the handler says so, unless a later
+			// request arrives first.
+			select {
+			case rsp := <-done:
+				if rsp == nil {
+					return &interfaces.CommandResult{ExitCode: 1, Stderr: []byte("worker crashed")}
+				}
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+	}
+}
+
+func echoArgs(req *wkpb.WorkRequest) *wkpb.WorkResponse {
+	return &wkpb.WorkResponse{Output: fmt.Sprint(req.GetArguments())}
+}
+
+func TestSend(t *testing.T) {
+	for _, protocol := range []string{"", persistentworker.ProtocolProto, persistentworker.ProtocolJSON} {
+		t.Run("protocol="+protocol, func(t *testing.T) {
+			w, err := persistentworker.Start(protocol, false /*=multiplex*/, fakeWorker(t, protocol, echoArgs))
+			require.NoError(t, err)
+			defer w.Stop()
+
+			for i := 0; i < 3; i++ {
+				arg := fmt.Sprintf("request-%d", i)
+				rsp, err := w.Send(context.Background(), &wkpb.WorkRequest{Arguments: []string{arg}})
+				require.NoError(t, err)
+				assert.Equal(t, fmt.Sprint([]string{arg}), rsp.GetOutput())
+				assert.Equal(t, int32(0), rsp.GetRequestId())
+			}
+		})
+	}
+}
+
+func TestStart_UnknownProtocol(t *testing.T) {
+	_, err := persistentworker.Start("unknown", false /*=multiplex*/, fakeWorker(t, "unknown", echoArgs))
+	assert.True(t, status.IsFailedPreconditionError(err), "expected FailedPrecondition error, got: %s", err)
+}
+
+func TestSend_Multiplex(t *testing.T) {
+	for _, protocol := range []string{persistentworker.ProtocolProto, persistentworker.ProtocolJSON} {
+		t.Run("protocol="+protocol, func(t *testing.T) {
+			// Each request waits for the request after it, so responses are
+			// written in the reverse order of the requests.
+			const numRequests = 5
+			started := make([]chan struct{}, numRequests+1)
+			for i := range started {
+				started[i] = make(chan struct{})
+			}
+			close(started[numRequests])
+			handle := func(req *wkpb.WorkRequest) *wkpb.WorkResponse {
+				i := int(req.GetRequestId()) - 1
+				close(started[i])
+				<-started[i+1]
+				// Give the next request time to be written.
+				time.Sleep(10 * time.Millisecond)
+				return echoArgs(req)
+			}
+			w, err := persistentworker.Start(protocol, true /*=multiplex*/, fakeWorker(t, protocol, handle))
+			require.NoError(t, err)
+			defer w.Stop()
+
+			var wg sync.WaitGroup
+			for i := 0; i < numRequests; i++ {
+				i := i
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					arg := fmt.Sprintf("request-%d", i)
+					rsp, err := w.Send(context.Background(), &wkpb.WorkRequest{Arguments: []string{arg}})
+					if assert.NoError(t, err) {
+						assert.Equal(t, fmt.Sprint([]string{arg}), rsp.GetOutput())
+					}
+				}()
+				// Send the requests in order.
+				<-started[i]
+			}
+			wg.Wait()
+		})
+	}
+}
+
+func TestSend_WorkerCrash(t *testing.T) {
+	handle := func(req *wkpb.WorkRequest) *wkpb.WorkResponse {
+		if req.GetArguments()[0] == "crash" {
+			return nil
+		}
+		return echoArgs(req)
+	}
+	w, err := persistentworker.Start("", false /*=multiplex*/, fakeWorker(t, "", handle))
+	require.NoError(t, err)
+	defer w.Stop()
+
+	_, err = w.Send(context.Background(), &wkpb.WorkRequest{Arguments: []string{"ok"}})
+	require.NoError(t, err)
+
+	_, err = w.Send(context.Background(), &wkpb.WorkRequest{Arguments: []string{"crash"}})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "exited with code 1")
+	assert.Contains(t, err.Error(), "worker crashed")
+	assert.True(t, w.Exited())
+
+	_, err = w.Send(context.Background(), &wkpb.WorkRequest{Arguments: []string{"ok"}})
+	assert.Error(t, err, "worker should not be usable after crashing")
+}
+
+func TestSend_Timeout(t *testing.T) {
+	handle := func(req *wkpb.WorkRequest) *wkpb.WorkResponse {
+		time.Sleep(1 * time.Second)
+		return echoArgs(req)
+	}
+	w, err := persistentworker.Start("", false /*=multiplex*/, fakeWorker(t, "", handle))
+	require.NoError(t, err)
+	defer w.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = w.Send(ctx, &wkpb.WorkRequest{Arguments: []string{"slow"}})
+	assert.True(t, status.IsDeadlineExceededError(err), "expected DeadlineExceeded error, got: %s", err)
+	assert.Error(t, w.Err(), "singleplex worker should be stopped after a request times out")
+}
+
+func TestSend_MultiplexCancel(t *testing.T) {
+	// Requests wait until they are cancelled.
+	cancelled := make(chan int32, 1)
+	release := make(chan struct{})
+	handle := func(req *wkpb.WorkRequest) *wkpb.WorkResponse {
+		if req.GetCancel() {
+			cancelled <- req.GetRequestId()
+			close(release)
+			return &wkpb.WorkResponse{WasCancelled: true}
+		}
+		<-release
+		return echoArgs(req)
+	}
+	w, err := persistentworker.Start("", true /*=multiplex*/, fakeWorker(t, "", handle))
+	require.NoError(t, err)
+	defer w.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = w.Send(ctx, &wkpb.WorkRequest{Arguments: []string{"slow"}})
+	assert.True(t, status.IsDeadlineExceededError(err), "expected DeadlineExceeded error, got: %s", err)
+
+	select {
+	case id := <-cancelled:
+		assert.Equal(t, int32(1), id)
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "worker was not sent a cancel request")
+	}
+	assert.NoError(t, w.Err(), "multiplex worker should still be usable after a request is cancelled")
+	rsp, err := w.Send(context.Background(), &wkpb.WorkRequest{Arguments: []string{"next"}})
+	require.NoError(t, err)
+	assert.Equal(t, fmt.Sprint([]string{"next"}), rsp.GetOutput())
+}
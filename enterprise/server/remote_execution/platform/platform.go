@@ -7,6 +7,7 @@ import (
 	"strconv"
 	"strings"
 
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/util/networking"
 	"github.com/buildbuddy-io/buildbuddy/server/config"
 	"github.com/buildbuddy-io/buildbuddy/server/environment"
 	"github.com/buildbuddy-io/buildbuddy/server/util/log"
@@ -41,19 +42,22 @@ const (
 	// empty or unset.
 	unsetContainerImageVal = "none"
 
-	RecycleRunnerPropertyName            = "recycle-runner"
-	preserveWorkspacePropertyName        = "preserve-workspace"
-	nonrootWorkspacePropertyName         = "nonroot-workspace"
-	cleanWorkspaceInputsPropertyName     = "clean-workspace-inputs"
-	persistentWorkerPropertyName         = "persistent-workers"
-	persistentWorkerKeyPropertyName      = "persistentWorkerKey"
-	persistentWorkerProtocolPropertyName = "persistentWorkerProtocol"
-	WorkflowIDPropertyName               = "workflow-id"
-	workloadIsolationPropertyName        = "workload-isolation-type"
-	initDockerdPropertyName              = "init-dockerd"
-	enableVFSPropertyName                = "enable-vfs"
-	HostedBazelAffinityKeyPropertyName   = "hosted-bazel-affinity-key"
-	useSelfHostedExecutorsPropertyName   = "use-self-hosted-executors"
+	RecycleRunnerPropertyName                    = "recycle-runner"
+	preserveWorkspacePropertyName                = "preserve-workspace"
+	nonrootWorkspacePropertyName                 = "nonroot-workspace"
+	cleanWorkspaceInputsPropertyName             = "clean-workspace-inputs"
+	persistentWorkerPropertyName                 = "persistent-workers"
+	persistentWorkerKeyPropertyName              = "persistentWorkerKey"
+	persistentWorkerProtocolPropertyName         = "persistentWorkerProtocol"
+	persistentWorkerMultiplexPropertyName        = "persistentWorkerMultiplex"
+	persistentWorkerMultiplexSandboxPropertyName = "persistentWorkerMultiplexSandbox"
+	WorkflowIDPropertyName                       = "workflow-id"
+	workloadIsolationPropertyName                = "workload-isolation-type"
+	initDockerdPropertyName                      = "init-dockerd"
+	enableVFSPropertyName                        = "enable-vfs"
+	HostedBazelAffinityKeyPropertyName           = "hosted-bazel-affinity-key"
+	useSelfHostedExecutorsPropertyName           = "use-self-hosted-executors"
+	SpeculativeRetryPropertyName                 = "speculative-retry"
 
 	OperatingSystemPropertyName = "OSFamily"
 	LinuxOperatingSystemName    = "linux"
@@ -61,13 +65,21 @@ const (
 	DarwinOperatingSystemName   = "darwin"
 
 	CPUArchitecturePropertyName = "Arch"
-	defaultCPUArchitecture      = "amd64"
+	DefaultCPUArchitecture      = "amd64"
 
 	// Using the property defined here: https://github.com/bazelbuild/bazel-toolchains/blob/v5.1.0/rules/exec_properties/exec_properties.bzl#L164
 	dockerRunAsRootPropertyName = "dockerRunAsRoot"
 	// Using the property defined here: https://github.com/bazelbuild/bazel-toolchains/blob/v5.1.0/rules/exec_properties/exec_properties.bzl#L156
 	dockerNetworkPropertyName = "dockerNetwork"
 
+	// NetworkPropertyName specifies the network access of the action. See
+	// networking.ParsePolicy for the values it accepts.
+	NetworkPropertyName = "network"
+	// defaultNetwork is the network access of actions when neither the action
+	// nor the executor specify one. Actions are network-hermetic unless they
+	// opt in.
+	defaultNetwork = networking.Loopback
+
 	// A BuildBuddy Compute Unit is defined as 1 cpu and 2.5GB of memory.
 	EstimatedComputeUnitsPropertyName = "EstimatedComputeUnits"
 
@@ -82,6 +94,8 @@ const (
 	PodmanContainerType      ContainerType = "podman"
 	DockerContainerType      ContainerType = "docker"
 	FirecrackerContainerType ContainerType = "firecracker"
+	SandboxContainerType     ContainerType = "sandbox"
+	ContainerdContainerType  ContainerType = "containerd"
 )
 
 // Properties represents the platform properties parsed from a command.
@@ -97,8 +111,14 @@ type Properties struct {
 	WorkloadIsolationType     string
 	DockerForceRoot           bool
 	DockerNetwork             string
-	RecycleRunner             bool
-	EnableVFS                 bool
+	// Network is the value of the network platform property. It takes
+	// precedence over DockerNetwork, which is only kept for compatibility.
+	Network string
+	// NetworkPolicy is the network access of the action, which is resolved by
+	// ApplyOverrides from Network, DockerNetwork and the executor's default.
+	NetworkPolicy *networking.Policy
+	RecycleRunner bool
+	EnableVFS     bool
 	// InitDockerd specifies whether to initialize dockerd within the execution
 	// environment if it is available in the execution image, allowing Docker
 	// containers to be spawned by actions. Only available with
@@ -121,9 +141,25 @@ type Properties struct {
 	PersistentWorker         bool
 	PersistentWorkerKey      string
 	PersistentWorkerProtocol string
-	WorkflowID               string
-	HostedBazelAffinityKey   string
-	UseSelfHostedExecutors   bool
+	// PersistentWorkerMultiplex specifies whether the persistent worker
+	// supports multiplexing, in which case one worker process may be sent
+	// the work requests of several runners at once, if it also supports
+	// sandboxing (see PersistentWorkerMultiplexSandbox). Only available with
+	// `workload-isolation-type=bare`.
+	PersistentWorkerMultiplex bool
+	// PersistentWorkerMultiplexSandbox specifies whether a multiplex worker
+	// supports sandboxing (Bazel's 'supports-multiplex-sandbox' execution
+	// requirement), in which case each request's sandbox_dir is set to the
+	// runner's workspace. Multiplex workers which don't are not shared.
+	PersistentWorkerMultiplexSandbox bool
+	WorkflowID                       string
+	HostedBazelAffinityKey           string
+	UseSelfHostedExecutors           bool
+	// SpeculativeRetry specifies whether the action is safe to run more than
+	// once concurrently. If true, a copy of the action may be started on
+	// another executor when it runs much longer than usual, and the result of
+	// whichever copy finishes first is used.
+	SpeculativeRetry bool
 }
 
 // ContainerType indicates the type of containerization required by an executor.
@@ -155,29 +191,33 @@ func ParseProperties(task *repb.ExecutionTask) *Properties {
 	}
 
 	return &Properties{
-		OS:                        strings.ToLower(stringProp(m, OperatingSystemPropertyName, defaultOperatingSystemName)),
-		Arch:                      strings.ToLower(stringProp(m, CPUArchitecturePropertyName, defaultCPUArchitecture)),
-		Pool:                      strings.ToLower(pool),
-		EstimatedComputeUnits:     int64Prop(m, EstimatedComputeUnitsPropertyName, 0),
-		EstimatedFreeDiskBytes:    int64Prop(m, EstimatedFreeDiskPropertyName, 0),
-		ContainerImage:            stringProp(m, containerImagePropertyName, ""),
-		ContainerRegistryUsername: stringProp(m, containerRegistryUsernamePropertyName, ""),
-		ContainerRegistryPassword: stringProp(m, containerRegistryPasswordPropertyName, ""),
-		WorkloadIsolationType:     stringProp(m, workloadIsolationPropertyName, ""),
-		InitDockerd:               boolProp(m, initDockerdPropertyName, false),
-		DockerForceRoot:           boolProp(m, dockerRunAsRootPropertyName, false),
-		DockerNetwork:             stringProp(m, dockerNetworkPropertyName, ""),
-		RecycleRunner:             boolProp(m, RecycleRunnerPropertyName, false),
-		EnableVFS:                 boolProp(m, enableVFSPropertyName, false),
-		PreserveWorkspace:         boolProp(m, preserveWorkspacePropertyName, false),
-		NonrootWorkspace:          boolProp(m, nonrootWorkspacePropertyName, false),
-		CleanWorkspaceInputs:      stringProp(m, cleanWorkspaceInputsPropertyName, ""),
-		PersistentWorker:          boolProp(m, persistentWorkerPropertyName, false),
-		PersistentWorkerKey:       stringProp(m, persistentWorkerKeyPropertyName, ""),
-		PersistentWorkerProtocol:  stringProp(m, persistentWorkerProtocolPropertyName, ""),
-		WorkflowID:                stringProp(m, WorkflowIDPropertyName, ""),
-		HostedBazelAffinityKey:    stringProp(m, HostedBazelAffinityKeyPropertyName, ""),
-		UseSelfHostedExecutors:    boolProp(m, useSelfHostedExecutorsPropertyName, false),
+		OS:                               strings.ToLower(stringProp(m, OperatingSystemPropertyName, defaultOperatingSystemName)),
+		Arch:                             strings.ToLower(stringProp(m, CPUArchitecturePropertyName, DefaultCPUArchitecture)),
+		Pool:                             strings.ToLower(pool),
+		EstimatedComputeUnits:            int64Prop(m, EstimatedComputeUnitsPropertyName, 0),
+		EstimatedFreeDiskBytes:           int64Prop(m, EstimatedFreeDiskPropertyName, 0),
+		ContainerImage:                   stringProp(m, containerImagePropertyName, ""),
+		ContainerRegistryUsername:        stringProp(m, containerRegistryUsernamePropertyName, ""),
+		ContainerRegistryPassword:        stringProp(m, containerRegistryPasswordPropertyName, ""),
+		WorkloadIsolationType:            stringProp(m, workloadIsolationPropertyName, ""),
+		InitDockerd:                      boolProp(m, initDockerdPropertyName, false),
+		DockerForceRoot:                  boolProp(m, dockerRunAsRootPropertyName, false),
+		DockerNetwork:                    stringProp(m, dockerNetworkPropertyName, ""),
+		Network:                          stringProp(m, NetworkPropertyName, ""),
+		RecycleRunner:                    boolProp(m, RecycleRunnerPropertyName, false),
+		EnableVFS:                        boolProp(m, enableVFSPropertyName, false),
+		PreserveWorkspace:                boolProp(m, preserveWorkspacePropertyName, false),
+		NonrootWorkspace:                 boolProp(m, nonrootWorkspacePropertyName, false),
+		CleanWorkspaceInputs:             stringProp(m, cleanWorkspaceInputsPropertyName, ""),
+		PersistentWorker:                 boolProp(m, persistentWorkerPropertyName, false),
+		PersistentWorkerKey:              stringProp(m, persistentWorkerKeyPropertyName, ""),
+		PersistentWorkerProtocol:         stringProp(m, persistentWorkerProtocolPropertyName, ""),
+		PersistentWorkerMultiplex:        boolProp(m, persistentWorkerMultiplexPropertyName, false),
+		PersistentWorkerMultiplexSandbox: boolProp(m, persistentWorkerMultiplexSandboxPropertyName, false),
+		WorkflowID:                       stringProp(m, WorkflowIDPropertyName, ""),
+		HostedBazelAffinityKey:           stringProp(m, HostedBazelAffinityKeyPropertyName, ""),
+		UseSelfHostedExecutors:           boolProp(m, useSelfHostedExecutorsPropertyName, false),
+		SpeculativeRetry:                 boolProp(m, SpeculativeRetryPropertyName, false),
 	}
 }
 
@@ -240,6 +280,22 @@ func GetExecutorProperties(executorConfig *config.ExecutorConfig) *ExecutorPrope
 		}
 	}
 
+	if executorConfig.ContainerdSocket != "" {
+		if runtime.GOOS != "linux" {
+			log.Warningf("Containerd was enabled, but is unsupported on %s. Ignoring.", runtime.GOOS)
+		} else {
+			p.SupportedIsolationTypes = append(p.SupportedIsolationTypes, ContainerdContainerType)
+		}
+	}
+
+	if executorConfig.EnableSandbox {
+		if runtime.GOOS != "linux" {
+			log.Warningf("Sandbox was enabled, but is unsupported on %s. Ignoring.", runtime.GOOS)
+		} else {
+			p.SupportedIsolationTypes = append(p.SupportedIsolationTypes, SandboxContainerType)
+		}
+	}
+
 	// Special case: for backwards compatibility, support bare-runners when docker
 	// is not enabled. Typically, this happens for macs.
 	if executorConfig.EnableBareRunner || len(p.SupportedIsolationTypes) == 0 {
@@ -283,14 +339,20 @@ func ApplyOverrides(env environment.Env, executorProps *ExecutorProperties, plat
 		return status.InvalidArgumentErrorf("The requested workload isolation type %q is unsupported by this executor. Supported types: %s)", platformProps.WorkloadIsolationType, executorProps.SupportedIsolationTypes)
 	}
 
+	policy, err := resolveNetworkPolicy(env, platformProps)
+	if err != nil {
+		return err
+	}
+	platformProps.NetworkPolicy = policy
+
 	defaultContainerImage := DefaultContainerImage
 	if env.GetConfigurator().GetExecutorConfig() != nil && env.GetConfigurator().GetExecutorConfig().DefaultImage != "" {
 		defaultContainerImage = env.GetConfigurator().GetExecutorConfig().DefaultImage
 	}
 
 	// Normalize the container image string
-	if platformProps.WorkloadIsolationType == string(BareContainerType) {
-		// BareRunner strings become ""
+	if platformProps.WorkloadIsolationType == string(BareContainerType) || platformProps.WorkloadIsolationType == string(SandboxContainerType) {
+		// BareRunner and sandbox strings become ""
 		if strings.EqualFold(platformProps.ContainerImage, "none") || platformProps.ContainerImage == "" {
 			platformProps.ContainerImage = ""
 		} else {
@@ -343,6 +405,50 @@ func ApplyOverrides(env environment.Env, executorProps *ExecutorProperties, plat
 	return nil
 }
 
+// resolveNetworkPolicy returns the network access of the action, and checks
+// that its isolation type can enforce it.
+func resolveNetworkPolicy(env environment.Env, props *Properties) (*networking.Policy, error) {
+	isolationType := ContainerType(props.WorkloadIsolationType)
+	// Bare runners can't restrict network access, so they are only rejected
+	// when an action explicitly asks for less than full access.
+	if isolationType == BareContainerType && props.Network == "" {
+		return &networking.Policy{Mode: networking.Full}, nil
+	}
+	value := props.Network
+	// Sandboxes never have a network other than loopback, so the Docker
+	// network, which toolchains often set for every action, is ignored.
+	if value == "" && props.DockerNetwork != "" && isolationType != SandboxContainerType {
+		// dockerNetwork=off turns networking off, and any other value, such
+		// as "standard", selects the default Docker network.
+		if strings.EqualFold(props.DockerNetwork, "off") {
+			value = string(networking.Off)
+		} else {
+			value = string(networking.Full)
+		}
+	}
+	if value == "" {
+		value = string(defaultNetwork)
+		if env.GetConfigurator().GetExecutorConfig() != nil && env.GetConfigurator().GetExecutorConfig().DefaultNetwork != "" {
+			value = env.GetConfigurator().GetExecutorConfig().DefaultNetwork
+		}
+	}
+	policy, err := networking.ParsePolicy(value)
+	if err != nil {
+		return nil, err
+	}
+	switch isolationType {
+	case BareContainerType:
+		if policy.Mode != networking.Full {
+			return nil, status.InvalidArgumentErrorf("Network %q is not supported by workload isolation type %q, which always has full network access.", policy.Mode, isolationType)
+		}
+	case SandboxContainerType:
+		if policy.NeedsInterface() {
+			return nil, status.InvalidArgumentErrorf("Network %q is not supported by workload isolation type %q, which only supports %q and %q.", policy.Mode, isolationType, networking.Off, networking.Loopback)
+		}
+	}
+	return policy, nil
+}
+
 func stringProp(props map[string]string, name string, defaultValue string) string {
 	val := props[strings.ToLower(name)]
 	if val == "" {
@@ -14,8 +14,9 @@ import (
 )
 
 var (
-	bare   = &platform.ExecutorProperties{SupportedIsolationTypes: []platform.ContainerType{platform.BareContainerType}}
-	docker = &platform.ExecutorProperties{SupportedIsolationTypes: []platform.ContainerType{platform.DockerContainerType}}
+	bare    = &platform.ExecutorProperties{SupportedIsolationTypes: []platform.ContainerType{platform.BareContainerType}}
+	docker  = &platform.ExecutorProperties{SupportedIsolationTypes: []platform.ContainerType{platform.DockerContainerType}}
+	sandbox = &platform.ExecutorProperties{SupportedIsolationTypes: []platform.ContainerType{platform.SandboxContainerType}}
 )
 
 func TestParse_ContainerImage_Success(t *testing.T) {
@@ -31,6 +32,8 @@ func TestParse_ContainerImage_Success(t *testing.T) {
 		{bare, "none", "Container-Image", ""},
 		{bare, "None", "container-image", ""},
 		{bare, "None", "Container-Image", ""},
+		{sandbox, "", "container-image", ""},
+		{sandbox, "none", "container-image", ""},
 		{docker, "", "container-image", platform.DefaultContainerImage},
 		{docker, "", "Container-Image", platform.DefaultContainerImage},
 		{docker, "none", "container-image", platform.DefaultContainerImage},
@@ -62,6 +65,7 @@ func TestParse_ContainerImage_Error(t *testing.T) {
 		{bare, "docker://alpine"},
 		{bare, "invalid"},
 		{bare, "invalid://alpine"},
+		{sandbox, "docker://alpine"},
 		{docker, "invalid"},
 		{docker, "invalid://alpine"},
 	} {
@@ -77,6 +81,56 @@ func TestParse_ContainerImage_Error(t *testing.T) {
 	}
 }
 
+func TestParse_Network(t *testing.T) {
+	for _, testCase := range []struct {
+		execProps     *platform.ExecutorProperties
+		props         map[string]string
+		expected      string
+		errorExpected bool
+	}{
+		// Actions are network-hermetic by default.
+		{docker, map[string]string{}, "loopback", false},
+		{sandbox, map[string]string{}, "loopback", false},
+		// Bare runners can't restrict network access.
+		{bare, map[string]string{}, "full", false},
+		{bare, map[string]string{"network": "full"}, "full", false},
+		{bare, map[string]string{"network": "loopback"}, "", true},
+		{bare, map[string]string{"dockerNetwork": "off"}, "full", false},
+		{docker, map[string]string{"network": "off"}, "off", false},
+		{docker, map[string]string{"Network": "FULL"}, "full", false},
+		{docker, map[string]string{"network": "egress:GitHub.com, 10.0.0.0/8"}, "egress:10.0.0.0/8,github.com", false},
+		{docker, map[string]string{"network": "egress"}, "", true},
+		{docker, map[string]string{"network": "egress:not_a_host"}, "", true},
+		{docker, map[string]string{"network": "full:github.com"}, "", true},
+		{docker, map[string]string{"network": "standard"}, "", true},
+		// Sandboxes only have a loopback interface.
+		{sandbox, map[string]string{"network": "off"}, "off", false},
+		{sandbox, map[string]string{"network": "egress:github.com"}, "", true},
+		{sandbox, map[string]string{"network": "full"}, "", true},
+		{sandbox, map[string]string{"dockerNetwork": "standard"}, "loopback", false},
+		// dockerNetwork is still supported, but network takes precedence.
+		{docker, map[string]string{"dockerNetwork": "off"}, "off", false},
+		{docker, map[string]string{"dockerNetwork": "standard"}, "full", false},
+		{docker, map[string]string{"dockerNetwork": "standard", "network": "loopback"}, "loopback", false},
+	} {
+		plat := &repb.Platform{}
+		for name, value := range testCase.props {
+			plat.Properties = append(plat.Properties, &repb.Platform_Property{Name: name, Value: value})
+		}
+
+		platformProps := platform.ParseProperties(&repb.ExecutionTask{Command: &repb.Command{Platform: plat}})
+		env := testenv.GetTestEnv(t)
+		env.RealEnv.SetXcodeLocator(&xcodeLocator{})
+		err := platform.ApplyOverrides(env, testCase.execProps, platformProps, &repb.Command{})
+		if testCase.errorExpected {
+			assert.Error(t, err, testCase)
+			continue
+		}
+		require.NoError(t, err, testCase)
+		assert.Equal(t, testCase.expected, platformProps.NetworkPolicy.String(), testCase)
+	}
+}
+
 func TestParse_OS(t *testing.T) {
 	for _, testCase := range []struct {
 		rawValue      string
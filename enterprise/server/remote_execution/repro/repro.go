@@ -0,0 +1,109 @@
+// Package repro generates the files needed to rerun a remote action locally.
+//
+// A repro directory holds the action's input root in InputRootDir, a run.sh
+// script returned by Script, and optionally a Dockerfile returned by
+// Dockerfile.
+package repro
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/platform"
+
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+)
+
+const (
+	// InputRootDir is the directory, relative to the script, holding the
+	// action's input root.
+	InputRootDir = "input"
+
+	// ScriptName is the name of the script that runs the action.
+	ScriptName = "run.sh"
+
+	// DockerfileName is the name of the Dockerfile that runs the script in
+	// the action's container image.
+	DockerfileName = "Dockerfile"
+)
+
+// shellQuote quotes s for use as a single word in a POSIX shell script.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// Script returns a shell script that runs cmd in the input root with the
+// same arguments, environment and working directory that it had on the
+// executor. The title is written in a comment at the top of the script.
+func Script(title string, cmd *repb.Command) string {
+	var b strings.Builder
+	b.WriteString("#!/bin/sh\n")
+	fmt.Fprintf(&b, "# %s\n", title)
+	props := cmd.GetPlatform().GetProperties()
+	if len(props) > 0 {
+		b.WriteString("#\n# It originally ran with these platform properties:\n")
+		for _, p := range props {
+			value := p.GetValue()
+			if strings.Contains(strings.ToLower(p.GetName()), "password") {
+				value = "<redacted>"
+			}
+			fmt.Fprintf(&b, "#   %s=%s\n", p.GetName(), value)
+		}
+	}
+	b.WriteString("set -e\n")
+	workDir := path.Join(InputRootDir, cmd.GetWorkingDirectory())
+	fmt.Fprintf(&b, "cd \"$(dirname \"$0\")\"/%s\n", shellQuote(workDir))
+
+	// Like the executor, create the parent directories of the outputs.
+	outputs := append(append([]string{}, cmd.GetOutputFiles()...), cmd.GetOutputDirectories()...)
+	parents := make(map[string]struct{})
+	for _, o := range outputs {
+		if dir := path.Dir(o); dir != "." {
+			parents[dir] = struct{}{}
+		}
+	}
+	sortedParents := make([]string, 0, len(parents))
+	for dir := range parents {
+		sortedParents = append(sortedParents, dir)
+	}
+	sort.Strings(sortedParents)
+	for _, dir := range sortedParents {
+		fmt.Fprintf(&b, "mkdir -p %s\n", shellQuote(dir))
+	}
+
+	b.WriteString("exec env -i")
+	for _, v := range cmd.GetEnvironmentVariables() {
+		fmt.Fprintf(&b, " \\\n  %s", shellQuote(v.GetName()+"="+v.GetValue()))
+	}
+	for _, arg := range cmd.GetArguments() {
+		fmt.Fprintf(&b, " \\\n  %s", shellQuote(arg))
+	}
+	b.WriteString("\n")
+	return b.String()
+}
+
+// Dockerfile returns a Dockerfile that runs the script returned by Script in
+// the container image that cmd requested. It returns "" if cmd does not run
+// in a container, which is the case for macOS actions.
+func Dockerfile(cmd *repb.Command) string {
+	props := platform.ParseProperties(&repb.ExecutionTask{Command: cmd})
+	if strings.EqualFold(props.OS, platform.DarwinOperatingSystemName) {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteString("# Runs the action in the container image it requested:\n")
+	fmt.Fprintf(&b, "#   docker build -t repro . && docker run --rm repro\n")
+	image := props.ContainerImage
+	if image == "" || strings.EqualFold(image, "none") {
+		b.WriteString("#\n# The action did not request a container image, so this is the default\n")
+		b.WriteString("# image. Executors may be configured with a different default.\n")
+		image = platform.DefaultContainerImage
+	}
+	fmt.Fprintf(&b, "FROM %s\n", strings.TrimPrefix(image, platform.DockerPrefix))
+	b.WriteString("COPY . /repro\n")
+	b.WriteString("WORKDIR /repro\n")
+	fmt.Fprintf(&b, "CMD [\"/bin/sh\", %q]\n", ScriptName)
+	return b.String()
+}
@@ -0,0 +1,96 @@
+package repro
+
+import (
+	"testing"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/platform"
+	"github.com/stretchr/testify/assert"
+
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+)
+
+func TestShellQuote(t *testing.T) {
+	assert.Equal(t, "''", shellQuote(""))
+	assert.Equal(t, "'foo bar'", shellQuote("foo bar"))
+	assert.Equal(t, `'it'\''s'`, shellQuote("it's"))
+	assert.Equal(t, "'$HOME'", shellQuote("$HOME"))
+}
+
+func TestScript(t *testing.T) {
+	cmd := &repb.Command{
+		Arguments: []string{"/bin/sh", "-c", "echo 'hello' > out/greeting.txt"},
+		EnvironmentVariables: []*repb.Command_EnvironmentVariable{
+			{Name: "PATH", Value: "/bin:/usr/bin"},
+			{Name: "GREETING", Value: "hello world"},
+		},
+		Platform: &repb.Platform{
+			Properties: []*repb.Platform_Property{
+				{Name: "container-image", Value: "docker://alpine:3"},
+				{Name: "container-registry-password", Value: "hunter2"},
+			},
+		},
+		WorkingDirectory: "pkg",
+		OutputFiles:      []string{"out/greeting.txt", "out/nested/other.txt", "top.txt"},
+	}
+
+	script := Script("Reproduces the failed execution instance/uploads/uuid/blobs/abc/123", cmd)
+
+	assert.Equal(t, `#!/bin/sh
+# Reproduces the failed execution instance/uploads/uuid/blobs/abc/123
+#
+# It originally ran with these platform properties:
+#   container-image=docker://alpine:3
+#   container-registry-password=<redacted>
+set -e
+cd "$(dirname "$0")"/'input/pkg'
+mkdir -p 'out'
+mkdir -p 'out/nested'
+exec env -i \
+  'PATH=/bin:/usr/bin' \
+  'GREETING=hello world' \
+  '/bin/sh' \
+  '-c' \
+  'echo '\''hello'\'' > out/greeting.txt'
+`, script)
+}
+
+func TestDockerfile(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		props    []*repb.Platform_Property
+		wantFrom string
+	}{
+		{
+			name:     "ContainerImage",
+			props:    []*repb.Platform_Property{{Name: "container-image", Value: "docker://alpine:3"}},
+			wantFrom: "FROM alpine:3\n",
+		},
+		{
+			name:     "NoContainerImage",
+			props:    nil,
+			wantFrom: "FROM " + platform.DefaultContainerImage + "\n",
+		},
+		{
+			name:     "NoneContainerImage",
+			props:    []*repb.Platform_Property{{Name: "container-image", Value: "none"}},
+			wantFrom: "FROM " + platform.DefaultContainerImage + "\n",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			dockerfile := Dockerfile(&repb.Command{Platform: &repb.Platform{Properties: test.props}})
+
+			assert.Contains(t, dockerfile, test.wantFrom)
+			assert.Contains(t, dockerfile, "CMD [\"/bin/sh\", \"run.sh\"]\n")
+		})
+	}
+}
+
+func TestDockerfile_Darwin(t *testing.T) {
+	cmd := &repb.Command{
+		Platform: &repb.Platform{
+			Properties: []*repb.Platform_Property{{Name: "OSFamily", Value: "Darwin"}},
+		},
+	}
+
+	assert.Equal(t, "", Dockerfile(cmd))
+}
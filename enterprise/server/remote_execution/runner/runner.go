@@ -3,8 +3,6 @@ package runner
 import (
 	"bufio"
 	"context"
-	"encoding/binary"
-	"encoding/json"
 	"fmt"
 	"io"
 	"math"
@@ -21,14 +19,21 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/commandutil"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/container"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/containers/bare"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/containers/containerd"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/containers/docker"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/containers/firecracker"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/containers/podman"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/containers/sandbox"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/dirtools"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/executionlog"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/imagestore"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/persistentworker"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/platform"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/vfs"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/workspace"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/tasksize"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/util/cgroup"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/util/networking"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/util/vfs_server"
 	"github.com/buildbuddy-io/buildbuddy/server/config"
 	"github.com/buildbuddy-io/buildbuddy/server/environment"
@@ -40,18 +45,21 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/server/util/log"
 	"github.com/buildbuddy-io/buildbuddy/server/util/perms"
 	"github.com/buildbuddy-io/buildbuddy/server/util/status"
-	"github.com/golang/protobuf/jsonpb"
 	"github.com/golang/protobuf/proto"
+	"github.com/google/uuid"
 	"github.com/prometheus/client_golang/prometheus"
 	"golang.org/x/sync/errgroup"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
 
 	aclpb "github.com/buildbuddy-io/buildbuddy/proto/acl"
 	espb "github.com/buildbuddy-io/buildbuddy/proto/execution_stats"
 	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+	scpb "github.com/buildbuddy-io/buildbuddy/proto/scheduler"
 	uidpb "github.com/buildbuddy-io/buildbuddy/proto/user_id"
 	vfspb "github.com/buildbuddy-io/buildbuddy/proto/vfs"
 	wkpb "github.com/buildbuddy-io/buildbuddy/proto/worker"
+	containerdclient "github.com/containerd/containerd"
 	dockerclient "github.com/docker/docker/client"
 )
 
@@ -85,15 +93,26 @@ const (
 	// default memory estimate for execution tasks.
 	runnerMemUsageEstimateMultiplierBytes = 6.5
 
+	// The default multiple of a task's estimated resource usage at which it is
+	// limited, when runners are placed in cgroups.
+	defaultCgroupLimitRatio = 4
+	// The number of processes that a task may run per CPU that it is allowed
+	// to use, when runners are placed in cgroups.
+	cgroupPIDsPerCPU = 2048
+
+	// The default number of paused firecracker VMs kept for each image in
+	// executor.firecracker_warm_pool.
+	defaultWarmPoolSize = 1
+
 	// Label assigned to runner pool request count metric for fulfilled requests.
 	hitStatusLabel = "hit"
 	// Label assigned to runner pool request count metric for unfulfilled requests.
 	missStatusLabel = "miss"
 
-	// Value for persisent workers that support the JSON persistent worker protocol.
-	workerProtocolJSONValue = "json"
-	// Value for persisent workers that support the protobuf persistent worker protocol.
-	workerProtocolProtobufValue = "proto"
+	// The number of times a persistent work request is attempted. If the
+	// worker crashes while handling a request, the worker is restarted and
+	// the request is retried.
+	maxPersistentWorkRequestAttempts = 2
 )
 
 var (
@@ -159,23 +178,45 @@ type commandRunner struct {
 	VFS *vfs.VFS
 	// VFSServer holds the RPC server that serves FUSE filesystem requests.
 	VFSServer *vfs_server.Server
+	// cgroup holds the processes started by the runner, if runners are
+	// placed in cgroups.
+	cgroup *cgroup.Cgroup
+	// cgroupLimitRatio is the multiple of each task's estimated resource
+	// usage at which it is limited.
+	cgroupLimitRatio float64
+	// taskCount is the number of tasks that the runner has run.
+	taskCount int
+	// maxStdoutBytes and maxStderrBytes are the maximum sizes of the stdout
+	// and stderr of each task, if positive.
+	maxStdoutBytes int64
+	maxStderrBytes int64
+	// enableLiveLogs is whether the output of each task is published while
+	// the task is running.
+	enableLiveLogs bool
+	// stdout and stderr hold the output of the current task. They are
+	// closed by Remove, which may be called while the task is running.
+	outputMu sync.Mutex // protects(stdout), protects(stderr)
+	stdout   *commandutil.OutputFile
+	stderr   *commandutil.OutputFile
 
 	// task is the current task assigned to the runner.
 	task *repb.ExecutionTask
+	// taskSize is the size that the scheduler assigned to the current task.
+	taskSize *scpb.TaskSize
 	// State is the current state of the runner as it pertains to reuse.
 	state state
 
-	// Stdin handle to send persistent WorkRequests to.
-	stdinWriter io.Writer
-	// Stdout handle to read persistent WorkResponses from.
-	// N.B. This is a bufio.Reader to support ByteReader required by ReadUvarint.
-	stdoutReader *bufio.Reader
+	// worker is the persistent worker started by the runner, if any.
+	worker *persistentworker.Worker
+	// multiplexWorkers holds the multiplex persistent workers shared by the
+	// runners in the pool.
+	multiplexWorkers *multiplexWorkers
+	// multiplexWorkerKey is the key of the multiplex persistent worker used
+	// by the runner, if any.
+	multiplexWorkerKey string
 	// Keeps track of whether or not we encountered any errors that make the runner non-reusable.
 	doNotReuse bool
 
-	// Decoder used when reading streamed JSON values from stdout.
-	jsonDecoder *json.Decoder
-
 	// Cached resource usage values from the last time the runner was added to
 	// the pool.
 
@@ -278,6 +319,181 @@ func (r *commandRunner) DownloadInputs(ctx context.Context, ioStats *espb.IOStat
 
 // Run runs the task that is currently bound to the command runner.
 func (r *commandRunner) Run(ctx context.Context) *interfaces.CommandResult {
+	r.taskCount++
+	// The live log is published with the caller's context, so that it is
+	// still published when the task is canceled below.
+	var liveLog *executionlog.Publisher
+	if r.enableLiveLogs {
+		// The app only accepts live logs from authorized executors.
+		logCtx := ctx
+		if apiKey := r.env.GetConfigurator().GetExecutorConfig().APIKey; apiKey != "" {
+			logCtx = metadata.AppendToOutgoingContext(ctx, auth.APIKeyHeader, apiKey)
+		}
+		p, err := executionlog.StartPublisher(logCtx, r.env.GetRemoteExecutionClient(), r.task.GetExecutionId(), r.task.GetTaskId())
+		if err != nil {
+			log.Warningf("Failed to publish live output of %q: %s", r.task.GetExecutionId(), err)
+		} else {
+			liveLog = p
+		}
+	}
+	// The task is canceled as soon as its output exceeds a limit.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	// The pool may remove the runner, closing its output files, while the
+	// task is running, so hold on to the files for this task.
+	stdout, stderr, err := r.openOutputFiles(cancel)
+	if err != nil {
+		r.closeLiveLog(liveLog)
+		return commandutil.ErrorResult(err)
+	}
+	stdio := &interfaces.Stdio{Stdout: stdout, Stderr: stderr}
+	if liveLog != nil {
+		stdio.Stdout = io.MultiWriter(stdout, liveLog)
+		stdio.Stderr = io.MultiWriter(stderr, liveLog)
+	}
+	result := r.runInCgroup(ctx, stdio)
+	r.closeLiveLog(liveLog)
+	for _, f := range []*commandutil.OutputFile{stdout, stderr} {
+		if err := f.Err(); err != nil {
+			result.Error = err
+			break
+		}
+	}
+	return result
+}
+
+// closeLiveLog finishes publishing the output of the current task. Failing to
+// publish it doesn't fail the task, since the output is also uploaded.
+func (r *commandRunner) closeLiveLog(liveLog *executionlog.Publisher) {
+	if liveLog == nil {
+		return
+	}
+	if err := liveLog.Close(); err != nil {
+		log.Warningf("Failed to publish live output of %q: %s", r.task.GetExecutionId(), err)
+	}
+}
+
+// openOutputFiles creates the files that hold the stdout and stderr of the
+// current task, replacing those of the previous task. onExceeded is called
+// when the output exceeds a limit.
+func (r *commandRunner) openOutputFiles(onExceeded func()) (*commandutil.OutputFile, *commandutil.OutputFile, error) {
+	r.closeOutputFiles()
+	// The files are kept next to the workspace, so that they aren't visible
+	// to the task.
+	dir := filepath.Dir(r.Workspace.Path())
+	stdout, err := commandutil.NewOutputFile(dir, "stdout", r.maxStdoutBytes, onExceeded)
+	if err != nil {
+		return nil, nil, err
+	}
+	stderr, err := commandutil.NewOutputFile(dir, "stderr", r.maxStderrBytes, onExceeded)
+	if err != nil {
+		closeOutputFile(stdout)
+		return nil, nil, err
+	}
+	r.outputMu.Lock()
+	r.stdout, r.stderr = stdout, stderr
+	r.outputMu.Unlock()
+	return stdout, stderr, nil
+}
+
+// outputFiles returns the output files of the current task, which are nil if
+// the task failed to start or the runner was removed.
+func (r *commandRunner) outputFiles() (*commandutil.OutputFile, *commandutil.OutputFile) {
+	r.outputMu.Lock()
+	defer r.outputMu.Unlock()
+	return r.stdout, r.stderr
+}
+
+func (r *commandRunner) closeOutputFiles() {
+	r.outputMu.Lock()
+	stdout, stderr := r.stdout, r.stderr
+	r.stdout, r.stderr = nil, nil
+	r.outputMu.Unlock()
+	for _, f := range []*commandutil.OutputFile{stdout, stderr} {
+		if f != nil {
+			closeOutputFile(f)
+		}
+	}
+}
+
+func closeOutputFile(f *commandutil.OutputFile) {
+	if err := f.Close(); err != nil {
+		log.Warningf("Failed to remove task output file: %s", err)
+	}
+}
+
+// runInCgroup runs the current task, limiting it and measuring its resource
+// usage with the runner's cgroup, if it has one.
+func (r *commandRunner) runInCgroup(ctx context.Context, stdio *interfaces.Stdio) *interfaces.CommandResult {
+	if r.cgroup == nil {
+		return r.run(ctx, stdio)
+	}
+	limits := r.cgroupLimits()
+	if err := r.cgroup.SetLimits(limits); err != nil {
+		return commandutil.ErrorResult(status.UnavailableErrorf("failed to set cgroup limits: %s", err))
+	}
+	base, err := r.cgroup.Usage()
+	if err != nil {
+		return commandutil.ErrorResult(status.UnavailableErrorf("failed to read cgroup usage: %s", err))
+	}
+	peakMemory, err := r.cgroup.WatchPeakMemory()
+	if err != nil {
+		log.Warningf("Failed to watch cgroup peak memory usage: %s", err)
+	}
+	if peakMemory != nil {
+		defer peakMemory.Close()
+	}
+	result := r.run(ctx, stdio)
+	usage, err := r.cgroup.Usage()
+	if err != nil {
+		log.Warningf("Failed to read cgroup usage: %s", err)
+		return result
+	}
+	usage = usage.Sub(base)
+	peakMeasured := false
+	if peakMemory != nil {
+		if peak, err := peakMemory.PeakMemoryBytes(); err != nil {
+			log.Warningf("Failed to read cgroup peak memory usage: %s", err)
+		} else {
+			usage.PeakMemoryBytes = peak
+			peakMeasured = true
+		}
+	}
+	r.recordCgroupUsage(result, usage, peakMeasured)
+	if usage.OOMKills > 0 && result.Error == nil && result.ExitCode != 0 {
+		result.Error = status.ResourceExhaustedErrorf("task exceeded its memory limit of %d bytes", limits.MemoryBytes)
+	}
+	return result
+}
+
+// cgroupLimits returns the limits for the task that is currently bound to
+// the runner, based on the size assigned to it by the scheduler.
+func (r *commandRunner) cgroupLimits() *cgroup.Limits {
+	size := r.taskSize
+	milliCPU := int64(float64(size.GetEstimatedMilliCpu()) * r.cgroupLimitRatio)
+	return &cgroup.Limits{
+		MemoryBytes: int64(float64(size.GetEstimatedMemoryBytes()) * r.cgroupLimitRatio),
+		MilliCPU:    milliCPU,
+		PIDs:        (milliCPU + 999) / 1000 * cgroupPIDsPerCPU,
+	}
+}
+
+// recordCgroupUsage records the resources used by the runner's cgroup during
+// a task into the task's result. peakMeasured is whether the usage's peak
+// memory was measured during the task only.
+func (r *commandRunner) recordCgroupUsage(result *interfaces.CommandResult, usage *cgroup.Usage, peakMeasured bool) {
+	stats := commandutil.CgroupUsageStats(usage)
+	// If the kernel can't reset the cgroup's peak memory usage between
+	// tasks, the cgroup's peak only describes the first task run by the
+	// runner. Later tasks keep the peak reported by the container, such as
+	// the one measured in a VM's guest, and otherwise leave it unset.
+	if !peakMeasured && r.taskCount != 1 {
+		stats.PeakMemoryBytes = result.UsageStats.GetPeakMemoryBytes()
+	}
+	result.UsageStats = stats
+}
+
+func (r *commandRunner) run(ctx context.Context, stdio *interfaces.Stdio) *interfaces.CommandResult {
 	wsPath := r.Workspace.Path()
 	if r.VFS != nil {
 		wsPath = r.VFS.GetMountDir()
@@ -289,7 +505,7 @@ func (r *commandRunner) Run(ctx context.Context) *interfaces.CommandResult {
 		// If the container is not recyclable, then use `Run` to walk through
 		// the entire container lifecycle in a single step.
 		// TODO: Remove this `Run` method and call lifecycle methods directly.
-		return r.Container.Run(ctx, command, wsPath, r.pullCredentials())
+		return r.Container.Run(ctx, command, wsPath, r.pullCredentials(), stdio)
 	}
 
 	// Get the container to "ready" state so that we can exec commands in it.
@@ -321,14 +537,28 @@ func (r *commandRunner) Run(ctx context.Context) *interfaces.CommandResult {
 	}
 
 	if r.supportsPersistentWorkers(ctx, command) {
-		return r.sendPersistentWorkRequest(ctx, command)
+		return r.sendPersistentWorkRequest(ctx, command, stdio)
 	}
 
-	return r.Container.Exec(ctx, command, nil, nil)
+	return r.Container.Exec(ctx, command, stdio)
 }
 
 func (r *commandRunner) UploadOutputs(ctx context.Context, ioStats *espb.IOStats, actionResult *repb.ActionResult, cmdResult *interfaces.CommandResult) error {
-	txInfo, err := r.Workspace.UploadOutputs(ctx, actionResult, cmdResult)
+	defer r.closeOutputFiles()
+	// The output files don't exist if the task failed to start.
+	stdout, stderr := io.ReadSeeker(strings.NewReader("")), io.ReadSeeker(strings.NewReader(""))
+	if stdoutFile, stderrFile := r.outputFiles(); stdoutFile != nil && stderrFile != nil {
+		stdout, stderr = stdoutFile.Reader(), stderrFile.Reader()
+	}
+	txInfo, err := r.Workspace.UploadOutputs(ctx, actionResult, stdout, stderr)
+	if status.IsResourceExhaustedError(err) {
+		// The outputs exceeded their limit, which fails the task rather
+		// than the upload, so that the task isn't retried.
+		if cmdResult.Error == nil {
+			cmdResult.Error = err
+		}
+		return nil
+	}
 	if err != nil {
 		return err
 	}
@@ -358,6 +588,13 @@ func (r *commandRunner) shutdown(ctx context.Context) error {
 
 func (r *commandRunner) Remove(ctx context.Context) error {
 	errs := []error{}
+	r.closeOutputFiles()
+	if r.worker != nil {
+		r.worker.Stop()
+	}
+	if r.multiplexWorkerKey != "" {
+		r.multiplexWorkers.release(r.multiplexWorkerKey, r)
+	}
 	if s := r.state; s != initial && s != removed {
 		r.state = removed
 		if err := r.shutdown(ctx); err != nil {
@@ -378,6 +615,11 @@ func (r *commandRunner) Remove(ctx context.Context) error {
 	if err := r.Workspace.Remove(); err != nil {
 		errs = append(errs, err)
 	}
+	if r.cgroup != nil {
+		if err := r.cgroup.Remove(); err != nil {
+			errs = append(errs, err)
+		}
+	}
 	if len(errs) > 0 {
 		return errSlice(errs)
 	}
@@ -414,7 +656,7 @@ func (r *commandRunner) cleanupCIRunner(ctx context.Context) error {
 	cleanupCmd := proto.Clone(r.task.GetCommand()).(*repb.Command)
 	cleanupCmd.Arguments = append(cleanupCmd.Arguments, "--shutdown_and_exit")
 
-	res := commandutil.Run(ctx, cleanupCmd, r.Workspace.Path(), nil /*=stdin*/, nil /*=stdout*/)
+	res := commandutil.Run(ctx, cleanupCmd, r.Workspace.Path(), nil /*=stdio*/)
 	return res.Error
 }
 
@@ -436,6 +678,18 @@ type pool struct {
 	podID          string
 	buildRoot      string
 	dockerClient   *dockerclient.Client
+	// containerdClient is the client used to create containerd containers,
+	// if containerd is enabled.
+	containerdClient *containerdclient.Client
+	// multiplexWorkers holds the multiplex persistent workers shared by the
+	// pool's runners.
+	multiplexWorkers *multiplexWorkers
+	// imageStore holds the images pulled for firecracker, podman and
+	// containerd, if any of them are enabled.
+	imageStore *imagestore.Store
+	// warmPool holds paused firecracker VMs for the images configured in
+	// executor.firecracker_warm_pool, if any.
+	warmPool *firecracker.WarmPool
 
 	maxRunnerCount            int
 	maxRunnerMemoryUsageBytes int64
@@ -479,19 +733,88 @@ func NewPool(env environment.Env) (*pool, error) {
 		log.Info("Using docker for execution")
 	}
 
+	var containerdClient *containerdclient.Client
+	if executorConfig.ContainerdSocket != "" {
+		containerdClient, err = containerd.NewClient(executorConfig.ContainerdSocket)
+		if err != nil {
+			return nil, status.FailedPreconditionErrorf("Failed to create containerd client: %s", err)
+		}
+		log.Info("Using containerd for execution")
+	}
+
+	var imageStore *imagestore.Store
+	if executorConfig.EnableFirecracker || executorConfig.EnablePodman || executorConfig.ContainerdSocket != "" {
+		imageStore, err = imagestore.New(filepath.Join(executorConfig.GetRootDirectory(), "images"), executorConfig.GetImageStoreMaxSizeBytes())
+		if err != nil {
+			return nil, status.FailedPreconditionErrorf("Failed to create image store: %s", err)
+		}
+	}
+
 	p := &pool{
-		env:            env,
-		imageCacheAuth: container.NewImageCacheAuthenticator(container.ImageCacheAuthenticatorOpts{}),
-		podID:          podID,
-		dockerClient:   dockerClient,
-		buildRoot:      executorConfig.GetRootDirectory(),
-		runners:        []*commandRunner{},
+		env:              env,
+		imageCacheAuth:   container.NewImageCacheAuthenticator(container.ImageCacheAuthenticatorOpts{}),
+		podID:            podID,
+		dockerClient:     dockerClient,
+		containerdClient: containerdClient,
+		imageStore:       imageStore,
+		multiplexWorkers: newMultiplexWorkers(executorConfig.GetRootDirectory()),
+		buildRoot:        executorConfig.GetRootDirectory(),
+		runners:          []*commandRunner{},
+	}
+	if executorConfig.EnableFirecracker && len(executorConfig.FirecrackerWarmPool.Images) > 0 {
+		p.warmPool, err = p.newWarmPool(&executorConfig.FirecrackerWarmPool)
+		if err != nil {
+			return nil, status.FailedPreconditionErrorf("Failed to create firecracker warm pool: %s", err)
+		}
 	}
 	p.setLimits(&executorConfig.RunnerPool)
 	hc.RegisterShutdownFunction(p.Shutdown)
 	return p, nil
 }
 
+// newWarmPool returns a warm pool of firecracker VMs for the configured
+// images. The VMs are configured like those of tasks with the default task
+// size, so that those tasks can use them.
+func (p *pool) newWarmPool(cfg *config.FirecrackerWarmPoolConfig) (*firecracker.WarmPool, error) {
+	executorProps := platform.GetExecutorProperties(p.env.GetConfigurator().GetExecutorConfig())
+	var images []*firecracker.WarmPoolImage
+	for _, image := range cfg.Images {
+		task := &repb.ExecutionTask{
+			Command: &repb.Command{
+				Platform: &repb.Platform{
+					Properties: []*repb.Platform_Property{
+						{Name: "container-image", Value: platform.DockerPrefix + strings.TrimPrefix(image, platform.DockerPrefix)},
+						{Name: "workload-isolation-type", Value: string(platform.FirecrackerContainerType)},
+					},
+				},
+			},
+		}
+		props := platform.ParseProperties(task)
+		if err := platform.ApplyOverrides(p.env, executorProps, props, task.GetCommand()); err != nil {
+			return nil, err
+		}
+		images = append(images, &firecracker.WarmPoolImage{
+			Opts:        p.firecrackerOptions(props, tasksize.Estimate(task), nil /*=cg*/),
+			Credentials: container.GetPullCredentials(p.env, props),
+		})
+	}
+	size := cfg.Size
+	if size <= 0 {
+		size = defaultWarmPoolSize
+	}
+	memoryBytes := cfg.MemoryBytes
+	if memoryBytes <= 0 {
+		for _, img := range images {
+			memoryBytes += int64(size) * img.Opts.MemSizeMB * 1e6
+		}
+	}
+	// Paused VMs keep their memory, so it can't be assigned to tasks.
+	if err := resources.ReserveRAMBytes(memoryBytes); err != nil {
+		return nil, err
+	}
+	return firecracker.NewWarmPool(p.env, p.imageCacheAuth, size, memoryBytes, images)
+}
+
 // Add pauses the runner and makes it available to be returned from the pool
 // via Get.
 //
@@ -681,7 +1004,7 @@ func (p *pool) warmupImage(ctx context.Context, containerType platform.Container
 		},
 	}
 	platProps := platform.ParseProperties(task)
-	c, err := p.newContainer(ctx, platProps, task)
+	c, err := p.newContainer(ctx, platProps, task, nil /*=cg*/)
 	if err != nil {
 		log.Errorf("Error warming up %q: %s", containerType, err)
 		return err
@@ -730,6 +1053,9 @@ func (p *pool) Warmup(ctx context.Context) {
 	if err := eg.Wait(); err != nil {
 		log.Warningf("Error warming up containers: %s", err)
 	}
+	if p.warmPool != nil {
+		p.warmPool.Start()
+	}
 }
 
 // Get returns a runner bound to the the given task. The caller must call
@@ -742,7 +1068,8 @@ func (p *pool) Warmup(ctx context.Context) {
 // The returned runner is considered "active" and will be killed if the
 // executor is shut down.
 func (p *pool) Get(ctx context.Context, task *repb.ExecutionTask) (interfaces.Runner, error) {
-	executorProps := platform.GetExecutorProperties(p.env.GetConfigurator().GetExecutorConfig())
+	executorConfig := p.env.GetConfigurator().GetExecutorConfig()
+	executorProps := platform.GetExecutorProperties(executorConfig)
 	props := platform.ParseProperties(task)
 	// TODO: This mutates the task; find a cleaner way to do this.
 	if err := platform.ApplyOverrides(p.env, executorProps, props, task.GetCommand()); err != nil {
@@ -774,6 +1101,7 @@ func (p *pool) Get(ctx context.Context, task *repb.ExecutionTask) (interfaces.Ru
 		Preserve:        props.PreserveWorkspace,
 		CleanInputs:     props.CleanWorkspaceInputs,
 		NonrootWritable: props.NonrootWorkspace,
+		MaxOutputBytes:  executorConfig.MaxOutputBytes,
 	}
 	if props.RecycleRunner {
 		r, err := p.take(ctx, &query{
@@ -782,6 +1110,7 @@ func (p *pool) Get(ctx context.Context, task *repb.ExecutionTask) (interfaces.Ru
 			WorkflowID:             props.WorkflowID,
 			WorkloadIsolationType:  platform.ContainerType(props.WorkloadIsolationType),
 			InitDockerd:            props.InitDockerd,
+			Network:                props.NetworkPolicy.String(),
 			HostedBazelAffinityKey: props.HostedBazelAffinityKey,
 			InstanceName:           instanceName,
 			WorkerKey:              workerKey,
@@ -793,6 +1122,7 @@ func (p *pool) Get(ctx context.Context, task *repb.ExecutionTask) (interfaces.Ru
 		if r != nil {
 			log.Info("Reusing workspace for task.")
 			r.task = task
+			r.taskSize = tasksize.SizeForTask(ctx, task)
 			r.PlatformProperties = props
 			return r, nil
 		}
@@ -801,8 +1131,18 @@ func (p *pool) Get(ctx context.Context, task *repb.ExecutionTask) (interfaces.Ru
 	if err != nil {
 		return nil, err
 	}
-	ctr, err := p.newContainer(ctx, props, task)
+	var cg *cgroup.Cgroup
+	if parent := p.env.GetConfigurator().GetExecutorConfig().CgroupParent; parent != "" {
+		cg, err = cgroup.New(filepath.Join(cgroup.RootPath, parent), "runner-"+uuid.New().String())
+		if err != nil {
+			return nil, status.UnavailableErrorf("failed to create cgroup: %s", err)
+		}
+	}
+	ctr, err := p.newContainer(ctx, props, task, cg)
 	if err != nil {
+		if cg != nil {
+			cg.Remove()
+		}
 		return nil, err
 	}
 	var fs *vfs.VFS
@@ -841,6 +1181,7 @@ func (p *pool) Get(ctx context.Context, task *repb.ExecutionTask) (interfaces.Ru
 		imageCacheAuth:     p.imageCacheAuth,
 		ACL:                ACLForUser(user),
 		task:               task,
+		taskSize:           tasksize.SizeForTask(ctx, task),
 		PlatformProperties: props,
 		InstanceName:       instanceName,
 		WorkerKey:          workerKey,
@@ -848,6 +1189,12 @@ func (p *pool) Get(ctx context.Context, task *repb.ExecutionTask) (interfaces.Ru
 		Workspace:          ws,
 		VFS:                fs,
 		VFSServer:          vfsServer,
+		cgroup:             cg,
+		cgroupLimitRatio:   p.cgroupLimitRatio(),
+		maxStdoutBytes:     executorConfig.MaxStdoutBytes,
+		maxStderrBytes:     executorConfig.MaxStderrBytes,
+		enableLiveLogs:     executorConfig.EnableLiveActionLogs,
+		multiplexWorkers:   p.multiplexWorkers,
 	}
 	p.mu.Lock()
 	defer p.mu.Unlock()
@@ -858,13 +1205,25 @@ func (p *pool) Get(ctx context.Context, task *repb.ExecutionTask) (interfaces.Ru
 	return r, nil
 }
 
-func (p *pool) newContainer(ctx context.Context, props *platform.Properties, task *repb.ExecutionTask) (*container.TracedCommandContainer, error) {
+func (p *pool) cgroupLimitRatio() float64 {
+	if ratio := p.env.GetConfigurator().GetExecutorConfig().CgroupLimitRatio; ratio > 0 {
+		return ratio
+	}
+	return defaultCgroupLimitRatio
+}
+
+// newContainer returns a container for the given task. If cg is non-nil, the
+// container's processes are placed in it.
+func (p *pool) newContainer(ctx context.Context, props *platform.Properties, task *repb.ExecutionTask, cg *cgroup.Cgroup) (*container.TracedCommandContainer, error) {
 	var ctr container.CommandContainer
 	switch platform.ContainerType(props.WorkloadIsolationType) {
 	case platform.DockerContainerType:
 		opts := p.dockerOptions()
 		opts.ForceRoot = props.DockerForceRoot
-		opts.DockerNetwork = props.DockerNetwork
+		opts.Network = props.NetworkPolicy
+		if cg != nil {
+			opts.CgroupParent = cg.Name()
+		}
 		ctr = docker.NewDockerContainer(
 			p.env, p.imageCacheAuth, p.dockerClient, props.ContainerImage,
 			p.hostBuildRoot(), opts,
@@ -872,38 +1231,63 @@ func (p *pool) newContainer(ctx context.Context, props *platform.Properties, tas
 	case platform.PodmanContainerType:
 		cfg := p.env.GetConfigurator().GetExecutorConfig()
 		opts := &podman.PodmanOptions{
-			ForceRoot: props.DockerForceRoot,
-			Network:   props.DockerNetwork,
-			CapAdd:    cfg.DockerCapAdd,
-			Runtime:   cfg.PodmanRuntime,
+			ForceRoot:  props.DockerForceRoot,
+			Network:    props.NetworkPolicy,
+			CapAdd:     cfg.DockerCapAdd,
+			Runtime:    cfg.PodmanRuntime,
+			ImageStore: p.imageStore,
+		}
+		if cg != nil {
+			opts.CgroupParent = cg.Name()
 		}
 		ctr = podman.NewPodmanCommandContainer(p.env, p.imageCacheAuth, props.ContainerImage, p.buildRoot, opts)
-	case platform.FirecrackerContainerType:
-		sizeEstimate := tasksize.Estimate(task)
-		opts := firecracker.ContainerOpts{
-			ContainerImage:         props.ContainerImage,
-			DockerClient:           p.dockerClient,
-			ActionWorkingDirectory: p.hostBuildRoot(),
-			NumCPUs:                int64(math.Max(1.0, float64(sizeEstimate.GetEstimatedMilliCpu())/1000)),
-			MemSizeMB:              int64(math.Max(1.0, float64(sizeEstimate.GetEstimatedMemoryBytes())/1e6)),
-			ScratchDiskSizeMB:      int64(float64(sizeEstimate.GetEstimatedFreeDiskBytes()) / 1e6),
-			EnableNetworking:       true,
-			InitDockerd:            props.InitDockerd,
-			JailerRoot:             p.buildRoot,
-			AllowSnapshotStart:     false,
-			DebugMode:              *commandutil.DebugStreamCommandOutputs,
+	case platform.ContainerdContainerType:
+		opts := &containerd.ContainerdOptions{
+			ForceRoot:  props.DockerForceRoot,
+			Network:    props.NetworkPolicy,
+			ImageStore: p.imageStore,
+		}
+		if cg != nil {
+			opts.CgroupParent = cg.Name()
 		}
+		ctr = containerd.NewContainerdContainer(p.env, p.imageCacheAuth, p.containerdClient, props.ContainerImage, p.hostBuildRoot(), opts)
+	case platform.FirecrackerContainerType:
+		opts := p.firecrackerOptions(props, tasksize.SizeForTask(ctx, task), cg)
+		opts.WarmPool = p.warmPool
 		c, err := firecracker.NewContainer(p.env, p.imageCacheAuth, opts)
 		if err != nil {
 			return nil, err
 		}
 		ctr = c
+	case platform.SandboxContainerType:
+		ctr = sandbox.NewSandboxCommandContainer(&sandbox.Opts{Cgroup: cg, Network: props.NetworkPolicy})
 	default:
-		ctr = bare.NewBareCommandContainer()
+		ctr = bare.NewBareCommandContainer(&bare.Opts{Cgroup: cg})
 	}
 	return container.NewTracedCommandContainer(ctr), nil
 }
 
+func (p *pool) firecrackerOptions(props *platform.Properties, sizeEstimate *scpb.TaskSize, cg *cgroup.Cgroup) firecracker.ContainerOpts {
+	policy := props.NetworkPolicy
+	return firecracker.ContainerOpts{
+		ContainerImage:         props.ContainerImage,
+		DockerClient:           p.dockerClient,
+		ImageStore:             p.imageStore,
+		ActionWorkingDirectory: p.hostBuildRoot(),
+		NumCPUs:                int64(math.Max(1.0, float64(sizeEstimate.GetEstimatedMilliCpu())/1000)),
+		MemSizeMB:              int64(math.Max(1.0, float64(sizeEstimate.GetEstimatedMemoryBytes())/1e6)),
+		ScratchDiskSizeMB:      int64(float64(sizeEstimate.GetEstimatedFreeDiskBytes()) / 1e6),
+		EnableNetworking:       policy == nil || policy.NeedsInterface(),
+		EnableLoopback:         policy != nil && policy.Mode == networking.Loopback,
+		EgressPolicy:           policy,
+		InitDockerd:            props.InitDockerd,
+		JailerRoot:             p.buildRoot,
+		AllowSnapshotStart:     false,
+		DebugMode:              *commandutil.DebugStreamCommandOutputs,
+		Cgroup:                 cg,
+	}
+}
+
 // query specifies a set of search criteria for runners within a pool.
 // All criteria must match in order for a runner to be matched.
 type query struct {
@@ -923,6 +1307,9 @@ type query struct {
 	WorkloadIsolationType platform.ContainerType
 	// InitDockerd specifies whether dockerd should be initialized.
 	InitDockerd bool
+	// Network is the network policy of the runner, in the form returned by
+	// networking.Policy.String.
+	Network string
 	// WorkerKey is the key used to tell if a persistent worker can be reused.
 	// Required; the zero-value "" matches non-persistent-worker runners.
 	WorkerKey string
@@ -950,6 +1337,7 @@ func (p *pool) take(ctx context.Context, q *query) (*commandRunner, error) {
 			r.PlatformProperties.ContainerImage != q.ContainerImage ||
 			platform.ContainerType(r.PlatformProperties.WorkloadIsolationType) != q.WorkloadIsolationType ||
 			r.PlatformProperties.InitDockerd != q.InitDockerd ||
+			r.PlatformProperties.NetworkPolicy.String() != q.Network ||
 			r.PlatformProperties.WorkflowID != q.WorkflowID ||
 			r.PlatformProperties.HostedBazelAffinityKey != q.HostedBazelAffinityKey ||
 			r.WorkerKey != q.WorkerKey ||
@@ -1055,6 +1443,11 @@ func (p *pool) Shutdown(ctx context.Context) error {
 			errs = append(errs, err)
 		}
 	}
+	if p.warmPool != nil {
+		if err := p.warmPool.Shutdown(ctx); err != nil {
+			errs = append(errs, err)
+		}
+	}
 	if len(errs) > 0 {
 		return status.InternalErrorf("failed to shut down runner pool: %s", errSlice(errs))
 	}
@@ -1209,7 +1602,7 @@ func (r *commandRunner) supportsPersistentWorkers(ctx context.Context, command *
 	return len(flagFiles) > 0
 }
 
-func (r *commandRunner) sendPersistentWorkRequest(ctx context.Context, command *repb.Command) *interfaces.CommandResult {
+func (r *commandRunner) sendPersistentWorkRequest(ctx context.Context, command *repb.Command, stdio *interfaces.Stdio) *interfaces.CommandResult {
 	result := &interfaces.CommandResult{
 		CommandDebugString: fmt.Sprintf("(persistentworker) %s", command.GetArguments()),
 		ExitCode:           commandutil.NoExitCode,
@@ -1217,33 +1610,8 @@ func (r *commandRunner) sendPersistentWorkRequest(ctx context.Context, command *
 
 	workerArgs, flagFiles := SplitArgsIntoWorkerArgsAndFlagFiles(command.GetArguments())
 
-	execContext, cancel := context.WithCancel(ctx)
-	// If it's our first rodeo, create the persistent worker.
-	if r.stdinWriter == nil || r.stdoutReader == nil {
-		stdinReader, stdinWriter := io.Pipe()
-		stdoutReader, stdoutWriter := io.Pipe()
-		r.stdinWriter = stdinWriter
-		r.stdoutReader = bufio.NewReader(stdoutReader)
-		r.jsonDecoder = json.NewDecoder(r.stdoutReader)
-
-		command.Arguments = append(workerArgs, "--persistent_worker")
-
-		go func() {
-			res := r.Container.Exec(execContext, command, stdinReader, stdoutWriter)
-			stdinWriter.Close()
-			stdoutReader.Close()
-			log.Debugf("Persistent worker exited with response: %+v, flagFiles: %+v, workerArgs: %+v", res, flagFiles, workerArgs)
-		}()
-	}
-
 	r.doNotReuse = true
-	defer func() {
-		if r.doNotReuse {
-			cancel()
-		}
-	}()
 
-	// We've got a worker - now let's build a work request.
 	requestProto := &wkpb.WorkRequest{
 		Inputs: make([]*wkpb.Input, 0, len(r.Workspace.Inputs)),
 	}
@@ -1269,72 +1637,184 @@ func (r *commandRunner) sendPersistentWorkRequest(ctx context.Context, command *
 		})
 	}
 
-	// Encode the work requests
-	err = r.marshalWorkRequest(requestProto, r.stdinWriter)
-	if err != nil {
-		result.Error = status.WrapError(err, "marshaling work request")
-		return result
-	}
-
-	// Now we've sent a work request, let's collect our response.
-	responseProto := &wkpb.WorkResponse{}
-	err = r.unmarshalWorkResponse(responseProto, r.stdoutReader)
-	if err != nil {
-		result.Error = status.WrapError(err, "unmarshaling work response")
-		return result
+	var responseProto *wkpb.WorkResponse
+	for attempt := 1; ; attempt++ {
+		worker, err := r.persistentWorker(command, workerArgs)
+		if err != nil {
+			result.Error = status.WrapError(err, "starting persistent worker")
+			return result
+		}
+		if r.useMultiplexWorker() {
+			// Shared multiplex workers run in the build root and are told
+			// which workspace to use.
+			sandboxDir, err := filepath.Rel(r.multiplexWorkers.rootDir, r.Workspace.Path())
+			if err != nil {
+				result.Error = status.InternalErrorf("failed to get workspace path: %s", err)
+				return result
+			}
+			requestProto.SandboxDir = sandboxDir
+		}
+		responseProto, err = worker.Send(ctx, requestProto)
+		if err == nil {
+			break
+		}
+		if !worker.Exited() || ctx.Err() != nil || attempt >= maxPersistentWorkRequestAttempts {
+			result.Error = status.WrapError(err, "sending work request")
+			return result
+		}
+		log.Warningf("Persistent worker crashed, restarting it and retrying the work request: %s", err)
 	}
 
-	// Populate the result from the response proto.
-	result.Stderr = []byte(responseProto.Output)
+	// Populate the result from the response proto. Errors writing the output
+	// are reported by Run.
+	io.WriteString(stdio.Stderr, responseProto.Output)
 	result.ExitCode = int(responseProto.ExitCode)
 	r.doNotReuse = false
 	return result
 }
 
-func (r *commandRunner) marshalWorkRequest(requestProto *wkpb.WorkRequest, writer io.Writer) error {
+// persistentWorker returns the persistent worker that should handle the
+// runner's current task, starting it if it isn't running.
+func (r *commandRunner) persistentWorker(command *repb.Command, workerArgs []string) (*persistentworker.Worker, error) {
+	workerCommand := proto.Clone(command).(*repb.Command)
+	workerCommand.Arguments = append(workerArgs, "--persistent_worker")
 	protocol := r.PlatformProperties.PersistentWorkerProtocol
-	if protocol == workerProtocolJSONValue {
-		marshaler := jsonpb.Marshaler{EmitDefaults: true}
-		if err := marshaler.Marshal(writer, requestProto); err != nil {
-			return err
+
+	if r.useMultiplexWorker() {
+		key := strings.Join([]string{r.ACL.GetGroupId(), r.InstanceName, protocol, r.WorkerKey}, "|")
+		if r.multiplexWorkerKey == "" {
+			r.multiplexWorkerKey = key
+			r.multiplexWorkers.acquire(key)
 		}
-		_, err := fmt.Fprintf(writer, "\n")
-		return err
+		rootDir := r.multiplexWorkers.rootDir
+		// The worker runs in the container, and so the cgroup, of the
+		// runner that starts it, which stops it when it is removed.
+		return r.multiplexWorkers.get(key, r, func() (*persistentworker.Worker, error) {
+			return persistentworker.Start(protocol, true /*=multiplex*/, func(ctx context.Context, stdin io.Reader, stdout io.Writer) *interfaces.CommandResult {
+				return r.Container.Run(ctx, workerCommand, rootDir, r.pullCredentials(), &interfaces.Stdio{Stdin: stdin, Stdout: stdout})
+			})
+		})
 	}
-	if protocol != "" && protocol != workerProtocolProtobufValue {
-		return status.FailedPreconditionErrorf("unsupported persistent worker type %s", protocol)
+
+	if r.worker != nil {
+		if r.worker.Err() == nil {
+			return r.worker, nil
+		}
+		r.worker.Stop()
+		r.worker = nil
 	}
-	buf := proto.NewBuffer( /* buf */ nil)
-	if err := buf.EncodeMessage(requestProto); err != nil {
-		return err
+	worker, err := persistentworker.Start(protocol, false /*=multiplex*/, func(ctx context.Context, stdin io.Reader, stdout io.Writer) *interfaces.CommandResult {
+		return r.Container.Exec(ctx, workerCommand, &interfaces.Stdio{Stdin: stdin, Stdout: stdout})
+	})
+	if err != nil {
+		return nil, err
 	}
-	_, err := writer.Write(buf.Bytes())
-	return err
+	r.worker = worker
+	return worker, nil
 }
 
-func (r *commandRunner) unmarshalWorkResponse(responseProto *wkpb.WorkResponse, reader io.Reader) error {
-	protocol := r.PlatformProperties.PersistentWorkerProtocol
-	if protocol == workerProtocolJSONValue {
-		unmarshaller := jsonpb.Unmarshaler{AllowUnknownFields: true}
-		return unmarshaller.UnmarshalNext(r.jsonDecoder, responseProto)
+// useMultiplexWorker returns whether the runner's persistent work requests
+// should be sent to a multiplex worker shared with other runners. This is
+// only possible for workers which support sandboxing, since requests must be
+// told which workspace to use, and for bare runners, since the processes of
+// other isolation types can't see other runners' workspaces.
+func (r *commandRunner) useMultiplexWorker() bool {
+	return r.PlatformProperties.PersistentWorkerMultiplex &&
+		r.PlatformProperties.PersistentWorkerMultiplexSandbox &&
+		platform.ContainerType(r.PlatformProperties.WorkloadIsolationType) == platform.BareContainerType
+}
+
+// multiplexWorkers holds the multiplex persistent workers which are shared by
+// the runners in a pool. A worker is stopped once no runner uses it.
+type multiplexWorkers struct {
+	// rootDir is the directory that workers run in, which contains the
+	// workspaces of all runners.
+	rootDir string
+
+	mu      sync.Mutex
+	workers map[string]*sharedWorker
+}
+
+type sharedWorker struct {
+	// worker is the running worker, or nil if it hasn't been started.
+	worker *persistentworker.Worker
+	// owner is the runner that started the worker, which it runs in.
+	owner *commandRunner
+	// refs is the number of runners which use the worker.
+	refs int
+}
+
+func newMultiplexWorkers(rootDir string) *multiplexWorkers {
+	return &multiplexWorkers{
+		rootDir: rootDir,
+		workers: map[string]*sharedWorker{},
 	}
-	if protocol != "" && protocol != workerProtocolProtobufValue {
-		return status.FailedPreconditionErrorf("unsupported persistent worker type %s", protocol)
+}
+
+// acquire registers a runner as a user of the worker with the given key.
+func (m *multiplexWorkers) acquire(key string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	w, ok := m.workers[key]
+	if !ok {
+		w = &sharedWorker{}
+		m.workers[key] = w
 	}
-	// Read the response size from stdout as a unsigned varint.
-	size, err := binary.ReadUvarint(r.stdoutReader)
-	if err != nil {
-		return err
+	w.refs++
+}
+
+// release unregisters a runner as a user of the worker with the given key,
+// stopping the worker if no other runner uses it, or if it runs in the
+// runner's container. In that case, the next runner to use the worker starts
+// it again.
+func (m *multiplexWorkers) release(key string, r *commandRunner) {
+	m.mu.Lock()
+	w, ok := m.workers[key]
+	if !ok {
+		m.mu.Unlock()
+		return
 	}
-	data := make([]byte, size)
-	// Read the response proto from stdout.
-	if _, err := io.ReadFull(r.stdoutReader, data); err != nil {
-		return err
+	w.refs--
+	worker := w.worker
+	if w.refs <= 0 {
+		delete(m.workers, key)
+	} else if w.owner == r {
+		w.worker = nil
+		w.owner = nil
+	} else {
+		worker = nil
 	}
-	if err := proto.Unmarshal(data, responseProto); err != nil {
-		return err
+	m.mu.Unlock()
+	if worker != nil {
+		worker.Stop()
 	}
-	return nil
+}
+
+// get returns the worker with the given key, which must have been acquired,
+// starting it with start on behalf of r if it isn't running or has failed.
+func (m *multiplexWorkers) get(key string, r *commandRunner, start func() (*persistentworker.Worker, error)) (*persistentworker.Worker, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	w, ok := m.workers[key]
+	if !ok {
+		return nil, status.InternalErrorf("multiplex worker %q was not acquired", key)
+	}
+	if w.worker != nil && w.worker.Err() == nil {
+		return w.worker, nil
+	}
+	if w.worker != nil {
+		// Stop the failed worker in the background, since it may take a
+		// while to exit.
+		go w.worker.Stop()
+		w.worker = nil
+	}
+	worker, err := start()
+	if err != nil {
+		return nil, err
+	}
+	w.worker = worker
+	w.owner = r
+	return worker, nil
 }
 
 // Recursively expands arguments by replacing @filename args with the contents of the referenced
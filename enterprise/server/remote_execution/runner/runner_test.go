@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"context"
 	"encoding/base64"
+	"fmt"
+	"io"
 	"math/rand"
 	"os"
 	"path"
@@ -15,6 +17,7 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/workspace"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/tasksize"
 	"github.com/buildbuddy-io/buildbuddy/server/config"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
 	"github.com/buildbuddy-io/buildbuddy/server/testutil/testauth"
 	"github.com/buildbuddy-io/buildbuddy/server/testutil/testenv"
 	"github.com/buildbuddy-io/buildbuddy/server/testutil/testfs"
@@ -544,6 +547,15 @@ func encodedResponse(t *testing.T, protocol string, resp *wkpb.WorkResponse, cou
 	return base64.StdEncoding.EncodeToString([]byte(buf.Bytes()))
 }
 
+// taskStderr returns the stderr written by the runner's current task.
+func taskStderr(r interfaces.Runner) string {
+	b, err := io.ReadAll(r.(*commandRunner).stderr.Reader())
+	if err != nil {
+		return fmt.Sprintf("failed to read stderr: %s", err)
+	}
+	return string(b)
+}
+
 func TestRunnerPool_PersistentWorker(t *testing.T) {
 	for _, testCase := range []struct {
 		protocol string
@@ -567,7 +579,7 @@ func TestRunnerPool_PersistentWorker(t *testing.T) {
 		res := r.Run(context.Background())
 		require.NoError(t, res.Error)
 		assert.Equal(t, 0, res.ExitCode)
-		assert.Equal(t, []byte(resp.Output), res.Stderr)
+		assert.Equal(t, resp.Output, taskStderr(r))
 		pool.TryRecycle(ctx, r, true)
 		assert.Equal(t, 1, pool.PausedRunnerCount())
 
@@ -577,7 +589,7 @@ func TestRunnerPool_PersistentWorker(t *testing.T) {
 		res = r.Run(context.Background())
 		require.NoError(t, res.Error)
 		assert.Equal(t, 0, res.ExitCode)
-		assert.Equal(t, []byte(resp.Output), res.Stderr)
+		assert.Equal(t, resp.Output, taskStderr(r))
 		pool.TryRecycle(ctx, r, true)
 		assert.Equal(t, 1, pool.PausedRunnerCount())
 
@@ -587,7 +599,7 @@ func TestRunnerPool_PersistentWorker(t *testing.T) {
 		res = r.Run(context.Background())
 		require.NoError(t, res.Error)
 		assert.Equal(t, 0, res.ExitCode)
-		assert.Equal(t, []byte(resp.Output), res.Stderr)
+		assert.Equal(t, resp.Output, taskStderr(r))
 		pool.TryRecycle(ctx, r, true)
 		assert.Equal(t, 2, pool.PausedRunnerCount())
 	}
@@ -624,3 +636,139 @@ func TestRunnerPool_PersistentWorker_Failure(t *testing.T) {
 	pool.TryRecycle(ctx, r, true)
 	assert.Equal(t, 0, pool.PausedRunnerCount())
 }
+
+func TestRunnerPool_PersistentWorker_RestartsCrashedWorker(t *testing.T) {
+	resp := &wkpb.WorkResponse{
+		ExitCode: 0,
+		Output:   "Test output!",
+	}
+	env := newTestEnv(t)
+	pool := newRunnerPool(t, env, noLimitsCfg)
+	ctx := withAuthenticatedUser(t, context.Background(), "US1")
+
+	// The first worker crashes before responding, leaving a marker file in
+	// the workspace so that the restarted worker responds.
+	task := newPersistentRunnerTask(t, "abc", "", "proto", resp)
+	script := task.Command.Arguments[2]
+	task.Command.Arguments[2] = `if [ -e crashed ]; then ` + script + `; else touch crashed; exit 1; fi`
+	r, err := pool.Get(ctx, task)
+	require.NoError(t, err)
+	res := r.Run(context.Background())
+	require.NoError(t, res.Error)
+	assert.Equal(t, 0, res.ExitCode)
+	assert.Equal(t, resp.Output, taskStderr(r))
+	pool.TryRecycle(ctx, r, true)
+	assert.Equal(t, 1, pool.PausedRunnerCount())
+}
+
+func TestRunnerPool_PersistentWorker_CrashLoop(t *testing.T) {
+	env := newTestEnv(t)
+	pool := newRunnerPool(t, env, noLimitsCfg)
+	ctx := withAuthenticatedUser(t, context.Background(), "US1")
+
+	task := newPersistentRunnerTask(t, "abc", "", "proto", &wkpb.WorkResponse{})
+	task.Command.Arguments[2] = `echo "worker is broken" >&2; exit 1`
+	r, err := pool.Get(ctx, task)
+	require.NoError(t, err)
+	res := r.Run(context.Background())
+	require.Error(t, res.Error)
+	assert.Contains(t, res.Error.Error(), "worker is broken")
+
+	pool.TryRecycle(ctx, r, true)
+	assert.Equal(t, 0, pool.PausedRunnerCount())
+}
+
+func newMultiplexWorkerTask(key string) *repb.ExecutionTask {
+	// Responds to each JSON request with the request's sandbox dir and the
+	// worker's PID.
+	script := `
+		while read -r line; do
+			id=$(echo "$line" | sed -n 's/.*"requestId": *\([0-9]*\).*/\1/p')
+			dir=$(echo "$line" | sed -n 's/.*"sandboxDir": *"\([^"]*\)".*/\1/p')
+			echo "{\"requestId\": $id, \"output\": \"$dir $$\"}"
+		done
+	`
+	return &repb.ExecutionTask{
+		Command: &repb.Command{
+			Arguments: []string{"sh", "-c", script},
+			Platform: &repb.Platform{
+				Properties: []*repb.Platform_Property{
+					{Name: "persistentWorkerKey", Value: key},
+					{Name: "persistentWorkerProtocol", Value: "json"},
+					{Name: "persistentWorkerMultiplex", Value: "true"},
+					{Name: "persistentWorkerMultiplexSandbox", Value: "true"},
+					{Name: platform.RecycleRunnerPropertyName, Value: "true"},
+				},
+			},
+		},
+	}
+}
+
+func TestRunnerPool_MultiplexWorker(t *testing.T) {
+	env := newTestEnv(t)
+	pool := newRunnerPool(t, env, noLimitsCfg)
+	ctx := withAuthenticatedUser(t, context.Background(), "US1")
+
+	r1, err := get(ctx, pool, newMultiplexWorkerTask("abc"))
+	require.NoError(t, err)
+	r2, err := get(ctx, pool, newMultiplexWorkerTask("abc"))
+	require.NoError(t, err)
+	require.NotSame(t, r1, r2)
+
+	var outputs [2]string
+	var wg sync.WaitGroup
+	for i, r := range []*commandRunner{r1, r2} {
+		i, r := i, r
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res := r.Run(context.Background())
+			assert.NoError(t, res.Error)
+			assert.Equal(t, 0, res.ExitCode)
+			outputs[i] = taskStderr(r)
+		}()
+	}
+	wg.Wait()
+
+	// Each request should have been sent to the same worker process, with
+	// the runner's workspace as its sandbox dir.
+	var dir1, dir2, pid1, pid2 string
+	_, err = fmt.Sscan(outputs[0], &dir1, &pid1)
+	require.NoError(t, err)
+	_, err = fmt.Sscan(outputs[1], &dir2, &pid2)
+	require.NoError(t, err)
+	assert.Equal(t, path.Base(r1.Workspace.Path()), dir1)
+	assert.Equal(t, path.Base(r2.Workspace.Path()), dir2)
+	assert.Equal(t, pid1, pid2)
+
+	// The worker may run in r1's cgroup, so it must be restarted for r2 once
+	// r1 is removed.
+	require.NoError(t, r1.Remove(ctx))
+	res := r2.Run(context.Background())
+	require.NoError(t, res.Error)
+	assert.Equal(t, 0, res.ExitCode)
+	var dir3, pid3 string
+	_, err = fmt.Sscan(taskStderr(r2), &dir3, &pid3)
+	require.NoError(t, err)
+	assert.Equal(t, path.Base(r2.Workspace.Path()), dir3)
+
+	require.NoError(t, r2.Remove(ctx))
+}
+
+func TestRunnerPool_OutputLimitExceeded(t *testing.T) {
+	env := newTestEnv(t)
+	env.GetConfigurator().GetExecutorConfig().MaxStdoutBytes = 10
+	pool := newRunnerPool(t, env, noLimitsCfg)
+	ctx := withAuthenticatedUser(t, context.Background(), "US1")
+
+	task := newTask()
+	task.Command.Arguments = []string{"sh", "-c", "while true; do echo 0123456789; done"}
+	r, err := get(ctx, pool, task)
+	require.NoError(t, err)
+	res := r.Run(context.Background())
+
+	require.True(t, status.IsResourceExhaustedError(res.Error), "expected ResourceExhausted but got: %s", res.Error)
+	assert.Contains(t, status.Message(res.Error), "stdout exceeded the limit of 10 bytes")
+
+	require.NoError(t, r.Remove(ctx))
+}
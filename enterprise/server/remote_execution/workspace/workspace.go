@@ -1,7 +1,6 @@
 package workspace
 
 import (
-	"bytes"
 	"context"
 	"fmt"
 	"io"
@@ -15,8 +14,8 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/dirtools"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/vfs"
 	"github.com/buildbuddy-io/buildbuddy/server/environment"
-	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
 	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/cachetools"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/digest"
 	"github.com/buildbuddy-io/buildbuddy/server/util/disk"
 	"github.com/buildbuddy-io/buildbuddy/server/util/log"
 	"github.com/buildbuddy-io/buildbuddy/server/util/status"
@@ -52,6 +51,11 @@ type Workspace struct {
 	// TODO: Make sure these files are written read-only
 	// to make sure this map accurately reflects the filesystem.
 	Inputs map[string]*repb.FileNode
+	// inputTree is the input tree that was last downloaded to a preserved
+	// workspace, as long as no output has replaced part of it since. The next
+	// download is diffed against it, so that unchanged directories are
+	// skipped.
+	inputTree *dirtools.IndexedTree
 
 	mu       sync.Mutex // protects(removing)
 	removing bool
@@ -65,6 +69,9 @@ type Opts struct {
 	// for output dirs.
 	Preserve    bool
 	CleanInputs string
+	// MaxOutputBytes is the maximum total size of the output files of an
+	// action, if positive.
+	MaxOutputBytes int64
 }
 
 // New creates a new workspace directly under the given parent directory.
@@ -147,16 +154,32 @@ func (ws *Workspace) DownloadInputs(ctx context.Context, tree *repb.Tree) (*dirt
 	if ws.Opts.Preserve {
 		opts.Skip = ws.Inputs
 		opts.TrackTransfers = true
+		opts.PreviousTree = ws.inputTree
 	}
+	// Until the download succeeds, the workspace may be partially updated.
+	ws.inputTree = nil
 	txInfo, err := dirtools.DownloadTree(ctx, ws.env, ws.task.GetExecuteRequest().GetInstanceName(), tree, ws.rootDir, opts)
 	if err == nil {
-		if err := ws.CleanInputsIfNecessary(txInfo.Exists); err != nil {
+		if opts.PreviousTree != nil {
+			// Inputs that aren't in the previous tree have already been
+			// cleaned, so only the removed files need to be.
+			if err := ws.cleanInputs(txInfo.Removed, nil); err != nil {
+				return txInfo, err
+			}
+		} else if err := ws.CleanInputsIfNecessary(txInfo.Exists); err != nil {
 			return txInfo, err
 		}
 
+		// Replaced inputs were deleted to make room for the new tree.
+		for path := range txInfo.Replaced {
+			delete(ws.Inputs, path)
+		}
 		for path, node := range txInfo.Transfers {
 			ws.Inputs[path] = node
 		}
+		if ws.Opts.Preserve {
+			ws.inputTree = txInfo.Tree
+		}
 		mbps := (float64(txInfo.BytesTransferred) / float64(1e6)) / float64(txInfo.TransferDuration.Seconds())
 		log.Debugf("GetTree downloaded %d bytes in %s [%2.2f MB/sec]", txInfo.BytesTransferred, txInfo.TransferDuration, mbps)
 	}
@@ -191,7 +214,15 @@ func (ws *Workspace) AddCIRunner(ctx context.Context) error {
 	return err
 }
 
+// CleanInputsIfNecessary removes the inputs that match the CleanInputs
+// patterns, except for the ones in keep.
 func (ws *Workspace) CleanInputsIfNecessary(keep map[string]*repb.FileNode) error {
+	return ws.cleanInputs(ws.Inputs, keep)
+}
+
+// cleanInputs removes the given inputs that match the CleanInputs patterns,
+// except for the ones in keep.
+func (ws *Workspace) cleanInputs(inputs, keep map[string]*repb.FileNode) error {
 	if ws.Opts.CleanInputs == "" {
 		return nil
 	}
@@ -201,16 +232,19 @@ func (ws *Workspace) CleanInputsIfNecessary(keep map[string]*repb.FileNode) erro
 	if err != nil {
 		return status.FailedPreconditionErrorf("Invalid glob {%s} used for input cleaning: %s", ws.Opts.CleanInputs, err.Error())
 	}
-	for path, node := range ws.Inputs {
+	for path, node := range inputs {
+		if _, ok := ws.Inputs[path]; !ok {
+			continue
+		}
 		if ws.Opts.CleanInputs == "*" || glob.Match(path) {
 			inputFilesToCleanUp[path] = node
 		}
 	}
-	for path, _ := range keep {
+	for path := range keep {
 		delete(inputFilesToCleanUp, path)
 	}
 	if len(inputFilesToCleanUp) > 0 {
-		for path, _ := range inputFilesToCleanUp {
+		for path := range inputFilesToCleanUp {
 			if err := os.RemoveAll(filepath.Join(ws.Path(), path)); err != nil && !os.IsNotExist(err) {
 				return status.UnavailableErrorf("Failed to clean inputs: %s", err)
 			}
@@ -222,7 +256,10 @@ func (ws *Workspace) CleanInputsIfNecessary(keep map[string]*repb.FileNode) erro
 
 // UploadOutputs uploads any outputs created by the last executed command
 // as well as the command's stdout and stderr.
-func (ws *Workspace) UploadOutputs(ctx context.Context, actionResult *repb.ActionResult, cmdResult *interfaces.CommandResult) (*dirtools.TransferInfo, error) {
+//
+// If the outputs exceed the workspace's MaxOutputBytes, it returns
+// RESOURCE_EXHAUSTED, but still uploads stdout and stderr.
+func (ws *Workspace) UploadOutputs(ctx context.Context, actionResult *repb.ActionResult, stdout, stderr io.ReadSeeker) (*dirtools.TransferInfo, error) {
 	ws.mu.Lock()
 	defer ws.mu.Unlock()
 	if ws.removing {
@@ -237,12 +274,13 @@ func (ws *Workspace) UploadOutputs(ctx context.Context, actionResult *repb.Actio
 
 	var txInfo *dirtools.TransferInfo
 	var stdoutDigest, stderrDigest *repb.Digest
+	var outputLimitErr error
 
 	eg, egCtx := errgroup.WithContext(ctx)
 	eg.Go(func() error {
 		// Errors uploading stderr/stdout are swallowed.
 		var err error
-		stdoutDigest, err = cachetools.UploadBlob(egCtx, bsClient, instanceName, bytes.NewReader(cmdResult.Stdout))
+		stdoutDigest, err = cachetools.UploadBlob(egCtx, bsClient, instanceName, stdout)
 		if err != nil {
 			log.Warningf("Failed to upload stdout: %s", err)
 		}
@@ -251,7 +289,7 @@ func (ws *Workspace) UploadOutputs(ctx context.Context, actionResult *repb.Actio
 	eg.Go(func() error {
 		// Errors uploading stderr/stdout are swallowed.
 		var err error
-		stderrDigest, err = cachetools.UploadBlob(egCtx, bsClient, instanceName, bytes.NewReader(cmdResult.Stderr))
+		stderrDigest, err = cachetools.UploadBlob(egCtx, bsClient, instanceName, stderr)
 		if err != nil {
 			log.Warningf("Failed to upload stderr: %s", err)
 		}
@@ -259,7 +297,13 @@ func (ws *Workspace) UploadOutputs(ctx context.Context, actionResult *repb.Actio
 	})
 	eg.Go(func() error {
 		var err error
-		txInfo, err = dirtools.UploadTree(egCtx, ws.env, ws.dirHelper, instanceName, ws.Path(), actionResult)
+		txInfo, err = dirtools.UploadTree(egCtx, ws.env, ws.dirHelper, instanceName, ws.Path(), ws.Opts.MaxOutputBytes, actionResult)
+		if status.IsResourceExhaustedError(err) {
+			// Don't cancel the stdout and stderr uploads, which may help
+			// to explain the size of the outputs.
+			outputLimitErr = err
+			return nil
+		}
 		return err
 	})
 	if err := eg.Wait(); err != nil {
@@ -267,6 +311,9 @@ func (ws *Workspace) UploadOutputs(ctx context.Context, actionResult *repb.Actio
 	}
 	actionResult.StdoutDigest = stdoutDigest
 	actionResult.StderrDigest = stderrDigest
+	if outputLimitErr != nil {
+		return nil, outputLimitErr
+	}
 	return txInfo, nil
 }
 
@@ -309,15 +356,28 @@ func (ws *Workspace) Clean() error {
 	// as-is.
 	if ws.Opts.Preserve {
 		cmd := ws.task.GetCommand()
+		// If an output replaced part of the last input tree, the next
+		// download can no longer be diffed against it.
+		for _, paths := range [][]string{cmd.GetOutputFiles(), cmd.GetOutputDirectories()} {
+			for _, path := range paths {
+				if ws.inputTree != nil && inTree(ws.inputTree, path) {
+					ws.inputTree = nil
+				}
+			}
+		}
 		for _, path := range cmd.GetOutputFiles() {
 			if err := os.RemoveAll(filepath.Join(ws.Path(), path)); err != nil && !os.IsNotExist(err) {
 				return status.UnavailableErrorf("Failed to clean workspace: %s", err)
 			}
 			// In case this output path was specified as an input path previously,
-			// delete it from known files.
+			// delete it from known files, along with any known input files
+			// which lived under it if it was a directory.
 			delete(ws.Inputs, path)
-			// TODO: If we remove an output file whose path previously pointed to
-			// a directory, then we need to remove all `inputs` under that directory.
+			for inputPath := range ws.Inputs {
+				if isParent(path, inputPath) {
+					delete(ws.Inputs, inputPath)
+				}
+			}
 		}
 		for _, outputDirPath := range cmd.GetOutputDirectories() {
 			if err := os.RemoveAll(filepath.Join(ws.Path(), outputDirPath)); err != nil && !os.IsNotExist(err) {
@@ -328,7 +388,7 @@ func (ws *Workspace) Clean() error {
 			// TODO: This nested loop impl may slow down the action if there are a lot
 			// of output directories. If this turns out to be an issue, might need to
 			// optimize this further.
-			for inputPath, _ := range ws.Inputs {
+			for inputPath := range ws.Inputs {
 				if isParent(outputDirPath, inputPath) {
 					delete(ws.Inputs, inputPath)
 				}
@@ -359,6 +419,36 @@ func removeChildren(dirPath string) error {
 	return nil
 }
 
+// inTree returns whether the given workspace-relative path is a file or
+// directory in the tree.
+func inTree(tree *dirtools.IndexedTree, path string) bool {
+	dir := tree.DirMap[digest.NewKey(tree.RootDigest)]
+	names := strings.Split(filepath.Clean(path), string(os.PathSeparator))
+	for i, name := range names {
+		last := i == len(names)-1
+		for _, node := range dir.GetFiles() {
+			if node.GetName() == name {
+				return last
+			}
+		}
+		var child *repb.DirectoryNode
+		for _, node := range dir.GetDirectories() {
+			if node.GetName() == name {
+				child = node
+				break
+			}
+		}
+		if child == nil {
+			return false
+		}
+		if last {
+			return true
+		}
+		dir = tree.DirMap[digest.NewKey(child.GetDigest())]
+	}
+	return false
+}
+
 func isParent(parent, child string) bool {
 	return strings.HasPrefix(child, parent+string(os.PathSeparator))
 }
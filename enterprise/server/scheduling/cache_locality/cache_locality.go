@@ -0,0 +1,125 @@
+// Package cache_locality supports routing tasks to executors that already
+// have their inputs in their file cache, so that fewer inputs need to be
+// downloaded.
+//
+// Executors periodically publish a Bloom filter of the digests in their file
+// cache. When a task is scheduled, its largest inputs are sampled, and
+// executors are ranked by the total size of the sampled inputs that their
+// filter contains.
+package cache_locality
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/digest"
+	"github.com/buildbuddy-io/buildbuddy/server/util/bloom"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/golang/protobuf/proto"
+
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+)
+
+const (
+	// The max number of directories of the input tree that are read, and the
+	// max time spent reading them, when sampling inputs. These bound the time
+	// that sampling adds to scheduling.
+	maxDirectories  = 1000
+	maxSamplingTime = 100 * time.Millisecond
+
+	// The max number of input digests that are sampled.
+	maxDigests = 100
+
+	// Tasks with less input than this are not worth routing by locality:
+	// their inputs download quickly anyway, and spreading them out balances
+	// load better.
+	minInputBytes = 10 * 1024 * 1024
+)
+
+// InputDigests returns the digests of the largest files in the input tree
+// with the given root, or nil if the inputs are too small to be worth routing
+// by locality. The cache must be the CAS of the task's instance name.
+//
+// Only the directories of large trees that can be read within a short time are
+// read, in breadth-first order.
+func InputDigests(ctx context.Context, cas interfaces.Cache, rootDigest *repb.Digest) ([]*repb.Digest, error) {
+	ctx, cancel := context.WithTimeout(ctx, maxSamplingTime)
+	defer cancel()
+	files := make(map[string]*repb.Digest)
+	totalBytes := int64(0)
+	dirsRead := 0
+	level := []*repb.Digest{rootDigest}
+	for len(level) > 0 && dirsRead < maxDirectories {
+		if len(level) > maxDirectories-dirsRead {
+			level = level[:maxDirectories-dirsRead]
+		}
+		var toRead []*repb.Digest
+		for _, d := range level {
+			if d.GetHash() != digest.EmptySha256 {
+				toRead = append(toRead, d)
+			}
+		}
+		dirsRead += len(level)
+		if len(toRead) == 0 {
+			break
+		}
+		blobs, err := cas.GetMulti(ctx, toRead)
+		if err != nil && ctx.Err() != nil {
+			// Out of time: use the inputs sampled so far.
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		var next []*repb.Digest
+		for _, d := range toRead {
+			blob, ok := blobs[d]
+			if !ok {
+				return nil, status.NotFoundErrorf("directory %s/%d not found", d.GetHash(), d.GetSizeBytes())
+			}
+			dir := &repb.Directory{}
+			if err := proto.Unmarshal(blob, dir); err != nil {
+				return nil, err
+			}
+			for _, f := range dir.GetFiles() {
+				if _, ok := files[f.GetDigest().GetHash()]; ok {
+					continue
+				}
+				files[f.GetDigest().GetHash()] = f.GetDigest()
+				totalBytes += f.GetDigest().GetSizeBytes()
+			}
+			for _, sd := range dir.GetDirectories() {
+				next = append(next, sd.GetDigest())
+			}
+		}
+		level = next
+	}
+	if totalBytes < minInputBytes {
+		return nil, nil
+	}
+	digests := make([]*repb.Digest, 0, len(files))
+	for _, d := range files {
+		digests = append(digests, d)
+	}
+	sort.Slice(digests, func(i, j int) bool {
+		return digests[i].GetSizeBytes() > digests[j].GetSizeBytes()
+	})
+	if len(digests) > maxDigests {
+		digests = digests[:maxDigests]
+	}
+	return digests, nil
+}
+
+// Score returns the total size of the given digests that the file cache
+// sketch may contain.
+func Score(sketch *bloom.Filter, digests []*repb.Digest) int64 {
+	score := int64(0)
+	for _, d := range digests {
+		if sketch.MayContain(d.GetHash()) {
+			score += d.GetSizeBytes()
+		}
+	}
+	return score
+}
@@ -0,0 +1,107 @@
+package cache_locality_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/scheduling/cache_locality"
+	"github.com/buildbuddy-io/buildbuddy/server/backends/memory_cache"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/digest"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testauth"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testenv"
+	"github.com/buildbuddy-io/buildbuddy/server/util/bloom"
+	"github.com/buildbuddy-io/buildbuddy/server/util/prefix"
+	"github.com/buildbuddy-io/buildbuddy/server/util/testing/flags"
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+)
+
+const mb = 1024 * 1024
+
+func getAnonContext(t *testing.T) context.Context {
+	flags.Set(t, "auth.enable_anonymous_usage", "true")
+	te := testenv.GetTestEnv(t)
+	te.SetAuthenticator(testauth.NewTestAuthenticator(testauth.TestUsers()))
+	ctx, err := prefix.AttachUserPrefixToContext(context.Background(), te)
+	require.NoError(t, err)
+	return ctx
+}
+
+func putDir(t *testing.T, ctx context.Context, cache *memory_cache.MemoryCache, dir *repb.Directory) *repb.Digest {
+	b, err := proto.Marshal(dir)
+	require.NoError(t, err)
+	d, err := digest.ComputeForMessage(dir)
+	require.NoError(t, err)
+	require.NoError(t, cache.Set(ctx, d, b))
+	return d
+}
+
+func fileNode(name, hash string, size int64) *repb.FileNode {
+	return &repb.FileNode{Name: name, Digest: &repb.Digest{Hash: hash, SizeBytes: size}}
+}
+
+func TestInputDigests(t *testing.T) {
+	ctx := getAnonContext(t)
+	cache, err := memory_cache.NewMemoryCache(100 * mb)
+	require.NoError(t, err)
+
+	sub := putDir(t, ctx, cache, &repb.Directory{
+		Files: []*repb.FileNode{fileNode("big", "b", 8*mb), fileNode("dup", "a", 1)},
+	})
+	root := putDir(t, ctx, cache, &repb.Directory{
+		Files:       []*repb.FileNode{fileNode("small", "a", 1), fileNode("medium", "m", 4*mb)},
+		Directories: []*repb.DirectoryNode{{Name: "sub", Digest: sub}, {Name: "empty", Digest: &repb.Digest{Hash: digest.EmptySha256}}},
+	})
+
+	digests, err := cache_locality.InputDigests(ctx, cache, root)
+	require.NoError(t, err)
+	var hashes []string
+	for _, d := range digests {
+		hashes = append(hashes, d.GetHash())
+	}
+	assert.Equal(t, []string{"b", "m", "a"}, hashes)
+
+	// Small input trees aren't routed by locality.
+	digests, err = cache_locality.InputDigests(ctx, cache, sub)
+	require.NoError(t, err)
+	assert.Empty(t, digests)
+}
+
+// slowCache is a cache whose reads block until their context is done.
+type slowCache struct {
+	interfaces.Cache
+}
+
+func (c *slowCache) GetMulti(ctx context.Context, digests []*repb.Digest) (map[*repb.Digest][]byte, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestInputDigests_Timeout(t *testing.T) {
+	ctx := getAnonContext(t)
+	cache, err := memory_cache.NewMemoryCache(100 * mb)
+	require.NoError(t, err)
+	root := putDir(t, ctx, cache, &repb.Directory{
+		Files: []*repb.FileNode{fileNode("big", "b", 20*mb)},
+	})
+
+	// Sampling gives up on slow reads rather than delaying scheduling.
+	start := time.Now()
+	digests, err := cache_locality.InputDigests(ctx, &slowCache{cache}, root)
+	require.NoError(t, err)
+	assert.Empty(t, digests)
+	assert.Less(t, time.Since(start), 5*time.Second)
+}
+
+func TestScore(t *testing.T) {
+	sketch := bloom.NewWithEstimates(10, 0.01, 1024)
+	sketch.Add("a")
+	sketch.Add("b")
+	digests := []*repb.Digest{{Hash: "a", SizeBytes: 10}, {Hash: "b", SizeBytes: 5}, {Hash: "c", SizeBytes: 100}}
+	assert.Equal(t, int64(15), cache_locality.Score(sketch, digests))
+}
@@ -0,0 +1,289 @@
+// Package executor_health tracks how often executors fail tasks because of
+// infrastructure errors, and quarantines executors that fail too often so that
+// the scheduler stops sending them work.
+//
+// Health is tracked in Redis so that it is shared by all scheduler instances:
+// the outcome of each task is counted in per-minute buckets, and an executor is
+// quarantined once its infrastructure error rate over the health window
+// exceeds the configured maximum.
+package executor_health
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	// The granularity of the health window.
+	bucketDuration = time.Minute
+
+	// How long an executor stays quarantined unless it is un-quarantined
+	// first. Executors get a new ID when they restart, so this mostly bounds
+	// how long the state of executors that went away is kept around.
+	quarantineTTL = 7 * 24 * time.Hour
+
+	// Defaults for unset options.
+	defaultMinTasks = 10
+	defaultWindow   = 30 * time.Minute
+
+	tasksField       = "tasks"
+	infraErrorsField = "infraErrors"
+	// Prefix of the fields counting infrastructure errors by class.
+	infraErrorClassFieldPrefix = "infraErrors/"
+)
+
+// Class classifies infrastructure errors by cause.
+type Class string
+
+const (
+	ImagePull Class = "image_pull"
+	Disk      Class = "disk"
+	OOM       Class = "oom"
+	// The executor stopped renewing the lease of a task it was executing,
+	// e.g. because it crashed.
+	LeaseLost Class = "lease_lost"
+	Other     Class = "other"
+)
+
+// Classify classifies an infrastructure error by its message, such as the
+// reason an executor gave for re-enqueueing a task.
+func Classify(reason string) Class {
+	r := strings.ToLower(reason)
+	switch {
+	case strings.Contains(r, "image") && (strings.Contains(r, "pull") || strings.Contains(r, "manifest")):
+		return ImagePull
+	case strings.Contains(r, "no space left on device") || strings.Contains(r, "disk quota exceeded"):
+		return Disk
+	case strings.Contains(r, "out of memory") || strings.Contains(r, "cannot allocate memory") || strings.Contains(r, "oom-kill") || strings.Contains(r, "oomkilled"):
+		return OOM
+	default:
+		return Other
+	}
+}
+
+// IsCancellation returns whether the reason an executor gave for
+// re-enqueueing a task is that the task was cancelled, e.g. because the
+// executor is shutting down, rather than an infrastructure error.
+func IsCancellation(reason string) bool {
+	r := strings.ToLower(reason)
+	return strings.Contains(r, "context canceled") || strings.Contains(r, "code = canceled")
+}
+
+type Options struct {
+	// The infrastructure error rate, between 0 and 1, above which an
+	// executor is quarantined.
+	MaxInfraErrorRate float64
+	// The minimum number of tasks an executor must have finished within the
+	// window before it can be quarantined. Defaults to 10.
+	MinTasks int64
+	// The window over which error rates are computed. Defaults to 30
+	// minutes.
+	Window time.Duration
+}
+
+// Health is the health of a single executor.
+type Health struct {
+	// The number of tasks that the executor finished within the window,
+	// successfully or not.
+	TaskCount int64
+	// The number of those tasks that failed because of an infrastructure
+	// error, in total and by class.
+	InfraErrorCount    int64
+	InfraErrorsByClass map[Class]int64
+
+	Quarantined      bool
+	QuarantineReason string
+	QuarantinedAt    time.Time
+}
+
+// InfraErrorRate returns the fraction of tasks that failed because of an
+// infrastructure error.
+func (h *Health) InfraErrorRate() float64 {
+	if h.TaskCount == 0 {
+		return 0
+	}
+	return float64(h.InfraErrorCount) / float64(h.TaskCount)
+}
+
+type quarantine struct {
+	Reason            string `json:"reason"`
+	QuarantinedAtUsec int64  `json:"quarantined_at_usec"`
+}
+
+type Tracker struct {
+	rdb  redis.UniversalClient
+	opts Options
+}
+
+func NewTracker(rdb redis.UniversalClient, opts Options) *Tracker {
+	if opts.MinTasks == 0 {
+		opts.MinTasks = defaultMinTasks
+	}
+	if opts.Window == 0 {
+		opts.Window = defaultWindow
+	}
+	return &Tracker{rdb: rdb, opts: opts}
+}
+
+func bucketKey(executorID string, bucket int64) string {
+	return fmt.Sprintf("executorHealth/%s/%d", executorID, bucket)
+}
+
+func quarantineKey(executorID string) string {
+	return "executorQuarantine/" + executorID
+}
+
+func (t *Tracker) buckets(now time.Time) []int64 {
+	last := now.Truncate(bucketDuration).Unix()
+	n := int64(t.opts.Window / bucketDuration)
+	if n < 1 {
+		n = 1
+	}
+	buckets := make([]int64, 0, n)
+	for i := int64(0); i < n; i++ {
+		buckets = append(buckets, last-i*int64(bucketDuration.Seconds()))
+	}
+	return buckets
+}
+
+func (t *Tracker) increment(ctx context.Context, executorID string, fields ...string) error {
+	key := bucketKey(executorID, t.buckets(time.Now())[0])
+	pipe := t.rdb.TxPipeline()
+	for _, f := range fields {
+		pipe.HIncrBy(ctx, key, f, 1)
+	}
+	pipe.Expire(ctx, key, t.opts.Window+bucketDuration)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// RecordTaskDone records that the executor finished a task without an
+// infrastructure error.
+func (t *Tracker) RecordTaskDone(ctx context.Context, executorID string) error {
+	return t.increment(ctx, executorID, tasksField)
+}
+
+// RecordInfraError records that a task failed on the executor because of an
+// infrastructure error, and quarantines the executor if its error rate is now
+// too high. It returns whether the executor was newly quarantined.
+func (t *Tracker) RecordInfraError(ctx context.Context, executorID string, class Class) (bool, error) {
+	if err := t.increment(ctx, executorID, tasksField, infraErrorsField, infraErrorClassFieldPrefix+string(class)); err != nil {
+		return false, err
+	}
+	h, err := t.counts(ctx, executorID)
+	if err != nil {
+		return false, err
+	}
+	if h.TaskCount < t.opts.MinTasks || h.InfraErrorRate() <= t.opts.MaxInfraErrorRate {
+		return false, nil
+	}
+	q, err := json.Marshal(&quarantine{
+		Reason:            fmt.Sprintf("%d of the last %d tasks failed with infrastructure errors, most recently %q", h.InfraErrorCount, h.TaskCount, class),
+		QuarantinedAtUsec: time.Now().UnixMicro(),
+	})
+	if err != nil {
+		return false, err
+	}
+	return t.rdb.SetNX(ctx, quarantineKey(executorID), q, quarantineTTL).Result()
+}
+
+func (t *Tracker) counts(ctx context.Context, executorID string) (*Health, error) {
+	pipe := t.rdb.Pipeline()
+	var cmds []*redis.StringStringMapCmd
+	for _, b := range t.buckets(time.Now()) {
+		cmds = append(cmds, pipe.HGetAll(ctx, bucketKey(executorID, b)))
+	}
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return nil, err
+	}
+	h := &Health{InfraErrorsByClass: make(map[Class]int64)}
+	for _, cmd := range cmds {
+		fields, err := cmd.Result()
+		if err != nil {
+			return nil, err
+		}
+		for f, v := range fields {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				continue
+			}
+			switch {
+			case f == tasksField:
+				h.TaskCount += n
+			case f == infraErrorsField:
+				h.InfraErrorCount += n
+			case strings.HasPrefix(f, infraErrorClassFieldPrefix):
+				h.InfraErrorsByClass[Class(strings.TrimPrefix(f, infraErrorClassFieldPrefix))] += n
+			}
+		}
+	}
+	return h, nil
+}
+
+// Health returns the health of the given executor.
+func (t *Tracker) Health(ctx context.Context, executorID string) (*Health, error) {
+	h, err := t.counts(ctx, executorID)
+	if err != nil {
+		return nil, err
+	}
+	data, err := t.rdb.Get(ctx, quarantineKey(executorID)).Result()
+	if err == redis.Nil {
+		return h, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	q := &quarantine{}
+	if err := json.Unmarshal([]byte(data), q); err != nil {
+		return nil, err
+	}
+	h.Quarantined = true
+	h.QuarantineReason = q.Reason
+	h.QuarantinedAt = time.UnixMicro(q.QuarantinedAtUsec)
+	return h, nil
+}
+
+// Quarantined returns which of the given executors are quarantined.
+func (t *Tracker) Quarantined(ctx context.Context, executorIDs []string) ([]string, error) {
+	if len(executorIDs) == 0 {
+		return nil, nil
+	}
+	keys := make([]string, 0, len(executorIDs))
+	for _, id := range executorIDs {
+		keys = append(keys, quarantineKey(id))
+	}
+	vals, err := t.rdb.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+	var quarantined []string
+	for i, v := range vals {
+		if v != nil {
+			quarantined = append(quarantined, executorIDs[i])
+		}
+	}
+	return quarantined, nil
+}
+
+// Unquarantine lifts the quarantine of the given executor and resets its
+// health, so that it isn't quarantined again because of past errors. It
+// returns whether the executor was quarantined.
+func (t *Tracker) Unquarantine(ctx context.Context, executorID string) (bool, error) {
+	keys := []string{quarantineKey(executorID)}
+	for _, b := range t.buckets(time.Now()) {
+		keys = append(keys, bucketKey(executorID, b))
+	}
+	pipe := t.rdb.TxPipeline()
+	quarantineDel := pipe.Del(ctx, keys[0])
+	pipe.Del(ctx, keys[1:]...)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return false, err
+	}
+	return quarantineDel.Val() > 0, nil
+}
@@ -0,0 +1,98 @@
+package executor_health_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/scheduling/executor_health"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/testutil/testredis"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/util/redisutil"
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClassify(t *testing.T) {
+	for _, test := range []struct {
+		reason string
+		class  executor_health.Class
+	}{
+		{`rpc error: code = Unavailable desc = Error creating runner for command: failed to pull image "gcr.io/foo"`, executor_health.ImagePull},
+		{"manifest for image docker.io/foo:latest not found", executor_health.ImagePull},
+		{"write /tmp/out: no space left on device", executor_health.Disk},
+		{"container was OOMKilled", executor_health.OOM},
+		{"fork/exec /bin/sh: cannot allocate memory", executor_health.OOM},
+		{"rpc error: code = Unavailable desc = Error uploading outputs", executor_health.Other},
+		{"", executor_health.Other},
+	} {
+		assert.Equal(t, test.class, executor_health.Classify(test.reason), "reason: %q", test.reason)
+	}
+}
+
+func TestIsCancellation(t *testing.T) {
+	assert.True(t, executor_health.IsCancellation("context canceled"))
+	assert.True(t, executor_health.IsCancellation("rpc error: code = Canceled desc = context canceled"))
+	assert.False(t, executor_health.IsCancellation("rpc error: code = Unavailable desc = Error uploading outputs"))
+	assert.False(t, executor_health.IsCancellation(""))
+}
+
+func TestQuarantine(t *testing.T) {
+	ctx := context.Background()
+	rdb := redis.NewClient(redisutil.TargetToOptions(testredis.Start(t).Target))
+	tracker := executor_health.NewTracker(rdb, executor_health.Options{MaxInfraErrorRate: 0.5, MinTasks: 4})
+
+	// Errors are tolerated until the executor has finished enough tasks.
+	for i := 0; i < 3; i++ {
+		quarantined, err := tracker.RecordInfraError(ctx, "executor1", executor_health.ImagePull)
+		require.NoError(t, err)
+		require.False(t, quarantined)
+	}
+	require.NoError(t, tracker.RecordTaskDone(ctx, "executor2"))
+	quarantined, err := tracker.RecordInfraError(ctx, "executor1", executor_health.Disk)
+	require.NoError(t, err)
+	require.True(t, quarantined)
+
+	h, err := tracker.Health(ctx, "executor1")
+	require.NoError(t, err)
+	assert.Equal(t, int64(4), h.TaskCount)
+	assert.Equal(t, int64(4), h.InfraErrorCount)
+	assert.Equal(t, map[executor_health.Class]int64{executor_health.ImagePull: 3, executor_health.Disk: 1}, h.InfraErrorsByClass)
+	assert.True(t, h.Quarantined)
+	assert.NotEmpty(t, h.QuarantineReason)
+
+	ids, err := tracker.Quarantined(ctx, []string{"executor1", "executor2", "executor3"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"executor1"}, ids)
+
+	// Un-quarantining resets the executor's health.
+	ok, err := tracker.Unquarantine(ctx, "executor1")
+	require.NoError(t, err)
+	require.True(t, ok)
+	h, err = tracker.Health(ctx, "executor1")
+	require.NoError(t, err)
+	assert.False(t, h.Quarantined)
+	assert.Equal(t, int64(0), h.TaskCount)
+	ok, err = tracker.Unquarantine(ctx, "executor1")
+	require.NoError(t, err)
+	require.False(t, ok)
+}
+
+func TestQuarantine_ErrorRateBelowMax(t *testing.T) {
+	ctx := context.Background()
+	rdb := redis.NewClient(redisutil.TargetToOptions(testredis.Start(t).Target))
+	tracker := executor_health.NewTracker(rdb, executor_health.Options{MaxInfraErrorRate: 0.5, MinTasks: 4})
+
+	for i := 0; i < 5; i++ {
+		require.NoError(t, tracker.RecordTaskDone(ctx, "executor1"))
+	}
+	for i := 0; i < 5; i++ {
+		quarantined, err := tracker.RecordInfraError(ctx, "executor1", executor_health.OOM)
+		require.NoError(t, err)
+		require.False(t, quarantined)
+	}
+
+	h, err := tracker.Health(ctx, "executor1")
+	require.NoError(t, err)
+	assert.Equal(t, 0.5, h.InfraErrorRate())
+	assert.False(t, h.Quarantined)
+}
@@ -0,0 +1,83 @@
+package fair_share
+
+import (
+	"context"
+	"strings"
+
+	"github.com/buildbuddy-io/buildbuddy/server/config"
+	"github.com/buildbuddy-io/buildbuddy/server/environment"
+	"github.com/buildbuddy-io/buildbuddy/server/util/perms"
+	"google.golang.org/grpc/metadata"
+
+	akpb "github.com/buildbuddy-io/buildbuddy/proto/api_key"
+)
+
+const (
+	// RoleHeader is the header that clients can set to identify the role of
+	// the invocation issuing execution requests, e.g. with
+	// --remote_header=x-buildbuddy-role=CI.
+	RoleHeader = "x-buildbuddy-role"
+
+	// The role of the invocations of BuildBuddy workflows.
+	CIRunnerRole = "CI_RUNNER"
+
+	defaultWeight = 1.0
+)
+
+// Role returns the role of the invocation that issued the request in the
+// given context, or "" if unknown.
+//
+// Roles are only trusted for requests authenticated with an API key that can
+// write to the cache. Read-only API keys are typically handed out to
+// developers, who could otherwise claim the role of CI invocations to get a
+// larger share of their group's executor capacity.
+func Role(ctx context.Context, env environment.Env, isWorkflow bool) string {
+	user, err := perms.AuthenticatedUser(ctx, env)
+	if err != nil || !user.HasCapability(akpb.ApiKey_CACHE_WRITE_CAPABILITY) {
+		return ""
+	}
+	if isWorkflow {
+		return CIRunnerRole
+	}
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		for _, role := range md.Get(RoleHeader) {
+			if role = strings.TrimSpace(role); role != "" {
+				return strings.ToUpper(role)
+			}
+		}
+	}
+	return ""
+}
+
+// Weights returns the weight of the given group, and of the invocations of
+// the given role within that group, according to the configured weights.
+func Weights(configured []config.FairShareWeight, groupID, role string) (groupWeight float64, invocationWeight float64) {
+	groupWeight = defaultWeight
+	invocationWeight = defaultWeight
+	foundGroupWeight := false
+	foundInvocationWeight := false
+	foundAnyGroupInvocationWeight := false
+	for _, w := range configured {
+		if w.Weight <= 0 {
+			continue
+		}
+		if w.Role == "" {
+			if !foundGroupWeight && w.GroupID != "" && w.GroupID == groupID {
+				groupWeight = w.Weight
+				foundGroupWeight = true
+			}
+			continue
+		}
+		if role == "" || !strings.EqualFold(w.Role, role) {
+			continue
+		}
+		if !foundInvocationWeight && w.GroupID == groupID {
+			invocationWeight = w.Weight
+			foundInvocationWeight = true
+		} else if !foundInvocationWeight && !foundAnyGroupInvocationWeight && w.GroupID == "" {
+			invocationWeight = w.Weight
+			foundAnyGroupInvocationWeight = true
+		}
+	}
+	return groupWeight, invocationWeight
+}
@@ -0,0 +1,69 @@
+package fair_share_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/scheduling/fair_share"
+	"github.com/buildbuddy-io/buildbuddy/server/config"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testauth"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testenv"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/metadata"
+)
+
+func TestRole(t *testing.T) {
+	env := testenv.GetTestEnv(t)
+	users := testauth.TestUsers("US1", "GR1", "US2", "GR1")
+	// US2 authenticates with a read-only API key.
+	users["US2"].(*testauth.TestUser).Capabilities = nil
+	env.SetAuthenticator(testauth.NewTestAuthenticator(users))
+
+	ctx := testauth.WithAuthenticatedUserInfo(context.Background(), users["US1"])
+	assert.Equal(t, "", fair_share.Role(ctx, env, false /*=isWorkflow*/))
+	assert.Equal(t, fair_share.CIRunnerRole, fair_share.Role(ctx, env, true /*=isWorkflow*/))
+
+	ctx = metadata.NewIncomingContext(ctx, metadata.Pairs(fair_share.RoleHeader, "ci"))
+	assert.Equal(t, "CI", fair_share.Role(ctx, env, false /*=isWorkflow*/))
+	assert.Equal(t, fair_share.CIRunnerRole, fair_share.Role(ctx, env, true /*=isWorkflow*/))
+
+	// Roles are ignored for read-only API keys and anonymous users.
+	for _, ctx := range []context.Context{
+		testauth.WithAuthenticatedUserInfo(context.Background(), users["US2"]),
+		context.Background(),
+	} {
+		ctx = metadata.NewIncomingContext(ctx, metadata.Pairs(fair_share.RoleHeader, "ci"))
+		assert.Equal(t, "", fair_share.Role(ctx, env, false /*=isWorkflow*/))
+		assert.Equal(t, "", fair_share.Role(ctx, env, true /*=isWorkflow*/))
+	}
+}
+
+func TestWeights(t *testing.T) {
+	configured := []config.FairShareWeight{
+		{GroupID: "GR1", Weight: 3},
+		{Role: "CI", Weight: 2},
+		{GroupID: "GR2", Role: "CI", Weight: 5},
+		{GroupID: "GR2", Role: "CI", Weight: 7},
+		{GroupID: "GR3", Weight: -1},
+	}
+
+	for _, testCase := range []struct {
+		groupID                  string
+		role                     string
+		expectedGroupWeight      float64
+		expectedInvocationWeight float64
+	}{
+		{"GR0", "", 1, 1},
+		{"GR1", "", 3, 1},
+		{"GR1", "CI", 3, 2},
+		{"GR1", "ci", 3, 2},
+		{"GR2", "CI", 1, 5},
+		{"GR2", "CI_RUNNER", 1, 1},
+		{"GR3", "", 1, 1},
+	} {
+		groupWeight, invocationWeight := fair_share.Weights(configured, testCase.groupID, testCase.role)
+
+		assert.Equal(t, testCase.expectedGroupWeight, groupWeight, "group weight of %+v", testCase)
+		assert.Equal(t, testCase.expectedInvocationWeight, invocationWeight, "invocation weight of %+v", testCase)
+	}
+}
@@ -52,10 +52,17 @@ func NewPriorityQueue() *PriorityQueue {
 }
 
 func (pq *PriorityQueue) Push(req *scpb.EnqueueTaskReservationRequest) {
+	pq.PushWithPriority(req, 0)
+}
+
+// PushWithPriority adds a request to the queue. Requests with a higher
+// priority are popped first; requests with the same priority are popped in
+// insertion order.
+func (pq *PriorityQueue) PushWithPriority(req *scpb.EnqueueTaskReservationRequest, priority int) {
 	pq.mu.Lock()
 	heap.Push(pq.inner, &pqItem{
 		value:      req,
-		priority:   0,
+		priority:   priority,
 		insertTime: time.Now(),
 	})
 
@@ -81,6 +88,17 @@ func (pq *PriorityQueue) Peek() *scpb.EnqueueTaskReservationRequest {
 	return (*pq.inner)[0].value
 }
 
+// PeekPriority returns the priority of the request that would be popped next,
+// or 0 if the queue is empty.
+func (pq *PriorityQueue) PeekPriority() int {
+	pq.mu.Lock()
+	defer pq.mu.Unlock()
+	if len(*pq.inner) == 0 {
+		return 0
+	}
+	return (*pq.inner)[0].priority
+}
+
 func (pq *PriorityQueue) GetAll() []*scpb.EnqueueTaskReservationRequest {
 	pq.mu.Lock()
 	defer pq.mu.Unlock()
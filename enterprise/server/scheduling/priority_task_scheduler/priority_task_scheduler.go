@@ -1,6 +1,7 @@
 package priority_task_scheduler
 
 import (
+	"container/heap"
 	"container/list"
 	"context"
 	"sync"
@@ -32,116 +33,289 @@ const (
 
 var shuttingDownLogOnce sync.Once
 
-type groupPriorityQueue struct {
+// fairShareQueue is an entry of a fair-share queue list. Entries are served in
+// the order of the virtual times that the scheduler assigned to their tasks,
+// which shares executors fairly across all executors. Entries with the same
+// virtual time, e.g. because the scheduler did not assign virtual times, are
+// shared fairly among the tasks queued on this executor: the entry with the
+// lowest pass is served next, and its pass is then advanced by the inverse of
+// its weight, so that entries are served in proportion to their weights.
+type fairShareQueue struct {
+	weight float64
+	pass   float64
+}
+
+func (q *fairShareQueue) setWeight(weight float64) {
+	if weight <= 0 {
+		weight = 1
+	}
+	q.weight = weight
+}
+
+func (q *fairShareQueue) advance() {
+	q.pass += 1 / q.weight
+}
+
+// before returns whether the entry with the given virtual time is served
+// before the other entry.
+func (q *fairShareQueue) before(virtualTime float64, other *fairShareQueue, otherVirtualTime float64) bool {
+	if virtualTime != otherVirtualTime {
+		return virtualTime < otherVirtualTime
+	}
+	return q.pass < other.pass
+}
+
+// virtualTimeHeap is a min-heap of virtual times.
+type virtualTimeHeap []float64
+
+func (h virtualTimeHeap) Len() int            { return len(h) }
+func (h virtualTimeHeap) Less(i, j int) bool  { return h[i] < h[j] }
+func (h virtualTimeHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *virtualTimeHeap) Push(x interface{}) { *h = append(*h, x.(float64)) }
+func (h *virtualTimeHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[:n-1]
+	return x
+}
+
+// invocationPriorityQueue holds the queued tasks of a single invocation.
+type invocationPriorityQueue struct {
+	fairShareQueue
 	*priority_queue.PriorityQueue
+	invocationID string
+}
+
+// virtualTime returns the invocation virtual time of the invocation's next
+// task.
+func (pq *invocationPriorityQueue) virtualTime() float64 {
+	return pq.Peek().GetSchedulingMetadata().GetInvocationVirtualTime()
+}
+
+// groupQueue holds the queued tasks of a group, split by invocation so that
+// an invocation with a large number of tasks can't starve the others.
+type groupQueue struct {
+	fairShareQueue
 	groupID string
+	// List of *invocationPriorityQueue items.
+	invocations *list.List
+	// Map to allow quick lookup of a specific *invocationPriorityQueue element
+	// in the invocations list.
+	invocationsByID map[string]*list.Element
+	// Number of tasks across all invocations of the group.
+	numTasks int
+	// The group virtual times of the queued tasks. Each dequeued task uses up
+	// the lowest one, no matter which invocation it belongs to, since the
+	// group virtual times are shared by all of the group's invocations.
+	virtualTimes virtualTimeHeap
+}
+
+// virtualTime returns the lowest group virtual time of the queued tasks.
+func (g *groupQueue) virtualTime() float64 {
+	return g.virtualTimes[0]
+}
+
+// minPass returns the lowest pass of the fairShareQueues in the given list,
+// which is the pass that queues joining the list start with. This prevents
+// queues that were empty for a while from being served exclusively until they
+// catch up with the others.
+func minPass(l *list.List, queue func(*list.Element) *fairShareQueue) float64 {
+	pass := 0.0
+	for e := l.Front(); e != nil; e = e.Next() {
+		if e == l.Front() || queue(e).pass < pass {
+			pass = queue(e).pass
+		}
+	}
+	return pass
 }
 
+func invocationFairShareQueue(e *list.Element) *fairShareQueue {
+	return &e.Value.(*invocationPriorityQueue).fairShareQueue
+}
+
+func groupFairShareQueue(e *list.Element) *fairShareQueue {
+	return &e.Value.(*groupQueue).fairShareQueue
+}
+
+// nextInvocation returns the invocation of the group from which the next task
+// will be obtained: the one whose next task has the highest priority or, if
+// several have the same priority, the one that is served first. Ties are
+// broken in favor of the invocation that was added to the list first.
+func (g *groupQueue) nextInvocation() *list.Element {
+	var next *list.Element
+	nextPriority := 0
+	for e := g.invocations.Front(); e != nil; e = e.Next() {
+		pq := e.Value.(*invocationPriorityQueue)
+		priority := pq.PeekPriority()
+		if next == nil || priority > nextPriority || (priority == nextPriority && pq.before(pq.virtualTime(), invocationFairShareQueue(next), next.Value.(*invocationPriorityQueue).virtualTime())) {
+			next = e
+			nextPriority = priority
+		}
+	}
+	return next
+}
+
+// nextGroup returns the group from which the next task will be obtained. Ties
+// are broken in favor of the group that was added to the list first.
+func (t *taskQueue) nextGroup() *list.Element {
+	var next *list.Element
+	for e := t.groups.Front(); e != nil; e = e.Next() {
+		g := e.Value.(*groupQueue)
+		if next == nil || g.before(g.virtualTime(), groupFairShareQueue(next), next.Value.(*groupQueue).virtualTime()) {
+			next = e
+		}
+	}
+	return next
+}
+
+// taskQueue shares the executor hierarchically: first between groups in
+// proportion to their group weight, then between the invocations of each group
+// in priority order and in proportion to their invocation weight, and finally
+// between the tasks of each invocation in priority order. Priorities never
+// preempt running tasks, and only order tasks within a group.
+//
+// The shares are based on the virtual times that the scheduler assigned to
+// the tasks, so that they apply across all executors, and on the tasks queued
+// on this executor for tasks with the same virtual times.
 type taskQueue struct {
-	// List of *groupPriorityQueue items.
-	pqs *list.List
-	// Map to allow quick lookup of a specific *groupPriorityQueue element in the pqs list.
-	pqByGroupID map[string]*list.Element
-	// The *groupPriorityQueue element from which the next task will be obtained.
-	// Will be nil when there are no tasks remaining.
-	currentPQ *list.Element
+	// List of *groupQueue items.
+	groups *list.List
+	// Map to allow quick lookup of a specific *groupQueue element in the
+	// groups list.
+	groupsByID map[string]*list.Element
 	// Number of tasks across all queues.
 	numTasks int
 }
 
 func newTaskQueue() *taskQueue {
 	return &taskQueue{
-		pqs:         list.New(),
-		pqByGroupID: make(map[string]*list.Element),
-		currentPQ:   nil,
+		groups:     list.New(),
+		groupsByID: make(map[string]*list.Element),
 	}
 }
 
+// queuePriority converts a REAPI execution priority, where lower values run
+// sooner, into a priority queue priority, where higher values run sooner.
+func queuePriority(executionPriority int32) int {
+	return -int(executionPriority)
+}
+
 func (t *taskQueue) GetAll() []*scpb.EnqueueTaskReservationRequest {
 	var reservations []*scpb.EnqueueTaskReservationRequest
 
-	for e := t.pqs.Front(); e != nil; e = e.Next() {
-		pq, ok := e.Value.(*groupPriorityQueue)
-		if !ok {
-			log.Error("not a *groupPriorityQueue!??!")
-			continue
+	for ge := t.groups.Front(); ge != nil; ge = ge.Next() {
+		g := ge.Value.(*groupQueue)
+		for ie := g.invocations.Front(); ie != nil; ie = ie.Next() {
+			reservations = append(reservations, ie.Value.(*invocationPriorityQueue).GetAll()...)
 		}
-
-		reservations = append(reservations, pq.GetAll()...)
 	}
 
 	return reservations
 }
 
 func (t *taskQueue) Enqueue(req *scpb.EnqueueTaskReservationRequest) {
-	taskGroupID := req.GetSchedulingMetadata().GetTaskGroupId()
-	var pq *groupPriorityQueue
-	if el, ok := t.pqByGroupID[taskGroupID]; ok {
-		pq, ok = el.Value.(*groupPriorityQueue)
-		if !ok {
-			// Why would this ever happen?
-			log.Error("not a *groupPriorityQueue!??!")
-			return
-		}
+	md := req.GetSchedulingMetadata()
+	taskGroupID := md.GetTaskGroupId()
+	var g *groupQueue
+	if el, ok := t.groupsByID[taskGroupID]; ok {
+		g = el.Value.(*groupQueue)
 	} else {
-		pq = &groupPriorityQueue{
-			PriorityQueue: priority_queue.NewPriorityQueue(),
-			groupID:       taskGroupID,
+		g = &groupQueue{
+			fairShareQueue:  fairShareQueue{pass: minPass(t.groups, groupFairShareQueue)},
+			groupID:         taskGroupID,
+			invocations:     list.New(),
+			invocationsByID: make(map[string]*list.Element),
 		}
-		el := t.pqs.PushBack(pq)
-		t.pqByGroupID[taskGroupID] = el
-		if t.currentPQ == nil {
-			t.currentPQ = el
+		t.groupsByID[taskGroupID] = t.groups.PushBack(g)
+	}
+	// The most recently enqueued task determines the weights, so that weight
+	// changes apply without waiting for the queue to drain.
+	g.setWeight(md.GetGroupWeight())
+
+	invocationID := md.GetTaskInvocationId()
+	var pq *invocationPriorityQueue
+	if el, ok := g.invocationsByID[invocationID]; ok {
+		pq = el.Value.(*invocationPriorityQueue)
+	} else {
+		pq = &invocationPriorityQueue{
+			fairShareQueue: fairShareQueue{pass: minPass(g.invocations, invocationFairShareQueue)},
+			PriorityQueue:  priority_queue.NewPriorityQueue(),
+			invocationID:   invocationID,
 		}
+		g.invocationsByID[invocationID] = g.invocations.PushBack(pq)
 	}
-	pq.Push(req)
+	pq.setWeight(md.GetInvocationWeight())
+
+	// The scheduler limits how many tasks of each group are prioritized.
+	pq.PushWithPriority(req, queuePriority(md.GetPriority()))
+	heap.Push(&g.virtualTimes, md.GetGroupVirtualTime())
+	g.numTasks++
 	t.numTasks++
-	metrics.RemoteExecutionQueueLength.With(prometheus.Labels{metrics.GroupID: taskGroupID}).Set(float64(pq.Len()))
+	t.updateMetrics(g)
+	if invocationID != "" {
+		metrics.RemoteExecutionInvocationQueueLength.With(prometheus.Labels{metrics.GroupID: g.groupID}).Observe(float64(pq.Len()))
+	}
 }
 
-func (t *taskQueue) Dequeue() *scpb.EnqueueTaskReservationRequest {
-	if t.currentPQ == nil {
-		return nil
+// nextQueue returns the queue from which the next task will be obtained, or
+// nil if there are no tasks remaining.
+func (t *taskQueue) nextQueue() (*list.Element, *list.Element) {
+	ge := t.nextGroup()
+	if ge == nil {
+		return nil, nil
 	}
-	pqEl := t.currentPQ
-	pq, ok := pqEl.Value.(*groupPriorityQueue)
-	if !ok {
-		// Why would this ever happen?
-		log.Error("not a *groupPriorityQueue!??!")
+	ie := ge.Value.(*groupQueue).nextInvocation()
+	if ie == nil {
+		// Empty queues are removed on Dequeue, so this should never happen.
+		log.Errorf("Group %q has no queued invocations", ge.Value.(*groupQueue).groupID)
+		return nil, nil
+	}
+	return ge, ie
+}
+
+func (t *taskQueue) Dequeue() *scpb.EnqueueTaskReservationRequest {
+	ge, ie := t.nextQueue()
+	if ge == nil {
 		return nil
 	}
+	g := ge.Value.(*groupQueue)
+	pq := ie.Value.(*invocationPriorityQueue)
 	req := pq.Pop()
+	heap.Pop(&g.virtualTimes)
 
-	t.currentPQ = t.currentPQ.Next()
+	g.advance()
+	pq.advance()
+	g.numTasks--
+	t.numTasks--
 	if pq.Len() == 0 {
-		t.pqs.Remove(pqEl)
-		delete(t.pqByGroupID, pq.groupID)
+		g.invocations.Remove(ie)
+		delete(g.invocationsByID, pq.invocationID)
 	}
-	if t.currentPQ == nil {
-		t.currentPQ = t.pqs.Front()
+	if g.numTasks == 0 {
+		t.groups.Remove(ge)
+		delete(t.groupsByID, g.groupID)
 	}
-	t.numTasks--
-	metrics.RemoteExecutionQueueLength.With(prometheus.Labels{metrics.GroupID: req.GetSchedulingMetadata().GetTaskGroupId()}).Set(float64(pq.Len()))
+	t.updateMetrics(g)
 	return req
 }
 
 func (t *taskQueue) Peek() *scpb.EnqueueTaskReservationRequest {
-	if t.currentPQ == nil {
-		return nil
-	}
-	pq, ok := t.currentPQ.Value.(*groupPriorityQueue)
-	if !ok {
-		// Why would this ever happen?
-		log.Error("not a *groupPriorityQueue!??!")
+	_, ie := t.nextQueue()
+	if ie == nil {
 		return nil
 	}
-	return pq.Peek()
+	return ie.Value.(*invocationPriorityQueue).Peek()
 }
 
 func (t *taskQueue) Len() int {
 	return t.numTasks
 }
 
+func (t *taskQueue) updateMetrics(g *groupQueue) {
+	metrics.RemoteExecutionQueueLength.With(prometheus.Labels{metrics.GroupID: g.groupID}).Set(float64(g.numTasks))
+}
+
 type Options struct {
 	RAMBytesCapacityOverride  int64
 	CPUMillisCapacityOverride int64
@@ -260,6 +434,7 @@ func propagateExecutionTaskValuesToContext(ctx context.Context, execTask *repb.E
 	ctx = context.WithValue(ctx, "x-buildbuddy-jwt", execTask.GetJwt())
 	rmd := &repb.RequestMetadata{
 		ToolInvocationId: execTask.GetInvocationId(),
+		ActionMnemonic:   execTask.GetRequestMetadata().GetActionMnemonic(),
 	}
 	if data, err := proto.Marshal(rmd); err == nil {
 		ctx = context.WithValue(ctx, "build.bazel.remote.execution.v2.requestmetadata-bin", string(data))
@@ -367,6 +542,9 @@ func (q *PriorityTaskScheduler) handleTask() {
 	}
 	ctx, cancel := context.WithCancel(q.rootContext)
 	ctx = tracing.ExtractProtoTraceMetadata(ctx, reservation.GetTraceMetadata())
+	if size := reservation.GetTaskSize(); size != nil {
+		ctx = tasksize.WithSize(ctx, size)
+	}
 
 	q.trackTask(reservation, &cancel)
 
@@ -378,7 +556,7 @@ func (q *PriorityTaskScheduler) handleTask() {
 			q.untrackTask(reservation, &cancel)
 		}()
 
-		taskLease := task_leaser.NewTaskLeaser(q.env, q.exec.HostID(), reservation.GetTaskId())
+		taskLease := task_leaser.NewTaskLeaser(q.env, q.exec.ID(), q.exec.HostID(), reservation.GetTaskId())
 		ctx, serializedTask, err := taskLease.Claim(ctx)
 		if err != nil {
 			// NotFound means the task is already claimed.
@@ -394,6 +572,7 @@ func (q *PriorityTaskScheduler) handleTask() {
 			taskLease.Close(nil, false /*=retry*/)
 			return
 		}
+		execTask.TaskId = reservation.GetTaskId()
 		retry, err := q.runTask(ctx, execTask)
 		if err != nil {
 			q.log.Errorf("Error running task %q (re-enqueue for retry: %t): %s", reservation.GetTaskId(), retry, err)
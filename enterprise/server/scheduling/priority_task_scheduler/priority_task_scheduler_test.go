@@ -1,6 +1,7 @@
 package priority_task_scheduler
 
 import (
+	"fmt"
 	"testing"
 
 	scpb "github.com/buildbuddy-io/buildbuddy/proto/scheduler"
@@ -69,3 +70,126 @@ func TestTaskQueue_MultipleGroups(t *testing.T) {
 	require.Equal(t, "group1Task3", q.Dequeue().GetTaskId())
 	require.Nil(t, q.Dequeue())
 }
+
+func newInvocationTaskReservationRequest(taskID, taskGroupID, invocationID string, groupWeight float64) *scpb.EnqueueTaskReservationRequest {
+	return &scpb.EnqueueTaskReservationRequest{
+		TaskId: taskID,
+		SchedulingMetadata: &scpb.SchedulingMetadata{
+			TaskGroupId:      taskGroupID,
+			TaskInvocationId: invocationID,
+			GroupWeight:      groupWeight,
+		},
+	}
+}
+
+func TestTaskQueue_MultipleInvocations(t *testing.T) {
+	q := newTaskQueue()
+
+	// First invocation of the first group has 3 task reservations.
+	q.Enqueue(newInvocationTaskReservationRequest("inv1Task1", testGroupID1, "inv1", 0))
+	q.Enqueue(newInvocationTaskReservationRequest("inv1Task2", testGroupID1, "inv1", 0))
+	q.Enqueue(newInvocationTaskReservationRequest("inv1Task3", testGroupID1, "inv1", 0))
+	// Second invocation of the first group has 2 task reservations.
+	q.Enqueue(newInvocationTaskReservationRequest("inv2Task1", testGroupID1, "inv2", 0))
+	q.Enqueue(newInvocationTaskReservationRequest("inv2Task2", testGroupID1, "inv2", 0))
+	// Second group has 1 task reservation.
+	q.Enqueue(newInvocationTaskReservationRequest("inv3Task1", testGroupID2, "inv3", 0))
+	require.Equal(t, 6, q.Len())
+
+	require.Equal(t, "inv1Task1", q.Dequeue().GetTaskId())
+	require.Equal(t, "inv3Task1", q.Dequeue().GetTaskId())
+	require.Equal(t, "inv2Task1", q.Dequeue().GetTaskId())
+	require.Equal(t, "inv1Task2", q.Dequeue().GetTaskId())
+	require.Equal(t, "inv2Task2", q.Dequeue().GetTaskId())
+	require.Equal(t, "inv1Task3", q.Dequeue().GetTaskId())
+	require.Nil(t, q.Dequeue())
+	require.Equal(t, 0, q.Len())
+}
+
+func TestTaskQueue_GroupWeights(t *testing.T) {
+	q := newTaskQueue()
+
+	for i := 0; i < 10; i++ {
+		q.Enqueue(newInvocationTaskReservationRequest(fmt.Sprintf("group1Task%d", i), testGroupID1, "inv1", 2))
+		q.Enqueue(newInvocationTaskReservationRequest(fmt.Sprintf("group2Task%d", i), testGroupID2, "inv2", 1))
+	}
+
+	// The first group has twice the weight of the second one, so it should
+	// get twice as many tasks dequeued.
+	dequeued := map[string]int{}
+	for i := 0; i < 6; i++ {
+		req := q.Peek()
+		require.Equal(t, req.GetTaskId(), q.Dequeue().GetTaskId(), "Peek should return the next task to be dequeued")
+		dequeued[req.GetSchedulingMetadata().GetTaskGroupId()]++
+	}
+	require.Equal(t, 4, dequeued[testGroupID1])
+	require.Equal(t, 2, dequeued[testGroupID2])
+}
+
+func newPriorityTaskReservationRequest(taskID, taskGroupID, invocationID string, priority int32) *scpb.EnqueueTaskReservationRequest {
+	return &scpb.EnqueueTaskReservationRequest{
+		TaskId: taskID,
+		SchedulingMetadata: &scpb.SchedulingMetadata{
+			TaskGroupId:      taskGroupID,
+			TaskInvocationId: invocationID,
+			Priority:         priority,
+		},
+	}
+}
+
+func TestTaskQueue_Priority(t *testing.T) {
+	q := newTaskQueue()
+
+	// A batch invocation queues tasks first, then an interactive invocation
+	// queues higher priority tasks.
+	q.Enqueue(newPriorityTaskReservationRequest("batchTask1", testGroupID1, "batch", 10))
+	q.Enqueue(newPriorityTaskReservationRequest("batchTask2", testGroupID1, "batch", 10))
+	q.Enqueue(newPriorityTaskReservationRequest("defaultTask1", testGroupID1, "default", 0))
+	q.Enqueue(newPriorityTaskReservationRequest("interactiveTask1", testGroupID1, "interactive", -10))
+	q.Enqueue(newPriorityTaskReservationRequest("interactiveTask2", testGroupID1, "interactive", -10))
+	// Priorities only apply within a group.
+	q.Enqueue(newPriorityTaskReservationRequest("group2Task1", testGroupID2, "other", 10))
+
+	require.Equal(t, "interactiveTask1", q.Dequeue().GetTaskId())
+	require.Equal(t, "group2Task1", q.Dequeue().GetTaskId())
+	require.Equal(t, "interactiveTask2", q.Dequeue().GetTaskId())
+	require.Equal(t, "defaultTask1", q.Dequeue().GetTaskId())
+	require.Equal(t, "batchTask1", q.Dequeue().GetTaskId())
+	require.Equal(t, "batchTask2", q.Dequeue().GetTaskId())
+	require.Nil(t, q.Dequeue())
+}
+
+func newVirtualTimeTaskReservationRequest(taskID, taskGroupID, invocationID string, groupVirtualTime, invocationVirtualTime float64) *scpb.EnqueueTaskReservationRequest {
+	return &scpb.EnqueueTaskReservationRequest{
+		TaskId: taskID,
+		SchedulingMetadata: &scpb.SchedulingMetadata{
+			TaskGroupId:           taskGroupID,
+			TaskInvocationId:      invocationID,
+			GroupVirtualTime:      groupVirtualTime,
+			InvocationVirtualTime: invocationVirtualTime,
+		},
+	}
+}
+
+func TestTaskQueue_VirtualTimes(t *testing.T) {
+	q := newTaskQueue()
+
+	// The first group already had many tasks scheduled on other executors,
+	// so its tasks have later virtual times than those of the second group,
+	// even though they were enqueued first on this executor.
+	q.Enqueue(newVirtualTimeTaskReservationRequest("group1Task1", testGroupID1, "inv1", 10, 10))
+	q.Enqueue(newVirtualTimeTaskReservationRequest("group1Task2", testGroupID1, "inv1", 11, 11))
+	q.Enqueue(newVirtualTimeTaskReservationRequest("group2Task1", testGroupID2, "inv2", 9, 20))
+	// Within the second group, a new invocation is served before the
+	// invocation that already had many tasks scheduled. It uses up the
+	// earliest group virtual time of the group.
+	q.Enqueue(newVirtualTimeTaskReservationRequest("group2Task2", testGroupID2, "inv2", 10.5, 21))
+	q.Enqueue(newVirtualTimeTaskReservationRequest("group2Task3", testGroupID2, "inv3", 12, 15))
+
+	require.Equal(t, "group2Task3", q.Dequeue().GetTaskId())
+	require.Equal(t, "group1Task1", q.Dequeue().GetTaskId())
+	require.Equal(t, "group2Task1", q.Dequeue().GetTaskId())
+	require.Equal(t, "group1Task2", q.Dequeue().GetTaskId())
+	require.Equal(t, "group2Task2", q.Dequeue().GetTaskId())
+	require.Nil(t, q.Dequeue())
+}
@@ -10,6 +10,7 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/auth"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/scheduling/priority_task_scheduler"
 	"github.com/buildbuddy-io/buildbuddy/server/environment"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
 	"github.com/buildbuddy-io/buildbuddy/server/resources"
 	"github.com/buildbuddy-io/buildbuddy/server/util/log"
 	"github.com/buildbuddy-io/buildbuddy/server/util/status"
@@ -23,6 +24,9 @@ import (
 const (
 	schedulerCheckInInterval         = 5 * time.Second
 	registrationFailureRetryInterval = 1 * time.Second
+	// How often the executor sends a sketch of its file cache, which the
+	// scheduler uses to route tasks to executors that have their inputs.
+	fileCacheSketchInterval = 1 * time.Minute
 )
 
 // Options provide overrides for executor registration properties.
@@ -78,6 +82,7 @@ func sleepWithContext(ctx context.Context, delay time.Duration) (done bool) {
 type Registration struct {
 	schedulerClient scpb.SchedulerClient
 	taskScheduler   *priority_task_scheduler.PriorityTaskScheduler
+	fileCache       interfaces.FileCache
 	node            *scpb.ExecutionNode
 	apiKey          string
 	shutdownSignal  chan struct{}
@@ -105,7 +110,15 @@ func (r *Registration) Check(ctx context.Context) error {
 	return errors.New("not registered to scheduler yet")
 }
 
-func (r *Registration) processWorkStream(ctx context.Context, stream scpb.Scheduler_RegisterAndStreamWorkClient, schedulerMsgs chan *scpb.RegisterAndStreamWorkResponse) (bool, error) {
+func (r *Registration) fileCacheSketch() (*scpb.FileCacheSketch, error) {
+	f, err := r.fileCache.Sketch()
+	if err != nil {
+		return nil, err
+	}
+	return &scpb.FileCacheSketch{BloomFilter: f.Bytes(), NumHashes: int32(f.NumHashes())}, nil
+}
+
+func (r *Registration) processWorkStream(ctx context.Context, stream scpb.Scheduler_RegisterAndStreamWorkClient, schedulerMsgs chan *scpb.RegisterAndStreamWorkResponse, sketchTicker <-chan time.Time) (bool, error) {
 	registrationMsg := &scpb.RegisterAndStreamWorkRequest{
 		RegisterExecutorRequest: &scpb.RegisterExecutorRequest{Node: r.node},
 	}
@@ -156,6 +169,15 @@ func (r *Registration) processWorkStream(ctx context.Context, stream scpb.Schedu
 		if err := stream.Send(registrationMsg); err != nil {
 			return false, status.UnavailableErrorf("could not send idle registration message: %s", err)
 		}
+	case <-sketchTicker:
+		sketch, err := r.fileCacheSketch()
+		if err != nil {
+			log.Warningf("Could not compute file cache sketch: %s", err)
+			return false, nil
+		}
+		if err := stream.Send(&scpb.RegisterAndStreamWorkRequest{FileCacheSketch: sketch}); err != nil {
+			return false, status.UnavailableErrorf("could not send file cache sketch: %s", err)
+		}
 	}
 	return false, nil
 }
@@ -169,6 +191,14 @@ func (r *Registration) maintainRegistrationAndStreamWork(ctx context.Context) {
 
 	defer r.setConnected(false)
 
+	// A nil channel never fires, so no sketches are sent without a file cache.
+	var sketchTicker <-chan time.Time
+	if r.fileCache != nil {
+		t := time.NewTicker(fileCacheSketchInterval)
+		defer t.Stop()
+		sketchTicker = t.C
+	}
+
 	for {
 		stream, err := r.schedulerClient.RegisterAndStreamWork(ctx)
 		if err != nil {
@@ -203,7 +233,7 @@ func (r *Registration) maintainRegistrationAndStreamWork(ctx context.Context) {
 		}()
 
 		for {
-			done, err := r.processWorkStream(ctx, stream, schedulerMsgs)
+			done, err := r.processWorkStream(ctx, stream, schedulerMsgs, sketchTicker)
 			if err != nil {
 				_ = stream.CloseSend()
 				log.Warningf("Error maintaining registration with scheduler, will retry: %s", err)
@@ -258,6 +288,7 @@ func NewRegistration(env environment.Env, taskScheduler *priority_task_scheduler
 	registration := &Registration{
 		schedulerClient: env.GetSchedulerClient(),
 		taskScheduler:   taskScheduler,
+		fileCache:       env.GetFileCache(),
 		node:            node,
 		apiKey:          apiKey,
 		shutdownSignal:  shutdownSignal,
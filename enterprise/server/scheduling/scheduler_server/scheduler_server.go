@@ -11,22 +11,33 @@ import (
 	"time"
 
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/platform"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/scheduling/executor_health"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/scheduling/speculation"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/tasksize"
+	"github.com/buildbuddy-io/buildbuddy/server/config"
 	"github.com/buildbuddy-io/buildbuddy/server/environment"
 	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/metrics"
 	"github.com/buildbuddy-io/buildbuddy/server/resources"
+	"github.com/buildbuddy-io/buildbuddy/server/util/authutil"
 	"github.com/buildbuddy-io/buildbuddy/server/util/background"
 	"github.com/buildbuddy-io/buildbuddy/server/util/grpc_client"
 	"github.com/buildbuddy-io/buildbuddy/server/util/log"
 	"github.com/buildbuddy-io/buildbuddy/server/util/perms"
+	"github.com/buildbuddy-io/buildbuddy/server/util/role"
 	"github.com/buildbuddy-io/buildbuddy/server/util/status"
 	"github.com/buildbuddy-io/buildbuddy/server/util/tracing"
 	"github.com/go-redis/redis/v8"
 	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
 	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/peer"
 
+	gcodes "google.golang.org/grpc/codes"
+	gstatus "google.golang.org/grpc/status"
+
 	akpb "github.com/buildbuddy-io/buildbuddy/proto/api_key"
 	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
 	scpb "github.com/buildbuddy-io/buildbuddy/proto/scheduler"
@@ -65,6 +76,11 @@ const (
 	redisTaskQueuedAtUsec     = "queuedAtUsec"
 	redisTaskAttempCountField = "attemptCount"
 	redisTaskClaimedField     = "claimed"
+	// The ID of the executor that most recently leased the task.
+	redisTaskLeasedByField = "leasedBy"
+	// The class of the infrastructure error that the current attempt of the
+	// task failed with, if any.
+	redisTaskInfraErrorField = "infraError"
 
 	// Maximum number of unclaimed task IDs we track per pool.
 	maxUnclaimedTasksTracked = 10_000
@@ -89,6 +105,32 @@ const (
 
 	// Platform property value corresponding with the darwin (Mac) operating system.
 	darwinOperatingSystemName = "darwin"
+
+	// How often the pool autoscaling metrics are updated, and the timeout for
+	// computing the signals of each pool.
+	autoscalingMetricsUpdateInterval = 30 * time.Second
+	autoscalingSignalsTimeout        = 10 * time.Second
+
+	// Redis key of the set of groups that have tasks held back by an
+	// executing task limit.
+	groupsWithHeldTasksKey = "groupsWithHeldTasks"
+	// How often held tasks are checked for release. Held tasks are normally
+	// released as soon as one of the group's tasks completes; this catches
+	// releases that were missed, e.g. because a scheduler restarted.
+	heldTaskReleaseInterval = 10 * time.Second
+	heldTaskReleaseTimeout  = 30 * time.Second
+	// How long clients are asked to wait before retrying an execution that
+	// was rejected because the group's queue is full.
+	groupQueueFullRetryDelay = 30 * time.Second
+	// The maximum number of unfinished tasks of a group with a higher than
+	// default priority, unless configured otherwise.
+	defaultMaxPrioritizedTasksPerGroup = 100
+
+	speculativeCopyStartTimeout = 30 * time.Second
+
+	// Redis key of the hash holding the global fair-share virtual time, which
+	// is the latest group virtual time of the tasks that were leased.
+	fairShareKey = "fairShare"
 )
 
 var (
@@ -98,8 +140,12 @@ var (
 		Buckets: prometheus.ExponentialBuckets(1, 2, 20),
 	})
 	// Claim field is set only if task exists & claim field is not present.
+	// The ID of the claiming executor (ARGV[1]) is recorded with the claim,
+	// and any infrastructure error of a previous attempt is cleared.
 	redisAcquireClaim = redis.NewScript(`
 		if redis.call("exists", KEYS[1]) == 1 and redis.call("hexists", KEYS[1], "claimed") == 0 then 
+			redis.call("hset", KEYS[1], "leasedBy", ARGV[1])
+			redis.call("hdel", KEYS[1], "infraError")
 			return redis.call("hset", KEYS[1], "claimed", "1") 
 		else 
 			return 0 
@@ -111,6 +157,14 @@ var (
 		else 
 			return 0 
 		end`)
+	// Infrastructure error class (ARGV[1]) recorded only if the task is
+	// claimed, so that it's attributed to the executor that leased it.
+	redisSetTaskInfraError = redis.NewScript(`
+		if redis.call("hget", KEYS[1], "claimed") == "1" then
+			return redis.call("hset", KEYS[1], "infraError", ARGV[1])
+		else
+			return 0
+		end`)
 	// Task deleted if claim field is present.
 	redisDeleteClaimedTask = redis.NewScript(`
 		if redis.call("hget", KEYS[1], "claimed") == "1" then 
@@ -118,6 +172,93 @@ var (
 		else 
 			return 0 
 		end`)
+	// Task added to the queued (KEYS[1]) and, if its group is at its executing
+	// task limit, held (KEYS[2]) tasks of its group, unless the group is at
+	// its queued task limit. KEYS[3] holds the group's executing tasks. The
+	// tasks counted against the executing task limit are those that are
+	// executing or have reservations enqueued, i.e. queued but not held.
+	// Returns -1 if the queue is full, 1 if the task is held and 0 otherwise.
+	redisQueueGroupTask = redis.NewScript(`
+		for i = 1, 3 do
+			redis.call("zremrangebyscore", KEYS[i], "0", ARGV[3])
+			redis.call("zrem", KEYS[i], ARGV[1])
+		end
+		local queued = redis.call("zcard", KEYS[1])
+		if tonumber(ARGV[4]) > 0 and queued >= tonumber(ARGV[4]) then
+			return -1
+		end
+		local active = redis.call("zcard", KEYS[3]) + queued - redis.call("zcard", KEYS[2])
+		local hold = 0
+		if tonumber(ARGV[5]) > 0 and active >= tonumber(ARGV[5]) then
+			hold = 1
+		end
+		local keys = {KEYS[1]}
+		if hold == 1 then
+			keys[2] = KEYS[2]
+		end
+		for _, key in ipairs(keys) do
+			redis.call("zadd", key, ARGV[2], ARGV[1])
+			redis.call("expire", key, ARGV[6])
+		end
+		return hold`)
+	// Task added to the prioritized tasks of its group (KEYS[1]), unless the
+	// group already has the maximum number (ARGV[4]) of prioritized tasks.
+	// Returns 1 if the task is prioritized and 0 otherwise.
+	redisAddPrioritizedTask = redis.NewScript(`
+		redis.call("zremrangebyscore", KEYS[1], "0", ARGV[3])
+		if redis.call("zscore", KEYS[1], ARGV[1]) then
+			return 1
+		end
+		if redis.call("zcard", KEYS[1]) >= tonumber(ARGV[4]) then
+			return 0
+		end
+		redis.call("zadd", KEYS[1], ARGV[2], ARGV[1])
+		redis.call("expire", KEYS[1], ARGV[5])
+		return 1`)
+	// Oldest held task (KEYS[2]) removed and returned if its group is below
+	// its executing task limit, counted using its queued (KEYS[1]) and
+	// executing (KEYS[3]) tasks. Returns false if no task can be released.
+	redisReleaseHeldTask = redis.NewScript(`
+		for i = 1, 3 do
+			redis.call("zremrangebyscore", KEYS[i], "0", ARGV[1])
+		end
+		local held = redis.call("zcard", KEYS[2])
+		if held == 0 then
+			return false
+		end
+		local active = redis.call("zcard", KEYS[3]) + redis.call("zcard", KEYS[1]) - held
+		if tonumber(ARGV[2]) > 0 and active >= tonumber(ARGV[2]) then
+			return false
+		end
+		return redis.call("zpopmin", KEYS[2])[1]`)
+	// Virtual times assigned to a task using start-time fair queueing. The
+	// task starts at the later of the global virtual time (ARGV[1]) and the
+	// time at which the previous task of its group finishes, stored in the
+	// group's hash (KEYS[1]), and finishes 1 / group weight (ARGV[2]) later.
+	// Likewise, within the group, the task starts at the later of the group's
+	// virtual time and the time at which the previous task of its invocation
+	// (KEYS[2]) finishes, and finishes 1 / invocation weight (ARGV[3]) later.
+	// The keys expire after ARGV[4] seconds. Returns the group and invocation
+	// virtual times of the task.
+	redisAssignVirtualTimes = redis.NewScript(`
+		local groupStart = math.max(tonumber(ARGV[1]), tonumber(redis.call("hget", KEYS[1], "finish")) or 0)
+		local groupTime = tonumber(redis.call("hget", KEYS[1], "virtualTime")) or 0
+		local invocationStart = math.max(groupTime, tonumber(redis.call("get", KEYS[2])) or 0)
+		redis.call("hset", KEYS[1], "finish", string.format("%.17g", groupStart + 1 / tonumber(ARGV[2])))
+		redis.call("expire", KEYS[1], ARGV[4])
+		redis.call("set", KEYS[2], string.format("%.17g", invocationStart + 1 / tonumber(ARGV[3])), "EX", ARGV[4])
+		return {string.format("%.17g", groupStart), string.format("%.17g", invocationStart)}`)
+	// The virtual time of the fair-share hash KEYS[1] advanced to ARGV[1],
+	// unless it is already later. The key expires after ARGV[2] seconds.
+	redisAdvanceVirtualTime = redis.NewScript(`
+		redis.call("expire", KEYS[1], ARGV[2])
+		local current = tonumber(redis.call("hget", KEYS[1], "virtualTime"))
+		if current and current >= tonumber(ARGV[1]) then
+			return 0
+		end
+		redis.call("hset", KEYS[1], "virtualTime", ARGV[1])
+		redis.call("expire", KEYS[1], ARGV[2])
+		return 1`)
 )
 
 func init() {
@@ -238,12 +379,16 @@ func (h *executorHandle) Serve(ctx context.Context) error {
 				executorID = registration.GetExecutorId()
 			} else if req.GetEnqueueTaskReservationResponse() != nil {
 				h.handleTaskReservationResponse(req.GetEnqueueTaskReservationResponse())
+			} else if req.GetFileCacheSketch() != nil {
+				if registeredNode != nil {
+					h.scheduler.taskRouter.RecordFileCacheSketch(ctx, registeredNode.GetExecutorId(), req.GetFileCacheSketch())
+				}
 			} else if req.GetShuttingDownRequest() != nil {
 				log.Infof("Executor %q is going away, re-enqueueing %d task reservations", executorID, len(req.GetShuttingDownRequest().GetTaskId()))
 				// Remove the executor first so that we don't try to send any work its way.
 				removeConnectedExecutor()
 				for _, taskID := range req.GetShuttingDownRequest().GetTaskId() {
-					if err := h.scheduler.reEnqueueTask(ctx, taskID, 1 /*=numReplicas*/, "executor shutting down"); err != nil {
+					if _, err := h.scheduler.reEnqueueTask(ctx, taskID, 1 /*=numReplicas*/, "executor shutting down"); err != nil {
 						log.Warningf("Could not re-enqueue task reservation for executor %q going down: %s", executorID, err)
 					}
 				}
@@ -406,13 +551,18 @@ type nodePool struct {
 	key       nodePoolKey
 	// Executors that are currently connected to this instance of the scheduler server.
 	connectedExecutors []*executionNode
+	// Nil if executor health is not tracked.
+	health *executor_health.Tracker
+	// IDs of the nodes that are quarantined, and should not be sent tasks.
+	quarantined []string
 }
 
-func newNodePool(env environment.Env, key nodePoolKey) *nodePool {
+func newNodePool(env environment.Env, key nodePoolKey, health *executor_health.Tracker) *nodePool {
 	np := &nodePool{
-		env: env,
-		key: key,
-		rdb: env.GetRemoteExecutionRedisClient(),
+		env:    env,
+		key:    key,
+		rdb:    env.GetRemoteExecutionRedisClient(),
+		health: health,
 	}
 	return np
 }
@@ -452,9 +602,35 @@ func (np *nodePool) RefreshNodes(ctx context.Context) error {
 	}
 	np.nodes = nodes
 	np.lastFetch = time.Now()
+	np.quarantined = nil
+	if np.health != nil {
+		ids := make([]string, 0, len(nodes))
+		for _, node := range nodes {
+			ids = append(ids, node.GetExecutorID())
+		}
+		quarantined, err := np.health.Quarantined(ctx, ids)
+		if err != nil {
+			log.Warningf("Could not look up quarantined executors in pool %q: %s", np.key.pool, err)
+		} else if len(quarantined) == len(nodes) && len(nodes) > 0 {
+			// Sending tasks to unhealthy executors is better than not
+			// running them at all.
+			log.Warningf("All %d executors in pool %q with os %q with arch %q are quarantined. Ignoring quarantine.", len(nodes), np.key.pool, np.key.os, np.key.arch)
+		} else {
+			np.quarantined = quarantined
+		}
+	}
 	return nil
 }
 
+func (np *nodePool) isQuarantined(executorID string) bool {
+	for _, id := range np.quarantined {
+		if id == executorID {
+			return true
+		}
+	}
+	return false
+}
+
 func (np *nodePool) NodeCount(ctx context.Context, taskSize *scpb.TaskSize) (int, error) {
 	if err := np.RefreshNodes(ctx); err != nil {
 		return 0, err
@@ -585,6 +761,8 @@ type persistedTask struct {
 	serializedTask  []byte
 	queuedTimestamp time.Time
 	attemptCount    int64
+	// leasedBy is the ID of the executor that most recently leased the task.
+	leasedBy string
 }
 
 type schedulerClient struct {
@@ -688,6 +866,15 @@ type SchedulerServer struct {
 
 	enableRedisAvailabilityMonitoring bool
 
+	// Limits on the tasks that groups may run on executors they don't own.
+	groupExecutionLimits []config.GroupExecutionLimit
+	// The maximum number of unfinished tasks of a group with a higher than
+	// default priority.
+	maxPrioritizedTasksPerGroup int64
+
+	// Nil if executor health is not tracked.
+	executorHealth *executor_health.Tracker
+
 	mu    sync.RWMutex
 	pools map[nodePoolKey]*nodePool
 }
@@ -705,11 +892,25 @@ func NewSchedulerServerWithOptions(env environment.Env, options *Options) (*Sche
 	requireExecutorAuthorization := false
 	forceUserOwnedDarwinExecutors := false
 	enableRedisAvailabilityMonitoring := false
+	var groupExecutionLimits []config.GroupExecutionLimit
+	maxPrioritizedTasksPerGroup := int64(defaultMaxPrioritizedTasksPerGroup)
+	var executorHealth *executor_health.Tracker
 	if conf := env.GetConfigurator().GetRemoteExecutionConfig(); conf != nil {
 		enableUserOwnedExecutors = conf.EnableUserOwnedExecutors
 		requireExecutorAuthorization = conf.RequireExecutorAuthorization
 		forceUserOwnedDarwinExecutors = conf.ForceUserOwnedDarwinExecutors
 		enableRedisAvailabilityMonitoring = conf.EnableRedisAvailabilityMonitoring
+		groupExecutionLimits = conf.GroupExecutionLimits
+		if conf.MaxPrioritizedTasksPerGroup > 0 {
+			maxPrioritizedTasksPerGroup = conf.MaxPrioritizedTasksPerGroup
+		}
+		if hc := conf.ExecutorHealth; hc.MaxInfraErrorRate > 0 {
+			executorHealth = executor_health.NewTracker(env.GetRemoteExecutionRedisClient(), executor_health.Options{
+				MaxInfraErrorRate: hc.MaxInfraErrorRate,
+				MinTasks:          hc.MinTasks,
+				Window:            hc.Window,
+			})
+		}
 	}
 
 	if options.RequireExecutorAuthorization {
@@ -749,9 +950,16 @@ func NewSchedulerServerWithOptions(env environment.Env, options *Options) (*Sche
 		forceUserOwnedDarwinExecutors:     forceUserOwnedDarwinExecutors,
 		requireExecutorAuthorization:      requireExecutorAuthorization,
 		enableRedisAvailabilityMonitoring: enableRedisAvailabilityMonitoring,
+		groupExecutionLimits:              groupExecutionLimits,
+		maxPrioritizedTasksPerGroup:       maxPrioritizedTasksPerGroup,
+		executorHealth:                    executorHealth,
 		ownHostPort:                       fmt.Sprintf("%s:%d", ownHostname, ownPort),
 	}
 	s.schedulerClientCache = newSchedulerClientCache(s.ownHostPort, s)
+	go s.updateAutoscalingMetrics()
+	if len(groupExecutionLimits) > 0 {
+		go s.releaseHeldTasksPeriodically()
+	}
 	return s, nil
 }
 
@@ -995,8 +1203,8 @@ func (s *SchedulerServer) unclaimTask(ctx context.Context, taskID string) error
 	return nil
 }
 
-func (s *SchedulerServer) claimTask(ctx context.Context, taskID string, claimTime time.Time) error {
-	r, err := redisAcquireClaim.Run(ctx, s.rdb, []string{s.redisKeyForTask(taskID)}).Result()
+func (s *SchedulerServer) claimTask(ctx context.Context, taskID, executorID string, claimTime time.Time) error {
+	r, err := redisAcquireClaim.Run(ctx, s.rdb, []string{s.redisKeyForTask(taskID)}, executorID).Result()
 	if err != nil {
 		return err
 	}
@@ -1052,7 +1260,7 @@ func (s *SchedulerServer) getOrCreatePool(key nodePoolKey) *nodePool {
 	if ok {
 		return nodePool
 	}
-	nodePool = newNodePool(s.env, key)
+	nodePool = newNodePool(s.env, key, s.executorHealth)
 	s.pools[key] = nodePool
 	return nodePool
 }
@@ -1083,6 +1291,7 @@ func (s *SchedulerServer) readTask(ctx context.Context, taskID string) (*persist
 		redisTaskMetadataField,
 		redisTaskQueuedAtUsec,
 		redisTaskAttempCountField,
+		redisTaskLeasedByField,
 	}
 	key := s.redisKeyForTask(taskID)
 	vals, err := s.rdb.HMGet(ctx, key, fields...).Result()
@@ -1134,12 +1343,456 @@ func (s *SchedulerServer) readTask(ctx context.Context, taskID string) (*persist
 		return nil, status.InvalidArgumentErrorf("could not parse attempt count %q: %v", attemptCountStr, attemptCount)
 	}
 
+	// Leased by field, which is only set once the task has been claimed.
+	leasedBy, _ := vals[4].(string)
+
 	return &persistedTask{
 		taskID:          taskID,
 		metadata:        metadata,
 		serializedTask:  serializedTask,
 		queuedTimestamp: time.UnixMicro(queuedAtUsec),
 		attemptCount:    attemptCount,
+		leasedBy:        leasedBy,
+	}, nil
+}
+
+// groupExecutionLimit returns the limit that applies to the given group: the
+// limit with the group's ID if there is one, or else the first limit without a
+// group ID.
+func groupExecutionLimit(limits []config.GroupExecutionLimit, groupID string) config.GroupExecutionLimit {
+	defaultLimit := config.GroupExecutionLimit{}
+	foundDefault := false
+	for _, l := range limits {
+		if l.GroupID == groupID {
+			return l
+		}
+		if l.GroupID == "" && !foundDefault {
+			defaultLimit = l
+			foundDefault = true
+		}
+	}
+	return defaultLimit
+}
+
+// executionLimit returns the limit that applies to the task with the given
+// metadata, and whether any limit applies. Limits only apply to tasks that run
+// on executors not owned by the task's group. Speculative copies of tasks are
+// exempt, since a task has at most one copy.
+func (s *SchedulerServer) executionLimit(metadata *scpb.SchedulingMetadata) (config.GroupExecutionLimit, bool) {
+	groupID := metadata.GetTaskGroupId()
+	if len(s.groupExecutionLimits) == 0 || groupID == "" || groupID == metadata.GetExecutorGroupId() || metadata.GetSpeculativeCopyOfTaskId() != "" {
+		return config.GroupExecutionLimit{}, false
+	}
+	limit := groupExecutionLimit(s.groupExecutionLimits, groupID)
+	return limit, limit.MaxQueuedTasks > 0 || limit.MaxExecutingTasks > 0
+}
+
+// groupTaskState is the state of a task subject to an execution limit.
+type groupTaskState int
+
+const (
+	groupTaskDone groupTaskState = iota
+	// The task is waiting for an executor to claim it.
+	groupTaskQueued
+	// The task is waiting to execute but no reservations have been enqueued
+	// for it, since its group is at its executing task limit.
+	groupTaskHeld
+	groupTaskExecuting
+)
+
+// Redis keys of the sets of tasks that a group has in each state. Held tasks
+// are a subset of queued tasks. The group ID is used as the hash tag so that a
+// group's sets are stored on the same shard.
+func redisKeyForGroupQueuedTasks(groupID string) string {
+	return fmt.Sprintf("groupTasks/{%s}/queued", groupID)
+}
+
+func redisKeyForGroupHeldTasks(groupID string) string {
+	return fmt.Sprintf("groupTasks/{%s}/held", groupID)
+}
+
+func redisKeyForGroupExecutingTasks(groupID string) string {
+	return fmt.Sprintf("groupTasks/{%s}/executing", groupID)
+}
+
+type groupTaskCounts struct {
+	queued    int64
+	held      int64
+	executing int64
+}
+
+// groupTaskKeys returns the keys of the queued, held and executing task sets
+// of the given group.
+func groupTaskKeys(groupID string) []string {
+	return []string{
+		redisKeyForGroupQueuedTasks(groupID),
+		redisKeyForGroupHeldTasks(groupID),
+		redisKeyForGroupExecutingTasks(groupID),
+	}
+}
+
+// groupTaskCutoff returns the score below which tasks are dropped from the
+// group task sets. Tasks that were never marked done (e.g. because a scheduler
+// crashed) are dropped once the task itself would have expired.
+func groupTaskCutoff() string {
+	return strconv.FormatInt(time.Now().Add(-taskTTL).Unix(), 10)
+}
+
+func (s *SchedulerServer) groupTaskCounts(ctx context.Context, groupID string) (*groupTaskCounts, error) {
+	cutoff := groupTaskCutoff()
+	keys := groupTaskKeys(groupID)
+	pipe := s.rdb.Pipeline()
+	counts := make([]*redis.IntCmd, len(keys))
+	for i, key := range keys {
+		pipe.ZRemRangeByScore(ctx, key, "0", cutoff)
+		counts[i] = pipe.ZCard(ctx, key)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+	return &groupTaskCounts{
+		queued:    counts[0].Val(),
+		held:      counts[1].Val(),
+		executing: counts[2].Val(),
+	}, nil
+}
+
+// setGroupTaskState records the state of a task in its group's task sets.
+func (s *SchedulerServer) setGroupTaskState(ctx context.Context, groupID, taskID string, state groupTaskState) error {
+	queuedKey := redisKeyForGroupQueuedTasks(groupID)
+	heldKey := redisKeyForGroupHeldTasks(groupID)
+	executingKey := redisKeyForGroupExecutingTasks(groupID)
+
+	var addKeys []string
+	switch state {
+	case groupTaskQueued:
+		addKeys = []string{queuedKey}
+	case groupTaskHeld:
+		addKeys = []string{queuedKey, heldKey}
+	case groupTaskExecuting:
+		addKeys = []string{executingKey}
+	}
+
+	m := &redis.Z{
+		Member: taskID,
+		Score:  float64(time.Now().Unix()),
+	}
+	pipe := s.rdb.Pipeline()
+	pipe.ZRem(ctx, queuedKey, taskID)
+	pipe.ZRem(ctx, heldKey, taskID)
+	pipe.ZRem(ctx, executingKey, taskID)
+	for _, key := range addKeys {
+		pipe.ZAdd(ctx, key, m)
+		pipe.Expire(ctx, key, taskTTL)
+	}
+	if state == groupTaskHeld {
+		pipe.SAdd(ctx, groupsWithHeldTasksKey, groupID)
+	}
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// queueGroupTask records that a task subject to the given limit is waiting to
+// execute, and returns true if the task must be held back because its group is
+// at its executing task limit, or an error if its group is at its queued task
+// limit. The limits are checked and the task is recorded atomically, so that
+// concurrent schedulers can't exceed them.
+func (s *SchedulerServer) queueGroupTask(ctx context.Context, taskID string, metadata *scpb.SchedulingMetadata, limit config.GroupExecutionLimit) (bool, error) {
+	groupID := metadata.GetTaskGroupId()
+	args := []interface{}{
+		taskID,
+		time.Now().Unix(),
+		groupTaskCutoff(),
+		limit.MaxQueuedTasks,
+		limit.MaxExecutingTasks,
+		int64(taskTTL.Seconds()),
+	}
+	result, err := redisQueueGroupTask.Run(ctx, s.rdb, groupTaskKeys(groupID), args...).Int64()
+	if err != nil {
+		return false, status.UnavailableErrorf("could not record task %q of group %q as queued: %s", taskID, groupID, err)
+	}
+	switch result {
+	case -1:
+		return false, groupQueueFullError(groupID, limit.MaxQueuedTasks)
+	case 1:
+		if err := s.rdb.SAdd(ctx, groupsWithHeldTasksKey, groupID).Err(); err != nil {
+			log.Warningf("Could not record that group %q has held tasks: %s", groupID, err)
+		}
+		log.Infof("Holding back task %q: group %q is at its limit of %d executing tasks.", taskID, groupID, limit.MaxExecutingTasks)
+		return true, nil
+	}
+	return false, nil
+}
+
+// redisKeyForPrioritizedTasks returns the key of the set of unfinished tasks
+// of a group that are scheduled with a higher than default priority.
+func redisKeyForPrioritizedTasks(groupID string) string {
+	return fmt.Sprintf("prioritizedTasks/{%s}", groupID)
+}
+
+// limitPriority resets the priority of a task to the default priority if its
+// group already has the maximum number of unfinished prioritized tasks, so
+// that a group can't mark all of its tasks as high priority. The limit is
+// checked and the task is recorded atomically, so that concurrent schedulers
+// can't exceed it.
+func (s *SchedulerServer) limitPriority(ctx context.Context, taskID string, metadata *scpb.SchedulingMetadata) {
+	groupID := metadata.GetTaskGroupId()
+	if metadata.GetPriority() >= 0 || groupID == "" {
+		return
+	}
+	now := time.Now()
+	args := []interface{}{
+		taskID,
+		now.Unix(),
+		// Tasks that were never marked done (e.g. because a scheduler
+		// crashed) are dropped once the task itself would have expired.
+		now.Add(-taskTTL).Unix(),
+		s.maxPrioritizedTasksPerGroup,
+		int64(taskTTL.Seconds()),
+	}
+	prioritized, err := redisAddPrioritizedTask.Run(ctx, s.rdb, []string{redisKeyForPrioritizedTasks(groupID)}, args...).Int64()
+	if err != nil {
+		log.Warningf("Could not record task %q of group %q as prioritized, scheduling it with the default priority: %s", taskID, groupID, err)
+	} else if prioritized == 1 {
+		return
+	} else {
+		log.Infof("Group %q has %d prioritized tasks, scheduling task %q with the default priority.", groupID, s.maxPrioritizedTasksPerGroup, taskID)
+	}
+	metadata.Priority = 0
+}
+
+// prioritizedTaskDone records that a task will no longer execute, so that it
+// no longer counts against the prioritized task limit of its group.
+func (s *SchedulerServer) prioritizedTaskDone(ctx context.Context, taskID string, metadata *scpb.SchedulingMetadata) {
+	groupID := metadata.GetTaskGroupId()
+	if metadata.GetPriority() >= 0 || groupID == "" {
+		return
+	}
+	if err := s.rdb.ZRem(ctx, redisKeyForPrioritizedTasks(groupID), taskID).Err(); err != nil {
+		log.Warningf("Could not record prioritized task %q of group %q as done: %s", taskID, groupID, err)
+	}
+}
+
+// redisKeyForFairShareGroup returns the key of the hash holding the fair-share
+// virtual times of a group.
+func redisKeyForFairShareGroup(groupID string) string {
+	return fmt.Sprintf("fairShare/{%s}", groupID)
+}
+
+// redisKeyForFairShareInvocation returns the key holding the virtual time at
+// which the next task of an invocation starts. The group ID is used as the
+// hash tag so that it is stored on the same shard as the group's hash.
+func redisKeyForFairShareInvocation(groupID, invocationID string) string {
+	return fmt.Sprintf("fairShare/{%s}/invocations/%s", groupID, invocationID)
+}
+
+func fairShareWeight(weight float64) float64 {
+	if weight <= 0 {
+		return 1
+	}
+	return weight
+}
+
+func parseVirtualTime(val interface{}) (float64, error) {
+	s, ok := val.(string)
+	if !ok {
+		return 0, status.InvalidArgumentErrorf("%v is not a string", val)
+	}
+	return strconv.ParseFloat(s, 64)
+}
+
+// assignVirtualTimes sets the fair-share virtual times of a task, which
+// executors use to share their capacity between groups, and between the
+// invocations within each group, in proportion to their weights. A group or
+// invocation that schedules many tasks at once gets increasingly later virtual
+// times, so that executors serve the tasks of the others first, no matter on
+// which executors the tasks are queued.
+func (s *SchedulerServer) assignVirtualTimes(ctx context.Context, taskID string, metadata *scpb.SchedulingMetadata) {
+	virtualTime, err := s.rdb.HGet(ctx, fairShareKey, "virtualTime").Float64()
+	if err != nil && err != redis.Nil {
+		log.Warningf("Could not read fair-share virtual time for task %q: %s", taskID, err)
+		return
+	}
+	groupID := metadata.GetTaskGroupId()
+	keys := []string{
+		redisKeyForFairShareGroup(groupID),
+		redisKeyForFairShareInvocation(groupID, metadata.GetTaskInvocationId()),
+	}
+	args := []interface{}{
+		virtualTime,
+		fairShareWeight(metadata.GetGroupWeight()),
+		fairShareWeight(metadata.GetInvocationWeight()),
+		int64(taskTTL.Seconds()),
+	}
+	result, err := redisAssignVirtualTimes.Run(ctx, s.rdb, keys, args...).Result()
+	if err != nil {
+		log.Warningf("Could not assign fair-share virtual times to task %q of group %q: %s", taskID, groupID, err)
+		return
+	}
+	times, ok := result.([]interface{})
+	if !ok || len(times) != 2 {
+		log.Warningf("Invalid fair-share virtual times %v for task %q", result, taskID)
+		return
+	}
+	groupTime, err := parseVirtualTime(times[0])
+	if err != nil {
+		log.Warningf("Invalid group virtual time for task %q: %s", taskID, err)
+		return
+	}
+	invocationTime, err := parseVirtualTime(times[1])
+	if err != nil {
+		log.Warningf("Invalid invocation virtual time for task %q: %s", taskID, err)
+		return
+	}
+	metadata.GroupVirtualTime = groupTime
+	metadata.InvocationVirtualTime = invocationTime
+}
+
+// advanceVirtualTimes records that a task was leased, so that the tasks of a
+// group or invocation that had no tasks queued don't start before it. This way
+// they get their share from then on, rather than being served exclusively
+// until they catch up with the groups and invocations that kept executors
+// busy.
+func (s *SchedulerServer) advanceVirtualTimes(ctx context.Context, taskID string, metadata *scpb.SchedulingMetadata) {
+	ttl := int64(taskTTL.Seconds())
+	if err := redisAdvanceVirtualTime.Run(ctx, s.rdb, []string{fairShareKey}, metadata.GetGroupVirtualTime(), ttl).Err(); err != nil {
+		log.Warningf("Could not advance fair-share virtual time for task %q: %s", taskID, err)
+	}
+	groupKey := redisKeyForFairShareGroup(metadata.GetTaskGroupId())
+	if err := redisAdvanceVirtualTime.Run(ctx, s.rdb, []string{groupKey}, metadata.GetInvocationVirtualTime(), ttl).Err(); err != nil {
+		log.Warningf("Could not advance fair-share virtual time of group %q for task %q: %s", metadata.GetTaskGroupId(), taskID, err)
+	}
+}
+
+// groupTaskDone records that a task will no longer execute, and releases held
+// tasks of its group in the background.
+func (s *SchedulerServer) groupTaskDone(ctx context.Context, taskID string, metadata *scpb.SchedulingMetadata) {
+	if _, ok := s.executionLimit(metadata); !ok {
+		return
+	}
+	groupID := metadata.GetTaskGroupId()
+	if err := s.setGroupTaskState(ctx, groupID, taskID, groupTaskDone); err != nil {
+		log.Warningf("Could not record task %q of group %q as done: %s", taskID, groupID, err)
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), heldTaskReleaseTimeout)
+		defer cancel()
+		if err := s.releaseHeldTasks(ctx, groupID); err != nil {
+			log.Warningf("Could not release held tasks of group %q: %s", groupID, err)
+		}
+	}()
+}
+
+// releaseHeldTasks enqueues reservations for the oldest held tasks of the
+// given group until the group reaches its executing task limit. Each task is
+// released atomically with the limit check, so that concurrent schedulers
+// can't exceed the limit.
+func (s *SchedulerServer) releaseHeldTasks(ctx context.Context, groupID string) error {
+	limit := groupExecutionLimit(s.groupExecutionLimits, groupID)
+	heldKey := redisKeyForGroupHeldTasks(groupID)
+	for {
+		taskID, err := redisReleaseHeldTask.Run(ctx, s.rdb, groupTaskKeys(groupID), groupTaskCutoff(), limit.MaxExecutingTasks).Text()
+		if err == redis.Nil {
+			n, err := s.rdb.ZCard(ctx, heldKey).Result()
+			if err != nil || n > 0 {
+				// The group is at its limit, so its held tasks are released
+				// later.
+				return err
+			}
+			if err := s.rdb.SRem(ctx, groupsWithHeldTasksKey, groupID).Err(); err != nil {
+				return err
+			}
+			// A task may have been held since the tasks were counted.
+			n, err = s.rdb.ZCard(ctx, heldKey).Result()
+			if err != nil {
+				return err
+			}
+			if n > 0 {
+				return s.rdb.SAdd(ctx, groupsWithHeldTasksKey, groupID).Err()
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		task, err := s.readTask(ctx, taskID)
+		if status.IsNotFoundError(err) {
+			// The task was cancelled or expired.
+			if err := s.setGroupTaskState(ctx, groupID, taskID, groupTaskDone); err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			if err := s.setGroupTaskState(ctx, groupID, taskID, groupTaskHeld); err != nil {
+				log.Warningf("Could not hold task %q of group %q again: %s", taskID, groupID, err)
+			}
+			return err
+		}
+		log.Infof("Releasing held task %q of group %q.", taskID, groupID)
+		enqueueRequest := &scpb.EnqueueTaskReservationRequest{
+			TaskId:             taskID,
+			TaskSize:           task.metadata.GetTaskSize(),
+			SchedulingMetadata: task.metadata,
+		}
+		opts := enqueueTaskReservationOpts{
+			numReplicas:                  probesPerTask,
+			scheduleOnConnectedExecutors: false,
+		}
+		if err := s.enqueueTaskReservations(ctx, enqueueRequest, task.serializedTask, opts); err != nil {
+			log.Warningf("Could not enqueue reservations for released task %q: %s", taskID, err)
+		}
+	}
+}
+
+func (s *SchedulerServer) releaseHeldTasksPeriodically() {
+	for {
+		select {
+		case <-s.shuttingDown:
+			return
+		case <-time.After(heldTaskReleaseInterval):
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), heldTaskReleaseTimeout)
+		groupIDs, err := s.rdb.SMembers(ctx, groupsWithHeldTasksKey).Result()
+		if err != nil {
+			log.Warningf("Could not read groups with held tasks: %s", err)
+		}
+		for _, groupID := range groupIDs {
+			if err := s.releaseHeldTasks(ctx, groupID); err != nil {
+				log.Warningf("Could not release held tasks of group %q: %s", groupID, err)
+			}
+		}
+		cancel()
+	}
+}
+
+// groupQueueFullError returns a RESOURCE_EXHAUSTED error telling the client
+// when to retry the execution.
+func groupQueueFullError(groupID string, maxQueuedTasks int64) error {
+	msg := fmt.Sprintf("Group %q has reached its limit of %d queued executions. Try again later.", groupID, maxQueuedTasks)
+	retryInfo := &errdetails.RetryInfo{RetryDelay: ptypes.DurationProto(groupQueueFullRetryDelay)}
+	st, err := gstatus.New(gcodes.ResourceExhausted, msg).WithDetails(retryInfo)
+	if err != nil {
+		return status.ResourceExhaustedError(msg)
+	}
+	return st.Err()
+}
+
+// executionUsage returns the given group's usage of executors that it doesn't
+// own, and the limits on that usage.
+func (s *SchedulerServer) executionUsage(ctx context.Context, groupID string) (*scpb.ExecutionUsage, error) {
+	counts, err := s.groupTaskCounts(ctx, groupID)
+	if err != nil {
+		return nil, err
+	}
+	limit := groupExecutionLimit(s.groupExecutionLimits, groupID)
+	return &scpb.ExecutionUsage{
+		QueuedTaskCount:    counts.queued,
+		ExecutingTaskCount: counts.executing,
+		HeldTaskCount:      counts.held,
+		MaxQueuedTasks:     limit.MaxQueuedTasks,
+		MaxExecutingTasks:  limit.MaxExecutingTasks,
 	}, nil
 }
 
@@ -1149,11 +1802,17 @@ func (s *SchedulerServer) LeaseTask(stream scpb.Scheduler_LeaseTaskServer) error
 	lastCheckin := time.Now()
 	claimed := false
 	taskID := ""
+	var taskMetadata *scpb.SchedulingMetadata
+	// When to start a speculative copy of the task, if the task is eligible
+	// and one hasn't been started yet.
+	var speculationDeadline time.Time
 
 	executorID := "unknown"
 	if p, ok := peer.FromContext(ctx); ok {
 		executorID = p.Addr.String()
 	}
+	// The ID that the executor registered with, as opposed to its address.
+	registeredExecutorID := ""
 
 	// If we've exited our event loop and the task is still claimed, then
 	// the worker did not finish properly and we should re-enqueue it.
@@ -1164,9 +1823,16 @@ func (s *SchedulerServer) LeaseTask(stream scpb.Scheduler_LeaseTaskServer) error
 		log.Warningf("LeaseTask %q exited event-loop with task still claimed. Will ReEnqueue!", taskID)
 		ctx, cancel := background.ExtendContextForFinalization(ctx, 3*time.Second)
 		defer cancel()
-		if _, err := s.ReEnqueueTask(ctx, &scpb.ReEnqueueTaskRequest{TaskId: taskID}); err != nil {
+		task, err := s.reEnqueueTask(ctx, taskID, probesPerTask, "" /*=reason*/)
+		if err != nil {
 			log.Errorf("LeaseTask %q tried to re-enqueue task but failed with err: %s", taskID, err.Error())
+			return
 		} // Success case will be logged by ReEnqueueTask flow.
+		// Losing the lease of a task that was re-enqueued, rather than
+		// cancelled, counts against the health of the leasing executor.
+		if task != nil {
+			s.recordInfraError(ctx, registeredExecutorID, executor_health.LeaseLost)
+		}
 	}()
 
 	for {
@@ -1185,6 +1851,9 @@ func (s *SchedulerServer) LeaseTask(stream scpb.Scheduler_LeaseTaskServer) error
 			return status.InvalidArgumentError("TaskId must be set and the same value for all requests")
 		}
 		taskID = req.GetTaskId()
+		if req.GetExecutorId() != "" {
+			registeredExecutorID = req.GetExecutorId()
+		}
 		if time.Since(lastCheckin) > (leaseInterval + leaseGracePeriod) {
 			log.Warningf("LeaseTask %q client went away after %s", taskID, time.Since(lastCheckin))
 			break
@@ -1193,7 +1862,7 @@ func (s *SchedulerServer) LeaseTask(stream scpb.Scheduler_LeaseTaskServer) error
 			LeaseDurationSeconds: int64(leaseInterval.Seconds()),
 		}
 		if !claimed {
-			err = s.claimTask(ctx, taskID, time.Now())
+			err = s.claimTask(ctx, taskID, registeredExecutorID, time.Now())
 			if err != nil {
 				return err
 			}
@@ -1206,6 +1875,17 @@ func (s *SchedulerServer) LeaseTask(stream scpb.Scheduler_LeaseTaskServer) error
 
 			log.Infof("LeaseTask task %q successfully claimed by executor %q", taskID, executorID)
 
+			taskMetadata = task.metadata
+			s.advanceVirtualTimes(ctx, taskID, taskMetadata)
+			if _, ok := s.executionLimit(taskMetadata); ok {
+				if err := s.setGroupTaskState(ctx, taskMetadata.GetTaskGroupId(), taskID, groupTaskExecuting); err != nil {
+					log.Warningf("Could not record task %q as executing: %s", taskID, err)
+				}
+			}
+			if delay := taskMetadata.GetSpeculativeExecutionDelayUsec(); delay > 0 && taskMetadata.GetSpeculativeCopyOfTaskId() == "" {
+				speculationDeadline = time.Now().Add(time.Duration(delay) * time.Microsecond)
+			}
+
 			key := nodePoolKey{
 				os:      task.metadata.GetOs(),
 				arch:    task.metadata.GetArch(),
@@ -1230,6 +1910,10 @@ func (s *SchedulerServer) LeaseTask(stream scpb.Scheduler_LeaseTaskServer) error
 				claimed = false
 				return status.NotFoundErrorf("task %q disappeared, possibly cancelled", req.GetTaskId())
 			}
+			if !speculationDeadline.IsZero() && time.Now().After(speculationDeadline) && !req.GetFinalize() && !req.GetRelease() {
+				speculationDeadline = time.Time{}
+				go s.startSpeculativeCopy(taskID, req.GetExecutorId())
+			}
 		}
 
 		done := req.GetFinalize() || req.GetRelease()
@@ -1238,10 +1922,19 @@ func (s *SchedulerServer) LeaseTask(stream scpb.Scheduler_LeaseTaskServer) error
 			// Finalize deletes the task (and implicitly releases the lease).
 			// It implies that no further work will/can be attempted for this task.
 
+			infraError := s.taskInfraError(ctx, taskID)
 			err := s.deleteClaimedTask(ctx, taskID)
 			if err == nil {
 				claimed = false
 				log.Infof("LeaseTask task %q successfully finalized by %q", taskID, executorID)
+				s.groupTaskDone(ctx, taskID, taskMetadata)
+				s.prioritizedTaskDone(ctx, taskID, taskMetadata)
+				if infraError != "" {
+					s.recordInfraError(ctx, registeredExecutorID, infraError)
+				} else {
+					s.recordTaskDone(ctx, registeredExecutorID)
+				}
+				s.cancelSpeculativeSibling(ctx, taskID, taskMetadata)
 			} else {
 				log.Warningf("Could not delete claimed task %q: %s", taskID, err)
 			}
@@ -1270,6 +1963,82 @@ func (s *SchedulerServer) LeaseTask(stream scpb.Scheduler_LeaseTaskServer) error
 	return nil
 }
 
+// startSpeculativeCopy starts a copy of a task that is taking much longer than
+// expected, on an executor other than the one executing the task.
+func (s *SchedulerServer) startSpeculativeCopy(taskID, executorID string) {
+	ctx, cancel := context.WithTimeout(context.Background(), speculativeCopyStartTimeout)
+	defer cancel()
+
+	task, err := s.readTask(ctx, taskID)
+	if err != nil {
+		log.Warningf("Could not read task %q to start a speculative copy: %s", taskID, err)
+		return
+	}
+	metadata := proto.Clone(task.metadata).(*scpb.SchedulingMetadata)
+	metadata.SpeculativeExecutionDelayUsec = 0
+	metadata.SpeculativeCopyOfTaskId = taskID
+	if executorID != "" {
+		metadata.ExcludedExecutorId = append(metadata.ExcludedExecutorId, executorID)
+	}
+
+	copyID := speculation.CopyTaskID(taskID)
+	log.Infof("Task %q is taking longer than expected on executor %q. Starting speculative copy %q.", taskID, executorID, copyID)
+	if err := speculation.MarkStarted(ctx, s.rdb, taskID); err != nil {
+		log.Warningf("Could not start speculative copy of task %q: %s", taskID, err)
+		return
+	}
+	if err := s.insertTask(ctx, copyID, metadata, task.serializedTask); err != nil {
+		log.Warningf("Could not start speculative copy of task %q: %s", taskID, err)
+		return
+	}
+	enqueueRequest := &scpb.EnqueueTaskReservationRequest{
+		TaskId:             copyID,
+		TaskSize:           metadata.GetTaskSize(),
+		SchedulingMetadata: metadata,
+	}
+	opts := enqueueTaskReservationOpts{
+		numReplicas:                  probesPerTask,
+		scheduleOnConnectedExecutors: false,
+	}
+	if err := s.enqueueTaskReservations(ctx, enqueueRequest, task.serializedTask, opts); err != nil {
+		log.Warningf("Could not enqueue reservations for speculative copy %q: %s", copyID, err)
+		if _, err := s.deleteTask(ctx, copyID); err != nil {
+			log.Warningf("Could not delete speculative copy %q: %s", copyID, err)
+		}
+	}
+}
+
+// cancelSpeculativeSibling cancels the other copy of a finalized task, if a
+// speculative copy of the task was started. The executor running the other
+// copy stops once it fails to renew its lease.
+func (s *SchedulerServer) cancelSpeculativeSibling(ctx context.Context, taskID string, metadata *scpb.SchedulingMetadata) {
+	siblingID := metadata.GetSpeculativeCopyOfTaskId()
+	if siblingID == "" {
+		if metadata.GetSpeculativeExecutionDelayUsec() == 0 {
+			return
+		}
+		siblingID = speculation.CopyTaskID(taskID)
+	}
+	deleted, err := s.deleteTask(ctx, siblingID)
+	if err != nil {
+		log.Warningf("Could not cancel task %q: %s", siblingID, err)
+		return
+	}
+	if !deleted {
+		return
+	}
+	log.Infof("Cancelled task %q since task %q finished first.", siblingID, taskID)
+	if metadata.GetSpeculativeCopyOfTaskId() != "" {
+		// The cancelled task is the original task, which counts against its
+		// group's execution limit, unlike its copy.
+		originalMetadata := proto.Clone(metadata).(*scpb.SchedulingMetadata)
+		originalMetadata.SpeculativeCopyOfTaskId = ""
+		originalMetadata.ExcludedExecutorId = nil
+		s.groupTaskDone(ctx, siblingID, originalMetadata)
+		s.prioritizedTaskDone(ctx, siblingID, originalMetadata)
+	}
+}
+
 func minInt(i, j int) int {
 	if i < j {
 		return i
@@ -1329,6 +2098,9 @@ func (s *SchedulerServer) enqueueTaskReservations(ctx context.Context, enqueueRe
 	// Note: preferredNode may be nil if the executor ID isn't specified or if
 	// the executor is no longer connected.
 	preferredNode := nodeBalancer.FindConnectedExecutorByID(enqueueRequest.GetExecutorId())
+	if preferredNode != nil && nodeBalancer.isQuarantined(preferredNode.GetExecutorID()) {
+		preferredNode = nil
+	}
 
 	attempts := 0
 	var nodes []*executionNode
@@ -1361,11 +2133,16 @@ func (s *SchedulerServer) enqueueTaskReservations(ctx context.Context, enqueueRe
 				if len(nodes) == 0 {
 					return status.UnavailableErrorf("No registered executors in pool %q with os %q with arch %q.", pool, os, arch)
 				}
-				rankedNodes := s.taskRouter.RankNodes(ctx, cmd, remoteInstanceName, toNodeInterfaces(nodes))
+				rankedNodes := s.taskRouter.RankNodes(ctx, cmd, remoteInstanceName, enqueueRequest.GetSchedulingMetadata().GetLocalityDigest(), toNodeInterfaces(nodes))
 				nodes, err = fromNodeInterfaces(rankedNodes)
 				if err != nil {
 					return err
 				}
+				nodes = excludeNodes(nodes, enqueueRequest.GetSchedulingMetadata().GetExcludedExecutorId())
+				nodes = excludeNodes(nodes, nodeBalancer.quarantined)
+				if len(nodes) == 0 {
+					return status.UnavailableErrorf("No eligible executors in pool %q with os %q with arch %q.", pool, os, arch)
+				}
 			}
 		}
 		if sampleIndex >= len(nodes) {
@@ -1413,6 +2190,25 @@ func (s *SchedulerServer) enqueueTaskReservations(ctx context.Context, enqueueRe
 	return nil
 }
 
+// excludeNodes returns the given nodes other than those with the given
+// executor IDs.
+func excludeNodes(nodes []*executionNode, excludedExecutorIDs []string) []*executionNode {
+	if len(excludedExecutorIDs) == 0 {
+		return nodes
+	}
+	excluded := make(map[string]struct{}, len(excludedExecutorIDs))
+	for _, id := range excludedExecutorIDs {
+		excluded[id] = struct{}{}
+	}
+	out := make([]*executionNode, 0, len(nodes))
+	for _, node := range nodes {
+		if _, ok := excluded[node.GetExecutorID()]; !ok {
+			out = append(out, node)
+		}
+	}
+	return out
+}
+
 func (s *SchedulerServer) ScheduleTask(ctx context.Context, req *scpb.ScheduleTaskRequest) (*scpb.ScheduleTaskResponse, error) {
 	if req.GetTaskId() == "" {
 		return nil, status.FailedPreconditionError("A task_id is required")
@@ -1428,9 +2224,26 @@ func (s *SchedulerServer) ScheduleTask(ctx context.Context, req *scpb.ScheduleTa
 	}
 	taskID := req.GetTaskId()
 	metadata := req.GetMetadata()
+	s.limitPriority(ctx, taskID, metadata)
+	s.assignVirtualTimes(ctx, taskID, metadata)
 	if err := s.insertTask(ctx, taskID, metadata, req.GetSerializedTask()); err != nil {
 		return nil, err
 	}
+	// The task is inserted before it is queued, so that it can be read once
+	// it is released.
+	if limit, ok := s.executionLimit(metadata); ok {
+		hold, err := s.queueGroupTask(ctx, taskID, metadata, limit)
+		if err != nil {
+			if _, err := s.deleteTask(ctx, taskID); err != nil {
+				log.Warningf("Could not delete rejected task %q: %s", taskID, err)
+			}
+			return nil, err
+		}
+		if hold {
+			// Reservations are enqueued once the task is released.
+			return &scpb.ScheduleTaskResponse{}, nil
+		}
+	}
 	enqueueRequest := &scpb.EnqueueTaskReservationRequest{
 		TaskId:             taskID,
 		TaskSize:           req.GetMetadata().GetTaskSize(),
@@ -1448,7 +2261,20 @@ func (s *SchedulerServer) ScheduleTask(ctx context.Context, req *scpb.ScheduleTa
 }
 
 func (s *SchedulerServer) CancelTask(ctx context.Context, taskID string) (bool, error) {
-	return s.deleteTask(ctx, taskID)
+	// The task's metadata is needed to record that the task is done.
+	var metadata *scpb.SchedulingMetadata
+	if task, err := s.readTask(ctx, taskID); err == nil {
+		metadata = task.metadata
+	}
+	deleted, err := s.deleteTask(ctx, taskID)
+	if err == nil && deleted && metadata != nil {
+		s.groupTaskDone(ctx, taskID, metadata)
+		s.prioritizedTaskDone(ctx, taskID, metadata)
+	}
+	if _, err := s.deleteTask(ctx, speculation.CopyTaskID(taskID)); err != nil {
+		log.Warningf("Could not delete speculative copy of task %q: %s", taskID, err)
+	}
+	return deleted, err
 }
 
 func (s *SchedulerServer) EnqueueTaskReservation(ctx context.Context, req *scpb.EnqueueTaskReservationRequest) (*scpb.EnqueueTaskReservationResponse, error) {
@@ -1465,18 +2291,29 @@ func (s *SchedulerServer) EnqueueTaskReservation(ctx context.Context, req *scpb.
 	return &scpb.EnqueueTaskReservationResponse{}, nil
 }
 
-func (s *SchedulerServer) reEnqueueTask(ctx context.Context, taskID string, numReplicas int, reason string) error {
+// reEnqueueTask enqueues reservations for a task that could not be executed,
+// and returns the task if it was re-enqueued, or nil if it was dropped instead.
+func (s *SchedulerServer) reEnqueueTask(ctx context.Context, taskID string, numReplicas int, reason string) (*persistedTask, error) {
 	if taskID == "" {
-		return status.FailedPreconditionError("A task_id is required")
+		return nil, status.FailedPreconditionError("A task_id is required")
 	}
 	task, err := s.readTask(ctx, taskID)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if task.metadata.GetSpeculativeCopyOfTaskId() != "" {
+		// The original task is still running, so there's no need to retry
+		// its speculative copy.
+		log.Infof("Dropping speculative copy %q instead of re-enqueueing it.", taskID)
+		_, err := s.deleteTask(ctx, taskID)
+		return nil, err
 	}
 	if task.attemptCount >= maxTaskAttemptCount {
 		if _, err := s.deleteTask(ctx, taskID); err != nil {
-			return err
+			return nil, err
 		}
+		s.groupTaskDone(ctx, taskID, task.metadata)
+		s.prioritizedTaskDone(ctx, taskID, task.metadata)
 		msg := fmt.Sprintf("Task %q already attempted %d times.", taskID, task.attemptCount)
 		if reason != "" {
 			msg += " Last failure: " + reason
@@ -1484,10 +2321,23 @@ func (s *SchedulerServer) reEnqueueTask(ctx context.Context, taskID string, numR
 		if err := s.env.GetRemoteExecutionService().MarkExecutionFailed(ctx, taskID, status.InternalError(msg)); err != nil {
 			log.Warningf("Could not mark execution failed for task %q: %s", taskID, err)
 		}
-		return status.ResourceExhaustedErrorf(msg)
+		return nil, status.ResourceExhaustedErrorf(msg)
 	}
 	_ = s.unclaimTask(ctx, taskID) // ignore error -- it's fine if it's already unclaimed.
 	log.Debugf("ReEnqueueTask RPC for task %q", taskID)
+	if limit, ok := s.executionLimit(task.metadata); ok {
+		// The task was already accepted, so only the executing task limit
+		// applies. The task itself isn't counted against it.
+		limit.MaxQueuedTasks = 0
+		hold, err := s.queueGroupTask(ctx, taskID, task.metadata, limit)
+		if err != nil {
+			// Don't hold a task that we could not record as held, since it
+			// would never be released.
+			log.Warningf("Could not queue task %q: %s", taskID, err)
+		} else if hold {
+			return task, nil
+		}
+	}
 	enqueueRequest := &scpb.EnqueueTaskReservationRequest{
 		TaskId:             taskID,
 		TaskSize:           task.metadata.GetTaskSize(),
@@ -1498,21 +2348,104 @@ func (s *SchedulerServer) reEnqueueTask(ctx context.Context, taskID string, numR
 		scheduleOnConnectedExecutors: false,
 	}
 	if err := s.enqueueTaskReservations(ctx, enqueueRequest, task.serializedTask, opts); err != nil {
-		return err
+		return nil, err
 	}
 	log.Debugf("ReEnqueueTask succeeded for task %q", taskID)
-	return nil
+	return task, nil
 }
 
 func (s *SchedulerServer) ReEnqueueTask(ctx context.Context, req *scpb.ReEnqueueTaskRequest) (*scpb.ReEnqueueTaskResponse, error) {
-	if err := s.reEnqueueTask(ctx, req.GetTaskId(), probesPerTask, req.GetReason()); err != nil {
+	task, err := s.reEnqueueTask(ctx, req.GetTaskId(), probesPerTask, req.GetReason())
+	if err != nil {
 		log.Errorf("ReEnqueueTask failed for task %q: %s", req.GetTaskId(), err)
 		return nil, err
 	}
+	// Executors re-enqueue tasks that they failed to execute because of an
+	// infrastructure error, which counts against the health of the executor
+	// that leased the task. Cancelled tasks, including speculative copies
+	// that lost to their sibling, are deleted rather than re-enqueued, so
+	// they don't count.
+	if task != nil && !executor_health.IsCancellation(req.GetReason()) {
+		s.recordInfraError(ctx, task.leasedBy, executor_health.Classify(req.GetReason()))
+	}
 	return &scpb.ReEnqueueTaskResponse{}, nil
 }
 
+// RecordTaskFailure records that the current attempt of a task failed with
+// the given error. Executors report such failures as the result of the task
+// rather than re-enqueueing it, so if the error is an infrastructure error, it
+// counts against the health of the executor that leased the task once the
+// executor finalizes its lease.
+func (s *SchedulerServer) RecordTaskFailure(ctx context.Context, taskID string, reason error) error {
+	if s.executorHealth == nil || reason == nil {
+		return nil
+	}
+	msg := reason.Error()
+	if executor_health.IsCancellation(msg) {
+		return nil
+	}
+	// Other errors, such as timeouts, are most likely caused by the action
+	// rather than the executor.
+	class := executor_health.Classify(msg)
+	if class == executor_health.Other {
+		return nil
+	}
+	return redisSetTaskInfraError.Run(ctx, s.rdb, []string{s.redisKeyForTask(taskID)}, string(class)).Err()
+}
+
+// taskInfraError returns the class of the infrastructure error recorded for
+// the current attempt of the task, or "" if there is none.
+func (s *SchedulerServer) taskInfraError(ctx context.Context, taskID string) executor_health.Class {
+	if s.executorHealth == nil {
+		return ""
+	}
+	class, err := s.rdb.HGet(ctx, s.redisKeyForTask(taskID), redisTaskInfraErrorField).Result()
+	if err != nil && err != redis.Nil {
+		log.Warningf("Could not read infrastructure error of task %q: %s", taskID, err)
+	}
+	return executor_health.Class(class)
+}
+
+// recordTaskDone records that the executor with the given ID finished a task,
+// if executor health is tracked.
+func (s *SchedulerServer) recordTaskDone(ctx context.Context, executorID string) {
+	if s.executorHealth == nil || executorID == "" {
+		return
+	}
+	if err := s.executorHealth.RecordTaskDone(ctx, executorID); err != nil {
+		log.Warningf("Could not record task done on executor %q: %s", executorID, err)
+	}
+}
+
+// recordInfraError records that a task failed on the executor with the given
+// ID because of an infrastructure error, if executor health is tracked.
+func (s *SchedulerServer) recordInfraError(ctx context.Context, executorID string, class executor_health.Class) {
+	if s.executorHealth == nil || executorID == "" {
+		return
+	}
+	quarantined, err := s.executorHealth.RecordInfraError(ctx, executorID, class)
+	if err != nil {
+		log.Warningf("Could not record %s error on executor %q: %s", class, executorID, err)
+		return
+	}
+	if quarantined {
+		log.Warningf("Quarantined executor %q after too many infrastructure errors, most recently %s.", executorID, class)
+	}
+}
+
 func (s *SchedulerServer) getExecutionNodesFromRedis(ctx context.Context, groupID string) ([]*scpb.ExecutionNode, error) {
+	registeredNodes, err := s.getRegisteredExecutionNodesFromRedis(ctx, groupID)
+	if err != nil {
+		return nil, err
+	}
+	executionNodes := make([]*scpb.ExecutionNode, 0, len(registeredNodes))
+	for _, registeredNode := range registeredNodes {
+		executionNodes = append(executionNodes, registeredNode.GetRegistration())
+	}
+	return executionNodes, nil
+}
+
+func (s *SchedulerServer) getRegisteredExecutionNodesFromRedis(ctx context.Context, groupID string) ([]*scpb.RegisteredExecutionNode, error) {
 	user, err := perms.AuthenticatedUser(ctx, s.env)
 	if err != nil {
 		return nil, err
@@ -1523,7 +2456,7 @@ func (s *SchedulerServer) getExecutionNodesFromRedis(ctx context.Context, groupI
 	if err != nil {
 		return nil, err
 	}
-	var executionNodes []*scpb.ExecutionNode
+	var executionNodes []*scpb.RegisteredExecutionNode
 	for _, k := range poolKeys {
 		executors, err := s.rdb.HGetAll(ctx, k).Result()
 		if err != nil {
@@ -1539,7 +2472,7 @@ func (s *SchedulerServer) getExecutionNodesFromRedis(ctx context.Context, groupI
 			if err != nil {
 				continue
 			}
-			executionNodes = append(executionNodes, registeredNode.GetRegistration())
+			executionNodes = append(executionNodes, registeredNode)
 		}
 	}
 	return executionNodes, nil
@@ -1587,14 +2520,268 @@ func (s *SchedulerServer) GetExecutionNodes(ctx context.Context, req *scpb.GetEx
 				(s.enableUserOwnedExecutors &&
 					(useGroupOwnedExecutors || (s.forceUserOwnedDarwinExecutors && isDarwinExecutor))),
 		}
+		if s.executorHealth != nil {
+			h, err := s.executorHealth.Health(ctx, node.GetExecutorId())
+			if err != nil {
+				return nil, err
+			}
+			executors[i].Health = healthToProto(h)
+		}
+	}
+
+	var executionUsage *scpb.ExecutionUsage
+	if len(s.groupExecutionLimits) > 0 {
+		executionUsage, err = s.executionUsage(ctx, u.GetGroupID())
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	return &scpb.GetExecutionNodesResponse{
 		Executor:                    executors,
 		UserOwnedExecutorsSupported: userOwnedExecutorsEnabled,
+		ExecutionUsage:              executionUsage,
 	}, nil
 }
 
+func healthToProto(h *executor_health.Health) *scpb.ExecutorHealth {
+	hp := &scpb.ExecutorHealth{
+		TaskCount:               h.TaskCount,
+		InfraErrorCount:         h.InfraErrorCount,
+		InfraErrorCountsByClass: make(map[string]int64, len(h.InfraErrorsByClass)),
+		Quarantined:             h.Quarantined,
+		QuarantineReason:        h.QuarantineReason,
+	}
+	for class, n := range h.InfraErrorsByClass {
+		hp.InfraErrorCountsByClass[string(class)] = n
+	}
+	if h.Quarantined {
+		hp.QuarantinedAtUsec = h.QuarantinedAt.UnixMicro()
+	}
+	return hp
+}
+
+// authorizeUnquarantine checks that the user may un-quarantine the given
+// executor. Server admins may un-quarantine any executor; otherwise the user
+// must be an admin of the group that owns the executor. Executors that don't
+// belong to any group are shared by all groups, so only server admins may
+// un-quarantine them.
+func (s *SchedulerServer) authorizeUnquarantine(user interfaces.UserInfo, node *scpb.RegisteredExecutionNode) error {
+	if adminGroupID := s.env.GetConfigurator().GetAuthAdminGroupID(); adminGroupID != "" {
+		if err := authutil.AuthorizeGroupRole(user, adminGroupID, role.Admin); err == nil {
+			return nil
+		}
+	}
+	if node.GetGroupId() == "" {
+		return status.PermissionDeniedError("Only server admins can un-quarantine shared executors")
+	}
+	return authutil.AuthorizeGroupRole(user, node.GetGroupId(), role.Admin)
+}
+
+// UnquarantineExecutor lets the scheduler send tasks to a quarantined executor
+// again. The executor must be visible to the requesting group, and the user
+// must be a server admin or an admin of the group that owns the executor.
+func (s *SchedulerServer) UnquarantineExecutor(ctx context.Context, req *scpb.UnquarantineExecutorRequest) (*scpb.UnquarantineExecutorResponse, error) {
+	if s.executorHealth == nil {
+		return nil, status.UnimplementedError("Executor health is not tracked")
+	}
+	groupID := req.GetRequestContext().GetGroupId()
+	if groupID == "" {
+		return nil, status.InvalidArgumentError("group not specified")
+	}
+	if req.GetExecutorId() == "" {
+		return nil, status.InvalidArgumentError("executor_id not specified")
+	}
+	user, err := perms.AuthenticatedUser(ctx, s.env)
+	if err != nil {
+		return nil, err
+	}
+	// As in GetExecutionNodes.
+	if !s.requireExecutorAuthorization {
+		groupID = ""
+	}
+	registeredNodes, err := s.getRegisteredExecutionNodesFromRedis(ctx, groupID)
+	if err != nil {
+		return nil, err
+	}
+	var node *scpb.RegisteredExecutionNode
+	for _, n := range registeredNodes {
+		if n.GetRegistration().GetExecutorId() == req.GetExecutorId() {
+			node = n
+			break
+		}
+	}
+	if node == nil {
+		return nil, status.NotFoundErrorf("executor %q not found", req.GetExecutorId())
+	}
+	if err := s.authorizeUnquarantine(user, node); err != nil {
+		return nil, err
+	}
+	quarantined, err := s.executorHealth.Unquarantine(ctx, req.GetExecutorId())
+	if err != nil {
+		return nil, err
+	}
+	if !quarantined {
+		return nil, status.FailedPreconditionErrorf("executor %q is not quarantined", req.GetExecutorId())
+	}
+	log.Infof("Executor %q was un-quarantined.", req.GetExecutorId())
+	return &scpb.UnquarantineExecutorResponse{}, nil
+}
+
+// poolAutoscalingSignals returns the demand for and capacity of the given pool.
+// The given executor resources are used to compute the recommended executor
+// count if no executor is registered in the pool.
+func (s *SchedulerServer) poolAutoscalingSignals(ctx context.Context, key nodePoolKey, executorMemoryBytes, executorMilliCPU int64) (*scpb.GetAutoscalingSignalsResponse, error) {
+	rsp := &scpb.GetAutoscalingSignalsResponse{}
+
+	nodes, err := newNodePool(s.env, key, s.executorHealth).fetchExecutionNodes(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, node := range nodes {
+		rsp.ExecutorCount++
+		rsp.CapacityMemoryBytes += node.assignableMemoryBytes
+		rsp.CapacityMilliCpu += node.assignableMilliCpu
+	}
+
+	taskIDs, err := s.rdb.ZRange(ctx, key.redisUnclaimedTasksKey(), 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	pipe := s.rdb.Pipeline()
+	cmds := make([]*redis.SliceCmd, 0, len(taskIDs))
+	for _, taskID := range taskIDs {
+		cmds = append(cmds, pipe.HMGet(ctx, s.redisKeyForTask(taskID), redisTaskMetadataField, redisTaskClaimedField))
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+	for _, cmd := range cmds {
+		vals := cmd.Val()
+		serializedMetadata, ok := vals[0].(string)
+		if !ok || vals[1] != nil {
+			// The task completed, was cancelled or was just claimed.
+			continue
+		}
+		metadata := &scpb.SchedulingMetadata{}
+		if err := proto.Unmarshal([]byte(serializedMetadata), metadata); err != nil {
+			log.Warningf("Could not unmarshal scheduling metadata: %s", err)
+			continue
+		}
+		rsp.PendingTaskCount++
+		rsp.PendingMemoryBytes += metadata.GetTaskSize().GetEstimatedMemoryBytes()
+		rsp.PendingMilliCpu += metadata.GetTaskSize().GetEstimatedMilliCpu()
+	}
+
+	rsp.RecommendedExecutorCount = recommendedExecutorCount(rsp, executorMemoryBytes, executorMilliCPU)
+	return rsp, nil
+}
+
+// recommendedExecutorCount returns the number of executors needed to start
+// all pending tasks right away.
+func recommendedExecutorCount(signals *scpb.GetAutoscalingSignalsResponse, executorMemoryBytes, executorMilliCPU int64) int64 {
+	if signals.GetPendingTaskCount() == 0 {
+		return signals.GetExecutorCount()
+	}
+	if n := signals.GetExecutorCount(); n > 0 {
+		executorMemoryBytes = signals.GetCapacityMemoryBytes() / n
+		executorMilliCPU = signals.GetCapacityMilliCpu() / n
+	}
+	// Executors only assign part of their resources to tasks.
+	executorMemoryBytes = int64(float64(executorMemoryBytes) * tasksize.MaxResourceCapacityRatio)
+	executorMilliCPU = int64(float64(executorMilliCPU) * tasksize.MaxResourceCapacityRatio)
+
+	// Without any information about the size of executors, ask for one more
+	// executor at a time.
+	missing := int64(1)
+	if executorMemoryBytes > 0 {
+		missing = maxInt64(missing, ceilDiv(signals.GetPendingMemoryBytes(), executorMemoryBytes))
+	}
+	if executorMilliCPU > 0 {
+		missing = maxInt64(missing, ceilDiv(signals.GetPendingMilliCpu(), executorMilliCPU))
+	}
+	return signals.GetExecutorCount() + missing
+}
+
+func ceilDiv(a, b int64) int64 {
+	return (a + b - 1) / b
+}
+
+func maxInt64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func (s *SchedulerServer) GetAutoscalingSignals(ctx context.Context, req *scpb.GetAutoscalingSignalsRequest) (*scpb.GetAutoscalingSignalsResponse, error) {
+	user, err := perms.AuthenticatedUser(ctx, s.env)
+	if err != nil {
+		return nil, err
+	}
+	key := nodePoolKey{
+		os:   strings.ToLower(req.GetOs()),
+		arch: strings.ToLower(req.GetArch()),
+		pool: req.GetPool(),
+	}
+	if key.os == "" {
+		key.os = platform.LinuxOperatingSystemName
+	}
+	if key.arch == "" {
+		key.arch = platform.DefaultCPUArchitecture
+	}
+	sharedExecutorPoolGroupID := s.env.GetConfigurator().GetRemoteExecutionConfig().SharedExecutorPoolGroupID
+	if s.enableUserOwnedExecutors {
+		key.groupID = user.GetGroupID()
+	}
+	if key.pool == "" && (!s.enableUserOwnedExecutors || key.groupID == sharedExecutorPoolGroupID) {
+		key.pool = s.env.GetConfigurator().GetRemoteExecutionConfig().DefaultPoolName
+	}
+	return s.poolAutoscalingSignals(ctx, key, req.GetExecutorMemoryBytes(), req.GetExecutorMilliCpu())
+}
+
+// updateAutoscalingMetrics periodically exports the autoscaling signals of the
+// pools known to this scheduler as metrics, until the server shuts down.
+func (s *SchedulerServer) updateAutoscalingMetrics() {
+	for {
+		select {
+		case <-s.shuttingDown:
+			return
+		case <-time.After(autoscalingMetricsUpdateInterval):
+		}
+
+		s.mu.RLock()
+		keys := make([]nodePoolKey, 0, len(s.pools))
+		for key := range s.pools {
+			keys = append(keys, key)
+		}
+		s.mu.RUnlock()
+
+		for _, key := range keys {
+			ctx, cancel := context.WithTimeout(context.Background(), autoscalingSignalsTimeout)
+			signals, err := s.poolAutoscalingSignals(ctx, key, 0, 0)
+			cancel()
+			if err != nil {
+				log.Warningf("Could not compute autoscaling signals of pool %+v: %s", key, err)
+				continue
+			}
+			labels := prometheus.Labels{
+				metrics.GroupID:      key.groupID,
+				metrics.OS:           key.os,
+				metrics.Arch:         key.arch,
+				metrics.ExecutorPool: key.pool,
+			}
+			metrics.RemoteExecutionPoolPendingTasks.With(labels).Set(float64(signals.GetPendingTaskCount()))
+			metrics.RemoteExecutionPoolPendingMemoryBytes.With(labels).Set(float64(signals.GetPendingMemoryBytes()))
+			metrics.RemoteExecutionPoolPendingMilliCPU.With(labels).Set(float64(signals.GetPendingMilliCpu()))
+			metrics.RemoteExecutionPoolExecutors.With(labels).Set(float64(signals.GetExecutorCount()))
+			metrics.RemoteExecutionPoolCapacityMemoryBytes.With(labels).Set(float64(signals.GetCapacityMemoryBytes()))
+			metrics.RemoteExecutionPoolCapacityMilliCPU.With(labels).Set(float64(signals.GetCapacityMilliCpu()))
+			metrics.RemoteExecutionPoolRecommendedExecutors.With(labels).Set(float64(signals.GetRecommendedExecutorCount()))
+		}
+	}
+}
+
 // extractRoutingProps deserializes the given task and returns the properties
 // needed to route the task (command and remote instance name).
 func extractRoutingProps(serializedTask []byte) (*repb.Command, string, error) {
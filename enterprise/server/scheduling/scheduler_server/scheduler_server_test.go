@@ -2,13 +2,31 @@ package scheduler_server
 
 import (
 	"context"
+	"fmt"
 	"testing"
+	"time"
 
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/scheduling/executor_health"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/testutil/enterprise_testenv"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/testutil/testredis"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/util/redisutil"
+	"github.com/buildbuddy-io/buildbuddy/server/config"
 	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
 	"github.com/buildbuddy-io/buildbuddy/server/testutil/testauth"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testenv"
+	"github.com/buildbuddy-io/buildbuddy/server/util/perms"
+	"github.com/buildbuddy-io/buildbuddy/server/util/role"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/buildbuddy-io/buildbuddy/server/util/testing/flags"
+	"github.com/go-redis/redis/v8"
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
 
+	ctxpb "github.com/buildbuddy-io/buildbuddy/proto/context"
+	scpb "github.com/buildbuddy-io/buildbuddy/proto/scheduler"
 	"github.com/stretchr/testify/require"
+
+	gstatus "google.golang.org/grpc/status"
 )
 
 func getScheduleServer(t *testing.T, userOwnedEnabled, groupOwnedEnabled bool, user string) (*SchedulerServer, context.Context) {
@@ -116,3 +134,475 @@ func TestSchedulerServerGetGroupIDAndDefaultPoolForUserSelfHostedByDefault(t *te
 	require.Equal(t, "group1", g)
 	require.Equal(t, "", p)
 }
+
+func TestGetAutoscalingSignals(t *testing.T) {
+	s, ctx := getScheduleServer(t, true, false, "user1")
+	rdb := redis.NewClient(redisutil.TargetToOptions(testredis.Start(t).Target))
+	s.env.(*testenv.TestEnv).SetRemoteExecutionRedisClient(rdb)
+	s.rdb = rdb
+	key := nodePoolKey{groupID: "group1", os: "linux", arch: "amd64", pool: ""}
+
+	// Register 2 executors.
+	for _, id := range []string{"executor1", "executor2"} {
+		b, err := proto.Marshal(&scpb.RegisteredExecutionNode{
+			Registration: &scpb.ExecutionNode{
+				ExecutorId:            id,
+				AssignableMemoryBytes: 10e9,
+				AssignableMilliCpu:    4000,
+			},
+		})
+		require.NoError(t, err)
+		err = rdb.HSet(ctx, key.redisPoolKey(), id, b).Err()
+		require.NoError(t, err)
+	}
+
+	// Queue 3 tasks, one of which is claimed, and a task that no longer exists.
+	np := newNodePool(s.env, key, nil /*=health*/)
+	metadata := &scpb.SchedulingMetadata{TaskSize: &scpb.TaskSize{EstimatedMemoryBytes: 4e9, EstimatedMilliCpu: 1000}}
+	for _, id := range []string{"task1", "task2", "task3"} {
+		err := s.insertTask(ctx, id, metadata, []byte("task"))
+		require.NoError(t, err)
+		err = np.AddUnclaimedTask(ctx, id)
+		require.NoError(t, err)
+	}
+	err := s.claimTask(ctx, "task3", "executor1", time.Now())
+	require.NoError(t, err)
+	err = np.AddUnclaimedTask(ctx, "deletedTask")
+	require.NoError(t, err)
+
+	rsp, err := s.GetAutoscalingSignals(ctx, &scpb.GetAutoscalingSignalsRequest{})
+	require.NoError(t, err)
+
+	require.Equal(t, int64(2), rsp.GetPendingTaskCount())
+	require.Equal(t, int64(8e9), rsp.GetPendingMemoryBytes())
+	require.Equal(t, int64(2000), rsp.GetPendingMilliCpu())
+	require.Equal(t, int64(2), rsp.GetExecutorCount())
+	require.Equal(t, int64(20e9), rsp.GetCapacityMemoryBytes())
+	require.Equal(t, int64(8000), rsp.GetCapacityMilliCpu())
+	// Each executor can fit 8GB of tasks, so one more executor is needed.
+	require.Equal(t, int64(3), rsp.GetRecommendedExecutorCount())
+}
+
+func TestRecommendedExecutorCount(t *testing.T) {
+	for _, testCase := range []struct {
+		name                string
+		signals             *scpb.GetAutoscalingSignalsResponse
+		executorMemoryBytes int64
+		executorMilliCPU    int64
+		expected            int64
+	}{
+		{
+			name:     "no pending tasks",
+			signals:  &scpb.GetAutoscalingSignalsResponse{ExecutorCount: 5, CapacityMemoryBytes: 50e9, CapacityMilliCpu: 20000},
+			expected: 5,
+		},
+		{
+			name:     "CPU bound",
+			signals:  &scpb.GetAutoscalingSignalsResponse{PendingTaskCount: 10, PendingMemoryBytes: 1e9, PendingMilliCpu: 10000, ExecutorCount: 2, CapacityMemoryBytes: 20e9, CapacityMilliCpu: 8000},
+			expected: 2 + 4,
+		},
+		{
+			name:                "scaled to zero",
+			signals:             &scpb.GetAutoscalingSignalsResponse{PendingTaskCount: 10, PendingMemoryBytes: 20e9, PendingMilliCpu: 1000},
+			executorMemoryBytes: 10e9,
+			executorMilliCPU:    4000,
+			expected:            3,
+		},
+		{
+			name:     "scaled to zero without executor size",
+			signals:  &scpb.GetAutoscalingSignalsResponse{PendingTaskCount: 10, PendingMemoryBytes: 20e9, PendingMilliCpu: 1000},
+			expected: 1,
+		},
+	} {
+		actual := recommendedExecutorCount(testCase.signals, testCase.executorMemoryBytes, testCase.executorMilliCPU)
+		require.Equal(t, testCase.expected, actual, testCase.name)
+	}
+}
+
+func TestGroupExecutionLimit(t *testing.T) {
+	limits := []config.GroupExecutionLimit{
+		{GroupID: "group1", MaxQueuedTasks: 10},
+		{MaxQueuedTasks: 20, MaxExecutingTasks: 5},
+		{MaxQueuedTasks: 30},
+	}
+	require.Equal(t, int64(10), groupExecutionLimit(limits, "group1").MaxQueuedTasks)
+	require.Equal(t, int64(0), groupExecutionLimit(limits, "group1").MaxExecutingTasks)
+	require.Equal(t, int64(20), groupExecutionLimit(limits, "group2").MaxQueuedTasks)
+	require.Equal(t, int64(5), groupExecutionLimit(limits, "group2").MaxExecutingTasks)
+	require.Equal(t, config.GroupExecutionLimit{}, groupExecutionLimit(limits[:1], "group2"))
+}
+
+func TestScheduleTask_GroupExecutionLimits(t *testing.T) {
+	s, ctx := getScheduleServer(t, true, false, "user1")
+	rdb := redis.NewClient(redisutil.TargetToOptions(testredis.Start(t).Target))
+	s.env.(*testenv.TestEnv).SetRemoteExecutionRedisClient(rdb)
+	s.rdb = rdb
+	s.pools = make(map[nodePoolKey]*nodePool)
+	s.groupExecutionLimits = []config.GroupExecutionLimit{
+		{GroupID: "group2", MaxQueuedTasks: 2, MaxExecutingTasks: 1},
+	}
+	scheduleTask := func(taskID string) error {
+		_, err := s.ScheduleTask(ctx, &scpb.ScheduleTaskRequest{
+			TaskId: taskID,
+			Metadata: &scpb.SchedulingMetadata{
+				TaskSize:        &scpb.TaskSize{},
+				TaskGroupId:     "group2",
+				ExecutorGroupId: "sharedGroupID",
+			},
+			SerializedTask: []byte("task"),
+		})
+		return err
+	}
+
+	// With a task executing, new tasks are held back rather than sent to
+	// executors.
+	err := s.setGroupTaskState(ctx, "group2", "task0", groupTaskExecuting)
+	require.NoError(t, err)
+	require.NoError(t, scheduleTask("task1"))
+	require.NoError(t, scheduleTask("task2"))
+
+	// The queue is now full.
+	err = scheduleTask("task3")
+	require.True(t, status.IsResourceExhaustedError(err), "expected ResourceExhausted, got %v", err)
+	details := gstatus.Convert(err).Details()
+	require.Len(t, details, 1)
+	require.IsType(t, &errdetails.RetryInfo{}, details[0])
+
+	usage, err := s.executionUsage(ctx, "group2")
+	require.NoError(t, err)
+	require.Equal(t, int64(2), usage.GetQueuedTaskCount())
+	require.Equal(t, int64(2), usage.GetHeldTaskCount())
+	require.Equal(t, int64(1), usage.GetExecutingTaskCount())
+	require.Equal(t, int64(2), usage.GetMaxQueuedTasks())
+	require.Equal(t, int64(1), usage.GetMaxExecutingTasks())
+
+	// Once the executing task completes, one held task is released.
+	err = s.setGroupTaskState(ctx, "group2", "task0", groupTaskDone)
+	require.NoError(t, err)
+	err = s.releaseHeldTasks(ctx, "group2")
+	require.NoError(t, err)
+
+	usage, err = s.executionUsage(ctx, "group2")
+	require.NoError(t, err)
+	require.Equal(t, int64(2), usage.GetQueuedTaskCount())
+	require.Equal(t, int64(1), usage.GetHeldTaskCount())
+	require.Equal(t, int64(0), usage.GetExecutingTaskCount())
+}
+
+func TestScheduleTask_GroupExecutionLimitsConcurrent(t *testing.T) {
+	s, ctx := getScheduleServer(t, true, false, "user1")
+	rdb := redis.NewClient(redisutil.TargetToOptions(testredis.Start(t).Target))
+	s.env.(*testenv.TestEnv).SetRemoteExecutionRedisClient(rdb)
+	s.rdb = rdb
+	s.pools = make(map[nodePoolKey]*nodePool)
+	s.groupExecutionLimits = []config.GroupExecutionLimit{
+		{GroupID: "group2", MaxQueuedTasks: 3, MaxExecutingTasks: 1},
+	}
+	err := s.setGroupTaskState(ctx, "group2", "task0", groupTaskExecuting)
+	require.NoError(t, err)
+
+	// Schedulers racing to queue tasks can't exceed the queued task limit.
+	errs := make(chan error, 10)
+	for i := 1; i <= cap(errs); i++ {
+		taskID := fmt.Sprintf("task%d", i)
+		go func() {
+			_, err := s.ScheduleTask(ctx, &scpb.ScheduleTaskRequest{
+				TaskId: taskID,
+				Metadata: &scpb.SchedulingMetadata{
+					TaskSize:        &scpb.TaskSize{},
+					TaskGroupId:     "group2",
+					ExecutorGroupId: "sharedGroupID",
+				},
+				SerializedTask: []byte("task"),
+			})
+			errs <- err
+		}()
+	}
+	accepted := 0
+	for i := 0; i < cap(errs); i++ {
+		err := <-errs
+		if err == nil {
+			accepted++
+			continue
+		}
+		require.True(t, status.IsResourceExhaustedError(err), "expected ResourceExhausted, got %v", err)
+	}
+	require.Equal(t, 3, accepted)
+
+	// Schedulers racing to release held tasks can't exceed the executing
+	// task limit.
+	err = s.setGroupTaskState(ctx, "group2", "task0", groupTaskDone)
+	require.NoError(t, err)
+	done := make(chan error, 3)
+	for i := 0; i < cap(done); i++ {
+		go func() {
+			done <- s.releaseHeldTasks(ctx, "group2")
+		}()
+	}
+	for i := 0; i < cap(done); i++ {
+		require.NoError(t, <-done)
+	}
+
+	usage, err := s.executionUsage(ctx, "group2")
+	require.NoError(t, err)
+	require.Equal(t, int64(3), usage.GetQueuedTaskCount())
+	require.Equal(t, int64(2), usage.GetHeldTaskCount())
+}
+
+func TestLimitPriority(t *testing.T) {
+	s, ctx := getScheduleServer(t, true, false, "user1")
+	rdb := redis.NewClient(redisutil.TargetToOptions(testredis.Start(t).Target))
+	s.rdb = rdb
+	s.maxPrioritizedTasksPerGroup = 2
+	limitPriority := func(taskID, groupID string) int32 {
+		metadata := &scpb.SchedulingMetadata{TaskGroupId: groupID, Priority: -1}
+		s.limitPriority(ctx, taskID, metadata)
+		return metadata.GetPriority()
+	}
+
+	require.Equal(t, int32(-1), limitPriority("task1", "group1"))
+	require.Equal(t, int32(-1), limitPriority("task2", "group1"))
+	// The group has the maximum number of prioritized tasks, so further
+	// tasks get the default priority.
+	require.Equal(t, int32(0), limitPriority("task3", "group1"))
+	// Scheduling the same task again doesn't count against the limit.
+	require.Equal(t, int32(-1), limitPriority("task1", "group1"))
+	// The limit applies to each group separately.
+	require.Equal(t, int32(-1), limitPriority("task4", "group2"))
+
+	// Finishing a prioritized task makes room for another one.
+	s.prioritizedTaskDone(ctx, "task1", &scpb.SchedulingMetadata{TaskGroupId: "group1", Priority: -1})
+	require.Equal(t, int32(-1), limitPriority("task5", "group1"))
+	require.Equal(t, int32(0), limitPriority("task6", "group1"))
+}
+
+func TestAssignVirtualTimes(t *testing.T) {
+	s, ctx := getScheduleServer(t, true, false, "user1")
+	rdb := redis.NewClient(redisutil.TargetToOptions(testredis.Start(t).Target))
+	s.rdb = rdb
+	schedule := func(taskID, groupID, invocationID string, groupWeight float64) *scpb.SchedulingMetadata {
+		metadata := &scpb.SchedulingMetadata{TaskGroupId: groupID, TaskInvocationId: invocationID, GroupWeight: groupWeight}
+		s.assignVirtualTimes(ctx, taskID, metadata)
+		return metadata
+	}
+	requireVirtualTimes := func(metadata *scpb.SchedulingMetadata, groupTime, invocationTime float64) {
+		require.Equal(t, groupTime, metadata.GetGroupVirtualTime(), "group virtual time")
+		require.Equal(t, invocationTime, metadata.GetInvocationVirtualTime(), "invocation virtual time")
+	}
+
+	// An invocation that fans out gets increasingly later virtual times.
+	requireVirtualTimes(schedule("task1", "group1", "inv1", 0), 0, 0)
+	requireVirtualTimes(schedule("task2", "group1", "inv1", 0), 1, 1)
+	task3 := schedule("task3", "group1", "inv1", 0)
+	requireVirtualTimes(task3, 2, 2)
+	// Other invocations of the group, and other groups, start at the
+	// current virtual time, so they are served first.
+	requireVirtualTimes(schedule("task4", "group1", "inv2", 0), 3, 0)
+	requireVirtualTimes(schedule("task5", "group2", "inv3", 2), 0, 0)
+	requireVirtualTimes(schedule("task6", "group2", "inv3", 2), 0.5, 1)
+
+	// Once a task is leased, groups and invocations without queued tasks
+	// start at its virtual time, rather than being served exclusively until
+	// they catch up.
+	s.advanceVirtualTimes(ctx, "task3", task3)
+	requireVirtualTimes(schedule("task7", "group3", "inv4", 0), 2, 0)
+	requireVirtualTimes(schedule("task8", "group1", "inv5", 0), 4, 2)
+	// Virtual times never go back.
+	s.advanceVirtualTimes(ctx, "task1", &scpb.SchedulingMetadata{TaskGroupId: "group1"})
+	requireVirtualTimes(schedule("task9", "group4", "inv6", 0), 2, 0)
+}
+
+func TestReEnqueueTask_RecordsInfraErrorOfLeasingExecutor(t *testing.T) {
+	s, ctx := getScheduleServer(t, true, false, "user1")
+	rdb := redis.NewClient(redisutil.TargetToOptions(testredis.Start(t).Target))
+	s.env.(*testenv.TestEnv).SetRemoteExecutionRedisClient(rdb)
+	s.rdb = rdb
+	s.pools = make(map[nodePoolKey]*nodePool)
+	s.executorHealth = executor_health.NewTracker(rdb, executor_health.Options{MaxInfraErrorRate: 0.5})
+	// Re-enqueued tasks are held back, so that no executors are needed.
+	s.groupExecutionLimits = []config.GroupExecutionLimit{{MaxExecutingTasks: 1}}
+	err := s.setGroupTaskState(ctx, "group2", "task0", groupTaskExecuting)
+	require.NoError(t, err)
+	metadata := &scpb.SchedulingMetadata{
+		TaskSize:        &scpb.TaskSize{},
+		TaskGroupId:     "group2",
+		ExecutorGroupId: "sharedGroupID",
+	}
+	infraErrors := func(executorID string) int64 {
+		h, err := s.executorHealth.Health(ctx, executorID)
+		require.NoError(t, err)
+		return h.InfraErrorCount
+	}
+
+	// The error counts against the executor that leased the task, not the
+	// one named in the request.
+	err = s.insertTask(ctx, "task1", metadata, []byte("task"))
+	require.NoError(t, err)
+	err = s.claimTask(ctx, "task1", "executor1", time.Now())
+	require.NoError(t, err)
+	_, err = s.ReEnqueueTask(ctx, &scpb.ReEnqueueTaskRequest{TaskId: "task1", ExecutorId: "executor2", Reason: "no space left on device"})
+	require.NoError(t, err)
+	require.Equal(t, int64(1), infraErrors("executor1"))
+	require.Equal(t, int64(0), infraErrors("executor2"))
+
+	// Cancellations don't count.
+	err = s.claimTask(ctx, "task1", "executor1", time.Now())
+	require.NoError(t, err)
+	_, err = s.ReEnqueueTask(ctx, &scpb.ReEnqueueTaskRequest{TaskId: "task1", Reason: "context canceled"})
+	require.NoError(t, err)
+	_, err = s.CancelTask(ctx, "task1")
+	require.NoError(t, err)
+	_, err = s.ReEnqueueTask(ctx, &scpb.ReEnqueueTaskRequest{TaskId: "task1", Reason: "no space left on device"})
+	require.True(t, status.IsNotFoundError(err), "expected NotFound, got %v", err)
+	require.Equal(t, int64(1), infraErrors("executor1"))
+}
+
+func TestExcludeNodes(t *testing.T) {
+	nodes := []*executionNode{
+		{executorID: "executor1"},
+		{executorID: "executor2"},
+		{executorID: "executor3"},
+	}
+	require.Equal(t, nodes, excludeNodes(nodes, nil))
+	require.Equal(t, []*executionNode{nodes[0], nodes[2]}, excludeNodes(nodes, []string{"executor2"}))
+	require.Empty(t, excludeNodes(nodes, []string{"executor1", "executor2", "executor3"}))
+}
+
+func TestNodePool_Quarantine(t *testing.T) {
+	s, ctx := getScheduleServer(t, true, false, "user1")
+	rdb := redis.NewClient(redisutil.TargetToOptions(testredis.Start(t).Target))
+	s.env.(*testenv.TestEnv).SetRemoteExecutionRedisClient(rdb)
+	key := nodePoolKey{groupID: "group1", os: "linux", arch: "amd64", pool: ""}
+	for _, id := range []string{"executor1", "executor2"} {
+		b, err := proto.Marshal(&scpb.RegisteredExecutionNode{
+			Registration: &scpb.ExecutionNode{ExecutorId: id},
+		})
+		require.NoError(t, err)
+		err = rdb.HSet(ctx, key.redisPoolKey(), id, b).Err()
+		require.NoError(t, err)
+	}
+	health := executor_health.NewTracker(rdb, executor_health.Options{MaxInfraErrorRate: 0.5, MinTasks: 1})
+	quarantine := func(id string) {
+		quarantined, err := health.RecordInfraError(ctx, id, executor_health.Disk)
+		require.NoError(t, err)
+		require.True(t, quarantined)
+	}
+
+	quarantine("executor1")
+	np := newNodePool(s.env, key, health)
+	require.NoError(t, np.RefreshNodes(ctx))
+	require.Equal(t, []string{"executor1"}, np.quarantined)
+	require.True(t, np.isQuarantined("executor1"))
+	require.False(t, np.isQuarantined("executor2"))
+
+	// The quarantine is ignored if all executors are quarantined.
+	quarantine("executor2")
+	np = newNodePool(s.env, key, health)
+	require.NoError(t, np.RefreshNodes(ctx))
+	require.Empty(t, np.quarantined)
+}
+
+func TestRecordTaskFailure(t *testing.T) {
+	s, ctx := getScheduleServer(t, true, false, "user1")
+	rdb := redis.NewClient(redisutil.TargetToOptions(testredis.Start(t).Target))
+	s.env.(*testenv.TestEnv).SetRemoteExecutionRedisClient(rdb)
+	s.rdb = rdb
+	s.executorHealth = executor_health.NewTracker(rdb, executor_health.Options{MaxInfraErrorRate: 0.5})
+	metadata := &scpb.SchedulingMetadata{TaskSize: &scpb.TaskSize{}, TaskGroupId: "group2"}
+	err := s.insertTask(ctx, "task1", metadata, []byte("task"))
+	require.NoError(t, err)
+
+	// Failures are only recorded while the task is leased.
+	err = s.RecordTaskFailure(ctx, "task1", status.UnavailableError("failed to pull image"))
+	require.NoError(t, err)
+	require.Equal(t, executor_health.Class(""), s.taskInfraError(ctx, "task1"))
+
+	err = s.claimTask(ctx, "task1", "executor1", time.Now())
+	require.NoError(t, err)
+	// Errors that are most likely caused by the action don't count.
+	err = s.RecordTaskFailure(ctx, "task1", status.DeadlineExceededError("deadline exceeded"))
+	require.NoError(t, err)
+	require.Equal(t, executor_health.Class(""), s.taskInfraError(ctx, "task1"))
+	err = s.RecordTaskFailure(ctx, "task1", status.UnavailableError("failed to pull image"))
+	require.NoError(t, err)
+	require.Equal(t, executor_health.ImagePull, s.taskInfraError(ctx, "task1"))
+
+	// The error is cleared when the task is leased again.
+	err = s.unclaimTask(ctx, "task1")
+	require.NoError(t, err)
+	err = s.claimTask(ctx, "task1", "executor2", time.Now())
+	require.NoError(t, err)
+	require.Equal(t, executor_health.Class(""), s.taskInfraError(ctx, "task1"))
+}
+
+func TestUnquarantineExecutor(t *testing.T) {
+	flags.Set(t, "auth.admin_group_id", "adminGroup")
+	s, _ := getScheduleServer(t, true, false, "")
+	s.env.GetConfigurator().ReconcileFlagsAndConfig()
+	rdb := redis.NewClient(redisutil.TargetToOptions(testredis.Start(t).Target))
+	s.env.(*testenv.TestEnv).SetRemoteExecutionRedisClient(rdb)
+	s.rdb = rdb
+	s.executorHealth = executor_health.NewTracker(rdb, executor_health.Options{MaxInfraErrorRate: 0.5, MinTasks: 1})
+	users := map[string]interfaces.UserInfo{
+		"developer": &testauth.TestUser{UserID: "developer", GroupID: "group1", AllowedGroups: []string{"group1"}, GroupMemberships: []*interfaces.GroupMembership{
+			{GroupID: "group1", Role: role.Developer},
+		}},
+		"groupAdmin": &testauth.TestUser{UserID: "groupAdmin", GroupID: "group1", AllowedGroups: []string{"group1"}, GroupMemberships: []*interfaces.GroupMembership{
+			{GroupID: "group1", Role: role.Admin},
+		}},
+		"serverAdmin": &testauth.TestUser{UserID: "serverAdmin", GroupID: "group1", AllowedGroups: []string{"group1", "adminGroup"}, GroupMemberships: []*interfaces.GroupMembership{
+			{GroupID: "group1", Role: role.Developer},
+			{GroupID: "adminGroup", Role: role.Admin},
+		}},
+	}
+	ta := testauth.NewTestAuthenticator(users)
+	s.env.(*testenv.TestEnv).SetAuthenticator(ta)
+	// Registers an executor and quarantines it.
+	register := func(executorID, groupID string) {
+		ctx := context.Background()
+		permissions := perms.OTHERS_READ
+		if s.requireExecutorAuthorization {
+			permissions = perms.GROUP_WRITE | perms.GROUP_READ
+		}
+		b, err := proto.Marshal(&scpb.RegisteredExecutionNode{
+			Registration: &scpb.ExecutionNode{ExecutorId: executorID},
+			GroupId:      groupID,
+			Acl:          perms.ToACLProto(nil /*=userID*/, groupID, permissions),
+		})
+		require.NoError(t, err)
+		key := nodePoolKey{groupID: groupID, os: "linux", arch: "amd64"}
+		err = rdb.HSet(ctx, key.redisPoolKey(), executorID, b).Err()
+		require.NoError(t, err)
+		err = rdb.SAdd(ctx, s.redisKeyForExecutorPools(groupID), key.redisPoolKey()).Err()
+		require.NoError(t, err)
+		quarantined, err := s.executorHealth.RecordInfraError(ctx, executorID, executor_health.Disk)
+		require.NoError(t, err)
+		require.True(t, quarantined)
+	}
+	unquarantine := func(user, executorID string) error {
+		ctx, err := ta.WithAuthenticatedUser(context.Background(), user)
+		require.NoError(t, err)
+		_, err = s.UnquarantineExecutor(ctx, &scpb.UnquarantineExecutorRequest{
+			RequestContext: &ctxpb.RequestContext{GroupId: "group1"},
+			ExecutorId:     executorID,
+		})
+		return err
+	}
+
+	// Executors owned by a group can be un-quarantined by admins of the
+	// group.
+	s.requireExecutorAuthorization = true
+	register("executor1", "group1")
+	err := unquarantine("developer", "executor1")
+	require.True(t, status.IsPermissionDeniedError(err), "expected PermissionDenied, got %v", err)
+	err = unquarantine("groupAdmin", "executor1")
+	require.NoError(t, err)
+
+	// Shared executors can only be un-quarantined by server admins.
+	s.requireExecutorAuthorization = false
+	register("executor2", "")
+	err = unquarantine("groupAdmin", "executor2")
+	require.True(t, status.IsPermissionDeniedError(err), "expected PermissionDenied, got %v", err)
+	err = unquarantine("serverAdmin", "executor2")
+	require.NoError(t, err)
+}
@@ -0,0 +1,151 @@
+// Package speculation supports speculative execution: running a copy of a
+// slow action on a second executor, and using the result of whichever copy
+// completes first.
+package speculation
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	// The suffix of the task ID of a speculative copy of a task.
+	copyTaskIDSuffix = "/speculative"
+
+	// The multiple of the expected task duration after which a speculative
+	// copy is started, unless configured otherwise.
+	defaultDelayMultiplier = 2.0
+
+	// The TTL of the record of a speculative execution. Matches the TTL of
+	// scheduler tasks.
+	executionTTL = 24 * time.Hour
+
+	executionStarted   = "started"
+	executionCompleted = "completed"
+
+	// The fields of the record of the task attempt that owns the log of an
+	// execution.
+	logTaskIDField    = "taskId"
+	logAttemptIDField = "attemptId"
+)
+
+// LogClaim is the result of claiming the log of an execution.
+type LogClaim int
+
+const (
+	// The log is owned by another copy of the execution.
+	LogNotClaimed LogClaim = iota
+	// The log was claimed by the first attempt to publish it.
+	LogClaimed
+	// The log was taken over from a previous attempt of the same task, whose
+	// output must be discarded.
+	LogTakenOver
+)
+
+var (
+	// Claims the completion of an execution. Returns 1 if no speculative copy
+	// of the execution was started, or if this is the first completion of
+	// either copy; 0 otherwise.
+	redisClaimCompletion = redis.NewScript(`
+		local state = redis.call("get", KEYS[1])
+		if state == false then
+			return 1
+		end
+		if state == ARGV[1] then
+			redis.call("set", KEYS[1], ARGV[2], "EX", ARGV[3])
+			return 1
+		end
+		return 0
+	`)
+
+	// Claims the log of an execution for an attempt of a task. Returns 0 if
+	// the log is owned by a different task, 1 if it was unowned, and 2 if it
+	// was owned by a previous attempt of the same task.
+	redisClaimLog = redis.NewScript(`
+		local owner = redis.call("hget", KEYS[1], ARGV[1])
+		if owner ~= false and owner ~= ARGV[2] then
+			return 0
+		end
+		redis.call("hset", KEYS[1], ARGV[1], ARGV[2], ARGV[3], ARGV[4])
+		redis.call("expire", KEYS[1], ARGV[5])
+		if owner == false then
+			return 1
+		end
+		return 2
+	`)
+)
+
+// CopyTaskID returns the task ID of the speculative copy of the given task.
+func CopyTaskID(taskID string) string {
+	return taskID + copyTaskIDSuffix
+}
+
+// Delay returns how long a task with the given expected duration may execute
+// before a speculative copy of it is started.
+func Delay(expectedDuration time.Duration, multiplier float64) time.Duration {
+	if multiplier <= 0 {
+		multiplier = defaultDelayMultiplier
+	}
+	return time.Duration(float64(expectedDuration) * multiplier)
+}
+
+func redisKeyForExecution(executionID string) string {
+	return "speculativeExecution/" + executionID
+}
+
+func redisKeyForLog(executionID string) string {
+	return "speculativeExecutionLog/" + executionID
+}
+
+// MarkStarted records that a speculative copy of the given execution has been
+// started. It must be called before the copy is scheduled.
+func MarkStarted(ctx context.Context, rdb redis.UniversalClient, executionID string) error {
+	return rdb.Set(ctx, redisKeyForExecution(executionID), executionStarted, executionTTL).Err()
+}
+
+// ClaimCompletion returns whether a completed execution should be reported to
+// the client. Once a speculative copy of an execution has been started, only
+// the first of the two copies to complete is reported.
+func ClaimCompletion(ctx context.Context, rdb redis.UniversalClient, executionID string) (bool, error) {
+	key := redisKeyForExecution(executionID)
+	r, err := redisClaimCompletion.Run(ctx, rdb, []string{key}, executionStarted, executionCompleted, int64(executionTTL.Seconds())).Result()
+	if err != nil {
+		return false, err
+	}
+	c, ok := r.(int64)
+	return ok && c == 1, nil
+}
+
+// ClaimLog claims the live log of an execution for the given attempt of the
+// task running it. A speculative copy of an execution runs as a separate task,
+// and can't claim the log while the original owns it, so that it doesn't
+// overwrite the log published by the original. A later attempt of the task
+// that owns the log, such as a retry after the executor was lost, takes the
+// log over from the previous attempt.
+func ClaimLog(ctx context.Context, rdb redis.UniversalClient, executionID, taskID, attemptID string) (LogClaim, error) {
+	key := redisKeyForLog(executionID)
+	r, err := redisClaimLog.Run(ctx, rdb, []string{key}, logTaskIDField, taskID, logAttemptIDField, attemptID, int64(executionTTL.Seconds())).Result()
+	if err != nil {
+		return LogNotClaimed, err
+	}
+	c, ok := r.(int64)
+	if !ok {
+		return LogNotClaimed, nil
+	}
+	return LogClaim(c), nil
+}
+
+// OwnsLog returns whether the given attempt still owns the live log of an
+// execution, i.e. it claimed the log and no later attempt took it over.
+func OwnsLog(ctx context.Context, rdb redis.UniversalClient, executionID, attemptID string) (bool, error) {
+	owner, err := rdb.HGet(ctx, redisKeyForLog(executionID), logAttemptIDField).Result()
+	if err == redis.Nil {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return owner == attemptID, nil
+}
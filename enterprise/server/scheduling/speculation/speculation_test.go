@@ -0,0 +1,80 @@
+package speculation_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/scheduling/speculation"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/testutil/testredis"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/util/redisutil"
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDelay(t *testing.T) {
+	require.Equal(t, 20*time.Second, speculation.Delay(10*time.Second, 0))
+	require.Equal(t, 15*time.Second, speculation.Delay(10*time.Second, 1.5))
+}
+
+func TestClaimCompletion(t *testing.T) {
+	ctx := context.Background()
+	rdb := redis.NewClient(redisutil.TargetToOptions(testredis.Start(t).Target))
+
+	// Without a speculative copy, every completion is reported.
+	for i := 0; i < 2; i++ {
+		ok, err := speculation.ClaimCompletion(ctx, rdb, "execution1")
+		require.NoError(t, err)
+		require.True(t, ok)
+	}
+
+	// With a speculative copy, only the first completion is reported.
+	err := speculation.MarkStarted(ctx, rdb, "execution2")
+	require.NoError(t, err)
+	ok, err := speculation.ClaimCompletion(ctx, rdb, "execution2")
+	require.NoError(t, err)
+	require.True(t, ok)
+	ok, err = speculation.ClaimCompletion(ctx, rdb, "execution2")
+	require.NoError(t, err)
+	require.False(t, ok)
+}
+
+func TestClaimLog(t *testing.T) {
+	ctx := context.Background()
+	rdb := redis.NewClient(redisutil.TargetToOptions(testredis.Start(t).Target))
+	copyTaskID := speculation.CopyTaskID("execution1")
+
+	claim, err := speculation.ClaimLog(ctx, rdb, "execution1", "execution1", "attempt1")
+	require.NoError(t, err)
+	require.Equal(t, speculation.LogClaimed, claim)
+	owned, err := speculation.OwnsLog(ctx, rdb, "execution1", "attempt1")
+	require.NoError(t, err)
+	require.True(t, owned)
+
+	// A speculative copy can't claim the log of the original.
+	claim, err = speculation.ClaimLog(ctx, rdb, "execution1", copyTaskID, "attempt2")
+	require.NoError(t, err)
+	require.Equal(t, speculation.LogNotClaimed, claim)
+	owned, err = speculation.OwnsLog(ctx, rdb, "execution1", "attempt2")
+	require.NoError(t, err)
+	require.False(t, owned)
+
+	// A retry of the original takes the log over.
+	claim, err = speculation.ClaimLog(ctx, rdb, "execution1", "execution1", "attempt3")
+	require.NoError(t, err)
+	require.Equal(t, speculation.LogTakenOver, claim)
+	owned, err = speculation.OwnsLog(ctx, rdb, "execution1", "attempt1")
+	require.NoError(t, err)
+	require.False(t, owned)
+	owned, err = speculation.OwnsLog(ctx, rdb, "execution1", "attempt3")
+	require.NoError(t, err)
+	require.True(t, owned)
+
+	// Claims of different executions are independent.
+	claim, err = speculation.ClaimLog(ctx, rdb, "execution2", speculation.CopyTaskID("execution2"), "attempt4")
+	require.NoError(t, err)
+	require.Equal(t, speculation.LogClaimed, claim)
+	owned, err = speculation.OwnsLog(ctx, rdb, "execution3", "attempt4")
+	require.NoError(t, err)
+	require.False(t, owned)
+}
@@ -18,6 +18,7 @@ import (
 type TaskLeaser struct {
 	env        environment.Env
 	log        *log.Logger
+	executorID string
 	taskID     string
 	quit       chan struct{}
 	mu         sync.Mutex // protects stream
@@ -27,15 +28,16 @@ type TaskLeaser struct {
 	cancelFunc context.CancelFunc
 }
 
-func NewTaskLeaser(env environment.Env, executorName string, taskID string) *TaskLeaser {
+func NewTaskLeaser(env environment.Env, executorID, executorName, taskID string) *TaskLeaser {
 	sublog := log.NamedSubLogger(executorName)
 	return &TaskLeaser{
-		env:    env,
-		log:    &sublog,
-		taskID: taskID,
-		quit:   make(chan struct{}),
-		ttl:    100 * time.Second,
-		closed: true, // set to false in Claim.
+		env:        env,
+		log:        &sublog,
+		executorID: executorID,
+		taskID:     taskID,
+		quit:       make(chan struct{}),
+		ttl:        100 * time.Second,
+		closed:     true, // set to false in Claim.
 	}
 }
 
@@ -43,7 +45,8 @@ func (t *TaskLeaser) pingServer() ([]byte, error) {
 	t.mu.Lock()
 	defer t.mu.Unlock()
 	req := &scpb.LeaseTaskRequest{
-		TaskId: t.taskID,
+		TaskId:     t.taskID,
+		ExecutorId: t.executorID,
 	}
 	if err := t.stream.Send(req); err != nil {
 		return nil, err
@@ -58,8 +61,9 @@ func (t *TaskLeaser) pingServer() ([]byte, error) {
 
 func (t *TaskLeaser) reEnqueueTask(ctx context.Context, reason string) error {
 	req := &scpb.ReEnqueueTaskRequest{
-		TaskId: t.taskID,
-		Reason: reason,
+		TaskId:     t.taskID,
+		Reason:     reason,
+		ExecutorId: t.executorID,
 	}
 	if apiKey := t.env.GetConfigurator().GetExecutorConfig().APIKey; apiKey != "" {
 		ctx = metadata.AppendToOutgoingContext(ctx, auth.APIKeyHeader, apiKey)
@@ -119,7 +123,8 @@ func (t *TaskLeaser) Close(taskErr error, retry bool) {
 	close(t.quit) // This cancels our lease-keep-alive background goroutine.
 
 	req := &scpb.LeaseTaskRequest{
-		TaskId: t.taskID,
+		TaskId:     t.taskID,
+		ExecutorId: t.executorID,
 	}
 
 	shouldReEnqueue := false
@@ -5,12 +5,17 @@ import (
 	"crypto/sha256"
 	"fmt"
 	"math/rand"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/platform"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/scheduling/cache_locality"
 	"github.com/buildbuddy-io/buildbuddy/server/environment"
 	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/util/bloom"
 	"github.com/buildbuddy-io/buildbuddy/server/util/log"
 	"github.com/buildbuddy-io/buildbuddy/server/util/perms"
 	"github.com/buildbuddy-io/buildbuddy/server/util/status"
@@ -18,6 +23,7 @@ import (
 	"github.com/golang/protobuf/proto"
 
 	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+	scpb "github.com/buildbuddy-io/buildbuddy/proto/scheduler"
 )
 
 const (
@@ -36,11 +42,44 @@ const (
 	// bigger than the number of probes, in case any of the nodes go down or
 	// a probe fails.
 	workflowsPreferredNodeLimit = 6
+
+	// The max number of recent execution durations stored for each key.
+	maxDurationSamples = 100
+	// The min number of execution durations needed to estimate the duration
+	// of a task.
+	minDurationSamples = 5
+
+	routingKeyPrefix  = "task_route"
+	durationKeyPrefix = "task_duration"
+	sketchKeyPrefix   = "filecache_sketch"
+
+	// The TTL of file cache sketches, after which executors that stopped
+	// sending them are no longer preferred. Executors send sketches every
+	// minute.
+	sketchTTL = 5 * time.Minute
+	// How long sketches are cached in memory before they are re-read from
+	// Redis.
+	sketchRefreshInterval = 30 * time.Second
+	// How long a task routed to an executor by locality counts towards the
+	// executor's load, which lowers its locality score for subsequent tasks.
+	localityLoadWindow = 30 * time.Second
 )
 
+type cachedSketch struct {
+	// Nil if the executor has no sketch.
+	sketch    *bloom.Filter
+	fetchedAt time.Time
+}
+
 type taskRouter struct {
 	env environment.Env
 	rdb redis.UniversalClient
+
+	mu       sync.Mutex
+	sketches map[string]*cachedSketch
+	// localityRoutes holds the times at which tasks were recently routed to
+	// each executor by locality, by executor ID.
+	localityRoutes map[string][]time.Time
 }
 
 func New(env environment.Env) (interfaces.TaskRouter, error) {
@@ -49,29 +88,35 @@ func New(env environment.Env) (interfaces.TaskRouter, error) {
 		return nil, status.FailedPreconditionError("Redis is required for task router")
 	}
 	return &taskRouter{
-		env: env,
-		rdb: rdb,
+		env:            env,
+		rdb:            rdb,
+		sketches:       make(map[string]*cachedSketch),
+		localityRoutes: make(map[string][]time.Time),
 	}, nil
 }
 
 // RankNodes returns the input nodes ordered by their affinity to the given
-// routing properties.
-func (tr *taskRouter) RankNodes(ctx context.Context, cmd *repb.Command, remoteInstanceName string, nodes []interfaces.ExecutionNode) []interfaces.ExecutionNode {
+// routing properties. Tasks that are not routed by their routing properties
+// are routed by the locality of the given input digests, if any.
+func (tr *taskRouter) RankNodes(ctx context.Context, cmd *repb.Command, remoteInstanceName string, localityDigests []*repb.Digest, nodes []interfaces.ExecutionNode) []interfaces.ExecutionNode {
 	nodes = copyNodes(nodes)
 
 	rand.Shuffle(len(nodes), func(i, j int) {
 		nodes[i], nodes[j] = nodes[j], nodes[i]
 	})
 
-	if cmd == nil {
-		return nodes
+	preferredNodeLimit := 0
+	if cmd != nil {
+		preferredNodeLimit = getPreferredNodeLimit(cmd)
 	}
-	preferredNodeLimit := getPreferredNodeLimit(cmd)
 	if preferredNodeLimit == 0 {
+		if len(localityDigests) > 0 {
+			return tr.rankNodesByLocality(ctx, localityDigests, nodes)
+		}
 		return nodes
 	}
 
-	key, err := tr.routingKey(ctx, cmd, remoteInstanceName)
+	key, err := tr.taskKey(ctx, routingKeyPrefix, cmd, remoteInstanceName)
 	if err != nil {
 		log.Errorf("Failed to compute routing key: %s", err)
 		return nodes
@@ -111,6 +156,124 @@ func (tr *taskRouter) RankNodes(ctx context.Context, cmd *repb.Command, remoteIn
 	return ranked
 }
 
+// rankNodesByLocality orders the nodes by decreasing size of the given inputs
+// that they have in their file cache, divided by the number of tasks recently
+// routed to them by locality, so that tasks sharing inputs are spread across
+// the executors that have them rather than piling up on one. Nodes with equal
+// scores keep their shuffled order.
+func (tr *taskRouter) rankNodesByLocality(ctx context.Context, digests []*repb.Digest, nodes []interfaces.ExecutionNode) []interfaces.ExecutionNode {
+	sketches := tr.getSketches(ctx, nodes)
+
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	now := time.Now()
+	tr.pruneLocalityRoutes(now)
+	scores := make(map[string]int64, len(nodes))
+	for _, node := range nodes {
+		id := node.GetExecutorID()
+		if sketch := sketches[id]; sketch != nil {
+			scores[id] = cache_locality.Score(sketch, digests) / int64(1+len(tr.localityRoutes[id]))
+		}
+	}
+	sort.SliceStable(nodes, func(i, j int) bool {
+		return scores[nodes[i].GetExecutorID()] > scores[nodes[j].GetExecutorID()]
+	})
+	if len(nodes) > 0 && scores[nodes[0].GetExecutorID()] > 0 {
+		id := nodes[0].GetExecutorID()
+		tr.localityRoutes[id] = append(tr.localityRoutes[id], now)
+	}
+	return nodes
+}
+
+// pruneLocalityRoutes forgets tasks routed by locality before the load window.
+func (tr *taskRouter) pruneLocalityRoutes(now time.Time) {
+	for id, times := range tr.localityRoutes {
+		i := 0
+		for i < len(times) && now.Sub(times[i]) > localityLoadWindow {
+			i++
+		}
+		if i == len(times) {
+			delete(tr.localityRoutes, id)
+		} else {
+			tr.localityRoutes[id] = times[i:]
+		}
+	}
+}
+
+// getSketches returns the file cache sketches of the given nodes, by executor
+// ID. Sketches are read from Redis if they are not cached in memory yet, or
+// are stale.
+func (tr *taskRouter) getSketches(ctx context.Context, nodes []interfaces.ExecutionNode) map[string]*bloom.Filter {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+
+	now := time.Now()
+	sketches := make(map[string]*bloom.Filter, len(nodes))
+	var staleIDs, staleKeys []string
+	for _, node := range nodes {
+		id := node.GetExecutorID()
+		if c, ok := tr.sketches[id]; ok && now.Sub(c.fetchedAt) < sketchRefreshInterval {
+			sketches[id] = c.sketch
+			continue
+		}
+		staleIDs = append(staleIDs, id)
+		staleKeys = append(staleKeys, sketchKey(id))
+	}
+	if len(staleKeys) == 0 {
+		return sketches
+	}
+	vals, err := tr.rdb.MGet(ctx, staleKeys...).Result()
+	if err != nil {
+		log.Errorf("Failed to read file cache sketches: redis MGET failed: %s", err)
+		return sketches
+	}
+	for i, v := range vals {
+		id := staleIDs[i]
+		var sketch *bloom.Filter
+		if s, ok := v.(string); ok {
+			sketch, err = unmarshalSketch([]byte(s))
+			if err != nil {
+				log.Warningf("Invalid file cache sketch for executor %q: %s", id, err)
+			}
+		}
+		tr.sketches[id] = &cachedSketch{sketch: sketch, fetchedAt: now}
+		sketches[id] = sketch
+	}
+
+	// Forget executors that went away.
+	for id, c := range tr.sketches {
+		if now.Sub(c.fetchedAt) > sketchTTL {
+			delete(tr.sketches, id)
+		}
+	}
+	return sketches
+}
+
+func sketchKey(executorID string) string {
+	return sketchKeyPrefix + "/" + executorID
+}
+
+func unmarshalSketch(b []byte) (*bloom.Filter, error) {
+	sketch := &scpb.FileCacheSketch{}
+	if err := proto.Unmarshal(b, sketch); err != nil {
+		return nil, err
+	}
+	return bloom.FromBytes(sketch.GetBloomFilter(), int(sketch.GetNumHashes()))
+}
+
+// RecordFileCacheSketch stores the latest file cache sketch of the given
+// executor, which is used to route tasks by the locality of their inputs.
+func (tr *taskRouter) RecordFileCacheSketch(ctx context.Context, executorID string, sketch *scpb.FileCacheSketch) {
+	b, err := proto.Marshal(sketch)
+	if err != nil {
+		log.Errorf("Failed to marshal file cache sketch: %s", err)
+		return
+	}
+	if err := tr.rdb.Set(ctx, sketchKey(executorID), b, sketchTTL).Err(); err != nil {
+		log.Errorf("Failed to record file cache sketch: redis SET failed: %s", err)
+	}
+}
+
 // MarkComplete updates the routing table after a task is completed, so that
 // future tasks with those properties are more likely to be fulfilled by the
 // given node.
@@ -119,7 +282,7 @@ func (tr *taskRouter) MarkComplete(ctx context.Context, cmd *repb.Command, remot
 	if nodeListMaxLength == 0 {
 		return
 	}
-	key, err := tr.routingKey(ctx, cmd, remoteInstanceName)
+	key, err := tr.taskKey(ctx, routingKeyPrefix, cmd, remoteInstanceName)
 	if err != nil {
 		log.Errorf("Failed to compute routing key: %s", err)
 		return
@@ -141,6 +304,67 @@ func (tr *taskRouter) MarkComplete(ctx context.Context, cmd *repb.Command, remot
 	log.Debugf("Preferred executor %q added to %q", executorID, key)
 }
 
+// RecordDuration records the execution duration of a task, so that
+// ExpectedDuration can estimate the duration of subsequent tasks with the same
+// routing properties. Durations are only recorded for tasks that may be
+// retried speculatively, since they are the only consumers of the estimates.
+func (tr *taskRouter) RecordDuration(ctx context.Context, cmd *repb.Command, remoteInstanceName string, duration time.Duration) {
+	if !platform.IsTrue(platform.FindValue(cmd.GetPlatform(), platform.SpeculativeRetryPropertyName)) {
+		return
+	}
+	key, err := tr.taskKey(ctx, durationKeyPrefix, cmd, remoteInstanceName)
+	if err != nil {
+		log.Errorf("Failed to compute duration key: %s", err)
+		return
+	}
+
+	pipe := tr.rdb.TxPipeline()
+	pipe.LPush(ctx, key, duration.Milliseconds())
+	pipe.LTrim(ctx, key, 0, maxDurationSamples-1)
+	pipe.Expire(ctx, key, routingPropsKeyTTL)
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Errorf("Failed to record task duration: redis pipeline failed: %s", err)
+	}
+}
+
+// ExpectedDuration returns the 90th percentile of the recorded durations of
+// tasks with the same routing properties.
+func (tr *taskRouter) ExpectedDuration(ctx context.Context, cmd *repb.Command, remoteInstanceName string) (time.Duration, bool) {
+	key, err := tr.taskKey(ctx, durationKeyPrefix, cmd, remoteInstanceName)
+	if err != nil {
+		log.Errorf("Failed to compute duration key: %s", err)
+		return 0, false
+	}
+	vals, err := tr.rdb.LRange(ctx, key, 0, -1).Result()
+	if err != nil {
+		log.Errorf("Failed to read task durations: redis LRANGE failed: %s", err)
+		return 0, false
+	}
+	durations := make([]time.Duration, 0, len(vals))
+	for _, v := range vals {
+		ms, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			continue
+		}
+		durations = append(durations, time.Duration(ms)*time.Millisecond)
+	}
+	return percentile(durations, 90)
+}
+
+// percentile returns the pth percentile of the given durations, or false if
+// there are too few durations to estimate it.
+func percentile(durations []time.Duration, p int) (time.Duration, bool) {
+	if len(durations) < minDurationSamples {
+		return 0, false
+	}
+	sorted := make([]time.Duration, len(durations))
+	copy(sorted, durations)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	// Nearest-rank method.
+	rank := (p*len(sorted) + 99) / 100
+	return sorted[rank-1], true
+}
+
 // getPreferredNodeLimit returns the max number of nodes that should be stored
 // in the preferred executors list for each task key, as well as the max number
 // of preferred nodes that should be returned by RankNodes.
@@ -156,8 +380,10 @@ func getPreferredNodeLimit(cmd *repb.Command) int {
 	return defaultPreferredNodeLimit
 }
 
-func (tr *taskRouter) routingKey(ctx context.Context, cmd *repb.Command, remoteInstanceName string) (string, error) {
-	parts := []string{"task_route"}
+// taskKey returns the Redis key under the given prefix for tasks with the
+// same group, remote instance name and platform properties as the given task.
+func (tr *taskRouter) taskKey(ctx context.Context, prefix string, cmd *repb.Command, remoteInstanceName string) (string, error) {
+	parts := []string{prefix}
 
 	if u, err := perms.AuthenticatedUser(ctx, tr.env); err == nil {
 		parts = append(parts, u.GetGroupID())
@@ -1,9 +1,24 @@
 package tasksize
 
 import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/platform"
+	"github.com/buildbuddy-io/buildbuddy/server/environment"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/util/bazel_request"
 	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/perms"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/go-redis/redis/v8"
 
+	espb "github.com/buildbuddy-io/buildbuddy/proto/execution_stats"
 	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
 	scpb "github.com/buildbuddy-io/buildbuddy/proto/scheduler"
 )
@@ -47,6 +62,51 @@ const (
 
 	// The fraction of an executor's allocatable resources to make available for task sizing.
 	MaxResourceCapacityRatio = 0.8
+
+	// Bounds for measured task sizes. Measurements are clamped to these
+	// bounds so that a single outlier can't make similar tasks unschedulable.
+
+	MinMeasuredMemEstimate = int64(10 * 1e6) // 10 MB
+	MaxMeasuredMemEstimate = int64(8 * 1e9)  // 8 GB
+	MinMeasuredCPUEstimate = int64(100)
+	MaxMeasuredCPUEstimate = int64(8000)
+
+	// The extra memory to reserve on top of the measured peak memory usage.
+	measuredMemHeadroomRatio = 1.1
+
+	// The weight of a new observation when it is lower than the previous
+	// measurement.
+	measuredSizeDecayFactor = 0.3
+
+	// How long a measured size is kept after the last execution of similar
+	// tasks.
+	measuredSizeTTL = 7 * 24 * time.Hour
+
+	// Fields of the Redis hash holding a measured task size.
+	memoryBytesField = "memoryBytes"
+	milliCPUField    = "milliCPU"
+)
+
+var (
+	// Blends an observed task size (ARGV[1] memory bytes, ARGV[2] milli-CPU)
+	// into the measured size stored in the hash KEYS[1], under the
+	// memoryBytesField and milliCPUField fields, and refreshes its TTL (ARGV[4]
+	// seconds). Increases are applied immediately since under-sizing
+	// a task risks overloading executors, while decreases are applied
+	// gradually, weighting the observation by the decay factor ARGV[3].
+	redisUpdateMeasuredSize = redis.NewScript(`
+		local function blend(field, observed)
+			local previous = tonumber(redis.call("hget", KEYS[1], field))
+			if not previous or observed >= previous then
+				return observed
+			end
+			local decay = tonumber(ARGV[3])
+			return math.floor(previous * (1 - decay) + observed * decay)
+		end
+		local mem = blend("memoryBytes", tonumber(ARGV[1]))
+		local cpu = blend("milliCPU", tonumber(ARGV[2]))
+		redis.call("hset", KEYS[1], "memoryBytes", string.format("%d", mem), "milliCPU", string.format("%d", cpu))
+		return redis.call("expire", KEYS[1], ARGV[4])`)
 )
 
 func testSize(testSize string) (int64, int64) {
@@ -74,7 +134,17 @@ func testSize(testSize string) (int64, int64) {
 	return int64(mb * 1e6), int64(cpu)
 }
 
+// Estimate returns the resources needed to execute the given task, based on
+// static estimates.
 func Estimate(task *repb.ExecutionTask) *scpb.TaskSize {
+	return EstimateWithMeasuredSize(task, nil)
+}
+
+// EstimateWithMeasuredSize returns the resources needed to execute the given
+// task. The measured memory and CPU usage of previous executions of similar
+// tasks, if any, take precedence over the static estimates. Explicitly
+// requested compute units still take precedence over measurements.
+func EstimateWithMeasuredSize(task *repb.ExecutionTask, measured *scpb.TaskSize) *scpb.TaskSize {
 	props := platform.ParseProperties(task)
 
 	memEstimate := DefaultMemEstimate
@@ -91,6 +161,12 @@ func Estimate(task *repb.ExecutionTask) *scpb.TaskSize {
 			break
 		}
 	}
+	if measured.GetEstimatedMemoryBytes() > 0 {
+		memEstimate = measured.GetEstimatedMemoryBytes()
+	}
+	if measured.GetEstimatedMilliCpu() > 0 {
+		cpuEstimate = measured.GetEstimatedMilliCpu()
+	}
 	if props.WorkloadIsolationType == string(platform.FirecrackerContainerType) {
 		memEstimate += FirecrackerAdditionalMemEstimateBytes
 		// Note: props.InitDockerd is only supported for docker-in-firecracker.
@@ -118,3 +194,182 @@ func Estimate(task *repb.ExecutionTask) *scpb.TaskSize {
 		EstimatedFreeDiskBytes: freeDiskEstimate,
 	}
 }
+
+type sizeContextKey struct{}
+
+// WithSize returns a context carrying the size that the scheduler assigned to
+// the task, so that executors size the task's resources the same way.
+func WithSize(ctx context.Context, size *scpb.TaskSize) context.Context {
+	return context.WithValue(ctx, sizeContextKey{}, size)
+}
+
+// SizeForTask returns the size that the scheduler assigned to the task, if
+// present in the context, falling back to the static estimate otherwise.
+func SizeForTask(ctx context.Context, task *repb.ExecutionTask) *scpb.TaskSize {
+	if size, ok := ctx.Value(sizeContextKey{}).(*scpb.TaskSize); ok && size != nil {
+		return size
+	}
+	return Estimate(task)
+}
+
+// taskSizer is a TaskSizer backed by Redis. Measurements are keyed by a
+// fingerprint of the task's command arguments (excluding paths), platform and
+// action mnemonic, so that e.g. all compile actions using the same toolchain
+// and flags share a measured size.
+type taskSizer struct {
+	env environment.Env
+	rdb redis.UniversalClient
+}
+
+// Register sets up a TaskSizer in the env if measured task sizes are enabled.
+func Register(env environment.Env) error {
+	if conf := env.GetConfigurator().GetRemoteExecutionConfig(); conf == nil || !conf.UseMeasuredTaskSizes {
+		return nil
+	}
+	sizer, err := NewSizer(env)
+	if err != nil {
+		return err
+	}
+	env.SetTaskSizer(sizer)
+	return nil
+}
+
+func NewSizer(env environment.Env) (interfaces.TaskSizer, error) {
+	rdb := env.GetRemoteExecutionRedisClient()
+	if rdb == nil {
+		return nil, status.FailedPreconditionError("Redis is required for measured task sizes")
+	}
+	return &taskSizer{env: env, rdb: rdb}, nil
+}
+
+func (s *taskSizer) Get(ctx context.Context, task *repb.ExecutionTask) *scpb.TaskSize {
+	key := s.sizeKey(ctx, task.GetCommand(), task.GetExecuteRequest().GetInstanceName())
+	vals, err := s.rdb.HMGet(ctx, key, memoryBytesField, milliCPUField).Result()
+	if err != nil {
+		log.Warningf("Failed to read measured task size: %s", err)
+		return nil
+	}
+	mem, memOK := parseMeasurement(vals[0])
+	cpu, cpuOK := parseMeasurement(vals[1])
+	if !memOK || !cpuOK {
+		return nil
+	}
+	return &scpb.TaskSize{
+		EstimatedMemoryBytes: mem,
+		EstimatedMilliCpu:    cpu,
+	}
+}
+
+func parseMeasurement(val interface{}) (int64, bool) {
+	s, ok := val.(string)
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, false
+	}
+	return n, true
+}
+
+func (s *taskSizer) Update(ctx context.Context, cmd *repb.Command, remoteInstanceName string, summary *espb.ExecutionSummary) error {
+	observed := measuredSize(summary)
+	if observed == nil {
+		return nil
+	}
+	key := s.sizeKey(ctx, cmd, remoteInstanceName)
+	// Blend the observation into the previous measurement atomically, so that
+	// concurrent updates for similar tasks don't overwrite each other.
+	return redisUpdateMeasuredSize.Run(
+		ctx, s.rdb, []string{key},
+		observed.GetEstimatedMemoryBytes(), observed.GetEstimatedMilliCpu(),
+		measuredSizeDecayFactor, int64(measuredSizeTTL.Seconds()),
+	).Err()
+}
+
+// measuredSize converts the resource usage recorded in an execution summary to
+// a task size, or returns nil if the usage was not measured.
+func measuredSize(summary *espb.ExecutionSummary) *scpb.TaskSize {
+	usage := summary.GetUsageStats()
+	if usage.GetPeakMemoryBytes() <= 0 {
+		return nil
+	}
+	md := summary.GetExecutedActionMetadata()
+	start := md.GetExecutionStartTimestamp()
+	end := md.GetExecutionCompletedTimestamp()
+	if start == nil || end == nil {
+		return nil
+	}
+	duration := end.AsTime().Sub(start.AsTime())
+	if duration <= 0 {
+		return nil
+	}
+	memEstimate := int64(float64(usage.GetPeakMemoryBytes()) * measuredMemHeadroomRatio)
+	// Peak CPU usage isn't measured, so use the average CPU usage over the
+	// execution.
+	cpuEstimate := usage.GetCpuNanos() * 1000 / duration.Nanoseconds()
+	return &scpb.TaskSize{
+		EstimatedMemoryBytes: clamp(memEstimate, MinMeasuredMemEstimate, MaxMeasuredMemEstimate),
+		EstimatedMilliCpu:    clamp(cpuEstimate, MinMeasuredCPUEstimate, MaxMeasuredCPUEstimate),
+	}
+}
+
+func (s *taskSizer) sizeKey(ctx context.Context, cmd *repb.Command, remoteInstanceName string) string {
+	groupID := interfaces.AuthAnonymousUser
+	if u, err := perms.AuthenticatedUser(ctx, s.env); err == nil {
+		groupID = u.GetGroupID()
+	}
+	mnemonic := bazel_request.GetRequestMetadata(ctx).GetActionMnemonic()
+	return fmt.Sprintf("taskSizes/%s/%s", groupID, Fingerprint(cmd, remoteInstanceName, mnemonic))
+}
+
+// Fingerprint returns a key identifying commands that are expected to use
+// similar resources: commands with the same arguments, ignoring paths, running
+// on the same platform, with the same mnemonic.
+func Fingerprint(cmd *repb.Command, remoteInstanceName, mnemonic string) string {
+	h := sha256.New()
+	write := func(s string) {
+		// Length-prefix each part to avoid ambiguity.
+		fmt.Fprintf(h, "%d:%s", len(s), s)
+	}
+	write(remoteInstanceName)
+	write(mnemonic)
+	for _, p := range cmd.GetPlatform().GetProperties() {
+		write(p.GetName())
+		write(p.GetValue())
+	}
+	for i, arg := range cmd.GetArguments() {
+		if i == 0 {
+			// Keep the tool name, but not where it lives.
+			write(filepath.Base(arg))
+			continue
+		}
+		if arg = stripPath(arg); arg != "" {
+			write(arg)
+		}
+	}
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// stripPath removes the path from a command argument, keeping flag names so
+// that e.g. "--output=foo/bar.o" becomes "--output=". Arguments that are only
+// paths (including param files) are dropped entirely.
+func stripPath(arg string) string {
+	if !strings.Contains(arg, "/") && !strings.HasPrefix(arg, "@") {
+		return arg
+	}
+	if i := strings.Index(arg, "="); i >= 0 && !strings.Contains(arg[:i], "/") {
+		return arg[:i+1]
+	}
+	return ""
+}
+
+func clamp(value, min, max int64) int64 {
+	if value < min {
+		return min
+	}
+	if value > max {
+		return max
+	}
+	return value
+}
@@ -1,14 +1,24 @@
 package tasksize_test
 
 import (
+	"context"
 	"fmt"
 	"testing"
+	"time"
 
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/platform"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/tasksize"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/testutil/testredis"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/util/redisutil"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testenv"
+	"github.com/go-redis/redis/v8"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/timestamppb"
 
+	espb "github.com/buildbuddy-io/buildbuddy/proto/execution_stats"
 	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+	scpb "github.com/buildbuddy-io/buildbuddy/proto/scheduler"
 )
 
 func TestEstimate_EmptyTask_DefaultEstimate(t *testing.T) {
@@ -108,3 +118,102 @@ func TestEstimate_DiskSizePlatformProp_UsesPropValueForDiskSize(t *testing.T) {
 	assert.Equal(t, tasksize.DefaultCPUEstimate, ts.EstimatedMilliCpu)
 	assert.Equal(t, disk, ts.EstimatedFreeDiskBytes)
 }
+
+func TestEstimateWithMeasuredSize_UsesMeasuredSize(t *testing.T) {
+	const mem = tasksize.MinMeasuredMemEstimate * 3
+	const cpu = tasksize.MinMeasuredCPUEstimate * 3
+	ts := tasksize.EstimateWithMeasuredSize(&repb.ExecutionTask{}, &scpb.TaskSize{
+		EstimatedMemoryBytes: mem,
+		EstimatedMilliCpu:    cpu,
+	})
+
+	assert.Equal(t, int64(mem), ts.EstimatedMemoryBytes)
+	assert.Equal(t, int64(cpu), ts.EstimatedMilliCpu)
+	assert.Equal(t, tasksize.DefaultFreeDiskEstimate, ts.EstimatedFreeDiskBytes)
+}
+
+func TestEstimateWithMeasuredSize_BCUPlatformProps_TakePrecedence(t *testing.T) {
+	ts := tasksize.EstimateWithMeasuredSize(&repb.ExecutionTask{
+		Command: &repb.Command{
+			Platform: &repb.Platform{
+				Properties: []*repb.Platform_Property{
+					{Name: "EstimatedComputeUnits", Value: "2"},
+				},
+			},
+		},
+	}, &scpb.TaskSize{
+		EstimatedMemoryBytes: tasksize.MinMeasuredMemEstimate,
+		EstimatedMilliCpu:    tasksize.MinMeasuredCPUEstimate,
+	})
+
+	assert.Equal(t, int64(2*2.5*1e9), ts.EstimatedMemoryBytes)
+	assert.Equal(t, int64(2*1000), ts.EstimatedMilliCpu)
+}
+
+func TestFingerprint(t *testing.T) {
+	cmd := func(args ...string) *repb.Command {
+		return &repb.Command{
+			Arguments: args,
+			Platform: &repb.Platform{
+				Properties: []*repb.Platform_Property{
+					{Name: "OSFamily", Value: "linux"},
+				},
+			},
+		}
+	}
+	fp := tasksize.Fingerprint(cmd("/usr/bin/gcc", "-c", "bazel-out/k8-fastbuild/bin/a.o"), "", "CppCompile")
+
+	assert.Equal(t, fp, tasksize.Fingerprint(cmd("/opt/bin/gcc", "-c", "bazel-out/k8-opt/bin/b.o"), "", "CppCompile"), "paths should not affect the fingerprint")
+	assert.NotEqual(t, fp, tasksize.Fingerprint(cmd("/usr/bin/gcc", "-c", "bazel-out/k8-fastbuild/bin/a.o"), "", "CppLink"), "mnemonic should affect the fingerprint")
+	assert.NotEqual(t, fp, tasksize.Fingerprint(cmd("/usr/bin/gcc", "-c", "bazel-out/k8-fastbuild/bin/a.o"), "other", "CppCompile"), "instance name should affect the fingerprint")
+	assert.NotEqual(t, fp, tasksize.Fingerprint(cmd("/usr/bin/gcc", "-O2", "-c", "bazel-out/k8-fastbuild/bin/a.o"), "", "CppCompile"), "flags should affect the fingerprint")
+
+	other := cmd("/usr/bin/gcc", "-c", "bazel-out/k8-fastbuild/bin/a.o")
+	other.Platform.Properties[0].Value = "darwin"
+	assert.NotEqual(t, fp, tasksize.Fingerprint(other, "", "CppCompile"), "platform should affect the fingerprint")
+}
+
+func executionSummary(peakMemoryBytes int64, cpu time.Duration) *espb.ExecutionSummary {
+	start := time.Unix(1000, 0)
+	return &espb.ExecutionSummary{
+		ExecutedActionMetadata: &repb.ExecutedActionMetadata{
+			ExecutionStartTimestamp:     timestamppb.New(start),
+			ExecutionCompletedTimestamp: timestamppb.New(start.Add(time.Second)),
+		},
+		UsageStats: &espb.UsageStats{
+			PeakMemoryBytes: peakMemoryBytes,
+			CpuNanos:        cpu.Nanoseconds(),
+		},
+	}
+}
+
+func TestSizer_Update_BlendsMeasurements(t *testing.T) {
+	ctx := context.Background()
+	env := testenv.GetTestEnv(t)
+	env.SetRemoteExecutionRedisClient(redis.NewClient(redisutil.TargetToOptions(testredis.Start(t).Target)))
+	sizer, err := tasksize.NewSizer(env)
+	require.NoError(t, err)
+	task := &repb.ExecutionTask{Command: &repb.Command{Arguments: []string{"/usr/bin/gcc", "-c", "a.c"}}}
+
+	assert.Nil(t, sizer.Get(ctx, task), "tasks should not have a measured size before they are executed")
+
+	err = sizer.Update(ctx, task.GetCommand(), "", executionSummary(100e6, time.Second))
+	require.NoError(t, err)
+	size := sizer.Get(ctx, task)
+	assert.Equal(t, int64(110e6), size.GetEstimatedMemoryBytes())
+	assert.Equal(t, int64(1000), size.GetEstimatedMilliCpu())
+
+	// Decreases are applied gradually.
+	err = sizer.Update(ctx, task.GetCommand(), "", executionSummary(50e6, 500*time.Millisecond))
+	require.NoError(t, err)
+	size = sizer.Get(ctx, task)
+	assert.InDelta(t, 110e6*0.7+55e6*0.3, size.GetEstimatedMemoryBytes(), 1)
+	assert.InDelta(t, 1000*0.7+500*0.3, size.GetEstimatedMilliCpu(), 1)
+
+	// Increases are applied immediately.
+	err = sizer.Update(ctx, task.GetCommand(), "", executionSummary(200e6, 2*time.Second))
+	require.NoError(t, err)
+	size = sizer.Get(ctx, task)
+	assert.Equal(t, int64(220e6), size.GetEstimatedMemoryBytes())
+	assert.Equal(t, int64(2000), size.GetEstimatedMilliCpu())
+}
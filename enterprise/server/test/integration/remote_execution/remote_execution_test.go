@@ -35,6 +35,7 @@ import (
 
 	bespb "github.com/buildbuddy-io/buildbuddy/proto/build_event_stream"
 	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+	scpb "github.com/buildbuddy-io/buildbuddy/proto/scheduler"
 )
 
 func TestSimpleCommandWithNonZeroExitCode(t *testing.T) {
@@ -991,7 +992,7 @@ func newFixedNodeTaskRouter(executorIDs []string) *fixedNodeTaskRouter {
 	return &fixedNodeTaskRouter{executorIDs: idSet}
 }
 
-func (f *fixedNodeTaskRouter) RankNodes(ctx context.Context, cmd *repb.Command, remoteInstanceName string, nodes []interfaces.ExecutionNode) []interfaces.ExecutionNode {
+func (f *fixedNodeTaskRouter) RankNodes(ctx context.Context, cmd *repb.Command, remoteInstanceName string, localityDigests []*repb.Digest, nodes []interfaces.ExecutionNode) []interfaces.ExecutionNode {
 	f.mu.Lock()
 	defer f.mu.Unlock()
 	var out []interfaces.ExecutionNode
@@ -1006,6 +1007,16 @@ func (f *fixedNodeTaskRouter) RankNodes(ctx context.Context, cmd *repb.Command,
 func (f *fixedNodeTaskRouter) MarkComplete(ctx context.Context, cmd *repb.Command, remoteInstanceName, executorInstanceID string) {
 }
 
+func (f *fixedNodeTaskRouter) RecordDuration(ctx context.Context, cmd *repb.Command, remoteInstanceName string, duration time.Duration) {
+}
+
+func (f *fixedNodeTaskRouter) ExpectedDuration(ctx context.Context, cmd *repb.Command, remoteInstanceName string) (time.Duration, bool) {
+	return 0, false
+}
+
+func (f *fixedNodeTaskRouter) RecordFileCacheSketch(ctx context.Context, executorID string, sketch *scpb.FileCacheSketch) {
+}
+
 func (f *fixedNodeTaskRouter) UpdateSubset(executorIDs []string) {
 	f.mu.Lock()
 	defer f.mu.Unlock()
@@ -13,9 +13,11 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/server/environment"
 	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
 	"github.com/buildbuddy-io/buildbuddy/server/testutil/testauth"
+	"github.com/buildbuddy-io/buildbuddy/server/util/bloom"
 	"github.com/stretchr/testify/require"
 
 	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+	scpb "github.com/buildbuddy-io/buildbuddy/proto/scheduler"
 )
 
 const (
@@ -46,7 +48,7 @@ func TestTaskRouter_RankNodes_Workflows_ReturnsMultipleRunnersThatExecutedWorkfl
 
 	// Task should now be routed to executor 1.
 
-	ranked := router.RankNodes(ctx, cmd, instanceName, nodes)
+	ranked := router.RankNodes(ctx, cmd, instanceName, nil /*=localityDigests*/, nodes)
 
 	require.ElementsMatch(t, nodes, ranked)
 	require.Equal(t, executorID1, ranked[0].GetExecutorID())
@@ -59,7 +61,7 @@ func TestTaskRouter_RankNodes_Workflows_ReturnsMultipleRunnersThatExecutedWorkfl
 	// ran the task more recently, and we memorize several recent executors for
 	// workflow tasks.
 
-	ranked = router.RankNodes(ctx, cmd, instanceName, nodes)
+	ranked = router.RankNodes(ctx, cmd, instanceName, nil /*=localityDigests*/, nodes)
 
 	require.ElementsMatch(t, nodes, ranked)
 	require.Equal(t, executorID2, ranked[0].GetExecutorID())
@@ -87,7 +89,7 @@ func TestTaskRouter_RankNodes_DefaultNodeLimit_ReturnsOnlyLatestNodeMarkedComple
 
 	// Task should now be routed to executor 1.
 
-	ranked := router.RankNodes(ctx, cmd, instanceName, nodes)
+	ranked := router.RankNodes(ctx, cmd, instanceName, nil /*=localityDigests*/, nodes)
 
 	require.ElementsMatch(t, nodes, ranked)
 	require.Equal(t, executorID1, ranked[0].GetExecutorID())
@@ -96,7 +98,7 @@ func TestTaskRouter_RankNodes_DefaultNodeLimit_ReturnsOnlyLatestNodeMarkedComple
 
 	router.MarkComplete(ctx, cmd, instanceName, executorID2)
 
-	ranked = router.RankNodes(ctx, cmd, instanceName, nodes)
+	ranked = router.RankNodes(ctx, cmd, instanceName, nil /*=localityDigests*/, nodes)
 
 	// Task should now be routed to executor 2, but executor 1 should be ranked
 	// randomly, since we only store up to 1 recent executor for non-workflow
@@ -115,7 +117,7 @@ func TestTaskRouter_RankNodes_JustShufflesIfCommandIsNotAvailable(t *testing.T)
 	ctx := withAuthUser(t, context.Background(), env, "US1")
 	instanceName := ""
 
-	ranked := router.RankNodes(ctx, nil /*=cmd*/, instanceName, nodes)
+	ranked := router.RankNodes(ctx, nil /*=cmd*/, instanceName, nil /*=localityDigests*/, nodes)
 
 	requireReordered(t, nodes, ranked)
 }
@@ -172,13 +174,113 @@ func TestTaskRouter_MarkComplete_DoesNotAffectOtherRemoteInstances(t *testing.T)
 	requireNotAlwaysRanked(0, executorID1, t, router, ctx, cmd, instanceName2)
 }
 
+func TestTaskRouter_RankNodes_ByLocality(t *testing.T) {
+	env := newTestEnv(t)
+	router := newTaskRouter(t, env)
+	ctx := withAuthUser(t, context.Background(), env, "US1")
+	instanceName := "test-instance"
+
+	// Executor 1 has a small input in its file cache, and executor 2 a large
+	// one.
+	for id, hash := range map[string]string{executorID1: "small", executorID2: "large"} {
+		f := bloom.NewWithEstimates(10, 0.01, 1024)
+		f.Add(hash)
+		router.RecordFileCacheSketch(ctx, id, &scpb.FileCacheSketch{BloomFilter: f.Bytes(), NumHashes: int32(f.NumHashes())})
+	}
+	localityDigests := []*repb.Digest{
+		{Hash: "large", SizeBytes: 100e6},
+		{Hash: "small", SizeBytes: 1e6},
+	}
+
+	nodes := sequentiallyNumberedNodes(100)
+	ranked := router.RankNodes(ctx, &repb.Command{}, instanceName, localityDigests, nodes)
+
+	require.ElementsMatch(t, nodes, ranked)
+	require.Equal(t, executorID2, ranked[0].GetExecutorID())
+	require.Equal(t, executorID1, ranked[1].GetExecutorID())
+}
+
+func TestTaskRouter_RankNodes_ByLocality_SpreadsLoad(t *testing.T) {
+	env := newTestEnv(t)
+	router := newTaskRouter(t, env)
+	ctx := withAuthUser(t, context.Background(), env, "US1")
+	instanceName := "test-instance"
+
+	// Both executors have the input in their file cache.
+	for _, id := range []string{executorID1, executorID2} {
+		f := bloom.NewWithEstimates(10, 0.01, 1024)
+		f.Add("large")
+		router.RecordFileCacheSketch(ctx, id, &scpb.FileCacheSketch{BloomFilter: f.Bytes(), NumHashes: int32(f.NumHashes())})
+	}
+	localityDigests := []*repb.Digest{{Hash: "large", SizeBytes: 100e6}}
+	nodes := sequentiallyNumberedNodes(100)
+
+	// Tasks sharing the input alternate between the executors rather than
+	// all going to the same one.
+	first := router.RankNodes(ctx, &repb.Command{}, instanceName, localityDigests, nodes)[0].GetExecutorID()
+	second := router.RankNodes(ctx, &repb.Command{}, instanceName, localityDigests, nodes)[0].GetExecutorID()
+	require.ElementsMatch(t, []string{executorID1, executorID2}, []string{first, second})
+}
+
+func TestTaskRouter_ExpectedDuration(t *testing.T) {
+	env := newTestEnv(t)
+	router := newTaskRouter(t, env)
+	ctx := withAuthUser(t, context.Background(), env, "US1")
+	cmd := &repb.Command{
+		Platform: &repb.Platform{
+			Properties: []*repb.Platform_Property{
+				{Name: "speculative-retry", Value: "true"},
+			},
+		},
+	}
+	instanceName := "test-instance"
+
+	for i := 1; i <= 4; i++ {
+		router.RecordDuration(ctx, cmd, instanceName, time.Duration(i)*time.Second)
+	}
+
+	// Too few durations have been recorded to estimate the duration.
+
+	_, ok := router.ExpectedDuration(ctx, cmd, instanceName)
+	require.False(t, ok)
+
+	for i := 5; i <= 10; i++ {
+		router.RecordDuration(ctx, cmd, instanceName, time.Duration(i)*time.Second)
+	}
+
+	d, ok := router.ExpectedDuration(ctx, cmd, instanceName)
+	require.True(t, ok)
+	require.Equal(t, 9*time.Second, d)
+
+	// Durations are not shared with other groups.
+
+	ctx2 := withAuthUser(t, context.Background(), env, "US2")
+	_, ok = router.ExpectedDuration(ctx2, cmd, instanceName)
+	require.False(t, ok)
+}
+
+func TestTaskRouter_RecordDuration_IgnoresTasksWithoutSpeculativeRetry(t *testing.T) {
+	env := newTestEnv(t)
+	router := newTaskRouter(t, env)
+	ctx := withAuthUser(t, context.Background(), env, "US1")
+	cmd := &repb.Command{}
+	instanceName := ""
+
+	for i := 1; i <= 10; i++ {
+		router.RecordDuration(ctx, cmd, instanceName, time.Duration(i)*time.Second)
+	}
+
+	_, ok := router.ExpectedDuration(ctx, cmd, instanceName)
+	require.False(t, ok)
+}
+
 // requireNotAlwaysRanked requires that the task router does not
 // deterministically assign the given rank to the given executor ID.
 func requireNotAlwaysRanked(rank int, executorID string, t *testing.T, router interfaces.TaskRouter, ctx context.Context, cmd *repb.Command, instanceName string) {
 	nodes := sequentiallyNumberedNodes(100)
 	nTrials := 10
 	for i := 0; i < nTrials; i++ {
-		ranked := router.RankNodes(ctx, cmd, instanceName, nodes)
+		ranked := router.RankNodes(ctx, cmd, instanceName, nil /*=localityDigests*/, nodes)
 
 		require.Equal(t, len(nodes), len(ranked))
 		if ranked[rank].GetExecutorID() != executorID {
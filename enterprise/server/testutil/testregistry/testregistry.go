@@ -0,0 +1,300 @@
+// Package testregistry runs an in-process container registry for tests,
+// which serves the parts of the Docker Registry HTTP API V2 that are needed
+// to pull images.
+package testregistry
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/require"
+
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	token = "test-registry-token"
+)
+
+// Opts configures a test registry.
+type Opts struct {
+	// If Username is set, the registry requires clients to exchange these
+	// credentials for a bearer token before pulling any image.
+	Username string
+	Password string
+}
+
+// Registry is an in-process container registry.
+type Registry struct {
+	opts   Opts
+	server *httptest.Server
+
+	mu sync.Mutex
+	// manifests holds the manifests of each repository, keyed by
+	// "<repository>:<tag>" and "<repository>@<digest>".
+	manifests map[string]manifest
+	blobs     map[digest.Digest][]byte
+	// blobRequests counts the blob requests served for each digest.
+	blobRequests map[digest.Digest]int
+}
+
+type manifest struct {
+	mediaType string
+	content   []byte
+}
+
+// Run starts a registry which is stopped when the test finishes.
+func Run(t *testing.T, opts *Opts) *Registry {
+	r := &Registry{
+		manifests:    map[string]manifest{},
+		blobs:        map[digest.Digest][]byte{},
+		blobRequests: map[digest.Digest]int{},
+	}
+	if opts != nil {
+		r.opts = *opts
+	}
+	r.server = httptest.NewServer(http.HandlerFunc(r.serve))
+	t.Cleanup(r.server.Close)
+	return r
+}
+
+// Address returns the host and port of the registry, which image references
+// start with.
+func (r *Registry) Address() string {
+	return strings.TrimPrefix(r.server.URL, "http://")
+}
+
+// BlobRequests returns the number of times the registry has served the blob
+// with the given digest.
+func (r *Registry) BlobRequests(d digest.Digest) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.blobRequests[d]
+}
+
+// Layer describes the contents of an image layer, as a map of paths to file
+// contents. Paths that end in "/" are directories, and whiteout files such
+// as ".wh.foo" can be used to remove files in lower layers.
+type Layer map[string]string
+
+// LayerDigest returns the digest of the compressed layer that Push creates
+// for the given contents.
+func LayerDigest(t *testing.T, layer Layer) digest.Digest {
+	return digest.FromBytes(makeLayer(t, layer))
+}
+
+// Push adds an image with the given layers to the registry, and returns a
+// reference to it. The repository and tag are given as "<repository>:<tag>".
+func (r *Registry) Push(t *testing.T, repoAndTag string, layers ...Layer) string {
+	return r.push(t, repoAndTag, "", layers)
+}
+
+// PushIndex adds an image index to the registry, which refers to a
+// different image for each of the given architectures. It returns a
+// reference to the index.
+func (r *Registry) PushIndex(t *testing.T, repoAndTag string, images map[string][]Layer) string {
+	repo, tag := splitRepoAndTag(t, repoAndTag)
+	index := ocispec.Index{}
+	index.SchemaVersion = 2
+	archs := make([]string, 0, len(images))
+	for arch := range images {
+		archs = append(archs, arch)
+	}
+	sort.Strings(archs)
+	for _, arch := range archs {
+		ref := r.push(t, fmt.Sprintf("%s:%s-%s", repo, tag, arch), arch, images[arch])
+		d := digest.Digest(ref[strings.LastIndex(ref, "@")+1:])
+		r.mu.Lock()
+		m := r.manifests[repo+"@"+d.String()]
+		r.mu.Unlock()
+		index.Manifests = append(index.Manifests, ocispec.Descriptor{
+			MediaType: m.mediaType,
+			Digest:    d,
+			Size:      int64(len(m.content)),
+			Platform:  &ocispec.Platform{OS: "linux", Architecture: arch},
+		})
+	}
+	b, err := json.Marshal(index)
+	require.NoError(t, err)
+	r.putManifest(repo, tag, ocispec.MediaTypeImageIndex, b)
+	return fmt.Sprintf("%s/%s:%s", r.Address(), repo, tag)
+}
+
+// push adds an image to the registry and returns a reference to it by
+// digest.
+func (r *Registry) push(t *testing.T, repoAndTag, arch string, layers []Layer) string {
+	repo, tag := splitRepoAndTag(t, repoAndTag)
+	if arch == "" {
+		arch = "amd64"
+	}
+	config := ocispec.Image{
+		Architecture: arch,
+		OS:           "linux",
+		Config:       ocispec.ImageConfig{Env: []string{"PATH=/usr/bin:/bin"}},
+		RootFS:       ocispec.RootFS{Type: "layers"},
+	}
+	m := ocispec.Manifest{}
+	m.SchemaVersion = 2
+	for _, layer := range layers {
+		tarball := makeTar(t, layer)
+		compressed := gzipBytes(t, tarball)
+		config.RootFS.DiffIDs = append(config.RootFS.DiffIDs, digest.FromBytes(tarball))
+		m.Layers = append(m.Layers, r.putBlob(ocispec.MediaTypeImageLayerGzip, compressed))
+	}
+	b, err := json.Marshal(config)
+	require.NoError(t, err)
+	m.Config = r.putBlob(ocispec.MediaTypeImageConfig, b)
+	b, err = json.Marshal(m)
+	require.NoError(t, err)
+	d := r.putManifest(repo, tag, ocispec.MediaTypeImageManifest, b)
+	return fmt.Sprintf("%s/%s@%s", r.Address(), repo, d)
+}
+
+func splitRepoAndTag(t *testing.T, repoAndTag string) (string, string) {
+	i := strings.LastIndex(repoAndTag, ":")
+	require.Greater(t, i, 0, "image must be given as <repository>:<tag>")
+	return repoAndTag[:i], repoAndTag[i+1:]
+}
+
+func (r *Registry) putBlob(mediaType string, b []byte) ocispec.Descriptor {
+	d := digest.FromBytes(b)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.blobs[d] = b
+	return ocispec.Descriptor{MediaType: mediaType, Digest: d, Size: int64(len(b))}
+}
+
+func (r *Registry) putManifest(repo, tag, mediaType string, b []byte) digest.Digest {
+	d := digest.FromBytes(b)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	m := manifest{mediaType: mediaType, content: b}
+	r.manifests[repo+":"+tag] = m
+	r.manifests[repo+"@"+d.String()] = m
+	return d
+}
+
+func makeLayer(t *testing.T, layer Layer) []byte {
+	return gzipBytes(t, makeTar(t, layer))
+}
+
+func makeTar(t *testing.T, layer Layer) []byte {
+	names := make([]string, 0, len(layer))
+	for name := range layer {
+		names = append(names, name)
+	}
+	// Sorting the names puts directories before their contents, and makes
+	// the layer's digest deterministic.
+	sort.Strings(names)
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	for _, name := range names {
+		hdr := &tar.Header{
+			Name:     name,
+			Mode:     0644,
+			ModTime:  time.Unix(0, 0),
+			Typeflag: tar.TypeReg,
+			Size:     int64(len(layer[name])),
+		}
+		if strings.HasSuffix(name, "/") {
+			hdr.Mode = 0755
+			hdr.Typeflag = tar.TypeDir
+			hdr.Size = 0
+		}
+		require.NoError(t, tw.WriteHeader(hdr))
+		if hdr.Typeflag == tar.TypeReg {
+			_, err := tw.Write([]byte(layer[name]))
+			require.NoError(t, err)
+		}
+	}
+	require.NoError(t, tw.Close())
+	return buf.Bytes()
+}
+
+func gzipBytes(t *testing.T, b []byte) []byte {
+	buf := &bytes.Buffer{}
+	gz := gzip.NewWriter(buf)
+	_, err := gz.Write(b)
+	require.NoError(t, err)
+	require.NoError(t, gz.Close())
+	return buf.Bytes()
+}
+
+func (r *Registry) serve(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path == "/token" {
+		r.serveToken(w, req)
+		return
+	}
+	if !strings.HasPrefix(req.URL.Path, "/v2/") || req.Method != http.MethodGet {
+		http.NotFound(w, req)
+		return
+	}
+	if r.opts.Username != "" && req.Header.Get("Authorization") != "Bearer "+token {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="testregistry"`, r.server.URL))
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	path := strings.TrimPrefix(req.URL.Path, "/v2/")
+	if i := strings.LastIndex(path, "/manifests/"); i >= 0 {
+		r.serveManifest(w, path[:i], path[i+len("/manifests/"):])
+		return
+	}
+	if i := strings.LastIndex(path, "/blobs/"); i >= 0 {
+		r.serveBlob(w, digest.Digest(path[i+len("/blobs/"):]))
+		return
+	}
+	http.NotFound(w, req)
+}
+
+func (r *Registry) serveToken(w http.ResponseWriter, req *http.Request) {
+	username, password, ok := req.BasicAuth()
+	if !ok || username != r.opts.Username || password != r.opts.Password {
+		http.Error(w, "invalid credentials", http.StatusUnauthorized)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, `{"token": %q}`, token)
+}
+
+func (r *Registry) serveManifest(w http.ResponseWriter, repo, ref string) {
+	key := repo + ":" + ref
+	if _, err := digest.Parse(ref); err == nil {
+		key = repo + "@" + ref
+	}
+	r.mu.Lock()
+	m, ok := r.manifests[key]
+	r.mu.Unlock()
+	if !ok {
+		http.Error(w, "manifest unknown", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", m.mediaType)
+	w.Header().Set("Docker-Content-Digest", digest.FromBytes(m.content).String())
+	w.Write(m.content)
+}
+
+func (r *Registry) serveBlob(w http.ResponseWriter, d digest.Digest) {
+	r.mu.Lock()
+	b, ok := r.blobs[d]
+	if ok {
+		r.blobRequests[d]++
+	}
+	r.mu.Unlock()
+	if !ok {
+		http.Error(w, "blob unknown", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Write(b)
+}
@@ -0,0 +1,456 @@
+// Package cgroup manages cgroup v2 cgroups, which executors use to measure
+// and limit the resources used by actions.
+package cgroup
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+)
+
+const (
+	// RootPath is where the cgroup v2 hierarchy is mounted.
+	RootPath = "/sys/fs/cgroup"
+
+	// The period over which CPU limits are enforced.
+	cpuPeriod = 100 * time.Millisecond
+
+	// How long Remove waits for the processes in a cgroup to exit.
+	removeTimeout = 5 * time.Second
+)
+
+// The controllers that are enabled for the cgroups created by New.
+var controllers = []string{"cpu", "io", "memory", "pids"}
+
+// Limits are the resource limits of a cgroup. Zero values mean no limit.
+type Limits struct {
+	MemoryBytes int64
+	MilliCPU    int64
+	PIDs        int64
+}
+
+// Pressure is the pressure stall information (PSI) of a resource: how long
+// the processes in a cgroup were stalled waiting for it.
+type Pressure struct {
+	// The total time during which at least one process was stalled.
+	Some time.Duration
+	// The total time during which all processes were stalled.
+	Full time.Duration
+}
+
+// Usage is the resource usage of the processes in a cgroup, including those
+// that have already exited, over the lifetime of the cgroup.
+type Usage struct {
+	// The peak memory usage, or 0 if the kernel doesn't track it (Linux
+	// versions before 5.19).
+	PeakMemoryBytes int64
+	CPUNanos        int64
+	IOReadBytes     int64
+	IOWriteBytes    int64
+
+	CPUPressure    Pressure
+	MemoryPressure Pressure
+	IOPressure     Pressure
+
+	// The number of processes killed because the cgroup reached its memory
+	// limit.
+	OOMKills int64
+}
+
+// Sub returns the usage since base was measured. Since peak memory usage
+// can't be split, it is kept as is.
+func (u *Usage) Sub(base *Usage) *Usage {
+	sub := func(a, b Pressure) Pressure {
+		return Pressure{Some: a.Some - b.Some, Full: a.Full - b.Full}
+	}
+	return &Usage{
+		PeakMemoryBytes: u.PeakMemoryBytes,
+		CPUNanos:        u.CPUNanos - base.CPUNanos,
+		IOReadBytes:     u.IOReadBytes - base.IOReadBytes,
+		IOWriteBytes:    u.IOWriteBytes - base.IOWriteBytes,
+		CPUPressure:     sub(u.CPUPressure, base.CPUPressure),
+		MemoryPressure:  sub(u.MemoryPressure, base.MemoryPressure),
+		IOPressure:      sub(u.IOPressure, base.IOPressure),
+		OOMKills:        u.OOMKills - base.OOMKills,
+	}
+}
+
+// Cgroup is a cgroup v2 cgroup.
+type Cgroup struct {
+	// The absolute path of the cgroup in the cgroup filesystem.
+	path string
+}
+
+// New creates a cgroup named name below the cgroup at parentPath, which is a
+// path in the cgroup filesystem. The parent must not contain any processes,
+// since the cgroup's controllers are enabled in it.
+func New(parentPath, name string) (*Cgroup, error) {
+	if err := enableControllers(parentPath); err != nil {
+		return nil, status.UnavailableErrorf("could not enable cgroup controllers in %q: %s", parentPath, err)
+	}
+	path := filepath.Join(parentPath, name)
+	if err := os.Mkdir(path, 0755); err != nil {
+		return nil, status.UnavailableErrorf("could not create cgroup: %s", err)
+	}
+	return &Cgroup{path: path}, nil
+}
+
+// Open returns the existing cgroup with the given path relative to the root
+// of the cgroup hierarchy, such as the cgroup of a container.
+func Open(name string) (*Cgroup, error) {
+	path := filepath.Join(RootPath, name)
+	if _, err := os.Stat(filepath.Join(path, "cgroup.procs")); err != nil {
+		return nil, status.UnavailableErrorf("could not open cgroup %q: %s", name, err)
+	}
+	return &Cgroup{path: path}, nil
+}
+
+// enableControllers enables the available controllers for the children of
+// the cgroup at path.
+func enableControllers(path string) error {
+	available, err := os.ReadFile(filepath.Join(path, "cgroup.controllers"))
+	if err != nil {
+		return err
+	}
+	enabled, err := os.ReadFile(filepath.Join(path, "cgroup.subtree_control"))
+	if err != nil {
+		return err
+	}
+	var toEnable []string
+	for _, c := range controllers {
+		if contains(strings.Fields(string(available)), c) && !contains(strings.Fields(string(enabled)), c) {
+			toEnable = append(toEnable, "+"+c)
+		}
+	}
+	if len(toEnable) == 0 {
+		return nil
+	}
+	return os.WriteFile(filepath.Join(path, "cgroup.subtree_control"), []byte(strings.Join(toEnable, " ")), 0)
+}
+
+func contains(haystack []string, needle string) bool {
+	for _, s := range haystack {
+		if s == needle {
+			return true
+		}
+	}
+	return false
+}
+
+// Path returns the absolute path of the cgroup in the cgroup filesystem.
+func (c *Cgroup) Path() string {
+	return c.path
+}
+
+// Name returns the path of the cgroup relative to the root of the cgroup
+// hierarchy, such as "/buildbuddy/runner-1234", which is what container
+// runtimes expect as a cgroup parent.
+func (c *Cgroup) Name() string {
+	if rel, err := filepath.Rel(RootPath, c.path); err == nil && !strings.HasPrefix(rel, "..") {
+		return "/" + rel
+	}
+	return c.path
+}
+
+func (c *Cgroup) write(file, value string) error {
+	if err := os.WriteFile(filepath.Join(c.path, file), []byte(value), 0); err != nil {
+		return status.UnavailableErrorf("could not write %q to %s: %s", value, file, err)
+	}
+	return nil
+}
+
+func limitString(limit int64) string {
+	if limit <= 0 {
+		return "max"
+	}
+	return strconv.FormatInt(limit, 10)
+}
+
+// SetLimits sets the resource limits of the cgroup, replacing any previous
+// limits.
+func (c *Cgroup) SetLimits(limits *Limits) error {
+	if err := c.write("memory.max", limitString(limits.MemoryBytes)); err != nil {
+		return err
+	}
+	// Swapping would only slow down processes that reach the memory limit.
+	swapMax := "max"
+	if limits.MemoryBytes > 0 {
+		swapMax = "0"
+	}
+	if _, err := os.Stat(filepath.Join(c.path, "memory.swap.max")); err == nil {
+		if err := c.write("memory.swap.max", swapMax); err != nil {
+			return err
+		}
+	}
+	cpuMax := "max"
+	if limits.MilliCPU > 0 {
+		quota := limits.MilliCPU * cpuPeriod.Microseconds() / 1000
+		cpuMax = strconv.FormatInt(quota, 10)
+	}
+	if err := c.write("cpu.max", fmt.Sprintf("%s %d", cpuMax, cpuPeriod.Microseconds())); err != nil {
+		return err
+	}
+	return c.write("pids.max", limitString(limits.PIDs))
+}
+
+// AddProcess moves the process with the given pid into the cgroup. Children
+// that the process forks afterwards are in the cgroup too.
+func (c *Cgroup) AddProcess(pid int) error {
+	return c.write("cgroup.procs", strconv.Itoa(pid))
+}
+
+// PeakMemoryWatcher measures the peak memory usage of a cgroup since the
+// watcher was created.
+type PeakMemoryWatcher struct {
+	f *os.File
+}
+
+// WatchPeakMemory returns a watcher of the cgroup's peak memory usage from
+// now on, which allows measuring the peak of each of several tasks run in the
+// same cgroup. It returns nil (with no error) if the kernel can't reset the
+// peak memory usage of cgroups (Linux versions before 6.12).
+func (c *Cgroup) WatchPeakMemory() (*PeakMemoryWatcher, error) {
+	f, err := os.OpenFile(filepath.Join(c.path, "memory.peak"), os.O_RDWR, 0)
+	if os.IsNotExist(err) || os.IsPermission(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, status.UnavailableErrorf("could not open memory.peak: %s", err)
+	}
+	// Writing to memory.peak resets the peak as seen through this file
+	// descriptor only. Older kernels reject the write.
+	if _, err := f.WriteString("reset\n"); err != nil {
+		f.Close()
+		return nil, nil
+	}
+	return &PeakMemoryWatcher{f: f}, nil
+}
+
+// PeakMemoryBytes returns the peak memory usage since the watcher was
+// created.
+func (w *PeakMemoryWatcher) PeakMemoryBytes() (int64, error) {
+	buf := make([]byte, 32)
+	n, err := w.f.ReadAt(buf, 0)
+	if err != nil && err != io.EOF {
+		return 0, status.UnavailableErrorf("could not read memory.peak: %s", err)
+	}
+	peak, err := strconv.ParseInt(strings.TrimSpace(string(buf[:n])), 10, 64)
+	if err != nil {
+		return 0, status.InternalErrorf("could not parse memory.peak: %s", err)
+	}
+	return peak, nil
+}
+
+func (w *PeakMemoryWatcher) Close() error {
+	return w.f.Close()
+}
+
+// Usage returns the resource usage of the cgroup. Usage that the kernel
+// doesn't track, e.g. because a controller isn't enabled, is left as zero.
+func (c *Cgroup) Usage() (*Usage, error) {
+	u := &Usage{}
+	if b, err := c.read("memory.peak"); err != nil {
+		return nil, err
+	} else if len(b) > 0 {
+		n, err := strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64)
+		if err != nil {
+			return nil, status.InternalErrorf("could not parse memory.peak: %s", err)
+		}
+		u.PeakMemoryBytes = n
+	}
+	cpuStat, err := c.readKeyedFile("cpu.stat")
+	if err != nil {
+		return nil, err
+	}
+	u.CPUNanos = cpuStat["usage_usec"] * 1000
+	memoryEvents, err := c.readKeyedFile("memory.events")
+	if err != nil {
+		return nil, err
+	}
+	u.OOMKills = memoryEvents["oom_kill"]
+
+	// io.stat has a line per device, like "8:0 rbytes=1 wbytes=2 rios=3 ...".
+	ioStat, err := c.read("io.stat")
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range strings.Split(string(ioStat), "\n") {
+		for _, field := range strings.Fields(line) {
+			k, v, ok := cut(field, "=")
+			if !ok {
+				continue
+			}
+			n, _ := strconv.ParseInt(v, 10, 64)
+			switch k {
+			case "rbytes":
+				u.IOReadBytes += n
+			case "wbytes":
+				u.IOWriteBytes += n
+			}
+		}
+	}
+
+	for file, p := range map[string]*Pressure{"cpu.pressure": &u.CPUPressure, "memory.pressure": &u.MemoryPressure, "io.pressure": &u.IOPressure} {
+		if err := c.readPressure(file, p); err != nil {
+			return nil, err
+		}
+	}
+	return u, nil
+}
+
+// read returns the contents of the given file of the cgroup, or nothing if
+// it doesn't exist.
+func (c *Cgroup) read(file string) ([]byte, error) {
+	b, err := os.ReadFile(filepath.Join(c.path, file))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, status.UnavailableErrorf("could not read %s: %s", file, err)
+	}
+	return b, nil
+}
+
+// readKeyedFile reads a file made of "key value" lines, such as cpu.stat.
+func (c *Cgroup) readKeyedFile(file string) (map[string]int64, error) {
+	b, err := c.read(file)
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[string]int64)
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		n, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		values[fields[0]] = n
+	}
+	return values, nil
+}
+
+// readPressure reads a PSI file, which looks like:
+//
+//	some avg10=0.00 avg60=0.00 avg300=0.00 total=1234
+//	full avg10=0.00 avg60=0.00 avg300=0.00 total=567
+//
+// where totals are in microseconds.
+func (c *Cgroup) readPressure(file string, p *Pressure) error {
+	b, err := c.read(file)
+	if err != nil {
+		return err
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		for _, field := range fields[1:] {
+			k, v, ok := cut(field, "=")
+			if !ok || k != "total" {
+				continue
+			}
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return status.InternalErrorf("could not parse %s: %s", file, err)
+			}
+			switch fields[0] {
+			case "some":
+				p.Some = time.Duration(n) * time.Microsecond
+			case "full":
+				p.Full = time.Duration(n) * time.Microsecond
+			}
+		}
+	}
+	return nil
+}
+
+func cut(s, sep string) (string, string, bool) {
+	if i := strings.Index(s, sep); i >= 0 {
+		return s[:i], s[i+len(sep):], true
+	}
+	return s, "", false
+}
+
+// Remove kills all processes in the cgroup and its descendants, and removes
+// them.
+func (c *Cgroup) Remove() error {
+	// cgroup.kill is only supported by Linux 5.14 and later; otherwise the
+	// processes are killed one by one.
+	if err := c.write("cgroup.kill", "1"); err != nil {
+		if err := c.killProcesses(); err != nil {
+			return err
+		}
+	}
+	// Cgroups can only be removed once their processes have exited, and
+	// children first.
+	var dirs []string
+	err := filepath.Walk(c.path, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			dirs = append(dirs, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return status.UnavailableErrorf("could not list cgroups: %s", err)
+	}
+	sort.Slice(dirs, func(i, j int) bool { return len(dirs[i]) > len(dirs[j]) })
+	deadline := time.Now().Add(removeTimeout)
+	for _, dir := range dirs {
+		for {
+			err := syscall.Rmdir(dir)
+			if err == nil || os.IsNotExist(err) {
+				break
+			}
+			if err != syscall.EBUSY || time.Now().After(deadline) {
+				return status.UnavailableErrorf("could not remove cgroup %q: %s", dir, err)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	return nil
+}
+
+// killProcesses sends SIGKILL to all processes in the cgroup and its
+// descendants.
+func (c *Cgroup) killProcesses() error {
+	return filepath.Walk(c.path, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || info.Name() != "cgroup.procs" {
+			return nil
+		}
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		for _, field := range strings.Fields(string(b)) {
+			pid, err := strconv.Atoi(field)
+			if err != nil {
+				continue
+			}
+			if err := syscall.Kill(pid, syscall.SIGKILL); err != nil && err != syscall.ESRCH {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,135 @@
+package cgroup_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/util/cgroup"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// The cgroup filesystem is faked with regular files, since tests can't
+// assume that they are allowed to create cgroups.
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	for name, contents := range files {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(contents), 0644))
+	}
+}
+
+func readFile(t *testing.T, path string) string {
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	return string(b)
+}
+
+func newCgroup(t *testing.T) (string, *cgroup.Cgroup) {
+	parent := t.TempDir()
+	writeFiles(t, parent, map[string]string{
+		"cgroup.controllers":     "cpuset cpu io memory hugetlb pids rdma\n",
+		"cgroup.subtree_control": "cpu\n",
+	})
+	cg, err := cgroup.New(parent, "runner-1")
+	require.NoError(t, err)
+	assert.Equal(t, "+io +memory +pids", readFile(t, filepath.Join(parent, "cgroup.subtree_control")))
+	assert.Equal(t, filepath.Join(parent, "runner-1"), cg.Path())
+	return cg.Path(), cg
+}
+
+func TestSetLimits(t *testing.T) {
+	path, cg := newCgroup(t)
+	writeFiles(t, path, map[string]string{"memory.swap.max": "max"})
+
+	err := cg.SetLimits(&cgroup.Limits{MemoryBytes: 1e9, MilliCPU: 1500, PIDs: 100})
+	require.NoError(t, err)
+	assert.Equal(t, "1000000000", readFile(t, filepath.Join(path, "memory.max")))
+	assert.Equal(t, "0", readFile(t, filepath.Join(path, "memory.swap.max")))
+	assert.Equal(t, "150000 100000", readFile(t, filepath.Join(path, "cpu.max")))
+	assert.Equal(t, "100", readFile(t, filepath.Join(path, "pids.max")))
+
+	err = cg.SetLimits(&cgroup.Limits{})
+	require.NoError(t, err)
+	assert.Equal(t, "max", readFile(t, filepath.Join(path, "memory.max")))
+	assert.Equal(t, "max", readFile(t, filepath.Join(path, "memory.swap.max")))
+	assert.Equal(t, "max 100000", readFile(t, filepath.Join(path, "cpu.max")))
+	assert.Equal(t, "max", readFile(t, filepath.Join(path, "pids.max")))
+}
+
+func TestUsage(t *testing.T) {
+	path, cg := newCgroup(t)
+	writeFiles(t, path, map[string]string{
+		"memory.peak":     "123456\n",
+		"cpu.stat":        "usage_usec 2000\nuser_usec 1500\nsystem_usec 500\n",
+		"memory.events":   "low 0\nhigh 0\nmax 3\noom 1\noom_kill 1\n",
+		"io.stat":         "8:0 rbytes=100 wbytes=200 rios=1 wios=2 dbytes=0 dios=0\n8:16 rbytes=10 wbytes=20 rios=1 wios=1 dbytes=0 dios=0\n",
+		"cpu.pressure":    "some avg10=0.00 avg60=0.00 avg300=0.00 total=300\nfull avg10=0.00 avg60=0.00 avg300=0.00 total=100\n",
+		"memory.pressure": "some avg10=1.00 avg60=0.50 avg300=0.10 total=50\nfull avg10=0.00 avg60=0.00 avg300=0.00 total=40\n",
+	})
+
+	u, err := cg.Usage()
+	require.NoError(t, err)
+	assert.Equal(t, &cgroup.Usage{
+		PeakMemoryBytes: 123456,
+		CPUNanos:        2000000,
+		IOReadBytes:     110,
+		IOWriteBytes:    220,
+		CPUPressure:     cgroup.Pressure{Some: 300 * time.Microsecond, Full: 100 * time.Microsecond},
+		MemoryPressure:  cgroup.Pressure{Some: 50 * time.Microsecond, Full: 40 * time.Microsecond},
+		OOMKills:        1,
+	}, u)
+
+	base := &cgroup.Usage{
+		PeakMemoryBytes: 1000,
+		CPUNanos:        500000,
+		IOReadBytes:     10,
+		CPUPressure:     cgroup.Pressure{Some: 100 * time.Microsecond},
+		OOMKills:        1,
+	}
+	assert.Equal(t, &cgroup.Usage{
+		PeakMemoryBytes: 123456,
+		CPUNanos:        1500000,
+		IOReadBytes:     100,
+		IOWriteBytes:    220,
+		CPUPressure:     cgroup.Pressure{Some: 200 * time.Microsecond, Full: 100 * time.Microsecond},
+		MemoryPressure:  cgroup.Pressure{Some: 50 * time.Microsecond, Full: 40 * time.Microsecond},
+	}, u.Sub(base))
+}
+
+func TestUsage_MissingFiles(t *testing.T) {
+	_, cg := newCgroup(t)
+
+	u, err := cg.Usage()
+	require.NoError(t, err)
+	assert.Equal(t, &cgroup.Usage{}, u)
+}
+
+func TestWatchPeakMemory(t *testing.T) {
+	path, cg := newCgroup(t)
+
+	// Kernels without memory.peak can't reset it either.
+	w, err := cg.WatchPeakMemory()
+	require.NoError(t, err)
+	assert.Nil(t, w)
+
+	writeFiles(t, path, map[string]string{"memory.peak": "123456\n"})
+	w, err = cg.WatchPeakMemory()
+	require.NoError(t, err)
+	require.NotNil(t, w)
+	defer w.Close()
+	assert.Regexp(t, "^reset\n", readFile(t, filepath.Join(path, "memory.peak")))
+
+	// The kernel reports the peak since the reset through the watcher.
+	writeFiles(t, path, map[string]string{"memory.peak": "2048\n"})
+	peak, err := w.PeakMemoryBytes()
+	require.NoError(t, err)
+	assert.Equal(t, int64(2048), peak)
+}
+
+func TestName(t *testing.T) {
+	_, cg := newCgroup(t)
+
+	// Cgroups outside of the cgroup filesystem are named by their path.
+	assert.Equal(t, cg.Path(), cg.Name())
+}
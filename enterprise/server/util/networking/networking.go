@@ -254,6 +254,68 @@ func SetupVethPair(ctx context.Context, netNamespace, vmIP string, vmIdx int) (f
 	}, nil
 }
 
+// SetupNamespaceNetwork connects the given network namespace, such as that of
+// a container, to the host with a new veth pair, and routes its traffic out of
+// the host's default device. idx determines the addresses of the pair, and
+// must be unique among the namespaces that are currently set up this way. It
+// returns a cleanup function that removes firewall rules associated with the
+// pair; the pair itself is removed along with the namespace.
+//
+// It is equivalent to:
+//
+//  # create a new veth pair and move the veth1 end into the root namespace
+//  $ sudo ip netns exec ns0 ip link add veth1 type veth peer name veth0
+//  $ sudo ip netns exec ns0 ip link set veth1 netns 1
+//
+//  # address and bring up both ends of the pair
+//  $ sudo ip netns exec ns0 ip addr add 10.200.0.2/30 dev veth0
+//  $ sudo ip netns exec ns0 ip link set dev veth0 up
+//  $ sudo ip addr add 10.200.0.1/30 dev veth1
+//  $ sudo ip link set dev veth1 up
+//
+//  # bring up loopback and route all traffic through the host end
+//  $ sudo ip netns exec ns0 ip link set dev lo up
+//  $ sudo ip netns exec ns0 ip route add default via 10.200.0.1
+//
+//  # allow forwarding traffic from the pair to the default device
+//  $ sudo iptables -A FORWARD -i veth1 -o eth0 -j ACCEPT
+func SetupNamespaceNetwork(ctx context.Context, netNamespace string, idx int) (func(context.Context) error, error) {
+	defaultDevice, err := findDefaultDevice(ctx)
+	if err != nil {
+		return nil, err
+	}
+	veth0, veth1, err := createRandomVethPair(ctx, netNamespace)
+	if err != nil {
+		return nil, err
+	}
+
+	// Each pair gets its own /30 in 10.200.0.0/16, which leaves the ranges
+	// used for VMs alone.
+	idx %= 1 << 14
+	subnet := fmt.Sprintf("10.200.%d.%d", idx/64, (idx%64)*4)
+	hostAddr := fmt.Sprintf("10.200.%d.%d", idx/64, (idx%64)*4+1)
+	namespaceAddr := fmt.Sprintf("10.200.%d.%d", idx/64, (idx%64)*4+2)
+	log.Debugf("Connecting network namespace %q to the host with subnet %s/30", netNamespace, subnet)
+
+	for _, args := range [][]string{
+		namespace(netNamespace, "ip", "addr", "add", namespaceAddr+"/30", "dev", veth0),
+		namespace(netNamespace, "ip", "link", "set", "dev", veth0, "up"),
+		{"ip", "addr", "add", hostAddr + "/30", "dev", veth1},
+		{"ip", "link", "set", "dev", veth1, "up"},
+		namespace(netNamespace, "ip", "link", "set", "dev", "lo", "up"),
+		namespace(netNamespace, "ip", "route", "add", "default", "via", hostAddr),
+		{"iptables", "-A", "FORWARD", "-i", veth1, "-o", defaultDevice, "-j", "ACCEPT"},
+	} {
+		if err := runCommand(ctx, args...); err != nil {
+			return nil, err
+		}
+	}
+
+	return func(ctx context.Context) error {
+		return removeForwardAcceptRule(ctx, veth1, defaultDevice)
+	}, nil
+}
+
 // findDefaultDevice find's the device used for the default route.
 // Equivalent to "ip route | grep default | awk '{print $5}'"
 func findDefaultDevice(ctx context.Context) (string, error) {
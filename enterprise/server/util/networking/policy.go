@@ -0,0 +1,243 @@
+package networking
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+)
+
+// Mode is the kind of network access that an action is allowed.
+type Mode string
+
+const (
+	// Off means that the action has no network interfaces at all, where the
+	// isolation type allows it, and otherwise only a loopback interface.
+	Off Mode = "off"
+	// Loopback means that the action can only reach its own loopback
+	// interface.
+	Loopback Mode = "loopback"
+	// Egress means that the action can only open connections to an allowlist
+	// of hosts and CIDRs, and to its nameservers.
+	Egress Mode = "egress"
+	// Full means that the action has unrestricted network access.
+	Full Mode = "full"
+
+	dnsPort = 53
+)
+
+// Policy is the network access that an action is allowed.
+type Policy struct {
+	Mode Mode
+	// AllowedHosts are the hostnames, IP addresses and CIDRs that an action
+	// may connect to in Egress mode.
+	AllowedHosts []string
+}
+
+// ParsePolicy parses a policy from its string form, which is one of "off",
+// "loopback" or "full", or "egress:" followed by a comma-separated list of
+// hostnames, IP addresses and CIDRs, such as
+// "egress:github.com,10.0.0.0/8".
+func ParsePolicy(s string) (*Policy, error) {
+	mode, hosts, hasHosts := strings.TrimSpace(s), "", false
+	if i := strings.Index(mode, ":"); i >= 0 {
+		mode, hosts, hasHosts = mode[:i], mode[i+1:], true
+	}
+	p := &Policy{Mode: Mode(strings.ToLower(strings.TrimSpace(mode)))}
+	switch p.Mode {
+	case Off, Loopback, Full:
+		if hasHosts {
+			return nil, status.InvalidArgumentErrorf("network policy %q does not take a host allowlist", p.Mode)
+		}
+	case Egress:
+		for _, h := range strings.Split(hosts, ",") {
+			h = strings.ToLower(strings.TrimSpace(h))
+			if h == "" {
+				continue
+			}
+			if err := validateHost(h); err != nil {
+				return nil, err
+			}
+			p.AllowedHosts = append(p.AllowedHosts, h)
+		}
+		if len(p.AllowedHosts) == 0 {
+			return nil, status.InvalidArgumentError(`network policy "egress" requires a host allowlist, such as "egress:github.com,10.0.0.0/8"`)
+		}
+		sort.Strings(p.AllowedHosts)
+	default:
+		return nil, status.InvalidArgumentErrorf(`invalid network policy %q: must be one of "off", "loopback", "egress:<hosts>" or "full"`, s)
+	}
+	return p, nil
+}
+
+func validateHost(h string) error {
+	if _, _, err := net.ParseCIDR(h); err == nil {
+		return nil
+	}
+	if net.ParseIP(h) != nil {
+		return nil
+	}
+	// Hostnames are resolved when the action runs, so only check that they
+	// look like one.
+	for _, label := range strings.Split(h, ".") {
+		if label == "" || len(label) > 63 || strings.HasPrefix(label, "-") || strings.HasSuffix(label, "-") {
+			return status.InvalidArgumentErrorf("invalid host %q in network allowlist", h)
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-') {
+				return status.InvalidArgumentErrorf("invalid host %q in network allowlist", h)
+			}
+		}
+	}
+	return nil
+}
+
+// String returns the policy in the form accepted by ParsePolicy. Policies
+// that allow the same access have the same string form.
+func (p *Policy) String() string {
+	if p.Mode != Egress {
+		return string(p.Mode)
+	}
+	return string(Egress) + ":" + strings.Join(p.AllowedHosts, ",")
+}
+
+// NeedsInterface returns whether the policy requires a network interface
+// other than loopback.
+func (p *Policy) NeedsInterface() bool {
+	return p.Mode == Egress || p.Mode == Full
+}
+
+// ResolveAllowedNetworks resolves the allowlist of an Egress policy to the
+// networks that may be connected to. Hostnames are resolved to all of their
+// addresses, so the allowlist should be resolved shortly before the action
+// runs.
+func ResolveAllowedNetworks(ctx context.Context, p *Policy) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, h := range p.AllowedHosts {
+		if _, n, err := net.ParseCIDR(h); err == nil {
+			nets = append(nets, n)
+			continue
+		}
+		if ip := net.ParseIP(h); ip != nil {
+			nets = append(nets, hostNetwork(ip))
+			continue
+		}
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, h)
+		if err != nil {
+			return nil, status.UnavailableErrorf("resolve allowed host %q: %s", h, err)
+		}
+		for _, a := range addrs {
+			nets = append(nets, hostNetwork(a.IP))
+		}
+	}
+	return nets, nil
+}
+
+func hostNetwork(ip net.IP) *net.IPNet {
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+}
+
+// ParseNameservers returns the IPv4 addresses of the nameservers listed in
+// the contents of a resolv.conf file.
+func ParseNameservers(resolvConf []byte) []net.IP {
+	var nameservers []net.IP
+	for _, line := range strings.Split(string(resolvConf), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || fields[0] != "nameserver" {
+			continue
+		}
+		if ip := net.ParseIP(fields[1]).To4(); ip != nil {
+			nameservers = append(nameservers, ip)
+		}
+	}
+	return nameservers
+}
+
+// egressRules returns the iptables rules, in the given chain, that only let
+// matching packets through to the nameservers and the allowed networks.
+// matchArgs selects the packets that the rules apply to.
+func egressRules(chain string, matchArgs []string, nameservers []net.IP, allowed []*net.IPNet) [][]string {
+	rule := func(args ...string) []string {
+		r := append([]string{"-A", chain}, matchArgs...)
+		return append(r, args...)
+	}
+	rules := [][]string{
+		rule("-m", "conntrack", "--ctstate", "ESTABLISHED,RELATED", "-j", "ACCEPT"),
+	}
+	for _, ns := range nameservers {
+		rules = append(rules,
+			rule("-d", ns.String(), "-p", "udp", "--dport", strconv.Itoa(dnsPort), "-j", "ACCEPT"),
+			rule("-d", ns.String(), "-p", "tcp", "--dport", strconv.Itoa(dnsPort), "-j", "ACCEPT"),
+		)
+	}
+	for _, n := range allowed {
+		// IPv6 traffic is blocked outright below, so only IPv4 networks
+		// need rules.
+		if n.IP.To4() == nil {
+			continue
+		}
+		rules = append(rules, rule("-d", n.String(), "-j", "ACCEPT"))
+	}
+	return append(rules, rule("-j", "REJECT"))
+}
+
+// RestrictForwardedEgressInNamespace only lets traffic that is forwarded from
+// the given device in the network namespace reach the nameservers and the
+// allowed networks. It is equivalent to:
+//  $ sudo ip netns exec "netNamespace" iptables -A FORWARD -i "device" -m conntrack --ctstate ESTABLISHED,RELATED -j ACCEPT
+//  # for each nameserver
+//  $ sudo ip netns exec "netNamespace" iptables -A FORWARD -i "device" -d "nameserver" -p udp --dport 53 -j ACCEPT
+//  $ sudo ip netns exec "netNamespace" iptables -A FORWARD -i "device" -d "nameserver" -p tcp --dport 53 -j ACCEPT
+//  # for each allowed network
+//  $ sudo ip netns exec "netNamespace" iptables -A FORWARD -i "device" -d "network" -j ACCEPT
+//  $ sudo ip netns exec "netNamespace" iptables -A FORWARD -i "device" -j REJECT
+//  $ sudo ip netns exec "netNamespace" ip6tables -A FORWARD -i "device" -j REJECT
+func RestrictForwardedEgressInNamespace(ctx context.Context, netNamespace, device string, nameservers []net.IP, allowed []*net.IPNet) error {
+	match := []string{"-i", device}
+	for _, r := range egressRules("FORWARD", match, nameservers, allowed) {
+		if err := runCommand(ctx, namespace(netNamespace, append([]string{"iptables"}, r...)...)...); err != nil {
+			return err
+		}
+	}
+	return runCommand(ctx, namespace(netNamespace, "ip6tables", "-A", "FORWARD", "-i", device, "-j", "REJECT")...)
+}
+
+// RestrictEgressOfProcess only lets the network namespace of the process with
+// the given pid, such as the init process of a container, reach its loopback
+// interface, the nameservers in the process's /etc/resolv.conf and the
+// allowed networks. It is equivalent to:
+//  $ sudo cat /proc/"pid"/root/etc/resolv.conf
+//  $ sudo nsenter --target "pid" --net iptables -A OUTPUT -o lo -j ACCEPT
+//  $ sudo nsenter --target "pid" --net iptables -A OUTPUT -m conntrack --ctstate ESTABLISHED,RELATED -j ACCEPT
+//  # for each nameserver
+//  $ sudo nsenter --target "pid" --net iptables -A OUTPUT -d "nameserver" -p udp --dport 53 -j ACCEPT
+//  $ sudo nsenter --target "pid" --net iptables -A OUTPUT -d "nameserver" -p tcp --dport 53 -j ACCEPT
+//  # for each allowed network
+//  $ sudo nsenter --target "pid" --net iptables -A OUTPUT -d "network" -j ACCEPT
+//  $ sudo nsenter --target "pid" --net iptables -A OUTPUT -j REJECT
+//  $ sudo nsenter --target "pid" --net ip6tables -A OUTPUT ! -o lo -j REJECT
+func RestrictEgressOfProcess(ctx context.Context, pid int, allowed []*net.IPNet) error {
+	// A missing resolv.conf just means that the process can't resolve
+	// hostnames, so no nameservers are allowed.
+	resolvConf, err := sudoCommand(ctx, "cat", fmt.Sprintf("/proc/%d/root/etc/resolv.conf", pid))
+	if err != nil {
+		log.Debugf("Failed to read resolv.conf of process %d: %s", pid, err)
+	}
+	nsenter := []string{"nsenter", "--target", strconv.Itoa(pid), "--net"}
+	rules := append([][]string{{"-A", "OUTPUT", "-o", "lo", "-j", "ACCEPT"}}, egressRules("OUTPUT", nil, ParseNameservers(resolvConf), allowed)...)
+	for _, r := range rules {
+		args := append(append([]string{}, nsenter...), "iptables")
+		if err := runCommand(ctx, append(args, r...)...); err != nil {
+			return err
+		}
+	}
+	return runCommand(ctx, append(nsenter, "ip6tables", "-A", "OUTPUT", "!", "-o", "lo", "-j", "REJECT")...)
+}
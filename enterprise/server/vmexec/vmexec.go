@@ -3,18 +3,25 @@ package vmexec
 import (
 	"bytes"
 	"context"
+	"encoding/binary"
 	"fmt"
+	"io"
+	"os"
 	"os/exec"
 	"sync"
+	"sync/atomic"
 	"syscall"
+	"unsafe"
 
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/commandutil"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/util/cgroup"
 	"github.com/buildbuddy-io/buildbuddy/server/util/log"
 	"github.com/buildbuddy-io/buildbuddy/server/util/status"
 	"github.com/golang/protobuf/ptypes"
 	"github.com/vishvananda/netlink"
 	"golang.org/x/sys/unix"
 
+	espb "github.com/buildbuddy-io/buildbuddy/proto/execution_stats"
 	vmxpb "github.com/buildbuddy-io/buildbuddy/proto/vmexec"
 	gstatus "google.golang.org/grpc/status"
 )
@@ -28,10 +35,16 @@ const (
 	// workspaceMountPath is the path where the hot-swappable workspace block
 	// device is mounted.
 	workspaceMountPath = "/workspace"
+
+	// cgroupRoot is where the cgroup v2 hierarchy is mounted.
+	cgroupRoot = "/sys/fs/cgroup/unified"
 )
 
 type execServer struct {
 	reapMutex *sync.RWMutex
+	// execCount is the number of commands that have been run, which names
+	// their cgroups.
+	execCount int64
 }
 
 func NewServer(reapMutex *sync.RWMutex) (*execServer, error) {
@@ -72,6 +85,32 @@ func clearARPCache() error {
 	return nil
 }
 
+// addEntropy adds b to the kernel's entropy pool, crediting all of it, and
+// reseeds the kernel's random number generator from the pool.
+func addEntropy(b []byte) error {
+	f, err := os.OpenFile("/dev/urandom", os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	// struct rand_pool_info {
+	//   int entropy_count; // in bits
+	//   int buf_size;      // in bytes
+	//   __u32 buf[];
+	// };
+	info := make([]byte, 8+len(b))
+	binary.LittleEndian.PutUint32(info[0:], uint32(len(b)*8))
+	binary.LittleEndian.PutUint32(info[4:], uint32(len(b)))
+	copy(info[8:], b)
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, f.Fd(), unix.RNDADDENTROPY, uintptr(unsafe.Pointer(&info[0]))); errno != 0 {
+		return status.InternalErrorf("failed to add entropy: %s", errno)
+	}
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, f.Fd(), unix.RNDRESEEDCRNG, 0); errno != 0 {
+		return status.InternalErrorf("failed to reseed random number generator: %s", errno)
+	}
+	return nil
+}
+
 func (x *execServer) Initialize(ctx context.Context, req *vmxpb.InitializeRequest) (*vmxpb.InitializeResponse, error) {
 	if req.GetClearArpCache() {
 		if err := clearARPCache(); err != nil {
@@ -79,6 +118,12 @@ func (x *execServer) Initialize(ctx context.Context, req *vmxpb.InitializeReques
 		}
 		log.Debugf("Cleared ARP cache")
 	}
+	if len(req.GetEntropy()) > 0 {
+		if err := addEntropy(req.GetEntropy()); err != nil {
+			return nil, err
+		}
+		log.Debugf("Added %d bytes of entropy", len(req.GetEntropy()))
+	}
 	if req.GetUnixTimestampNanoseconds() > 1 {
 		tv := syscall.NsecToTimeval(req.GetUnixTimestampNanoseconds())
 		if err := syscall.Settimeofday(&tv); err != nil {
@@ -104,6 +149,60 @@ func (x *execServer) MountWorkspace(ctx context.Context, req *vmxpb.MountWorkspa
 }
 
 func (x *execServer) Exec(ctx context.Context, req *vmxpb.ExecRequest) (*vmxpb.ExecResponse, error) {
+	var stdout, stderr bytes.Buffer
+	rsp, err := x.exec(ctx, req, &stdout, &stderr)
+	if err != nil {
+		return nil, err
+	}
+	rsp.Stdout = stdout.Bytes()
+	rsp.Stderr = stderr.Bytes()
+	return rsp, nil
+}
+
+func (x *execServer) ExecStreamed(req *vmxpb.ExecRequest, stream vmxpb.Exec_ExecStreamedServer) error {
+	s := &outputStream{stream: stream}
+	rsp, err := x.exec(stream.Context(), req, &outputWriter{s: s}, &outputWriter{s: s, stderr: true})
+	if err != nil {
+		return err
+	}
+	return s.send(&vmxpb.ExecStreamedResponse{Response: rsp})
+}
+
+// outputStream sends the output of a command over an ExecStreamed stream.
+type outputStream struct {
+	mu     sync.Mutex // protects(stream)
+	stream vmxpb.Exec_ExecStreamedServer
+}
+
+func (s *outputStream) send(msg *vmxpb.ExecStreamedResponse) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stream.Send(msg)
+}
+
+// outputWriter writes to either the stdout or stderr of an outputStream.
+type outputWriter struct {
+	s      *outputStream
+	stderr bool
+}
+
+func (w *outputWriter) Write(p []byte) (int, error) {
+	// The message may be used after Send returns, and the caller may reuse
+	// p, so send a copy.
+	b := append([]byte(nil), p...)
+	msg := &vmxpb.ExecStreamedResponse{Stdout: b}
+	if w.stderr {
+		msg = &vmxpb.ExecStreamedResponse{Stderr: b}
+	}
+	if err := w.s.send(msg); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// exec runs the command of an exec request, writing its output to stdout and
+// stderr.
+func (x *execServer) exec(ctx context.Context, req *vmxpb.ExecRequest, stdout, stderr io.Writer) (*vmxpb.ExecResponse, error) {
 	if len(req.GetArguments()) < 1 {
 		return nil, status.InvalidArgumentError("Arguments not specified")
 	}
@@ -136,9 +235,8 @@ func (x *execServer) Exec(ctx context.Context, req *vmxpb.ExecRequest) (*vmxpb.E
 	// TODO(tylerw): use syncfs or something better here.
 	defer unix.Sync()
 
-	var stdoutBuf, stderrBuf bytes.Buffer
-	cmd.Stdout = &stdoutBuf
-	cmd.Stderr = &stderrBuf
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
 	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
 	for _, envVar := range req.GetEnvironmentVariables() {
 		cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", envVar.GetName(), envVar.GetValue()))
@@ -147,13 +245,43 @@ func (x *execServer) Exec(ctx context.Context, req *vmxpb.ExecRequest) (*vmxpb.E
 	x.reapMutex.RLock()
 	defer x.reapMutex.RUnlock()
 
+	// Each command runs in its own cgroup, so that its resource usage,
+	// including its peak memory usage, can be measured even though the VM
+	// may be reused for many commands.
+	cg, err := cgroup.New(cgroupRoot, fmt.Sprintf("exec-%d", atomic.AddInt64(&x.execCount, 1)))
+	if err != nil {
+		log.Warningf("Failed to create cgroup, resource usage will not be measured: %s", err)
+		cg = nil
+	}
+
 	log.Debugf("Running command in VM: %q", cmd.String())
-	err := commandutil.RunWithProcessTreeCleanup(ctx, cmd)
+	err = commandutil.RunWithProcessTreeCleanupInCgroup(ctx, cmd, cg)
 	exitCode, err := commandutil.ExitCode(ctx, cmd, err)
 	rsp := &vmxpb.ExecResponse{}
 	rsp.ExitCode = int32(exitCode)
 	rsp.Status = gstatus.Convert(err).Proto()
-	rsp.Stdout = stdoutBuf.Bytes()
-	rsp.Stderr = stderrBuf.Bytes()
+	rsp.UsageStats = commandutil.UsageStats(cmd.ProcessState)
+	if cg != nil {
+		rsp.UsageStats = cgroupUsageStats(cg, rsp.UsageStats)
+		if err := cg.Remove(); err != nil {
+			log.Warningf("Failed to remove cgroup: %s", err)
+		}
+	}
 	return rsp, nil
 }
+
+// cgroupUsageStats returns the resources used by the processes in cg, falling
+// back to the given stats of the command's process if the cgroup's usage can't
+// be read or its peak memory usage isn't tracked.
+func cgroupUsageStats(cg *cgroup.Cgroup, processStats *espb.UsageStats) *espb.UsageStats {
+	usage, err := cg.Usage()
+	if err != nil {
+		log.Warningf("Failed to read cgroup usage: %s", err)
+		return processStats
+	}
+	stats := commandutil.CgroupUsageStats(usage)
+	if stats.GetPeakMemoryBytes() == 0 {
+		stats.PeakMemoryBytes = processStats.GetPeakMemoryBytes()
+	}
+	return stats
+}
@@ -706,6 +706,9 @@ func (z *AzureBlobStore) DeleteBlob(ctx context.Context, blobName string) error
 	_, err := blobURL.Delete(ctx, azblob.DeleteSnapshotsOptionNone, azblob.BlobAccessConditions{})
 	spn.End()
 	recordDeleteMetrics(azureLabel, start, err)
+	if z.isAzureError(err, azblob.ServiceCodeBlobNotFound) {
+		return nil
+	}
 	return err
 }
 
@@ -3,6 +3,7 @@ package invocationdb
 import (
 	"context"
 	"errors"
+	"strings"
 	"time"
 
 	"github.com/buildbuddy-io/buildbuddy/server/environment"
@@ -147,6 +148,26 @@ func (d *InvocationDB) UpdateInvocationACL(ctx context.Context, authenticatedUse
 	})
 }
 
+func (d *InvocationDB) SetInvocationLegalHold(ctx context.Context, authenticatedUser *interfaces.UserInfo, invocationID string, legalHold bool) error {
+	if authenticatedUser == nil {
+		return status.InvalidArgumentError("authenticatedUser cannot be nil.")
+	}
+	u := *authenticatedUser
+	return d.h.Transaction(ctx, func(tx *db.DB) error {
+		var in tables.Invocation
+		if err := tx.Raw(`SELECT group_id FROM Invocations WHERE invocation_id = ?`, invocationID).Take(&in).Error; err != nil {
+			return err
+		}
+		// Legal holds are managed by the admins of the group owning the
+		// invocation, so unlike other writes, the invocation owner being
+		// the authenticated user is not sufficient.
+		if in.GroupID == "" || u.GetGroupID() != in.GroupID {
+			return status.PermissionDeniedError("You do not have permission to perform this action.")
+		}
+		return tx.Exec(`UPDATE Invocations SET legal_hold = ? WHERE invocation_id = ?`, legalHold, invocationID).Error
+	})
+}
+
 func (d *InvocationDB) LookupInvocation(ctx context.Context, invocationID string) (*tables.Invocation, error) {
 	ti := &tables.Invocation{}
 	if err := d.h.DB(ctx).Raw(`SELECT * FROM Invocations WHERE invocation_id = ?`, invocationID).Take(ti).Error; err != nil {
@@ -190,11 +211,68 @@ func (d *InvocationDB) LookupGroupIDFromInvocation(ctx context.Context, invocati
 	return in.GroupID, nil
 }
 
-func (d *InvocationDB) LookupExpiredInvocations(ctx context.Context, cutoffTime time.Time, limit int) ([]*tables.Invocation, error) {
-	cutoffUsec := cutoffTime.UnixMicro()
-	rows, err := d.h.DB(ctx).Raw(`SELECT * FROM Invocations as i
-                                      WHERE i.created_at_usec < ?
-                                      LIMIT ?`, cutoffUsec, limit).Rows()
+// expiryFilterClause returns a SQL clause matching the invocations selected
+// by the group and role of the filter, or an empty clause if the filter
+// matches all invocations.
+func expiryFilterClause(filter *interfaces.InvocationExpiryFilter) (string, []interface{}) {
+	var clauses []string
+	var args []interface{}
+	if filter.GroupID != "" {
+		clauses = append(clauses, `i.group_id = ?`)
+		args = append(args, filter.GroupID)
+	}
+	if filter.Role != "" {
+		clauses = append(clauses, `i.role = ?`)
+		args = append(args, filter.Role)
+	}
+	return strings.Join(clauses, " AND "), args
+}
+
+func (d *InvocationDB) LookupExpiredInvocations(ctx context.Context, cutoffTime time.Time, filter *interfaces.InvocationExpiryFilter, limit int) ([]*tables.Invocation, error) {
+	if filter == nil {
+		filter = &interfaces.InvocationExpiryFilter{}
+	}
+	q := query_builder.NewQuery(`SELECT * FROM Invocations as i`)
+	q.AddWhereClause(`i.created_at_usec < ?`, cutoffTime.UnixMicro())
+	q.AddWhereClause(`i.legal_hold = ?`, false)
+	if clause, args := expiryFilterClause(filter); clause != "" {
+		q.AddWhereClause(clause, args...)
+	}
+	for _, ex := range filter.Exclude {
+		clause, args := expiryFilterClause(ex)
+		if clause == "" {
+			// Everything is excluded.
+			return nil, nil
+		}
+		q.AddWhereClause(`NOT (`+clause+`)`, args...)
+	}
+	if len(filter.ExcludeInvocationIDs) > 0 {
+		params := make([]string, 0, len(filter.ExcludeInvocationIDs))
+		args := make([]interface{}, 0, len(filter.ExcludeInvocationIDs))
+		for _, id := range filter.ExcludeInvocationIDs {
+			params = append(params, "?")
+			args = append(args, id)
+		}
+		q.AddWhereClause(`i.invocation_id NOT IN (`+strings.Join(params, ", ")+`)`, args...)
+	}
+	if filter.PendingDataFlags != 0 {
+		q.AddWhereClause(`(i.deleted_data_flags & ?) != ?`, filter.PendingDataFlags, filter.PendingDataFlags)
+	}
+	if filter.FailedDataFlags != 0 {
+		var clauses []string
+		var args []interface{}
+		for _, f := range []int{tables.InvocationEventLogsDataFlag, tables.InvocationBlobsDataFlag} {
+			if filter.FailedDataFlags&f == 0 {
+				continue
+			}
+			clauses = append(clauses, `((i.deleted_data_flags & ?) != 0 AND (i.deleted_data_flags & ?) = 0)`)
+			args = append(args, tables.DeletionFailedDataFlags(f), f)
+		}
+		q.AddWhereClause(`(`+strings.Join(clauses, " OR ")+`)`, args...)
+	}
+	q.SetLimit(int64(limit))
+	queryStr, args := q.Build()
+	rows, err := d.h.DB(ctx).Raw(queryStr, args...).Rows()
 	if err != nil {
 		return nil, err
 	}
@@ -212,6 +290,10 @@ func (d *InvocationDB) LookupExpiredInvocations(ctx context.Context, cutoffTime
 	return invocations, nil
 }
 
+func (d *InvocationDB) MarkInvocationDataDeleted(ctx context.Context, invocationID string, dataFlags int) error {
+	return d.h.DB(ctx).Exec(`UPDATE Invocations SET deleted_data_flags = (deleted_data_flags | ?) WHERE invocation_id = ?`, dataFlags, invocationID).Error
+}
+
 func (d *InvocationDB) FillCounts(ctx context.Context, stat *telpb.TelemetryStat) error {
 	counts := d.h.DB(ctx).Raw(`
 		SELECT 
@@ -239,13 +321,16 @@ func (d *InvocationDB) DeleteInvocation(ctx context.Context, invocationID string
 func (d *InvocationDB) DeleteInvocationWithPermsCheck(ctx context.Context, authenticatedUser *interfaces.UserInfo, invocationID string) error {
 	return d.h.Transaction(ctx, func(tx *db.DB) error {
 		var in tables.Invocation
-		if err := tx.Raw(`SELECT user_id, group_id, perms FROM Invocations WHERE invocation_id = ?`, invocationID).Take(&in).Error; err != nil {
+		if err := tx.Raw(`SELECT user_id, group_id, perms, legal_hold FROM Invocations WHERE invocation_id = ?`, invocationID).Take(&in).Error; err != nil {
 			return err
 		}
 		acl := perms.ToACLProto(&uidpb.UserId{Id: in.UserID}, in.GroupID, in.Perms)
 		if err := perms.AuthorizeWrite(authenticatedUser, acl); err != nil {
 			return err
 		}
+		if in.LegalHold {
+			return status.FailedPreconditionError("Invocations under legal hold cannot be deleted.")
+		}
 		if err := tx.Exec(`DELETE FROM Invocations WHERE invocation_id = ?`, invocationID).Error; err != nil {
 			return err
 		}
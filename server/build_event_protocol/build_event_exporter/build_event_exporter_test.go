@@ -0,0 +1,372 @@
+package build_event_exporter_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/build_event_exporter"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+
+	bexpb "github.com/buildbuddy-io/buildbuddy/proto/build_event_export"
+	inpb "github.com/buildbuddy-io/buildbuddy/proto/invocation"
+)
+
+func testEvent(seq int64) *bexpb.ExportedBuildEvent {
+	return &bexpb.ExportedBuildEvent{
+		InvocationId: "a2cb5d0e-9e0c-4b6c-a47c-0c5b9f4f6b19",
+		Attempt:      1,
+		GroupId:      "GR1",
+		Event:        &inpb.InvocationEvent{SequenceNumber: seq},
+	}
+}
+
+func sequenceNumbers(events []*bexpb.ExportedBuildEvent) []int64 {
+	var seqs []int64
+	for _, e := range events {
+		seqs = append(seqs, e.GetEvent().GetSequenceNumber())
+	}
+	return seqs
+}
+
+type fakeSink struct {
+	mu        sync.Mutex
+	failures  int
+	published []*bexpb.ExportedBuildEvent
+
+	// If set, Publish signals started and waits for release before returning.
+	started chan struct{}
+	release chan struct{}
+}
+
+func (s *fakeSink) Publish(ctx context.Context, events []*bexpb.ExportedBuildEvent) error {
+	if s.started != nil {
+		s.started <- struct{}{}
+		<-s.release
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.failures > 0 {
+		s.failures--
+		return status.UnavailableError("sink unavailable")
+	}
+	s.published = append(s.published, events...)
+	return nil
+}
+
+func (s *fakeSink) Close() error {
+	return nil
+}
+
+func (s *fakeSink) Published() []*bexpb.ExportedBuildEvent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.published
+}
+
+func shutdown(t *testing.T, e *build_event_exporter.Exporter) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err := e.Shutdown(ctx)
+	require.NoError(t, err)
+}
+
+func TestExporter_RetriesFailedBatches(t *testing.T) {
+	sink := &fakeSink{failures: 2}
+	e := build_event_exporter.NewExporter(sink, 100, 10, nil /*=overflow*/)
+	e.Start()
+
+	for i := int64(1); i <= 3; i++ {
+		e.Export(testEvent(i))
+	}
+	shutdown(t, e)
+
+	assert.Equal(t, []int64{1, 2, 3}, sequenceNumbers(sink.Published()))
+}
+
+func TestExporter_DropsEventsWhenQueueIsFull(t *testing.T) {
+	sink := &fakeSink{
+		started: make(chan struct{}),
+		release: make(chan struct{}),
+	}
+	e := build_event_exporter.NewExporter(sink, 2, 1, nil /*=overflow*/)
+	e.Start()
+
+	e.Export(testEvent(1))
+	// Wait for the first event to be dequeued and stuck in the sink.
+	<-sink.started
+	// The queue holds 2 events; the 4th one must be dropped without waiting
+	// for the sink.
+	for i := int64(2); i <= 4; i++ {
+		e.Export(testEvent(i))
+	}
+	go func() {
+		for range sink.started {
+		}
+	}()
+	close(sink.release)
+	shutdown(t, e)
+	close(sink.started)
+
+	assert.Equal(t, []int64{1, 2, 3}, sequenceNumbers(sink.Published()))
+}
+
+func TestExporter_SpoolsEventsWhenQueueIsFull(t *testing.T) {
+	sink := &fakeSink{
+		started: make(chan struct{}),
+		release: make(chan struct{}),
+	}
+	dir := t.TempDir()
+	overflow, err := build_event_exporter.NewFileSink(dir, 1_000_000)
+	require.NoError(t, err)
+	e := build_event_exporter.NewExporter(sink, 2, 1, overflow)
+	e.Start()
+
+	e.Export(testEvent(1))
+	// Wait for the first event to be dequeued and stuck in the sink.
+	<-sink.started
+	// The queue holds 2 events; the 4th and 5th ones must be spooled without
+	// waiting for the sink.
+	for i := int64(2); i <= 5; i++ {
+		e.Export(testEvent(i))
+	}
+	go func() {
+		for range sink.started {
+		}
+	}()
+	close(sink.release)
+	shutdown(t, e)
+	close(sink.started)
+
+	assert.Equal(t, []int64{1, 2, 3}, sequenceNumbers(sink.Published()))
+	paths, err := filepath.Glob(filepath.Join(dir, "*.spool"))
+	require.NoError(t, err)
+	require.Len(t, paths, 1)
+	assert.Equal(t, []int64{4, 5}, sequenceNumbers(readSpoolFile(t, paths[0])))
+}
+
+func readSpoolFile(t *testing.T, path string) []*bexpb.ExportedBuildEvent {
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	var events []*bexpb.ExportedBuildEvent
+	for len(b) > 0 {
+		size, n := binary.Uvarint(b)
+		require.Greater(t, n, 0)
+		b = b[n:]
+		event := &bexpb.ExportedBuildEvent{}
+		err := proto.Unmarshal(b[:size], event)
+		require.NoError(t, err)
+		events = append(events, event)
+		b = b[size:]
+	}
+	return events
+}
+
+func TestFileSink(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	// Small enough for each batch to complete a file.
+	sink, err := build_event_exporter.NewFileSink(dir, 1)
+	require.NoError(t, err)
+
+	err = sink.Publish(ctx, []*bexpb.ExportedBuildEvent{testEvent(1), testEvent(2)})
+	require.NoError(t, err)
+	// Make sure spool file names don't collide.
+	time.Sleep(time.Millisecond)
+	err = sink.Publish(ctx, []*bexpb.ExportedBuildEvent{testEvent(3)})
+	require.NoError(t, err)
+	err = sink.Close()
+	require.NoError(t, err)
+
+	paths, err := filepath.Glob(filepath.Join(dir, "*"))
+	require.NoError(t, err)
+	require.Len(t, paths, 2)
+	sort.Strings(paths)
+	var events []*bexpb.ExportedBuildEvent
+	for _, path := range paths {
+		require.True(t, strings.HasSuffix(path, ".spool"), "%s is not a completed spool file", path)
+		events = append(events, readSpoolFile(t, path)...)
+	}
+	assert.Equal(t, []int64{1, 2, 3}, sequenceNumbers(events))
+	assert.True(t, proto.Equal(testEvent(1), events[0]))
+}
+
+func TestKafkaSink(t *testing.T) {
+	var mu sync.Mutex
+	var received []*bexpb.ExportedBuildEvent
+	fail := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v2/topics/build-events", r.URL.Path)
+		assert.Equal(t, "application/vnd.kafka.binary.v2+json", r.Header.Get("Content-Type"))
+		req := &struct {
+			Records []struct {
+				Key   []byte `json:"key"`
+				Value []byte `json:"value"`
+			} `json:"records"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		var offsets []string
+		for i, rec := range req.Records {
+			event := &bexpb.ExportedBuildEvent{}
+			err := proto.Unmarshal(rec.Value, event)
+			assert.NoError(t, err)
+			assert.Equal(t, event.GetInvocationId(), string(rec.Key))
+			received = append(received, event)
+			if fail {
+				offsets = append(offsets, `{"partition":0,"offset":null,"error_code":50003,"error":"Kafka error"}`)
+			} else {
+				offsets = append(offsets, fmt.Sprintf(`{"partition":0,"offset":%d,"error_code":null,"error":null}`, i))
+			}
+		}
+		w.Header().Set("Content-Type", "application/vnd.kafka.v2+json")
+		io.WriteString(w, `{"offsets":[`+strings.Join(offsets, ",")+`]}`)
+	}))
+	defer server.Close()
+
+	sink, err := build_event_exporter.NewKafkaSink(server.URL+"/v2", "build-events")
+	require.NoError(t, err)
+
+	err = sink.Publish(context.Background(), []*bexpb.ExportedBuildEvent{testEvent(1), testEvent(2)})
+	require.NoError(t, err)
+	assert.Equal(t, []int64{1, 2}, sequenceNumbers(received))
+
+	mu.Lock()
+	fail = true
+	mu.Unlock()
+	err = sink.Publish(context.Background(), []*bexpb.ExportedBuildEvent{testEvent(3)})
+	require.Error(t, err)
+}
+
+// runFakeNATSServer accepts a single connection, answers JetStream account
+// info requests, records the payloads of the messages published to subject,
+// and replies to each of them with ack, like JetStream acknowledging a stored
+// message.
+func runFakeNATSServer(t *testing.T, lis net.Listener, subject, ack string, payloads chan<- []byte) {
+	conn, err := lis.Accept()
+	require.NoError(t, err)
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	_, err = io.WriteString(conn, `INFO {"server_id":"test","version":"2.2.0","proto":1,"max_payload":1048576,"headers":true}`+"\r\n")
+	require.NoError(t, err)
+	// Subscription IDs by subject, which may end in a "*" wildcard.
+	sids := map[string]string{}
+	reply := func(replySubject, payload string) {
+		for sub, sid := range sids {
+			if sub == replySubject || (strings.HasSuffix(sub, "*") && strings.HasPrefix(replySubject, strings.TrimSuffix(sub, "*"))) {
+				_, err := fmt.Fprintf(conn, "MSG %s %s %d\r\n%s\r\n", replySubject, sid, len(payload), payload)
+				require.NoError(t, err)
+				return
+			}
+		}
+		t.Errorf("no subscription for reply subject %q", replySubject)
+	}
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		parts := strings.Fields(line)
+		switch {
+		case strings.HasPrefix(line, "CONNECT "), strings.HasPrefix(line, "UNSUB "), line == "PONG":
+		case line == "PING":
+			_, err := io.WriteString(conn, "PONG\r\n")
+			require.NoError(t, err)
+		case strings.HasPrefix(line, "SUB "):
+			require.Len(t, parts, 3)
+			sids[parts[1]] = parts[2]
+		case strings.HasPrefix(line, "PUB "):
+			require.Len(t, parts, 4)
+			size, err := strconv.Atoi(parts[3])
+			require.NoError(t, err)
+			_, err = io.ReadFull(r, make([]byte, size+2))
+			require.NoError(t, err)
+			assert.Equal(t, "$JS.API.INFO", parts[1])
+			reply(parts[2], `{"type":"io.nats.jetstream.api.v1.account_info_response"}`)
+		case strings.HasPrefix(line, "HPUB "):
+			require.Len(t, parts, 5)
+			assert.Equal(t, subject, parts[1])
+			headerSize, err := strconv.Atoi(parts[3])
+			require.NoError(t, err)
+			size, err := strconv.Atoi(parts[4])
+			require.NoError(t, err)
+			msg := make([]byte, size+2)
+			_, err = io.ReadFull(r, msg)
+			require.NoError(t, err)
+
+			event := &bexpb.ExportedBuildEvent{}
+			err = proto.Unmarshal(msg[headerSize:size], event)
+			require.NoError(t, err)
+			msgID := fmt.Sprintf("%s/%d/%d", event.GetInvocationId(), event.GetAttempt(), event.GetEvent().GetSequenceNumber())
+			assert.Contains(t, string(msg[:headerSize]), "Nats-Msg-Id: "+msgID+"\r\n")
+			payloads <- msg[headerSize:size]
+
+			reply(parts[2], ack)
+		default:
+			t.Errorf("unexpected NATS message %q", line)
+		}
+	}
+}
+
+func TestNATSSink(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer lis.Close()
+	payloads := make(chan []byte, 10)
+	go runFakeNATSServer(t, lis, "build.events", `{"stream":"BUILD_EVENTS","seq":1}`, payloads)
+
+	sink, err := build_event_exporter.NewNATSSink("nats://"+lis.Addr().String(), "build.events")
+	require.NoError(t, err)
+	err = sink.Publish(context.Background(), []*bexpb.ExportedBuildEvent{testEvent(1), testEvent(2)})
+	require.NoError(t, err)
+	err = sink.Close()
+	require.NoError(t, err)
+
+	// Both messages must have been acknowledged.
+	require.Len(t, payloads, 2)
+	for i := int64(1); i <= 2; i++ {
+		event := &bexpb.ExportedBuildEvent{}
+		err := proto.Unmarshal(<-payloads, event)
+		require.NoError(t, err)
+		assert.Equal(t, i, event.GetEvent().GetSequenceNumber())
+	}
+}
+
+func TestNATSSink_JetStreamError(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer lis.Close()
+	payloads := make(chan []byte, 10)
+	go runFakeNATSServer(t, lis, "build.events", `{"error":{"code":503,"description":"insufficient resources"}}`, payloads)
+
+	sink, err := build_event_exporter.NewNATSSink("nats://"+lis.Addr().String(), "build.events")
+	require.NoError(t, err)
+	err = sink.Publish(context.Background(), []*bexpb.ExportedBuildEvent{testEvent(1)})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "insufficient resources")
+	err = sink.Close()
+	require.NoError(t, err)
+}
@@ -0,0 +1,143 @@
+package build_event_exporter
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"google.golang.org/protobuf/proto"
+
+	bexpb "github.com/buildbuddy-io/buildbuddy/proto/build_event_export"
+)
+
+const (
+	// Spool files are written with this suffix, which is removed once the file
+	// is complete.
+	incompleteSpoolFileSuffix = ".tmp"
+	spoolFileExtension        = ".spool"
+)
+
+// FileSink appends build events to spool files in a local directory, to be
+// shipped elsewhere by an external process.
+//
+// Each spool file is a sequence of records, each consisting of the
+// varint-encoded length of a serialized ExportedBuildEvent followed by the
+// event itself. Files are written with a ".tmp" suffix, which is removed once
+// the file reaches its maximum size or the sink is closed, at which point the
+// file won't be modified anymore and may be consumed.
+type FileSink struct {
+	dir              string
+	maxFileSizeBytes int64
+
+	mu   sync.Mutex // PROTECTS(file, size)
+	file *os.File
+	size int64
+}
+
+func NewFileSink(dir string, maxFileSizeBytes int64) (*FileSink, error) {
+	if dir == "" {
+		return nil, status.InvalidArgumentError("build_event_export.file.directory must be set to use the file sink")
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	if err := completeSpoolFiles(dir); err != nil {
+		return nil, err
+	}
+	return &FileSink{dir: dir, maxFileSizeBytes: maxFileSizeBytes}, nil
+}
+
+// completeSpoolFiles completes the spool files left incomplete by a previous
+// run. Their contents are valid since records are only ever appended after
+// being fully written.
+func completeSpoolFiles(dir string) error {
+	paths, err := filepath.Glob(filepath.Join(dir, "*"+spoolFileExtension+incompleteSpoolFileSuffix))
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		if err := os.Rename(path, strings.TrimSuffix(path, incompleteSpoolFileSuffix)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *FileSink) Publish(ctx context.Context, events []*bexpb.ExportedBuildEvent) error {
+	var buf []byte
+	lenBuf := make([]byte, binary.MaxVarintLen64)
+	for _, event := range events {
+		b, err := proto.Marshal(event)
+		if err != nil {
+			return err
+		}
+		n := binary.PutUvarint(lenBuf, uint64(len(b)))
+		buf = append(buf, lenBuf[:n]...)
+		buf = append(buf, b...)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		name := fmt.Sprintf("build_events-%d%s%s", time.Now().UnixNano(), spoolFileExtension, incompleteSpoolFileSuffix)
+		f, err := os.OpenFile(filepath.Join(s.dir, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err != nil {
+			return err
+		}
+		s.file = f
+		s.size = 0
+	}
+	if _, err := s.file.Write(buf); err != nil {
+		s.discardPartialWrite()
+		return err
+	}
+	if err := s.file.Sync(); err != nil {
+		s.discardPartialWrite()
+		return err
+	}
+	s.size += int64(len(buf))
+	if s.size >= s.maxFileSizeBytes {
+		return s.completeFile()
+	}
+	return nil
+}
+
+// discardPartialWrite truncates the current file to its last known good size,
+// so that a failed write doesn't leave a partial record behind. If that isn't
+// possible, the file is abandoned without being completed.
+func (s *FileSink) discardPartialWrite() {
+	if err := s.file.Truncate(s.size); err == nil {
+		if _, err := s.file.Seek(s.size, 0); err == nil {
+			return
+		}
+	}
+	log.Warningf("Abandoning build event spool file %q after a failed write", s.file.Name())
+	s.file.Close()
+	s.file = nil
+}
+
+func (s *FileSink) completeFile() error {
+	name := s.file.Name()
+	err := s.file.Close()
+	s.file = nil
+	if err != nil {
+		return err
+	}
+	return os.Rename(name, strings.TrimSuffix(name, incompleteSpoolFileSuffix))
+}
+
+func (s *FileSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	return s.completeFile()
+}
@@ -0,0 +1,129 @@
+package build_event_exporter
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"google.golang.org/protobuf/proto"
+
+	bexpb "github.com/buildbuddy-io/buildbuddy/proto/build_event_export"
+)
+
+const (
+	kafkaBinaryContentType = "application/vnd.kafka.binary.v2+json"
+	kafkaAcceptContentType = "application/vnd.kafka.v2+json"
+	kafkaRequestTimeout    = 30 * time.Second
+)
+
+type kafkaRecord struct {
+	// Base64-encoded, since []byte is marshaled as base64 by encoding/json.
+	Key   []byte `json:"key"`
+	Value []byte `json:"value"`
+}
+
+type kafkaProduceRequest struct {
+	Records []*kafkaRecord `json:"records"`
+}
+
+type kafkaProduceResponse struct {
+	Offsets []struct {
+		Partition int32   `json:"partition"`
+		Offset    int64   `json:"offset"`
+		ErrorCode *int32  `json:"error_code"`
+		Error     *string `json:"error"`
+	} `json:"offsets"`
+}
+
+// KafkaSink publishes build events to a Kafka topic through a Kafka REST
+// proxy implementing the v2 API, such as the Confluent REST Proxy or
+// Redpanda's HTTP proxy.
+//
+// Events are keyed by invocation ID, so all events of an invocation are
+// written to the same partition, in order.
+type KafkaSink struct {
+	produceURL string
+	client     *http.Client
+}
+
+func NewKafkaSink(restProxyURL, topic string) (*KafkaSink, error) {
+	if restProxyURL == "" {
+		return nil, status.InvalidArgumentError("build_event_export.kafka.rest_proxy_url must be set to use the Kafka sink")
+	}
+	if topic == "" {
+		return nil, status.InvalidArgumentError("build_event_export.kafka.topic must be set to use the Kafka sink")
+	}
+	u, err := url.Parse(restProxyURL)
+	if err != nil {
+		return nil, status.InvalidArgumentErrorf("Invalid Kafka REST proxy URL %q: %s", restProxyURL, err)
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/topics/" + url.PathEscape(topic)
+	return &KafkaSink{
+		produceURL: u.String(),
+		client:     &http.Client{Timeout: kafkaRequestTimeout},
+	}, nil
+}
+
+func (s *KafkaSink) Publish(ctx context.Context, events []*bexpb.ExportedBuildEvent) error {
+	req := &kafkaProduceRequest{Records: make([]*kafkaRecord, 0, len(events))}
+	for _, event := range events {
+		b, err := proto.Marshal(event)
+		if err != nil {
+			return err
+		}
+		req.Records = append(req.Records, &kafkaRecord{
+			Key:   []byte(event.GetInvocationId()),
+			Value: b,
+		})
+	}
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, s.produceURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Content-Type", kafkaBinaryContentType)
+	httpReq.Header.Set("Accept", kafkaAcceptContentType)
+	res, err := s.client.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	resBody, err := io.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return status.UnavailableErrorf("Kafka REST proxy returned HTTP %d: %s", res.StatusCode, string(resBody))
+	}
+	rsp := &kafkaProduceResponse{}
+	if err := json.Unmarshal(resBody, rsp); err != nil {
+		return status.UnavailableErrorf("Invalid Kafka REST proxy response: %s", err)
+	}
+	// The proxy returns an offset entry per record, with an error if that
+	// record could not be produced. Retry the whole batch in that case: some
+	// events may be published twice, which at-least-once delivery allows.
+	for _, o := range rsp.Offsets {
+		if o.Error != nil || o.ErrorCode != nil {
+			msg := ""
+			if o.Error != nil {
+				msg = *o.Error
+			}
+			return status.UnavailableErrorf("Kafka REST proxy failed to produce record: %s", msg)
+		}
+	}
+	return nil
+}
+
+func (s *KafkaSink) Close() error {
+	s.client.CloseIdleConnections()
+	return nil
+}
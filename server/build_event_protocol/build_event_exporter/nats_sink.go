@@ -0,0 +1,114 @@
+package build_event_exporter
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/nats-io/nats.go"
+	"google.golang.org/protobuf/proto"
+
+	bexpb "github.com/buildbuddy-io/buildbuddy/proto/build_event_export"
+)
+
+const (
+	// How long to wait for JetStream to acknowledge a batch when the publish
+	// context has no deadline.
+	natsTimeout = 30 * time.Second
+)
+
+// NATSSink publishes build events to a NATS JetStream stream, one message per
+// event.
+//
+// A batch is only considered published once JetStream has acknowledged that
+// every event of the batch was stored in the stream bound to the subject.
+// Events carry a Nats-Msg-Id header, so that JetStream discards the events of
+// retried batches that it already stored.
+//
+// The connection uses TLS if the URL scheme is tls:// or if the server
+// requires it, and is re-established in the background if it is lost.
+type NATSSink struct {
+	subject string
+	nc      *nats.Conn
+
+	mu sync.Mutex // PROTECTS(js)
+	js nats.JetStreamContext
+}
+
+func NewNATSSink(natsURL, subject string) (*NATSSink, error) {
+	if natsURL == "" {
+		return nil, status.InvalidArgumentError("build_event_export.nats.url must be set to use the NATS sink")
+	}
+	nc, err := nats.Connect(
+		natsURL,
+		nats.Name("buildbuddy-build-event-exporter"),
+		// Don't fail to start if the server is unavailable: events are
+		// queued and retried until the connection is established.
+		nats.RetryOnFailedConnect(true),
+		nats.MaxReconnects(-1),
+	)
+	if err != nil {
+		return nil, status.InvalidArgumentErrorf("Could not connect to NATS server: %s", err)
+	}
+	return &NATSSink{subject: subject, nc: nc}, nil
+}
+
+// jetStream returns the JetStream context of the connection. It is created on
+// first use, since creating it fails until the server is reachable.
+func (s *NATSSink) jetStream() (nats.JetStreamContext, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.js != nil {
+		return s.js, nil
+	}
+	js, err := s.nc.JetStream()
+	if err != nil {
+		return nil, status.UnavailableErrorf("JetStream is unavailable: %s", err)
+	}
+	s.js = js
+	return js, nil
+}
+
+func (s *NATSSink) Publish(ctx context.Context, events []*bexpb.ExportedBuildEvent) error {
+	js, err := s.jetStream()
+	if err != nil {
+		return err
+	}
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, natsTimeout)
+		defer cancel()
+	}
+	acks := make([]nats.PubAckFuture, 0, len(events))
+	for _, event := range events {
+		b, err := proto.Marshal(event)
+		if err != nil {
+			return err
+		}
+		msg := nats.NewMsg(s.subject)
+		msg.Data = b
+		msgID := fmt.Sprintf("%s/%d/%d", event.GetInvocationId(), event.GetAttempt(), event.GetEvent().GetSequenceNumber())
+		ack, err := js.PublishMsgAsync(msg, nats.MsgId(msgID))
+		if err != nil {
+			return status.UnavailableErrorf("Could not publish build event to NATS: %s", err)
+		}
+		acks = append(acks, ack)
+	}
+	for _, ack := range acks {
+		select {
+		case <-ack.Ok():
+		case err := <-ack.Err():
+			return status.UnavailableErrorf("JetStream did not store build event: %s", err)
+		case <-ctx.Done():
+			return status.DeadlineExceededErrorf("Timed out waiting for JetStream to acknowledge build events: %s", ctx.Err())
+		}
+	}
+	return nil
+}
+
+func (s *NATSSink) Close() error {
+	s.nc.Close()
+	return nil
+}
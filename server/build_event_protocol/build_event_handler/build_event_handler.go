@@ -17,6 +17,7 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/accumulator"
 	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/build_status_reporter"
 	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/event_parser"
+	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/failure_summary"
 	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/invocation_format"
 	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/target_tracker"
 	"github.com/buildbuddy-io/buildbuddy/server/environment"
@@ -40,6 +41,7 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	"golang.org/x/sync/errgroup"
 
+	bexpb "github.com/buildbuddy-io/buildbuddy/proto/build_event_export"
 	bepb "github.com/buildbuddy-io/buildbuddy/proto/build_events"
 	capb "github.com/buildbuddy-io/buildbuddy/proto/cache"
 	inpb "github.com/buildbuddy-io/buildbuddy/proto/invocation"
@@ -127,6 +129,7 @@ func (b *BuildEventHandler) OpenChannel(ctx context.Context, iid string) interfa
 		redactor:                redact.NewStreamingRedactor(b.env),
 		statusReporter:          build_status_reporter.NewBuildStatusReporter(b.env, buildEventAccumulator),
 		targetTracker:           target_tracker.NewTargetTracker(b.env, buildEventAccumulator),
+		failureSummary:          failure_summary.NewCollector(b.env),
 		hasReceivedStartedEvent: false,
 		eventsBeforeStarted:     make([]*inpb.InvocationEvent, 0),
 		logWriter:               nil,
@@ -213,7 +216,7 @@ func (r *statsRecorder) Enqueue(ctx context.Context, invocation *inpb.Invocation
 	}
 }
 
-func scoreCardBlobName(invocationID string) string {
+func ScoreCardBlobName(invocationID string) string {
 	blobFileName := invocationID + "-scorecard.pb"
 	return filepath.Join(invocationID, blobFileName)
 }
@@ -224,13 +227,13 @@ func writeScoreCard(ctx context.Context, env environment.Env, invocationID strin
 		return err
 	}
 	blobStore := env.GetBlobstore()
-	_, err = blobStore.WriteBlob(ctx, scoreCardBlobName(invocationID), scoreCardBuf)
+	_, err = blobStore.WriteBlob(ctx, ScoreCardBlobName(invocationID), scoreCardBuf)
 	return err
 }
 
 func readScoreCard(ctx context.Context, env environment.Env, invocationID string) (*capb.ScoreCard, error) {
 	blobStore := env.GetBlobstore()
-	buf, err := blobStore.ReadBlob(ctx, scoreCardBlobName(invocationID))
+	buf, err := blobStore.ReadBlob(ctx, ScoreCardBlobName(invocationID))
 	if err != nil {
 		return nil, err
 	}
@@ -489,12 +492,17 @@ type EventChannel struct {
 	redactor                *redact.StreamingRedactor
 	statusReporter          *build_status_reporter.BuildStatusReporter
 	targetTracker           *target_tracker.TargetTracker
+	failureSummary          *failure_summary.Collector
 	statsRecorder           *statsRecorder
 	eventsBeforeStarted     []*inpb.InvocationEvent
 	hasReceivedStartedEvent bool
 	logWriter               *eventlog.EventLogWriter
 	onClose                 func()
 	attempt                 uint64
+	// The group ID attached to exported build events, resolved from the
+	// authenticated context on the first exported event.
+	exportGroupID         string
+	exportGroupIDResolved bool
 	// isVoid determines whether all EventChannel operations are NOPs. This is set
 	// when we're retrying an invocation that is already complete, or is
 	// incomplete but was created too far in the past.
@@ -583,6 +591,9 @@ func (e *EventChannel) FinalizeInvocation(iid string) error {
 		}
 		invocation.LastChunkId = e.logWriter.GetLastChunkId(ctx)
 	}
+	if !invocation.Success {
+		invocation.FailureSummary = e.failureSummary.Summary(ctx)
+	}
 
 	ti, err := tableInvocationFromProto(invocation, iid)
 	if err != nil {
@@ -823,6 +834,10 @@ func (e *EventChannel) processSingleEvent(event *inpb.InvocationEvent, iid strin
 	}
 	e.redactor.RedactMetadata(event.BuildEvent)
 
+	if exporter := e.env.GetBuildEventExporter(); exporter != nil {
+		e.exportEvent(exporter, iid, event)
+	}
+
 	e.beValues.AddEvent(event.BuildEvent) // in-memory structure to hold common values we want from the event.
 
 	switch p := event.BuildEvent.Payload.(type) {
@@ -838,6 +853,7 @@ func (e *EventChannel) processSingleEvent(event *inpb.InvocationEvent, iid strin
 	}
 
 	e.targetTracker.TrackTargetsForEvent(e.ctx, event.BuildEvent)
+	e.failureSummary.CollectEvent(event.BuildEvent)
 	e.statusReporter.ReportStatusForEvent(e.ctx, event.BuildEvent)
 
 	// For everything else, just save the event to our buffer and keep on chugging.
@@ -868,6 +884,24 @@ func (e *EventChannel) processSingleEvent(event *inpb.InvocationEvent, iid strin
 	return nil
 }
 
+// exportEvent queues a copy of the redacted event for export. The event is
+// copied since it may still be modified before being written to the
+// blobstore.
+func (e *EventChannel) exportEvent(exporter interfaces.BuildEventExporter, iid string, event *inpb.InvocationEvent) {
+	if !e.exportGroupIDResolved {
+		e.exportGroupIDResolved = true
+		if u, err := perms.AuthenticatedUser(e.ctx, e.env); err == nil {
+			e.exportGroupID = u.GetGroupID()
+		}
+	}
+	exporter.Export(&bexpb.ExportedBuildEvent{
+		InvocationId: iid,
+		Attempt:      e.attempt,
+		GroupId:      e.exportGroupID,
+		Event:        proto.Clone(event).(*inpb.InvocationEvent),
+	})
+}
+
 func (e *EventChannel) writeBuildMetadata(ctx context.Context, invocationID string) error {
 	db := e.env.GetInvocationDB()
 	ti := &tables.Invocation{
@@ -1067,6 +1101,13 @@ func tableInvocationFromProto(p *inpb.Invocation, blobID string) (*tables.Invoca
 	i.LastChunkId = p.LastChunkId
 	i.RedactionFlags = redact.RedactionFlagStandardRedactions
 	i.Attempt = p.Attempt
+	if p.FailureSummary != nil {
+		fs, err := proto.Marshal(p.FailureSummary)
+		if err != nil {
+			return nil, err
+		}
+		i.FailureSummary = fs
+	}
 	return i, nil
 }
 
@@ -1116,6 +1157,15 @@ func TableInvocationToProto(i *tables.Invocation) *inpb.Invocation {
 		out.HasChunkedEventLogs = true
 	}
 	out.Attempt = i.Attempt
+	out.LegalHold = i.LegalHold
+	if len(i.FailureSummary) > 0 {
+		fs := &inpb.FailureSummary{}
+		if err := proto.Unmarshal(i.FailureSummary, fs); err != nil {
+			log.Warningf("Invalid failure summary for invocation %s: %s", i.InvocationID, err)
+		} else {
+			out.FailureSummary = fs
+		}
+	}
 	return out
 }
 
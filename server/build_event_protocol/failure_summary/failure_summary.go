@@ -0,0 +1,288 @@
+package failure_summary
+
+import (
+	"context"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/buildbuddy-io/buildbuddy/proto/build_event_stream"
+	"github.com/buildbuddy-io/buildbuddy/server/bytestream"
+	"github.com/buildbuddy-io/buildbuddy/server/environment"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/digest"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"golang.org/x/sync/errgroup"
+
+	inpb "github.com/buildbuddy-io/buildbuddy/proto/invocation"
+)
+
+const (
+	// The maximum number of entries of each kind kept in a summary.
+	maxFailedActions = 5
+	maxFailedTests   = 10
+	maxErrors        = 10
+
+	// The number of bytes fetched from the end of stderr and test logs.
+	tailSizeBytes = 2048
+	// How long to wait for log tails, which are fetched while the invocation
+	// is being finalized. Summaries are returned without the tails that
+	// couldn't be fetched in time.
+	tailFetchTimeout = 2 * time.Second
+
+	testLogName = "test.log"
+)
+
+var ansiEscapeRegex = regexp.MustCompile(`\x1b\[[0-9;]*[A-Za-z]`)
+
+type failedTest struct {
+	summary *inpb.FailureSummary_FailedTest
+	logURI  string
+}
+
+// Collector extracts the root causes of a build failure from the build event
+// stream, so they can be shown without scrolling through the build log.
+type Collector struct {
+	env environment.Env
+
+	failedActions []*inpb.FailureSummary_FailedAction
+	// The URIs of the stderr of the failed actions, by index.
+	stderrURIs []string
+
+	// Failed tests, keyed by label, in the order they were first reported.
+	failedTests     map[string]*failedTest
+	failedTestOrder []string
+
+	errors []*inpb.FailureSummary_Error
+}
+
+func NewCollector(env environment.Env) *Collector {
+	return &Collector{
+		env:         env,
+		failedTests: make(map[string]*failedTest, 0),
+	}
+}
+
+func (c *Collector) CollectEvent(event *build_event_stream.BuildEvent) {
+	switch p := event.Payload.(type) {
+	case *build_event_stream.BuildEvent_Action:
+		c.collectAction(event, p.Action)
+	case *build_event_stream.BuildEvent_TestResult:
+		c.collectTestResult(event, p.TestResult)
+	case *build_event_stream.BuildEvent_TestSummary:
+		c.collectTestSummary(event, p.TestSummary)
+	case *build_event_stream.BuildEvent_Aborted:
+		c.collectAborted(event, p.Aborted)
+	}
+}
+
+func (c *Collector) collectAction(event *build_event_stream.BuildEvent, action *build_event_stream.ActionExecuted) {
+	if action.GetSuccess() || len(c.failedActions) >= maxFailedActions {
+		return
+	}
+	label := event.GetId().GetActionCompleted().GetLabel()
+	if label == "" {
+		label = action.GetLabel()
+	}
+	c.failedActions = append(c.failedActions, &inpb.FailureSummary_FailedAction{
+		Label:          label,
+		Mnemonic:       action.GetType(),
+		ExitCode:       action.GetExitCode(),
+		FailureMessage: action.GetFailureDetail().GetMessage(),
+	})
+	c.stderrURIs = append(c.stderrURIs, action.GetStderr().GetUri())
+}
+
+func isFailedTestStatus(s build_event_stream.TestStatus) bool {
+	switch s {
+	case build_event_stream.TestStatus_FAILED,
+		build_event_stream.TestStatus_TIMEOUT,
+		build_event_stream.TestStatus_INCOMPLETE,
+		build_event_stream.TestStatus_REMOTE_FAILURE:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *Collector) collectTestResult(event *build_event_stream.BuildEvent, result *build_event_stream.TestResult) {
+	if !isFailedTestStatus(result.GetStatus()) {
+		return
+	}
+	id := event.GetId().GetTestResult()
+	label := id.GetLabel()
+	if _, ok := c.failedTests[label]; !ok {
+		if len(c.failedTestOrder) >= maxFailedTests {
+			return
+		}
+		c.failedTestOrder = append(c.failedTestOrder, label)
+	}
+	logURI := ""
+	for _, f := range result.GetTestActionOutput() {
+		if f.GetName() == testLogName {
+			logURI = f.GetUri()
+		}
+	}
+	// Keep the last failed attempt, which is the most relevant one when tests
+	// are retried with --flaky_test_attempts.
+	c.failedTests[label] = &failedTest{
+		summary: &inpb.FailureSummary_FailedTest{
+			Label:         label,
+			Status:        result.GetStatus(),
+			Run:           id.GetRun(),
+			Shard:         id.GetShard(),
+			Attempt:       id.GetAttempt(),
+			StatusDetails: result.GetStatusDetails(),
+		},
+		logURI: logURI,
+	}
+}
+
+func (c *Collector) collectTestSummary(event *build_event_stream.BuildEvent, summary *build_event_stream.TestSummary) {
+	switch summary.GetOverallStatus() {
+	case build_event_stream.TestStatus_PASSED, build_event_stream.TestStatus_FLAKY:
+	default:
+		return
+	}
+	// The test eventually passed, so its failed attempts are not a cause of
+	// the invocation failure.
+	label := event.GetId().GetTestSummary().GetLabel()
+	if _, ok := c.failedTests[label]; !ok {
+		return
+	}
+	delete(c.failedTests, label)
+	for i, l := range c.failedTestOrder {
+		if l == label {
+			c.failedTestOrder = append(c.failedTestOrder[:i], c.failedTestOrder[i+1:]...)
+			break
+		}
+	}
+}
+
+func (c *Collector) collectAborted(event *build_event_stream.BuildEvent, aborted *build_event_stream.Aborted) {
+	switch aborted.GetReason() {
+	case build_event_stream.Aborted_SKIPPED,
+		build_event_stream.Aborted_INCOMPLETE,
+		build_event_stream.Aborted_NO_ANALYZE,
+		build_event_stream.Aborted_NO_BUILD:
+		// These are consequences of other failures, or expected.
+		return
+	}
+	if aborted.GetDescription() == "" || len(c.errors) >= maxErrors {
+		return
+	}
+	id := event.GetId()
+	label := id.GetTargetCompleted().GetLabel()
+	if label == "" {
+		label = id.GetConfiguredLabel().GetLabel()
+	}
+	if label == "" {
+		label = id.GetUnconfiguredLabel().GetLabel()
+	}
+	c.errors = append(c.errors, &inpb.FailureSummary_Error{
+		Label:   label,
+		Reason:  aborted.GetReason(),
+		Message: aborted.GetDescription(),
+	})
+}
+
+// Summary returns the failures collected so far, with the tails of the
+// relevant logs that could be fetched within tailFetchTimeout, or nil if no
+// failure was collected.
+func (c *Collector) Summary(ctx context.Context) *inpb.FailureSummary {
+	if len(c.failedActions) == 0 && len(c.failedTestOrder) == 0 && len(c.errors) == 0 {
+		return nil
+	}
+	summary := &inpb.FailureSummary{
+		FailedAction: c.failedActions,
+		Error:        c.errors,
+	}
+	ctx, cancel := context.WithTimeout(ctx, tailFetchTimeout)
+	defer cancel()
+	var mu sync.Mutex
+	// Set when the summary is returned, after which late tails are dropped.
+	returned := false
+	eg, egCtx := errgroup.WithContext(ctx)
+	fetch := func(uri string, setTail func(string)) {
+		if uri == "" {
+			return
+		}
+		eg.Go(func() error {
+			tail, err := fetchTail(egCtx, c.env, uri)
+			if err != nil {
+				// Logs may have been evicted from the cache or never uploaded;
+				// the summary is still useful without them.
+				log.Debugf("Could not fetch log tail %q: %s", uri, err)
+				return nil
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if !returned {
+				setTail(tail)
+			}
+			return nil
+		})
+	}
+	for i, a := range c.failedActions {
+		a := a
+		fetch(c.stderrURIs[i], func(tail string) { a.StderrTail = tail })
+	}
+	for _, label := range c.failedTestOrder {
+		t := c.failedTests[label]
+		summary.FailedTest = append(summary.FailedTest, t.summary)
+		fetch(t.logURI, func(tail string) { t.summary.LogTail = tail })
+	}
+	fetched := make(chan struct{})
+	go func() {
+		eg.Wait()
+		close(fetched)
+	}()
+	select {
+	case <-fetched:
+	case <-ctx.Done():
+		log.Debugf("Timed out fetching log tails for failure summary")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	returned = true
+	return summary
+}
+
+// fetchTail returns the last tailSizeBytes of the file at the given bytestream
+// URI, with ANSI escape sequences removed.
+func fetchTail(ctx context.Context, env environment.Env, uri string) (string, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "", status.InvalidArgumentErrorf("invalid log URI %q: %s", uri, err)
+	}
+	offset := int64(0)
+	if r, err := digest.ParseDownloadResourceName(strings.TrimPrefix(u.RequestURI(), "/")); err == nil {
+		if size := r.GetDigest().GetSizeBytes(); size > tailSizeBytes {
+			offset = size - tailSizeBytes
+		}
+	}
+	var buf []byte
+	err = bytestream.StreamBytestreamFileChunk(ctx, env, u, offset, 0, func(data []byte) {
+		buf = append(buf, data...)
+	})
+	if err != nil {
+		return "", err
+	}
+	if len(buf) > tailSizeBytes {
+		buf = buf[len(buf)-tailSizeBytes:]
+	}
+	return cleanTail(buf), nil
+}
+
+// cleanTail strips ANSI escape sequences and any partial UTF-8 sequence left at
+// the start of the tail by the offset.
+func cleanTail(b []byte) string {
+	for len(b) > 0 && !utf8.RuneStart(b[0]) {
+		b = b[1:]
+	}
+	s := ansiEscapeRegex.ReplaceAllString(string(b), "")
+	return strings.ToValidUTF8(s, "")
+}
@@ -0,0 +1,147 @@
+package failure_summary_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/buildbuddy-io/buildbuddy/proto/build_event_stream"
+	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/failure_summary"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testenv"
+	"github.com/google/go-cmp/cmp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/testing/protocmp"
+
+	fdpb "github.com/buildbuddy-io/buildbuddy/proto/failure_details"
+	inpb "github.com/buildbuddy-io/buildbuddy/proto/invocation"
+)
+
+func actionEvent(label, mnemonic string, success bool, exitCode int32, message string) *build_event_stream.BuildEvent {
+	return &build_event_stream.BuildEvent{
+		Id: &build_event_stream.BuildEventId{
+			Id: &build_event_stream.BuildEventId_ActionCompleted{
+				ActionCompleted: &build_event_stream.BuildEventId_ActionCompletedId{Label: label},
+			},
+		},
+		Payload: &build_event_stream.BuildEvent_Action{
+			Action: &build_event_stream.ActionExecuted{
+				Success:       success,
+				Type:          mnemonic,
+				ExitCode:      exitCode,
+				FailureDetail: &fdpb.FailureDetail{Message: message},
+			},
+		},
+	}
+}
+
+func testResultEvent(label string, attempt int32, status build_event_stream.TestStatus) *build_event_stream.BuildEvent {
+	return &build_event_stream.BuildEvent{
+		Id: &build_event_stream.BuildEventId{
+			Id: &build_event_stream.BuildEventId_TestResult{
+				TestResult: &build_event_stream.BuildEventId_TestResultId{
+					Label:   label,
+					Run:     1,
+					Shard:   1,
+					Attempt: attempt,
+				},
+			},
+		},
+		Payload: &build_event_stream.BuildEvent_TestResult{
+			TestResult: &build_event_stream.TestResult{Status: status},
+		},
+	}
+}
+
+func testSummaryEvent(label string, status build_event_stream.TestStatus) *build_event_stream.BuildEvent {
+	return &build_event_stream.BuildEvent{
+		Id: &build_event_stream.BuildEventId{
+			Id: &build_event_stream.BuildEventId_TestSummary{
+				TestSummary: &build_event_stream.BuildEventId_TestSummaryId{Label: label},
+			},
+		},
+		Payload: &build_event_stream.BuildEvent_TestSummary{
+			TestSummary: &build_event_stream.TestSummary{OverallStatus: status},
+		},
+	}
+}
+
+func abortedEvent(label string, reason build_event_stream.Aborted_AbortReason, description string) *build_event_stream.BuildEvent {
+	return &build_event_stream.BuildEvent{
+		Id: &build_event_stream.BuildEventId{
+			Id: &build_event_stream.BuildEventId_TargetCompleted{
+				TargetCompleted: &build_event_stream.BuildEventId_TargetCompletedId{Label: label},
+			},
+		},
+		Payload: &build_event_stream.BuildEvent_Aborted{
+			Aborted: &build_event_stream.Aborted{Reason: reason, Description: description},
+		},
+	}
+}
+
+func TestSummary_NoFailures(t *testing.T) {
+	te := testenv.GetTestEnv(t)
+	c := failure_summary.NewCollector(te)
+
+	c.CollectEvent(actionEvent("//:ok", "Genrule", true, 0, ""))
+	c.CollectEvent(testResultEvent("//:test", 1, build_event_stream.TestStatus_PASSED))
+	c.CollectEvent(abortedEvent("//:skipped", build_event_stream.Aborted_SKIPPED, "skipped"))
+
+	assert.Nil(t, c.Summary(context.Background()))
+}
+
+func TestSummary_CollectsRootCauses(t *testing.T) {
+	te := testenv.GetTestEnv(t)
+	c := failure_summary.NewCollector(te)
+
+	c.CollectEvent(actionEvent("//:ok", "Genrule", true, 0, ""))
+	c.CollectEvent(actionEvent("//:lib", "CppCompile", false, 1, "C++ compilation of rule '//:lib' failed"))
+	// A flaky test that eventually passed must not be reported.
+	c.CollectEvent(testResultEvent("//:flaky_test", 1, build_event_stream.TestStatus_FAILED))
+	c.CollectEvent(testResultEvent("//:flaky_test", 2, build_event_stream.TestStatus_PASSED))
+	c.CollectEvent(testSummaryEvent("//:flaky_test", build_event_stream.TestStatus_FLAKY))
+	// Only the last failed attempt of a failed test is reported.
+	c.CollectEvent(testResultEvent("//:failed_test", 1, build_event_stream.TestStatus_FAILED))
+	c.CollectEvent(testResultEvent("//:failed_test", 2, build_event_stream.TestStatus_TIMEOUT))
+	c.CollectEvent(testSummaryEvent("//:failed_test", build_event_stream.TestStatus_FAILED))
+	c.CollectEvent(abortedEvent("//:broken", build_event_stream.Aborted_ANALYSIS_FAILURE, "no such package 'missing'"))
+	c.CollectEvent(abortedEvent("//:skipped", build_event_stream.Aborted_SKIPPED, "skipped"))
+
+	summary := c.Summary(context.Background())
+
+	require.NotNil(t, summary)
+	expected := &inpb.FailureSummary{
+		FailedAction: []*inpb.FailureSummary_FailedAction{{
+			Label:          "//:lib",
+			Mnemonic:       "CppCompile",
+			ExitCode:       1,
+			FailureMessage: "C++ compilation of rule '//:lib' failed",
+		}},
+		FailedTest: []*inpb.FailureSummary_FailedTest{{
+			Label:   "//:failed_test",
+			Status:  build_event_stream.TestStatus_TIMEOUT,
+			Run:     1,
+			Shard:   1,
+			Attempt: 2,
+		}},
+		Error: []*inpb.FailureSummary_Error{{
+			Label:   "//:broken",
+			Reason:  build_event_stream.Aborted_ANALYSIS_FAILURE,
+			Message: "no such package 'missing'",
+		}},
+	}
+	assert.Empty(t, cmp.Diff(expected, summary, protocmp.Transform()))
+}
+
+func TestSummary_LimitsFailedActions(t *testing.T) {
+	te := testenv.GetTestEnv(t)
+	c := failure_summary.NewCollector(te)
+
+	for i := 0; i < 20; i++ {
+		c.CollectEvent(actionEvent("//:lib", "CppCompile", false, 1, ""))
+	}
+
+	summary := c.Summary(context.Background())
+
+	require.NotNil(t, summary)
+	assert.Len(t, summary.GetFailedAction(), 5)
+}
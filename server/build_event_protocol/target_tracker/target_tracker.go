@@ -1,19 +1,25 @@
 package target_tracker
 
 import (
+	"bytes"
 	"context"
 	"crypto/md5"
 	"encoding/binary"
 	"flag"
 	"fmt"
+	"net/url"
+	"sort"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/buildbuddy-io/buildbuddy/proto/build_event_stream"
 	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/accumulator"
+	"github.com/buildbuddy-io/buildbuddy/server/bytestream"
 	"github.com/buildbuddy-io/buildbuddy/server/environment"
 	"github.com/buildbuddy-io/buildbuddy/server/tables"
 	"github.com/buildbuddy-io/buildbuddy/server/util/db"
+	"github.com/buildbuddy-io/buildbuddy/server/util/junit"
 	"github.com/buildbuddy-io/buildbuddy/server/util/log"
 	"github.com/buildbuddy-io/buildbuddy/server/util/perms"
 	"github.com/buildbuddy-io/buildbuddy/server/util/query_builder"
@@ -26,7 +32,21 @@ import (
 	cmpb "github.com/buildbuddy-io/buildbuddy/proto/api/v1/common"
 )
 
-var enableTargetTracking = flag.Bool("app.enable_target_tracking", false, "Cloud-Only")
+var (
+	enableTargetTracking   = flag.Bool("app.enable_target_tracking", false, "Cloud-Only")
+	enableTestCaseTracking = flag.Bool("app.enable_test_case_tracking", false, "If true, the test.xml outputs of tracked test targets are parsed and per-testcase results are recorded. Requires app.enable_target_tracking.")
+)
+
+const (
+	// The maximum number of test.xml files fetched concurrently.
+	testXMLFetchConcurrency = 8
+
+	// test.xml files larger than this are not parsed.
+	maxTestXMLSizeBytes = 20_000_000
+
+	// Failure messages longer than this are truncated before being stored.
+	maxFailureMessageLength = 4096
+)
 
 type targetClosure func(event *build_event_stream.BuildEvent)
 type targetState int
@@ -40,6 +60,13 @@ const (
 	targetStateAborted
 )
 
+// testXMLFile is a test.xml output reported in a TestResult event.
+type testXMLFile struct {
+	uri     string
+	run     int32
+	attempt int32
+}
+
 type target struct {
 	label          string
 	ruleType       string
@@ -51,6 +78,7 @@ type target struct {
 	targetType     cmpb.TargetType
 	testSize       build_event_stream.TestSize
 	buildSuccess   bool
+	testXMLFiles   []*testXMLFile
 }
 
 func md5Int64(text string) int64 {
@@ -58,6 +86,13 @@ func md5Int64(text string) int64 {
 	return int64(binary.BigEndian.Uint64(hash[:8]))
 }
 
+// testCaseID returns the ID of the test case with the given class name and name
+// in the given target. The class name is length-prefixed, so that class names
+// and names containing separators can't produce the same ID.
+func testCaseID(targetID int64, className, name string) int64 {
+	return md5Int64(fmt.Sprintf("%d/%d:%s/%s", targetID, len(className), className, name))
+}
+
 func newTarget(label string) *target {
 	return &target{
 		label: label,
@@ -88,6 +123,16 @@ func (t *target) updateFromEvent(event *build_event_stream.BuildEvent) {
 		}
 		t.state = targetStateCompleted
 	case *build_event_stream.BuildEvent_TestResult:
+		id := event.GetId().GetTestResult()
+		for _, f := range p.TestResult.GetTestActionOutput() {
+			if f.GetName() == "test.xml" && f.GetUri() != "" {
+				t.testXMLFiles = append(t.testXMLFiles, &testXMLFile{
+					uri:     f.GetUri(),
+					run:     id.GetRun(),
+					attempt: id.GetAttempt(),
+				})
+			}
+		}
 		t.state = targetStateResult
 	case *build_event_stream.BuildEvent_TestSummary:
 		ts := p.TestSummary
@@ -351,9 +396,182 @@ func (t *TargetTracker) handleLastEvent(ctx context.Context, event *build_event_
 	}
 	if err := t.writeTestTargetStatuses(ctx, permissions); err != nil {
 		log.Debugf("Error writing %q target statuses: %s", t.buildEventAccumulator.InvocationID(), err.Error())
+		return
+	}
+	if *enableTestCaseTracking {
+		if err := t.writeTestCaseStatuses(ctx); err != nil {
+			log.Debugf("Error writing %q test case statuses: %s", t.buildEventAccumulator.InvocationID(), err.Error())
+		}
 	}
 }
 
+// fetchTestCases downloads the test.xml file at the given bytestream URI and
+// returns the test cases it contains.
+func (t *TargetTracker) fetchTestCases(ctx context.Context, uri string) ([]*junit.TestCase, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, status.InvalidArgumentErrorf("invalid test.xml URI %q: %s", uri, err)
+	}
+	// The read is cancelled once the file turns out to be too large, rather
+	// than reading the rest of it only to discard it.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	buf := &bytes.Buffer{}
+	tooLarge := false
+	err = bytestream.StreamBytestreamFile(ctx, t.env, u, func(data []byte) {
+		if tooLarge {
+			return
+		}
+		if buf.Len()+len(data) > maxTestXMLSizeBytes {
+			tooLarge = true
+			buf.Reset()
+			cancel()
+			return
+		}
+		buf.Write(data)
+	})
+	if tooLarge {
+		return nil, status.ResourceExhaustedErrorf("test.xml %q exceeds %d bytes", uri, maxTestXMLSizeBytes)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return junit.Parse(buf)
+}
+
+func testCaseStatusFromJUnit(s junit.CaseStatus) cmpb.Status {
+	switch s {
+	case junit.CasePassed:
+		return cmpb.Status_PASSED
+	case junit.CaseFailed, junit.CaseErrored:
+		return cmpb.Status_FAILED
+	case junit.CaseSkipped:
+		return cmpb.Status_SKIPPED
+	default:
+		return cmpb.Status_STATUS_UNSPECIFIED
+	}
+}
+
+// mergeTestCaseStatus combines the statuses of a test case that was run more
+// than once in the same invocation (because of --runs_per_test or
+// --flaky_test_attempts).
+func mergeTestCaseStatus(prev, next cmpb.Status) cmpb.Status {
+	switch {
+	case prev == next:
+		return next
+	case next == cmpb.Status_SKIPPED:
+		return prev
+	case prev == cmpb.Status_SKIPPED:
+		return next
+	default:
+		// A mix of passes and failures.
+		return cmpb.Status_FLAKY
+	}
+}
+
+func truncateFailureMessage(msg string) string {
+	if len(msg) <= maxFailureMessageLength {
+		return msg
+	}
+	// Don't cut a multi-byte character in half.
+	n := maxFailureMessageLength
+	for n > 0 && !utf8.RuneStart(msg[n]) {
+		n--
+	}
+	return msg[:n]
+}
+
+func (t *TargetTracker) writeTestCaseStatuses(ctx context.Context) error {
+	repoURL := t.buildEventAccumulator.RepoURL()
+	invocationUUID, err := uuid.StringToBytes(t.buildEventAccumulator.InvocationID())
+	if err != nil {
+		return err
+	}
+
+	type fetch struct {
+		targetID int64
+		file     *testXMLFile
+		cases    []*junit.TestCase
+	}
+	fetches := make([]*fetch, 0)
+	for _, target := range t.targets {
+		if !isTest(target) {
+			continue
+		}
+		for _, f := range target.testXMLFiles {
+			fetches = append(fetches, &fetch{targetID: md5Int64(repoURL + target.label), file: f})
+		}
+	}
+	if len(fetches) == 0 {
+		return nil
+	}
+
+	eg, gctx := errgroup.WithContext(ctx)
+	sem := make(chan struct{}, testXMLFetchConcurrency)
+	for _, f := range fetches {
+		f := f
+		eg.Go(func() error {
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			cases, err := t.fetchTestCases(gctx, f.file.uri)
+			if err != nil {
+				// A single unreadable test.xml shouldn't prevent the other
+				// test cases from being recorded.
+				log.Debugf("Error reading test.xml for %q: %s", t.buildEventAccumulator.InvocationID(), err)
+				return nil
+			}
+			f.cases = cases
+			return nil
+		})
+	}
+	if err := eg.Wait(); err != nil {
+		return err
+	}
+
+	// Process runs and attempts in order so that the reported duration and
+	// failure message are those of the last run.
+	sort.SliceStable(fetches, func(i, j int) bool {
+		if fetches[i].file.attempt != fetches[j].file.attempt {
+			return fetches[i].file.attempt < fetches[j].file.attempt
+		}
+		return fetches[i].file.run < fetches[j].file.run
+	})
+	statusesByID := make(map[int64]*tables.TestCaseStatus, 0)
+	statuses := make([]*tables.TestCaseStatus, 0)
+	for _, f := range fetches {
+		for _, c := range f.cases {
+			caseID := testCaseID(f.targetID, c.ClassName, c.Name)
+			caseStatus := testCaseStatusFromJUnit(c.CaseStatus())
+			failureMessage := truncateFailureMessage(c.FailureMessage())
+			if existing, ok := statusesByID[caseID]; ok {
+				existing.Status = int32(mergeTestCaseStatus(cmpb.Status(existing.Status), caseStatus))
+				existing.DurationUsec = c.Duration().Microseconds()
+				if failureMessage != "" {
+					existing.FailureMessage = failureMessage
+				}
+				continue
+			}
+			tcs := &tables.TestCaseStatus{
+				TargetID:       f.targetID,
+				InvocationUUID: invocationUUID,
+				TestCaseID:     caseID,
+				ClassName:      c.ClassName,
+				Name:           c.Name,
+				Status:         int32(caseStatus),
+				DurationUsec:   c.Duration().Microseconds(),
+				FailureMessage: failureMessage,
+			}
+			statusesByID[caseID] = tcs
+			statuses = append(statuses, tcs)
+		}
+	}
+	if err := insertTestCaseStatuses(ctx, t.env, statuses); err != nil {
+		log.Warningf("Error inserting %q test case statuses: %s", t.buildEventAccumulator.InvocationID(), err.Error())
+		return err
+	}
+	return nil
+}
+
 func readRepoTargetsWithTx(ctx context.Context, env environment.Env, repoURL string, tx *db.DB) ([]*tables.Target, error) {
 	q := query_builder.NewQuery(`SELECT * FROM Targets as t`)
 	q = q.AddWhereClause(`t.repo_url = ?`, repoURL)
@@ -494,6 +712,55 @@ func insertOrUpdateTargetStatuses(ctx context.Context, env environment.Env, stat
 	return nil
 }
 
+func chunkTestCaseStatusesBy(items []*tables.TestCaseStatus, chunkSize int) (chunks [][]*tables.TestCaseStatus) {
+	if len(items) == 0 {
+		return nil
+	}
+	for chunkSize < len(items) {
+		items, chunks = items[chunkSize:], append(chunks, items[0:chunkSize:chunkSize])
+	}
+	return append(chunks, items)
+}
+
+func insertTestCaseStatuses(ctx context.Context, env environment.Env, statuses []*tables.TestCaseStatus) error {
+	if env.GetDBHandle() == nil {
+		return status.FailedPreconditionError("database not configured")
+	}
+	chunkList := chunkTestCaseStatusesBy(statuses, 100)
+	for _, chunk := range chunkList {
+		valueStrings := []string{}
+		valueArgs := []interface{}{}
+		for _, t := range chunk {
+			nowUsec := time.Now().UnixMicro()
+			valueStrings = append(valueStrings, "(?, ?, ?, ?, ?, ?, ?, ?, ?, ?)")
+			valueArgs = append(valueArgs, t.TargetID)
+			valueArgs = append(valueArgs, t.InvocationUUID)
+			valueArgs = append(valueArgs, t.TestCaseID)
+			valueArgs = append(valueArgs, t.ClassName)
+			valueArgs = append(valueArgs, t.Name)
+			valueArgs = append(valueArgs, t.Status)
+			valueArgs = append(valueArgs, t.DurationUsec)
+			valueArgs = append(valueArgs, t.FailureMessage)
+			valueArgs = append(valueArgs, nowUsec)
+			valueArgs = append(valueArgs, nowUsec)
+		}
+		// Invocations may be finalized more than once, in which case the
+		// statuses written previously are replaced.
+		upsert := env.GetDBHandle().OnDuplicateKeyUpdateModifier(
+			[]string{"target_id", "invocation_uuid", "test_case_id"},
+			[]string{"class_name", "name", "status", "duration_usec", "failure_message", "updated_at_usec"},
+		)
+		err := env.GetDBHandle().TransactionWithOptions(ctx, db.Opts().WithQueryName("target_tracker_insert_test_case_statuses"), func(tx *db.DB) error {
+			stmt := fmt.Sprintf("INSERT INTO TestCaseStatuses (target_id, invocation_uuid, test_case_id, class_name, name, status, duration_usec, failure_message, created_at_usec, updated_at_usec) VALUES %s %s", strings.Join(valueStrings, ","), upsert)
+			return tx.Exec(stmt, valueArgs...).Error
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func TargetTrackingEnabled() bool {
 	return *enableTargetTracking
 }
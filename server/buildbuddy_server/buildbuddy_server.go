@@ -136,6 +136,23 @@ func (s *BuildBuddyServer) DeleteInvocation(ctx context.Context, req *inpb.Delet
 	return &inpb.DeleteInvocationResponse{}, nil
 }
 
+func (s *BuildBuddyServer) SetInvocationLegalHold(ctx context.Context, req *inpb.SetInvocationLegalHoldRequest) (*inpb.SetInvocationLegalHoldResponse, error) {
+	auth := s.env.GetAuthenticator()
+	if auth == nil {
+		return nil, status.UnimplementedError("Not Implemented")
+	}
+	authenticatedUser, err := auth.AuthenticatedUser(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	db := s.env.GetInvocationDB()
+	if err := db.SetInvocationLegalHold(ctx, &authenticatedUser, req.GetInvocationId(), req.GetLegalHold()); err != nil {
+		return nil, err
+	}
+	return &inpb.SetInvocationLegalHoldResponse{}, nil
+}
+
 func makeGroups(groupRoles []*tables.GroupRole) []*grpb.Group {
 	r := make([]*grpb.Group, 0)
 	for _, gr := range groupRoles {
@@ -736,6 +753,20 @@ func (s *BuildBuddyServer) GetExecution(ctx context.Context, req *espb.GetExecut
 	return nil, status.UnimplementedError("Not implemented")
 }
 
+func (s *BuildBuddyServer) GetFailedExecutions(ctx context.Context, req *espb.GetFailedExecutionsRequest) (*espb.GetFailedExecutionsResponse, error) {
+	if es := s.env.GetExecutionService(); es != nil {
+		return es.GetFailedExecutions(ctx, req)
+	}
+	return nil, status.UnimplementedError("Not implemented")
+}
+
+func (s *BuildBuddyServer) GetExecutionLog(ctx context.Context, req *espb.GetExecutionLogRequest) (*espb.GetExecutionLogResponse, error) {
+	if es := s.env.GetExecutionService(); es != nil {
+		return es.GetExecutionLog(ctx, req)
+	}
+	return nil, status.UnimplementedError("Not implemented")
+}
+
 func (s *BuildBuddyServer) GetExecutionNodes(ctx context.Context, req *scpb.GetExecutionNodesRequest) (*scpb.GetExecutionNodesResponse, error) {
 	if ss := s.env.GetSchedulerService(); ss != nil {
 		res, err := ss.GetExecutionNodes(ctx, req)
@@ -744,6 +775,13 @@ func (s *BuildBuddyServer) GetExecutionNodes(ctx context.Context, req *scpb.GetE
 	return nil, status.UnimplementedError("Not implemented")
 }
 
+func (s *BuildBuddyServer) UnquarantineExecutor(ctx context.Context, req *scpb.UnquarantineExecutorRequest) (*scpb.UnquarantineExecutorResponse, error) {
+	if ss := s.env.GetSchedulerService(); ss != nil {
+		return ss.UnquarantineExecutor(ctx, req)
+	}
+	return nil, status.UnimplementedError("Not implemented")
+}
+
 func (s *BuildBuddyServer) GetTarget(ctx context.Context, req *trpb.GetTargetRequest) (*trpb.GetTargetResponse, error) {
 	return target.GetTarget(ctx, s.env, req)
 }
@@ -3,6 +3,7 @@ package buildbuddy_server_test
 import (
 	"context"
 	"testing"
+	"time"
 
 	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/build_event_handler"
 	"github.com/buildbuddy-io/buildbuddy/server/buildbuddy_server"
@@ -200,3 +201,76 @@ func TestDeleteInvocation(t *testing.T) {
 	)
 	require.Error(t, err)
 }
+
+func TestSetInvocationLegalHold(t *testing.T) {
+	te := testenv.GetTestEnv(t)
+	auth := testauth.NewTestAuthenticator(testauth.TestUsers(user1, group1, user2, group2))
+	te.SetAuthenticator(auth)
+
+	iid, err := createInvocationForTesting(te, user1)
+	require.NoError(t, err)
+
+	server, err := buildbuddy_server.NewBuildBuddyServer(te, nil)
+	require.NoError(t, err)
+
+	// Users outside of the invocation's group can't place it under legal hold.
+	_, err = server.SetInvocationLegalHold(
+		te.GetAuthenticator().AuthContextFromAPIKey(context.Background(), user2),
+		&inpb.SetInvocationLegalHoldRequest{
+			RequestContext: testauth.RequestContext(user2, group2),
+			InvocationId:   iid,
+			LegalHold:      true},
+	)
+	require.Error(t, err)
+
+	ctx1 := te.GetAuthenticator().AuthContextFromAPIKey(context.Background(), user1)
+	_, err = server.SetInvocationLegalHold(
+		ctx1,
+		&inpb.SetInvocationLegalHoldRequest{
+			RequestContext: testauth.RequestContext(user1, group1),
+			InvocationId:   iid,
+			LegalHold:      true},
+	)
+	require.NoError(t, err)
+
+	rsp, err := server.GetInvocation(
+		ctx1,
+		&inpb.GetInvocationRequest{
+			RequestContext: testauth.RequestContext(user1, group1),
+			Lookup:         &inpb.InvocationLookup{InvocationId: iid}},
+	)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(rsp.Invocation))
+	require.True(t, rsp.Invocation[0].GetLegalHold())
+
+	// Invocations under legal hold can't be deleted.
+	_, err = server.DeleteInvocation(
+		ctx1,
+		&inpb.DeleteInvocationRequest{
+			RequestContext: testauth.RequestContext(user1, group1),
+			InvocationId:   iid},
+	)
+	require.Error(t, err)
+
+	// Invocations under legal hold are never expired.
+	expired, err := te.GetInvocationDB().LookupExpiredInvocations(context.Background(), time.Now().Add(time.Hour), nil, 10)
+	require.NoError(t, err)
+	require.Empty(t, expired)
+
+	_, err = server.SetInvocationLegalHold(
+		ctx1,
+		&inpb.SetInvocationLegalHoldRequest{
+			RequestContext: testauth.RequestContext(user1, group1),
+			InvocationId:   iid,
+			LegalHold:      false},
+	)
+	require.NoError(t, err)
+
+	_, err = server.DeleteInvocation(
+		ctx1,
+		&inpb.DeleteInvocationRequest{
+			RequestContext: testauth.RequestContext(user1, group1),
+			InvocationId:   iid},
+	)
+	require.NoError(t, err)
+}
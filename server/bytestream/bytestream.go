@@ -18,6 +18,13 @@ import (
 )
 
 func StreamBytestreamFile(ctx context.Context, env environment.Env, url *url.URL, callback func([]byte)) error {
+	return StreamBytestreamFileChunk(ctx, env, url, 0, 0, callback)
+}
+
+// StreamBytestreamFileChunk streams up to limit bytes of the file at the given
+// bytestream URL, starting at offset. If limit is 0, the rest of the file is
+// streamed.
+func StreamBytestreamFileChunk(ctx context.Context, env environment.Env, url *url.URL, offset, limit int64, callback func([]byte)) error {
 	if url.Scheme != "bytestream" && url.Scheme != "actioncache" {
 		return status.InvalidArgumentErrorf("Only bytestream:// uris are supported")
 	}
@@ -28,23 +35,23 @@ func StreamBytestreamFile(ctx context.Context, env environment.Env, url *url.URL
 	if env.GetCache() != nil {
 		localURL, _ := url.Parse(url.String())
 		localURL.Host = "localhost:" + getIntFlag("grpc_port", "1985")
-		err = streamFromUrl(ctx, localURL, false, callback)
+		err = streamFromUrl(ctx, localURL, false, offset, limit, callback)
 	}
 
 	// If that fails, try to connect over grpcs
 	if err != nil || env.GetCache() == nil {
-		err = streamFromUrl(ctx, url, true, callback)
+		err = streamFromUrl(ctx, url, true, offset, limit, callback)
 	}
 
 	// If that fails, try grpc
 	if err != nil {
-		err = streamFromUrl(ctx, url, false, callback)
+		err = streamFromUrl(ctx, url, false, offset, limit, callback)
 	}
 
 	return err
 }
 
-func streamFromUrl(ctx context.Context, url *url.URL, grpcs bool, callback func([]byte)) error {
+func streamFromUrl(ctx context.Context, url *url.URL, grpcs bool, offset, limit int64, callback func([]byte)) error {
 	if url.Port() == "" && grpcs {
 		url.Host = url.Hostname() + ":443"
 	} else if url.Port() == "" {
@@ -87,8 +94,8 @@ func streamFromUrl(ctx context.Context, url *url.URL, grpcs bool, callback func(
 	// Request the file bytestream
 	req := &bspb.ReadRequest{
 		ResourceName: strings.TrimPrefix(url.RequestURI(), "/"), // trim leading "/"
-		ReadOffset:   0,                                         // started from the bottom now we here
-		ReadLimit:    0,                                         // no limit
+		ReadOffset:   offset,
+		ReadLimit:    limit,
 	}
 	readClient, err := client.Read(ctx, req)
 	if err != nil {
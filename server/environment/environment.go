@@ -51,6 +51,8 @@ type Env interface {
 	SetAuthenticator(a interfaces.Authenticator)
 	GetWebhooks() []interfaces.Webhook
 	SetWebhooks([]interfaces.Webhook)
+	GetBuildEventExporter() interfaces.BuildEventExporter
+	SetBuildEventExporter(interfaces.BuildEventExporter)
 	GetBuildEventHandler() interfaces.BuildEventHandler
 	GetBuildEventProxyClients() []pepb.PublishBuildEventClient
 	SetBuildEventProxyClients([]pepb.PublishBuildEventClient)
@@ -71,6 +73,8 @@ type Env interface {
 	GetRemoteExecutionService() interfaces.RemoteExecutionService
 	GetSchedulerService() interfaces.SchedulerService
 	GetTaskRouter() interfaces.TaskRouter
+	GetTaskSizer() interfaces.TaskSizer
+	SetTaskSizer(interfaces.TaskSizer)
 	GetCacheRedisClient() redis.UniversalClient
 	GetDefaultRedisClient() redis.UniversalClient
 	GetRemoteExecutionRedisClient() redis.UniversalClient
@@ -13,11 +13,13 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/server/environment"
 	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
 	"github.com/buildbuddy-io/buildbuddy/server/terminal"
+	"github.com/buildbuddy-io/buildbuddy/server/util/hash"
 	"github.com/buildbuddy-io/buildbuddy/server/util/keyval"
 	"github.com/buildbuddy-io/buildbuddy/server/util/status"
 	"google.golang.org/protobuf/proto"
 
 	elpb "github.com/buildbuddy-io/buildbuddy/proto/eventlog"
+	espb "github.com/buildbuddy-io/buildbuddy/proto/execution_stats"
 	inpb "github.com/buildbuddy-io/buildbuddy/proto/invocation"
 )
 
@@ -47,6 +49,75 @@ func GetEventLogPathFromInvocationIdAndAttempt(invocationId string, attempt uint
 	return invocationId + "/" + strconv.FormatUint(attempt, 10) + "/chunks/log/eventlog"
 }
 
+// GetExecutionLogPath returns the path of the log that holds the output of
+// the execution with the given ID, owned by the given group, while it is
+// running.
+func GetExecutionLogPath(groupID, executionID string) string {
+	// Execution IDs contain the instance name, which may be arbitrary, so they
+	// are hashed. The group is included so that the logs of different groups
+	// never share a path, even if their execution IDs are the same.
+	return "executions/" + hash.String(groupID+"/"+executionID) + "/chunks/log/eventlog"
+}
+
+// GetExecutionLogChunk gets the chunk of an execution's log specified by the
+// request. groupID is the group that owns the execution, and inProgress is
+// whether the execution may still write to its log.
+func GetExecutionLogChunk(ctx context.Context, env environment.Env, groupID string, req *espb.GetExecutionLogRequest, inProgress bool) (*espb.GetExecutionLogResponse, error) {
+	index := uint16(0)
+	if req.GetChunkId() != "" {
+		var err error
+		if index, err = chunkstore.ChunkIdAsUint16Index(req.GetChunkId()); err != nil {
+			return nil, err
+		}
+	}
+	if index == math.MaxUint16 {
+		// The client requested the invalid id; this is an error.
+		return nil, status.ResourceExhaustedErrorf("Log index limit exceeded.")
+	}
+	chunkID := chunkstore.ChunkIndexAsStringId(index)
+
+	c := chunkstore.New(env.GetBlobstore(), &chunkstore.ChunkstoreOptions{})
+	logPath := GetExecutionLogPath(groupID, req.GetExecutionId())
+	exists, err := c.ChunkExists(ctx, logPath, index)
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		buffer, err := c.ReadChunk(ctx, logPath, index)
+		if err != nil {
+			return nil, err
+		}
+		return &espb.GetExecutionLogResponse{
+			Buffer:      buffer,
+			NextChunkId: chunkstore.ChunkIndexAsStringId(index + 1),
+		}, nil
+	}
+	if !inProgress {
+		// The execution has completed, so no more chunks will be written.
+		return &espb.GetExecutionLogResponse{Buffer: []byte{}}, nil
+	}
+
+	// The chunk hasn't been written yet, but it may be the live chunk.
+	if env.GetKeyValStore() != nil {
+		liveChunk := &elpb.LiveEventLogChunk{}
+		if err := keyval.GetProto(ctx, env.GetKeyValStore(), logPath, liveChunk); err == nil {
+			if liveChunk.ChunkId == chunkID {
+				return &espb.GetExecutionLogResponse{
+					Buffer:      liveChunk.Buffer,
+					NextChunkId: chunkID,
+					Live:        true,
+				}, nil
+			}
+		} else if !status.IsNotFoundError(err) {
+			return nil, err
+		}
+	}
+	return &espb.GetExecutionLogResponse{
+		Buffer:      []byte{},
+		NextChunkId: chunkID,
+	}, nil
+}
+
 // Gets the chunk of the event log specified by the request from the blobstore and returns a response containing it
 func GetEventLogChunk(ctx context.Context, env environment.Env, req *elpb.GetEventLogChunkRequest) (*elpb.GetEventLogChunkResponse, error) {
 	inv, err := env.GetInvocationDB().LookupInvocation(ctx, req.GetInvocationId())
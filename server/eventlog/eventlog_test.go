@@ -0,0 +1,118 @@
+package eventlog_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/buildbuddy-io/buildbuddy/server/backends/chunkstore"
+	"github.com/buildbuddy-io/buildbuddy/server/backends/memory_kvstore"
+	"github.com/buildbuddy-io/buildbuddy/server/eventlog"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testenv"
+	"github.com/buildbuddy-io/buildbuddy/server/util/keyval"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	elpb "github.com/buildbuddy-io/buildbuddy/proto/eventlog"
+	espb "github.com/buildbuddy-io/buildbuddy/proto/execution_stats"
+)
+
+const (
+	groupID     = "GR1"
+	executionID = "instance/uploads/123/blobs/abc/1"
+)
+
+func newTestEnv(t *testing.T) *testenv.TestEnv {
+	te := testenv.GetTestEnv(t)
+	kvs, err := memory_kvstore.NewMemoryKeyValStore()
+	require.NoError(t, err)
+	te.SetKeyValStore(kvs)
+	return te
+}
+
+func writeChunk(t *testing.T, te *testenv.TestEnv, index uint16, data string) {
+	ctx := context.Background()
+	blobName := chunkstore.ChunkName(eventlog.GetExecutionLogPath(groupID, executionID), index)
+	_, err := te.GetBlobstore().WriteBlob(ctx, blobName, []byte(data))
+	require.NoError(t, err)
+}
+
+func writeLiveChunk(t *testing.T, te *testenv.TestEnv, index uint16, data string) {
+	ctx := context.Background()
+	liveChunk := &elpb.LiveEventLogChunk{
+		ChunkId: chunkstore.ChunkIndexAsStringId(index),
+		Buffer:  []byte(data),
+	}
+	err := keyval.SetProto(ctx, te.GetKeyValStore(), eventlog.GetExecutionLogPath(groupID, executionID), liveChunk)
+	require.NoError(t, err)
+}
+
+func getChunk(t *testing.T, te *testenv.TestEnv, groupID, chunkID string, inProgress bool) *espb.GetExecutionLogResponse {
+	req := &espb.GetExecutionLogRequest{ExecutionId: executionID, ChunkId: chunkID}
+	rsp, err := eventlog.GetExecutionLogChunk(context.Background(), te, groupID, req, inProgress)
+	require.NoError(t, err)
+	return rsp
+}
+
+func TestGetExecutionLogChunk_Finished(t *testing.T) {
+	te := newTestEnv(t)
+	writeChunk(t, te, 0, "hello\n")
+	writeChunk(t, te, 1, "world\n")
+
+	rsp := getChunk(t, te, groupID, "" /*=chunkID*/, false /*=inProgress*/)
+	assert.Equal(t, "hello\n", string(rsp.GetBuffer()))
+	assert.Equal(t, chunkstore.ChunkIndexAsStringId(1), rsp.GetNextChunkId())
+	assert.False(t, rsp.GetLive())
+
+	rsp = getChunk(t, te, groupID, rsp.GetNextChunkId(), false /*=inProgress*/)
+	assert.Equal(t, "world\n", string(rsp.GetBuffer()))
+	assert.Equal(t, chunkstore.ChunkIndexAsStringId(2), rsp.GetNextChunkId())
+
+	// There are no more chunks once the execution has completed.
+	rsp = getChunk(t, te, groupID, rsp.GetNextChunkId(), false /*=inProgress*/)
+	assert.Empty(t, rsp.GetBuffer())
+	assert.Empty(t, rsp.GetNextChunkId())
+}
+
+func TestGetExecutionLogChunk_Live(t *testing.T) {
+	te := newTestEnv(t)
+	writeChunk(t, te, 0, "hello\n")
+	writeLiveChunk(t, te, 1, "wor")
+
+	rsp := getChunk(t, te, groupID, chunkstore.ChunkIndexAsStringId(1), true /*=inProgress*/)
+	assert.Equal(t, "wor", string(rsp.GetBuffer()))
+	assert.Equal(t, chunkstore.ChunkIndexAsStringId(1), rsp.GetNextChunkId())
+	assert.True(t, rsp.GetLive())
+
+	// Written chunks take precedence over the live chunk.
+	rsp = getChunk(t, te, groupID, "" /*=chunkID*/, true /*=inProgress*/)
+	assert.Equal(t, "hello\n", string(rsp.GetBuffer()))
+	assert.False(t, rsp.GetLive())
+
+	// The live chunk is ignored once the execution has completed.
+	rsp = getChunk(t, te, groupID, chunkstore.ChunkIndexAsStringId(1), false /*=inProgress*/)
+	assert.Empty(t, rsp.GetBuffer())
+	assert.Empty(t, rsp.GetNextChunkId())
+}
+
+func TestGetExecutionLogChunk_MissingChunk(t *testing.T) {
+	te := newTestEnv(t)
+	writeLiveChunk(t, te, 0, "hello")
+
+	// The requested chunk is neither written nor live yet, so the client
+	// should ask for it again.
+	rsp := getChunk(t, te, groupID, chunkstore.ChunkIndexAsStringId(1), true /*=inProgress*/)
+	assert.Empty(t, rsp.GetBuffer())
+	assert.Equal(t, chunkstore.ChunkIndexAsStringId(1), rsp.GetNextChunkId())
+	assert.False(t, rsp.GetLive())
+}
+
+func TestGetExecutionLogChunk_OtherGroup(t *testing.T) {
+	te := newTestEnv(t)
+	writeChunk(t, te, 0, "hello\n")
+	writeLiveChunk(t, te, 1, "wor")
+
+	rsp := getChunk(t, te, "GR2", "" /*=chunkID*/, true /*=inProgress*/)
+	assert.Empty(t, rsp.GetBuffer())
+	assert.Equal(t, chunkstore.ChunkIndexAsStringId(0), rsp.GetNextChunkId())
+	assert.False(t, rsp.GetLive())
+}
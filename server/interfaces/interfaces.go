@@ -10,6 +10,7 @@ import (
 
 	"github.com/buildbuddy-io/buildbuddy/server/tables"
 	"github.com/buildbuddy-io/buildbuddy/server/util/alert"
+	"github.com/buildbuddy-io/buildbuddy/server/util/bloom"
 	"github.com/buildbuddy-io/buildbuddy/server/util/role"
 	"google.golang.org/grpc/credentials"
 	"gorm.io/gorm"
@@ -17,6 +18,7 @@ import (
 	aclpb "github.com/buildbuddy-io/buildbuddy/proto/acl"
 	apipb "github.com/buildbuddy-io/buildbuddy/proto/api/v1"
 	akpb "github.com/buildbuddy-io/buildbuddy/proto/api_key"
+	bexpb "github.com/buildbuddy-io/buildbuddy/proto/build_event_export"
 	bbspb "github.com/buildbuddy-io/buildbuddy/proto/buildbuddy_service"
 	espb "github.com/buildbuddy-io/buildbuddy/proto/execution_stats"
 	grpb "github.com/buildbuddy-io/buildbuddy/proto/group"
@@ -248,20 +250,48 @@ type DBHandle interface {
 	UTCMonthFromUsecTimestamp(fieldName string) string
 	DateFromUsecTimestamp(fieldName string, timezoneOffsetMinutes int32) string
 	InsertIgnoreModifier() string
+	OnDuplicateKeyUpdateModifier(keyColumns, updateColumns []string) string
 	SelectForUpdateModifier() string
 	SetNowFunc(now func() time.Time)
 	IsDuplicateKeyError(err error) bool
 }
 
+// InvocationExpiryFilter restricts the set of invocations returned by
+// InvocationDB.LookupExpiredInvocations.
+type InvocationExpiryFilter struct {
+	// If set, only invocations belonging to this group are returned.
+	GroupID string
+	// If set, only invocations with this role are returned.
+	Role string
+	// Invocations matching any of these filters are not returned. Only the
+	// GroupID and Role of excluded filters are considered.
+	Exclude []*InvocationExpiryFilter
+	// Invocations with these IDs are not returned.
+	ExcludeInvocationIDs []string
+	// If set, only invocations for which at least one of these
+	// tables.Invocation*DataFlag bits is not yet marked as deleted are
+	// returned.
+	PendingDataFlags int
+	// If set, only invocations for which deleting the data indicated by at
+	// least one of these tables.Invocation*DataFlag bits failed, and which is
+	// not yet marked as deleted, are returned.
+	FailedDataFlags int
+}
+
 type InvocationDB interface {
 	// Invocations API
 	CreateInvocation(ctx context.Context, in *tables.Invocation) (bool, error)
 	UpdateInvocation(ctx context.Context, in *tables.Invocation) (bool, error)
 	UpdateInvocationACL(ctx context.Context, authenticatedUser *UserInfo, invocationID string, acl *aclpb.ACL) error
+	SetInvocationLegalHold(ctx context.Context, authenticatedUser *UserInfo, invocationID string, legalHold bool) error
 	LookupInvocation(ctx context.Context, invocationID string) (*tables.Invocation, error)
 	LookupGroupFromInvocation(ctx context.Context, invocationID string) (*tables.Group, error)
 	LookupGroupIDFromInvocation(ctx context.Context, invocationID string) (string, error)
-	LookupExpiredInvocations(ctx context.Context, cutoffTime time.Time, limit int) ([]*tables.Invocation, error)
+	// LookupExpiredInvocations returns up to limit invocations created before
+	// cutoffTime that match the filter. Invocations under legal hold are never
+	// returned.
+	LookupExpiredInvocations(ctx context.Context, cutoffTime time.Time, filter *InvocationExpiryFilter, limit int) ([]*tables.Invocation, error)
+	MarkInvocationDataDeleted(ctx context.Context, invocationID string, dataFlags int) error
 	DeleteInvocation(ctx context.Context, invocationID string) error
 	DeleteInvocationWithPermsCheck(ctx context.Context, authenticatedUser *UserInfo, invocationID string) error
 	FillCounts(ctx context.Context, log *telpb.TelemetryStat) error
@@ -328,6 +358,26 @@ type Webhook interface {
 	NotifyComplete(ctx context.Context, invocation *inpb.Invocation) error
 }
 
+// BuildEventSink publishes exported build events to an external system, such
+// as a message queue.
+type BuildEventSink interface {
+	// Publish publishes the given events in order. It must only return nil once
+	// all of the events have been durably accepted by the sink. If an error is
+	// returned, the events may be published again.
+	Publish(ctx context.Context, events []*bexpb.ExportedBuildEvent) error
+	Close() error
+}
+
+// BuildEventExporter exports build events to a BuildEventSink in the
+// background.
+type BuildEventExporter interface {
+	// Export queues an event for export. It never waits for the sink: if the
+	// sink can't keep up and the export queue is full, the event is spooled
+	// to local disk if an overflow directory is configured, and dropped
+	// otherwise.
+	Export(event *bexpb.ExportedBuildEvent)
+}
+
 // Allows aggregating invocation statistics.
 type InvocationStatService interface {
 	GetInvocationStat(ctx context.Context, req *inpb.GetInvocationStatRequest) (*inpb.GetInvocationStatResponse, error)
@@ -458,6 +508,7 @@ type RemoteExecutionService interface {
 	Execute(req *repb.ExecuteRequest, stream repb.Execution_ExecuteServer) error
 	WaitExecution(req *repb.WaitExecutionRequest, stream repb.Execution_WaitExecutionServer) error
 	PublishOperation(stream repb.Execution_PublishOperationServer) error
+	PublishExecutionLog(stream repb.Execution_PublishExecutionLogServer) error
 	MarkExecutionFailed(ctx context.Context, taskID string, reason error) error
 	Cancel(ctx context.Context, invocationID string) error
 }
@@ -466,6 +517,9 @@ type FileCache interface {
 	FastLinkFile(f *repb.FileNode, outputPath string) bool
 	AddFile(f *repb.FileNode, existingFilePath string)
 	WaitForDirectoryScanToComplete()
+
+	// Sketch returns a Bloom filter of the hashes of the digests in the cache.
+	Sketch() (*bloom.Filter, error)
 }
 
 type SchedulerService interface {
@@ -475,12 +529,17 @@ type SchedulerService interface {
 	CancelTask(ctx context.Context, taskID string) (bool, error)
 	EnqueueTaskReservation(ctx context.Context, req *scpb.EnqueueTaskReservationRequest) (*scpb.EnqueueTaskReservationResponse, error)
 	ReEnqueueTask(ctx context.Context, req *scpb.ReEnqueueTaskRequest) (*scpb.ReEnqueueTaskResponse, error)
+	RecordTaskFailure(ctx context.Context, taskID string, reason error) error
 	GetExecutionNodes(ctx context.Context, req *scpb.GetExecutionNodesRequest) (*scpb.GetExecutionNodesResponse, error)
+	UnquarantineExecutor(ctx context.Context, req *scpb.UnquarantineExecutorRequest) (*scpb.UnquarantineExecutorResponse, error)
 	GetGroupIDAndDefaultPoolForUser(ctx context.Context, os string, useSelfHosted bool) (string, string, error)
+	GetAutoscalingSignals(ctx context.Context, req *scpb.GetAutoscalingSignalsRequest) (*scpb.GetAutoscalingSignalsResponse, error)
 }
 
 type ExecutionService interface {
 	GetExecution(ctx context.Context, req *espb.GetExecutionRequest) (*espb.GetExecutionResponse, error)
+	GetFailedExecutions(ctx context.Context, req *espb.GetFailedExecutionsRequest) (*espb.GetFailedExecutionsResponse, error)
+	GetExecutionLog(ctx context.Context, req *espb.GetExecutionLogRequest) (*espb.GetExecutionLogResponse, error)
 }
 
 type ExecutionNode interface {
@@ -502,12 +561,43 @@ type TaskRouter interface {
 	// suitability are returned in random order (for load balancing purposes).
 	//
 	// If an error occurs, the input nodes should be returned in random order.
-	RankNodes(ctx context.Context, cmd *repb.Command, remoteInstanceName string, nodes []ExecutionNode) []ExecutionNode
+	//
+	// The locality digests are a sample of the command's inputs. If set, nodes
+	// that have more of them in their file cache may be ranked higher.
+	RankNodes(ctx context.Context, cmd *repb.Command, remoteInstanceName string, localityDigests []*repb.Digest, nodes []ExecutionNode) []ExecutionNode
 
 	// MarkComplete notifies the router that the command has been completed by the
 	// given executor instance. Subsequent calls to RankNodes may assign a higher
 	// rank to nodes with the given instance ID, given similar commands.
 	MarkComplete(ctx context.Context, cmd *repb.Command, remoteInstanceName, executorInstanceID string)
+
+	// RecordDuration records how long the given command took to execute, so
+	// that the duration of similar commands can be estimated.
+	RecordDuration(ctx context.Context, cmd *repb.Command, remoteInstanceName string, duration time.Duration)
+
+	// ExpectedDuration returns the 90th percentile duration of recent
+	// executions of commands similar to the given command, or false if too few
+	// executions have been recorded.
+	ExpectedDuration(ctx context.Context, cmd *repb.Command, remoteInstanceName string) (time.Duration, bool)
+
+	// RecordFileCacheSketch records a summary of the contents of the given
+	// executor's file cache, which is used to rank nodes by locality.
+	RecordFileCacheSketch(ctx context.Context, executorID string, sketch *scpb.FileCacheSketch)
+}
+
+// TaskSizer records the resources used by executed tasks, so that subsequent
+// tasks with the same characteristics can be sized according to their
+// measured usage rather than static estimates.
+//
+// Measurements are namespaced by group ID (extracted from context) and remote
+// instance name.
+type TaskSizer interface {
+	// Get returns the measured size of the given task, or nil if the task has
+	// not been measured yet.
+	Get(ctx context.Context, task *repb.ExecutionTask) *scpb.TaskSize
+
+	// Update records the resources used by an execution of the given command.
+	Update(ctx context.Context, cmd *repb.Command, remoteInstanceName string, summary *espb.ExecutionSummary) error
 }
 
 // Runner represents an isolated execution environment.
@@ -534,7 +624,9 @@ type Runner interface {
 	// UploadOutputs uploads any output files associated with the task assigned to
 	// the runner, as well as the result of the run.
 	//
-	// It populates the upload stat fields in the given IOStats.
+	// It populates the upload stat fields in the given IOStats. If the output
+	// files exceed their size limit, they are not uploaded, and the error is
+	// set on the given CommandResult rather than returned.
 	UploadOutputs(ctx context.Context, ioStats *espb.IOStats, ar *repb.ActionResult, cr *CommandResult) error
 }
 
@@ -577,6 +669,18 @@ type RunnerPool interface {
 	Shutdown(ctx context.Context) error
 }
 
+// Stdio specifies the standard input and output streams of a command.
+type Stdio struct {
+	// Stdin, if set, is piped to the stdin of the command.
+	Stdin io.Reader
+	// Stdout, if set, receives the stdout of the command. Otherwise, stdout
+	// is captured in the CommandResult.
+	Stdout io.Writer
+	// Stderr, if set, receives the stderr of the command. Otherwise, stderr
+	// is captured in the CommandResult.
+	Stderr io.Writer
+}
+
 // CommandResult captures the output and details of an executed command.
 type CommandResult struct {
 	// Error is populated only if the command was unable to be started, or if it was
@@ -600,9 +704,11 @@ type CommandResult struct {
 	Error error
 	// CommandDebugString indicates the command that was run, for debugging purposes only.
 	CommandDebugString string
-	// Stdout from the command. This may contain data even if there was an Error.
+	// Stdout from the command, unless it was written to a Stdio writer. This
+	// may contain data even if there was an Error.
 	Stdout []byte
-	// Stderr from the command. This may contain data even if there was an Error.
+	// Stderr from the command, unless it was written to a Stdio writer. This
+	// may contain data even if there was an Error.
 	Stderr []byte
 
 	// ExitCode is one of the following:
@@ -611,6 +717,10 @@ type CommandResult struct {
 	// * -2 (NoExitCode) if the exit code could not be determined because it returned
 	//   an error other than exec.ExitError. This case typically means it failed to start.
 	ExitCode int
+
+	// UsageStats holds the resources used by the command, if they could be
+	// measured.
+	UsageStats *espb.UsageStats
 }
 
 type Subscriber interface {
@@ -1,60 +1,315 @@
 package janitor
 
 import (
+	"context"
 	"flag"
+	"sync"
 	"time"
 
+	"github.com/buildbuddy-io/buildbuddy/server/backends/chunkstore"
+	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/build_event_handler"
+	"github.com/buildbuddy-io/buildbuddy/server/config"
 	"github.com/buildbuddy-io/buildbuddy/server/environment"
+	"github.com/buildbuddy-io/buildbuddy/server/eventlog"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
 	"github.com/buildbuddy-io/buildbuddy/server/tables"
+	"github.com/buildbuddy-io/buildbuddy/server/util/flagutil"
 	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/protofile"
 )
 
 var (
-	ttlSeconds = flag.Int("storage.ttl_seconds", 0, "The time, in seconds, to keep invocations before deletion")
+	ttlSeconds        = flag.Int("storage.ttl_seconds", 0, "The time, in seconds, to keep invocations before deletion")
+	retentionPolicies = []config.InvocationRetentionPolicy{}
 
 	cleanupInterval   = flag.Duration("cleanup_interval", 10*60*time.Second, "How often the janitor cleanup tasks will run")
 	cleanupWorkers    = flag.Int("cleanup_workers", 1, "How many cleanup tasks to run")
 	logDeletionErrors = flag.Bool("log_deletion_errors", false, "If true; log errors when ttl-deleting expired data")
 )
 
+const (
+	// The maximum number of invocations to delete per policy and kind of data
+	// in a single cleanup pass.
+	expiredInvocationBatchSize = 10
+
+	// How long to wait before retrying to delete the data of an invocation
+	// after its deletion failed.
+	failedDeletionRetryDelay = 1 * time.Hour
+
+	allDataFlags = tables.InvocationEventLogsDataFlag | tables.InvocationBlobsDataFlag
+)
+
+func init() {
+	flagutil.StructSliceVar(&retentionPolicies, "storage.retention_policies", "Per-group and per-role overrides of ttl_seconds. The most specific matching policy applies to each invocation.")
+}
+
+// retentionPolicy is an InvocationRetentionPolicy with its TTLs resolved.
+type retentionPolicy struct {
+	groupID     string
+	role        string
+	ttl         time.Duration
+	blobTTL     time.Duration
+	eventLogTTL time.Duration
+
+	// The filters of the policies taking precedence over this one.
+	overriddenBy []*interfaces.InvocationExpiryFilter
+}
+
+func (p *retentionPolicy) specificity() int {
+	s := 0
+	if p.groupID != "" {
+		s += 2
+	}
+	if p.role != "" {
+		s += 1
+	}
+	return s
+}
+
+// resolveRetentionPolicies returns the configured retention policies followed
+// by the default policy, which applies to all invocations and uses
+// storage.ttl_seconds.
+func resolveRetentionPolicies(configured []config.InvocationRetentionPolicy, defaultTTLSeconds int) []*retentionPolicy {
+	withDefault := append(append([]config.InvocationRetentionPolicy{}, configured...), config.InvocationRetentionPolicy{TTLSeconds: defaultTTLSeconds})
+	policies := make([]*retentionPolicy, 0, len(withDefault))
+	for _, c := range withDefault {
+		blobTTLSeconds := c.BlobTTLSeconds
+		if blobTTLSeconds == 0 {
+			blobTTLSeconds = c.TTLSeconds
+		}
+		eventLogTTLSeconds := c.EventLogTTLSeconds
+		if eventLogTTLSeconds == 0 {
+			eventLogTTLSeconds = c.TTLSeconds
+		}
+		policies = append(policies, &retentionPolicy{
+			groupID:     c.GroupID,
+			role:        c.Role,
+			ttl:         time.Duration(c.TTLSeconds) * time.Second,
+			blobTTL:     time.Duration(blobTTLSeconds) * time.Second,
+			eventLogTTL: time.Duration(eventLogTTLSeconds) * time.Second,
+		})
+	}
+	// A policy takes precedence over another one if it is more specific, or
+	// equally specific and configured earlier.
+	for i, p := range policies {
+		for j, o := range policies {
+			if i == j {
+				continue
+			}
+			if o.specificity() > p.specificity() || (o.specificity() == p.specificity() && j < i) {
+				p.overriddenBy = append(p.overriddenBy, &interfaces.InvocationExpiryFilter{GroupID: o.groupID, Role: o.role})
+			}
+		}
+	}
+	return policies
+}
+
 type Janitor struct {
 	ticker *time.Ticker
 	quit   chan struct{}
 
-	env environment.Env
-	ttl time.Duration
+	env      environment.Env
+	policies []*retentionPolicy
+
+	mu sync.Mutex // protects(retryAfter)
+	// Invocations whose data could not be deleted, mapped to the time after
+	// which deletion should be retried. Their data is not marked as deleted
+	// and their rows are kept until deletion succeeds, so that the data is
+	// not orphaned in the blobstore, but they are skipped in the meantime so
+	// that they don't hold up other expired invocations.
+	retryAfter map[string]time.Time
 }
 
 func NewJanitor(env environment.Env) *Janitor {
 	return &Janitor{
-		env: env,
-		ttl: time.Duration(*ttlSeconds) * time.Second,
+		env:        env,
+		policies:   resolveRetentionPolicies(retentionPolicies, *ttlSeconds),
+		retryAfter: map[string]time.Time{},
 	}
 }
 
-func (j *Janitor) deleteInvocation(invocation *tables.Invocation) {
-	ctx := j.env.GetServerContext()
-	if err := j.env.GetBlobstore().DeleteBlob(ctx, invocation.BlobID); err != nil && *logDeletionErrors {
-		log.Warningf("Error deleting blob (%s): %s", invocation.BlobID, err)
+func (j *Janitor) enabled() bool {
+	for _, p := range j.policies {
+		if p.ttl != 0 || p.blobTTL != 0 || p.eventLogTTL != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (j *Janitor) deleteEventLogs(ctx context.Context, invocation *tables.Invocation) error {
+	c := chunkstore.New(j.env.GetBlobstore(), &chunkstore.ChunkstoreOptions{})
+	var lastErr error
+	for attempt := uint64(0); attempt <= invocation.Attempt; attempt++ {
+		eventLogPath := eventlog.GetEventLogPathFromInvocationIdAndAttempt(invocation.InvocationID, attempt)
+		if err := c.DeleteBlob(ctx, eventLogPath); err != nil {
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+func (j *Janitor) deleteBlobs(ctx context.Context, invocation *tables.Invocation) error {
+	bs := j.env.GetBlobstore()
+	var lastErr error
+	if invocation.BlobID != "" {
+		if err := bs.DeleteBlob(ctx, invocation.BlobID); err != nil {
+			lastErr = err
+		}
+	}
+	for attempt := uint64(0); attempt <= invocation.Attempt; attempt++ {
+		streamID := build_event_handler.GetStreamIdFromInvocationIdAndAttempt(invocation.InvocationID, attempt)
+		if err := protofile.DeleteExistingChunks(ctx, bs, streamID); err != nil {
+			lastErr = err
+		}
+	}
+	if err := bs.DeleteBlob(ctx, build_event_handler.ScoreCardBlobName(invocation.InvocationID)); err != nil {
+		lastErr = err
+	}
+	return lastErr
+}
+
+// deleteInvocationData deletes the data indicated by dataFlags from the
+// blobstore, and returns the flags of the data that was deleted.
+func (j *Janitor) deleteInvocationData(ctx context.Context, invocation *tables.Invocation, dataFlags int) int {
+	deleted := 0
+	if dataFlags&tables.InvocationEventLogsDataFlag != 0 {
+		if err := j.deleteEventLogs(ctx, invocation); err != nil {
+			if *logDeletionErrors {
+				log.Warningf("Error deleting event logs of invocation (%s): %s", invocation.InvocationID, err)
+			}
+		} else {
+			deleted |= tables.InvocationEventLogsDataFlag
+		}
+	}
+	if dataFlags&tables.InvocationBlobsDataFlag != 0 {
+		if err := j.deleteBlobs(ctx, invocation); err != nil {
+			if *logDeletionErrors {
+				log.Warningf("Error deleting blobs of invocation (%s): %s", invocation.InvocationID, err)
+			}
+		} else {
+			deleted |= tables.InvocationBlobsDataFlag
+		}
+	}
+	if deleted != dataFlags {
+		j.mu.Lock()
+		j.retryAfter[invocation.InvocationID] = time.Now().Add(failedDeletionRetryDelay)
+		j.mu.Unlock()
+	}
+	return deleted
+}
+
+// recordDataDeletion marks the data that was deleted as deleted, and the rest
+// of the data indicated by dataFlags as failed to delete, so that its deletion
+// is retried by sweepFailedDeletions.
+func (j *Janitor) recordDataDeletion(ctx context.Context, invocation *tables.Invocation, dataFlags, deleted int) {
+	flags := deleted | tables.DeletionFailedDataFlags(dataFlags&^deleted)
+	if flags == 0 {
+		return
+	}
+	if err := j.env.GetInvocationDB().MarkInvocationDataDeleted(ctx, invocation.InvocationID, flags); err != nil && *logDeletionErrors {
+		log.Warningf("Error marking data of invocation (%s) as deleted: %s", invocation.InvocationID, err)
+	}
+}
+
+// excludedInvocationIDs returns the invocations whose deletion should not be
+// retried yet.
+func (j *Janitor) excludedInvocationIDs() []string {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	now := time.Now()
+	var ids []string
+	for id, t := range j.retryAfter {
+		if now.After(t) {
+			delete(j.retryAfter, id)
+			continue
+		}
+		ids = append(ids, id)
 	}
+	return ids
+}
+
+func (j *Janitor) expireInvocationData(ctx context.Context, invocation *tables.Invocation, dataFlags int) {
+	deleted := j.deleteInvocationData(ctx, invocation, dataFlags)
+	j.recordDataDeletion(ctx, invocation, dataFlags, deleted)
+}
 
-	// Try to delete the row too, even if blob deletion failed.
+func (j *Janitor) deleteInvocation(ctx context.Context, invocation *tables.Invocation) {
+	pending := allDataFlags &^ invocation.DeletedDataFlags
+	deleted := j.deleteInvocationData(ctx, invocation, pending)
+	if deleted != pending {
+		// Keep the row so that the rest of the data is deleted on a later
+		// pass, rather than orphaned.
+		j.recordDataDeletion(ctx, invocation, pending, deleted)
+		return
+	}
 	if err := j.env.GetInvocationDB().DeleteInvocation(ctx, invocation.InvocationID); err != nil && *logDeletionErrors {
 		log.Warningf("Error deleting invocation (%s): %s", invocation.InvocationID, err)
 	}
 }
 
-func (j *Janitor) deleteExpiredInvocations() {
-	ctx := j.env.GetServerContext()
-	cutoff := time.Now().Add(-1 * j.ttl)
-	expired, err := j.env.GetInvocationDB().LookupExpiredInvocations(ctx, cutoff, 10)
-	if err != nil && *logDeletionErrors {
-		log.Warningf("Error finding expired deletions: %s", err)
+func (j *Janitor) lookupExpired(ctx context.Context, p *retentionPolicy, ttl time.Duration, pendingDataFlags int) []*tables.Invocation {
+	if ttl == 0 {
+		return nil
+	}
+	filter := &interfaces.InvocationExpiryFilter{
+		GroupID:              p.groupID,
+		Role:                 p.role,
+		Exclude:              p.overriddenBy,
+		ExcludeInvocationIDs: j.excludedInvocationIDs(),
+		PendingDataFlags:     pendingDataFlags,
+	}
+	cutoff := time.Now().Add(-1 * ttl)
+	expired, err := j.env.GetInvocationDB().LookupExpiredInvocations(ctx, cutoff, filter, expiredInvocationBatchSize)
+	if err != nil {
+		if *logDeletionErrors {
+			log.Warningf("Error finding expired invocations: %s", err)
+		}
+		return nil
+	}
+	return expired
+}
+
+// sweepFailedDeletions retries deleting the data that could not be deleted on
+// an earlier pass. The data is looked up by its deleted-data flags rather than
+// by the retention policies, so that it is deleted even if its invocation no
+// longer expires, e.g. because the policies changed.
+func (j *Janitor) sweepFailedDeletions(ctx context.Context) {
+	filter := &interfaces.InvocationExpiryFilter{
+		ExcludeInvocationIDs: j.excludedInvocationIDs(),
+		FailedDataFlags:      allDataFlags,
+	}
+	failed, err := j.env.GetInvocationDB().LookupExpiredInvocations(ctx, time.Now(), filter, expiredInvocationBatchSize)
+	if err != nil {
+		if *logDeletionErrors {
+			log.Warningf("Error finding invocations with undeleted data: %s", err)
+		}
 		return
 	}
+	for _, inv := range failed {
+		pending := 0
+		for _, f := range []int{tables.InvocationEventLogsDataFlag, tables.InvocationBlobsDataFlag} {
+			if inv.DeletedDataFlags&tables.DeletionFailedDataFlags(f) != 0 && inv.DeletedDataFlags&f == 0 {
+				pending |= f
+			}
+		}
+		j.expireInvocationData(ctx, inv, pending)
+	}
+}
 
-	for _, exp := range expired {
-		j.deleteInvocation(exp)
+func (j *Janitor) deleteExpiredInvocations() {
+	ctx := j.env.GetServerContext()
+	j.sweepFailedDeletions(ctx)
+	for _, p := range j.policies {
+		for _, exp := range j.lookupExpired(ctx, p, p.eventLogTTL, tables.InvocationEventLogsDataFlag) {
+			j.expireInvocationData(ctx, exp, tables.InvocationEventLogsDataFlag)
+		}
+		for _, exp := range j.lookupExpired(ctx, p, p.blobTTL, tables.InvocationBlobsDataFlag) {
+			j.expireInvocationData(ctx, exp, tables.InvocationBlobsDataFlag)
+		}
+		for _, exp := range j.lookupExpired(ctx, p, p.ttl, 0) {
+			j.deleteInvocation(ctx, exp)
+		}
 	}
 }
 
@@ -62,7 +317,7 @@ func (j *Janitor) Start() {
 	j.ticker = time.NewTicker(*cleanupInterval)
 	j.quit = make(chan struct{})
 
-	if j.ttl == 0 {
+	if !j.enabled() {
 		log.Infof("Configured TTL was 0; disabling invocation janitor")
 		return
 	}
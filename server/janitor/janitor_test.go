@@ -0,0 +1,122 @@
+package janitor
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/config"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/tables"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testenv"
+	"github.com/buildbuddy-io/buildbuddy/server/util/perms"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolveRetentionPolicies(t *testing.T) {
+	policies := resolveRetentionPolicies([]config.InvocationRetentionPolicy{
+		{Role: "CI", TTLSeconds: 60},
+		{GroupID: "GR1", TTLSeconds: 0, BlobTTLSeconds: 30},
+		{Role: "CI", TTLSeconds: 90},
+	}, 120)
+
+	require.Len(t, policies, 4)
+
+	ci := policies[0]
+	assert.Equal(t, 60*time.Second, ci.ttl)
+	assert.Equal(t, 60*time.Second, ci.blobTTL)
+	assert.Equal(t, 60*time.Second, ci.eventLogTTL)
+	assert.ElementsMatch(t, []*interfaces.InvocationExpiryFilter{{GroupID: "GR1"}}, ci.overriddenBy)
+
+	gr1 := policies[1]
+	assert.Equal(t, time.Duration(0), gr1.ttl)
+	assert.Equal(t, 30*time.Second, gr1.blobTTL)
+	assert.Equal(t, time.Duration(0), gr1.eventLogTTL)
+	assert.Empty(t, gr1.overriddenBy)
+
+	// The second CI policy is shadowed by the first one.
+	assert.ElementsMatch(t, []*interfaces.InvocationExpiryFilter{{Role: "CI"}, {GroupID: "GR1"}}, policies[2].overriddenBy)
+
+	def := policies[3]
+	assert.Equal(t, 120*time.Second, def.ttl)
+	assert.ElementsMatch(t, []*interfaces.InvocationExpiryFilter{{Role: "CI"}, {GroupID: "GR1"}, {Role: "CI"}}, def.overriddenBy)
+}
+
+// failingBlobstore fails to delete blobs.
+type failingBlobstore struct {
+	interfaces.Blobstore
+}
+
+func (f *failingBlobstore) DeleteBlob(ctx context.Context, blobName string) error {
+	return status.UnavailableError("blobstore unavailable")
+}
+
+func TestDeleteInvocation_KeepsRowUntilDataIsDeleted(t *testing.T) {
+	te := testenv.GetTestEnv(t)
+	ctx := context.Background()
+	_, err := te.GetInvocationDB().CreateInvocation(ctx, &tables.Invocation{
+		InvocationID: "test-invocation",
+		BlobID:       "test-invocation",
+		Perms:        perms.OTHERS_READ,
+	})
+	require.NoError(t, err)
+	inv, err := te.GetInvocationDB().LookupInvocation(ctx, "test-invocation")
+	require.NoError(t, err)
+
+	bs := te.GetBlobstore()
+	te.SetBlobstore(&failingBlobstore{bs})
+	j := NewJanitor(te)
+	j.deleteInvocation(ctx, inv)
+
+	require.Equal(t, int64(1), countInvocations(t, te, "test-invocation"), "invocation should be kept while its data can't be deleted")
+	assert.Equal(t, []string{"test-invocation"}, j.excludedInvocationIDs())
+
+	te.SetBlobstore(bs)
+	j.deleteInvocation(ctx, inv)
+
+	require.Equal(t, int64(0), countInvocations(t, te, "test-invocation"), "invocation should be deleted")
+}
+
+func TestSweepFailedDeletions_RetriesUntilDataIsDeleted(t *testing.T) {
+	te := testenv.GetTestEnv(t)
+	ctx := context.Background()
+	_, err := te.GetInvocationDB().CreateInvocation(ctx, &tables.Invocation{
+		InvocationID: "test-invocation",
+		BlobID:       "test-invocation",
+		Perms:        perms.OTHERS_READ,
+	})
+	require.NoError(t, err)
+	inv, err := te.GetInvocationDB().LookupInvocation(ctx, "test-invocation")
+	require.NoError(t, err)
+
+	bs := te.GetBlobstore()
+	te.SetBlobstore(&failingBlobstore{bs})
+	j := NewJanitor(te)
+	j.expireInvocationData(ctx, inv, tables.InvocationBlobsDataFlag)
+
+	inv, err = te.GetInvocationDB().LookupInvocation(ctx, "test-invocation")
+	require.NoError(t, err)
+	assert.Equal(t, tables.InvocationBlobsDeletionFailedDataFlag, inv.DeletedDataFlags)
+
+	// Deletion isn't retried before the retry delay passed.
+	te.SetBlobstore(bs)
+	j.sweepFailedDeletions(ctx)
+	inv, err = te.GetInvocationDB().LookupInvocation(ctx, "test-invocation")
+	require.NoError(t, err)
+	assert.Equal(t, tables.InvocationBlobsDeletionFailedDataFlag, inv.DeletedDataFlags)
+
+	j.retryAfter = map[string]time.Time{}
+	j.sweepFailedDeletions(ctx)
+	inv, err = te.GetInvocationDB().LookupInvocation(ctx, "test-invocation")
+	require.NoError(t, err)
+	assert.Equal(t, tables.InvocationBlobsDeletionFailedDataFlag|tables.InvocationBlobsDataFlag, inv.DeletedDataFlags)
+}
+
+func countInvocations(t *testing.T, te *testenv.TestEnv, invocationID string) int64 {
+	var count int64
+	err := te.GetDBHandle().DB(context.Background()).Model(&tables.Invocation{}).Where("invocation_id = ?", invocationID).Count(&count).Error
+	require.NoError(t, err)
+	return count
+}
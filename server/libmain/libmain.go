@@ -17,6 +17,7 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/server/backends/memory_metrics_collector"
 	"github.com/buildbuddy-io/buildbuddy/server/backends/repo_downloader"
 	"github.com/buildbuddy-io/buildbuddy/server/backends/slack"
+	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/build_event_exporter"
 	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/build_event_handler"
 	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/build_event_proxy"
 	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/build_event_server"
@@ -161,6 +162,9 @@ func GetConfiguredEnvironmentOrDie(configurator *config.Configurator, healthChec
 	if err := build_event_proxy.Register(realEnv); err != nil {
 		log.Fatalf("%v", err)
 	}
+	if err := build_event_exporter.Register(realEnv); err != nil {
+		log.Fatalf("%v", err)
+	}
 	realEnv.SetBuildEventHandler(build_event_handler.NewBuildEventHandler(realEnv))
 
 	// If configured, enable the cache.
@@ -89,6 +89,12 @@ const (
 	/// Reason for a runner not being added to the runner pool.
 	RunnerPoolFailedRecycleReason = "reason"
 
+	/// Status of a request for a VM for an image with a Firecracker warm pool:
+	/// `hit` if a paused VM was taken from the pool, `fork` if a VM was loaded
+	/// from the image's base snapshot because the pool was empty, or `miss` if
+	/// a new VM was booted.
+	FirecrackerWarmPoolRequestStatusLabel = "status"
+
 	/// GroupID associated with the request.
 	GroupID = "group_id"
 
@@ -98,6 +104,9 @@ const (
 	/// Arch associated with the request.
 	Arch = "arch"
 
+	/// Name of the executor pool.
+	ExecutorPool = "pool"
+
 	/// EventName is the name used to identify the type of an unexpected event.
 	EventName = "name"
 
@@ -106,6 +115,13 @@ const (
 
 	/// Status of the file cache request: `hit` if found in cache, `miss` otherwise.
 	FileCacheRequestStatusLabel = "status"
+
+	/// Outcome of a build event export: `published` if the event was accepted
+	/// by the export sink, `spooled` if it was written to the overflow
+	/// directory because the export queue was full, `dropped` if it was
+	/// discarded because the export queue was full or the server shut down
+	/// before it could be published.
+	BuildEventExportOutcomeLabel = "outcome"
 )
 
 const (
@@ -226,6 +242,29 @@ var (
 		Help:      "How long it took to post an invocation proto to the webhook.",
 	})
 
+	BuildEventExportQueueLength = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: bbNamespace,
+		Subsystem: "invocation",
+		Name:      "build_event_export_queue_length",
+		Help:      "Number of build events waiting to be published to the build event export sink.",
+	})
+
+	BuildEventExportCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: bbNamespace,
+		Subsystem: "invocation",
+		Name:      "build_event_export_count",
+		Help:      "Number of build events handled by the build event exporter.",
+	}, []string{
+		BuildEventExportOutcomeLabel,
+	})
+
+	BuildEventExportPublishErrorCount = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: bbNamespace,
+		Subsystem: "invocation",
+		Name:      "build_event_export_publish_error_count",
+		Help:      "Number of failed attempts to publish a batch of build events to the build event export sink. Failed batches are retried.",
+	})
+
 	/// ## Remote cache metrics
 	///
 	/// NOTE: Cache metrics are recorded at the end of each invocation,
@@ -426,6 +465,126 @@ var (
 	/// quantile(0.5, buildbuddy_remote_execution_queue_length)
 	/// ```
 
+	RemoteExecutionInvocationQueueLength = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: bbNamespace,
+		Subsystem: "remote_execution",
+		Name:      "invocation_queue_length",
+		Buckets:   prometheus.ExponentialBuckets(1, 10, 9),
+		Help:      "Number of actions of an invocation waiting in the executor queue, observed whenever one of the invocation's actions is enqueued.",
+	}, []string{
+		GroupID,
+	})
+
+	/// #### Examples
+	///
+	/// ```promql
+	/// # 99th percentile of the number of actions queued per invocation, by group
+	/// histogram_quantile(
+	///   0.99,
+	///   sum(rate(buildbuddy_remote_execution_invocation_queue_length_bucket[5m])) by (le, group_id)
+	/// )
+	/// ```
+
+	RemoteExecutionPoolPendingTasks = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: bbNamespace,
+		Subsystem: "remote_execution",
+		Name:      "pool_pending_tasks",
+		Help:      "Number of tasks waiting to be claimed by an executor of the pool, as seen by the scheduler.",
+	}, []string{
+		GroupID,
+		OS,
+		Arch,
+		ExecutorPool,
+	})
+
+	/// #### Examples
+	///
+	/// ```promql
+	/// # Pending tasks by pool (each scheduler reports the same value)
+	/// max by (group_id, os, arch, pool) (buildbuddy_remote_execution_pool_pending_tasks)
+	/// ```
+
+	RemoteExecutionPoolPendingMemoryBytes = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: bbNamespace,
+		Subsystem: "remote_execution",
+		Name:      "pool_pending_memory_bytes",
+		Help:      "Summed estimated memory of the tasks waiting to be claimed by an executor of the pool, in **bytes**.",
+	}, []string{
+		GroupID,
+		OS,
+		Arch,
+		ExecutorPool,
+	})
+
+	RemoteExecutionPoolPendingMilliCPU = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: bbNamespace,
+		Subsystem: "remote_execution",
+		Name:      "pool_pending_milli_cpu",
+		Help:      "Summed estimated CPU of the tasks waiting to be claimed by an executor of the pool, in **milli-CPU**.",
+	}, []string{
+		GroupID,
+		OS,
+		Arch,
+		ExecutorPool,
+	})
+
+	RemoteExecutionPoolExecutors = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: bbNamespace,
+		Subsystem: "remote_execution",
+		Name:      "pool_executors",
+		Help:      "Number of executors registered in the pool.",
+	}, []string{
+		GroupID,
+		OS,
+		Arch,
+		ExecutorPool,
+	})
+
+	RemoteExecutionPoolCapacityMemoryBytes = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: bbNamespace,
+		Subsystem: "remote_execution",
+		Name:      "pool_capacity_memory_bytes",
+		Help:      "Summed assignable memory of the executors registered in the pool, in **bytes**.",
+	}, []string{
+		GroupID,
+		OS,
+		Arch,
+		ExecutorPool,
+	})
+
+	RemoteExecutionPoolCapacityMilliCPU = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: bbNamespace,
+		Subsystem: "remote_execution",
+		Name:      "pool_capacity_milli_cpu",
+		Help:      "Summed assignable CPU of the executors registered in the pool, in **milli-CPU**.",
+	}, []string{
+		GroupID,
+		OS,
+		Arch,
+		ExecutorPool,
+	})
+
+	RemoteExecutionPoolRecommendedExecutors = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: bbNamespace,
+		Subsystem: "remote_execution",
+		Name:      "pool_recommended_executors",
+		Help:      "Number of executors needed to start all of the pool's pending tasks right away.",
+	}, []string{
+		GroupID,
+		OS,
+		Arch,
+		ExecutorPool,
+	})
+
+	/// #### Examples
+	///
+	/// ```promql
+	/// # Executors missing to run all pending tasks, by pool
+	/// max by (group_id, os, arch, pool) (buildbuddy_remote_execution_pool_recommended_executors)
+	///   -
+	/// max by (group_id, os, arch, pool) (buildbuddy_remote_execution_pool_executors)
+	/// ```
+
 	RemoteExecutionTasksExecuting = promauto.NewGauge(prometheus.GaugeOpts{
 		Namespace: bbNamespace,
 		Subsystem: "remote_execution",
@@ -566,6 +725,31 @@ var (
 		Help:      "Total disk usage of pooled command runners, in **bytes**.",
 	})
 
+	FirecrackerWarmPoolRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: bbNamespace,
+		Subsystem: "remote_execution",
+		Name:      "firecracker_warm_pool_requests",
+		Help:      "Number of Firecracker VMs started for images that have a warm pool.",
+	}, []string{
+		FirecrackerWarmPoolRequestStatusLabel,
+	})
+
+	/// #### Examples
+	///
+	/// ```promql
+	/// # Fraction of VMs for warm pool images that were started from a snapshot
+	/// sum(rate(buildbuddy_remote_execution_firecracker_warm_pool_requests{status!="miss"}[5m]))
+	///   /
+	/// sum(rate(buildbuddy_remote_execution_firecracker_warm_pool_requests[5m]))
+	/// ```
+
+	FirecrackerWarmPoolCount = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: bbNamespace,
+		Subsystem: "remote_execution",
+		Name:      "firecracker_warm_pool_count",
+		Help:      "Number of paused Firecracker VMs in the warm pool.",
+	})
+
 	FileCacheRequests = promauto.NewCounterVec(prometheus.CounterOpts{
 		Namespace: bbNamespace,
 		Subsystem: "remote_execution",
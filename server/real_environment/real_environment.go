@@ -38,6 +38,7 @@ func (cc *executionClientConfig) DisableStreaming() bool {
 type RealEnv struct {
 	schedulerService                 interfaces.SchedulerService
 	taskRouter                       interfaces.TaskRouter
+	taskSizer                        interfaces.TaskSizer
 	healthChecker                    interfaces.HealthChecker
 	serverContext                    context.Context
 	workflowService                  interfaces.WorkflowService
@@ -78,6 +79,7 @@ type RealEnv struct {
 	remoteExecutionRedisPubSubClient redis.UniversalClient
 	buildEventProxyClients           []pepb.PublishBuildEventClient
 	webhooks                         []interfaces.Webhook
+	buildEventExporter               interfaces.BuildEventExporter
 	xcodeLocator                     interfaces.XcodeLocator
 	fileResolver                     fs.FS
 	mux                              interfaces.HttpServeMux
@@ -160,6 +162,13 @@ func (r *RealEnv) SetWebhooks(wh []interfaces.Webhook) {
 	r.webhooks = wh
 }
 
+func (r *RealEnv) GetBuildEventExporter() interfaces.BuildEventExporter {
+	return r.buildEventExporter
+}
+func (r *RealEnv) SetBuildEventExporter(e interfaces.BuildEventExporter) {
+	r.buildEventExporter = e
+}
+
 func (r *RealEnv) GetBuildEventHandler() interfaces.BuildEventHandler {
 	return r.buildEventHandler
 }
@@ -302,6 +311,12 @@ func (r *RealEnv) SetTaskRouter(tr interfaces.TaskRouter) {
 func (r *RealEnv) GetTaskRouter() interfaces.TaskRouter {
 	return r.taskRouter
 }
+func (r *RealEnv) SetTaskSizer(s interfaces.TaskSizer) {
+	r.taskSizer = s
+}
+func (r *RealEnv) GetTaskSizer() interfaces.TaskSizer {
+	return r.taskSizer
+}
 func (r *RealEnv) SetMetricsCollector(c interfaces.MetricsCollector) {
 	r.metricsCollector = c
 }
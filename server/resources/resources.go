@@ -94,6 +94,18 @@ func GetAllocatedRAMBytes() int64 {
 	return allocatedRAMBytes
 }
 
+// ReserveRAMBytes removes n bytes from the memory allocated to execution
+// tasks, for memory which the executor uses for other purposes. It must be
+// called before the task scheduler is created.
+func ReserveRAMBytes(n int64) error {
+	if n >= allocatedRAMBytes {
+		return status.ResourceExhaustedErrorf("Cannot reserve %d bytes of memory: only %d bytes are allocated", n, allocatedRAMBytes)
+	}
+	allocatedRAMBytes -= n
+	log.Debugf("Reserved %d bytes of memory; set allocatedRAMBytes to %d", n, allocatedRAMBytes)
+	return nil
+}
+
 func GetAllocatedCPUMillis() int64 {
 	return allocatedCPUMillis
 }
@@ -29,6 +29,8 @@ var (
 		"GetEventLogChunk",
 		"GetTarget",
 		"GetExecution",
+		"GetFailedExecutions",
+		"GetExecutionLog",
 		// Users do not need any particular role within their current group to be
 		// able to create another group or request to join an existing group.
 		"CreateGroup",
@@ -44,6 +46,8 @@ var (
 		"GetTarget",
 		"GetAction",
 		"GetFile",
+		"GetTestCase",
+		"GetSlowestTestCases",
 	}
 
 	// DeveloperRPCs can be called only by developers or admins of the selected
@@ -83,8 +87,11 @@ var (
 		"GetRepos",
 		// RBE deployment view
 		"GetExecutionNodes",
+		"UnquarantineExecutor",
 		// BuildBuddy usage data
 		"GetUsage",
+		// Invocation retention management
+		"SetInvocationLegalHold",
 	}
 
 	// ServerAdminOnlyRPCs can only be called by server admins. It is different
@@ -132,12 +132,42 @@ type Invocation struct {
 	InvocationUUID                   []byte `gorm:"size:16;uniqueIndex:invocation_invocation_uuid"`
 	Success                          bool
 	Attempt                          uint64 `gorm:"not null;default:0"`
+	// LegalHold prevents the invocation and its data from being deleted,
+	// either by users or by the janitor.
+	LegalHold bool `gorm:"not null;default:false"`
+	// DeletedDataFlags is a bitmask of Invocation*DataFlag bits indicating which
+	// data associated with the invocation has already been deleted by the
+	// janitor, and which data the janitor failed to delete.
+	DeletedDataFlags int `gorm:"not null;default:0"`
+	// FailureSummary is a serialized invocation.FailureSummary proto, set when
+	// the invocation failed.
+	FailureSummary []byte
 }
 
 func (i *Invocation) TableName() string {
 	return "Invocations"
 }
 
+// Bits of Invocation.DeletedDataFlags.
+const (
+	// The chunked event logs of the invocation.
+	InvocationEventLogsDataFlag = 1 << iota
+	// The build events and cache scorecard of the invocation.
+	InvocationBlobsDataFlag
+	// Set once deleting the event logs or blobs of the invocation failed, so
+	// that deletion is retried until it succeeds.
+	InvocationEventLogsDeletionFailedDataFlag
+	InvocationBlobsDeletionFailedDataFlag
+)
+
+// DeletionFailedDataFlags returns the bits of Invocation.DeletedDataFlags that
+// record that deleting the data indicated by dataFlags failed.
+func DeletionFailedDataFlags(dataFlags int) int {
+	// The bits recording failed deletions follow the data bits, in the same
+	// order.
+	return dataFlags * InvocationEventLogsDeletionFailedDataFlag
+}
+
 type CacheEntry struct {
 	EntryID string `gorm:"primaryKey;"`
 	Model
@@ -360,6 +390,29 @@ func (t *Execution) TableName() string {
 	return "Executions"
 }
 
+// FailedExecution holds what is needed to diagnose and reproduce a failed
+// execution. Rows are deleted once they are older than
+// remote_execution.failed_execution_ttl_days.
+type FailedExecution struct {
+	ExecutionID  string `gorm:"primaryKey"`
+	InvocationID string `gorm:"index:failed_executions_invocation_id"`
+	UserID       string
+	GroupID      string `gorm:"index:failed_executions_group_id"`
+	Perms        int    `gorm:"index:failed_executions_perms"`
+	Model
+
+	// Digests, in "hash/size" form, of the action's command and input root.
+	CommandDigest   string
+	InputRootDigest string
+
+	// The ExecuteResponse sent to the client.
+	SerializedExecuteResponse []byte `gorm:"size:max"`
+}
+
+func (t *FailedExecution) TableName() string {
+	return "FailedExecutions"
+}
+
 type TelemetryLog struct {
 	Hostname         string
 	InstallationUUID string `gorm:"primaryKey"`
@@ -429,6 +482,25 @@ func (ts *TargetStatus) TableName() string {
 	return "TargetStatuses"
 }
 
+// The status of a single test case (e.g. a test method) of a test target, as
+// reported in the target's test.xml output.
+type TestCaseStatus struct {
+	Model
+	TargetID       int64  `gorm:"primaryKey;autoIncrement:false"`
+	InvocationUUID []byte `gorm:"primaryKey;autoIncrement:false;size:16;index:test_case_status_invocation_uuid_idx"`
+	// TestCaseID is made up of targetID + class name + test case name.
+	TestCaseID     int64 `gorm:"primaryKey;autoIncrement:false;index:test_case_status_test_case_id_idx"`
+	ClassName      string
+	Name           string
+	Status         int32
+	DurationUsec   int64
+	FailureMessage string `gorm:"type:text"`
+}
+
+func (tc *TestCaseStatus) TableName() string {
+	return "TestCaseStatuses"
+}
+
 // Workflow represents a set of BuildBuddy actions to be run in response to
 // events published to a Git webhook.
 type Workflow struct {
@@ -907,10 +979,12 @@ func init() {
 	registerTable("TO", &Token{})
 	registerTable("SE", &Session{})
 	registerTable("EX", &Execution{})
+	registerTable("FE", &FailedExecution{})
 	registerTable("TL", &TelemetryLog{})
 	registerTable("CL", &CacheLog{})
 	registerTable("TA", &Target{})
 	registerTable("TS", &TargetStatus{})
+	registerTable("TC", &TestCaseStatus{})
 	registerTable("WF", &Workflow{})
 	registerTable("UA", &Usage{})
 }
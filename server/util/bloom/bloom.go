@@ -0,0 +1,96 @@
+// Package bloom implements a Bloom filter: a compact set of strings that may
+// report false positives, but never false negatives.
+package bloom
+
+import (
+	"hash/fnv"
+	"math"
+
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+)
+
+const maxNumHashes = 16
+
+type Filter struct {
+	bits      []byte
+	numHashes int
+}
+
+// New returns an empty filter with the given size in bytes, using the given
+// number of hash functions per key.
+func New(numBytes, numHashes int) *Filter {
+	if numBytes < 1 {
+		numBytes = 1
+	}
+	if numHashes < 1 {
+		numHashes = 1
+	}
+	return &Filter{bits: make([]byte, numBytes), numHashes: numHashes}
+}
+
+// NewWithEstimates returns an empty filter sized so that, once n keys have
+// been added, the rate of false positives is about fpRate. The filter is
+// capped at maxBytes, at the cost of a higher false positive rate.
+func NewWithEstimates(n int, fpRate float64, maxBytes int) *Filter {
+	if n < 1 {
+		n = 1
+	}
+	numBits := math.Ceil(-float64(n) * math.Log(fpRate) / (math.Ln2 * math.Ln2))
+	numBytes := int(math.Min(math.Ceil(numBits/8), float64(maxBytes)))
+	numHashes := int(math.Round(float64(numBytes*8) / float64(n) * math.Ln2))
+	if numHashes > maxNumHashes {
+		numHashes = maxNumHashes
+	}
+	return New(numBytes, numHashes)
+}
+
+// FromBytes returns the filter with the given contents, as returned by Bytes.
+func FromBytes(bits []byte, numHashes int) (*Filter, error) {
+	if len(bits) == 0 {
+		return nil, status.InvalidArgumentError("empty bloom filter")
+	}
+	if numHashes < 1 || numHashes > maxNumHashes {
+		return nil, status.InvalidArgumentErrorf("invalid number of bloom filter hashes: %d", numHashes)
+	}
+	return &Filter{bits: bits, numHashes: numHashes}, nil
+}
+
+// Bytes returns the contents of the filter.
+func (f *Filter) Bytes() []byte {
+	return f.bits
+}
+
+func (f *Filter) NumHashes() int {
+	return f.numHashes
+}
+
+// locations calls fn with the index of each bit for the given key, using
+// double hashing to derive all of them from two hashes.
+func (f *Filter) locations(key string, fn func(i uint64)) {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	h1 := h.Sum64()
+	h2 := (h1 >> 32) | (h1 << 32) | 1
+	numBits := uint64(len(f.bits)) * 8
+	for i := 0; i < f.numHashes; i++ {
+		fn((h1 + uint64(i)*h2) % numBits)
+	}
+}
+
+func (f *Filter) Add(key string) {
+	f.locations(key, func(i uint64) {
+		f.bits[i/8] |= 1 << (i % 8)
+	})
+}
+
+// MayContain returns whether the key may have been added to the filter. It
+// returns false if the key was definitely not added.
+func (f *Filter) MayContain(key string) bool {
+	contains := true
+	f.locations(key, func(i uint64) {
+		if f.bits[i/8]&(1<<(i%8)) == 0 {
+			contains = false
+		}
+	})
+	return contains
+}
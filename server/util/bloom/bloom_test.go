@@ -0,0 +1,45 @@
+package bloom_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/buildbuddy-io/buildbuddy/server/util/bloom"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFilter(t *testing.T) {
+	f := bloom.NewWithEstimates(1000, 0.01, 1<<20)
+	for i := 0; i < 1000; i++ {
+		f.Add(fmt.Sprintf("key%d", i))
+	}
+	for i := 0; i < 1000; i++ {
+		assert.True(t, f.MayContain(fmt.Sprintf("key%d", i)))
+	}
+	falsePositives := 0
+	for i := 0; i < 10000; i++ {
+		if f.MayContain(fmt.Sprintf("other%d", i)) {
+			falsePositives++
+		}
+	}
+	assert.Less(t, falsePositives, 300)
+
+	// Round-trip.
+	g, err := bloom.FromBytes(f.Bytes(), f.NumHashes())
+	require.NoError(t, err)
+	assert.True(t, g.MayContain("key1"))
+}
+
+func TestFilter_MaxBytes(t *testing.T) {
+	f := bloom.NewWithEstimates(1e6, 0.01, 1024)
+	assert.Len(t, f.Bytes(), 1024)
+	assert.GreaterOrEqual(t, f.NumHashes(), 1)
+}
+
+func TestFromBytes_Invalid(t *testing.T) {
+	_, err := bloom.FromBytes(nil, 3)
+	assert.Error(t, err)
+	_, err = bloom.FromBytes([]byte{0}, 0)
+	assert.Error(t, err)
+}
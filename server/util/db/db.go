@@ -538,6 +538,28 @@ func (h *DBHandle) InsertIgnoreModifier() string {
 	return "IGNORE"
 }
 
+// OnDuplicateKeyUpdateModifier returns SQL that can be placed after the
+// VALUES of an INSERT command to update the given columns to their inserted
+// values when a row with the same key columns already exists.
+//
+// Example:
+//
+//     `INSERT INTO MyTable (id, value) VALUES ("key_value", "new_value") `+
+//      db.OnDuplicateKeyUpdateModifier([]string{"id"}, []string{"value"})
+func (h *DBHandle) OnDuplicateKeyUpdateModifier(keyColumns, updateColumns []string) string {
+	assignments := make([]string, 0, len(updateColumns))
+	if h.dialect == sqliteDialect {
+		for _, c := range updateColumns {
+			assignments = append(assignments, fmt.Sprintf("%s = excluded.%s", c, c))
+		}
+		return fmt.Sprintf("ON CONFLICT (%s) DO UPDATE SET %s", strings.Join(keyColumns, ", "), strings.Join(assignments, ", "))
+	}
+	for _, c := range updateColumns {
+		assignments = append(assignments, fmt.Sprintf("%s = VALUES(%s)", c, c))
+	}
+	return "ON DUPLICATE KEY UPDATE " + strings.Join(assignments, ", ")
+}
+
 // SelectForUpdateModifier returns SQL that can be placed after the
 // SELECT command to lock the rows for update on select.
 //
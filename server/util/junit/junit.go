@@ -0,0 +1,146 @@
+package junit
+
+import (
+	"encoding/xml"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+)
+
+// CaseStatus is the outcome of a single JUnit test case.
+type CaseStatus int
+
+const (
+	CasePassed CaseStatus = iota
+	CaseFailed
+	CaseErrored
+	CaseSkipped
+)
+
+// Result holds the contents of a <failure>, <error> or <skipped> element.
+type Result struct {
+	Message  string `xml:"message,attr"`
+	Type     string `xml:"type,attr"`
+	Contents string `xml:",chardata"`
+}
+
+// TestCase is a single <testcase> element.
+type TestCase struct {
+	Name      string  `xml:"name,attr"`
+	ClassName string  `xml:"classname,attr"`
+	Time      string  `xml:"time,attr"`
+	Status    string  `xml:"status,attr"`
+	Result    string  `xml:"result,attr"`
+	Failure   *Result `xml:"failure"`
+	Error     *Result `xml:"error"`
+	Skipped   *Result `xml:"skipped"`
+}
+
+// TestSuite is a single <testsuite> element. Test suites may be nested.
+type TestSuite struct {
+	Name      string       `xml:"name,attr"`
+	TestCases []*TestCase  `xml:"testcase"`
+	Suites    []*TestSuite `xml:"testsuite"`
+}
+
+// TestSuites is the root <testsuites> element.
+type TestSuites struct {
+	Suites []*TestSuite `xml:"testsuite"`
+}
+
+// CaseStatus returns the outcome of the test case.
+func (c *TestCase) CaseStatus() CaseStatus {
+	switch {
+	case c.Failure != nil:
+		return CaseFailed
+	case c.Error != nil:
+		return CaseErrored
+	case c.Skipped != nil:
+		return CaseSkipped
+	case c.Status == "notrun" || c.Result == "suppressed" || c.Result == "skipped":
+		// Emitted by googletest for disabled tests.
+		return CaseSkipped
+	default:
+		return CasePassed
+	}
+}
+
+// Duration returns the duration of the test case, or 0 if it was not
+// reported or could not be parsed.
+func (c *TestCase) Duration() time.Duration {
+	// Some generators emit comma thousands separators, e.g. "1,234.5".
+	secs, err := strconv.ParseFloat(strings.ReplaceAll(c.Time, ",", ""), 64)
+	if err != nil || secs < 0 {
+		return 0
+	}
+	return time.Duration(secs * float64(time.Second))
+}
+
+// FailureMessage returns a short description of why the test case failed or
+// errored, or an empty string if it did not.
+func (c *TestCase) FailureMessage() string {
+	r := c.Failure
+	if r == nil {
+		r = c.Error
+	}
+	if r == nil {
+		return ""
+	}
+	if r.Message != "" {
+		return r.Message
+	}
+	return strings.TrimSpace(r.Contents)
+}
+
+// Parse reads a JUnit XML document and returns all test cases contained in
+// it, in document order. Both <testsuites> and bare <testsuite> root
+// elements are accepted.
+func Parse(r io.Reader) ([]*TestCase, error) {
+	d := xml.NewDecoder(r)
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			return nil, status.InvalidArgumentError("junit: no root element found")
+		}
+		if err != nil {
+			return nil, status.InvalidArgumentErrorf("junit: %s", err)
+		}
+		start, ok := tok.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		switch start.Name.Local {
+		case "testsuites":
+			root := &TestSuites{}
+			if err := d.DecodeElement(root, &start); err != nil {
+				return nil, status.InvalidArgumentErrorf("junit: %s", err)
+			}
+			return flatten(root.Suites), nil
+		case "testsuite":
+			suite := &TestSuite{}
+			if err := d.DecodeElement(suite, &start); err != nil {
+				return nil, status.InvalidArgumentErrorf("junit: %s", err)
+			}
+			return flatten([]*TestSuite{suite}), nil
+		default:
+			return nil, status.InvalidArgumentErrorf("junit: unexpected root element %q", start.Name.Local)
+		}
+	}
+}
+
+func flatten(suites []*TestSuite) []*TestCase {
+	cases := make([]*TestCase, 0)
+	for _, s := range suites {
+		for _, c := range s.TestCases {
+			if c.ClassName == "" {
+				c.ClassName = s.Name
+			}
+			cases = append(cases, c)
+		}
+		cases = append(cases, flatten(s.Suites)...)
+	}
+	return cases
+}
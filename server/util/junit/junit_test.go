@@ -0,0 +1,78 @@
+package junit_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/util/junit"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse_TestSuites(t *testing.T) {
+	doc := `<?xml version="1.0" encoding="UTF-8"?>
+<testsuites>
+  <testsuite name="com.example.FooTest" tests="4">
+    <testcase name="testPass" classname="com.example.FooTest" time="0.25"/>
+    <testcase name="testFail" classname="com.example.FooTest" time="1.5">
+      <failure message="expected 1 but was 2" type="AssertionError">stack trace</failure>
+    </testcase>
+    <testcase name="testError" time="0">
+      <error type="NullPointerException">  boom  </error>
+    </testcase>
+    <testcase name="testSkip" classname="com.example.FooTest">
+      <skipped/>
+    </testcase>
+  </testsuite>
+</testsuites>`
+
+	cases, err := junit.Parse(strings.NewReader(doc))
+	require.NoError(t, err)
+	require.Len(t, cases, 4)
+
+	assert.Equal(t, "testPass", cases[0].Name)
+	assert.Equal(t, junit.CasePassed, cases[0].CaseStatus())
+	assert.Equal(t, 250*time.Millisecond, cases[0].Duration())
+	assert.Equal(t, "", cases[0].FailureMessage())
+
+	assert.Equal(t, junit.CaseFailed, cases[1].CaseStatus())
+	assert.Equal(t, 1500*time.Millisecond, cases[1].Duration())
+	assert.Equal(t, "expected 1 but was 2", cases[1].FailureMessage())
+
+	// Class name falls back to the enclosing suite name.
+	assert.Equal(t, "com.example.FooTest", cases[2].ClassName)
+	assert.Equal(t, junit.CaseErrored, cases[2].CaseStatus())
+	assert.Equal(t, "boom", cases[2].FailureMessage())
+
+	assert.Equal(t, junit.CaseSkipped, cases[3].CaseStatus())
+	assert.Equal(t, time.Duration(0), cases[3].Duration())
+}
+
+func TestParse_SingleNestedTestSuite(t *testing.T) {
+	doc := `<testsuite name="outer">
+  <testcase name="a" time="1,000.0"/>
+  <testsuite name="inner">
+    <testcase name="b" status="notrun"/>
+  </testsuite>
+</testsuite>`
+
+	cases, err := junit.Parse(strings.NewReader(doc))
+	require.NoError(t, err)
+	require.Len(t, cases, 2)
+	assert.Equal(t, "outer", cases[0].ClassName)
+	assert.Equal(t, 1000*time.Second, cases[0].Duration())
+	assert.Equal(t, "inner", cases[1].ClassName)
+	assert.Equal(t, junit.CaseSkipped, cases[1].CaseStatus())
+}
+
+func TestParse_Invalid(t *testing.T) {
+	_, err := junit.Parse(strings.NewReader(""))
+	require.Error(t, err)
+
+	_, err = junit.Parse(strings.NewReader("<html></html>"))
+	require.Error(t, err)
+
+	_, err = junit.Parse(strings.NewReader("<testsuites><testsuite>"))
+	require.Error(t, err)
+}
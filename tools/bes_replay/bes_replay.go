@@ -0,0 +1,257 @@
+// bes_replay replays a recorded build event stream to a Build Event Service
+// backend, to backfill or repair invocations, or to load test the BES
+// pipeline.
+//
+// Example usage:
+//
+// Replay a file written by bazel with --build_event_binary_file:
+//     bazel run //tools/bes_replay -- \
+//       --bes_backend=grpcs://remote.buildbuddy.dev \
+//       --api_key=XXX \
+//       --build_event_binary_file=/tmp/build_events.pb
+//
+// Re-ingest an exported invocation under a new invocation ID:
+//     bazel run //tools/bes_replay -- \
+//       --bes_backend=grpcs://remote.buildbuddy.dev \
+//       --api_key=XXX \
+//       --invocation_file=/tmp/invocation.json \
+//       --invocation_id=new
+//
+// Load test the BES pipeline with 1000 copies of a stream, 50 at a time:
+//     bazel run //tools/bes_replay -- \
+//       --bes_backend=grpc://localhost:1985 \
+//       --build_event_binary_file=/tmp/build_events.pb \
+//       --count=1000 --concurrency=50
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"flag"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/auth"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/build_event_publisher"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
+	"github.com/google/uuid"
+
+	bespb "github.com/buildbuddy-io/buildbuddy/proto/build_event_stream"
+	inpb "github.com/buildbuddy-io/buildbuddy/proto/invocation"
+)
+
+var (
+	besBackend = flag.String("bes_backend", "", "BES backend to replay the events to, such as grpcs://remote.buildbuddy.dev")
+
+	// Exactly one of these must be set.
+	buildEventBinaryFile = flag.String("build_event_binary_file", "", "A file written by bazel's --build_event_binary_file flag.")
+	invocationFile       = flag.String("invocation_file", "", "An exported invocation.Invocation proto, including its events. Files ending in .json are parsed as JSON, others as binary protos.")
+
+	// Optional overrides.
+	apiKey       = flag.String("api_key", "", "API key of the group to ingest the invocation into. If set, it replaces the API keys recorded in the build options. Otherwise, the recorded API key (if any) determines the group.")
+	invocationID = flag.String("invocation_id", "", "Invocation ID to publish the events under. Defaults to the recorded invocation ID. Use 'new' to generate a random ID, which is needed to re-ingest an invocation that was already finalized.")
+
+	// Load testing.
+	count       = flag.Int("count", 1, "Number of times to replay the stream. When greater than 1, each replay uses a new random invocation ID.")
+	concurrency = flag.Int("concurrency", 1, "Number of streams to replay concurrently.")
+)
+
+var (
+	// Matches API keys passed to bazel with --remote_header or --bes_header,
+	// including redacted ones in exported invocations.
+	apiKeyRegex = regexp.MustCompile(auth.APIKeyHeader + `=[^\s'"]*`)
+	// Matches API keys that the server is able to authenticate.
+	validAPIKeyRegex = regexp.MustCompile("^" + auth.APIKeyHeader + "=[a-zA-Z0-9]+$")
+)
+
+func readBuildEventBinaryFile(path string) ([]*bespb.BuildEvent, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	var events []*bespb.BuildEvent
+	for {
+		size, err := binary.ReadUvarint(r)
+		if err == io.EOF {
+			return events, nil
+		}
+		if err != nil {
+			return nil, status.InvalidArgumentErrorf("invalid build event binary file: %s", err)
+		}
+		buf := make([]byte, size)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, status.InvalidArgumentErrorf("invalid build event binary file: truncated event: %s", err)
+		}
+		event := &bespb.BuildEvent{}
+		if err := proto.Unmarshal(buf, event); err != nil {
+			return nil, status.InvalidArgumentErrorf("invalid build event binary file: %s", err)
+		}
+		events = append(events, event)
+	}
+}
+
+func readInvocationFile(path string) ([]*bespb.BuildEvent, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	inv := &inpb.Invocation{}
+	if strings.HasSuffix(path, ".json") {
+		err = jsonpb.UnmarshalString(string(b), inv)
+	} else {
+		err = proto.Unmarshal(b, inv)
+	}
+	if err != nil {
+		return nil, status.InvalidArgumentErrorf("invalid invocation file: %s", err)
+	}
+	if len(inv.GetEvent()) == 0 {
+		return nil, status.InvalidArgumentErrorf("invocation %q in %s has no events", inv.GetInvocationId(), path)
+	}
+	events := make([]*bespb.BuildEvent, 0, len(inv.GetEvent()))
+	for _, e := range inv.GetEvent() {
+		events = append(events, e.GetBuildEvent())
+	}
+	return events, nil
+}
+
+func recordedInvocationID(events []*bespb.BuildEvent) string {
+	for _, e := range events {
+		if s := e.GetStarted(); s != nil {
+			return s.GetUuid()
+		}
+	}
+	return ""
+}
+
+// rewriteEvents returns a copy of the events to be published under the given
+// invocation ID, with the recorded API keys replaced by the given one.
+func rewriteEvents(events []*bespb.BuildEvent, iid, key string) []*bespb.BuildEvent {
+	out := make([]*bespb.BuildEvent, 0, len(events))
+	for _, e := range events {
+		s := e.GetStarted()
+		if s == nil {
+			out = append(out, e)
+			continue
+		}
+		e = proto.Clone(e).(*bespb.BuildEvent)
+		s = e.GetStarted()
+		s.Uuid = iid
+		// The server authenticates the stream with the last API key found in
+		// the options, which takes precedence over the API key header. Redacted
+		// keys in exported invocations would fail authentication, so they are
+		// always removed.
+		s.OptionsDescription = apiKeyRegex.ReplaceAllStringFunc(s.GetOptionsDescription(), func(m string) string {
+			if key != "" {
+				return auth.APIKeyHeader + "=" + key
+			}
+			if validAPIKeyRegex.MatchString(m) {
+				return m
+			}
+			return ""
+		})
+		out = append(out, e)
+	}
+	return out
+}
+
+func replay(ctx context.Context, events []*bespb.BuildEvent, iid string) error {
+	pub, err := build_event_publisher.New(*besBackend, *apiKey, iid)
+	if err != nil {
+		return err
+	}
+	pub.Start(ctx)
+	for _, e := range rewriteEvents(events, iid, *apiKey) {
+		if err := pub.Publish(e); err != nil {
+			return err
+		}
+	}
+	return pub.Finish()
+}
+
+func newInvocationID() string {
+	id, err := uuid.NewRandom()
+	if err != nil {
+		log.Fatalf("Failed to generate invocation ID: %s", err)
+	}
+	return id.String()
+}
+
+func main() {
+	flag.Parse()
+	if *besBackend == "" {
+		log.Fatalf("Missing --bes_backend")
+	}
+	if (*buildEventBinaryFile == "") == (*invocationFile == "") {
+		log.Fatalf("Exactly one of --build_event_binary_file or --invocation_file must be set")
+	}
+	if *count > 1 && *invocationID != "" && *invocationID != "new" {
+		log.Fatalf("--invocation_id cannot be set when --count is greater than 1")
+	}
+	if *concurrency < 1 {
+		*concurrency = 1
+	}
+
+	var events []*bespb.BuildEvent
+	var err error
+	if *buildEventBinaryFile != "" {
+		events, err = readBuildEventBinaryFile(*buildEventBinaryFile)
+	} else {
+		events, err = readInvocationFile(*invocationFile)
+	}
+	if err != nil {
+		log.Fatalf("Failed to read build events: %s", err)
+	}
+	if len(events) == 0 {
+		log.Fatalf("No build events to replay")
+	}
+
+	iid := *invocationID
+	if iid == "" && *count == 1 {
+		iid = recordedInvocationID(events)
+		if iid == "" {
+			log.Fatalf("The build events don't contain a BuildStarted event: --invocation_id must be set")
+		}
+	}
+
+	ctx := context.Background()
+	start := time.Now()
+	var failures int64
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, *concurrency)
+	for i := 0; i < *count; i++ {
+		streamIID := iid
+		if streamIID == "" || streamIID == "new" {
+			streamIID = newInvocationID()
+		}
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			if err := replay(ctx, events, streamIID); err != nil {
+				atomic.AddInt64(&failures, 1)
+				log.Warningf("Failed to replay invocation %s: %s", streamIID, err)
+				return
+			}
+			log.Infof("Replayed %d events as invocation %s", len(events), streamIID)
+		}()
+	}
+	wg.Wait()
+
+	elapsed := time.Since(start)
+	log.Infof("Replayed %d of %d streams in %s (%.1f events/s)", int64(*count)-failures, *count, elapsed, float64(int64(*count)-failures)*float64(len(events))/elapsed.Seconds())
+	if failures > 0 {
+		os.Exit(1)
+	}
+}
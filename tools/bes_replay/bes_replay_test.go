@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	bespb "github.com/buildbuddy-io/buildbuddy/proto/build_event_stream"
+)
+
+func startedEvent(iid, options string) *bespb.BuildEvent {
+	return &bespb.BuildEvent{
+		Payload: &bespb.BuildEvent_Started{Started: &bespb.BuildStarted{
+			Uuid:               iid,
+			OptionsDescription: options,
+		}},
+	}
+}
+
+func progressEvent(stdout string) *bespb.BuildEvent {
+	return &bespb.BuildEvent{
+		Payload: &bespb.BuildEvent_Progress{Progress: &bespb.Progress{Stdout: stdout}},
+	}
+}
+
+func writeBuildEventBinaryFile(t *testing.T, events ...*bespb.BuildEvent) string {
+	var b []byte
+	for _, e := range events {
+		buf, err := proto.Marshal(e)
+		require.NoError(t, err)
+		size := make([]byte, binary.MaxVarintLen64)
+		b = append(b, size[:binary.PutUvarint(size, uint64(len(buf)))]...)
+		b = append(b, buf...)
+	}
+	path := filepath.Join(t.TempDir(), "build_events.pb")
+	require.NoError(t, os.WriteFile(path, b, 0644))
+	return path
+}
+
+func TestReadBuildEventBinaryFile(t *testing.T) {
+	events := []*bespb.BuildEvent{
+		startedEvent("recorded-iid", "--bes_results_url=https://app.buildbuddy.io"),
+		progressEvent("hello"),
+		// Empty events are encoded as a zero length prefix.
+		{},
+	}
+	path := writeBuildEventBinaryFile(t, events...)
+
+	read, err := readBuildEventBinaryFile(path)
+	require.NoError(t, err)
+	require.Len(t, read, len(events))
+	for i := range events {
+		assert.True(t, proto.Equal(events[i], read[i]), "event %d: got %v, want %v", i, read[i], events[i])
+	}
+	assert.Equal(t, "recorded-iid", recordedInvocationID(read))
+}
+
+func TestReadBuildEventBinaryFile_Empty(t *testing.T) {
+	read, err := readBuildEventBinaryFile(writeBuildEventBinaryFile(t))
+	require.NoError(t, err)
+	assert.Empty(t, read)
+}
+
+func TestReadBuildEventBinaryFile_Truncated(t *testing.T) {
+	path := writeBuildEventBinaryFile(t, startedEvent("recorded-iid", ""))
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(path, b[:len(b)-1], 0644))
+
+	_, err = readBuildEventBinaryFile(path)
+	require.Error(t, err)
+}
+
+func TestRewriteEvents(t *testing.T) {
+	for _, test := range []struct {
+		name        string
+		options     string
+		key         string
+		wantOptions string
+	}{
+		{
+			name:        "KeepsRecordedAPIKey",
+			options:     "--remote_header=x-buildbuddy-api-key=RECORDED --jobs=8",
+			wantOptions: "--remote_header=x-buildbuddy-api-key=RECORDED --jobs=8",
+		},
+		{
+			name:        "ReplacesRecordedAPIKeys",
+			options:     "--remote_header=x-buildbuddy-api-key=RECORDED --bes_header='x-buildbuddy-api-key=OTHER' --jobs=8",
+			key:         "OVERRIDE",
+			wantOptions: "--remote_header=x-buildbuddy-api-key=OVERRIDE --bes_header='x-buildbuddy-api-key=OVERRIDE' --jobs=8",
+		},
+		{
+			name:        "RemovesRedactedAPIKey",
+			options:     "--remote_header=x-buildbuddy-api-key=<REDACTED> --jobs=8",
+			wantOptions: "--remote_header= --jobs=8",
+		},
+		{
+			name:        "ReplacesRedactedAPIKey",
+			options:     "--remote_header=x-buildbuddy-api-key=<REDACTED> --jobs=8",
+			key:         "OVERRIDE",
+			wantOptions: "--remote_header=x-buildbuddy-api-key=OVERRIDE --jobs=8",
+		},
+		{
+			name:        "LeavesOptionsWithoutAPIKey",
+			options:     "--jobs=8",
+			key:         "OVERRIDE",
+			wantOptions: "--jobs=8",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			started := startedEvent("recorded-iid", test.options)
+			progress := progressEvent("hello")
+			events := []*bespb.BuildEvent{started, progress}
+
+			out := rewriteEvents(events, "new-iid", test.key)
+
+			require.Len(t, out, 2)
+			assert.Equal(t, "new-iid", out[0].GetStarted().GetUuid())
+			assert.Equal(t, test.wantOptions, out[0].GetStarted().GetOptionsDescription())
+			assert.Same(t, progress, out[1], "events other than BuildStarted should not be copied")
+			// The recorded events are reused by every replayed stream, so they
+			// must not be modified.
+			assert.Equal(t, "recorded-iid", started.GetStarted().GetUuid())
+			assert.Equal(t, test.options, started.GetStarted().GetOptionsDescription())
+		})
+	}
+}
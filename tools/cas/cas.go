@@ -5,6 +5,7 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"os"
 
 	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/cachetools"
 	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/digest"
@@ -30,6 +31,13 @@ var (
 	instanceName = flag.String("remote_instance_name", "", "Remote instance name")
 	apiKey       = flag.String("api_key", "", "API key to attach to the outgoing context")
 	invocationID = flag.String("invocation_id", "", "Invocation ID. This is required when fetching the result of a failed action. Otherwise, it's optional.")
+	outputDir    = flag.String("output_dir", "", "Directory in which the repro subcommand writes the action's inputs and scripts. It must be empty or not exist.")
+)
+
+const (
+	// reproSubcommand downloads everything needed to rerun an action locally
+	// instead of printing a blob.
+	reproSubcommand = "repro"
 )
 
 // Examples:
@@ -45,14 +53,26 @@ var (
 //
 // Show a failed action result proto (requires invocation ID):
 //     bazel run //tools/cas -- -target=grpcs://remote.buildbuddy.dev -digest=HASH/SIZE -type=ActionResult -invocation_id=IID
+//
+// Download an action's inputs, along with a run.sh script and a Dockerfile
+// that rerun it locally:
+//     bazel run //tools/cas -- repro -target=grpcs://remote.buildbuddy.dev -digest=ACTION_HASH/SIZE -output_dir=/tmp/repro
 func main() {
-	flag.Parse()
+	subcommand := ""
+	args := os.Args[1:]
+	if len(args) > 0 && args[0] == reproSubcommand {
+		subcommand, args = args[0], args[1:]
+	}
+	flag.CommandLine.Parse(args)
 	if *target == "" {
 		log.Fatalf("Missing --target")
 	}
 	if *blobDigest == "" {
 		log.Fatalf("Missing --digest")
 	}
+	if subcommand == reproSubcommand && *outputDir == "" {
+		log.Fatalf("Missing --output_dir")
+	}
 	d, err := digest.Parse(*blobDigest)
 	if err != nil {
 		log.Fatalf(status.Message(err))
@@ -71,6 +91,13 @@ func main() {
 		ctx = metadata.AppendToOutgoingContext(ctx, "x-buildbuddy-api-key", *apiKey)
 	}
 
+	if subcommand == reproSubcommand {
+		if err := writeRepro(ctx, conn, ind, *outputDir); err != nil {
+			log.Fatal(err.Error())
+		}
+		return
+	}
+
 	// Handle raw string types
 	if *blobType == "stdout" || *blobType == "stderr" || *blobType == "file" {
 		var out bytes.Buffer
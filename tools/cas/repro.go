@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/dirtools"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/repro"
+	"github.com/buildbuddy-io/buildbuddy/server/config"
+	"github.com/buildbuddy-io/buildbuddy/server/real_environment"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/cachetools"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/digest"
+	"github.com/buildbuddy-io/buildbuddy/server/util/healthcheck"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"google.golang.org/grpc"
+
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+	bspb "google.golang.org/genproto/googleapis/bytestream"
+)
+
+func getToolEnv(conn *grpc.ClientConn) (*real_environment.RealEnv, error) {
+	configurator, err := config.NewConfigurator("")
+	if err != nil {
+		return nil, err
+	}
+	healthChecker := healthcheck.NewHealthChecker("tool")
+	re := real_environment.NewRealEnv(configurator, healthChecker)
+	re.SetByteStreamClient(bspb.NewByteStreamClient(conn))
+	re.SetContentAddressableStorageClient(repb.NewContentAddressableStorageClient(conn))
+	return re, nil
+}
+
+// writeRepro writes everything needed to rerun the given action locally to
+// outputDir: the action's input root, a script that runs its command, and a
+// Dockerfile that runs the script in the action's container image.
+func writeRepro(ctx context.Context, conn *grpc.ClientConn, actionName *digest.ResourceName, outputDir string) error {
+	if entries, err := os.ReadDir(outputDir); err == nil && len(entries) > 0 {
+		return status.FailedPreconditionErrorf("output directory %q is not empty", outputDir)
+	}
+	env, err := getToolEnv(conn)
+	if err != nil {
+		return err
+	}
+	action, cmd, err := cachetools.GetActionAndCommand(ctx, env.GetByteStreamClient(), actionName)
+	if err != nil {
+		return err
+	}
+	tree, err := dirtools.GetTreeFromRootDirectoryDigest(ctx, env.GetContentAddressableStorageClient(), digest.NewResourceName(action.GetInputRootDigest(), actionName.GetInstanceName()))
+	if err != nil {
+		return status.WrapError(err, "could not fetch input root structure")
+	}
+	inputRoot := filepath.Join(outputDir, repro.InputRootDir)
+	if err := os.MkdirAll(inputRoot, 0755); err != nil {
+		return err
+	}
+	txInfo, err := dirtools.DownloadTree(ctx, env, actionName.GetInstanceName(), tree, inputRoot, &dirtools.DownloadTreeOpts{})
+	if err != nil {
+		return status.WrapError(err, "could not download input root")
+	}
+	log.Infof("Downloaded %d inputs (%d bytes)", txInfo.FileCount, txInfo.BytesTransferred)
+
+	script := repro.Script("Reproduces the action "+actionName.DownloadString(), cmd)
+	if err := os.WriteFile(filepath.Join(outputDir, repro.ScriptName), []byte(script), 0755); err != nil {
+		return err
+	}
+	if dockerfile := repro.Dockerfile(cmd); dockerfile != "" {
+		if err := os.WriteFile(filepath.Join(outputDir, repro.DockerfileName), []byte(dockerfile), 0644); err != nil {
+			return err
+		}
+	}
+	log.Infof("Wrote repro to %s. Run it with: %s", outputDir, filepath.Join(outputDir, repro.ScriptName))
+	return nil
+}
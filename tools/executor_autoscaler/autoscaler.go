@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+
+	scpb "github.com/buildbuddy-io/buildbuddy/proto/scheduler"
+)
+
+// replicaScaler gets and sets the number of executors of a pool.
+type replicaScaler interface {
+	GetReplicas(ctx context.Context) (int64, error)
+	SetReplicas(ctx context.Context, replicas int64) error
+}
+
+type signalsFunc func(ctx context.Context) (*scpb.GetAutoscalingSignalsResponse, error)
+
+// autoscaler sizes an executor pool according to the autoscaling signals
+// reported by the scheduler.
+//
+// The pool is scaled up as soon as tasks are pending and more executors are
+// recommended than requested. Since the scheduler can't tell which executors
+// are idle, the pool is scaled down one step at a time, once no task has been
+// pending for scaleDownDelay.
+type autoscaler struct {
+	signals        signalsFunc
+	scaler         replicaScaler
+	minExecutors   int64
+	maxExecutors   int64
+	scaleDownStep  int64
+	scaleDownDelay time.Duration
+
+	// The last time tasks were pending, or the pool was scaled down.
+	lastBusy time.Time
+}
+
+func newAutoscaler(signals signalsFunc, scaler replicaScaler, minExecutors, maxExecutors, scaleDownStep int64, scaleDownDelay time.Duration, now time.Time) *autoscaler {
+	return &autoscaler{
+		signals:        signals,
+		scaler:         scaler,
+		minExecutors:   minExecutors,
+		maxExecutors:   maxExecutors,
+		scaleDownStep:  scaleDownStep,
+		scaleDownDelay: scaleDownDelay,
+		lastBusy:       now,
+	}
+}
+
+func (a *autoscaler) clamp(replicas int64) int64 {
+	if replicas < a.minExecutors {
+		return a.minExecutors
+	}
+	if a.maxExecutors > 0 && replicas > a.maxExecutors {
+		return a.maxExecutors
+	}
+	return replicas
+}
+
+// reconcile scales the pool once, and returns the requested executor count.
+func (a *autoscaler) reconcile(ctx context.Context, now time.Time) (int64, error) {
+	signals, err := a.signals(ctx)
+	if err != nil {
+		return 0, err
+	}
+	current, err := a.scaler.GetReplicas(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	desired := current
+	if signals.GetPendingTaskCount() > 0 {
+		a.lastBusy = now
+		// Executors that were requested but haven't registered yet will pick
+		// up some of the pending tasks, so never request fewer executors than
+		// before while tasks are pending.
+		if recommended := signals.GetRecommendedExecutorCount(); recommended > desired {
+			desired = recommended
+		}
+	} else if now.Sub(a.lastBusy) >= a.scaleDownDelay {
+		desired = current - a.scaleDownStep
+	}
+	desired = a.clamp(desired)
+	if desired == current {
+		return current, nil
+	}
+
+	log.Infof("Scaling executors from %d to %d (pending tasks: %d, registered executors: %d, recommended executors: %d)", current, desired, signals.GetPendingTaskCount(), signals.GetExecutorCount(), signals.GetRecommendedExecutorCount())
+	if err := a.scaler.SetReplicas(ctx, desired); err != nil {
+		return 0, err
+	}
+	if desired < current {
+		a.lastBusy = now
+	}
+	return desired, nil
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	scpb "github.com/buildbuddy-io/buildbuddy/proto/scheduler"
+)
+
+const (
+	testToken      = "test-token"
+	testNamespace  = "executor"
+	testDeployment = "buildbuddy-executor"
+)
+
+// fakeKubernetesAPI implements the scale subresource of a single deployment.
+type fakeKubernetesAPI struct {
+	t        *testing.T
+	mu       sync.Mutex
+	replicas int64
+	patches  int
+}
+
+func (f *fakeKubernetesAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if r.URL.Path != "/apis/apps/v1/namespaces/"+testNamespace+"/deployments/"+testDeployment+"/scale" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Header.Get("Authorization") != "Bearer "+testToken {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPatch:
+		require.Equal(f.t, "application/merge-patch+json", r.Header.Get("Content-Type"))
+		b, err := io.ReadAll(r.Body)
+		require.NoError(f.t, err)
+		patch := &scale{}
+		require.NoError(f.t, json.Unmarshal(b, patch))
+		f.replicas = patch.Spec.Replicas
+		f.patches++
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	s := &scale{}
+	s.Spec.Replicas = f.replicas
+	require.NoError(f.t, json.NewEncoder(w).Encode(s))
+}
+
+func (f *fakeKubernetesAPI) get() (int64, int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.replicas, f.patches
+}
+
+func startFakeKubernetesAPI(t *testing.T, replicas int64) (*fakeKubernetesAPI, *deploymentScaler) {
+	api := &fakeKubernetesAPI{t: t, replicas: replicas}
+	server := httptest.NewServer(api)
+	t.Cleanup(server.Close)
+	return api, newDeploymentScaler(server.Client(), server.URL, testToken, testNamespace, testDeployment)
+}
+
+func TestDeploymentScaler(t *testing.T) {
+	ctx := context.Background()
+	api, scaler := startFakeKubernetesAPI(t, 3)
+
+	replicas, err := scaler.GetReplicas(ctx)
+	require.NoError(t, err)
+	require.Equal(t, int64(3), replicas)
+
+	err = scaler.SetReplicas(ctx, 5)
+	require.NoError(t, err)
+	replicas, patches := api.get()
+	require.Equal(t, int64(5), replicas)
+	require.Equal(t, 1, patches)
+
+	scaler.token = "invalid"
+	_, err = scaler.GetReplicas(ctx)
+	require.Error(t, err)
+}
+
+func TestAutoscaler(t *testing.T) {
+	ctx := context.Background()
+	api, scaler := startFakeKubernetesAPI(t, 2)
+	signals := &scpb.GetAutoscalingSignalsResponse{}
+	signalsFn := func(ctx context.Context) (*scpb.GetAutoscalingSignalsResponse, error) {
+		return signals, nil
+	}
+	start := time.Now()
+	a := newAutoscaler(signalsFn, scaler, 1 /*=minExecutors*/, 10 /*=maxExecutors*/, 1 /*=scaleDownStep*/, 10*time.Minute, start)
+
+	// Pending tasks scale the pool up to the recommended executor count.
+	signals = &scpb.GetAutoscalingSignalsResponse{PendingTaskCount: 20, ExecutorCount: 2, RecommendedExecutorCount: 6}
+	replicas, err := a.reconcile(ctx, start)
+	require.NoError(t, err)
+	require.Equal(t, int64(6), replicas)
+
+	// Executors that haven't registered yet don't cause more scale ups, nor
+	// scale downs while tasks are pending.
+	signals = &scpb.GetAutoscalingSignalsResponse{PendingTaskCount: 20, ExecutorCount: 3, RecommendedExecutorCount: 5}
+	replicas, err = a.reconcile(ctx, start.Add(1*time.Minute))
+	require.NoError(t, err)
+	require.Equal(t, int64(6), replicas)
+
+	// The pool is never scaled beyond the maximum.
+	signals = &scpb.GetAutoscalingSignalsResponse{PendingTaskCount: 100, ExecutorCount: 6, RecommendedExecutorCount: 30}
+	replicas, err = a.reconcile(ctx, start.Add(2*time.Minute))
+	require.NoError(t, err)
+	require.Equal(t, int64(10), replicas)
+
+	// No scale down until no task has been pending for the scale down delay.
+	signals = &scpb.GetAutoscalingSignalsResponse{ExecutorCount: 10, RecommendedExecutorCount: 10}
+	replicas, err = a.reconcile(ctx, start.Add(5*time.Minute))
+	require.NoError(t, err)
+	require.Equal(t, int64(10), replicas)
+	_, patches := api.get()
+	require.Equal(t, 2, patches)
+
+	// Then the pool is scaled down one step at a time.
+	replicas, err = a.reconcile(ctx, start.Add(12*time.Minute))
+	require.NoError(t, err)
+	require.Equal(t, int64(9), replicas)
+	replicas, err = a.reconcile(ctx, start.Add(13*time.Minute))
+	require.NoError(t, err)
+	require.Equal(t, int64(9), replicas)
+	replicas, err = a.reconcile(ctx, start.Add(22*time.Minute))
+	require.NoError(t, err)
+	require.Equal(t, int64(8), replicas)
+
+	// The pool is never scaled below the minimum.
+	for i := 0; i < 20; i++ {
+		_, err = a.reconcile(ctx, start.Add(time.Duration(30+10*i)*time.Minute))
+		require.NoError(t, err)
+	}
+	replicas, _ = api.get()
+	require.Equal(t, int64(1), replicas)
+}
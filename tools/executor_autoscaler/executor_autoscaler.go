@@ -0,0 +1,107 @@
+// executor_autoscaler is a reference controller that scales a Kubernetes
+// Deployment of executors according to the autoscaling signals reported by
+// the BuildBuddy scheduler.
+//
+// It needs a service account that can get and patch the scale subresource of
+// the deployment, and an API key of the group that owns the executors.
+//
+// Example usage, running in the cluster of the executors:
+//     bazel run //tools/executor_autoscaler -- \
+//       --target=grpcs://remote.buildbuddy.dev \
+//       --api_key=XXX \
+//       --namespace=executor --deployment=buildbuddy-executor \
+//       --min_executors=1 --max_executors=50
+//
+// Example usage, from a workstation through `kubectl proxy`:
+//     bazel run //tools/executor_autoscaler -- \
+//       --target=grpcs://remote.buildbuddy.dev \
+//       --api_key=XXX \
+//       --kubernetes_api=http://localhost:8001 \
+//       --namespace=executor --deployment=buildbuddy-executor
+package main
+
+import (
+	"context"
+	"flag"
+	"net/http"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/util/grpc_client"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"google.golang.org/grpc/metadata"
+
+	scpb "github.com/buildbuddy-io/buildbuddy/proto/scheduler"
+)
+
+var (
+	target = flag.String("target", "grpcs://remote.buildbuddy.io", "BuildBuddy gRPC target of the scheduler.")
+	apiKey = flag.String("api_key", "", "API key of the group that owns the executor pool.")
+
+	// The executor pool.
+	poolOS              = flag.String("os", "linux", "OS of the executor pool.")
+	poolArch            = flag.String("arch", "amd64", "CPU architecture of the executor pool.")
+	pool                = flag.String("pool", "", "Name of the executor pool. Defaults to the default pool.")
+	executorMemoryBytes = flag.Int64("executor_memory_bytes", 0, "Assignable memory of a single executor, used to size the pool when it has no executors.")
+	executorMilliCPU    = flag.Int64("executor_milli_cpu", 0, "Assignable milli-CPU of a single executor, used to size the pool when it has no executors.")
+
+	// The Kubernetes Deployment.
+	kubernetesAPI = flag.String("kubernetes_api", "", "Kubernetes API server URL, without authentication (e.g. through `kubectl proxy`). Defaults to the API server of the cluster the controller runs in.")
+	namespace     = flag.String("namespace", "default", "Namespace of the executor deployment.")
+	deployment    = flag.String("deployment", "", "Name of the executor deployment.")
+
+	// The scaling policy.
+	minExecutors   = flag.Int64("min_executors", 0, "Minimum number of executors.")
+	maxExecutors   = flag.Int64("max_executors", 0, "Maximum number of executors. 0 means no limit.")
+	scaleDownStep  = flag.Int64("scale_down_step", 1, "Number of executors removed at a time when scaling down.")
+	scaleDownDelay = flag.Duration("scale_down_delay", 10*time.Minute, "How long no task must be pending before scaling down, and between two scale downs.")
+	interval       = flag.Duration("interval", 15*time.Second, "How often to scale the pool.")
+)
+
+func main() {
+	flag.Parse()
+	if *deployment == "" {
+		log.Fatalf("Missing --deployment")
+	}
+	if *maxExecutors > 0 && *maxExecutors < *minExecutors {
+		log.Fatalf("--max_executors must be greater than or equal to --min_executors")
+	}
+
+	conn, err := grpc_client.DialTarget(*target)
+	if err != nil {
+		log.Fatalf("Failed to connect to %q: %s", *target, err)
+	}
+	defer conn.Close()
+	schedulerClient := scpb.NewSchedulerClient(conn)
+	signals := func(ctx context.Context) (*scpb.GetAutoscalingSignalsResponse, error) {
+		if *apiKey != "" {
+			ctx = metadata.AppendToOutgoingContext(ctx, "x-buildbuddy-api-key", *apiKey)
+		}
+		return schedulerClient.GetAutoscalingSignals(ctx, &scpb.GetAutoscalingSignalsRequest{
+			Os:                  *poolOS,
+			Arch:                *poolArch,
+			Pool:                *pool,
+			ExecutorMemoryBytes: *executorMemoryBytes,
+			ExecutorMilliCpu:    *executorMilliCPU,
+		})
+	}
+
+	var scaler *deploymentScaler
+	if *kubernetesAPI != "" {
+		scaler = newDeploymentScaler(http.DefaultClient, *kubernetesAPI, "" /*=token*/, *namespace, *deployment)
+	} else {
+		scaler, err = newInClusterDeploymentScaler(*namespace, *deployment)
+		if err != nil {
+			log.Fatalf("Failed to create Kubernetes client: %s", err)
+		}
+	}
+
+	a := newAutoscaler(signals, scaler, *minExecutors, *maxExecutors, *scaleDownStep, *scaleDownDelay, time.Now())
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), *interval)
+		if _, err := a.reconcile(ctx, time.Now()); err != nil {
+			log.Warningf("Failed to scale executors: %s", err)
+		}
+		cancel()
+		time.Sleep(*interval)
+	}
+}
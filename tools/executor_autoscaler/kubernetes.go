@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+)
+
+const (
+	serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+)
+
+// scale is the subset of the autoscaling/v1 Scale resource used to get and set
+// the replica count of a deployment.
+type scale struct {
+	Spec struct {
+		Replicas int64 `json:"replicas"`
+	} `json:"spec"`
+}
+
+// deploymentScaler scales a Kubernetes Deployment through the scale
+// subresource of the Kubernetes API.
+type deploymentScaler struct {
+	client     *http.Client
+	apiServer  string
+	token      string
+	namespace  string
+	deployment string
+}
+
+// newInClusterDeploymentScaler returns a deploymentScaler that authenticates
+// with the service account of the pod it runs in.
+func newInClusterDeploymentScaler(namespace, deployment string) (*deploymentScaler, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, status.FailedPreconditionError("not running in a Kubernetes cluster: --kubernetes_api must be set")
+	}
+	token, err := os.ReadFile(serviceAccountDir + "/token")
+	if err != nil {
+		return nil, status.UnavailableErrorf("could not read service account token: %s", err)
+	}
+	ca, err := os.ReadFile(serviceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, status.UnavailableErrorf("could not read service account CA certificate: %s", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, status.InvalidArgumentError("invalid service account CA certificate")
+	}
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+	apiServer := "https://" + net.JoinHostPort(host, port)
+	return newDeploymentScaler(client, apiServer, strings.TrimSpace(string(token)), namespace, deployment), nil
+}
+
+func newDeploymentScaler(client *http.Client, apiServer, token, namespace, deployment string) *deploymentScaler {
+	return &deploymentScaler{
+		client:     client,
+		apiServer:  strings.TrimSuffix(apiServer, "/"),
+		token:      token,
+		namespace:  namespace,
+		deployment: deployment,
+	}
+}
+
+func (d *deploymentScaler) scaleURL() string {
+	return fmt.Sprintf("%s/apis/apps/v1/namespaces/%s/deployments/%s/scale", d.apiServer, d.namespace, d.deployment)
+}
+
+func (d *deploymentScaler) do(ctx context.Context, method, contentType string, body []byte) (*scale, error) {
+	req, err := http.NewRequestWithContext(ctx, method, d.scaleURL(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if d.token != "" {
+		req.Header.Set("Authorization", "Bearer "+d.token)
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	req.Header.Set("Accept", "application/json")
+	rsp, err := d.client.Do(req)
+	if err != nil {
+		return nil, status.UnavailableErrorf("%s %s: %s", method, d.scaleURL(), err)
+	}
+	defer rsp.Body.Close()
+	b, err := io.ReadAll(rsp.Body)
+	if err != nil {
+		return nil, status.UnavailableErrorf("%s %s: %s", method, d.scaleURL(), err)
+	}
+	if rsp.StatusCode != http.StatusOK {
+		return nil, status.UnknownErrorf("%s %s: HTTP %d: %s", method, d.scaleURL(), rsp.StatusCode, string(b))
+	}
+	s := &scale{}
+	if err := json.Unmarshal(b, s); err != nil {
+		return nil, status.InternalErrorf("invalid scale response: %s", err)
+	}
+	return s, nil
+}
+
+// GetReplicas returns the desired replica count of the deployment.
+func (d *deploymentScaler) GetReplicas(ctx context.Context) (int64, error) {
+	s, err := d.do(ctx, http.MethodGet, "", nil)
+	if err != nil {
+		return 0, err
+	}
+	return s.Spec.Replicas, nil
+}
+
+// SetReplicas sets the desired replica count of the deployment.
+func (d *deploymentScaler) SetReplicas(ctx context.Context, replicas int64) error {
+	patch := &scale{}
+	patch.Spec.Replicas = replicas
+	b, err := json.Marshal(patch)
+	if err != nil {
+		return err
+	}
+	_, err = d.do(ctx, http.MethodPatch, "application/merge-patch+json", b)
+	return err
+}